@@ -0,0 +1,393 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"xylitol4/internal/config"
+	"xylitol4/sip"
+)
+
+// fileSettings are the parts of the configuration file that no flag
+// expresses: trunk accounts as [[trunk]] tables, DID routes as a [dids]
+// table of number = "user@domain", transaction timers as a [timers] table,
+// the dial plan as [[route]] tables in the order they are tried, and the
+// header manipulation pipeline as [[header-rule]] tables in the order they
+// run.
+type fileSettings struct {
+	trunks  []sip.TrunkConfig
+	dids    map[string]string
+	timers  sip.TimerConfig
+	routes  []sip.RouteRule
+	headers []sip.HeaderRule
+}
+
+// reloadable are the settings SIGHUP and POST /api/v1/reload change on a
+// running proxy.
+type reloadable struct {
+	level slog.Level
+	stack sip.ReloadConfig
+}
+
+// loadConfig reads the configuration file at path, or an empty configuration
+// when path is empty, and checks that it names only known settings.
+func loadConfig(path string) (*config.Table, fileSettings, error) {
+	root, err := config.Parse(nil)
+	if path != "" {
+		root, err = config.Load(path)
+	}
+	if err != nil {
+		return nil, fileSettings{}, err
+	}
+	// --config and --validate say how to run, so the file cannot set them.
+	for _, key := range root.Keys {
+		if flag.Lookup(key) == nil || key == "config" || key == "validate" {
+			return nil, fileSettings{}, &config.Error{Line: root.Values[key].Line, Msg: fmt.Sprintf("unknown setting %q", key)}
+		}
+	}
+	for name, table := range root.Tables {
+		if name != "dids" && name != "timers" {
+			return nil, fileSettings{}, &config.Error{Line: table.Line, Msg: fmt.Sprintf("unknown table [%s]", name)}
+		}
+	}
+	for name, tables := range root.Arrays {
+		if name != "trunk" && name != "route" && name != "header-rule" {
+			return nil, fileSettings{}, &config.Error{Line: tables[0].Line, Msg: fmt.Sprintf("unknown table [[%s]]", name)}
+		}
+	}
+	settings, err := readFileSettings(root)
+	if err != nil {
+		return nil, fileSettings{}, err
+	}
+	return root, settings, nil
+}
+
+// commandLineFlags returns the names of the flags given on the command line.
+// Settings from the file are stored without marking their flags as set.
+func commandLineFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// settingTexts returns the values to set flag f to for a setting of the file:
+// each element of an array for a repeatable flag, the comma-separated
+// elements for any other flag, or the scalar.
+func settingTexts(f *flag.Flag, value config.Value) []string {
+	if !value.IsList {
+		return []string{value.Text}
+	}
+	if _, repeatable := f.Value.(*stringList); repeatable {
+		return value.List
+	}
+	return []string{strings.Join(value.List, ",")}
+}
+
+// applyConfig sets every flag not given on the command line from the
+// top-level setting of the same name.
+func applyConfig(root *config.Table) error {
+	explicit := commandLineFlags()
+	for _, key := range root.Keys {
+		if explicit[key] {
+			continue
+		}
+		value := root.Values[key]
+		f := flag.Lookup(key)
+		for _, text := range settingTexts(f, value) {
+			if err := f.Value.Set(text); err != nil {
+				return &config.Error{Line: value.Line, Msg: fmt.Sprintf("invalid %s: %v", key, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// readReloadable gathers the reloadable settings as startup does. Each flag
+// takes its value from the command line, else from root, else its default,
+// since a reload must not keep a setting removed from the file. The file's
+// [[trunk]] and [dids] tables add to the trunks and DID routes of the flags,
+// and a nonzero --timer-* flag overrides the same timer of the [timers] table.
+func readReloadable(root *config.Table, settings fileSettings) (reloadable, error) {
+	explicit := commandLineFlags()
+	setting := func(name string) []string {
+		f := flag.Lookup(name)
+		_, repeatable := f.Value.(*stringList)
+		switch value, inFile := root.Lookup(name); {
+		case explicit[name] && repeatable:
+			return *f.Value.(*stringList)
+		case explicit[name]:
+			return []string{f.Value.String()}
+		case inFile:
+			return settingTexts(f, value)
+		case repeatable:
+			return nil
+		}
+		return []string{f.DefValue}
+	}
+
+	var r reloadable
+	level := setting("log-level")[0]
+	if err := r.level.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+		return r, fmt.Errorf("invalid --log-level %q: use debug, info, warn, or error", level)
+	}
+	for _, spec := range setting("trunk") {
+		trunk, err := sip.ParseTrunk(spec)
+		if err != nil {
+			return r, fmt.Errorf("invalid --trunk: %w", err)
+		}
+		r.stack.Trunks = append(r.stack.Trunks, trunk)
+	}
+	r.stack.Trunks = append(r.stack.Trunks, settings.trunks...)
+	dids, err := parseDIDs(strings.Join(setting("trunk-did"), ","))
+	if err != nil {
+		return r, fmt.Errorf("invalid --trunk-did: %w", err)
+	}
+	for number, target := range settings.dids {
+		if _, ok := dids[number]; !ok {
+			dids[number] = target
+		}
+	}
+	r.stack.TrunkDIDs = dids
+	r.stack.Timers = settings.timers
+	r.stack.Routes = settings.routes
+	r.stack.HeaderRules = settings.headers
+	r.stack.Emergency.Numbers = strings.Split(setting("emergency-numbers")[0], ",")
+	r.stack.Emergency.Route = setting("emergency-route")[0]
+	r.stack.Identity.TrustedPeers = strings.Split(setting("trusted-peers")[0], ",")
+	hiding := setting("topology-hiding")[0]
+	if r.stack.TopologyHiding, err = strconv.ParseBool(strings.TrimSpace(hiding)); err != nil {
+		return r, fmt.Errorf("invalid --topology-hiding %q: use true or false", hiding)
+	}
+	diversion := setting("diversion")[0]
+	if r.stack.Diversion, err = strconv.ParseBool(strings.TrimSpace(diversion)); err != nil {
+		return r, fmt.Errorf("invalid --diversion %q: use true or false", diversion)
+	}
+	r.stack.ENUM.Suffixes = strings.Split(setting("enum")[0], ",")
+	r.stack.ENUM.Resolver = setting("enum-resolver")[0]
+	enumDurations := map[string]*time.Duration{
+		"enum-timeout":   &r.stack.ENUM.Timeout,
+		"enum-cache-ttl": &r.stack.ENUM.CacheTTL,
+	}
+	for name, field := range enumDurations {
+		text := setting(name)[0]
+		d, err := time.ParseDuration(strings.TrimSpace(text))
+		if err != nil || d <= 0 {
+			return r, fmt.Errorf("invalid --%s %q: use a positive duration", name, text)
+		}
+		*field = d
+	}
+	timers := map[string]*time.Duration{
+		"timer-t1": &r.stack.Timers.T1,
+		"timer-t2": &r.stack.Timers.T2,
+		"timer-t4": &r.stack.Timers.T4,
+		"timer-c":  &r.stack.Timers.TimerC,
+	}
+	for name, field := range timers {
+		text := setting(name)[0]
+		d, err := time.ParseDuration(strings.TrimSpace(text))
+		if err != nil {
+			return r, fmt.Errorf("invalid --%s %q: %v", name, text, err)
+		}
+		if d != 0 {
+			*field = d
+		}
+	}
+	return r, nil
+}
+
+// readFileSettings reads the configuration file's tables.
+func readFileSettings(root *config.Table) (fileSettings, error) {
+	var settings fileSettings
+	for _, table := range root.Arrays["trunk"] {
+		trunk, err := readTrunk(table)
+		if err != nil {
+			return settings, err
+		}
+		settings.trunks = append(settings.trunks, trunk)
+	}
+	if table, ok := root.Tables["dids"]; ok {
+		settings.dids = make(map[string]string, len(table.Keys))
+		for _, number := range table.Keys {
+			value := table.Values[number]
+			if value.IsList || value.Text == "" {
+				return settings, &config.Error{Line: value.Line, Msg: fmt.Sprintf("DID %s must name one user@domain", number)}
+			}
+			settings.dids[number] = value.Text
+		}
+	}
+	for _, table := range root.Arrays["route"] {
+		route, err := readRoute(table)
+		if err != nil {
+			return settings, err
+		}
+		settings.routes = append(settings.routes, route)
+	}
+	for _, table := range root.Arrays["header-rule"] {
+		rule, err := readHeaderRule(table)
+		if err != nil {
+			return settings, err
+		}
+		settings.headers = append(settings.headers, rule)
+	}
+	if table, ok := root.Tables["timers"]; ok {
+		if err := table.CheckKeys("t1", "t2", "t4", "timer-c"); err != nil {
+			return settings, err
+		}
+		fields := map[string]*time.Duration{
+			"t1":      &settings.timers.T1,
+			"t2":      &settings.timers.T2,
+			"t4":      &settings.timers.T4,
+			"timer-c": &settings.timers.TimerC,
+		}
+		for _, key := range table.Keys {
+			d, err := table.Values[key].Duration()
+			if err != nil {
+				return settings, err
+			}
+			*fields[key] = d
+		}
+	}
+	return settings, nil
+}
+
+// readTrunk reads one [[trunk]] table.
+func readTrunk(table *config.Table) (sip.TrunkConfig, error) {
+	if err := table.CheckKeys("registrar", "domain", "username", "auth-user", "password", "expires", "cost"); err != nil {
+		return sip.TrunkConfig{}, err
+	}
+	text := func(key string) string {
+		value, _ := table.Lookup(key)
+		return value.Text
+	}
+	trunk := sip.TrunkConfig{
+		Registrar:    text("registrar"),
+		Domain:       text("domain"),
+		Username:     text("username"),
+		AuthUsername: text("auth-user"),
+		Password:     text("password"),
+	}
+	if trunk.Registrar == "" || trunk.Username == "" {
+		return trunk, &config.Error{Line: table.Line, Msg: "[[trunk]] needs registrar and username"}
+	}
+	if value, ok := table.Lookup("expires"); ok {
+		d, err := value.Duration()
+		if err != nil {
+			return trunk, err
+		}
+		trunk.Expires = d
+	}
+	if value, ok := table.Lookup("cost"); ok {
+		n, err := strconv.Atoi(value.Text)
+		if err != nil || n < 0 || value.IsList {
+			return trunk, &config.Error{Line: value.Line, Msg: "cost must be a number of at least 0"}
+		}
+		trunk.Cost = n
+	}
+	return trunk, nil
+}
+
+// readRoute reads one [[route]] table. source may be one address or prefix,
+// or an array of them, and trunk one trunk or an array of them.
+func readRoute(table *config.Table) (sip.RouteRule, error) {
+	if err := table.CheckKeys("name", "user", "prefix", "domain", "source", "days", "time", "rewrite", "strip", "prepend", "host", "upstream", "trunk", "reject", "reason"); err != nil {
+		return sip.RouteRule{}, err
+	}
+	text := func(key string) string {
+		value, _ := table.Lookup(key)
+		return value.Text
+	}
+	route := sip.RouteRule{
+		Name:     text("name"),
+		User:     text("user"),
+		Prefix:   text("prefix"),
+		Domain:   text("domain"),
+		Days:     text("days"),
+		Time:     text("time"),
+		Rewrite:  text("rewrite"),
+		Prepend:  text("prepend"),
+		Host:     text("host"),
+		Upstream: text("upstream"),
+		Trunk:    text("trunk"),
+		Reason:   text("reason"),
+	}
+	if route.Name == "" {
+		route.Name = fmt.Sprintf("at line %d", table.Line)
+	}
+	if value, ok := table.Lookup("source"); ok {
+		route.Sources = value.List
+		if !value.IsList {
+			route.Sources = []string{value.Text}
+		}
+	}
+	if value, ok := table.Lookup("trunk"); ok && value.IsList {
+		route.Trunk = strings.Join(value.List, ",")
+	}
+	for key, field := range map[string]*int{"strip": &route.Strip, "reject": &route.Reject} {
+		value, ok := table.Lookup(key)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value.Text)
+		if err != nil || value.IsList {
+			return route, &config.Error{Line: value.Line, Msg: fmt.Sprintf("%s must be a number", key)}
+		}
+		*field = n
+	}
+	return route, nil
+}
+
+// readHeaderRule reads one [[header-rule]] table. method and peer may be one
+// value or an array of them.
+func readHeaderRule(table *config.Table) (sip.HeaderRule, error) {
+	if err := table.CheckKeys("name", "direction", "method", "peer", "header", "action", "match", "value"); err != nil {
+		return sip.HeaderRule{}, err
+	}
+	text := func(key string) string {
+		value, _ := table.Lookup(key)
+		return value.Text
+	}
+	list := func(key string) []string {
+		value, ok := table.Lookup(key)
+		switch {
+		case !ok:
+			return nil
+		case value.IsList:
+			return value.List
+		}
+		return []string{value.Text}
+	}
+	rule := sip.HeaderRule{
+		Name:      text("name"),
+		Direction: text("direction"),
+		Methods:   list("method"),
+		Peers:     list("peer"),
+		Header:    text("header"),
+		Action:    text("action"),
+		Match:     text("match"),
+		Value:     text("value"),
+	}
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("at line %d", table.Line)
+	}
+	if rule.Header == "" || rule.Action == "" {
+		return rule, &config.Error{Line: table.Line, Msg: "[[header-rule]] needs header and action"}
+	}
+	return rule, nil
+}
+
+// checkLogger is the logger of check-config, which reports to standard
+// error instead of opening the configured log outputs.
+func checkLogger(cfg logConfig) (*slog.Logger, func(), error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(cfg.Level))); err != nil {
+		return nil, nil, fmt.Errorf("invalid --log-level %q: use debug, info, warn, or error", cfg.Level)
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})), func() {}, nil
+}
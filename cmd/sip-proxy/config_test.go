@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"xylitol4/internal/config"
+)
+
+var defineFlagsOnce sync.Once
+
+// defineFlags registers the flags the configuration file maps onto, as main
+// does, since main registers them only when it runs.
+func defineFlags() {
+	defineFlagsOnce.Do(func() {
+		flag.String("listen", ":5060", "")
+		flag.Int("queue-capacity", 32, "")
+		flag.String("log-level", "info", "")
+		flag.Var(&stringList{}, "trunk", "")
+		flag.String("trunk-did", "", "")
+		flag.String("emergency-numbers", "", "")
+		flag.String("emergency-route", "", "")
+		flag.String("trusted-peers", "", "")
+		flag.Bool("topology-hiding", false, "")
+		flag.Bool("diversion", false, "")
+		flag.String("enum", "", "")
+		flag.String("enum-resolver", "", "")
+		flag.Duration("enum-timeout", time.Second, "")
+		flag.Duration("enum-cache-ttl", 5*time.Minute, "")
+		flag.Duration("timer-t1", 0, "")
+		flag.Duration("timer-t2", 0, "")
+		flag.Duration("timer-t4", 0, "")
+		flag.Duration("timer-c", 0, "")
+	})
+}
+
+// writeConfig writes a configuration file into a temporary directory and
+// returns its path.
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	defineFlags()
+	for _, tt := range []struct {
+		name string
+		text string
+		line int
+	}{
+		{"unknown setting", "listen = \":5060\"\nlisten-udp = \":5070\"\n", 2},
+		{"config cannot be set", "config = \"other.toml\"\n", 1},
+		{"unknown table", "listen = \":5060\"\n\n[timer]\n", 3},
+		{"unknown array of tables", "[[trunks]]\n", 1},
+		{"unknown timer", "[timers]\nt3 = \"1s\"\n", 2},
+		{"incomplete trunk", "[[trunk]]\nusername = \"alice\"\n", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := loadConfig(writeConfig(t, tt.text))
+			var cerr *config.Error
+			if !errors.As(err, &cerr) || cerr.Line != tt.line {
+				t.Fatalf("expected an error at line %d, got %v", tt.line, err)
+			}
+		})
+	}
+}
+
+func TestApplyConfigKeepsCommandLineFlags(t *testing.T) {
+	defineFlags()
+	root, _, err := loadConfig(writeConfig(t, `
+listen = ":5080"
+queue-capacity = 64
+trunk = ["alice:secret@sip.provider.example", "bob:secret@backup.provider.example"]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := flag.Set("listen", ":5070"); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(root); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := flag.Lookup("listen").Value.String(); got != ":5070" {
+		t.Fatalf("expected the command line's --listen to win, got %q", got)
+	}
+	if got := flag.Lookup("queue-capacity").Value.String(); got != "64" {
+		t.Fatalf("expected --queue-capacity from the file, got %q", got)
+	}
+	if got := *flag.Lookup("trunk").Value.(*stringList); len(got) != 2 {
+		t.Fatalf("expected each element of the trunk array to be given to the repeatable flag, got %q", got)
+	}
+
+	root, err = config.Parse([]byte("queue-capacity = \"many\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cerr *config.Error
+	if err := applyConfig(root); !errors.As(err, &cerr) || cerr.Line != 1 {
+		t.Fatalf("expected an invalid value reported at its line, got %v", err)
+	}
+}
+
+func TestReadReloadableMapsTheFileOntoTheStack(t *testing.T) {
+	defineFlags()
+	root, settings, err := loadConfig(writeConfig(t, `
+topology-hiding = true
+emergency-numbers = ["110", "119"]
+trunk-did = "0311112222=bob@example.com"
+
+[timers]
+t1 = "250ms"
+timer-c = 120
+
+[dids]
+"0311112222" = "carol@example.com"
+"0333334444" = "alice@example.com"
+
+[[trunk]]
+registrar = "sip.provider.example"
+username = "0311112222"
+password = "secret"
+cost = 2
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := flag.Set("timer-c", "90s"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := readReloadable(root, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stack := r.stack
+	if stack.Timers.T1 != 250*time.Millisecond || stack.Timers.TimerC != 90*time.Second {
+		t.Fatalf("expected T1 from [timers] and Timer C from the command line, got %+v", stack.Timers)
+	}
+	if !stack.TopologyHiding || stack.Diversion {
+		t.Fatalf("expected topology hiding from the file and Diversion by default")
+	}
+	if !slices.Equal(stack.Emergency.Numbers, []string{"110", "119"}) {
+		t.Fatalf("expected the emergency numbers array joined, got %q", stack.Emergency.Numbers)
+	}
+	if stack.TrunkDIDs["0311112222"] != "bob@example.com" || stack.TrunkDIDs["0333334444"] != "alice@example.com" {
+		t.Fatalf("expected --trunk-did to win over [dids] and [dids] to add the rest, got %v", stack.TrunkDIDs)
+	}
+	if len(stack.Trunks) != 1 || stack.Trunks[0].Registrar != "sip.provider.example" || stack.Trunks[0].Cost != 2 {
+		t.Fatalf("expected the [[trunk]] table, got %+v", stack.Trunks)
+	}
+	if stack.ENUM.Timeout != time.Second || r.level.String() != "INFO" {
+		t.Fatalf("expected defaults for settings given nowhere, got %v and %v", stack.ENUM.Timeout, r.level)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stopSignals shut the proxy down. On Windows Go also delivers SIGTERM for
+// console close, logoff, and shutdown events.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// host is the service manager running the proxy when it controls the process
+// other than through signals, as the Windows service control manager does: it
+// asks the proxy to stop or reload, and hears when the proxy runs and when it
+// stops. The zero host, for a console or systemd, has none.
+type host struct {
+	stop     <-chan struct{}
+	reload   <-chan struct{}
+	running  func()
+	stopping func()
+}
+
+// stopContext returns a context cancelled on a stop signal or when the host
+// asks the proxy to stop.
+func (h host) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := signal.NotifyContext(context.Background(), stopSignals...)
+	if h.stop != nil {
+		go func() {
+			select {
+			case <-h.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// reloads returns a channel receiving a value for each request to reload the
+// configuration, from reloadSignals or the host, and a function that stops
+// delivering them. Requests made while one is pending are merged.
+func (h host) reloads() (<-chan struct{}, func()) {
+	requests := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(signals, reloadSignals...)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-h.reload:
+			case <-done:
+				return
+			}
+			select {
+			case requests <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return requests, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// notifyRunning tells the host that the proxy serves traffic.
+func (h host) notifyRunning() {
+	if h.running != nil {
+		h.running()
+	}
+}
+
+// notifyStopping tells the host that the proxy is shutting down.
+func (h host) notifyStopping() {
+	if h.stopping != nil {
+		h.stopping()
+	}
+}
@@ -2,128 +2,669 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
-	"syscall"
 	"time"
 
+	"xylitol4/internal/logsink"
+	"xylitol4/internal/metrics"
+	"xylitol4/internal/systemd"
+	"xylitol4/internal/tracing"
 	"xylitol4/internal/userweb"
 	"xylitol4/sip"
 	"xylitol4/sip/userdb"
 )
 
+// version is reported on /buildinfo; release builds set it with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// commands runs each command with the arguments that follow its name. serve
+// and check-config exit the process themselves on failure.
+var commands = map[string]func(args []string) error{
+	"serve": func(args []string) error {
+		serve(host{}, args, false)
+		return nil
+	},
+	"check-config": func(args []string) error {
+		serve(host{}, args, true)
+		return nil
+	},
+	"user":    runUser,
+	"db":      runDB,
+	"trace":   runTrace,
+	"service": runService,
+}
+
+// run dispatches args to their command and returns the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	// Without a command, or with flags first, the proxy runs as it always
+	// has.
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if command == "help" {
+		usage(stdout)
+		return 0
+	}
+	runCommand, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", command)
+		usage(stderr)
+		return 2
+	}
+	if err := runCommand(args); err != nil {
+		fmt.Fprintf(stderr, "sip-proxy %s: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+// usage describes the commands.
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: sip-proxy [command] [flags]
+
+Commands:
+  serve           run the proxy (the default when no command is given)
+  check-config    validate the configuration without starting
+  user add        add a SIP user: user add [flags] user@domain
+  user list       list SIP users
+  user del        delete a SIP user: user del [flags] user@domain
+  user passwd     set a SIP user's password: user passwd [flags] user@domain
+  db migrate      create or upgrade the user database schema
+  trace           print SIP messages from a running proxy's tracer
+  service         install, remove, start, stop, or run the Windows service
+  help            show this message
+
+Run "sip-proxy <command> -h" for the flags of a command.
+`)
+}
+
+// serve runs the proxy under h until asked to stop, or with checkOnly
+// validates its configuration and exits without opening any socket or
+// database. With --validate it also takes and releases the database and
+// sockets the proxy would use, and exits.
+func serve(h host, args []string, checkOnly bool) {
+	configPath := flag.String("config", "", "TOML configuration file whose top-level settings are named like these flags; flags given on the command line take precedence")
+	validateOnly := flag.Bool("validate", false, "Open and check the user database, resolve the upstreams and trunk registrars, and bind the listen addresses, then release them and exit, with a nonzero status on any problem")
 	listenAddr := flag.String("listen", ":5060", "UDP address to listen on for downstream clients (host:port)")
-	upstreamAddr := flag.String("upstream", "", "Upstream SIP server UDP address (host:port)")
+	upstreamAddr := flag.String("upstream", "", "Upstream SIP server UDP address (host:port), or a comma-separated list in priority order to fail over across")
+	localNames := flag.String("local-name", "", "Comma-separated host names or host:port pairs the proxy answers OPTIONS for itself, besides its listen address")
+	flag.Var(&stringList{}, "trunk", "Provider account to register to from the upstream socket, as user:password@host[:port][;expires=<seconds>][;auth-user=<name>][;domain=<domain>] (repeatable)")
+	flag.String("trunk-did", "", "Comma-separated number=user@domain pairs delivering calls to those numbers arriving from upstream to local users")
+	flag.String("emergency-numbers", "", "Comma-separated emergency numbers, such as 110,118,119, always sent to --emergency-route ahead of overload control, the dial plan, and callee settings")
+	flag.String("emergency-route", "", "Configured trunk (user@domain) or SIP URI that calls to --emergency-numbers go to")
+	flag.String("trusted-peers", "", "Comma-separated addresses, CIDR prefixes, and host names of the peers trusted with P-Asserted-Identity (RFC 3325); others have it removed and callers registered from the request's address are asserted (empty passes identity headers untouched)")
+	flag.Bool("topology-hiding", false, "Hide the Via and Record-Route headers of requests sent to peers outside --trusted-peers (every peer when it is empty), restoring them on responses")
+	flag.Bool("diversion", false, "Add a Diversion header (RFC 5806), besides History-Info, to requests retargeted by call forwarding or broadcast rules")
+	flag.String("enum", "", "Comma-separated ENUM suffixes, such as e164.arpa, to look up the numbers the dial plan sends through trunks under, calling the SIP URI found directly (empty disables)")
+	flag.String("enum-resolver", "", "DNS server (host:port) for ENUM lookups (empty uses the first nameserver of /etc/resolv.conf)")
+	flag.Duration("enum-timeout", time.Second, "How long to wait for each ENUM query")
+	flag.Duration("enum-cache-ttl", 5*time.Minute, "Longest time to remember an ENUM result, or that a number has none")
+	flag.Duration("timer-t1", 0, "RFC 3261 round-trip estimate T1 setting retransmission and transaction timeouts, 10ms to 10s (0 uses 500ms)")
+	flag.Duration("timer-t2", 0, "RFC 3261 T2 capping retransmission intervals, from T1 to 1m (0 uses 4s)")
+	flag.Duration("timer-t4", 0, "RFC 3261 T4 for how long the network may hold a message, 10ms to 1m (0 uses 5s)")
+	flag.Duration("timer-c", 0, "How long a forwarded INVITE may go without a final response, from 64*T1 to 1h (0 uses 3m)")
+	messageStore := flag.Int("message-store", 0, "Most MESSAGE requests kept for each offline user and delivered when they next register (0 answers them with 480 instead)")
+	eventPackages := flag.String("event-packages", "", "Comma-separated event packages the proxy serves SUBSCRIBE for itself: presence (which also accepts PUBLISH) and dialog (the state of calls through the proxy, for busy lamp fields); empty forwards SUBSCRIBE and PUBLISH")
 	upstreamBind := flag.String("upstream-bind", "", "Local UDP address to use for upstream traffic (defaults to system-chosen port)")
+	upstreamHoldDown := flag.Duration("upstream-hold-down", 30*time.Second, "How long an upstream server that timed out or answered 503 is skipped when --upstream-ping is 0; with pings it returns once it answers one")
+	upstreamPing := flag.Duration("upstream-ping", 30*time.Second, "Interval between OPTIONS pings to --upstream reported by /readyz (0 disables)")
+	transactionShards := flag.Int("transaction-shards", 0, "Number of goroutines running the transaction layer, each owning a share of the transactions (0 uses one per CPU)")
+	parseWorkers := flag.Int("parse-workers", 0, "Number of goroutines parsing downstream datagrams (0 uses one per CPU)")
+	queueCapacity := flag.Int("queue-capacity", 32, "Buffer size of each internal proxy queue")
+	queuePolicy := flag.String("queue-policy", "block", "What to do with a message arriving at a full proxy queue: block, drop, or reject (answer requests with 503)")
+	overloadQueueDepth := flag.Int("overload-queue-depth", 0, "Answer new INVITEs with 503 while more messages than this wait in the proxy's queues (0 disables)")
+	overloadTransactions := flag.Int("overload-transactions", 0, "Answer new INVITEs with 503 while more transactions than this are live (0 disables)")
+	maxCalls := flag.Int("max-calls", 0, "Answer new INVITEs with 503 while this many calls are in progress (0 disables); per-user limits come from the call_limit setting")
+	overloadRetryAfter := flag.Duration("overload-retry-after", 5*time.Second, "Retry-After advertised in 503 responses sent for overload (0 omits the header)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "On SIGTERM or interrupt, refuse new calls and wait up to this long for transactions in progress to finish before exiting (0 exits immediately)")
 	routeTTL := flag.Duration("route-ttl", 5*time.Minute, "How long to remember downstream transaction routes")
-	userDBPath := flag.String("user-db", "", "Path to SQLite database containing SIP user directory")
-	httpListen := flag.String("http-listen", ":8080", "HTTP address to listen on (host:port)")
-	adminUser := flag.String("admin-user", "", "Username required for admin endpoints")
-	adminPass := flag.String("admin-pass", "", "Password required for admin endpoints")
-	flag.Parse()
+	routeMaxEntries := flag.Int("route-max-entries", 0, "Most downstream transaction routes to remember, evicting the least recently used (0 is unbounded)")
+	compactHeaders := flag.Bool("compact-headers", false, "Send SIP header names in their compact form (v, f, t, i, ...) to keep messages small")
+	lenientParsing := flag.Bool("lenient-parsing", false, "Accept received SIP messages with LF-only line endings, extra whitespace in the start line, or no reason phrase")
+	userDBPath := flag.String("user-db", "", "Path to SQLite database (or LDAP URL for the ldap backend) containing SIP user directory")
+	userDBDriver := flag.String("user-db-driver", "sqlite", "User directory backend: sqlite or ldap")
+	userCacheTTL := flag.Duration("user-cache-ttl", 30*time.Second, "How long to cache user lookups for REGISTER authentication (0 disables)")
+	directoryRefresh := flag.Duration("directory-refresh", time.Minute, "Interval for reloading the user directory to pick up external changes (0 disables)")
+	registrarRedis := flag.String("registrar-redis", "", "Redis URL (redis://[user:password@]host:port[/db]) for sharing registrations between proxy instances")
+	httpListen := flag.String("http-listen", ":8080", "HTTP address to listen on (host:port); with TLS enabled it only redirects to HTTPS (empty disables it)")
+	httpsListen := flag.String("https-listen", ":8443", "HTTPS address to listen on (host:port) when --http-tls-cert and --http-tls-key are set")
+	adminListen := flag.String("admin-listen", "", "Address (host:port), such as 127.0.0.1:8081, serving the admin pages, JSON API, and /metrics apart from the portal, over HTTPS when TLS is set (empty serves them with the portal)")
+	httpTLSCert := flag.String("http-tls-cert", "", "PEM certificate (chain) file serving the web interface over HTTPS")
+	httpTLSKey := flag.String("http-tls-key", "", "PEM private key file for --http-tls-cert")
+	adminUser := flag.String("admin-user", "", "Bootstrap superadmin username for the web interface (further admins are stored in the user database)")
+	adminPass := flag.String("admin-pass", "", "Bootstrap superadmin password for the web interface")
+	apiToken := flag.String("api-token", "", "Bearer token enabling the JSON API under /api/v1/")
+	httpTemplates := flag.String("http-templates", "", "Directory of <page>.html templates and messages.<lang>.json catalogs overriding the built-in web pages")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn, or error (debug logs every SIP message sent and received)")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logOutput := flag.String("log-output", "stdout", "Comma-separated log destinations: stdout, file, and/or syslog")
+	logFile := flag.String("log-file", "", "Log file written when --log-output includes file")
+	logFileMaxSize := flag.Int("log-file-max-size", 100, "Rotate the log file after this many megabytes")
+	logFileMaxAge := flag.Duration("log-file-max-age", 24*time.Hour, "Rotate the log file after it has been written for this long (0 disables)")
+	logFileMaxFiles := flag.Int("log-file-max-files", 7, "Number of rotated log files (<file>.1 ... <file>.N) to keep")
+	syslogAddr := flag.String("syslog-addr", "", "Syslog server as udp://host:port, tcp://host:port, or unix:///path when --log-output includes syslog (empty uses the local daemon)")
+	syslogFacility := flag.String("syslog-facility", "daemon", "RFC 5424 syslog facility: kern, user, daemon, auth, local0 ... local7, etc.")
+	sipTrace := flag.Bool("sip-trace", false, "Start with the SIP message tracer enabled for every datagram (it can be reconfigured through /api/v1/trace)")
+	hepAddr := flag.String("hep-addr", "", "UDP address (host:port) of a HEPv3 capture server (Homer) receiving a copy of every SIP message (empty disables)")
+	hepAgentID := flag.Uint("hep-agent-id", 2001, "Capture agent ID sent with every HEP packet")
+	hepPassword := flag.String("hep-password", "", "Authentication key sent with every HEP packet")
+	pcapFile := flag.String("pcap-file", "", "Write every sent and received SIP datagram to this pcap file for Wireshark (empty disables)")
+	pcapMaxSize := flag.Int("pcap-max-size", 100, "Rotate the pcap file after this many megabytes")
+	pcapMaxFiles := flag.Int("pcap-max-files", 5, "Number of rotated pcap files (<file>.1 ... <file>.N) to keep")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OpenTelemetry collector base URL (e.g. http://localhost:4318) receiving spans over OTLP/HTTP for every SIP message and transaction (empty disables)")
+	otlpService := flag.String("otlp-service-name", "xylitol4", "service.name reported with exported spans")
+	metricsListen := flag.String("metrics-listen", "", "HTTP address (host:port) serving Prometheus metrics at /metrics (empty disables)")
+	flag.CommandLine.Parse(args)
+
+	root, settings, err := loadConfig(*configPath)
+	if err == nil {
+		err = applyConfig(root)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration file:", err)
+		os.Exit(2)
+	}
+	current, err := readReloadable(root, settings)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	newLog := newLogger
+	if checkOnly || *validateOnly {
+		newLog = checkLogger
+	}
+	var level slog.LevelVar
+	baseLogger, closeLogs, err := newLog(logConfig{
+		Level:          *logLevel,
+		LevelVar:       &level,
+		Format:         *logFormat,
+		Outputs:        *logOutput,
+		File:           *logFile,
+		FileMaxSize:    *logFileMaxSize,
+		FileMaxAge:     *logFileMaxAge,
+		FileMaxFiles:   *logFileMaxFiles,
+		SyslogAddr:     *syslogAddr,
+		SyslogFacility: *syslogFacility,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	defer closeLogs()
+	slog.SetDefault(baseLogger)
+	logger := baseLogger.With("component", "main")
+
+	buildInfo := userweb.ReadBuildInfo(version)
+	logger.Info("starting xylitol4", "version", buildInfo.Version, "commit", buildInfo.Commit)
 
 	if strings.TrimSpace(*userDBPath) == "" {
 		flag.Usage()
-		log.Fatal("the --user-db flag is required")
+		fatal(logger, "the --user-db flag is required")
+	}
+
+	policy, err := sip.ParseQueuePolicy(*queuePolicy)
+	if err != nil {
+		fatal(logger, "invalid --queue-policy", "error", err)
 	}
 
 	if *upstreamAddr == "" {
-		log.Println("--upstream not provided; requests will be routed using local registrations or Request-URI resolution")
+		logger.Info("--upstream not provided; requests will be routed using local registrations or Request-URI resolution")
 	}
 
 	trimmedAdminUser := strings.TrimSpace(*adminUser)
 	trimmedAdminPass := strings.TrimSpace(*adminPass)
-	httpEnabled := trimmedAdminUser != "" || trimmedAdminPass != ""
-	if httpEnabled && (trimmedAdminUser == "" || trimmedAdminPass == "") {
-		log.Fatal("both --admin-user and --admin-pass must be provided to enable the web interface")
+	trimmedAPIToken := strings.TrimSpace(*apiToken)
+	adminEnabled := trimmedAdminUser != "" || trimmedAdminPass != ""
+	if adminEnabled && (trimmedAdminUser == "" || trimmedAdminPass == "") {
+		fatal(logger, "both --admin-user and --admin-pass must be provided to enable the web interface")
+	}
+	httpEnabled := adminEnabled || trimmedAPIToken != ""
+	tlsEnabled := *httpTLSCert != "" || *httpTLSKey != ""
+	if tlsEnabled && (*httpTLSCert == "" || *httpTLSKey == "") {
+		fatal(logger, "both --http-tls-cert and --http-tls-key must be provided to serve the web interface over HTTPS")
+	}
+
+	stackCfg := sip.SIPStackConfig{
+		ListenAddr:        *listenAddr,
+		UpstreamAddr:      *upstreamAddr,
+		UpstreamBind:      *upstreamBind,
+		LocalNames:        splitNames(*localNames),
+		Trunks:            current.stack.Trunks,
+		TrunkDIDs:         current.stack.TrunkDIDs,
+		Timers:            current.stack.Timers,
+		Routes:            current.stack.Routes,
+		ENUM:              current.stack.ENUM,
+		Emergency:         current.stack.Emergency,
+		Identity:          current.stack.Identity,
+		TopologyHiding:    current.stack.TopologyHiding,
+		Diversion:         current.stack.Diversion,
+		HeaderRules:       current.stack.HeaderRules,
+		RouteTTL:          *routeTTL,
+		RouteMaxEntries:   *routeMaxEntries,
+		CompactHeaders:    *compactHeaders,
+		LenientParsing:    *lenientParsing,
+		UserDBPath:        *userDBPath,
+		UserDBDriver:      *userDBDriver,
+		DirectoryRefresh:  *directoryRefresh,
+		UserLoadTimeout:   5 * time.Second,
+		UpstreamPing:      *upstreamPing,
+		UpstreamHoldDown:  *upstreamHoldDown,
+		TransactionShards: *transactionShards,
+		ParseWorkers:      *parseWorkers,
+		QueueCapacity:     *queueCapacity,
+		QueuePolicy:       policy,
+		MessageStore:      *messageStore,
+		EventPackages:     splitNames(*eventPackages),
+		Overload: sip.OverloadConfig{
+			MaxQueueDepth:   *overloadQueueDepth,
+			MaxTransactions: *overloadTransactions,
+			MaxCalls:        *maxCalls,
+			RetryAfter:      *overloadRetryAfter,
+		},
+	}
+	if checkOnly || *validateOnly {
+		stack, err := sip.NewSIPStack(stackCfg)
+		if err != nil {
+			fatal(logger, "invalid SIP configuration", "error", err)
+		}
+		for _, addr := range []string{stackCfg.ListenAddr, stackCfg.UpstreamBind} {
+			if _, err := net.ResolveUDPAddr("udp", addr); addr != "" && err != nil {
+				fatal(logger, "invalid socket address", "address", addr, "error", err)
+			}
+		}
+		if !*validateOnly {
+			fmt.Println("configuration OK")
+			return
+		}
+		listen := []string{*httpListen, *metricsListen, *adminListen}
+		if tlsEnabled {
+			listen = append(listen, *httpsListen)
+		}
+		d := deployment{
+			stack:   stack,
+			redis:   strings.TrimSpace(*registrarRedis),
+			listen:  listen,
+			tlsCert: *httpTLSCert,
+			tlsKey:  *httpTLSKey,
+		}
+		if err := d.validate(context.Background()); err != nil {
+			fatal(logger, "validation failed", "error", err)
+		}
+		fmt.Println("validation OK")
+		return
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := h.stopContext()
 	defer cancel()
 
-	logger := log.New(os.Stdout, "sip-proxy: ", log.LstdFlags|log.Lmicroseconds)
+	// Under socket activation systemd binds the sockets before starting the
+	// proxy, so packets sent while it restarts wait in their buffers.
+	sockets, err := systemd.Activated()
+	if err != nil {
+		fatal(logger, "failed to take sockets from systemd", "error", err)
+	}
+	defer sockets.Close()
 
-	stack, err := sip.NewSIPStack(sip.SIPStackConfig{
-		ListenAddr:      *listenAddr,
-		UpstreamAddr:    *upstreamAddr,
-		UpstreamBind:    *upstreamBind,
-		RouteTTL:        *routeTTL,
-		UserDBPath:      *userDBPath,
-		Logger:          logger,
-		UserLoadTimeout: 5 * time.Second,
-	})
+	var registrations sip.RegistrationStore
+	if strings.TrimSpace(*registrarRedis) != "" {
+		redisStore, err := sip.OpenRedisRegistrationStore(*registrarRedis)
+		if err != nil {
+			fatal(logger, "failed to connect to registration store", "error", err)
+		}
+		defer redisStore.Close()
+		registrations = redisStore
+		logger.Info("sharing registrations through Redis")
+	}
+
+	// The SIP stack and the web UI share one store handle so that edits made
+	// through the web interface are announced to the stack immediately.
+	openedStore, err := userdb.OpenStore(*userDBDriver, *userDBPath)
+	if err != nil {
+		fatal(logger, "failed to open user database", "error", err)
+	}
+	userStore := userdb.NewCachedStore(openedStore, *userCacheTTL)
+	defer func() {
+		if err := userStore.Close(); err != nil {
+			logger.Error("error closing user database", "error", err)
+		}
+	}()
+
+	// Admin accounts or API tokens kept in the database are enough to serve
+	// the web interface without bootstrap credentials.
+	if !httpEnabled {
+		if admins, err := userStore.ListAdminAccounts(ctx); err != nil {
+			logger.Error("failed to list admin accounts", "error", err)
+		} else if len(admins) > 0 {
+			httpEnabled = true
+		}
+	}
+	if !httpEnabled {
+		if tokens, err := userStore.ListAPITokens(ctx); err != nil {
+			logger.Error("failed to list API tokens", "error", err)
+		} else if len(tokens) > 0 {
+			httpEnabled = true
+		}
+	}
+
+	var registry *metrics.Registry
+	if *metricsListen != "" || *adminListen != "" {
+		registry = metrics.NewRegistry()
+	}
+
+	tracer := sip.NewTracer(baseLogger.With("component", "trace"), 0)
+	tracer.Configure(*sipTrace, sip.TraceFilter{})
+
+	var observers []sip.PacketObserver
+	if *hepAddr != "" {
+		hep, err := sip.NewHEPExporter(sip.HEPConfig{
+			Addr:     *hepAddr,
+			AgentID:  uint32(*hepAgentID),
+			Password: *hepPassword,
+			Logger:   baseLogger.With("component", "hep"),
+		})
+		if err != nil {
+			fatal(logger, "failed to start HEP capture agent", "error", err)
+		}
+		defer hep.Close()
+		observers = append(observers, hep)
+		logger.Info("copying SIP messages to HEP capture server", "addr", *hepAddr)
+	}
+
+	if *pcapFile != "" {
+		pcap, err := sip.NewPcapWriter(sip.PcapConfig{
+			Path:     *pcapFile,
+			MaxBytes: int64(*pcapMaxSize) << 20,
+			MaxFiles: *pcapMaxFiles,
+			Logger:   baseLogger.With("component", "pcap"),
+		})
+		if err != nil {
+			fatal(logger, "failed to open pcap file", "error", err)
+		}
+		defer func() {
+			if err := pcap.Close(); err != nil {
+				logger.Error("error closing pcap file", "error", err)
+			}
+		}()
+		observers = append(observers, pcap)
+		logger.Info("writing SIP traffic to pcap file", "path", *pcapFile)
+	}
+
+	var spans *tracing.Tracer
+	if *otlpEndpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(*otlpEndpoint, *otlpService)
+		if err != nil {
+			fatal(logger, "invalid OTLP endpoint", "error", err)
+		}
+		spans = tracing.NewTracer(tracing.Config{
+			Exporter: exporter,
+			Logger:   baseLogger.With("component", "tracing"),
+		})
+		logger.Info("exporting SIP spans to OpenTelemetry collector", "endpoint", *otlpEndpoint)
+	}
+
+	stackCfg.UserStore = userStore
+	stackCfg.RegistrationStore = registrations
+	stackCfg.Logger = baseLogger.With("component", "sip")
+	stackCfg.Metrics = registry
+	stackCfg.Tracer = tracer
+	stackCfg.Observers = observers
+	stackCfg.Tracing = spans
+	stackCfg.ListenConn = sockets.PacketConn("sip")
+	stackCfg.UpstreamConn = sockets.PacketConn("sip-upstream")
+	if stackCfg.ListenConn != nil {
+		logger.Info("using SIP socket from systemd", "addr", stackCfg.ListenConn.LocalAddr().String())
+	}
+	if stackCfg.UpstreamConn != nil {
+		logger.Info("using upstream SIP socket from systemd", "addr", stackCfg.UpstreamConn.LocalAddr().String())
+	}
+	stack, err := sip.NewSIPStack(stackCfg)
 	if err != nil {
-		logger.Fatalf("failed to construct SIP stack: %v", err)
+		fatal(logger, "failed to construct SIP stack", "error", err)
 	}
 
 	if err := stack.Start(ctx); err != nil {
-		logger.Fatalf("failed to start SIP stack: %v", err)
+		fatal(logger, "failed to start SIP stack", "error", err)
+	}
+
+	// SIGHUP, the Windows service's paramchange control, and POST
+	// /api/v1/reload read the configuration file again and apply the
+	// settings that can change without restarting.
+	reload := func(ctx context.Context) error {
+		root, settings, err := loadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("configuration file: %w", err)
+		}
+		next, err := readReloadable(root, settings)
+		if err != nil {
+			return err
+		}
+		if err := stack.Reload(ctx, next.stack); err != nil {
+			return err
+		}
+		level.Set(next.level)
+		logger.Info("configuration reloaded", "log_level", next.level.String())
+		return nil
 	}
+	reloads, stopReloads := h.reloads()
+	defer stopReloads()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloads:
+				if err := reload(ctx); err != nil {
+					logger.Error("configuration reload failed", "error", err)
+				}
+			}
+		}
+	}()
 
 	var (
-		httpServer  *http.Server
-		httpErrCh   chan error
-		httpErr     error
-		errReported bool
-		webStore    *userdb.SQLiteStore
-		webLogger   *log.Logger
+		httpServers   []*http.Server
+		metricsServer *http.Server
+		adminServer   *http.Server
+		probeServer   *http.Server
+		httpErrCh     chan error
+		httpErr       error
+		errReported   bool
+		webLogger     *slog.Logger
 	)
 
-	if httpEnabled {
-		store, err := userdb.OpenSQLite(*userDBPath)
-		if err != nil {
-			logger.Fatalf("failed to open user database for web interface: %v", err)
+	if *metricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", registry.Handler())
+		metricsServer = &http.Server{
+			Addr:         *metricsListen,
+			Handler:      metricsMux,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		httpServers = append(httpServers, metricsServer)
+	}
+
+	// newAdminServer serves web, the admin side of the web interface when it
+	// is enabled, with /metrics and the probes on --admin-listen.
+	newAdminServer := func(web http.Handler) *http.Server {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		if web != nil {
+			mux.Handle("/", web)
 		}
-		webStore = store
-		webLogger = log.New(os.Stdout, "user-web: ", log.LstdFlags|log.Lmicroseconds)
+		server := &http.Server{
+			Addr:         *adminListen,
+			Handler:      userweb.WithProbes(mux, stack, buildInfo),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		if tlsEnabled {
+			server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		return server
+	}
+
+	if httpEnabled {
+		webLogger = baseLogger.With("component", "userweb")
 		webServer, err := userweb.New(userweb.Config{
-			Store:     store,
-			AdminUser: trimmedAdminUser,
-			AdminPass: trimmedAdminPass,
-			Logger:    webLogger,
+			Store:         userStore,
+			AdminUser:     trimmedAdminUser,
+			AdminPass:     trimmedAdminPass,
+			APIToken:      trimmedAPIToken,
+			TemplateDir:   *httpTemplates,
+			Registrations: stack,
+			Calls:         stack,
+			Logger:        webLogger,
+			Metrics:       registry,
+			Tracer:        tracer,
+			Reload:        reload,
 		})
 		if err != nil {
-			logger.Fatalf("failed to construct user web server: %v", err)
+			fatal(logger, "failed to construct user web server", "error", err)
+		}
+		web := webServer.Handler()
+		if *adminListen != "" {
+			web = webServer.PortalHandler()
+			adminServer = newAdminServer(webServer.AdminHandler())
+			httpServers = append(httpServers, adminServer)
 		}
 
-		httpServer = &http.Server{
-			Addr:         *httpListen,
-			Handler:      webServer.Handler(),
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
+		if tlsEnabled {
+			// Load the key pair up front so that a bad file stops startup
+			// instead of failing in the listener goroutine.
+			if _, err := tls.LoadX509KeyPair(*httpTLSCert, *httpTLSKey); err != nil {
+				fatal(logger, "failed to load web interface TLS certificate", "error", err)
+			}
+			httpServers = append(httpServers, &http.Server{
+				Addr:         *httpsListen,
+				Handler:      userweb.WithProbes(web, stack, buildInfo),
+				ReadTimeout:  5 * time.Second,
+				WriteTimeout: 10 * time.Second,
+				TLSConfig:    &tls.Config{MinVersion: tls.VersionTLS12},
+			})
+			if *httpListen != "" {
+				httpServers = append(httpServers, &http.Server{
+					Addr:         *httpListen,
+					Handler:      userweb.WithProbes(userweb.RedirectToHTTPS(*httpsListen), stack, buildInfo),
+					ReadTimeout:  5 * time.Second,
+					WriteTimeout: 10 * time.Second,
+				})
+			}
+		} else {
+			httpServers = append(httpServers, &http.Server{
+				Addr:         *httpListen,
+				Handler:      userweb.WithProbes(web, stack, buildInfo),
+				ReadTimeout:  5 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			})
 		}
-		httpErrCh = make(chan error, 1)
-		go func() {
-			webLogger.Printf("user web interface listening on %s", *httpListen)
-			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				httpErrCh <- err
-				return
+		// Open trace streams would otherwise hold Shutdown until its deadline.
+		for _, server := range httpServers {
+			server.RegisterOnShutdown(webServer.CloseStreams)
+		}
+	} else {
+		logger.Info("user web interface disabled; provide --admin-user and --admin-pass, --api-token, or admin accounts or API tokens in the user database to enable it")
+		if *httpListen != "" {
+			// Orchestrators still need the probes without the web interface.
+			probeServer = &http.Server{
+				Addr:         *httpListen,
+				Handler:      userweb.WithProbes(nil, stack, buildInfo),
+				ReadTimeout:  5 * time.Second,
+				WriteTimeout: 10 * time.Second,
 			}
-			httpErrCh <- nil
-		}()
-		defer func() {
-			if webStore != nil {
-				if err := webStore.Close(); err != nil {
-					webLogger.Printf("error closing user database: %v", err)
+			httpServers = append(httpServers, probeServer)
+		}
+		if *adminListen != "" {
+			adminServer = newAdminServer(nil)
+			httpServers = append(httpServers, adminServer)
+		}
+	}
+
+	if len(httpServers) > 0 {
+		// Bind every listener before serving, so that READY=1 is sent only
+		// once the web interface, probes, and metrics accept connections.
+		listeners := make([]net.Listener, len(httpServers))
+		for i, server := range httpServers {
+			listener := sockets.Listener(socketName(server, metricsServer, adminServer))
+			if listener == nil {
+				listener, err = net.Listen("tcp", server.Addr)
+				if err != nil {
+					fatal(logger, "failed to listen for HTTP", "addr", server.Addr, "error", err)
 				}
 			}
-		}()
-	} else {
-		logger.Println("user web interface disabled; provide --admin-user and --admin-pass to enable it")
+			listeners[i] = listener
+		}
+		httpErrCh = make(chan error, len(httpServers))
+		for i, server := range httpServers {
+			go func(server *http.Server, listener net.Listener) {
+				var err error
+				addr := listener.Addr().String()
+				if server == metricsServer {
+					logger.Info("metrics listening", "addr", addr, "path", "/metrics")
+					err = server.Serve(listener)
+				} else if server == adminServer && server.TLSConfig != nil {
+					logger.Info("admin interface listening", "addr", addr, "scheme", "https")
+					err = server.ServeTLS(listener, *httpTLSCert, *httpTLSKey)
+				} else if server == adminServer {
+					logger.Info("admin interface listening", "addr", addr, "scheme", "http")
+					err = server.Serve(listener)
+				} else if server == probeServer {
+					logger.Info("health probes listening", "addr", addr)
+					err = server.Serve(listener)
+				} else if server.TLSConfig != nil {
+					webLogger.Info("user web interface listening", "addr", addr, "scheme", "https")
+					err = server.ServeTLS(listener, *httpTLSCert, *httpTLSKey)
+				} else if tlsEnabled {
+					webLogger.Info("redirecting HTTP to HTTPS", "addr", addr)
+					err = server.Serve(listener)
+				} else {
+					webLogger.Info("user web interface listening", "addr", addr, "scheme", "http")
+					err = server.Serve(listener)
+				}
+				if err != nil && err != http.ErrServerClosed {
+					httpErrCh <- err
+					return
+				}
+				httpErrCh <- nil
+			}(server, listeners[i])
+		}
 	}
 
+	if unused := sockets.Unused(); len(unused) > 0 {
+		logger.Warn("closing sockets from systemd that no setting uses; name them sip, sip-upstream, http, https, or metrics", "names", unused)
+		sockets.Close()
+	}
+	if sent, err := systemd.Notify("READY=1"); err != nil {
+		logger.Warn("failed to notify systemd of readiness", "error", err)
+	} else if sent {
+		logger.Debug("notified systemd of readiness")
+	}
+	h.notifyRunning()
+
 	if httpErrCh != nil {
 		select {
 		case err := <-httpErrCh:
 			httpErr = err
 			errReported = true
 			if err != nil {
-				logger.Printf("user web interface error: %v", err)
+				logger.Error("HTTP server error", "error", err)
 				cancel()
 			}
 		case <-ctx.Done():
@@ -134,23 +675,208 @@ func main() {
 
 	<-ctx.Done()
 
-	logger.Println("shutdown requested, stopping proxy")
-	if httpServer != nil {
+	logger.Info("shutdown requested, stopping proxy")
+	if _, err := systemd.Notify("STOPPING=1"); err != nil {
+		logger.Warn("failed to notify systemd of shutdown", "error", err)
+	}
+	h.notifyStopping()
+	if *drainTimeout > 0 {
+		// Probes keep answering, not ready, while the stack drains; a
+		// second signal cuts the drain short.
+		drainCtx, drainStop := signal.NotifyContext(context.Background(), stopSignals...)
+		drainCtx, drainCancel := context.WithTimeout(drainCtx, *drainTimeout)
+		stack.Drain(drainCtx)
+		drainCancel()
+		drainStop()
+	}
+	if len(httpServers) > 0 {
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-		if err := httpServer.Shutdown(shutdownCtx); err != nil && err != http.ErrServerClosed {
-			logger.Printf("error shutting down user web interface: %v", err)
+		for _, server := range httpServers {
+			if err := server.Shutdown(shutdownCtx); err != nil && err != http.ErrServerClosed {
+				logger.Error("error shutting down HTTP server", "addr", server.Addr, "error", err)
+			}
 		}
 		shutdownCancel()
-		if !errReported {
-			if err := <-httpErrCh; err != nil {
+		pending := len(httpServers)
+		if errReported {
+			pending--
+		}
+		for ; pending > 0; pending-- {
+			if err := <-httpErrCh; err != nil && httpErr == nil {
 				httpErr = err
 			}
 		}
 		if httpErr != nil {
-			logger.Printf("user web interface terminated with error: %v", httpErr)
+			logger.Error("HTTP server terminated with error", "error", httpErr)
 		}
 	}
 
 	stack.Stop()
-	logger.Println("shutdown complete")
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	spans.Shutdown(flushCtx)
+	flushCancel()
+	logger.Info("shutdown complete")
+}
+
+// socketName is the FileDescriptorName= of the systemd socket serving
+// server: metrics for the metrics server, admin for the admin interface,
+// https for the TLS web interface, and http for the plain web interface, its
+// HTTPS redirect, or the probes.
+func socketName(server, metricsServer, adminServer *http.Server) string {
+	switch {
+	case server == metricsServer:
+		return "metrics"
+	case server == adminServer:
+		return "admin"
+	case server.TLSConfig != nil:
+		return "https"
+	}
+	return "http"
+}
+
+// logConfig selects where and how the process logs. LevelVar, when set,
+// holds the minimum level so that a reload can change it.
+type logConfig struct {
+	Level          string
+	LevelVar       *slog.LevelVar
+	Format         string
+	Outputs        string
+	File           string
+	FileMaxSize    int
+	FileMaxAge     time.Duration
+	FileMaxFiles   int
+	SyslogAddr     string
+	SyslogFacility string
+}
+
+// newLogger builds the process-wide logger writing records at or above the
+// configured level to each configured output. The returned function closes
+// the log file and syslog connection.
+func newLogger(cfg logConfig) (*slog.Logger, func(), error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(strings.TrimSpace(cfg.Level))); err != nil {
+		return nil, nil, fmt.Errorf("invalid --log-level %q: use debug, info, warn, or error", cfg.Level)
+	}
+	opts := &slog.HandlerOptions{Level: minLevel}
+	if cfg.LevelVar != nil {
+		cfg.LevelVar.Set(minLevel)
+		opts.Level = cfg.LevelVar
+	}
+	var json bool
+	switch strings.ToLower(strings.TrimSpace(cfg.Format)) {
+	case "", "text":
+	case "json":
+		json = true
+	default:
+		return nil, nil, fmt.Errorf("invalid --log-format %q: use text or json", cfg.Format)
+	}
+	stream := func(w io.Writer) slog.Handler {
+		if json {
+			return slog.NewJSONHandler(w, opts)
+		}
+		return slog.NewTextHandler(w, opts)
+	}
+
+	var (
+		handlers []slog.Handler
+		closers  []io.Closer
+	)
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	seen := make(map[string]bool)
+	for _, output := range strings.Split(cfg.Outputs, ",") {
+		output = strings.ToLower(strings.TrimSpace(output))
+		if output == "" || seen[output] {
+			continue
+		}
+		seen[output] = true
+		switch output {
+		case "stdout":
+			handlers = append(handlers, stream(os.Stdout))
+		case "file":
+			if strings.TrimSpace(cfg.File) == "" {
+				closeAll()
+				return nil, nil, fmt.Errorf("--log-output file requires --log-file")
+			}
+			file, err := logsink.OpenRotatingFile(logsink.FileConfig{
+				Path:     cfg.File,
+				MaxBytes: int64(cfg.FileMaxSize) << 20,
+				MaxAge:   cfg.FileMaxAge,
+				MaxFiles: cfg.FileMaxFiles,
+			})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			closers = append(closers, file)
+			handlers = append(handlers, stream(file))
+		case "syslog":
+			facility, err := logsink.ParseFacility(cfg.SyslogFacility)
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("invalid --syslog-facility %q", cfg.SyslogFacility)
+			}
+			syslog, err := logsink.NewSyslog(logsink.SyslogConfig{Addr: cfg.SyslogAddr, Facility: facility, AppName: "xylitol4"})
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			closers = append(closers, syslog)
+			handlers = append(handlers, logsink.NewSyslogHandler(syslog, json, opts))
+		default:
+			closeAll()
+			return nil, nil, fmt.Errorf("invalid --log-output %q: use stdout, file, or syslog", output)
+		}
+	}
+	if len(handlers) == 0 {
+		return nil, nil, fmt.Errorf("--log-output must name at least one of stdout, file, or syslog")
+	}
+	return slog.New(logsink.Multi(handlers...)), closeAll, nil
+}
+
+// fatal logs msg at error level and exits, like log.Fatal.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// splitNames splits a comma-separated flag value, dropping empty entries.
+func splitNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// stringList collects the values of a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseDIDs reads the comma-separated number=user@domain pairs of
+// --trunk-did.
+func parseDIDs(value string) (map[string]string, error) {
+	dids := make(map[string]string)
+	for _, pair := range splitNames(value) {
+		number, target, ok := strings.Cut(pair, "=")
+		number, target = strings.TrimSpace(number), strings.TrimSpace(target)
+		if !ok || number == "" || target == "" {
+			return nil, fmt.Errorf("%q is not number=user@domain", pair)
+		}
+		dids[number] = target
+	}
+	return dids, nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// stubServe replaces the commands that start the proxy with ones recording
+// how they were called.
+func stubServe(t *testing.T) *[]string {
+	t.Helper()
+	var calls []string
+	for _, name := range []string{"serve", "check-config"} {
+		original := commands[name]
+		t.Cleanup(func() { commands[name] = original })
+		commands[name] = func(args []string) error {
+			calls = append(calls, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+			return nil
+		}
+	}
+	return &calls
+}
+
+func TestRunStartsTheProxyByDefault(t *testing.T) {
+	calls := stubServe(t)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "serve"},
+		{[]string{"-listen", ":5070", "-upstream", "192.0.2.1:5060"}, "serve -listen :5070 -upstream 192.0.2.1:5060"},
+		{[]string{"--config=/etc/xylitol4/proxy.toml"}, "serve --config=/etc/xylitol4/proxy.toml"},
+		{[]string{"serve", "-listen", ":5070"}, "serve -listen :5070"},
+		{[]string{"check-config", "-config", "proxy.toml"}, "check-config -config proxy.toml"},
+	} {
+		*calls = nil
+		var stdout, stderr bytes.Buffer
+		if code := run(tt.args, &stdout, &stderr); code != 0 || stderr.Len() != 0 {
+			t.Fatalf("%q: expected success, got %d: %s", tt.args, code, stderr.String())
+		}
+		if !slices.Equal(*calls, []string{tt.want}) {
+			t.Fatalf("%q: expected %q, got %q", tt.args, tt.want, *calls)
+		}
+	}
+}
+
+func TestRunReportsUnknownCommandsAndMissingArguments(t *testing.T) {
+	calls := stubServe(t)
+	t.Setenv("XYLITOL4_API_TOKEN", "")
+	for _, tt := range []struct {
+		args   []string
+		code   int
+		stderr string
+	}{
+		{[]string{"frobnicate"}, 2, "unknown command \"frobnicate\"\n\nUsage: sip-proxy"},
+		{[]string{"users", "list"}, 2, "unknown command \"users\"\n\nUsage: sip-proxy"},
+		{[]string{"user"}, 1, "sip-proxy user: expected add, list, del, or passwd\n"},
+		{[]string{"user", "rename", "alice@example.com"}, 1, "sip-proxy user: unknown action \"rename\": expected add, list, del, or passwd\n"},
+		{[]string{"user", "add"}, 1, "sip-proxy user: expected one user@domain argument\n"},
+		{[]string{"user", "passwd", "alice@example.com", "bob@example.com"}, 1, "sip-proxy user: expected one user@domain argument\n"},
+		{[]string{"user", "del", "alice"}, 1, "sip-proxy user: \"alice\" is not user@domain\n"},
+		{[]string{"user", "del", "@example.com"}, 1, "sip-proxy user: \"@example.com\" is not user@domain\n"},
+		{[]string{"user", "add", "-password", "secret", "alice@example.com"}, 1, "sip-proxy user: the --user-db flag is required\n"},
+		{[]string{"user", "list"}, 1, "sip-proxy user: the --user-db flag is required\n"},
+		{[]string{"db"}, 1, "sip-proxy db: expected migrate\n"},
+		{[]string{"db", "upgrade"}, 1, "sip-proxy db: expected migrate\n"},
+		{[]string{"trace"}, 1, "sip-proxy trace: an API token is required: use --token or $XYLITOL4_API_TOKEN\n"},
+		{[]string{"service"}, 1, "sip-proxy service: "},
+	} {
+		var stdout, stderr bytes.Buffer
+		code := run(tt.args, &stdout, &stderr)
+		if code != tt.code || !strings.HasPrefix(stderr.String(), tt.stderr) {
+			t.Fatalf("%q: expected %d with %q, got %d with %q", tt.args, tt.code, tt.stderr, code, stderr.String())
+		}
+	}
+	if len(*calls) != 0 {
+		t.Fatalf("expected no command to start the proxy, got %q", *calls)
+	}
+}
+
+func TestRunHelpPrintsTheUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"help"}, &stdout, &stderr); code != 0 || stderr.Len() != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stderr.String())
+	}
+	for name := range commands {
+		if !strings.Contains(stdout.String(), "\n  "+name+" ") {
+			t.Fatalf("expected the usage to list %s, got\n%s", name, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// runService manages the Windows service, which exists only on Windows.
+func runService(args []string) error {
+	return errors.New("services are only managed on Windows; elsewhere run the proxy under systemd as the README describes")
+}
@@ -0,0 +1,415 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The service control manager API of advapi32.dll, called directly so the
+// module keeps depending only on the standard library.
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procOpenSCManager                = advapi32.NewProc("OpenSCManagerW")
+	procCreateService                = advapi32.NewProc("CreateServiceW")
+	procOpenService                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                = advapi32.NewProc("DeleteService")
+	procStartService                 = advapi32.NewProc("StartServiceW")
+	procControlService               = advapi32.NewProc("ControlService")
+	procQueryServiceStatus           = advapi32.NewProc("QueryServiceStatus")
+	procChangeServiceConfig2         = advapi32.NewProc("ChangeServiceConfig2W")
+	procCloseServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+
+	scManagerConnect       = 0x1
+	scManagerCreateService = 0x2
+	serviceQueryStatus     = 0x4
+	serviceStart           = 0x10
+	serviceStop            = 0x20
+	serviceDelete          = 0x10000
+	serviceAllAccess       = 0xF01FF
+
+	serviceAutoStart   = 2
+	serviceDemandStart = 3
+	serviceErrorNormal = 1
+
+	serviceConfigDescription = 1
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+)
+
+// defaultServiceName is the name the service is installed under.
+const defaultServiceName = "sip-proxy"
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// serviceDescription is SERVICE_DESCRIPTIONW.
+type serviceDescription struct {
+	description *uint16
+}
+
+// runService manages the Windows service running the proxy.
+func runService(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected install, remove, start, stop, or run")
+	}
+	action, args := args[0], args[1:]
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "Name of the Windows service")
+	switch action {
+	case "install":
+		display := fs.String("display-name", "xylitol4 SIP proxy", "Name shown in the Services console")
+		description := fs.String("description", "RFC 3261 stateful SIP proxy with registrar and user management", "Description shown in the Services console")
+		manual := fs.Bool("manual", false, "Start the service only on request instead of at boot")
+		fs.Parse(args)
+		return installService(*name, *display, *description, *manual, fs.Args())
+	case "remove":
+		fs.Parse(args)
+		return removeService(*name)
+	case "start":
+		timeout := fs.Duration("timeout", 30*time.Second, "How long to wait for the service to run")
+		fs.Parse(args)
+		return startService(*name, *timeout)
+	case "stop":
+		timeout := fs.Duration("timeout", time.Minute, "How long to wait for the service to stop, draining calls")
+		fs.Parse(args)
+		return stopService(*name, *timeout)
+	case "run":
+		fs.Parse(args)
+		return runAsService(*name, fs.Args())
+	}
+	return fmt.Errorf("unknown action %q: expected install, remove, start, stop, or run", action)
+}
+
+// call invokes proc, returning its error when it reports failure by
+// returning zero.
+func call(proc *syscall.LazyProc, args ...uintptr) (uintptr, error) {
+	r, _, err := proc.Call(args...)
+	if r == 0 {
+		return 0, err
+	}
+	return r, nil
+}
+
+func utf16(s string) *uint16 {
+	p, err := syscall.UTF16PtrFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// openService opens the service name with access, through a connection to
+// the service control manager that closing the returned function releases.
+func openService(name string, access uint32) (uintptr, func(), error) {
+	manager, err := call(procOpenSCManager, 0, 0, scManagerConnect)
+	if err != nil {
+		return 0, nil, fmt.Errorf("connect to the service control manager: %w", err)
+	}
+	service, err := call(procOpenService, manager, uintptr(unsafe.Pointer(utf16(name))), uintptr(access))
+	if err != nil {
+		procCloseServiceHandle.Call(manager)
+		return 0, nil, fmt.Errorf("open service %s: %w", name, err)
+	}
+	return service, func() {
+		procCloseServiceHandle.Call(service)
+		procCloseServiceHandle.Call(manager)
+	}, nil
+}
+
+// installService registers the service to run "sip-proxy service run" with
+// serveArgs, the flags of serve, as the LocalSystem account. Installing needs
+// an administrator.
+func installService(name, display, description string, manual bool, serveArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err = filepath.Abs(exe)
+	if err != nil {
+		return err
+	}
+	words := append([]string{exe, "service", "run", "--name", name, "--"}, serveArgs...)
+	for i, word := range words {
+		words[i] = syscall.EscapeArg(word)
+	}
+	start := uint32(serviceAutoStart)
+	if manual {
+		start = serviceDemandStart
+	}
+
+	manager, err := call(procOpenSCManager, 0, 0, scManagerConnect|scManagerCreateService)
+	if err != nil {
+		return fmt.Errorf("connect to the service control manager (run as administrator): %w", err)
+	}
+	defer procCloseServiceHandle.Call(manager)
+	service, err := call(procCreateService, manager,
+		uintptr(unsafe.Pointer(utf16(name))),
+		uintptr(unsafe.Pointer(utf16(display))),
+		serviceAllAccess, serviceWin32OwnProcess, uintptr(start), serviceErrorNormal,
+		uintptr(unsafe.Pointer(utf16(strings.Join(words, " ")))),
+		0, 0, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("create service %s: %w", name, err)
+	}
+	defer procCloseServiceHandle.Call(service)
+	desc := serviceDescription{description: utf16(description)}
+	if _, err := call(procChangeServiceConfig2, service, serviceConfigDescription, uintptr(unsafe.Pointer(&desc))); err != nil {
+		return fmt.Errorf("describe service %s: %w", name, err)
+	}
+	fmt.Printf("installed service %s running %s\n", name, strings.Join(words, " "))
+	return nil
+}
+
+func removeService(name string) error {
+	service, closeService, err := openService(name, serviceDelete)
+	if err != nil {
+		return err
+	}
+	defer closeService()
+	if _, err := call(procDeleteService, service); err != nil {
+		return fmt.Errorf("remove service %s: %w", name, err)
+	}
+	fmt.Println("removed service", name)
+	return nil
+}
+
+func startService(name string, timeout time.Duration) error {
+	service, closeService, err := openService(name, serviceStart|serviceQueryStatus)
+	if err != nil {
+		return err
+	}
+	defer closeService()
+	if _, err := call(procStartService, service, 0, 0); err != nil {
+		return fmt.Errorf("start service %s: %w", name, err)
+	}
+	if err := waitService(service, serviceRunning, timeout); err != nil {
+		return fmt.Errorf("start service %s: %w", name, err)
+	}
+	fmt.Println("started service", name)
+	return nil
+}
+
+func stopService(name string, timeout time.Duration) error {
+	service, closeService, err := openService(name, serviceStop|serviceQueryStatus)
+	if err != nil {
+		return err
+	}
+	defer closeService()
+	var status serviceStatus
+	if _, err := call(procControlService, service, serviceControlStop, uintptr(unsafe.Pointer(&status))); err != nil {
+		return fmt.Errorf("stop service %s: %w", name, err)
+	}
+	if err := waitService(service, serviceStopped, timeout); err != nil {
+		return fmt.Errorf("stop service %s: %w", name, err)
+	}
+	fmt.Println("stopped service", name)
+	return nil
+}
+
+// waitService polls the service until it reaches state, stops, or timeout
+// passes.
+func waitService(service uintptr, state uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var status serviceStatus
+		if _, err := call(procQueryServiceStatus, service, uintptr(unsafe.Pointer(&status))); err != nil {
+			return err
+		}
+		switch {
+		case status.CurrentState == state:
+			return nil
+		case status.CurrentState == serviceStopped:
+			return fmt.Errorf("the service stopped with exit code %d; see its log", status.Win32ExitCode)
+		case time.Now().After(deadline):
+			return fmt.Errorf("still in state %d after %v", status.CurrentState, timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// windowsService is the service this process runs. The service control
+// manager calls serviceMain and serviceHandler on threads of its own, so
+// they find it here.
+type windowsService struct {
+	name string
+	args []string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	reload   chan struct{}
+
+	mu         sync.Mutex
+	handle     uintptr
+	status     serviceStatus
+	dispatched error
+}
+
+var theService *windowsService
+
+func newWindowsService(name string, serveArgs []string) *windowsService {
+	return &windowsService{
+		name:   name,
+		args:   serveArgs,
+		stop:   make(chan struct{}),
+		reload: make(chan struct{}, 1),
+	}
+}
+
+// runAsService hands the process to the service control manager, which runs
+// serve with serveArgs until the service is stopped. Relative paths in
+// serveArgs are taken from the executable's directory, since services start
+// in the system directory.
+func runAsService(name string, serveArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		return err
+	}
+	theService = newWindowsService(name, serveArgs)
+	table := []serviceTableEntry{
+		{name: utf16(name), proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	if _, err := call(procStartServiceCtrlDispatcher, uintptr(unsafe.Pointer(&table[0]))); err != nil {
+		if errno, ok := err.(syscall.Errno); ok && errno == errorFailedServiceControllerConnect {
+			return errors.New("service run is started by the service control manager; use service start, or serve in a console")
+		}
+		return err
+	}
+	return theService.dispatched
+}
+
+// serviceMain is the ServiceMain of the service.
+func serviceMain(argc, argv uintptr) uintptr {
+	s := theService
+	handle, err := call(procRegisterServiceCtrlHandlerEx, uintptr(unsafe.Pointer(utf16(s.name))), syscall.NewCallback(serviceHandler), 0)
+	if err != nil {
+		s.dispatched = fmt.Errorf("register service control handler: %w", err)
+		return 0
+	}
+	s.mu.Lock()
+	s.handle = handle
+	s.mu.Unlock()
+	s.setState(serviceStartPending, 30*time.Second)
+	serve(s.host(), s.args, false)
+	s.setState(serviceStopped, 0)
+	return 0
+}
+
+// host connects serve to the service: controls stop and reload it, and it
+// reports running and stopping as service states.
+func (s *windowsService) host() host {
+	return host{
+		stop:   s.stop,
+		reload: s.reload,
+		running: func() {
+			s.setState(serviceRunning, 0)
+		},
+		stopping: func() {
+			s.setState(serviceStopPending, time.Minute)
+		},
+	}
+}
+
+// serviceHandler is the HandlerEx of the service.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	return uintptr(theService.handleControl(uint32(control)))
+}
+
+// handleControl acts on a control code from the service control manager and
+// returns the HandlerEx result, which is ERROR_CALL_NOT_IMPLEMENTED for
+// controls the service does not accept.
+func (s *windowsService) handleControl(control uint32) uint32 {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.stopOnce.Do(func() {
+			close(s.stop)
+		})
+	case serviceControlParamChange:
+		select {
+		case s.reload <- struct{}{}:
+		default:
+		}
+	case serviceControlInterrogate:
+		s.mu.Lock()
+		s.report()
+		s.mu.Unlock()
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// setState reports state to the service control manager. waitHint tells it
+// how long a pending state may last before it counts the service as hung.
+func (s *windowsService) setState(state uint32, waitHint time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.ServiceType = serviceWin32OwnProcess
+	s.status.CurrentState = state
+	s.status.WaitHint = uint32(waitHint / time.Millisecond)
+	s.status.ControlsAccepted = 0
+	s.status.CheckPoint = 0
+	switch state {
+	case serviceRunning:
+		s.status.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	case serviceStartPending, serviceStopPending:
+		s.status.CheckPoint = 1
+	}
+	s.report()
+}
+
+// report sends the current status. s.mu must be held.
+func (s *windowsService) report() {
+	if s.handle != 0 {
+		procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+	}
+}
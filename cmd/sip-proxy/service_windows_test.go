@@ -0,0 +1,98 @@
+//go:build windows
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// currentStatus returns the status s last reported.
+func (s *windowsService) currentStatus() serviceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// stopped reports whether s was asked to stop.
+func (s *windowsService) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHandleControlStopsOnStopAndShutdown(t *testing.T) {
+	for _, control := range []uint32{serviceControlStop, serviceControlShutdown} {
+		s := newWindowsService(defaultServiceName, nil)
+		if got := s.handleControl(control); got != 0 {
+			t.Fatalf("control %d: expected NO_ERROR, got %d", control, got)
+		}
+		if !s.stopped() {
+			t.Fatalf("control %d: expected the service to be asked to stop", control)
+		}
+		// The manager sends shutdown to a service already stopping.
+		if s.handleControl(serviceControlShutdown) != 0 || s.handleControl(serviceControlStop) != 0 {
+			t.Fatalf("control %d: expected repeated stops to be accepted", control)
+		}
+	}
+}
+
+func TestHandleControlReloadsAndReports(t *testing.T) {
+	s := newWindowsService(defaultServiceName, nil)
+	for i := 0; i < 3; i++ {
+		if got := s.handleControl(serviceControlParamChange); got != 0 {
+			t.Fatalf("expected NO_ERROR for a parameter change, got %d", got)
+		}
+	}
+	if len(s.reload) != 1 || s.stopped() {
+		t.Fatalf("expected one pending reload and no stop, got %d reloads", len(s.reload))
+	}
+	if got := s.handleControl(serviceControlInterrogate); got != 0 {
+		t.Fatalf("expected NO_ERROR for interrogate, got %d", got)
+	}
+	const servicePause = 2
+	if got := s.handleControl(servicePause); got != errorCallNotImplemented {
+		t.Fatalf("expected ERROR_CALL_NOT_IMPLEMENTED for pause, got %d", got)
+	}
+	if s.stopped() {
+		t.Fatalf("expected only stop and shutdown to stop the service")
+	}
+}
+
+func TestServiceStateTransitions(t *testing.T) {
+	s := newWindowsService(defaultServiceName, nil)
+	h := s.host()
+	ctx, cancel := h.stopContext()
+	defer cancel()
+	const accepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+
+	s.setState(serviceStartPending, 30*time.Second)
+	for _, step := range []struct {
+		name string
+		do   func()
+		want serviceStatus
+	}{
+		{"start pending", func() {}, serviceStatus{CurrentState: serviceStartPending, CheckPoint: 1, WaitHint: 30000}},
+		{"running", h.running, serviceStatus{CurrentState: serviceRunning, ControlsAccepted: accepted}},
+		{"stop control", func() { s.handleControl(serviceControlStop) }, serviceStatus{CurrentState: serviceRunning, ControlsAccepted: accepted}},
+		{"stopping", h.stopping, serviceStatus{CurrentState: serviceStopPending, CheckPoint: 1, WaitHint: 60000}},
+		{"stopped", func() { s.setState(serviceStopped, 0) }, serviceStatus{CurrentState: serviceStopped}},
+	} {
+		step.do()
+		step.want.ServiceType = serviceWin32OwnProcess
+		if got := s.currentStatus(); got != step.want {
+			t.Fatalf("%s: expected %+v, got %+v", step.name, step.want, got)
+		}
+		if step.name == "stop control" {
+			// serve drains once the stop context ends.
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected the stop control to end the stop context")
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals ask the proxy to reload its configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// reloadSignals is empty: Windows has no SIGHUP, so a service reloads on the
+// paramchange control instead.
+var reloadSignals []os.Signal
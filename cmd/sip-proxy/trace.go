@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"xylitol4/sip"
+)
+
+// traceStatus is the body of GET and PUT /api/v1/trace.
+type traceStatus struct {
+	Enabled bool            `json:"enabled"`
+	Filter  sip.TraceFilter `json:"filter"`
+}
+
+// runTrace prints the messages a running proxy traces, read from its JSON
+// API, until interrupted. With a filter it first enables tracing with that
+// filter, and puts the tracer back as it found it on exit.
+func runTrace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	api := fs.String("api", "http://127.0.0.1:8080", "Base URL of the proxy's web interface")
+	token := fs.String("token", os.Getenv("XYLITOL4_API_TOKEN"), "API token with the trace scope (defaults to $XYLITOL4_API_TOKEN)")
+	callID := fs.String("call-id", "", "Only trace messages with this Call-ID")
+	method := fs.String("method", "", "Only trace requests of this method and responses to them")
+	peer := fs.String("peer", "", "Only trace messages to and from this host or host:port")
+	raw := fs.Bool("json", false, "Print each message as a line of JSON")
+	fs.Parse(args)
+	if *token == "" {
+		return errors.New("an API token is required: use --token or $XYLITOL4_API_TOKEN")
+	}
+	client := &traceClient{base: strings.TrimRight(*api, "/"), token: *token}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	filter := sip.TraceFilter{CallID: *callID, Method: *method, Peer: *peer}
+	if filter != (sip.TraceFilter{}) {
+		var previous traceStatus
+		if err := client.do(ctx, http.MethodGet, "/api/v1/trace", nil, &previous); err != nil {
+			return err
+		}
+		if err := client.do(ctx, http.MethodPut, "/api/v1/trace", traceStatus{Enabled: true, Filter: filter}, nil); err != nil {
+			return err
+		}
+		defer func() {
+			restore, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := client.do(restore, http.MethodPut, "/api/v1/trace", previous, nil); err != nil {
+				fmt.Fprintln(os.Stderr, "warning: could not restore the tracer:", err)
+			}
+		}()
+	} else {
+		var status traceStatus
+		if err := client.do(ctx, http.MethodGet, "/api/v1/trace", nil, &status); err != nil {
+			return err
+		}
+		if !status.Enabled {
+			fmt.Fprintln(os.Stderr, "tracing is disabled on the proxy; give a filter such as --method INVITE to enable it")
+		}
+	}
+
+	resp, err := client.send(ctx, http.MethodGet, "/api/v1/trace/stream", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lines.Scan() {
+		if *raw {
+			fmt.Println(lines.Text())
+			continue
+		}
+		var entry sip.TraceEntry
+		if err := json.Unmarshal(lines.Bytes(), &entry); err != nil {
+			return fmt.Errorf("decode trace entry: %w", err)
+		}
+		fmt.Printf("%s %s %s %s\n%s\n", entry.Time.Format("15:04:05.000"), entry.Direction, entry.Side, entry.Peer, strings.TrimRight(entry.Wire, "\r\n"))
+		fmt.Println()
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return lines.Err()
+}
+
+// traceClient calls the proxy's JSON API.
+type traceClient struct {
+	base  string
+	token string
+}
+
+// send makes a request and returns the response when it succeeded.
+func (c *traceClient) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return nil, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, failure.Error)
+	}
+	return resp, nil
+}
+
+// do makes a request and decodes its JSON response into out, when non-nil.
+func (c *traceClient) do(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
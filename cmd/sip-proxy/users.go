@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"xylitol4/internal/config"
+	"xylitol4/sip/userdb"
+)
+
+// cliActor is the audit log actor of changes made from the command line.
+const cliActor = "cli"
+
+// storeFlags are the flags of the commands that open the user database
+// directly, without a running proxy.
+type storeFlags struct {
+	config *string
+	path   *string
+	driver *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) storeFlags {
+	return storeFlags{
+		config: fs.String("config", "", "Configuration file to take user-db and user-db-driver from when the flags are not given"),
+		path:   fs.String("user-db", "", "Path to the SQLite user database, or the LDAP URL for the ldap backend"),
+		driver: fs.String("user-db-driver", "sqlite", "User directory backend: sqlite or ldap"),
+	}
+}
+
+// open opens the user database named by the flags, or by the configuration
+// file for those not given. Opening an SQL database creates or upgrades its
+// schema.
+func (f storeFlags) open(fs *flag.FlagSet) (userdb.Store, error) {
+	path, driver := *f.path, *f.driver
+	if *f.config != "" {
+		root, err := config.Load(*f.config)
+		if err != nil {
+			return nil, err
+		}
+		given := make(map[string]bool)
+		fs.Visit(func(fl *flag.Flag) {
+			given[fl.Name] = true
+		})
+		if value, ok := root.Lookup("user-db"); ok && !given["user-db"] {
+			path = value.Text
+		}
+		if value, ok := root.Lookup("user-db-driver"); ok && !given["user-db-driver"] {
+			driver = value.Text
+		}
+	}
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("the --user-db flag is required")
+	}
+	return userdb.OpenStore(driver, path)
+}
+
+// runUser manages SIP users in the user database.
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected add, list, del, or passwd")
+	}
+	action, args := args[0], args[1:]
+	fs := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	store := addStoreFlags(fs)
+	var password, contact, domain *string
+	switch action {
+	case "add":
+		password = fs.String("password", "", "Password of the new user; read from standard input when empty")
+		contact = fs.String("contact", "", "Static contact URI used when the user has no registration")
+	case "passwd":
+		password = fs.String("password", "", "New password; read from standard input when empty")
+	case "list":
+		domain = fs.String("domain", "", "Only list users of this domain")
+	case "del":
+	default:
+		return fmt.Errorf("unknown action %q: expected add, list, del, or passwd", action)
+	}
+	fs.Parse(args)
+
+	var username, userDomain string
+	if action != "list" {
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expected one user@domain argument")
+		}
+		var ok bool
+		username, userDomain, ok = strings.Cut(fs.Arg(0), "@")
+		if !ok || username == "" || userDomain == "" {
+			return fmt.Errorf("%q is not user@domain", fs.Arg(0))
+		}
+	}
+	if password != nil && *password == "" {
+		read, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		*password = read
+	}
+
+	db, err := store.open(fs)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	address := username + "@" + userDomain
+
+	switch action {
+	case "add":
+		user := userdb.User{
+			Username:     username,
+			Domain:       userDomain,
+			PasswordHash: userdb.HashPassword(username, userDomain, *password),
+			ContactURI:   strings.TrimSpace(*contact),
+		}
+		if err := db.CreateUser(ctx, user); err != nil {
+			return err
+		}
+		recordCLIAudit(ctx, db, "user.create", address)
+		fmt.Println("added", address)
+	case "passwd":
+		if err := db.UpdatePassword(ctx, username, userDomain, userdb.HashPassword(username, userDomain, *password)); err != nil {
+			return err
+		}
+		recordCLIAudit(ctx, db, "user.password", address)
+		fmt.Println("changed the password of", address)
+	case "del":
+		if err := db.DeleteUser(ctx, username, userDomain); err != nil {
+			return err
+		}
+		recordCLIAudit(ctx, db, "user.delete", address)
+		fmt.Println("deleted", address)
+	case "list":
+		users, err := db.AllUsers(ctx)
+		if err != nil {
+			return err
+		}
+		out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(out, "USER\tCONTACT\tSTATUS")
+		for _, user := range users {
+			if *domain != "" && !strings.EqualFold(user.Domain, *domain) {
+				continue
+			}
+			status := "enabled"
+			if user.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(out, "%s@%s\t%s\t%s\n", user.Username, user.Domain, user.ContactURI, status)
+		}
+		return out.Flush()
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of r, so that scripts
+// can pipe it in rather than put it on the command line.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("a password is required on standard input or with --password")
+	}
+	return password, nil
+}
+
+// recordCLIAudit records a change made from the command line in the audit
+// log, as the web interface does for its changes.
+func recordCLIAudit(ctx context.Context, store userdb.Store, action, target string) {
+	entry := userdb.AuditEntry{Actor: cliActor, Action: action, Target: target}
+	if err := store.RecordAudit(ctx, entry); err != nil && !errors.Is(err, userdb.ErrReadOnly) {
+		fmt.Fprintln(os.Stderr, "warning: could not record audit entry:", err)
+	}
+}
+
+// runDB maintains the user database.
+func runDB(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return errors.New("expected migrate")
+	}
+	fs := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	fs.Parse(args[1:])
+
+	db, err := store.open(fs)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	versioned, ok := db.(interface {
+		SchemaVersion(context.Context) (int, error)
+	})
+	if !ok {
+		fmt.Println("the directory has no schema to migrate")
+		return nil
+	}
+	version, err := versioned.SchemaVersion(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user database schema is at version %d\n", version)
+	return nil
+}
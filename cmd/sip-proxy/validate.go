@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"xylitol4/sip"
+)
+
+// deployment is what serve --validate checks beyond the configuration: the
+// resources the proxy takes when it starts.
+type deployment struct {
+	stack *sip.SIPStack
+	// redis is the --registrar-redis URL, or empty.
+	redis string
+	// listen are the TCP addresses the HTTP servers would bind.
+	listen []string
+	// tlsCert and tlsKey are the web interface's key pair, or empty.
+	tlsCert, tlsKey string
+}
+
+// validate opens, binds, and resolves what starting the proxy would, and
+// releases it all again, so that a deployment pipeline learns of a missing
+// database, an unresolvable upstream, or a port in use before the proxy is
+// swapped in. The HTTP addresses are all bound at once, so two servers
+// configured on one address fail as they would at startup.
+func (d deployment) validate(ctx context.Context) error {
+	if err := d.stack.Validate(ctx); err != nil {
+		return err
+	}
+	if d.redis != "" {
+		store, err := sip.OpenRedisRegistrationStore(d.redis)
+		if err != nil {
+			return err
+		}
+		store.Close()
+	}
+	if d.tlsCert != "" || d.tlsKey != "" {
+		if _, err := tls.LoadX509KeyPair(d.tlsCert, d.tlsKey); err != nil {
+			return fmt.Errorf("load TLS key pair: %w", err)
+		}
+	}
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, addr := range d.listen {
+		if addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Command user-web serves the web interface of sip-proxy, its admin pages,
+// self-service portal, and JSON API, on its own against the user database,
+// for deployments that keep it apart from the SIP proxy. It is the same
+// internal/userweb package, and its listen, TLS, and credential flags are
+// named and behave as those of sip-proxy serve. Without a running proxy the
+// registration and call pages report that no registrar is attached.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"xylitol4/internal/metrics"
+	"xylitol4/internal/userweb"
+	"xylitol4/sip/userdb"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// options are the command-line flags.
+type options struct {
+	userDB        string
+	userDBDriver  string
+	httpListen    string
+	httpsListen   string
+	adminListen   string
+	metricsListen string
+	tlsCert       string
+	tlsKey        string
+	adminUser     string
+	adminPass     string
+	apiToken      string
+	templates     string
+	logLevel      string
+	logFormat     string
+}
+
+// secure reports whether the web interface is served over HTTPS.
+func (o options) secure() bool {
+	return o.tlsCert != ""
+}
+
+// newFlagSet defines the flags setting o.
+func newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("user-web", flag.ContinueOnError)
+	fs.StringVar(&o.userDB, "user-db", "", "Path to SQLite database (or LDAP URL for the ldap backend) containing SIP user directory")
+	fs.StringVar(&o.userDBDriver, "user-db-driver", "sqlite", "User directory backend: sqlite or ldap")
+	fs.StringVar(&o.httpListen, "http-listen", ":8080", "HTTP address to listen on (host:port); with TLS enabled it only redirects to HTTPS (empty disables it)")
+	fs.StringVar(&o.httpsListen, "https-listen", ":8443", "HTTPS address to listen on (host:port) when --http-tls-cert and --http-tls-key are set")
+	fs.StringVar(&o.adminListen, "admin-listen", "", "Address (host:port), such as 127.0.0.1:8081, serving the admin pages, JSON API, and /metrics apart from the portal, over HTTPS when TLS is set (empty serves them with the portal)")
+	fs.StringVar(&o.metricsListen, "metrics-listen", "", "HTTP address (host:port) serving Prometheus metrics at /metrics (empty disables)")
+	fs.StringVar(&o.tlsCert, "http-tls-cert", "", "PEM certificate (chain) file serving the web interface over HTTPS")
+	fs.StringVar(&o.tlsKey, "http-tls-key", "", "PEM private key file for --http-tls-cert")
+	fs.StringVar(&o.adminUser, "admin-user", "", "Bootstrap superadmin username for the web interface (further admins are stored in the user database)")
+	fs.StringVar(&o.adminPass, "admin-pass", "", "Bootstrap superadmin password for the web interface")
+	fs.StringVar(&o.apiToken, "api-token", "", "Bearer token enabling the JSON API under /api/v1/")
+	fs.StringVar(&o.templates, "http-templates", "", "Directory of <page>.html templates and messages.<lang>.json catalogs overriding the built-in web pages")
+	fs.StringVar(&o.logLevel, "log-level", "info", "Minimum log level: debug, info, warn, or error")
+	fs.StringVar(&o.logFormat, "log-format", "text", "Log output format: text or json")
+	return fs
+}
+
+// parseOptions parses and checks the command line.
+func parseOptions(args []string, stderr io.Writer) (options, error) {
+	var o options
+	fs := newFlagSet(&o)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if fs.NArg() > 0 {
+		return o, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	o.adminUser = strings.TrimSpace(o.adminUser)
+	o.adminPass = strings.TrimSpace(o.adminPass)
+	o.apiToken = strings.TrimSpace(o.apiToken)
+	switch {
+	case strings.TrimSpace(o.userDB) == "":
+		return o, errors.New("the --user-db flag is required")
+	case (o.adminUser == "") != (o.adminPass == ""):
+		return o, errors.New("both --admin-user and --admin-pass must be provided to enable the web interface")
+	case (o.tlsCert == "") != (o.tlsKey == ""):
+		return o, errors.New("both --http-tls-cert and --http-tls-key must be provided to serve the web interface over HTTPS")
+	case o.secure() && o.httpsListen == "":
+		return o, errors.New("--https-listen is required with --http-tls-cert")
+	case !o.secure() && o.httpListen == "" && o.adminListen == "":
+		return o, errors.New("nothing to serve: set --http-listen, --admin-listen, or TLS")
+	}
+	return o, nil
+}
+
+// newLogger returns the logger writing records at or above o.logLevel to
+// stdout in o.logFormat.
+func newLogger(o options) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(o.logLevel))); err != nil {
+		return nil, fmt.Errorf("invalid --log-level %q: use debug, info, warn, or error", o.logLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(strings.TrimSpace(o.logFormat)) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid --log-format %q: use text or json", o.logFormat)
+}
+
+// servers lays out the HTTP servers as sip-proxy serve does: the web
+// interface on --http-listen or, with TLS, on --https-listen with
+// --http-listen redirecting to it; the admin pages, JSON API, and /metrics
+// on --admin-listen apart from the portal; and /metrics on --metrics-listen.
+// Servers with a TLSConfig are served over HTTPS.
+func servers(o options, web *userweb.Server, registry *metrics.Registry, build userweb.BuildInfo) []*http.Server {
+	newServer := func(addr string, handler http.Handler, secure bool) *http.Server {
+		server := &http.Server{
+			Addr:         addr,
+			Handler:      handler,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+		if secure {
+			server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		return server
+	}
+
+	var list []*http.Server
+	handler := web.Handler()
+	if o.adminListen != "" {
+		handler = web.PortalHandler()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		mux.Handle("/", web.AdminHandler())
+		list = append(list, newServer(o.adminListen, userweb.WithProbes(mux, nil, build), o.secure()))
+	}
+	switch {
+	case o.secure():
+		list = append(list, newServer(o.httpsListen, userweb.WithProbes(handler, nil, build), true))
+		if o.httpListen != "" {
+			list = append(list, newServer(o.httpListen, userweb.WithProbes(userweb.RedirectToHTTPS(o.httpsListen), nil, build), false))
+		}
+	case o.httpListen != "":
+		list = append(list, newServer(o.httpListen, userweb.WithProbes(handler, nil, build), false))
+	}
+	if o.metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry.Handler())
+		list = append(list, newServer(o.metricsListen, mux, false))
+	}
+	for _, server := range list {
+		// Open trace streams would otherwise hold Shutdown until its deadline.
+		server.RegisterOnShutdown(web.CloseStreams)
+	}
+	return list
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// run serves the web interface until interrupted and returns the exit status.
+func run(args []string, stderr io.Writer) int {
+	o, err := parseOptions(args, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "user-web:", err)
+		return 2
+	}
+	logger, err := newLogger(o)
+	if err != nil {
+		fmt.Fprintln(stderr, "user-web:", err)
+		return 2
+	}
+	slog.SetDefault(logger)
+	build := userweb.ReadBuildInfo(version)
+	logger.Info("starting xylitol4 user-web", "version", build.Version, "commit", build.Commit)
+
+	if o.secure() {
+		// Load the key pair up front so that a bad file stops startup
+		// instead of failing in the listener goroutine.
+		if _, err := tls.LoadX509KeyPair(o.tlsCert, o.tlsKey); err != nil {
+			logger.Error("failed to load web interface TLS certificate", "error", err)
+			return 1
+		}
+	}
+	store, err := userdb.OpenStore(o.userDBDriver, o.userDB)
+	if err != nil {
+		logger.Error("failed to open user database", "error", err)
+		return 1
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Error("error closing user database", "error", err)
+		}
+	}()
+
+	var registry *metrics.Registry
+	if o.metricsListen != "" || o.adminListen != "" {
+		registry = metrics.NewRegistry()
+	}
+	web, err := userweb.New(userweb.Config{
+		Store:       store,
+		AdminUser:   o.adminUser,
+		AdminPass:   o.adminPass,
+		APIToken:    o.apiToken,
+		TemplateDir: o.templates,
+		Logger:      logger.With("component", "userweb"),
+		Metrics:     registry,
+	})
+	if err != nil {
+		logger.Error("failed to construct user web server", "error", err)
+		return 1
+	}
+
+	// Bind every listener before serving, so that a taken port fails
+	// startup rather than one server.
+	list := servers(o, web, registry, build)
+	listeners := make([]net.Listener, len(list))
+	for i, server := range list {
+		listeners[i], err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			logger.Error("failed to listen for HTTP", "addr", server.Addr, "error", err)
+			for _, listener := range listeners[:i] {
+				listener.Close()
+			}
+			return 1
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	errCh := make(chan error, len(list))
+	for i, server := range list {
+		go func(server *http.Server, listener net.Listener) {
+			var err error
+			if server.TLSConfig != nil {
+				logger.Info("web interface listening", "addr", listener.Addr().String(), "scheme", "https")
+				err = server.ServeTLS(listener, o.tlsCert, o.tlsKey)
+			} else {
+				logger.Info("web interface listening", "addr", listener.Addr().String(), "scheme", "http")
+				err = server.Serve(listener)
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errCh <- err
+		}(server, listeners[i])
+	}
+
+	status := 0
+	select {
+	case <-ctx.Done():
+		logger.Info("shutdown requested, stopping user-web")
+	case err := <-errCh:
+		logger.Error("HTTP server error", "error", err)
+		status = 1
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	for _, server := range list {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("error shutting down HTTP server", "addr", server.Addr, "error", err)
+		}
+	}
+	logger.Info("shutdown complete")
+	return status
+}
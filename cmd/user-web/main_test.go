@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"xylitol4/internal/metrics"
+	"xylitol4/internal/userweb"
+	"xylitol4/sip/userdb"
+)
+
+// serveStringFlags returns the defaults of the string flags sip-proxy serve
+// defines, read from its source.
+func serveStringFlags(t *testing.T) map[string]string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join("..", "sip-proxy", "main.go"), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := make(map[string]string)
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 3 {
+			return true
+		}
+		fun, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || fun.Sel.Name != "String" {
+			return true
+		}
+		if pkg, ok := fun.X.(*ast.Ident); !ok || pkg.Name != "flag" {
+			return true
+		}
+		name, nameOK := call.Args[0].(*ast.BasicLit)
+		value, valueOK := call.Args[1].(*ast.BasicLit)
+		if nameOK && valueOK {
+			unquotedName, _ := strconv.Unquote(name.Value)
+			defaults[unquotedName], _ = strconv.Unquote(value.Value)
+		}
+		return true
+	})
+	if len(defaults) == 0 {
+		t.Fatalf("found no flags in sip-proxy")
+	}
+	return defaults
+}
+
+func TestFlagsMatchSIPProxyServe(t *testing.T) {
+	defaults := serveStringFlags(t)
+	newFlagSet(&options{}).VisitAll(func(f *flag.Flag) {
+		want, ok := defaults[f.Name]
+		if !ok {
+			t.Errorf("sip-proxy serve has no --%s flag", f.Name)
+		} else if f.DefValue != want {
+			t.Errorf("--%s defaults to %q, but to %q in sip-proxy serve", f.Name, f.DefValue, want)
+		}
+	})
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"--user-db", "users.db"}, ""},
+		{[]string{"--user-db", "users.db", "--admin-user", " admin ", "--admin-pass", "secret"}, ""},
+		{[]string{"--user-db", "users.db", "--http-listen", "", "--admin-listen", "127.0.0.1:8081"}, ""},
+		{[]string{"--user-db", "users.db", "--http-listen", "", "--http-tls-cert", "c.pem", "--http-tls-key", "k.pem"}, ""},
+		{nil, "the --user-db flag is required"},
+		{[]string{"--user-db", " "}, "the --user-db flag is required"},
+		{[]string{"--user-db", "users.db", "serve"}, `unexpected argument "serve"`},
+		{[]string{"--user-db", "users.db", "--admin-user", "admin"}, "both --admin-user and --admin-pass must be provided to enable the web interface"},
+		{[]string{"--user-db", "users.db", "--admin-pass", "secret"}, "both --admin-user and --admin-pass must be provided to enable the web interface"},
+		{[]string{"--user-db", "users.db", "--http-tls-cert", "c.pem"}, "both --http-tls-cert and --http-tls-key must be provided to serve the web interface over HTTPS"},
+		{[]string{"--user-db", "users.db", "--http-tls-key", "k.pem"}, "both --http-tls-cert and --http-tls-key must be provided to serve the web interface over HTTPS"},
+		{[]string{"--user-db", "users.db", "--https-listen", "", "--http-tls-cert", "c.pem", "--http-tls-key", "k.pem"}, "--https-listen is required with --http-tls-cert"},
+		{[]string{"--user-db", "users.db", "--http-listen", ""}, "nothing to serve: set --http-listen, --admin-listen, or TLS"},
+		{[]string{"--user-db", "users.db", "--listen", ":5060"}, "flag provided but not defined: -listen"},
+	} {
+		o, err := parseOptions(tt.args, io.Discard)
+		if tt.err == "" && err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.args, err)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Fatalf("%q: expected %q, got %v", tt.args, tt.err, err)
+		}
+		if err == nil && o.adminUser != strings.TrimSpace(o.adminUser) {
+			t.Fatalf("expected the admin user trimmed, got %q", o.adminUser)
+		}
+	}
+	if code := run([]string{"-h"}, io.Discard); code != 0 {
+		t.Fatalf("expected -h to succeed, got %d", code)
+	}
+	if code := run(nil, io.Discard); code != 2 {
+		t.Fatalf("expected a usage error to exit with 2, got %d", code)
+	}
+}
+
+func TestServersAreLaidOutAsInSIPProxyServe(t *testing.T) {
+	store, err := userdb.OpenSQLite(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	registry := metrics.NewRegistry()
+	web, err := userweb.New(userweb.Config{
+		Store:     store,
+		AdminUser: "admin",
+		AdminPass: "secret",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:   registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := options{httpListen: ":8080", httpsListen: ":8443"}
+	withTLS := func(o options) options {
+		o.tlsCert, o.tlsKey = "cert.pem", "key.pem"
+		return o
+	}
+	split := base
+	split.adminListen = "127.0.0.1:8081"
+	everything := withTLS(split)
+	everything.metricsListen = ":9090"
+
+	// Each server is "addr scheme" followed by the status of some paths.
+	type want struct {
+		server string
+		paths  map[string]int
+	}
+	for _, tt := range []struct {
+		name string
+		o    options
+		want []want
+	}{
+		{"plain", base, []want{
+			{":8080 http", map[string]int{"/login": 200, "/portal/login": 200, "/healthz": 200}},
+		}},
+		{"TLS", withTLS(base), []want{
+			{":8443 https", map[string]int{"/login": 200, "/portal/login": 200, "/healthz": 200}},
+			{":8080 http", map[string]int{"/login": 308, "/portal/login": 308, "/healthz": 200}},
+		}},
+		{"admin apart", split, []want{
+			{"127.0.0.1:8081 http", map[string]int{"/login": 200, "/metrics": 200, "/portal/login": 404, "/healthz": 200}},
+			{":8080 http", map[string]int{"/login": 404, "/metrics": 404, "/admin/users": 404, "/portal/login": 200}},
+		}},
+		{"everything", everything, []want{
+			{"127.0.0.1:8081 https", map[string]int{"/login": 200, "/metrics": 200, "/portal/login": 404}},
+			{":8443 https", map[string]int{"/login": 404, "/api/v1/users": 404, "/portal/login": 200}},
+			{":8080 http", map[string]int{"/portal/login": 308}},
+			{":9090 http", map[string]int{"/metrics": 200, "/login": 404}},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			list := servers(tt.o, web, registry, userweb.BuildInfo{})
+			if len(list) != len(tt.want) {
+				t.Fatalf("expected %d servers, got %d", len(tt.want), len(list))
+			}
+			for i, server := range list {
+				scheme := "http"
+				if server.TLSConfig != nil {
+					scheme = "https"
+				}
+				if got := server.Addr + " " + scheme; got != tt.want[i].server {
+					t.Fatalf("server %d: expected %s, got %s", i, tt.want[i].server, got)
+				}
+				for path, code := range tt.want[i].paths {
+					rec := httptest.NewRecorder()
+					server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://proxy.example"+path, nil))
+					if rec.Code != code {
+						t.Fatalf("%s%s: expected %d, got %d", tt.want[i].server, path, code, rec.Code)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+// backend is where userctl makes its changes: the user database itself, or a
+// running proxy's JSON API.
+type backend interface {
+	Users(ctx context.Context) ([]userdb.User, error)
+	CreateUser(ctx context.Context, user userdb.User) error
+	DeleteUser(ctx context.Context, username, domain string) error
+	SetPassword(ctx context.Context, username, domain, hash string) error
+	SetEnabled(ctx context.Context, username, domain string, enabled bool) error
+	Rules(ctx context.Context) ([]userdb.BroadcastRule, error)
+	CreateRule(ctx context.Context, rule userdb.BroadcastRule) (int64, error)
+	UpdateRule(ctx context.Context, rule userdb.BroadcastRule) error
+	DeleteRule(ctx context.Context, id int64) error
+	Close() error
+}
+
+// auditActor is the audit log actor of changes made directly to the
+// database; the JSON API records the token instead.
+const auditActor = "userctl"
+
+// storeBackend changes the user database directly.
+type storeBackend struct {
+	store  userdb.Store
+	errOut io.Writer
+}
+
+// audit records a change in the audit log, as the web interface does for its
+// changes.
+func (b storeBackend) audit(ctx context.Context, action, target string) {
+	entry := userdb.AuditEntry{Actor: auditActor, Action: action, Target: target}
+	if err := b.store.RecordAudit(ctx, entry); err != nil && !errors.Is(err, userdb.ErrReadOnly) {
+		fmt.Fprintln(b.errOut, "userctl: warning: could not record audit entry:", err)
+	}
+}
+
+func (b storeBackend) Users(ctx context.Context) ([]userdb.User, error) {
+	return b.store.AllUsers(ctx)
+}
+
+func (b storeBackend) CreateUser(ctx context.Context, user userdb.User) error {
+	if err := b.store.CreateUser(ctx, user); err != nil {
+		return err
+	}
+	b.audit(ctx, "user.create", user.Username+"@"+user.Domain)
+	return nil
+}
+
+func (b storeBackend) DeleteUser(ctx context.Context, username, domain string) error {
+	if err := b.store.DeleteUser(ctx, username, domain); err != nil {
+		return err
+	}
+	b.audit(ctx, "user.delete", username+"@"+domain)
+	return nil
+}
+
+func (b storeBackend) SetPassword(ctx context.Context, username, domain, hash string) error {
+	if err := b.store.UpdatePassword(ctx, username, domain, hash); err != nil {
+		return err
+	}
+	b.audit(ctx, "user.password", username+"@"+domain)
+	return nil
+}
+
+func (b storeBackend) SetEnabled(ctx context.Context, username, domain string, enabled bool) error {
+	if err := b.store.SetUserEnabled(ctx, username, domain, enabled); err != nil {
+		return err
+	}
+	b.audit(ctx, "user.update", username+"@"+domain)
+	return nil
+}
+
+func (b storeBackend) Rules(ctx context.Context) ([]userdb.BroadcastRule, error) {
+	return b.store.ListBroadcastRules(ctx)
+}
+
+func (b storeBackend) CreateRule(ctx context.Context, rule userdb.BroadcastRule) (int64, error) {
+	created, err := b.store.CreateBroadcastRule(ctx, rule)
+	if err != nil {
+		return 0, err
+	}
+	b.audit(ctx, "broadcast.create", strconv.FormatInt(created.ID, 10))
+	return created.ID, nil
+}
+
+func (b storeBackend) UpdateRule(ctx context.Context, rule userdb.BroadcastRule) error {
+	if err := b.store.UpdateBroadcastRule(ctx, rule); err != nil {
+		return err
+	}
+	if err := b.store.ReplaceBroadcastTargets(ctx, rule.ID, rule.Targets); err != nil {
+		return err
+	}
+	b.audit(ctx, "broadcast.update", strconv.FormatInt(rule.ID, 10))
+	return nil
+}
+
+func (b storeBackend) DeleteRule(ctx context.Context, id int64) error {
+	if err := b.store.DeleteBroadcastRule(ctx, id); err != nil {
+		return err
+	}
+	b.audit(ctx, "broadcast.delete", strconv.FormatInt(id, 10))
+	return nil
+}
+
+func (b storeBackend) Close() error {
+	return b.store.Close()
+}
+
+// apiUser and apiBroadcastRule are the JSON forms the API exchanges.
+type apiUser struct {
+	Username     string `json:"username"`
+	Domain       string `json:"domain"`
+	ContactURI   string `json:"contact_uri,omitempty"`
+	Enabled      bool   `json:"enabled"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+type apiBroadcastRule struct {
+	ID          int64    `json:"id"`
+	Address     string   `json:"address"`
+	Description string   `json:"description,omitempty"`
+	Targets     []string `json:"targets"`
+}
+
+func toAPIRule(rule userdb.BroadcastRule) apiBroadcastRule {
+	targets := make([]string, len(rule.Targets))
+	for i, target := range rule.Targets {
+		targets[i] = target.ContactURI
+	}
+	return apiBroadcastRule{ID: rule.ID, Address: rule.Address, Description: rule.Description, Targets: targets}
+}
+
+// apiBackend makes changes through the JSON API of a running proxy, which
+// applies them at once and records them against the token.
+type apiBackend struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// call sends body as JSON and decodes the response into out when non-nil.
+func (b apiBackend) call(ctx context.Context, method, path string, body, out any) error {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.base+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		if failure.Error == "" {
+			failure.Error = resp.Status
+		}
+		return &apiError{Status: resp.StatusCode, Msg: failure.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// apiError is an error answer of the API.
+type apiError struct {
+	Status int
+	Msg    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API: %s (HTTP %d)", e.Msg, e.Status)
+}
+
+// isExists reports whether err says the user already exists.
+func isExists(err error) bool {
+	var failure *apiError
+	return errors.Is(err, userdb.ErrUserExists) || (errors.As(err, &failure) && failure.Status == http.StatusConflict)
+}
+
+// isNotFound reports whether err says the user or rule does not exist.
+func isNotFound(err error) bool {
+	var failure *apiError
+	return errors.Is(err, userdb.ErrUserNotFound) || errors.Is(err, userdb.ErrBroadcastRuleNotFound) ||
+		(errors.As(err, &failure) && failure.Status == http.StatusNotFound)
+}
+
+func userPath(username, domain string) string {
+	return "/api/v1/users/" + url.PathEscape(username+"@"+domain)
+}
+
+func (b apiBackend) Users(ctx context.Context) ([]userdb.User, error) {
+	var list []apiUser
+	if err := b.call(ctx, http.MethodGet, "/api/v1/users", nil, &list); err != nil {
+		return nil, err
+	}
+	users := make([]userdb.User, len(list))
+	for i, user := range list {
+		users[i] = userdb.User{Username: user.Username, Domain: user.Domain, ContactURI: user.ContactURI, Disabled: !user.Enabled}
+	}
+	return users, nil
+}
+
+func (b apiBackend) CreateUser(ctx context.Context, user userdb.User) error {
+	in := apiUser{Username: user.Username, Domain: user.Domain, ContactURI: user.ContactURI, PasswordHash: user.PasswordHash}
+	if err := b.call(ctx, http.MethodPost, "/api/v1/users", in, nil); err != nil {
+		return err
+	}
+	if user.Disabled {
+		return b.SetEnabled(ctx, user.Username, user.Domain, false)
+	}
+	return nil
+}
+
+func (b apiBackend) DeleteUser(ctx context.Context, username, domain string) error {
+	return b.call(ctx, http.MethodDelete, userPath(username, domain), nil, nil)
+}
+
+func (b apiBackend) SetPassword(ctx context.Context, username, domain, hash string) error {
+	return b.call(ctx, http.MethodPut, userPath(username, domain)+"/password", map[string]string{"password_hash": hash}, nil)
+}
+
+func (b apiBackend) SetEnabled(ctx context.Context, username, domain string, enabled bool) error {
+	return b.call(ctx, http.MethodPatch, userPath(username, domain), map[string]bool{"enabled": enabled}, nil)
+}
+
+func (b apiBackend) Rules(ctx context.Context) ([]userdb.BroadcastRule, error) {
+	var list []apiBroadcastRule
+	if err := b.call(ctx, http.MethodGet, "/api/v1/broadcast-rules", nil, &list); err != nil {
+		return nil, err
+	}
+	rules := make([]userdb.BroadcastRule, len(list))
+	for i, in := range list {
+		rules[i] = userdb.BroadcastRule{ID: in.ID, Address: in.Address, Description: in.Description}
+		for priority, contact := range in.Targets {
+			rules[i].Targets = append(rules[i].Targets, userdb.BroadcastTarget{RuleID: in.ID, ContactURI: contact, Priority: priority})
+		}
+	}
+	return rules, nil
+}
+
+func (b apiBackend) CreateRule(ctx context.Context, rule userdb.BroadcastRule) (int64, error) {
+	var created apiBroadcastRule
+	if err := b.call(ctx, http.MethodPost, "/api/v1/broadcast-rules", toAPIRule(rule), &created); err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+func (b apiBackend) UpdateRule(ctx context.Context, rule userdb.BroadcastRule) error {
+	return b.call(ctx, http.MethodPut, "/api/v1/broadcast-rules/"+strconv.FormatInt(rule.ID, 10), toAPIRule(rule), nil)
+}
+
+func (b apiBackend) DeleteRule(ctx context.Context, id int64) error {
+	return b.call(ctx, http.MethodDelete, "/api/v1/broadcast-rules/"+strconv.FormatInt(id, 10), nil, nil)
+}
+
+func (b apiBackend) Close() error {
+	return nil
+}
+
+// newAPIBackend checks the API's base URL.
+func newAPIBackend(base, token string, client *http.Client) (apiBackend, error) {
+	base = strings.TrimRight(strings.TrimSpace(base), "/")
+	parsed, err := url.Parse(base)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return apiBackend{}, fmt.Errorf("invalid --api %q: use http://host:port or https://host:port", base)
+	}
+	if token == "" {
+		return apiBackend{}, errors.New("an API token is required with --api: use --token or $XYLITOL4_API_TOKEN")
+	}
+	return apiBackend{base: base, token: token, client: client}, nil
+}
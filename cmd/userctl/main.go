@@ -0,0 +1,430 @@
+// Command userctl provisions SIP users and broadcast rules from scripts and
+// CI fixtures. It changes the user database file directly, or a running
+// proxy through its JSON API, and exits with status 0 on success, 1 when a
+// change fails, and 2 on a usage error.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// usageError is an error in the command line, reported with exit status 2.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...any) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: userctl [--db path | --api url] <command> [flags] [arguments]
+
+Commands:
+  user list [--domain d] [--json]
+  user add [--password p | --password-hash h] [--contact uri] [--disabled] [--exist-ok] user@domain
+  user del [--missing-ok] user@domain
+  user passwd [--password p | --password-hash h] user@domain
+  user enable user@domain
+  user disable user@domain
+  rule list [--json]
+  rule set [--description text] address target...
+  rule del [--missing-ok] address|id
+
+Passwords not given by flag are read from the first line of standard input.
+
+Global flags:
+`)
+}
+
+// streams are the standard streams a command reads and writes.
+type streams struct {
+	in          io.Reader
+	out, errOut io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], streams{in: os.Stdin, out: os.Stdout, errOut: os.Stderr}))
+}
+
+// run runs the command line args and returns the exit status.
+func run(args []string, std streams) int {
+	global := flag.NewFlagSet("userctl", flag.ContinueOnError)
+	global.SetOutput(std.errOut)
+	dbPath := global.String("db", "", "Path to the SQLite user database")
+	driver := global.String("db-driver", "sqlite", "User database backend: sqlite")
+	api := global.String("api", "", "Base URL of a running proxy's web interface, used instead of --db")
+	token := global.String("token", os.Getenv("XYLITOL4_API_TOKEN"), "API token for --api (defaults to $XYLITOL4_API_TOKEN)")
+	timeout := global.Duration("timeout", 30*time.Second, "Time limit of the whole command")
+	global.Usage = func() {
+		usage(global.Output())
+		global.PrintDefaults()
+	}
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	err := execute(global.Args(), std, func() (backend, error) {
+		switch {
+		case *api != "" && *dbPath != "":
+			return nil, usagef("give either --db or --api, not both")
+		case *api != "":
+			return newAPIBackend(*api, *token, &http.Client{Timeout: *timeout})
+		case strings.TrimSpace(*dbPath) == "":
+			return nil, usagef("either --db or --api is required")
+		}
+		store, err := userdb.OpenStore(*driver, *dbPath)
+		if err != nil {
+			return nil, err
+		}
+		return storeBackend{store: store, errOut: std.errOut}, nil
+	}, *timeout)
+	if err == nil {
+		return 0
+	}
+	fmt.Fprintln(std.errOut, "userctl:", err)
+	var bad usageError
+	if errors.As(err, &bad) {
+		return 2
+	}
+	return 1
+}
+
+// execute parses the command and its flags before opening the backend, so
+// that a mistyped command changes nothing.
+func execute(args []string, std streams, open func() (backend, error), timeout time.Duration) error {
+	if len(args) < 2 {
+		usage(std.errOut)
+		return usagef("expected a command such as \"user list\"")
+	}
+	var cmd func(context.Context, backend) error
+	var err error
+	switch args[0] {
+	case "user":
+		cmd, err = userCommand(args[1], args[2:], std)
+	case "rule":
+		cmd, err = ruleCommand(args[1], args[2:], std)
+	default:
+		return usagef("unknown command %q: expected user or rule", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	b, err := open()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cmd(ctx, b)
+}
+
+// parseFlags parses the flags of a command and checks its argument count.
+func parseFlags(fs *flag.FlagSet, args []string, min, max int) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return usagef("%s: %v", fs.Name(), err)
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		return usagef("%s: wrong number of arguments", fs.Name())
+	}
+	return nil
+}
+
+// splitAddress splits user@domain.
+func splitAddress(address string) (string, string, error) {
+	username, domain, ok := strings.Cut(strings.TrimSpace(address), "@")
+	if !ok || username == "" || domain == "" {
+		return "", "", usagef("%q is not user@domain", address)
+	}
+	return username, domain, nil
+}
+
+// passwordHash returns the hash to store for user from the --password or
+// --password-hash flag, or from a password read from stdin. The hash is
+// computed here so that a plain password never reaches the API.
+func passwordHash(stdin io.Reader, username, domain, password, hash string) (string, error) {
+	switch {
+	case password != "" && hash != "":
+		return "", usagef("give either --password or --password-hash, not both")
+	case hash != "":
+		return strings.TrimSpace(hash), nil
+	case password == "":
+		read, err := readPassword(stdin)
+		if err != nil {
+			return "", err
+		}
+		password = read
+	}
+	return userdb.HashPassword(username, domain, password), nil
+}
+
+// readPassword reads a password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("a password is required on standard input, or with --password or --password-hash")
+	}
+	return password, nil
+}
+
+func userCommand(action string, args []string, std streams) (func(context.Context, backend) error, error) {
+	fs := flag.NewFlagSet("user "+action, flag.ContinueOnError)
+	switch action {
+	case "list":
+		domain := fs.String("domain", "", "Only list users of this domain")
+		asJSON := fs.Bool("json", false, "Print the users as a JSON array")
+		if err := parseFlags(fs, args, 0, 0); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, b backend) error {
+			users, err := b.Users(ctx)
+			if err != nil {
+				return err
+			}
+			return printUsers(std.out, users, *domain, *asJSON)
+		}, nil
+
+	case "add":
+		password := fs.String("password", "", "Password of the new user")
+		hash := fs.String("password-hash", "", "Digest hash of the new user's password, instead of --password")
+		contact := fs.String("contact", "", "Static contact URI used when the user has no registration")
+		disabled := fs.Bool("disabled", false, "Create the user disabled")
+		existOK := fs.Bool("exist-ok", false, "Succeed without changes when the user already exists")
+		if err := parseFlags(fs, args, 1, 1); err != nil {
+			return nil, err
+		}
+		username, domain, err := splitAddress(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		if *contact != "" {
+			if _, err := userdb.ParseContactURI(*contact); err != nil {
+				return nil, usagef("invalid --contact: %v", err)
+			}
+		}
+		digest, err := passwordHash(std.in, username, domain, *password, *hash)
+		if err != nil {
+			return nil, err
+		}
+		user := userdb.User{Username: username, Domain: domain, PasswordHash: digest, ContactURI: strings.TrimSpace(*contact), Disabled: *disabled}
+		return func(ctx context.Context, b backend) error {
+			err := b.CreateUser(ctx, user)
+			if err != nil && !(*existOK && isExists(err)) {
+				return err
+			}
+			return nil
+		}, nil
+
+	case "del":
+		missingOK := fs.Bool("missing-ok", false, "Succeed when the user does not exist")
+		if err := parseFlags(fs, args, 1, 1); err != nil {
+			return nil, err
+		}
+		username, domain, err := splitAddress(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, b backend) error {
+			err := b.DeleteUser(ctx, username, domain)
+			if err != nil && !(*missingOK && isNotFound(err)) {
+				return err
+			}
+			return nil
+		}, nil
+
+	case "passwd":
+		password := fs.String("password", "", "New password")
+		hash := fs.String("password-hash", "", "Digest hash of the new password")
+		if err := parseFlags(fs, args, 1, 1); err != nil {
+			return nil, err
+		}
+		username, domain, err := splitAddress(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		digest, err := passwordHash(std.in, username, domain, *password, *hash)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, b backend) error {
+			return b.SetPassword(ctx, username, domain, digest)
+		}, nil
+
+	case "enable", "disable":
+		if err := parseFlags(fs, args, 1, 1); err != nil {
+			return nil, err
+		}
+		username, domain, err := splitAddress(fs.Arg(0))
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, b backend) error {
+			return b.SetEnabled(ctx, username, domain, action == "enable")
+		}, nil
+	}
+	return nil, usagef("unknown user command %q: expected list, add, del, passwd, enable, or disable", action)
+}
+
+// printUsers prints users as a table, or as the JSON the API lists them in.
+func printUsers(w io.Writer, users []userdb.User, domain string, asJSON bool) error {
+	list := make([]apiUser, 0, len(users))
+	for _, user := range users {
+		if domain != "" && !strings.EqualFold(user.Domain, domain) {
+			continue
+		}
+		list = append(list, apiUser{Username: user.Username, Domain: user.Domain, ContactURI: user.ContactURI, Enabled: !user.Disabled})
+	}
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "USER\tCONTACT\tSTATUS")
+	for _, user := range list {
+		status := "enabled"
+		if !user.Enabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(out, "%s@%s\t%s\t%s\n", user.Username, user.Domain, user.ContactURI, status)
+	}
+	return out.Flush()
+}
+
+func ruleCommand(action string, args []string, std streams) (func(context.Context, backend) error, error) {
+	fs := flag.NewFlagSet("rule "+action, flag.ContinueOnError)
+	switch action {
+	case "list":
+		asJSON := fs.Bool("json", false, "Print the rules as a JSON array")
+		if err := parseFlags(fs, args, 0, 0); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, b backend) error {
+			rules, err := b.Rules(ctx)
+			if err != nil {
+				return err
+			}
+			return printRules(std.out, rules, *asJSON)
+		}, nil
+
+	case "set":
+		description := fs.String("description", "", "Description of the rule")
+		if err := parseFlags(fs, args, 2, -1); err != nil {
+			return nil, err
+		}
+		address := strings.TrimSpace(fs.Arg(0))
+		rule := userdb.BroadcastRule{Address: address, Description: strings.TrimSpace(*description)}
+		for priority, target := range fs.Args()[1:] {
+			if _, err := userdb.ParseContactURI(target); err != nil {
+				return nil, usagef("invalid target %q: %v", target, err)
+			}
+			rule.Targets = append(rule.Targets, userdb.BroadcastTarget{ContactURI: strings.TrimSpace(target), Priority: priority})
+		}
+		return func(ctx context.Context, b backend) error {
+			return setRule(ctx, std.out, b, rule)
+		}, nil
+
+	case "del":
+		missingOK := fs.Bool("missing-ok", false, "Succeed when the rule does not exist")
+		if err := parseFlags(fs, args, 1, 1); err != nil {
+			return nil, err
+		}
+		name := strings.TrimSpace(fs.Arg(0))
+		return func(ctx context.Context, b backend) error {
+			id, err := findRule(ctx, b, name)
+			if err == nil {
+				err = b.DeleteRule(ctx, id)
+			}
+			if err != nil && !(*missingOK && isNotFound(err)) {
+				return err
+			}
+			return nil
+		}, nil
+	}
+	return nil, usagef("unknown rule command %q: expected list, set, or del", action)
+}
+
+// setRule makes rule the broadcast rule of its address: it replaces the
+// description and targets of an existing rule, or creates one, so that
+// running the same command twice leaves one rule. It prints the rule's ID to
+// w.
+func setRule(ctx context.Context, w io.Writer, b backend, rule userdb.BroadcastRule) error {
+	id, err := findRule(ctx, b, rule.Address)
+	switch {
+	case err == nil:
+		rule.ID = id
+		for i := range rule.Targets {
+			rule.Targets[i].RuleID = id
+		}
+		err = b.UpdateRule(ctx, rule)
+	case isNotFound(err):
+		id, err = b.CreateRule(ctx, rule)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, id)
+	return nil
+}
+
+// findRule returns the ID of the rule named by its ID or its address.
+func findRule(ctx context.Context, b backend, name string) (int64, error) {
+	rules, err := b.Rules(ctx)
+	if err != nil {
+		return 0, err
+	}
+	id, numeric := strconv.ParseInt(name, 10, 64)
+	for _, rule := range rules {
+		if (numeric == nil && rule.ID == id) || strings.EqualFold(rule.Address, name) {
+			return rule.ID, nil
+		}
+	}
+	return 0, userdb.ErrBroadcastRuleNotFound
+}
+
+// printRules prints rules as a table, or as the JSON the API lists them in.
+func printRules(w io.Writer, rules []userdb.BroadcastRule, asJSON bool) error {
+	if asJSON {
+		list := make([]apiBroadcastRule, len(rules))
+		for i, rule := range rules {
+			list[i] = toAPIRule(rule)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	out := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tADDRESS\tTARGETS\tDESCRIPTION")
+	for _, rule := range rules {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", rule.ID, rule.Address, strings.Join(toAPIRule(rule).Targets, ","), rule.Description)
+	}
+	return out.Flush()
+}
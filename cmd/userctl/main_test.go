@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xylitol4/sip/userdb"
+)
+
+// userctl runs args with stdin as the standard input and returns the exit
+// status and what the command wrote.
+func userctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, streams{in: strings.NewReader(stdin), out: &stdout, errOut: &stderr})
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunRejectsBadCommandLines(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "users.db")
+	for _, tt := range []struct {
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+	}{
+		{nil, "", 2, "Usage: userctl"},
+		{[]string{"--db", db}, "", 2, "userctl: expected a command such as \"user list\"\n"},
+		{[]string{"--db", db, "user"}, "", 2, "userctl: expected a command such as \"user list\"\n"},
+		{[]string{"--frob", "user", "list"}, "", 2, "flag provided but not defined: -frob\n"},
+		{[]string{"--db", db, "group", "list"}, "", 2, "userctl: unknown command \"group\": expected user or rule\n"},
+		{[]string{"--db", db, "user", "rename", "alice@example.com"}, "", 2, "userctl: unknown user command \"rename\": expected list, add, del, passwd, enable, or disable\n"},
+		{[]string{"--db", db, "user", "list", "extra"}, "", 2, "userctl: user list: wrong number of arguments\n"},
+		{[]string{"--db", db, "user", "list", "--frob"}, "", 2, "userctl: user list: flag provided but not defined: -frob\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw"}, "", 2, "userctl: user add: wrong number of arguments\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw", "a@example.com", "b@example.com"}, "", 2, "userctl: user add: wrong number of arguments\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw", "alice"}, "", 2, "userctl: \"alice\" is not user@domain\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw", "@example.com"}, "", 2, "userctl: \"@example.com\" is not user@domain\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw", "--password-hash", "abc", "alice@example.com"}, "", 2, "userctl: give either --password or --password-hash, not both\n"},
+		{[]string{"--db", db, "user", "add", "--password", "pw", "--contact", "mailto:alice", "alice@example.com"}, "", 2, "userctl: invalid --contact: "},
+		{[]string{"--db", db, "user", "add", "alice@example.com"}, "\n", 1, "userctl: a password is required on standard input, or with --password or --password-hash\n"},
+		{[]string{"--db", db, "user", "passwd", "alice@example.com"}, "", 1, "userctl: a password is required on standard input, or with --password or --password-hash\n"},
+		{[]string{"--db", db, "user", "del"}, "", 2, "userctl: user del: wrong number of arguments\n"},
+		{[]string{"--db", db, "user", "disable", "alice"}, "", 2, "userctl: \"alice\" is not user@domain\n"},
+		{[]string{"--db", db, "user", "enable", "a@example.com", "b@example.com"}, "", 2, "userctl: user enable: wrong number of arguments\n"},
+		{[]string{"user", "list"}, "", 2, "userctl: either --db or --api is required\n"},
+		{[]string{"--db", db, "--api", "http://127.0.0.1:8080", "user", "list"}, "", 2, "userctl: give either --db or --api, not both\n"},
+	} {
+		code, stdout, stderr := userctl(t, tt.stdin, tt.args...)
+		if code != tt.code || stdout != "" || !strings.Contains(stderr, tt.stderr) {
+			t.Fatalf("%q: expected %d with %q, got %d with %q and output %q", tt.args, tt.code, tt.stderr, code, stderr, stdout)
+		}
+	}
+	// None of these got as far as opening the database.
+	if _, err := os.Stat(db); !os.IsNotExist(err) {
+		t.Fatalf("expected no database to be created, got %v", err)
+	}
+	if code, _, stderr := userctl(t, "", "-h"); code != 0 || !strings.Contains(stderr, "Usage: userctl") {
+		t.Fatalf("expected -h to print the usage and succeed, got %d with %q", code, stderr)
+	}
+}
+
+func TestUserCommandsChangeTheDatabase(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "users.db")
+	for _, tt := range []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"user", "list"}, "", 0, "USER  CONTACT  STATUS\n", ""},
+		{[]string{"user", "add", "--password", "secret", "alice@example.com"}, "", 0, "", ""},
+		{[]string{"user", "add", "--contact", "sip:bob@192.0.2.5:5062", "bob@example.com"}, "hunter2\r\nignored\n", 0, "", ""},
+		{[]string{"user", "add", "--disabled", "--password-hash", "0123456789abcdef", "carol@example.org"}, "", 0, "", ""},
+		{[]string{"user", "add", "--password", "other", "alice@example.com"}, "", 1, "", "userctl: " + userdb.ErrUserExists.Error()},
+		{[]string{"user", "add", "--exist-ok", "--password", "other", "alice@example.com"}, "", 0, "", ""},
+		{[]string{"user", "list"}, "", 0, "USER               CONTACT                 STATUS\n" +
+			"alice@example.com                          enabled\n" +
+			"bob@example.com    sip:bob@192.0.2.5:5062  enabled\n" +
+			"carol@example.org                          disabled\n", ""},
+		{[]string{"user", "disable", "bob@example.com"}, "", 0, "", ""},
+		{[]string{"user", "disable", "dave@example.com"}, "", 1, "", "userctl: " + userdb.ErrUserNotFound.Error()},
+		{[]string{"user", "enable", "carol@example.org"}, "", 0, "", ""},
+		{[]string{"user", "passwd", "--password", "changed", "alice@example.com"}, "", 0, "", ""},
+		{[]string{"user", "passwd", "dave@example.com"}, "new\n", 1, "", "userctl: " + userdb.ErrUserNotFound.Error()},
+		{[]string{"user", "list", "--json", "--domain", "EXAMPLE.com"}, "", 0, `[
+  {
+    "username": "alice",
+    "domain": "example.com",
+    "enabled": true
+  },
+  {
+    "username": "bob",
+    "domain": "example.com",
+    "contact_uri": "sip:bob@192.0.2.5:5062",
+    "enabled": false
+  }
+]
+`, ""},
+		{[]string{"user", "del", "bob@example.com"}, "", 0, "", ""},
+		{[]string{"user", "del", "bob@example.com"}, "", 1, "", "userctl: " + userdb.ErrUserNotFound.Error()},
+		{[]string{"user", "del", "--missing-ok", "bob@example.com"}, "", 0, "", ""},
+		{[]string{"user", "list", "--domain", "example.org"}, "", 0, "USER               CONTACT  STATUS\ncarol@example.org           enabled\n", ""},
+	} {
+		code, stdout, stderr := userctl(t, tt.stdin, append([]string{"--db", db}, tt.args...)...)
+		if code != tt.code || stdout != tt.stdout || !strings.HasPrefix(stderr, tt.stderr) || (tt.stderr == "" && stderr != "") {
+			t.Fatalf("%q: expected %d with %q and output\n%s\ngot %d with %q and output\n%s", tt.args, tt.code, tt.stderr, tt.stdout, code, stderr, stdout)
+		}
+	}
+
+	store, err := userdb.OpenStore("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	for _, tt := range []struct {
+		username, domain, hash string
+	}{
+		{"alice", "example.com", userdb.HashPassword("alice", "example.com", "changed")},
+		{"carol", "example.org", "0123456789abcdef"},
+	} {
+		user, err := store.Lookup(ctx, tt.username, tt.domain)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", tt.username, err)
+		}
+		if user.PasswordHash != tt.hash || user.Disabled {
+			t.Fatalf("expected %s enabled with hash %s, got %+v", tt.username, tt.hash, user)
+		}
+	}
+	entries, err := store.ListAuditEntries(ctx, userdb.AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		if entry.Actor != auditActor {
+			t.Fatalf("expected every change recorded as %s, got %+v", auditActor, entry)
+		}
+		actions = append(actions, entry.Action+" "+entry.Target)
+	}
+	want := []string{
+		"user.delete bob@example.com",
+		"user.password alice@example.com",
+		"user.update carol@example.org",
+		"user.update bob@example.com",
+		"user.create carol@example.org",
+		"user.create bob@example.com",
+		"user.create alice@example.com",
+	}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected only the successful changes in the audit log, newest first, got %q", actions)
+	}
+}
+
+func TestAddReadsThePasswordFromStandardInput(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "users.db")
+	if code, _, stderr := userctl(t, "hunter2\r\nignored\n", "--db", db, "user", "add", "bob@example.com"); code != 0 {
+		t.Fatalf("expected success, got %d: %s", code, stderr)
+	}
+	store, err := userdb.OpenStore("sqlite", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, err := store.Lookup(context.Background(), "bob", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := userdb.HashPassword("bob", "example.com", "hunter2"); user.PasswordHash != want {
+		t.Fatalf("expected the first line without its line ending as the password, got hash %s", user.PasswordHash)
+	}
+}
@@ -0,0 +1,374 @@
+// Package config reads the proxy's configuration file, written in a subset of
+// TOML: key = value pairs, [table] and [[array-of-tables]] headers, and #
+// comments. Values are basic ("...") or literal ('...') strings, integers,
+// floats, booleans, and arrays of those, which may span lines. Keys are bare
+// (letters, digits, '-' and '_') or quoted.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error reports a problem at a line of the file.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...any) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Value is one setting. Text holds a scalar as a command-line flag would take
+// it; an array's elements are in List instead.
+type Value struct {
+	Line   int
+	Text   string
+	List   []string
+	IsList bool
+}
+
+// Duration reads the value as a Go duration such as "90s", or as a whole
+// number of seconds.
+func (v Value) Duration() (time.Duration, error) {
+	if v.IsList {
+		return 0, errorf(v.Line, "expected a duration, got an array")
+	}
+	if seconds, err := strconv.Atoi(v.Text); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v.Text)
+	if err != nil {
+		return 0, errorf(v.Line, "invalid duration %q", v.Text)
+	}
+	return d, nil
+}
+
+// Table is the top level of the file or one of its tables. Keys lists the
+// table's settings in the order they appear.
+type Table struct {
+	Name   string
+	Line   int
+	Keys   []string
+	Values map[string]Value
+	Tables map[string]*Table
+	Arrays map[string][]*Table
+}
+
+func newTable(name string, line int) *Table {
+	return &Table{
+		Name:   name,
+		Line:   line,
+		Values: make(map[string]Value),
+		Tables: make(map[string]*Table),
+		Arrays: make(map[string][]*Table),
+	}
+}
+
+// Lookup returns the named setting.
+func (t *Table) Lookup(key string) (Value, bool) {
+	v, ok := t.Values[key]
+	return v, ok
+}
+
+// CheckKeys reports the first setting whose key is not among allowed.
+func (t *Table) CheckKeys(allowed ...string) error {
+	for _, key := range t.Keys {
+		known := false
+		for _, name := range allowed {
+			if key == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errorf(t.Values[key].Line, "unknown setting %q in [%s]", key, t.Name)
+		}
+	}
+	return nil
+}
+
+// Load reads and parses the file at path.
+func Load(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return root, nil
+}
+
+// Parse parses a configuration file.
+func Parse(data []byte) (*Table, error) {
+	root := newTable("", 0)
+	current := root
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line, err := stripComment(lines[i], number)
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if current, err = root.openTable(line, number); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key, rest, err := parseKey(line, number)
+		if err != nil {
+			return nil, err
+		}
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(rest, "=") {
+			return nil, errorf(number, "expected = after %q", key)
+		}
+		raw := strings.TrimSpace(rest[1:])
+		// An array may continue on the following lines until its
+		// brackets balance.
+		for strings.HasPrefix(raw, "[") && !balanced(raw) && i+1 < len(lines) {
+			i++
+			next, err := stripComment(lines[i], i+1)
+			if err != nil {
+				return nil, err
+			}
+			raw += " " + strings.TrimSpace(next)
+		}
+		value, err := parseValue(raw, number)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := current.Values[key]; dup {
+			return nil, errorf(number, "%q is set twice", key)
+		}
+		if _, clash := current.Tables[key]; clash {
+			return nil, errorf(number, "%q is already a table", key)
+		}
+		current.Keys = append(current.Keys, key)
+		current.Values[key] = value
+	}
+	return root, nil
+}
+
+// openTable starts the table named by a [name] or [[name]] header.
+func (t *Table) openTable(header string, line int) (*Table, error) {
+	array := strings.HasPrefix(header, "[[")
+	inner := strings.TrimPrefix(header, "[")
+	closing := "]"
+	if array {
+		inner = strings.TrimPrefix(inner, "[")
+		closing = "]]"
+	}
+	if !strings.HasSuffix(inner, closing) {
+		return nil, errorf(line, "unterminated table header")
+	}
+	name, rest, err := parseKey(strings.TrimSpace(strings.TrimSuffix(inner, closing)), line)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errorf(line, "nested table names are not supported")
+	}
+	if _, clash := t.Values[name]; clash {
+		return nil, errorf(line, "%q is already a setting", name)
+	}
+	if array {
+		if _, clash := t.Tables[name]; clash {
+			return nil, errorf(line, "%q is already a table", name)
+		}
+		table := newTable(name, line)
+		t.Arrays[name] = append(t.Arrays[name], table)
+		return table, nil
+	}
+	if _, clash := t.Tables[name]; clash {
+		return nil, errorf(line, "table %q is defined twice", name)
+	}
+	if _, clash := t.Arrays[name]; clash {
+		return nil, errorf(line, "%q is already an array of tables", name)
+	}
+	table := newTable(name, line)
+	t.Tables[name] = table
+	return table, nil
+}
+
+// stripComment removes a # comment that is outside any string.
+func stripComment(line string, number int) (string, error) {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i], nil
+		}
+	}
+	if quote != 0 {
+		return "", errorf(number, "unterminated string")
+	}
+	return line, nil
+}
+
+// balanced reports whether every '[' in raw outside strings is closed.
+func balanced(raw string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// parseKey reads a bare or quoted key from the start of s.
+func parseKey(s string, line int) (string, string, error) {
+	if strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'") {
+		text, rest, err := parseString(s, line)
+		if err != nil {
+			return "", "", err
+		}
+		if text == "" {
+			return "", "", errorf(line, "empty key")
+		}
+		return text, rest, nil
+	}
+	end := 0
+	for end < len(s) && isBareKeyChar(s[end]) {
+		end++
+	}
+	if end == 0 {
+		return "", "", errorf(line, "expected a key")
+	}
+	return s[:end], s[end:], nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// parseString reads the basic or literal string at the start of s.
+func parseString(s string, line int) (string, string, error) {
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errorf(line, "unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			text, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", errorf(line, "invalid string %s", s[:i+1])
+			}
+			return text, s[i+1:], nil
+		}
+	}
+	return "", "", errorf(line, "unterminated string")
+}
+
+// parseValue reads a scalar or an array of scalars.
+func parseValue(raw string, line int) (Value, error) {
+	if raw == "" {
+		return Value{}, errorf(line, "missing value")
+	}
+	if !strings.HasPrefix(raw, "[") {
+		text, rest, err := parseScalar(raw, line)
+		if err != nil {
+			return Value{}, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return Value{}, errorf(line, "unexpected %q after value", strings.TrimSpace(rest))
+		}
+		return Value{Line: line, Text: text}, nil
+	}
+	value := Value{Line: line, IsList: true, List: []string{}}
+	rest := strings.TrimSpace(raw[1:])
+	for {
+		if strings.HasPrefix(rest, "]") {
+			rest = rest[1:]
+			break
+		}
+		if rest == "" {
+			return Value{}, errorf(line, "unterminated array")
+		}
+		if strings.HasPrefix(rest, "[") {
+			return Value{}, errorf(line, "nested arrays are not supported")
+		}
+		text, after, err := parseScalar(rest, line)
+		if err != nil {
+			return Value{}, err
+		}
+		value.List = append(value.List, text)
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return Value{}, errorf(line, "expected , or ] in array")
+		}
+	}
+	if strings.TrimSpace(rest) != "" {
+		return Value{}, errorf(line, "unexpected %q after array", strings.TrimSpace(rest))
+	}
+	return value, nil
+}
+
+// parseScalar reads a string, number, or boolean from the start of s and
+// returns it as text.
+func parseScalar(s string, line int) (string, string, error) {
+	if s[0] == '"' || s[0] == '\'' {
+		return parseString(s, line)
+	}
+	end := 0
+	for end < len(s) && s[end] != ',' && s[end] != ']' && s[end] != ' ' && s[end] != '\t' {
+		end++
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true", "false":
+		return token, rest, nil
+	}
+	number := strings.ReplaceAll(token, "_", "")
+	if _, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return number, rest, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil && token != "" {
+		return number, rest, nil
+	}
+	return "", "", errorf(line, "invalid value %q (strings must be quoted)", token)
+}
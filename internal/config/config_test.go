@@ -0,0 +1,165 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValues(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		key   string
+		text  string
+		list  []string
+	}{
+		{"bare string", `listen = ":5060"`, "listen", ":5060", nil},
+		{"basic escapes", `motd = "tab\there \"quoted\" \u00e9"`, "motd", "tab\there \"quoted\" é", nil},
+		{"literal string", `path = 'C:\proxy\users.db'`, "path", `C:\proxy\users.db`, nil},
+		{"hash in string", `secret = "a#b" # comment`, "secret", "a#b", nil},
+		{"quoted key", `"log level" = "debug"`, "log level", "debug", nil},
+		{"literal quoted key", `'trunk.did' = "x"`, "trunk.did", "x", nil},
+		{"integer with underscores", `queue-capacity = 1_024`, "queue-capacity", "1024", nil},
+		{"hex integer", `mask = 0xff`, "mask", "0xff", nil},
+		{"float", `ratio = 0.5`, "ratio", "0.5", nil},
+		{"boolean", `topology-hiding = true`, "topology-hiding", "true", nil},
+		{"inline array", `trunk = ["a", 'b', 3]`, "trunk", "", []string{"a", "b", "3"}},
+		{"empty array", `trunk = []`, "trunk", "", []string{}},
+		{"array across lines", "trunk = [\n  \"a\", # first\n  \"b\",\n]", "trunk", "", []string{"a", "b"}},
+		{"bracket in string across lines", "peers = [\n  \"[::1]\",\n  \"x]\"\n]", "peers", "", []string{"[::1]", "x]"}},
+		{"CRLF line endings", "a = 1\r\nb = 2\r\n", "b", "2", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := Parse([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			value, ok := root.Lookup(tt.key)
+			if !ok {
+				t.Fatalf("expected %q to be set, got keys %q", tt.key, root.Keys)
+			}
+			if value.IsList != (tt.list != nil) || value.Text != tt.text || !slices.Equal(value.List, tt.list) {
+				t.Fatalf("expected %q %q, got %+v", tt.text, tt.list, value)
+			}
+			if value.Line != 1 && tt.name != "CRLF line endings" {
+				t.Fatalf("expected the value from line 1, got %d", value.Line)
+			}
+		})
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	root, err := Parse([]byte(`
+listen = ":5060"
+
+[dids]
+"0312345678" = "alice@example.com"
+
+[[trunk]]
+registrar = "sip.provider.example"
+
+[[trunk]]
+registrar = "backup.provider.example"
+expires = 600
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(root.Keys, []string{"listen"}) {
+		t.Fatalf("expected only listen at the top level, got %q", root.Keys)
+	}
+	dids := root.Tables["dids"]
+	if dids == nil || dids.Line != 4 || dids.Values["0312345678"].Text != "alice@example.com" {
+		t.Fatalf("expected the [dids] table from line 4, got %+v", dids)
+	}
+	trunks := root.Arrays["trunk"]
+	if len(trunks) != 2 || trunks[0].Line != 7 || trunks[1].Line != 10 {
+		t.Fatalf("expected two [[trunk]] tables at lines 7 and 10, got %d", len(trunks))
+	}
+	if trunks[0].Values["registrar"].Text != "sip.provider.example" || len(trunks[0].Keys) != 1 {
+		t.Fatalf("expected the first trunk's settings only, got %q", trunks[0].Keys)
+	}
+	expires, _ := trunks[1].Lookup("expires")
+	if d, err := expires.Duration(); err != nil || d != 10*time.Minute || expires.Line != 12 {
+		t.Fatalf("expected 600 seconds from line 12, got %v, %v at line %d", d, err, expires.Line)
+	}
+	if err := trunks[1].CheckKeys("registrar"); err == nil || err.(*Error).Line != 12 {
+		t.Fatalf("expected the unknown expires setting reported at line 12, got %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		line  int
+		msg   string
+	}{
+		{"duplicate key", "a = 1\nb = 2\na = 3", 3, `"a" is set twice`},
+		{"duplicate key in table", "[timers]\nt1 = 1\nt1 = 2", 3, `"t1" is set twice`},
+		{"duplicate table", "[dids]\n\n[timers]\n[dids]", 4, `table "dids" is defined twice`},
+		{"table then array of tables", "[trunk]\n[[trunk]]", 2, `"trunk" is already a table`},
+		{"array of tables then table", "[[trunk]]\n[trunk]", 2, `"trunk" is already an array of tables`},
+		{"setting then table", "dids = 1\n[dids]", 2, `"dids" is already a setting`},
+		{"unterminated string", "a = 1\nb = \"open", 2, "unterminated string"},
+		{"unterminated array", "a = [\n1,\n", 1, "unterminated array"},
+		{"nested array", "a = [[1]]", 1, "nested arrays are not supported"},
+		{"unquoted string", "a = 1\n\nb = hello", 3, "strings must be quoted"},
+		{"missing equals", "a 1", 1, `expected = after "a"`},
+		{"missing value", "a =", 1, "missing value"},
+		{"trailing text", `a = "x" y`, 1, `unexpected "y" after value`},
+		{"nested table name", "[a.b]", 1, "nested table names are not supported"},
+		{"unterminated header", "[[trunk]", 1, "unterminated table header"},
+		{"empty key", `"" = 1`, 1, "empty key"},
+		{"invalid escape", `a = "\q"`, 1, "invalid string"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.input))
+			var perr *Error
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a *config.Error, got %v", err)
+			}
+			if perr.Line != tt.line || !strings.Contains(perr.Msg, tt.msg) {
+				t.Fatalf("expected %q at line %d, got %v", tt.msg, tt.line, err)
+			}
+			if !strings.HasPrefix(err.Error(), "line ") {
+				t.Fatalf("expected the line in the message, got %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestValueDuration(t *testing.T) {
+	for _, tt := range []struct {
+		value Value
+		want  time.Duration
+		ok    bool
+	}{
+		{Value{Text: "90"}, 90 * time.Second, true},
+		{Value{Text: "1m30s"}, 90 * time.Second, true},
+		{Value{Text: "soon", Line: 4}, 0, false},
+		{Value{IsList: true, List: []string{"1s"}}, 0, false},
+	} {
+		d, err := tt.value.Duration()
+		if (err == nil) != tt.ok || d != tt.want {
+			t.Fatalf("%+v: expected %v (ok %v), got %v, %v", tt.value, tt.want, tt.ok, d, err)
+		}
+	}
+}
+
+func TestLoadNamesTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.toml")
+	if err := os.WriteFile(path, []byte("a = 1\na = 2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Line != 2 || !strings.HasPrefix(err.Error(), path+": line 2:") {
+		t.Fatalf("expected the file and line in the error, got %v", err)
+	}
+}
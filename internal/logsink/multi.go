@@ -0,0 +1,55 @@
+package logsink
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// Multi returns a handler passing each record to every handler that accepts
+// its level. A single handler is returned unchanged.
+func Multi(handlers ...slog.Handler) slog.Handler {
+	if len(handlers) == 1 {
+		return handlers[0]
+	}
+	return multiHandler(handlers)
+}
+
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, h := range m {
+		next[i] = h.WithAttrs(attrs)
+	}
+	return next
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, h := range m {
+		next[i] = h.WithGroup(name)
+	}
+	return next
+}
@@ -0,0 +1,140 @@
+// Package logsink provides log destinations besides standard output: a file
+// rotated by size and age, and a syslog client speaking RFC 5424, together
+// with the slog handlers that route records to them.
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFileMaxBytes = 100 << 20
+	defaultFileMaxFiles = 7
+)
+
+// FileConfig describes a RotatingFile.
+type FileConfig struct {
+	// Path is the active log file. Rotated files get the suffixes .1
+	// (newest) to .N.
+	Path string
+	// MaxBytes rotates the file before a write would grow it past this size
+	// (100 MiB when not positive).
+	MaxBytes int64
+	// MaxAge rotates the file once it has been open this long; zero disables
+	// time-based rotation.
+	MaxAge time.Duration
+	// MaxFiles is how many rotated files to keep besides the active one (7
+	// when not positive).
+	MaxFiles int
+}
+
+// RotatingFile is an io.WriteCloser appending to a log file that it rotates
+// by size and age. It is safe for concurrent use; each Write is kept whole
+// within one file.
+type RotatingFile struct {
+	cfg FileConfig
+	now func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens cfg.Path for appending, creating it when missing.
+func OpenRotatingFile(cfg FileConfig) (*RotatingFile, error) {
+	cfg.Path = strings.TrimSpace(cfg.Path)
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("logsink: log file path is required")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultFileMaxBytes
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultFileMaxFiles
+	}
+	f := &RotatingFile{cfg: cfg, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p, rotating first when p would not fit or the file is older
+// than MaxAge.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("logsink: %s is closed", f.cfg.Path)
+	}
+	tooBig := f.size > 0 && f.size+int64(len(p)) > f.cfg.MaxBytes
+	tooOld := f.cfg.MaxAge > 0 && f.now().Sub(f.opened) >= f.cfg.MaxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the active file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("logsink: open %s: %w", f.cfg.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("logsink: stat %s: %w", f.cfg.Path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	// An existing file is aged from its last write, so restarts do not keep
+	// postponing time-based rotation.
+	f.opened = f.now()
+	if f.size > 0 {
+		f.opened = info.ModTime()
+	}
+	return nil
+}
+
+// rotate closes the active file, shifts the rotated files up by one, and
+// starts a new file.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("logsink: close %s: %w", f.cfg.Path, err)
+	}
+	f.file = nil
+	os.Remove(f.rotatedPath(f.cfg.MaxFiles))
+	for i := f.cfg.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(f.rotatedPath(i), f.rotatedPath(i+1))
+	}
+	if err := os.Rename(f.cfg.Path, f.rotatedPath(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("logsink: rotate %s: %w", f.cfg.Path, err)
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) rotatedPath(n int) string {
+	return f.cfg.Path + "." + strconv.Itoa(n)
+}
@@ -0,0 +1,115 @@
+package logsink
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// logFiles returns the contents of the files in dir by name.
+func logFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestRotatingFileRotatesBySizeAndKeepsMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	f, err := OpenRotatingFile(FileConfig{Path: filepath.Join(dir, "proxy.log"), MaxBytes: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	// Each line is five bytes, so two fit in a file.
+	long := "a line past the limit\n"
+	for _, tt := range []struct {
+		write string
+		want  map[string]string
+	}{
+		{"1111\n", map[string]string{"proxy.log": "1111\n"}},
+		{"2222\n", map[string]string{"proxy.log": "1111\n2222\n"}},
+		{"3333\n", map[string]string{"proxy.log": "3333\n", "proxy.log.1": "1111\n2222\n"}},
+		{"4444\n", map[string]string{"proxy.log": "3333\n4444\n", "proxy.log.1": "1111\n2222\n"}},
+		{"5555\n", map[string]string{"proxy.log": "5555\n", "proxy.log.1": "3333\n4444\n", "proxy.log.2": "1111\n2222\n"}},
+		{"6666\n", map[string]string{"proxy.log": "5555\n6666\n", "proxy.log.1": "3333\n4444\n", "proxy.log.2": "1111\n2222\n"}},
+		{"7777\n", map[string]string{"proxy.log": "7777\n", "proxy.log.1": "5555\n6666\n", "proxy.log.2": "3333\n4444\n"}},
+		// A write larger than the limit is kept whole in a file of its own.
+		{long, map[string]string{"proxy.log": long, "proxy.log.1": "7777\n", "proxy.log.2": "5555\n6666\n"}},
+		{"8888\n", map[string]string{"proxy.log": "8888\n", "proxy.log.1": long, "proxy.log.2": "7777\n"}},
+	} {
+		if n, err := f.Write([]byte(tt.write)); err != nil || n != len(tt.write) {
+			t.Fatalf("write %q: got %d, %v", tt.write, n, err)
+		}
+		if got := logFiles(t, dir); !maps.Equal(got, tt.want) {
+			t.Fatalf("after %q: expected %q, got %q", tt.write, tt.want, got)
+		}
+	}
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+	if err := os.WriteFile(path, []byte("before restart\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	written := time.Unix(1_700_000_000, 0)
+	if err := os.Chtimes(path, written, written); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(FileConfig{Path: path, MaxAge: time.Hour, MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	now := written.Add(59 * time.Minute)
+	f.now = func() time.Time { return now }
+
+	// The existing file is aged from its last write, not from the restart.
+	f.Write([]byte("same hour\n"))
+	if got := logFiles(t, dir); !maps.Equal(got, map[string]string{"proxy.log": "before restart\nsame hour\n"}) {
+		t.Fatalf("expected no rotation within the hour, got %q", got)
+	}
+	now = written.Add(time.Hour)
+	f.Write([]byte("next hour\n"))
+	now = now.Add(30 * time.Minute)
+	f.Write([]byte("half an hour on\n"))
+	want := map[string]string{"proxy.log": "next hour\nhalf an hour on\n", "proxy.log.1": "before restart\nsame hour\n"}
+	if got := logFiles(t, dir); !maps.Equal(got, want) {
+		t.Fatalf("expected one rotation after an hour, got %q", got)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Fatalf("expected a write after Close to fail")
+	}
+}
+
+func TestRotatingFileDefaults(t *testing.T) {
+	if _, err := OpenRotatingFile(FileConfig{Path: " "}); err == nil {
+		t.Fatalf("expected a path to be required")
+	}
+	f, err := OpenRotatingFile(FileConfig{Path: filepath.Join(t.TempDir(), "proxy.log")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	if f.cfg.MaxBytes != defaultFileMaxBytes || f.cfg.MaxFiles != defaultFileMaxFiles {
+		t.Fatalf("expected the default limits, got %d bytes and %d files", f.cfg.MaxBytes, f.cfg.MaxFiles)
+	}
+}
@@ -0,0 +1,247 @@
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 5424 severities used for slog levels.
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+// facilities maps RFC 5424 facility names to their codes.
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseFacility returns the code of an RFC 5424 facility name such as
+// "daemon" or "local0".
+func ParseFacility(name string) (int, error) {
+	code, ok := facilities[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("logsink: unknown syslog facility %q", name)
+	}
+	return code, nil
+}
+
+// SyslogConfig describes where a Syslog client sends.
+type SyslogConfig struct {
+	// Addr is empty for the local syslog daemon, or a URL such as
+	// udp://host:514, tcp://host:601, or unix:///dev/log.
+	Addr string
+	// Facility is an RFC 5424 facility code (see ParseFacility).
+	Facility int
+	// AppName identifies the program; the executable name when empty.
+	AppName string
+}
+
+// Syslog sends RFC 5424 messages to a syslog daemon. TCP messages use
+// octet-counting framing (RFC 6587). A failed send reconnects once before
+// giving up, so a restarted daemon is picked up again.
+type Syslog struct {
+	cfg      SyslogConfig
+	network  string
+	address  string
+	hostname string
+	procID   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// localSyslogPaths are tried in order for the local syslog daemon.
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// NewSyslog connects to the syslog daemon described by cfg.
+func NewSyslog(cfg SyslogConfig) (*Syslog, error) {
+	if cfg.Facility < 0 || cfg.Facility > 23 {
+		return nil, fmt.Errorf("logsink: syslog facility %d out of range", cfg.Facility)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = filepath.Base(os.Args[0])
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &Syslog{cfg: cfg, hostname: hostname, procID: strconv.Itoa(os.Getpid())}
+	if addr := strings.TrimSpace(cfg.Addr); addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("logsink: parse syslog address: %w", err)
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			s.network, s.address = u.Scheme, u.Host
+		case "unix", "unixgram":
+			s.network, s.address = "unixgram", u.Path
+		default:
+			return nil, fmt.Errorf("logsink: unsupported syslog address %q: use udp://, tcp://, or unix://", addr)
+		}
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	for _, path := range localSyslogPaths {
+		s.network, s.address = "unixgram", path
+		if err := s.connect(); err == nil {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("logsink: no local syslog socket found in %s", strings.Join(localSyslogPaths, ", "))
+}
+
+func (s *Syslog) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("logsink: connect to syslog %s: %w", s.address, err)
+	}
+	s.conn = conn
+	return nil
+}
+
+// Send writes msg with the given RFC 5424 severity.
+func (s *Syslog) Send(severity int, t time.Time, msg []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s - - ", s.cfg.Facility*8+severity,
+		t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.cfg.AppName, s.procID)
+	buf.Write(bytes.TrimRight(msg, "\n"))
+	frame := buf.Bytes()
+	if s.network == "tcp" {
+		frame = append([]byte(strconv.Itoa(len(frame))+" "), frame...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write(frame); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// Close closes the connection to the daemon.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return severityError
+	case level >= slog.LevelWarn:
+		return severityWarning
+	case level >= slog.LevelInfo:
+		return severityInfo
+	default:
+		return severityDebug
+	}
+}
+
+// SyslogHandler is a slog.Handler that renders each record with a text or
+// JSON handler and sends it to syslog with the severity matching its level.
+// The time and level are left to the syslog header.
+type SyslogHandler struct {
+	syslog *Syslog
+	inner  slog.Handler
+	out    *lockedBuffer
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) { return b.buf.Write(p) }
+
+// NewSyslogHandler returns a handler sending to s, rendering records as JSON
+// when json is set and as key=value text otherwise.
+func NewSyslogHandler(s *Syslog, json bool, opts *slog.HandlerOptions) *SyslogHandler {
+	inner := slog.HandlerOptions{}
+	if opts != nil {
+		inner = *opts
+	}
+	replace := inner.ReplaceAttr
+	inner.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+			return slog.Attr{}
+		}
+		if replace != nil {
+			return replace(groups, a)
+		}
+		return a
+	}
+	out := &lockedBuffer{}
+	h := &SyslogHandler{syslog: s, out: out}
+	if json {
+		h.inner = slog.NewJSONHandler(out, &inner)
+	} else {
+		h.inner = slog.NewTextHandler(out, &inner)
+	}
+	return h
+}
+
+// Enabled reports whether the inner handler accepts level.
+func (h *SyslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+// Handle renders r and sends it.
+func (h *SyslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	h.out.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		h.out.mu.Unlock()
+		return err
+	}
+	msg := append([]byte(nil), h.out.buf.Bytes()...)
+	h.out.mu.Unlock()
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return h.syslog.Send(severity(r.Level), t, msg)
+}
+
+// WithAttrs returns a handler adding attrs to every record.
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SyslogHandler{syslog: h.syslog, inner: h.inner.WithAttrs(attrs), out: h.out}
+}
+
+// WithGroup returns a handler nesting later attributes under name.
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	return &SyslogHandler{syslog: h.syslog, inner: h.inner.WithGroup(name), out: h.out}
+}
@@ -0,0 +1,148 @@
+package logsink
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUDP returns a local UDP socket standing in for a syslog daemon.
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readDatagram returns the next message conn receives.
+func readDatagram(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogFramesRFC5424OverUDP(t *testing.T) {
+	daemon := listenUDP(t)
+	facility, err := ParseFacility("local3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSyslog(SyslogConfig{Addr: "udp://" + daemon.LocalAddr().String(), Facility: facility, AppName: "sip-proxy"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	logger := slog.New(NewSyslogHandler(s, false, &slog.HandlerOptions{Level: slog.LevelDebug - 4}))
+	hostname, _ := os.Hostname()
+
+	for _, tt := range []struct {
+		level    slog.Level
+		severity int
+	}{
+		{slog.LevelError, 3},
+		{slog.LevelWarn, 4},
+		{slog.LevelInfo, 6},
+		{slog.LevelDebug, 7},
+		{slog.LevelDebug - 4, 7},
+	} {
+		logger.Log(context.Background(), tt.level, `call "ended"`, "reason", `a]b\c`)
+		msg := readDatagram(t, daemon)
+		fields := strings.SplitN(msg, " ", 8)
+		if len(fields) != 8 {
+			t.Fatalf("expected eight RFC 5424 fields, got %q", msg)
+		}
+		if want := "<" + strconv.Itoa(19*8+tt.severity) + ">1"; fields[0] != want {
+			t.Fatalf("%v: expected PRI and version %s, got %s", tt.level, want, fields[0])
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, fields[1]); err != nil || !strings.HasSuffix(fields[1], "Z") || time.Since(ts) > time.Minute {
+			t.Fatalf("expected a current UTC timestamp, got %q", fields[1])
+		}
+		if fields[2] != hostname || fields[3] != "sip-proxy" || fields[4] != strconv.Itoa(os.Getpid()) {
+			t.Fatalf("expected hostname, app name, and process ID, got %q", fields[2:5])
+		}
+		// There is no MSGID or structured data: both are the NILVALUE, and
+		// the characters structured data would escape reach MSG unchanged.
+		if fields[5] != "-" || fields[6] != "-" {
+			t.Fatalf("expected NILVALUE MSGID and STRUCTURED-DATA, got %q and %q", fields[5], fields[6])
+		}
+		if want := `msg="call \"ended\"" reason=a]b\c`; fields[7] != want {
+			t.Fatalf("expected MSG %s without level, time, or newline, got %s", want, fields[7])
+		}
+	}
+}
+
+func TestSyslogCountsOctetsOverTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	s, err := NewSyslog(SyslogConfig{Addr: "tcp://" + ln.Addr().String(), Facility: 3, AppName: "sip-proxy"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, msg := range []string{"first\n", "second"} {
+		if err := s.Send(severityInfo, time.Unix(0, 0), []byte(msg)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"first", "second"} {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatalf("read length: %v", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("expected an octet count, got %q", length)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		if !strings.HasPrefix(string(frame), "<30>1 1970-01-01T00:00:00.000000Z ") || !strings.HasSuffix(string(frame), " - - "+want) {
+			t.Fatalf("expected a daemon.info frame ending in %q, got %q", want, frame)
+		}
+	}
+}
+
+func TestParseFacility(t *testing.T) {
+	for name, want := range map[string]int{"kern": 0, "daemon": 3, " Local0 ": 16, "local7": 23} {
+		if got, err := ParseFacility(name); err != nil || got != want {
+			t.Fatalf("%q: expected %d, got %d, %v", name, want, got, err)
+		}
+	}
+	if _, err := ParseFacility("local8"); err == nil {
+		t.Fatalf("expected an unknown facility to be refused")
+	}
+	if _, err := NewSyslog(SyslogConfig{Addr: "udp://127.0.0.1:514", Facility: 24}); err == nil {
+		t.Fatalf("expected a facility out of range to be refused")
+	}
+}
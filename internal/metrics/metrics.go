@@ -0,0 +1,307 @@
+// Package metrics implements the small subset of Prometheus instrumentation
+// the proxy needs: labelled counters, gauges, and histograms, plus gauges
+// computed at scrape time, exposed in the Prometheus text format.
+//
+// Every method is safe on a nil receiver and does nothing, so components can
+// be instrumented unconditionally and only pay for metrics when a Registry was
+// configured.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds in seconds suited to SIP
+// transaction and HTTP request latencies.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 32}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// Registry holds metric families and renders them for scraping.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	names    map[string]bool
+	hooks    []func()
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// family is one named metric with a fixed set of label names.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is one combination of label values.
+type series struct {
+	values  []string
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+func (r *Registry) register(f *family) *family {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[f.name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+	}
+	r.names[f.name] = true
+	f.series = make(map[string]*series)
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter registers a counter partitioned by the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// Gauge registers a gauge partitioned by the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// GaugeFunc registers an unlabelled gauge whose value fn computes at scrape
+// time. fn must be safe to call from any goroutine.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, kind: kindGauge, fn: fn})
+}
+
+// BeforeScrape registers fn to run before every scrape, typically to Set
+// labelled gauges sampled from other components. fn must be safe to call from
+// any goroutine.
+func (r *Registry) BeforeScrape(fn func()) {
+	if r == nil || fn == nil {
+		return
+	}
+	r.mu.Lock()
+	r.hooks = append(r.hooks, fn)
+	r.mu.Unlock()
+}
+
+// Histogram registers a histogram with the given bucket upper bounds,
+// partitioned by the given label names. Nil buckets select DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: sorted})}
+}
+
+// with returns the series for values, creating it on first use. Missing
+// values are treated as empty and extra values are ignored.
+func (f *family) with(values []string) *series {
+	normalised := make([]string, len(f.labels))
+	copy(normalised, values)
+	key := strings.Join(normalised, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: normalised}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a monotonically increasing count per label combination.
+type CounterVec struct {
+	f *family
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter with the given
+// label values.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if c == nil || c.f == nil || delta < 0 {
+		return
+	}
+	c.f.mu.Lock()
+	c.f.with(values).value += delta
+	c.f.mu.Unlock()
+}
+
+// GaugeVec is a value per label combination that can go up and down.
+type GaugeVec struct {
+	f *family
+}
+
+// Set replaces the gauge with the given label values.
+func (g *GaugeVec) Set(value float64, values ...string) {
+	if g == nil || g.f == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.with(values).value = value
+	g.f.mu.Unlock()
+}
+
+// Add adds delta to the gauge with the given label values.
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	if g == nil || g.f == nil {
+		return
+	}
+	g.f.mu.Lock()
+	g.f.with(values).value += delta
+	g.f.mu.Unlock()
+}
+
+// HistogramVec counts observations into buckets per label combination.
+type HistogramVec struct {
+	f *family
+}
+
+// Observe records one observation with the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	if h == nil || h.f == nil {
+		return
+	}
+	h.f.mu.Lock()
+	s := h.f.with(values)
+	for i, bound := range h.f.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.samples++
+	h.f.mu.Unlock()
+}
+
+// WriteText renders every family in the Prometheus text exposition format,
+// families in registration order and series sorted by label values.
+func (r *Registry) WriteText(w io.Writer) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	hooks := append([]func(){}, r.hooks...)
+	r.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	var b strings.Builder
+	for _, f := range families {
+		f.writeText(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) writeText(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+	if f.fn != nil {
+		fmt.Fprintf(b, "%s %s\n", f.name, formatValue(f.fn()))
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != kindHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", 0), formatValue(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", bound), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", math.Inf(1)), s.samples)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", 0), formatValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", 0), s.samples)
+	}
+}
+
+// formatLabels renders {name="value",...}, appending le for histogram
+// buckets when extra is non-empty.
+func formatLabels(names, values []string, extra string, bound float64) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra+`="`+formatValue(bound)+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string { return labelEscaper.Replace(v) }
+
+func escapeHelp(v string) string { return helpEscaper.Replace(v) }
+
+// Handler serves the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if req.Method == http.MethodHead {
+			return
+		}
+		_ = r.WriteText(w)
+	})
+}
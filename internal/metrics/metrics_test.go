@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape gets the registry's handler with method and returns the response.
+func scrape(t *testing.T, r *Registry, method string) (*http.Response, string) {
+	t.Helper()
+	srv := httptest.NewServer(r.Handler())
+	t.Cleanup(srv.Close)
+	req, err := http.NewRequest(method, srv.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return resp, string(body)
+}
+
+func TestHandlerWritesTheTextExpositionFormat(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("sip_requests_total", "SIP requests by method.\nCounted on receipt, C:\\ not included.", "method", "transport")
+	calls := r.Gauge("sip_active_calls", "Calls in progress.", "trunk")
+	r.GaugeFunc("sip_uptime_seconds", "Seconds since start.", func() float64 { return 12.5 })
+	scraped := 0
+	r.BeforeScrape(func() {
+		scraped++
+		calls.Set(float64(scraped), "backup")
+	})
+	latency := r.Histogram("sip_transaction_seconds", "Transaction latency.", []float64{1, 0.1, 0.5}, "method")
+
+	requests.Inc("INVITE", "udp")
+	requests.Add(2, "INVITE", "udp")
+	requests.Add(-1, "INVITE", "udp")
+	requests.Inc(`odd "name" \ with`+"\nnewline", "tcp")
+	requests.Inc("OPTIONS")
+	calls.Add(3, "primary")
+	calls.Add(-1, "primary")
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.5, 0.7, 2} {
+		latency.Observe(v, "INVITE")
+	}
+
+	resp, body := scrape(t, r, http.MethodGet)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("expected 200 in the text format, got %d with %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	want := `# HELP sip_requests_total SIP requests by method.\nCounted on receipt, C:\\ not included.
+# TYPE sip_requests_total counter
+sip_requests_total{method="INVITE",transport="udp"} 3
+sip_requests_total{method="OPTIONS",transport=""} 1
+sip_requests_total{method="odd \"name\" \\ with\nnewline",transport="tcp"} 1
+# HELP sip_active_calls Calls in progress.
+# TYPE sip_active_calls gauge
+sip_active_calls{trunk="backup"} 1
+sip_active_calls{trunk="primary"} 2
+# HELP sip_uptime_seconds Seconds since start.
+# TYPE sip_uptime_seconds gauge
+sip_uptime_seconds 12.5
+# HELP sip_transaction_seconds Transaction latency.
+# TYPE sip_transaction_seconds histogram
+sip_transaction_seconds_bucket{method="INVITE",le="0.1"} 2
+sip_transaction_seconds_bucket{method="INVITE",le="0.5"} 4
+sip_transaction_seconds_bucket{method="INVITE",le="1"} 5
+sip_transaction_seconds_bucket{method="INVITE",le="+Inf"} 6
+sip_transaction_seconds_sum{method="INVITE"} 3.65
+sip_transaction_seconds_count{method="INVITE"} 6
+`
+	if body != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, body)
+	}
+
+	// The hook runs on every scrape, so sampled gauges are current.
+	if _, body := scrape(t, r, http.MethodGet); !strings.Contains(body, "sip_active_calls{trunk=\"backup\"} 2\n") {
+		t.Fatalf("expected the hook to run again, got\n%s", body)
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency_seconds", "Latency.", nil)
+	for _, v := range []float64{0.001, 0.02, 0.02, 0.3, 4, 40} {
+		h.Observe(v)
+	}
+	_, body := scrape(t, r, http.MethodGet)
+
+	var last uint64
+	buckets := 0
+	for _, line := range strings.Split(body, "\n") {
+		rest, ok := strings.CutPrefix(line, "latency_seconds_bucket{le=\"")
+		if !ok {
+			continue
+		}
+		bound, count, _ := strings.Cut(rest, "\"} ")
+		n, err := strconv.ParseUint(count, 10, 64)
+		if err != nil {
+			t.Fatalf("bad bucket line %q", line)
+		}
+		if n < last {
+			t.Fatalf("bucket le=%s count %d is below the previous %d", bound, n, last)
+		}
+		last = n
+		buckets++
+		if bound == "+Inf" && buckets != len(DefaultBuckets)+1 {
+			t.Fatalf("expected +Inf after the %d default buckets, got it at %d", len(DefaultBuckets), buckets)
+		}
+	}
+	if buckets != len(DefaultBuckets)+1 || last != 6 {
+		t.Fatalf("expected %d buckets ending at the sample count 6, got %d ending at %d", len(DefaultBuckets)+1, buckets, last)
+	}
+	for _, line := range []string{`latency_seconds_bucket{le="0.005"} 1`, `latency_seconds_bucket{le="32"} 5`, "latency_seconds_count 6"} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected %q, got\n%s", line, body)
+		}
+	}
+}
+
+func TestHandlerMethods(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("c_total", "C.").Inc()
+	if resp, body := scrape(t, r, http.MethodHead); resp.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("expected an empty 200 for HEAD, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := scrape(t, r, http.MethodPost); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for POST, got %d", resp.StatusCode)
+	}
+}
+
+func TestNilRegistryIsSafe(t *testing.T) {
+	var r *Registry
+	r.Counter("c_total", "C.", "a").Inc("x")
+	r.Gauge("g", "G.").Set(1)
+	r.GaugeFunc("f", "F.", func() float64 { return 1 })
+	r.Histogram("h_seconds", "H.", nil).Observe(1)
+	r.BeforeScrape(func() { t.Fatalf("expected no hook on a nil registry") })
+	if resp, body := scrape(t, r, http.MethodGet); resp.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("expected an empty scrape, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRegisteringANameTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("c_total", "C.")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic")
+		}
+	}()
+	r.Gauge("c_total", "C again.")
+}
@@ -0,0 +1,483 @@
+// Package qrcode renders short strings, such as otpauth:// provisioning URIs,
+// as QR codes. It implements only byte mode at error correction level M for
+// versions 1 to 15, which is plenty for the web interface, and depends only on
+// the standard library.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTooLong is returned when the text does not fit the largest supported
+// version.
+var ErrTooLong = errors.New("qrcode: text too long")
+
+// Code is an encoded QR symbol. Modules are indexed [row][column] and true is
+// dark. The quiet zone is not included.
+type Code struct {
+	Version int
+	Size    int
+	Modules [][]bool
+
+	reserved [][]bool // function modules, which masking skips
+}
+
+// blockLayout is the level M error correction layout of one version: blocks
+// in the first group hold dataShort data codewords, blocks in the second one
+// more.
+type blockLayout struct {
+	ecPerBlock int
+	shortCount int
+	dataShort  int
+	longCount  int
+}
+
+var layoutsM = [...]blockLayout{
+	1:  {10, 1, 16, 0},
+	2:  {16, 1, 28, 0},
+	3:  {26, 1, 44, 0},
+	4:  {18, 2, 32, 0},
+	5:  {24, 2, 43, 0},
+	6:  {16, 4, 27, 0},
+	7:  {18, 4, 31, 0},
+	8:  {22, 2, 38, 2},
+	9:  {22, 3, 36, 2},
+	10: {26, 4, 43, 1},
+	11: {30, 1, 50, 4},
+	12: {22, 6, 36, 2},
+	13: {22, 8, 37, 1},
+	14: {24, 4, 40, 5},
+	15: {24, 5, 41, 5},
+}
+
+var alignmentCenters = [...][]int{
+	2:  {6, 18},
+	3:  {6, 22},
+	4:  {6, 26},
+	5:  {6, 30},
+	6:  {6, 34},
+	7:  {6, 22, 38},
+	8:  {6, 24, 42},
+	9:  {6, 26, 46},
+	10: {6, 28, 50},
+	11: {6, 30, 54},
+	12: {6, 32, 58},
+	13: {6, 34, 62},
+	14: {6, 26, 46, 66},
+	15: {6, 26, 48, 70},
+}
+
+const maxVersion = len(layoutsM) - 1
+
+func (l blockLayout) dataCodewords() int {
+	return l.shortCount*l.dataShort + l.longCount*(l.dataShort+1)
+}
+
+// Encode encodes text in byte mode using the smallest version that fits,
+// choosing the mask with the lowest penalty score.
+func Encode(text string) (*Code, error) {
+	var best *Code
+	bestPenalty := 0
+	for mask := 0; mask < 8; mask++ {
+		code, err := encode(text, mask)
+		if err != nil {
+			return nil, err
+		}
+		if p := code.penalty(); best == nil || p < bestPenalty {
+			best, bestPenalty = code, p
+		}
+	}
+	return best, nil
+}
+
+func encode(text string, mask int) (*Code, error) {
+	version := 0
+	for v := 1; v <= maxVersion; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) <= 8*layoutsM[v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLong, len(text))
+	}
+	code := newCode(version)
+	code.placeData(interleave(layoutsM[version], dataCodewords(text, version)))
+	code.applyMask(mask)
+	code.drawFormat(mask)
+	return code, nil
+}
+
+// dataCodewords builds the byte mode segment, terminator, and padding.
+func dataCodewords(text string, version int) []byte {
+	capacity := layoutsM[version].dataCodewords()
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	if version >= 10 {
+		bits.append(len(text), 16)
+	} else {
+		bits.append(len(text), 8)
+	}
+	for i := 0; i < len(text); i++ {
+		bits.append(int(text[i]), 8)
+	}
+	bits.append(0, min(4, 8*capacity-bits.n))
+	if bits.n%8 != 0 {
+		bits.append(0, 8-bits.n%8)
+	}
+	out := bits.bytes
+	for pad := byte(0xEC); len(out) < capacity; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+type bitBuffer struct {
+	bytes []byte
+	n     int
+}
+
+func (b *bitBuffer) append(value, width int) {
+	for i := width - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.bytes = append(b.bytes, 0)
+		}
+		if value>>i&1 == 1 {
+			b.bytes[b.n/8] |= 0x80 >> (b.n % 8)
+		}
+		b.n++
+	}
+}
+
+// interleave splits data into blocks, appends each block's error correction
+// codewords, and interleaves the result as the symbol stores it.
+func interleave(layout blockLayout, data []byte) []byte {
+	var blocks, ecBlocks [][]byte
+	for i := 0; i < layout.shortCount+layout.longCount; i++ {
+		n := layout.dataShort
+		if i >= layout.shortCount {
+			n++
+		}
+		blocks = append(blocks, data[:n])
+		ecBlocks = append(ecBlocks, reedSolomon(data[:n], layout.ecPerBlock))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i <= layout.dataShort; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// GF(256) arithmetic over the QR polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() (exp [512]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// reedSolomon returns the n error correction codewords for data.
+func reedSolomon(data []byte, n int) []byte {
+	// Generator polynomial (x-α^0)(x-α^1)...(x-α^(n-1)), highest degree
+	// coefficient (always 1) omitted.
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	rem := make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for j := range rem {
+			rem[j] ^= gfMul(gen[j], factor)
+		}
+	}
+	return rem
+}
+
+// newCode draws the function patterns of a version. Format bits are reserved
+// here and drawn once the mask is known.
+func newCode(version int) *Code {
+	size := 17 + 4*version
+	c := &Code{Version: version, Size: size, Modules: make([][]bool, size)}
+	reserved := make([][]bool, size)
+	for i := range c.Modules {
+		c.Modules[i] = make([]bool, size)
+		reserved[i] = make([]bool, size)
+	}
+	set := func(row, col int, dark bool) {
+		c.Modules[row][col] = dark
+		reserved[row][col] = true
+	}
+	for i := 0; i < size; i++ {
+		set(6, i, i%2 == 0)
+		set(i, 6, i%2 == 0)
+	}
+	finder := func(row, col int) {
+		for dr := -4; dr <= 4; dr++ {
+			for dc := -4; dc <= 4; dc++ {
+				r, cc := row+dr, col+dc
+				if r < 0 || r >= size || cc < 0 || cc >= size {
+					continue
+				}
+				d := max(abs(dr), abs(dc))
+				set(r, cc, d != 2 && d != 4)
+			}
+		}
+	}
+	finder(3, 3)
+	finder(3, size-4)
+	finder(size-4, 3)
+	centers := alignmentCenters[version]
+	for i, row := range centers {
+		for j, col := range centers {
+			last := len(centers) - 1
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dr := -2; dr <= 2; dr++ {
+				for dc := -2; dc <= 2; dc++ {
+					set(row+dr, col+dc, max(abs(dr), abs(dc)) != 1)
+				}
+			}
+		}
+	}
+	// Format information areas and the dark module.
+	for i := 0; i < 9; i++ {
+		reserved[8][i] = true
+		reserved[i][8] = true
+	}
+	for i := 0; i < 8; i++ {
+		reserved[8][size-1-i] = true
+		reserved[size-1-i][8] = true
+	}
+	set(size-8, 8, true)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			set(b, a, dark)
+			set(a, b, dark)
+		}
+	}
+	c.reserved = reserved
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// placeData fills the non-function modules in the standard zigzag order.
+func (c *Code) placeData(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			row := vert
+			if upward {
+				row = c.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				col := right - j
+				if c.reserved[row][col] || i >= len(codewords)*8 {
+					continue
+				}
+				c.Modules[row][col] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for row := 0; row < c.Size; row++ {
+		for col := 0; col < c.Size; col++ {
+			if !c.reserved[row][col] && maskBit(mask, row, col) {
+				c.Modules[row][col] = !c.Modules[row][col]
+			}
+		}
+	}
+}
+
+func maskBit(mask, row, col int) bool {
+	switch mask {
+	case 0:
+		return (row+col)%2 == 0
+	case 1:
+		return row%2 == 0
+	case 2:
+		return col%3 == 0
+	case 3:
+		return (row+col)%3 == 0
+	case 4:
+		return (row/2+col/3)%2 == 0
+	case 5:
+		return row*col%2+row*col%3 == 0
+	case 6:
+		return (row*col%2+row*col%3)%2 == 0
+	default:
+		return ((row+col)%2+row*col%3)%2 == 0
+	}
+}
+
+// drawFormat writes both copies of the format information for level M.
+func (c *Code) drawFormat(mask int) {
+	data := mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		c.Modules[i][8] = bit(i)
+	}
+	c.Modules[7][8] = bit(6)
+	c.Modules[8][8] = bit(7)
+	c.Modules[8][7] = bit(8)
+	for i := 9; i < 15; i++ {
+		c.Modules[8][14-i] = bit(i)
+	}
+	for i := 0; i < 8; i++ {
+		c.Modules[8][c.Size-1-i] = bit(i)
+	}
+	for i := 8; i < 15; i++ {
+		c.Modules[c.Size-15+i][8] = bit(i)
+	}
+}
+
+// penalty scores the symbol with the four mask evaluation rules.
+func (c *Code) penalty() int {
+	score := 0
+	dark := 0
+	line := func(get func(i int) bool) {
+		run := 0
+		var prev bool
+		for i := 0; i < c.Size; i++ {
+			m := get(i)
+			if i > 0 && m == prev {
+				run++
+			} else {
+				run = 1
+			}
+			if run == 5 {
+				score += 3
+			} else if run > 5 {
+				score++
+			}
+			prev = m
+		}
+		// 1:1:3:1:1 finder-like patterns with four light modules on
+		// either side.
+		for i := 0; i+11 <= c.Size; i++ {
+			pattern := []bool{true, false, true, true, true, false, true, false, false, false, false}
+			if matches(get, i, pattern) || matches(get, i, reversed(pattern)) {
+				score += 40
+			}
+		}
+	}
+	for row := 0; row < c.Size; row++ {
+		line(func(i int) bool { return c.Modules[row][i] })
+		line(func(i int) bool { return c.Modules[i][row] })
+		for col := 0; col < c.Size; col++ {
+			m := c.Modules[row][col]
+			if m {
+				dark++
+			}
+			if row+1 < c.Size && col+1 < c.Size && m == c.Modules[row][col+1] && m == c.Modules[row+1][col] && m == c.Modules[row+1][col+1] {
+				score += 3
+			}
+		}
+	}
+	total := c.Size * c.Size
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+func matches(get func(int) bool, start int, pattern []bool) bool {
+	for i, want := range pattern {
+		if get(start+i) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func reversed(pattern []bool) []bool {
+	out := make([]bool, len(pattern))
+	for i, v := range pattern {
+		out[len(pattern)-1-i] = v
+	}
+	return out
+}
+
+// SVG renders the code as a standalone SVG image with a four-module quiet
+// zone, each module scale pixels wide.
+func (c *Code) SVG(scale int) string {
+	full := c.Size + 8
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, full*scale, full*scale, full, full)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, full, full)
+	for row := 0; row < c.Size; row++ {
+		for col := 0; col < c.Size; col++ {
+			if c.Modules[row][col] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", col+4, row+4)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
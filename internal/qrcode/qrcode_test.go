@@ -0,0 +1,88 @@
+package qrcode
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// goldenXylitol4 is "xylitol4" as version 1 at level M with mask 2, checked
+// against an independent decoder: format bits, finder and timing patterns,
+// Reed-Solomon syndromes, and the byte mode segment.
+var goldenXylitol4 = []string{
+	"#######..##.#.#######",
+	"#.....#.....#.#.....#",
+	"#.###.#.#####.#.###.#",
+	"#.###.#.##.##.#.###.#",
+	"#.###.#.#..##.#.###.#",
+	"#.....#.#.#.#.#.....#",
+	"#######.#.#.#.#######",
+	"........#..##........",
+	"#.#####.....#.#####..",
+	".#..#..#.#..##..#..##",
+	"#####.#.#.##...#.###.",
+	"#.#.##.#..#....#.##..",
+	"..#..#####.#....#...#",
+	"........##.#######.##",
+	"#######..##.#.#...##.",
+	"#.....#.#.#####.###..",
+	"#.###.#.#.#.#...#...#",
+	"#.###.#.#...#..##....",
+	"#.###.#.#.##.#...##..",
+	"#.....#........#.##..",
+	"#######.#.##.#...#.#.",
+}
+
+func TestEncodeMatchesGolden(t *testing.T) {
+	code, err := Encode("xylitol4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code.Version != 1 || code.Size != 21 {
+		t.Fatalf("expected version 1 (21 modules), got version %d (%d)", code.Version, code.Size)
+	}
+	for row, want := range goldenXylitol4 {
+		var got strings.Builder
+		for _, dark := range code.Modules[row] {
+			if dark {
+				got.WriteByte('#')
+			} else {
+				got.WriteByte('.')
+			}
+		}
+		if got.String() != want {
+			t.Fatalf("row %d: expected %s, got %s", row, want, got.String())
+		}
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// The "HELLO WORLD" 1-M example of the QR code tutorial at thonky.com.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomon(data, 10); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestEncodeChoosesVersion(t *testing.T) {
+	for _, tt := range []struct {
+		length  int
+		version int
+	}{
+		{14, 1},
+		{15, 2},
+		{62, 4},
+		{213, 10},
+		{412, 15},
+	} {
+		code, err := Encode(strings.Repeat("a", tt.length))
+		if err != nil || code.Version != tt.version {
+			t.Fatalf("%d bytes: expected version %d, got %v, %v", tt.length, tt.version, code, err)
+		}
+	}
+	if _, err := Encode(strings.Repeat("a", 413)); !errors.Is(err, ErrTooLong) {
+		t.Fatalf("expected ErrTooLong beyond version 15, got %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+// Package redis implements the small subset of the Redis RESP2 protocol used
+// by the proxy to share state between instances. It depends only on the
+// standard library so the module keeps building without third-party clients.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error is a server-side error reply such as "WRONGTYPE ...".
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// ErrClosed is returned when commands are issued after Close.
+var ErrClosed = errors.New("redis: client closed")
+
+// Config describes how to reach a Redis server.
+type Config struct {
+	Addr        string
+	Username    string
+	Password    string
+	DB          int
+	DialTimeout time.Duration
+	MaxIdle     int
+}
+
+// ParseURL converts redis://[user:password@]host:port[/db] into a Config. A
+// bare host:port is accepted as well.
+func ParseURL(raw string) (Config, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Config{}, fmt.Errorf("redis: address is required")
+	}
+	if !strings.Contains(raw, "://") {
+		return Config{Addr: raw}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Config{}, fmt.Errorf("redis: parse url: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return Config{}, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+	}
+	cfg := Config{Addr: u.Host}
+	if u.Port() == "" {
+		cfg.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			cfg.Username = u.User.Username()
+			cfg.Password = pass
+		} else {
+			cfg.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("redis: invalid database %q", db)
+		}
+		cfg.DB = n
+	}
+	return cfg, nil
+}
+
+// Client issues commands over a small pool of connections. It is safe for
+// concurrent use.
+type Client struct {
+	cfg Config
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// NewClient prepares a client. Connections are dialled lazily.
+func NewClient(cfg Config) (*Client, error) {
+	if strings.TrimSpace(cfg.Addr) == "" {
+		return nil, fmt.Errorf("redis: address is required")
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 4
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// Do sends a single command and returns its reply. Replies are decoded into
+// string (simple and bulk strings), int64, []interface{}, or nil for null
+// bulk strings and arrays. Error replies are returned as Error values.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("redis: empty command")
+	}
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.roundTrip(ctx, args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		cn.nc.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// Close releases idle connections. In-flight commands finish on their own
+// connections, which are then discarded.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial(ctx)
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.cfg.MaxIdle {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	dialer := net.Dialer{Timeout: c.cfg.DialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: dial %s: %w", c.cfg.Addr, err)
+	}
+	cn := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if c.cfg.Password != "" {
+		args := []string{"AUTH", c.cfg.Password}
+		if c.cfg.Username != "" {
+			args = []string{"AUTH", c.cfg.Username, c.cfg.Password}
+		}
+		if _, err := cn.roundTrip(ctx, args); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis: auth: %w", err)
+		}
+	}
+	if c.cfg.DB != 0 {
+		if _, err := cn.roundTrip(ctx, []string{"SELECT", strconv.Itoa(c.cfg.DB)}); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis: select %d: %w", c.cfg.DB, err)
+		}
+	}
+	return cn, nil
+}
+
+func (cn *conn) roundTrip(ctx context.Context, args []string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Time{}
+	}
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := cn.nc.Write(encodeCommand(args)); err != nil {
+		return nil, fmt.Errorf("redis: write: %w", err)
+	}
+	return readReply(cn.r)
+}
+
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// readReply decodes one RESP2 value.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	payload := line[1:]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, Error(payload)
+	case ':':
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid integer reply %q", payload)
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", payload)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis: read bulk: %w", err)
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", payload)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readReply(r)
+			var replyErr Error
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = replyErr
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("redis: read: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Strings converts an array reply of bulk strings into a slice.
+func Strings(reply interface{}) ([]string, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: expected array reply, got %T", reply)
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("redis: expected string element, got %T", item)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// Int converts an integer reply.
+func Int(reply interface{}) (int64, error) {
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: expected integer reply, got %T", reply)
+	}
+	return n, nil
+}
@@ -0,0 +1,158 @@
+// Package systemd implements the parts of the systemd service protocol the
+// proxy uses: receiving sockets opened by a socket unit (sd_listen_fds) and
+// reporting readiness to the service manager (sd_notify). It depends only on
+// the standard library, and does nothing when not started by systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes, after standard
+// input, output, and error.
+const listenFDsStart = 3
+
+// Sockets are the sockets systemd passed to the process, keyed by the
+// FileDescriptorName= of their socket unit, which defaults to the unit's name.
+type Sockets struct {
+	packet map[string]net.PacketConn
+	stream map[string]net.Listener
+}
+
+// Activated returns the sockets systemd passed to the process, or empty
+// Sockets when it passed none. It unsets LISTEN_PID, LISTEN_FDS, and
+// LISTEN_FDNAMES so that child processes do not take the sockets for theirs.
+func Activated() (*Sockets, error) {
+	s := &Sockets{packet: make(map[string]net.PacketConn), stream: make(map[string]net.Listener)}
+	names, err := listenNames()
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if err := s.add(uintptr(listenFDsStart+i), name); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// listenNames reads and unsets the LISTEN_* variables and returns the name of
+// each socket passed to this process, in file descriptor order. Sockets
+// without a name in LISTEN_FDNAMES are called "unknown", as systemd does.
+func listenNames() ([]string, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("systemd: invalid LISTEN_FDS %q", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	socketNames := make([]string, count)
+	for i := range socketNames {
+		socketNames[i] = "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			socketNames[i] = fdNames[i]
+		}
+	}
+	return socketNames, nil
+}
+
+// add wraps the passed file descriptor fd as a listener or, failing that, a
+// packet connection. Either duplicates fd, which is then closed.
+func (s *Sockets) add(fd uintptr, name string) error {
+	f := os.NewFile(fd, name)
+	defer f.Close()
+	if _, taken := s.packet[name]; taken {
+		return fmt.Errorf("systemd: more than one socket is named %q", name)
+	}
+	if _, taken := s.stream[name]; taken {
+		return fmt.Errorf("systemd: more than one socket is named %q", name)
+	}
+	if ln, err := net.FileListener(f); err == nil {
+		s.stream[name] = ln
+		return nil
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return fmt.Errorf("systemd: socket %q (fd %d) is neither listening nor datagram: %w", name, fd, err)
+	}
+	s.packet[name] = conn
+	return nil
+}
+
+// PacketConn removes and returns the datagram socket named name, or nil.
+func (s *Sockets) PacketConn(name string) net.PacketConn {
+	conn := s.packet[name]
+	delete(s.packet, name)
+	return conn
+}
+
+// Listener removes and returns the listening socket named name, or nil.
+func (s *Sockets) Listener(name string) net.Listener {
+	ln := s.stream[name]
+	delete(s.stream, name)
+	return ln
+}
+
+// Unused returns the names of the sockets not yet taken, sorted.
+func (s *Sockets) Unused() []string {
+	var names []string
+	for name := range s.packet {
+		names = append(names, name)
+	}
+	for name := range s.stream {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the sockets not yet taken.
+func (s *Sockets) Close() {
+	for name, conn := range s.packet {
+		conn.Close()
+		delete(s.packet, name)
+	}
+	for name, ln := range s.stream {
+		ln.Close()
+		delete(s.stream, name)
+	}
+}
+
+// Notify sends state, such as "READY=1" or "STOPPING=1", to the service
+// manager at $NOTIFY_SOCKET. It reports whether the message was sent, which
+// it is not when the variable is unset because systemd did not ask for
+// notifications.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Go maps a leading '@' to the abstract namespace, as systemd means it.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("systemd: notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("systemd: notify: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,186 @@
+//go:build unix
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenNames(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	for _, tt := range []struct {
+		pid, fds, names string
+		want            []string
+		err             string
+	}{
+		{"", "", "", nil, ""},
+		{self, "", "sip", nil, ""},
+		{"", "2", "sip:http", nil, ""},
+		{"1", "2", "sip:http", nil, ""},
+		{self, "0", "", []string{}, ""},
+		{self, "1", "", []string{"unknown"}, ""},
+		{self, "2", "sip:http", []string{"sip", "http"}, ""},
+		{self, "3", "sip::", []string{"sip", "unknown", "unknown"}, ""},
+		{self, "3", "sip", []string{"sip", "unknown", "unknown"}, ""},
+		{self, "1", "sip:http:admin", []string{"sip"}, ""},
+		{self, "two", "", nil, `systemd: invalid LISTEN_FDS "two"`},
+		{self, "-1", "", nil, `systemd: invalid LISTEN_FDS "-1"`},
+	} {
+		t.Setenv("LISTEN_PID", tt.pid)
+		t.Setenv("LISTEN_FDS", tt.fds)
+		t.Setenv("LISTEN_FDNAMES", tt.names)
+		got, err := listenNames()
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("%s/%s: expected %q, got %v", tt.pid, tt.fds, tt.err, err)
+			}
+		} else if err != nil || !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+			t.Fatalf("%s/%s/%s: expected %q, got %q (%v)", tt.pid, tt.fds, tt.names, tt.want, got, err)
+		}
+		// Child processes must not think the sockets are theirs.
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			if _, set := os.LookupEnv(name); set {
+				t.Fatalf("expected %s to be unset", name)
+			}
+		}
+	}
+}
+
+func TestActivatedWithoutSockets(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	s, err := Activated()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Listener("http") != nil || s.PacketConn("sip") != nil || len(s.Unused()) != 0 {
+		t.Fatalf("expected no sockets for another process")
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	if _, err := Activated(); err == nil {
+		t.Fatalf("expected an invalid LISTEN_FDS to be an error")
+	}
+}
+
+// passedFD returns a new descriptor for the socket of f, which add takes over
+// as it would one passed by systemd.
+func passedFD(t *testing.T, f interface{ File() (*os.File, error) }) uintptr {
+	t.Helper()
+	file, err := f.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uintptr(fd)
+}
+
+func TestSocketsWrapPassedDescriptors(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &Sockets{packet: make(map[string]net.PacketConn), stream: make(map[string]net.Listener)}
+	defer s.Close()
+	if err := s.add(passedFD(t, ln), "http"); err != nil {
+		t.Fatalf("listener: %v", err)
+	}
+	if err := s.add(passedFD(t, conn), "sip"); err != nil {
+		t.Fatalf("packet conn: %v", err)
+	}
+	if err := s.add(passedFD(t, conn), "http"); err == nil || !strings.Contains(err.Error(), `more than one socket is named "http"`) {
+		t.Fatalf("expected a duplicate name to be an error, got %v", err)
+	}
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(uintptr(fd), "file"); err == nil || !strings.Contains(err.Error(), "neither listening nor datagram") {
+		t.Fatalf("expected a regular file to be an error, got %v", err)
+	}
+	file.Close()
+	if got := s.Unused(); !slices.Equal(got, []string{"http", "sip"}) {
+		t.Fatalf("expected http and sip unused, got %q", got)
+	}
+
+	passed := s.Listener("http")
+	if passed == nil || passed.Addr().String() != ln.Addr().String() {
+		t.Fatalf("expected the listener on %s, got %v", ln.Addr(), passed)
+	}
+	defer passed.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	passed.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	if accepted, err := passed.Accept(); err != nil {
+		t.Fatalf("expected the passed listener to accept, got %v", err)
+	} else {
+		accepted.Close()
+	}
+	if s.Listener("http") != nil || s.PacketConn("http") != nil {
+		t.Fatalf("expected a socket to be taken once")
+	}
+	if got := s.Unused(); !slices.Equal(got, []string{"sip"}) {
+		t.Fatalf("expected sip unused, got %q", got)
+	}
+	s.Close()
+	if len(s.Unused()) != 0 || s.PacketConn("sip") != nil {
+		t.Fatalf("expected Close to drop the sockets not taken")
+	}
+}
+
+func TestNotifyWritesToTheNotifySocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Notify("READY=1"); sent || err != nil {
+		t.Fatalf("expected nothing sent without NOTIFY_SOCKET, got %v, %v", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+	manager, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		if sent, err := Notify(state); !sent || err != nil {
+			t.Fatalf("expected %s to be sent, got %v, %v", state, sent, err)
+		}
+		manager.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 64)
+		n, err := manager.Read(buf)
+		if err != nil || string(buf[:n]) != state {
+			t.Fatalf("expected one datagram %q, got %q (%v)", state, buf[:n], err)
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if sent, err := Notify("READY=1"); sent || err == nil || !strings.HasPrefix(err.Error(), "systemd: notify: ") {
+		t.Fatalf("expected an error for a missing socket, got %v, %v", sent, err)
+	}
+}
@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP with
+// the JSON encoding.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+}
+
+// NewOTLPExporter returns an exporter for the collector at endpoint, the
+// base URL such as http://collector:4318. The /v1/traces path is appended
+// unless endpoint already ends with it.
+func NewOTLPExporter(endpoint, serviceName string) (*OTLPExporter, error) {
+	endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+	if endpoint == "" {
+		return nil, fmt.Errorf("tracing: OTLP endpoint is required")
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("tracing: OTLP endpoint %q must be an http or https URL", endpoint)
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	if serviceName == "" {
+		serviceName = "xylitol4"
+	}
+	return &OTLPExporter{
+		url:     endpoint,
+		service: serviceName,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// Export sends one batch of spans.
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return fmt.Errorf("tracing: encode spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("tracing: build export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("tracing: export spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("tracing: collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) encode(spans []SpanData) otlpRequest {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "xylitol4/sip"
+	scope.Spans = make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		out := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              int(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent != (SpanID{}) {
+			out.ParentSpanID = span.Parent.String()
+		}
+		for _, attr := range span.Attributes {
+			out.Attributes = append(out.Attributes, otlpAttr(attr))
+		}
+		if span.Error != "" {
+			// STATUS_CODE_ERROR
+			out.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, out)
+	}
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{otlpAttr(String("service.name", e.service))}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+func otlpAttr(attr Attribute) otlpAttribute {
+	if attr.IsInt {
+		// OTLP/JSON encodes 64-bit integers as strings.
+		value := strconv.FormatInt(attr.Int, 10)
+		return otlpAttribute{Key: attr.Key, Value: otlpValue{IntValue: &value}}
+	}
+	value := attr.String
+	return otlpAttribute{Key: attr.Key, Value: otlpValue{StringValue: &value}}
+}
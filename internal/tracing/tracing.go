@@ -0,0 +1,288 @@
+// Package tracing records OpenTelemetry-compatible spans and exports them in
+// batches, by default to an OTLP/HTTP collector using the JSON encoding. It
+// implements only what the proxy needs: explicit parents, string and integer
+// attributes, and an error status, without context propagation through
+// context.Context.
+//
+// Every method is safe on a nil receiver and does nothing, so components can
+// be instrumented unconditionally.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the lower-case hex form used by OTLP and traceparent.
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// String returns the lower-case hex form used by OTLP and traceparent.
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext names a span so that other spans can be parented to it.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid reports whether the context names a span.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attribute is a span attribute holding either a string or an integer.
+type Attribute struct {
+	Key    string
+	String string
+	Int    int64
+	IsInt  bool
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{Key: key, String: value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int) Attribute { return Attribute{Key: key, Int: int64(value), IsInt: true} }
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	Context    SpanContext
+	Parent     SpanID
+	Name       string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Error, when set, marks the span as failed with this description.
+	Error string
+}
+
+// Exporter sends finished spans to a backend.
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// Config configures a Tracer.
+type Config struct {
+	Exporter Exporter
+	// BatchSize is how many spans to send at once (512 when not positive).
+	BatchSize int
+	// Interval is the longest a span waits before being sent (5s when not
+	// positive).
+	Interval time.Duration
+	Logger   *slog.Logger
+}
+
+// Tracer creates spans and exports them in the background. Spans are
+// dropped rather than blocking the caller when the export queue is full.
+type Tracer struct {
+	cfg    Config
+	logger *slog.Logger
+	queue  chan SpanData
+	flush  chan chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+	finished  chan struct{}
+}
+
+// NewTracer starts a tracer exporting through cfg.Exporter.
+func NewTracer(cfg Config) *Tracer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	t := &Tracer{
+		cfg:      cfg,
+		logger:   logger,
+		queue:    make(chan SpanData, 8*cfg.BatchSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Span is a span in progress. End it exactly once.
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+	ended  bool
+}
+
+// Start begins a span at start. A zero start means now. An invalid parent
+// starts a new trace.
+func (t *Tracer) Start(name string, kind Kind, parent SpanContext, start time.Time, attrs ...Attribute) *Span {
+	if t == nil {
+		return nil
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	data := SpanData{Name: name, Kind: kind, Start: start, Attributes: attrs}
+	if parent.IsValid() {
+		data.Context.TraceID = parent.TraceID
+		data.Parent = parent.SpanID
+	} else {
+		rand.Read(data.Context.TraceID[:])
+	}
+	rand.Read(data.Context.SpanID[:])
+	return &Span{tracer: t, data: data}
+}
+
+// Record exports a span that has already finished.
+func (t *Tracer) Record(name string, kind Kind, parent SpanContext, start, end time.Time, attrs ...Attribute) SpanContext {
+	span := t.Start(name, kind, parent, start, attrs...)
+	span.End(end)
+	return span.Context()
+}
+
+// Context returns the span's identity for parenting other spans.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(description string) {
+	if s == nil {
+		return
+	}
+	s.data.Error = description
+}
+
+// End finishes the span at end, or now when end is zero, and queues it for
+// export. Later calls do nothing.
+func (s *Span) End(end time.Time) {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.data.End = end
+	select {
+	case s.tracer.queue <- s.data:
+	default:
+	}
+}
+
+// Flush exports every queued span and waits until it has been sent.
+func (t *Tracer) Flush(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-t.finished:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ack:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown exports the queued spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.Flush(ctx)
+	t.closeOnce.Do(func() { close(t.done) })
+	select {
+	case <-t.finished:
+	case <-ctx.Done():
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.finished)
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, t.cfg.BatchSize)
+	send := func() {
+		if len(batch) == 0 || t.cfg.Exporter == nil {
+			batch = batch[:0]
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := t.cfg.Exporter.Export(ctx, batch); err != nil {
+			t.logger.Warn("failed to export spans", "spans", len(batch), "error", err)
+		}
+		cancel()
+		batch = make([]SpanData, 0, t.cfg.BatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) >= t.cfg.BatchSize {
+					send()
+				}
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.cfg.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-t.flush:
+			drain()
+			send()
+			close(ack)
+		case <-t.done:
+			drain()
+			send()
+			return
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an httptest OTLP/HTTP collector that keeps every request it
+// receives.
+type collector struct {
+	srv    *httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []otlpRequest
+	paths    []string
+	types    []string
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+	c := &collector{status: http.StatusOK}
+	c.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil {
+			t.Errorf("collector: bad body %q: %v", body, err)
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, req)
+		c.paths = append(c.paths, r.Method+" "+r.URL.Path)
+		c.types = append(c.types, r.Header.Get("Content-Type"))
+		status := c.status
+		c.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+// spans returns every span the collector received, in order.
+func (c *collector) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, resource := range req.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// newTestTracer returns a tracer exporting to c that only sends on Flush,
+// Shutdown, or a full batch.
+func newTestTracer(t *testing.T, c *collector, batchSize int) *Tracer {
+	t.Helper()
+	exporter, err := NewOTLPExporter(c.srv.URL, "sip-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(Config{Exporter: exporter, BatchSize: batchSize, Interval: time.Hour})
+	t.Cleanup(func() { tracer.Shutdown(context.Background()) })
+	return tracer
+}
+
+var (
+	traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	spanIDPattern  = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+func TestTracerStartsTracesAndChildSpans(t *testing.T) {
+	tracer := NewTracer(Config{Interval: time.Hour})
+	t.Cleanup(func() { tracer.Shutdown(context.Background()) })
+
+	root := tracer.Start("root", KindServer, SpanContext{}, time.Time{})
+	other := tracer.Start("other", KindServer, SpanContext{}, time.Time{})
+	if !root.Context().IsValid() || root.Context().TraceID == other.Context().TraceID {
+		t.Fatalf("expected each span without a parent to start its own trace")
+	}
+	if root.data.Parent != (SpanID{}) || root.data.Start.IsZero() {
+		t.Fatalf("expected a root span starting now, got %+v", root.data)
+	}
+	child := tracer.Start("child", KindInternal, root.Context(), time.Time{})
+	if child.Context().TraceID != root.Context().TraceID || child.data.Parent != root.Context().SpanID || child.Context().SpanID == root.Context().SpanID {
+		t.Fatalf("expected a new span in the parent's trace, got %+v under %+v", child.Context(), root.Context())
+	}
+	// A parent with only half an identity is not a parent.
+	orphan := tracer.Start("orphan", KindInternal, SpanContext{TraceID: root.Context().TraceID}, time.Time{})
+	if orphan.Context().TraceID == root.Context().TraceID || orphan.data.Parent != (SpanID{}) {
+		t.Fatalf("expected an invalid parent to start a new trace")
+	}
+
+	var nilTracer *Tracer
+	span := nilTracer.Start("nothing", KindInternal, root.Context(), time.Time{})
+	span.SetAttributes(String("k", "v"))
+	span.SetError("ignored")
+	span.End(time.Time{})
+	if span != nil || span.Context().IsValid() || nilTracer.Record("nothing", KindInternal, root.Context(), time.Time{}, time.Time{}).IsValid() {
+		t.Fatalf("expected a nil tracer to make no spans")
+	}
+	nilTracer.Flush(context.Background())
+	nilTracer.Shutdown(context.Background())
+}
+
+func TestOTLPExporterPostsTheSpans(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTestTracer(t, c, 16)
+	start := time.Unix(1_700_000_000, 123_456_789)
+
+	root := tracer.Start("sip.server_transaction", KindServer, SpanContext{}, start, String("sip.method", "INVITE"))
+	root.SetAttributes(Int("sip.status_code", 503))
+	root.SetError("final response 503")
+	child := tracer.Record("sip.tu", KindInternal, root.Context(), start.Add(time.Millisecond), start.Add(2*time.Millisecond))
+	root.End(start.Add(time.Second))
+	root.End(start.Add(time.Hour))
+	tracer.Flush(context.Background())
+
+	c.mu.Lock()
+	if len(c.requests) != 1 || c.paths[0] != "POST /v1/traces" || c.types[0] != "application/json" {
+		t.Fatalf("expected one JSON POST to /v1/traces, got %q with %q", c.paths, c.types)
+	}
+	resource := c.requests[0].ResourceSpans[0]
+	c.mu.Unlock()
+	if len(resource.Resource.Attributes) != 1 || resource.Resource.Attributes[0].Key != "service.name" || *resource.Resource.Attributes[0].Value.StringValue != "sip-proxy" {
+		t.Fatalf("expected the service name as the resource, got %+v", resource.Resource.Attributes)
+	}
+	if len(resource.ScopeSpans) != 1 || resource.ScopeSpans[0].Scope.Name != "xylitol4/sip" {
+		t.Fatalf("expected one instrumentation scope, got %+v", resource.ScopeSpans)
+	}
+
+	spans := c.spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected each span exported once, got %d", len(spans))
+	}
+	tu, server := spans[0], spans[1]
+	for _, span := range spans {
+		if !traceIDPattern.MatchString(span.TraceID) || !spanIDPattern.MatchString(span.SpanID) {
+			t.Fatalf("expected lower-case hex IDs, got %q and %q", span.TraceID, span.SpanID)
+		}
+	}
+	if server.TraceID != root.Context().TraceID.String() || server.SpanID != root.Context().SpanID.String() || server.ParentSpanID != "" {
+		t.Fatalf("expected the root span without a parent, got %+v", server)
+	}
+	if server.Name != "sip.server_transaction" || server.Kind != 2 {
+		t.Fatalf("expected a server span, got %q kind %d", server.Name, server.Kind)
+	}
+	if server.StartTimeUnixNano != "1700000000123456789" || server.EndTimeUnixNano != strconv.FormatInt(start.Add(time.Second).UnixNano(), 10) {
+		t.Fatalf("expected the first End to set the end time, got %s to %s", server.StartTimeUnixNano, server.EndTimeUnixNano)
+	}
+	if len(server.Attributes) != 2 || *server.Attributes[0].Value.StringValue != "INVITE" || server.Attributes[1].Value.IntValue == nil || *server.Attributes[1].Value.IntValue != "503" {
+		t.Fatalf("expected a string and a string-encoded integer attribute, got %+v", server.Attributes)
+	}
+	if server.Status.Code != 2 || server.Status.Message != "final response 503" {
+		t.Fatalf("expected an error status, got %+v", server.Status)
+	}
+	if tu.Kind != 1 || tu.Status.Code != 0 || tu.Attributes != nil {
+		t.Fatalf("expected an internal span with an unset status, got %+v", tu)
+	}
+	if tu.TraceID != server.TraceID || tu.SpanID != child.SpanID.String() || tu.ParentSpanID != server.SpanID {
+		t.Fatalf("expected the child exported under its parent, got %+v", tu)
+	}
+}
+
+func TestTraceContextPropagatesAlongAChain(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTestTracer(t, c, 2)
+
+	// As in the proxy, each hop is parented to the span the message carries.
+	parent := tracer.Record("sip.receive", KindServer, SpanContext{}, time.Time{}, time.Time{})
+	want := []SpanContext{parent}
+	for _, name := range []string{"sip.transport", "sip.transaction", "sip.tu", "sip.send"} {
+		parent = tracer.Record(name, KindInternal, parent, time.Time{}, time.Time{})
+		want = append(want, parent)
+	}
+	tracer.Shutdown(context.Background())
+
+	spans := c.spans()
+	if len(spans) != len(want) {
+		t.Fatalf("expected %d spans, got %d", len(want), len(spans))
+	}
+	for i, span := range spans {
+		if span.TraceID != want[0].TraceID.String() || span.SpanID != want[i].SpanID.String() {
+			t.Fatalf("span %d: expected %v in the first span's trace, got %s/%s", i, want[i], span.TraceID, span.SpanID)
+		}
+		if i > 0 && span.ParentSpanID != spans[i-1].SpanID {
+			t.Fatalf("span %d: expected the previous hop %s as parent, got %q", i, spans[i-1].SpanID, span.ParentSpanID)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Batches of two were sent as they filled; Shutdown sent the last one.
+	if len(c.requests) != 3 {
+		t.Fatalf("expected three batches, got %d", len(c.requests))
+	}
+}
+
+func TestOTLPExporterReportsCollectorErrors(t *testing.T) {
+	c := newCollector(t)
+	c.status = http.StatusServiceUnavailable
+	exporter, err := NewOTLPExporter(c.srv.URL+"/v1/traces/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(context.Background(), []SpanData{{Name: "x"}}); err == nil {
+		t.Fatalf("expected a 503 from the collector to be an error")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.paths) != 1 || c.paths[0] != "POST /v1/traces" {
+		t.Fatalf("expected the path not to be doubled, got %q", c.paths)
+	}
+	if attrs := c.requests[0].ResourceSpans[0].Resource.Attributes; *attrs[0].Value.StringValue != "xylitol4" {
+		t.Fatalf("expected the default service name, got %+v", attrs)
+	}
+	for _, endpoint := range []string{"", "collector:4318", "grpc://collector:4317"} {
+		if _, err := NewOTLPExporter(endpoint, ""); err == nil {
+			t.Fatalf("%q: expected an error", endpoint)
+		}
+	}
+}
@@ -0,0 +1,1132 @@
+package userweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"xylitol4/sip"
+	"xylitol4/sip/userdb"
+)
+
+// RegistrationSource exposes the registrar's active bindings to the API and
+// the registration status page. *sip.SIPStack satisfies it.
+type RegistrationSource interface {
+	BindingsFor(username, domain string) []sip.Registration
+	AllBindings() map[string][]sip.Registration
+	Deregister(username, domain, contact string) error
+}
+
+// maxAPIBodySize bounds JSON request bodies accepted by the API.
+const maxAPIBodySize = 1 << 20
+
+// apiUser is the JSON form of a directory entry. Password hashes are accepted
+// on input but never returned.
+type apiUser struct {
+	Username     string `json:"username"`
+	Domain       string `json:"domain"`
+	ContactURI   string `json:"contact_uri,omitempty"`
+	Enabled      bool   `json:"enabled"`
+	HasPassword  bool   `json:"has_password"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+type apiUserPatch struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type apiPassword struct {
+	Password     string `json:"password"`
+	PasswordHash string `json:"password_hash"`
+}
+
+type apiBroadcastRule struct {
+	ID          int64    `json:"id"`
+	Address     string   `json:"address"`
+	Description string   `json:"description,omitempty"`
+	Targets     []string `json:"targets"`
+}
+
+type apiTrunkRoute struct {
+	ID          int64  `json:"id"`
+	Prefix      string `json:"prefix"`
+	Trunk       string `json:"trunk"`
+	Strip       int    `json:"strip,omitempty"`
+	Prepend     string `json:"prepend,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type apiShortNumber struct {
+	ID          int64  `json:"id"`
+	Domain      string `json:"domain"`
+	Number      string `json:"number"`
+	Target      string `json:"target"`
+	Description string `json:"description,omitempty"`
+}
+
+type apiCallerIDRule struct {
+	ID                int64  `json:"id"`
+	Caller            string `json:"caller,omitempty"`
+	Trunk             string `json:"trunk,omitempty"`
+	DisplayName       string `json:"display_name,omitempty"`
+	User              string `json:"user,omitempty"`
+	Host              string `json:"host,omitempty"`
+	PreferredIdentity bool   `json:"preferred_identity,omitempty"`
+	Description       string `json:"description,omitempty"`
+}
+
+type apiDomain struct {
+	Name               string   `json:"name"`
+	Aliases            []string `json:"aliases,omitempty"`
+	DefaultExpires     int      `json:"default_expires,omitempty"`
+	AuthPolicy         string   `json:"auth_policy"`
+	Trunk              string   `json:"trunk,omitempty"`
+	BroadcastNamespace string   `json:"broadcast_namespace,omitempty"`
+	Description        string   `json:"description,omitempty"`
+}
+
+type apiRegistration struct {
+	Contact   string    `json:"contact"`
+	Expires   time.Time `json:"expires"`
+	Source    string    `json:"source,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func toAPIUser(user userdb.User) apiUser {
+	return apiUser{
+		Username:    user.Username,
+		Domain:      user.Domain,
+		ContactURI:  user.ContactURI,
+		Enabled:     !user.Disabled,
+		HasPassword: user.PasswordHash != "",
+	}
+}
+
+func toAPIRegistration(binding sip.Registration) apiRegistration {
+	return apiRegistration{
+		Contact:   binding.Contact,
+		Expires:   binding.Expires.UTC(),
+		Source:    binding.Source,
+		UserAgent: binding.UserAgent,
+	}
+}
+
+func toAPIBroadcastRule(rule userdb.BroadcastRule) apiBroadcastRule {
+	targets := make([]string, len(rule.Targets))
+	for i, target := range rule.Targets {
+		targets[i] = target.ContactURI
+	}
+	return apiBroadcastRule{ID: rule.ID, Address: rule.Address, Description: rule.Description, Targets: targets}
+}
+
+func toAPITrunkRoute(route userdb.TrunkRoute) apiTrunkRoute {
+	return apiTrunkRoute{
+		ID:          route.ID,
+		Prefix:      route.Prefix,
+		Trunk:       route.Trunk,
+		Strip:       route.Strip,
+		Prepend:     route.Prepend,
+		Description: route.Description,
+	}
+}
+
+// apiRoute is a JSON API endpoint and the token scope it requires. An empty
+// scope accepts any valid token.
+type apiRoute struct {
+	pattern string
+	scope   userdb.APIScope
+	handler http.HandlerFunc
+}
+
+// registerAPI adds the /api/v1/ routes to mux. Every route requires either
+// the bearer token from the command line, which grants every scope, or a
+// token created on the API token page whose scopes cover the route.
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	routes := []apiRoute{
+		{"GET /api/v1/users", userdb.ScopeUsersRead, s.apiListUsers},
+		{"POST /api/v1/users", userdb.ScopeUsersWrite, s.apiCreateUser},
+		{"GET /api/v1/users/{address}", userdb.ScopeUsersRead, s.apiGetUser},
+		{"PATCH /api/v1/users/{address}", userdb.ScopeUsersWrite, s.apiPatchUser},
+		{"DELETE /api/v1/users/{address}", userdb.ScopeUsersWrite, s.apiDeleteUser},
+		{"PUT /api/v1/users/{address}/password", userdb.ScopeUsersWrite, s.apiSetPassword},
+		{"GET /api/v1/users/{address}/registrations", userdb.ScopeUsersRead, s.apiListRegistrations},
+		{"GET /api/v1/broadcast-rules", userdb.ScopeRulesRead, s.apiListBroadcastRules},
+		{"POST /api/v1/broadcast-rules", userdb.ScopeRulesWrite, s.apiCreateBroadcastRule},
+		{"GET /api/v1/broadcast-rules/{id}", userdb.ScopeRulesRead, s.apiGetBroadcastRule},
+		{"PUT /api/v1/broadcast-rules/{id}", userdb.ScopeRulesWrite, s.apiUpdateBroadcastRule},
+		{"DELETE /api/v1/broadcast-rules/{id}", userdb.ScopeRulesWrite, s.apiDeleteBroadcastRule},
+		{"GET /api/v1/trunk-routes", userdb.ScopeRulesRead, s.apiListTrunkRoutes},
+		{"POST /api/v1/trunk-routes", userdb.ScopeRulesWrite, s.apiCreateTrunkRoute},
+		{"GET /api/v1/trunk-routes/{id}", userdb.ScopeRulesRead, s.apiGetTrunkRoute},
+		{"PUT /api/v1/trunk-routes/{id}", userdb.ScopeRulesWrite, s.apiUpdateTrunkRoute},
+		{"DELETE /api/v1/trunk-routes/{id}", userdb.ScopeRulesWrite, s.apiDeleteTrunkRoute},
+		{"GET /api/v1/short-numbers", userdb.ScopeRulesRead, s.apiListShortNumbers},
+		{"POST /api/v1/short-numbers", userdb.ScopeRulesWrite, s.apiCreateShortNumber},
+		{"GET /api/v1/short-numbers/{id}", userdb.ScopeRulesRead, s.apiGetShortNumber},
+		{"PUT /api/v1/short-numbers/{id}", userdb.ScopeRulesWrite, s.apiUpdateShortNumber},
+		{"DELETE /api/v1/short-numbers/{id}", userdb.ScopeRulesWrite, s.apiDeleteShortNumber},
+		{"GET /api/v1/caller-id-rules", userdb.ScopeRulesRead, s.apiListCallerIDRules},
+		{"POST /api/v1/caller-id-rules", userdb.ScopeRulesWrite, s.apiCreateCallerIDRule},
+		{"GET /api/v1/caller-id-rules/{id}", userdb.ScopeRulesRead, s.apiGetCallerIDRule},
+		{"PUT /api/v1/caller-id-rules/{id}", userdb.ScopeRulesWrite, s.apiUpdateCallerIDRule},
+		{"DELETE /api/v1/caller-id-rules/{id}", userdb.ScopeRulesWrite, s.apiDeleteCallerIDRule},
+		{"GET /api/v1/domains", userdb.ScopeRulesRead, s.apiListDomains},
+		{"POST /api/v1/domains", userdb.ScopeRulesWrite, s.apiCreateDomain},
+		{"GET /api/v1/domains/{name}", userdb.ScopeRulesRead, s.apiGetDomain},
+		{"PUT /api/v1/domains/{name}", userdb.ScopeRulesWrite, s.apiUpdateDomain},
+		{"DELETE /api/v1/domains/{name}", userdb.ScopeRulesWrite, s.apiDeleteDomain},
+		{"GET /api/v1/trace", userdb.ScopeTrace, s.apiGetTrace},
+		{"PUT /api/v1/trace", userdb.ScopeTrace, s.apiSetTrace},
+		{"GET /api/v1/trace/messages", userdb.ScopeTrace, s.apiListTraces},
+		{"GET /api/v1/trace/stream", userdb.ScopeTrace, s.apiStreamTraces},
+		{"POST /api/v1/reload", userdb.ScopeReload, s.apiReload},
+		{"/api/v1/", "", s.apiNotFound},
+	}
+	for _, route := range routes {
+		mux.HandleFunc(route.pattern, s.tokenAuth(route.scope, route.handler))
+	}
+}
+
+type apiActorKey struct{}
+
+// tokenAuth admits requests whose bearer token grants scope and records the
+// token in the request context for the audit log.
+func (s *Server) tokenAuth(scope userdb.APIScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		bearer = strings.TrimSpace(bearer)
+		if !ok || bearer == "" {
+			s.rejectToken(w)
+			return
+		}
+		actor := staticTokenActor
+		if s.apiToken == "" || !subtleCompare(bearer, s.apiToken) {
+			token, err := s.store.APITokenByHash(r.Context(), userdb.HashAPIToken(bearer))
+			if errors.Is(err, userdb.ErrAPITokenNotFound) {
+				s.rejectToken(w)
+				return
+			}
+			if err != nil {
+				s.writeStoreError(w, "look up API token", err)
+				return
+			}
+			if scope != "" && !token.Allows(scope) {
+				writeAPIError(w, http.StatusForbidden, fmt.Sprintf("the token does not have the %s scope", scope))
+				return
+			}
+			actor = apiTokenActor(*token)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiActorKey{}, actor)))
+	}
+}
+
+func (s *Server) rejectToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeAPIError(w, http.StatusUnauthorized, "a valid bearer token is required")
+}
+
+// apiActor returns the audit log actor of an authenticated API request.
+func apiActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(apiActorKey{}).(string); ok {
+		return actor
+	}
+	return staticTokenActor
+}
+
+func (s *Server) apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "no such endpoint")
+}
+
+func (s *Server) apiListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.store.AllUsers(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list users", err)
+		return
+	}
+	out := make([]apiUser, len(users))
+	for i, user := range users {
+		out[i] = toAPIUser(user)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	var in apiUser
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	in.Username = strings.TrimSpace(in.Username)
+	in.Domain = strings.TrimSpace(in.Domain)
+	if in.Username == "" || in.Domain == "" {
+		writeAPIError(w, http.StatusBadRequest, "username and domain are required")
+		return
+	}
+	if in.Password != "" && in.PasswordHash != "" {
+		writeAPIError(w, http.StatusBadRequest, "give either password or password_hash, not both")
+		return
+	}
+	user := userdb.User{
+		Username:     in.Username,
+		Domain:       in.Domain,
+		PasswordHash: strings.TrimSpace(in.PasswordHash),
+		ContactURI:   strings.TrimSpace(in.ContactURI),
+	}
+	if in.Password != "" {
+		user.PasswordHash = userdb.HashPassword(user.Username, user.Domain, in.Password)
+	}
+	if err := s.store.CreateUser(r.Context(), user); err != nil {
+		s.writeStoreError(w, "create user", err)
+		return
+	}
+	created, err := s.store.Lookup(r.Context(), user.Username, user.Domain)
+	if err != nil {
+		s.writeStoreError(w, "look up created user", err)
+		return
+	}
+	s.audit(r, apiActor(r), "user.create", created.Username+"@"+created.Domain, nil, toAPIUser(*created))
+	w.Header().Set("Location", "/api/v1/users/"+created.Username+"@"+created.Domain)
+	writeJSON(w, http.StatusCreated, toAPIUser(*created))
+}
+
+func (s *Server) apiGetUser(w http.ResponseWriter, r *http.Request) {
+	username, domain, ok := userAddress(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.store.Lookup(r.Context(), username, domain)
+	if err != nil {
+		s.writeStoreError(w, "look up user", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(*user))
+}
+
+func (s *Server) apiPatchUser(w http.ResponseWriter, r *http.Request) {
+	username, domain, ok := userAddress(w, r)
+	if !ok {
+		return
+	}
+	var patch apiUserPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	ctx := r.Context()
+	before := s.userSnapshot(r, username, domain)
+	if patch.Enabled != nil {
+		if err := s.store.SetUserEnabled(ctx, username, domain, *patch.Enabled); err != nil {
+			s.writeStoreError(w, "update user", err)
+			return
+		}
+	}
+	user, err := s.store.Lookup(ctx, username, domain)
+	if err != nil {
+		s.writeStoreError(w, "look up user", err)
+		return
+	}
+	if patch.Enabled != nil {
+		s.audit(r, apiActor(r), "user.update", username+"@"+domain, before, toAPIUser(*user))
+	}
+	writeJSON(w, http.StatusOK, toAPIUser(*user))
+}
+
+func (s *Server) apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username, domain, ok := userAddress(w, r)
+	if !ok {
+		return
+	}
+	before := s.userSnapshot(r, username, domain)
+	if err := s.store.DeleteUser(r.Context(), username, domain); err != nil {
+		s.writeStoreError(w, "delete user", err)
+		return
+	}
+	s.audit(r, apiActor(r), "user.delete", username+"@"+domain, before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiSetPassword(w http.ResponseWriter, r *http.Request) {
+	username, domain, ok := userAddress(w, r)
+	if !ok {
+		return
+	}
+	var in apiPassword
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	hash := strings.TrimSpace(in.PasswordHash)
+	switch {
+	case in.Password != "" && hash != "":
+		writeAPIError(w, http.StatusBadRequest, "give either password or password_hash, not both")
+		return
+	case in.Password != "":
+		hash = userdb.HashPassword(username, domain, in.Password)
+	case hash == "":
+		writeAPIError(w, http.StatusBadRequest, "password or password_hash is required")
+		return
+	}
+	if err := s.store.UpdatePassword(r.Context(), username, domain, hash); err != nil {
+		s.writeStoreError(w, "update password", err)
+		return
+	}
+	s.audit(r, apiActor(r), "user.password", username+"@"+domain, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiListRegistrations(w http.ResponseWriter, r *http.Request) {
+	username, domain, ok := userAddress(w, r)
+	if !ok {
+		return
+	}
+	if _, err := s.store.Lookup(r.Context(), username, domain); err != nil {
+		s.writeStoreError(w, "look up user", err)
+		return
+	}
+	out := []apiRegistration{}
+	if s.registrations != nil {
+		for _, binding := range s.registrations.BindingsFor(username, domain) {
+			out = append(out, toAPIRegistration(binding))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiListBroadcastRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.store.ListBroadcastRules(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list broadcast rules", err)
+		return
+	}
+	out := make([]apiBroadcastRule, len(rules))
+	for i, rule := range rules {
+		out[i] = toAPIBroadcastRule(rule)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateBroadcastRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeBroadcastRule(w, r)
+	if !ok {
+		return
+	}
+	created, err := s.store.CreateBroadcastRule(r.Context(), rule)
+	if err != nil {
+		s.writeStoreError(w, "create broadcast rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "broadcast.create", strconv.FormatInt(created.ID, 10), nil, toAPIBroadcastRule(*created))
+	w.Header().Set("Location", "/api/v1/broadcast-rules/"+strconv.FormatInt(created.ID, 10))
+	writeJSON(w, http.StatusCreated, toAPIBroadcastRule(*created))
+}
+
+func (s *Server) apiGetBroadcastRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	rule, err := s.broadcastRule(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up broadcast rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIBroadcastRule(*rule))
+}
+
+func (s *Server) apiUpdateBroadcastRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := decodeBroadcastRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = id
+	ctx := r.Context()
+	before := s.ruleSnapshot(r, id)
+	if err := s.store.UpdateBroadcastRule(ctx, rule); err != nil {
+		s.writeStoreError(w, "update broadcast rule", err)
+		return
+	}
+	if err := s.store.ReplaceBroadcastTargets(ctx, id, rule.Targets); err != nil {
+		s.writeStoreError(w, "replace broadcast targets", err)
+		return
+	}
+	updated, err := s.broadcastRule(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up broadcast rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "broadcast.update", strconv.FormatInt(id, 10), before, toAPIBroadcastRule(*updated))
+	writeJSON(w, http.StatusOK, toAPIBroadcastRule(*updated))
+}
+
+func (s *Server) apiDeleteBroadcastRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	before := s.ruleSnapshot(r, id)
+	if err := s.store.DeleteBroadcastRule(r.Context(), id); err != nil {
+		s.writeStoreError(w, "delete broadcast rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "broadcast.delete", strconv.FormatInt(id, 10), before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// broadcastRule finds one rule by ID. The store has no single-rule lookup, so
+// it scans the list.
+func (s *Server) broadcastRule(r *http.Request, id int64) (*userdb.BroadcastRule, error) {
+	rules, err := s.store.ListBroadcastRules(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i], nil
+		}
+	}
+	return nil, userdb.ErrBroadcastRuleNotFound
+}
+
+// decodeBroadcastRule reads a rule body. Targets are given as contact URIs in
+// priority order and are validated before anything is written, so a bad
+// target cannot leave a rule half-updated.
+func decodeBroadcastRule(w http.ResponseWriter, r *http.Request) (userdb.BroadcastRule, bool) {
+	var in apiBroadcastRule
+	if !decodeJSON(w, r, &in) {
+		return userdb.BroadcastRule{}, false
+	}
+	rule := userdb.BroadcastRule{
+		Address:     strings.TrimSpace(in.Address),
+		Description: strings.TrimSpace(in.Description),
+	}
+	if rule.Address == "" {
+		writeAPIError(w, http.StatusBadRequest, "address is required")
+		return userdb.BroadcastRule{}, false
+	}
+	for i, contact := range in.Targets {
+		contact = strings.TrimSpace(contact)
+		if contact == "" {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("target %d is empty", i+1))
+			return userdb.BroadcastRule{}, false
+		}
+		if _, err := userdb.ParseContactURI(contact); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("target %d: %v", i+1, err))
+			return userdb.BroadcastRule{}, false
+		}
+		rule.Targets = append(rule.Targets, userdb.BroadcastTarget{ContactURI: contact, Priority: i})
+	}
+	return rule, true
+}
+
+func (s *Server) apiListTrunkRoutes(w http.ResponseWriter, r *http.Request) {
+	routes, err := s.store.ListTrunkRoutes(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list trunk routes", err)
+		return
+	}
+	out := make([]apiTrunkRoute, len(routes))
+	for i, route := range routes {
+		out[i] = toAPITrunkRoute(route)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateTrunkRoute(w http.ResponseWriter, r *http.Request) {
+	route, ok := decodeTrunkRoute(w, r)
+	if !ok {
+		return
+	}
+	created, err := s.store.CreateTrunkRoute(r.Context(), route)
+	if err != nil {
+		s.writeStoreError(w, "create trunk route", err)
+		return
+	}
+	s.audit(r, apiActor(r), "trunk-route.create", strconv.FormatInt(created.ID, 10), nil, toAPITrunkRoute(*created))
+	w.Header().Set("Location", "/api/v1/trunk-routes/"+strconv.FormatInt(created.ID, 10))
+	writeJSON(w, http.StatusCreated, toAPITrunkRoute(*created))
+}
+
+func (s *Server) apiGetTrunkRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	route, err := s.trunkRoute(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up trunk route", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPITrunkRoute(*route))
+}
+
+func (s *Server) apiUpdateTrunkRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	route, ok := decodeTrunkRoute(w, r)
+	if !ok {
+		return
+	}
+	route.ID = id
+	before, err := s.trunkRoute(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up trunk route", err)
+		return
+	}
+	if err := s.store.UpdateTrunkRoute(r.Context(), route); err != nil {
+		s.writeStoreError(w, "update trunk route", err)
+		return
+	}
+	s.audit(r, apiActor(r), "trunk-route.update", strconv.FormatInt(id, 10), toAPITrunkRoute(*before), toAPITrunkRoute(route))
+	writeJSON(w, http.StatusOK, toAPITrunkRoute(route))
+}
+
+func (s *Server) apiDeleteTrunkRoute(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	before, err := s.trunkRoute(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up trunk route", err)
+		return
+	}
+	if err := s.store.DeleteTrunkRoute(r.Context(), id); err != nil {
+		s.writeStoreError(w, "delete trunk route", err)
+		return
+	}
+	s.audit(r, apiActor(r), "trunk-route.delete", strconv.FormatInt(id, 10), toAPITrunkRoute(*before), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trunkRoute finds one trunk route by ID by scanning the list, like
+// broadcastRule.
+func (s *Server) trunkRoute(r *http.Request, id int64) (*userdb.TrunkRoute, error) {
+	routes, err := s.store.ListTrunkRoutes(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		if routes[i].ID == id {
+			return &routes[i], nil
+		}
+	}
+	return nil, userdb.ErrTrunkRouteNotFound
+}
+
+// decodeTrunkRoute reads a trunk route body and validates it, so that a bad
+// prefix is answered with 400 rather than as a store failure.
+func decodeTrunkRoute(w http.ResponseWriter, r *http.Request) (userdb.TrunkRoute, bool) {
+	var in apiTrunkRoute
+	if !decodeJSON(w, r, &in) {
+		return userdb.TrunkRoute{}, false
+	}
+	route := userdb.TrunkRoute{
+		Prefix:      strings.TrimSpace(in.Prefix),
+		Trunk:       strings.TrimSpace(in.Trunk),
+		Strip:       in.Strip,
+		Prepend:     strings.TrimSpace(in.Prepend),
+		Description: strings.TrimSpace(in.Description),
+	}
+	if err := userdb.ValidateTrunkRoute(route); err != nil {
+		writeAPIError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "userdb: "))
+		return userdb.TrunkRoute{}, false
+	}
+	return route, true
+}
+
+func toAPIShortNumber(number userdb.ShortNumber) apiShortNumber {
+	return apiShortNumber{
+		ID:          number.ID,
+		Domain:      number.Domain,
+		Number:      number.Number,
+		Target:      number.Target,
+		Description: number.Description,
+	}
+}
+
+func (s *Server) apiListShortNumbers(w http.ResponseWriter, r *http.Request) {
+	numbers, err := s.store.ListShortNumbers(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list short numbers", err)
+		return
+	}
+	out := make([]apiShortNumber, len(numbers))
+	for i, number := range numbers {
+		out[i] = toAPIShortNumber(number)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateShortNumber(w http.ResponseWriter, r *http.Request) {
+	number, ok := decodeShortNumber(w, r)
+	if !ok {
+		return
+	}
+	created, err := s.store.CreateShortNumber(r.Context(), number)
+	if err != nil {
+		s.writeStoreError(w, "create short number", err)
+		return
+	}
+	s.audit(r, apiActor(r), "short-number.create", strconv.FormatInt(created.ID, 10), nil, toAPIShortNumber(*created))
+	w.Header().Set("Location", "/api/v1/short-numbers/"+strconv.FormatInt(created.ID, 10))
+	writeJSON(w, http.StatusCreated, toAPIShortNumber(*created))
+}
+
+func (s *Server) apiGetShortNumber(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	number, err := s.shortNumber(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up short number", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIShortNumber(*number))
+}
+
+func (s *Server) apiUpdateShortNumber(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	number, ok := decodeShortNumber(w, r)
+	if !ok {
+		return
+	}
+	number.ID = id
+	before, err := s.shortNumber(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up short number", err)
+		return
+	}
+	if err := s.store.UpdateShortNumber(r.Context(), number); err != nil {
+		s.writeStoreError(w, "update short number", err)
+		return
+	}
+	s.audit(r, apiActor(r), "short-number.update", strconv.FormatInt(id, 10), toAPIShortNumber(*before), toAPIShortNumber(number))
+	writeJSON(w, http.StatusOK, toAPIShortNumber(number))
+}
+
+func (s *Server) apiDeleteShortNumber(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	before, err := s.shortNumber(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up short number", err)
+		return
+	}
+	if err := s.store.DeleteShortNumber(r.Context(), id); err != nil {
+		s.writeStoreError(w, "delete short number", err)
+		return
+	}
+	s.audit(r, apiActor(r), "short-number.delete", strconv.FormatInt(id, 10), toAPIShortNumber(*before), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// shortNumber finds one short number by ID by scanning the list, like
+// trunkRoute.
+func (s *Server) shortNumber(r *http.Request, id int64) (*userdb.ShortNumber, error) {
+	numbers, err := s.store.ListShortNumbers(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	for i := range numbers {
+		if numbers[i].ID == id {
+			return &numbers[i], nil
+		}
+	}
+	return nil, userdb.ErrShortNumberNotFound
+}
+
+// decodeShortNumber reads a short number body and validates it, so that a
+// bad number or target is answered with 400 rather than as a store failure.
+func decodeShortNumber(w http.ResponseWriter, r *http.Request) (userdb.ShortNumber, bool) {
+	var in apiShortNumber
+	if !decodeJSON(w, r, &in) {
+		return userdb.ShortNumber{}, false
+	}
+	number := userdb.ShortNumber{
+		Domain:      strings.ToLower(strings.TrimSpace(in.Domain)),
+		Number:      strings.TrimSpace(in.Number),
+		Target:      strings.TrimSpace(in.Target),
+		Description: strings.TrimSpace(in.Description),
+	}
+	if err := userdb.ValidateShortNumber(number); err != nil {
+		writeAPIError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "userdb: "))
+		return userdb.ShortNumber{}, false
+	}
+	return number, true
+}
+
+func toAPICallerIDRule(rule userdb.CallerIDRule) apiCallerIDRule {
+	return apiCallerIDRule{
+		ID:                rule.ID,
+		Caller:            rule.Caller,
+		Trunk:             rule.Trunk,
+		DisplayName:       rule.DisplayName,
+		User:              rule.User,
+		Host:              rule.Host,
+		PreferredIdentity: rule.PreferredIdentity,
+		Description:       rule.Description,
+	}
+}
+
+func (s *Server) apiListCallerIDRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := s.store.ListCallerIDRules(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list caller-id rules", err)
+		return
+	}
+	out := make([]apiCallerIDRule, len(rules))
+	for i, rule := range rules {
+		out[i] = toAPICallerIDRule(rule)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateCallerIDRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeCallerIDRule(w, r)
+	if !ok {
+		return
+	}
+	created, err := s.store.CreateCallerIDRule(r.Context(), rule)
+	if err != nil {
+		s.writeStoreError(w, "create caller-id rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "caller-id-rule.create", strconv.FormatInt(created.ID, 10), nil, toAPICallerIDRule(*created))
+	w.Header().Set("Location", "/api/v1/caller-id-rules/"+strconv.FormatInt(created.ID, 10))
+	writeJSON(w, http.StatusCreated, toAPICallerIDRule(*created))
+}
+
+func (s *Server) apiGetCallerIDRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	rule, err := s.callerIDRule(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up caller-id rule", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPICallerIDRule(*rule))
+}
+
+func (s *Server) apiUpdateCallerIDRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	rule, ok := decodeCallerIDRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = id
+	before, err := s.callerIDRule(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up caller-id rule", err)
+		return
+	}
+	if err := s.store.UpdateCallerIDRule(r.Context(), rule); err != nil {
+		s.writeStoreError(w, "update caller-id rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "caller-id-rule.update", strconv.FormatInt(id, 10), toAPICallerIDRule(*before), toAPICallerIDRule(rule))
+	writeJSON(w, http.StatusOK, toAPICallerIDRule(rule))
+}
+
+func (s *Server) apiDeleteCallerIDRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := ruleID(w, r)
+	if !ok {
+		return
+	}
+	before, err := s.callerIDRule(r, id)
+	if err != nil {
+		s.writeStoreError(w, "look up caller-id rule", err)
+		return
+	}
+	if err := s.store.DeleteCallerIDRule(r.Context(), id); err != nil {
+		s.writeStoreError(w, "delete caller-id rule", err)
+		return
+	}
+	s.audit(r, apiActor(r), "caller-id-rule.delete", strconv.FormatInt(id, 10), toAPICallerIDRule(*before), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// callerIDRule finds one caller-ID rule by ID by scanning the list, like
+// trunkRoute.
+func (s *Server) callerIDRule(r *http.Request, id int64) (*userdb.CallerIDRule, error) {
+	rules, err := s.store.ListCallerIDRules(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i], nil
+		}
+	}
+	return nil, userdb.ErrCallerIDRuleNotFound
+}
+
+// decodeCallerIDRule reads a caller-ID rule body and validates it, so that a
+// bad caller or replacement is answered with 400 rather than as a store
+// failure.
+func decodeCallerIDRule(w http.ResponseWriter, r *http.Request) (userdb.CallerIDRule, bool) {
+	var in apiCallerIDRule
+	if !decodeJSON(w, r, &in) {
+		return userdb.CallerIDRule{}, false
+	}
+	rule := userdb.CallerIDRule{
+		Caller:            strings.ToLower(strings.TrimSpace(in.Caller)),
+		Trunk:             strings.TrimSpace(in.Trunk),
+		DisplayName:       strings.TrimSpace(in.DisplayName),
+		User:              strings.TrimSpace(in.User),
+		Host:              strings.TrimSpace(in.Host),
+		PreferredIdentity: in.PreferredIdentity,
+		Description:       strings.TrimSpace(in.Description),
+	}
+	if err := userdb.ValidateCallerIDRule(rule); err != nil {
+		writeAPIError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "userdb: "))
+		return userdb.CallerIDRule{}, false
+	}
+	return rule, true
+}
+
+func toAPIDomain(domain userdb.Domain) apiDomain {
+	return apiDomain{
+		Name:               domain.Name,
+		Aliases:            domain.Aliases,
+		DefaultExpires:     domain.DefaultExpires,
+		AuthPolicy:         string(domain.AuthPolicy),
+		Trunk:              domain.Trunk,
+		BroadcastNamespace: domain.BroadcastNamespace,
+		Description:        domain.Description,
+	}
+}
+
+func (s *Server) apiListDomains(w http.ResponseWriter, r *http.Request) {
+	domains, err := s.store.ListDomains(r.Context())
+	if err != nil {
+		s.writeStoreError(w, "list domains", err)
+		return
+	}
+	out := make([]apiDomain, len(domains))
+	for i, domain := range domains {
+		out[i] = toAPIDomain(domain)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) apiCreateDomain(w http.ResponseWriter, r *http.Request) {
+	domain, ok := decodeDomain(w, r, "")
+	if !ok {
+		return
+	}
+	if err := s.store.CreateDomain(r.Context(), domain); err != nil {
+		s.writeStoreError(w, "create domain", err)
+		return
+	}
+	s.audit(r, apiActor(r), "domain.create", domain.Name, nil, toAPIDomain(domain))
+	w.Header().Set("Location", "/api/v1/domains/"+domain.Name)
+	writeJSON(w, http.StatusCreated, toAPIDomain(domain))
+}
+
+func (s *Server) apiGetDomain(w http.ResponseWriter, r *http.Request) {
+	domain, err := s.domain(r, r.PathValue("name"))
+	if err != nil {
+		s.writeStoreError(w, "look up domain", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAPIDomain(*domain))
+}
+
+func (s *Server) apiUpdateDomain(w http.ResponseWriter, r *http.Request) {
+	domain, ok := decodeDomain(w, r, r.PathValue("name"))
+	if !ok {
+		return
+	}
+	before, err := s.domain(r, domain.Name)
+	if err != nil {
+		s.writeStoreError(w, "look up domain", err)
+		return
+	}
+	if err := s.store.UpdateDomain(r.Context(), domain); err != nil {
+		s.writeStoreError(w, "update domain", err)
+		return
+	}
+	s.audit(r, apiActor(r), "domain.update", domain.Name, toAPIDomain(*before), toAPIDomain(domain))
+	writeJSON(w, http.StatusOK, toAPIDomain(domain))
+}
+
+func (s *Server) apiDeleteDomain(w http.ResponseWriter, r *http.Request) {
+	before, err := s.domain(r, r.PathValue("name"))
+	if err != nil {
+		s.writeStoreError(w, "look up domain", err)
+		return
+	}
+	if err := s.store.DeleteDomain(r.Context(), before.Name); err != nil {
+		s.writeStoreError(w, "delete domain", err)
+		return
+	}
+	s.audit(r, apiActor(r), "domain.delete", before.Name, toAPIDomain(*before), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// domain finds one domain's settings by name by scanning the list, like
+// trunkRoute.
+func (s *Server) domain(r *http.Request, name string) (*userdb.Domain, error) {
+	domains, err := s.store.ListDomains(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i := range domains {
+		if domains[i].Name == name {
+			return &domains[i], nil
+		}
+	}
+	return nil, userdb.ErrDomainNotFound
+}
+
+// decodeDomain reads a domain body and validates it. name, from the path,
+// takes the place of the body's name when set; the body may then leave it
+// out but not contradict it.
+func decodeDomain(w http.ResponseWriter, r *http.Request, name string) (userdb.Domain, bool) {
+	var in apiDomain
+	if !decodeJSON(w, r, &in) {
+		return userdb.Domain{}, false
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	bodyName := strings.ToLower(strings.TrimSpace(in.Name))
+	if name != "" && bodyName != "" && bodyName != name {
+		writeAPIError(w, http.StatusBadRequest, "name does not match the path")
+		return userdb.Domain{}, false
+	}
+	if name == "" {
+		name = bodyName
+	}
+	policy, err := userdb.ParseAuthPolicy(in.AuthPolicy)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "userdb: "))
+		return userdb.Domain{}, false
+	}
+	var aliases []string
+	for _, alias := range in.Aliases {
+		if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	domain := userdb.Domain{
+		Name:               name,
+		Aliases:            aliases,
+		DefaultExpires:     in.DefaultExpires,
+		AuthPolicy:         policy,
+		Trunk:              strings.TrimSpace(in.Trunk),
+		BroadcastNamespace: strings.ToLower(strings.TrimSpace(in.BroadcastNamespace)),
+		Description:        strings.TrimSpace(in.Description),
+	}
+	if err := userdb.ValidateDomain(domain); err != nil {
+		writeAPIError(w, http.StatusBadRequest, strings.TrimPrefix(err.Error(), "userdb: "))
+		return userdb.Domain{}, false
+	}
+	return domain, true
+}
+
+// userAddress splits the {address} path segment, "username@domain", at its
+// last "@".
+func userAddress(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	address := r.PathValue("address")
+	idx := strings.LastIndex(address, "@")
+	if idx <= 0 || idx == len(address)-1 {
+		writeAPIError(w, http.StatusBadRequest, "user address must be username@domain")
+		return "", "", false
+	}
+	return address[:idx], address[idx+1:], true
+}
+
+func ruleID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "rule id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeJSON reads a single JSON object from the body, rejecting unknown
+// fields so that typos are reported instead of ignored.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %v", err))
+		return false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON body: trailing data")
+		return false
+	}
+	return true
+}
+
+// writeStoreError maps store errors onto status codes and logs the ones that
+// indicate a server-side failure.
+func (s *Server) writeStoreError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, userdb.ErrUserNotFound):
+		writeAPIError(w, http.StatusNotFound, "user not found")
+	case errors.Is(err, userdb.ErrBroadcastRuleNotFound):
+		writeAPIError(w, http.StatusNotFound, "broadcast rule not found")
+	case errors.Is(err, userdb.ErrTrunkRouteNotFound):
+		writeAPIError(w, http.StatusNotFound, "trunk route not found")
+	case errors.Is(err, userdb.ErrTrunkRouteExists):
+		writeAPIError(w, http.StatusConflict, "a trunk route for the prefix already exists")
+	case errors.Is(err, userdb.ErrShortNumberNotFound):
+		writeAPIError(w, http.StatusNotFound, "short number not found")
+	case errors.Is(err, userdb.ErrShortNumberExists):
+		writeAPIError(w, http.StatusConflict, "short number already exists in domain")
+	case errors.Is(err, userdb.ErrCallerIDRuleNotFound):
+		writeAPIError(w, http.StatusNotFound, "caller-id rule not found")
+	case errors.Is(err, userdb.ErrDomainNotFound):
+		writeAPIError(w, http.StatusNotFound, "domain not found")
+	case errors.Is(err, userdb.ErrDomainExists):
+		writeAPIError(w, http.StatusConflict, "domain already exists")
+	case errors.Is(err, userdb.ErrUserExists):
+		writeAPIError(w, http.StatusConflict, "user already exists")
+	case errors.Is(err, userdb.ErrReadOnly):
+		writeAPIError(w, http.StatusForbidden, "the user directory is read-only")
+	case errors.Is(err, userdb.ErrInvalidContactURI):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+	default:
+		s.logger.Error("api request failed", "action", action, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to %s", action))
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,253 @@
+package userweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"xylitol4/sip/userdb"
+)
+
+// staticToken is the command-line bearer token of the API test servers.
+const staticToken = "static-secret"
+
+// newAPITestServer returns a test server that accepts staticToken.
+func newAPITestServer(t *testing.T) (*Server, *userdb.SQLStore) {
+	t.Helper()
+	s, store := newTestServer(t)
+	s.apiToken = staticToken
+	return s, store
+}
+
+// createToken stores an API token with scopes and returns its secret.
+func createToken(t *testing.T, store *userdb.SQLStore, scopes ...userdb.APIScope) (string, int64) {
+	t.Helper()
+	secret, hash, err := userdb.GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.CreateAPIToken(context.Background(), userdb.APIToken{Name: "provisioning", TokenHash: hash, Scopes: scopes, CreatedBy: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, token.ID
+}
+
+// apiRequest sends method path with body, if any, authorised by token, if
+// any, and returns the response.
+func apiRequest(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTokenAuthChecksTheBearerTokenAndItsScopes(t *testing.T) {
+	s, store := newAPITestServer(t)
+	handler := s.Handler()
+	reader, _ := createToken(t, store, userdb.ScopeUsersRead)
+	rulesWriter, _ := createToken(t, store, userdb.ScopeRulesWrite)
+	revoked, revokedID := createToken(t, store, userdb.ScopeUsersRead, userdb.ScopeUsersWrite)
+	if err := store.DeleteAPIToken(context.Background(), revokedID); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := s.sessions.create(session{user: "admin", builtin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		method  string
+		path    string
+		header  string
+		session *session
+		want    int
+	}{
+		{"no token", http.MethodGet, "/api/v1/users", "", nil, http.StatusUnauthorized},
+		{"basic credentials", http.MethodGet, "/api/v1/users", "Basic YWRtaW46c2VjcmV0", nil, http.StatusUnauthorized},
+		{"empty bearer", http.MethodGet, "/api/v1/users", "Bearer  ", nil, http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "/api/v1/users", "Bearer xyl_unknown", nil, http.StatusUnauthorized},
+		{"revoked token", http.MethodGet, "/api/v1/users", "Bearer " + revoked, nil, http.StatusUnauthorized},
+		{"admin session instead of a token", http.MethodGet, "/api/v1/users", "", admin, http.StatusUnauthorized},
+		{"read scope reading", http.MethodGet, "/api/v1/users", "Bearer " + reader, nil, http.StatusOK},
+		{"read scope writing", http.MethodDelete, "/api/v1/users/alice@example.com", "Bearer " + reader, nil, http.StatusForbidden},
+		{"read scope on other endpoints", http.MethodGet, "/api/v1/broadcast-rules", "Bearer " + reader, nil, http.StatusForbidden},
+		{"write scope implies read", http.MethodGet, "/api/v1/broadcast-rules", "Bearer " + rulesWriter, nil, http.StatusOK},
+		{"write scope of other endpoints", http.MethodGet, "/api/v1/users", "Bearer " + rulesWriter, nil, http.StatusForbidden},
+		{"static token", http.MethodGet, "/api/v1/broadcast-rules", "Bearer " + staticToken, nil, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.session != nil {
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.session.id})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != `Bearer realm="api"` {
+				t.Fatalf("expected a bearer challenge, got %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Without a command-line token the old one is just an unknown token.
+	s.apiToken = ""
+	if rec := apiRequest(handler, http.MethodGet, "/api/v1/users", staticToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the static token to stop working once unset, got %d", rec.Code)
+	}
+}
+
+func TestAPIUserLifecycle(t *testing.T) {
+	s, store := newAPITestServer(t)
+	handler := s.Handler()
+	writer, _ := createToken(t, store, userdb.ScopeUsersWrite)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"create", http.MethodPost, "/api/v1/users", `{"username":"alice","domain":"example.com","password":"pw"}`, http.StatusCreated},
+		{"create again", http.MethodPost, "/api/v1/users", `{"username":"alice","domain":"example.com"}`, http.StatusConflict},
+		{"create without a domain", http.MethodPost, "/api/v1/users", `{"username":"bob"}`, http.StatusBadRequest},
+		{"create with an unknown field", http.MethodPost, "/api/v1/users", `{"username":"bob","domain":"example.com","admin":true}`, http.StatusBadRequest},
+		{"create with trailing data", http.MethodPost, "/api/v1/users", `{"username":"bob","domain":"example.com"} {}`, http.StatusBadRequest},
+		{"read", http.MethodGet, "/api/v1/users/alice@example.com", "", http.StatusOK},
+		{"read a malformed address", http.MethodGet, "/api/v1/users/alice", "", http.StatusBadRequest},
+		{"disable", http.MethodPatch, "/api/v1/users/alice@example.com", `{"enabled":false}`, http.StatusOK},
+		{"set the password", http.MethodPut, "/api/v1/users/alice@example.com/password", `{"password":"new"}`, http.StatusNoContent},
+		{"set both password forms", http.MethodPut, "/api/v1/users/alice@example.com/password", `{"password":"new","password_hash":"abc"}`, http.StatusBadRequest},
+		{"list registrations", http.MethodGet, "/api/v1/users/alice@example.com/registrations", "", http.StatusOK},
+		{"delete", http.MethodDelete, "/api/v1/users/alice@example.com", "", http.StatusNoContent},
+		{"read after delete", http.MethodGet, "/api/v1/users/alice@example.com", "", http.StatusNotFound},
+		{"update after delete", http.MethodPatch, "/api/v1/users/alice@example.com", `{"enabled":true}`, http.StatusNotFound},
+		{"set the password after delete", http.MethodPut, "/api/v1/users/alice@example.com/password", `{"password":"new"}`, http.StatusNotFound},
+		{"delete again", http.MethodDelete, "/api/v1/users/alice@example.com", "", http.StatusNotFound},
+	} {
+		rec := apiRequest(handler, tt.method, tt.path, writer, tt.body)
+		if rec.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); tt.want != http.StatusNoContent && got != "application/json; charset=utf-8" {
+			t.Fatalf("%s: expected a JSON body, got %q", tt.name, got)
+		}
+		switch tt.name {
+		case "create":
+			var user apiUser
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil || !user.Enabled || !user.HasPassword || user.PasswordHash != "" {
+				t.Fatalf("expected an enabled user without its hash, got %s", rec.Body)
+			}
+			if rec.Header().Get("Location") != "/api/v1/users/alice@example.com" {
+				t.Fatalf("expected the new user's location, got %q", rec.Header().Get("Location"))
+			}
+		case "disable":
+			var user apiUser
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil || user.Enabled {
+				t.Fatalf("expected the disabled user, got %s", rec.Body)
+			}
+		case "set the password":
+			user, err := store.Lookup(context.Background(), "alice", "example.com")
+			if err != nil || user.PasswordHash != userdb.HashPassword("alice", "example.com", "new") {
+				t.Fatalf("expected the new password to be stored, got %v", err)
+			}
+		case "read after delete":
+			var body apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error != "user not found" {
+				t.Fatalf("expected a JSON error, got %s", rec.Body)
+			}
+		}
+	}
+}
+
+func TestAPIBroadcastRuleLifecycle(t *testing.T) {
+	s, store := newAPITestServer(t)
+	handler := s.Handler()
+	writer, _ := createToken(t, store, userdb.ScopeRulesWrite)
+
+	rec := apiRequest(handler, http.MethodPost, "/api/v1/broadcast-rules", writer, `{"address":"sales@example.com","targets":["sip:alice@192.0.2.10","sip:bob@192.0.2.11"]}`)
+	var rule apiBroadcastRule
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &rule) != nil || len(rule.Targets) != 2 {
+		t.Fatalf("expected the rule to be created, got %d: %s", rec.Code, rec.Body)
+	}
+	path := fmt.Sprintf("/api/v1/broadcast-rules/%d", rule.ID)
+	if rec.Header().Get("Location") != path {
+		t.Fatalf("expected the new rule's location, got %q", rec.Header().Get("Location"))
+	}
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"read", http.MethodGet, path, "", http.StatusOK},
+		{"read a malformed id", http.MethodGet, "/api/v1/broadcast-rules/first", "", http.StatusBadRequest},
+		{"update", http.MethodPut, path, `{"address":"sales@example.com","targets":["sip:carol@192.0.2.12"]}`, http.StatusOK},
+		{"update with a bad target", http.MethodPut, path, `{"address":"sales@example.com","targets":["mailto:carol"]}`, http.StatusBadRequest},
+		{"update without an address", http.MethodPut, path, `{"targets":[]}`, http.StatusBadRequest},
+		{"delete", http.MethodDelete, path, "", http.StatusNoContent},
+		{"read after delete", http.MethodGet, path, "", http.StatusNotFound},
+		{"update after delete", http.MethodPut, path, `{"address":"sales@example.com","targets":[]}`, http.StatusNotFound},
+		{"delete again", http.MethodDelete, path, "", http.StatusNotFound},
+	} {
+		if rec := apiRequest(handler, tt.method, tt.path, writer, tt.body); rec.Code != tt.want {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body)
+		}
+	}
+	if _, err := store.LookupBroadcastTargets(context.Background(), "sales@example.com"); !errors.Is(err, userdb.ErrBroadcastRuleNotFound) {
+		t.Fatalf("expected the rule to be gone from the store, got %v", err)
+	}
+}
+
+func TestWriteStoreErrorMapsStoreErrorsToStatusCodes(t *testing.T) {
+	s, _ := newAPITestServer(t)
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{userdb.ErrUserNotFound, http.StatusNotFound},
+		{userdb.ErrBroadcastRuleNotFound, http.StatusNotFound},
+		{userdb.ErrTrunkRouteNotFound, http.StatusNotFound},
+		{userdb.ErrShortNumberNotFound, http.StatusNotFound},
+		{userdb.ErrCallerIDRuleNotFound, http.StatusNotFound},
+		{userdb.ErrDomainNotFound, http.StatusNotFound},
+		{userdb.ErrUserExists, http.StatusConflict},
+		{userdb.ErrTrunkRouteExists, http.StatusConflict},
+		{userdb.ErrShortNumberExists, http.StatusConflict},
+		{userdb.ErrDomainExists, http.StatusConflict},
+		{userdb.ErrReadOnly, http.StatusForbidden},
+		{userdb.ErrInvalidContactURI, http.StatusBadRequest},
+		{errors.New("disk I/O error"), http.StatusInternalServerError},
+	} {
+		for _, err := range []error{tt.err, fmt.Errorf("userdb: wrapped: %w", tt.err)} {
+			rec := httptest.NewRecorder()
+			s.writeStoreError(rec, "do something", err)
+			var body apiError
+			if rec.Code != tt.want || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body.Error == "" {
+				t.Fatalf("%v: expected %d with a JSON error, got %d: %s", err, tt.want, rec.Code, rec.Body)
+			}
+			if tt.want == http.StatusInternalServerError && body.Error != "failed to do something" {
+				t.Fatalf("expected the internal error to stay in the log, got %q", body.Error)
+			}
+		}
+	}
+}
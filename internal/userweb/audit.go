@@ -0,0 +1,200 @@
+package userweb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+// staticTokenActor is the audit log actor for changes made through the JSON
+// API with the --api-token bearer token.
+const staticTokenActor = "api-token"
+
+// apiTokenActor is the audit log actor for changes made with a stored token.
+func apiTokenActor(token userdb.APIToken) string {
+	return "api-token:" + token.Name
+}
+
+// auditPageSize is how many entries the audit page shows at a time.
+const auditPageSize = 50
+
+// auditAdmin is the audit snapshot of an admin account. Password hashes and
+// TOTP secrets are deliberately left out.
+type auditAdmin struct {
+	Username string           `json:"username"`
+	Role     userdb.AdminRole `json:"role"`
+	TOTP     bool             `json:"totp"`
+}
+
+func toAuditAdmin(account userdb.AdminAccount) auditAdmin {
+	return auditAdmin{Username: account.Username, Role: account.Role, TOTP: account.TOTPSecret != ""}
+}
+
+// audit records a successful admin change. before and after are snapshots
+// of the affected object, nil where it did not exist. A failure to record is
+// logged but does not undo the change, which has already happened.
+func (s *Server) audit(r *http.Request, actor, action, target string, before, after any) {
+	entry := userdb.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Before: auditJSON(before),
+		After:  auditJSON(after),
+	}
+	if err := s.store.RecordAudit(r.Context(), entry); err != nil {
+		s.logger.Error("record audit entry", "action", action, "target", target, "actor", actor, "error", err)
+	}
+}
+
+func auditJSON(v any) string {
+	if v == nil {
+		return ""
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return string(raw)
+}
+
+// userSnapshot returns the audit snapshot of a user before a change, or nil
+// when the user cannot be read.
+func (s *Server) userSnapshot(r *http.Request, username, domain string) any {
+	user, err := s.store.Lookup(r.Context(), username, domain)
+	if err != nil {
+		return nil
+	}
+	return toAPIUser(*user)
+}
+
+// ruleSnapshot returns the audit snapshot of a broadcast rule before a
+// change, or nil when it cannot be read.
+func (s *Server) ruleSnapshot(r *http.Request, id int64) any {
+	rule, err := s.broadcastRule(r, id)
+	if err != nil {
+		return nil
+	}
+	return toAPIBroadcastRule(*rule)
+}
+
+// adminSnapshot returns the audit snapshot of an admin account before a
+// change, or nil when it cannot be read.
+func (s *Server) adminSnapshot(r *http.Request, username string) any {
+	account, err := s.store.AdminAccount(r.Context(), username)
+	if err != nil {
+		return nil
+	}
+	return toAuditAdmin(*account)
+}
+
+type auditTemplateData struct {
+	Entries  []userdb.AuditEntry
+	Filter   userdb.AuditFilter
+	Page     int
+	PrevLink string
+	NextLink string
+	Error    string
+}
+
+// handleAudit browses the audit log newest first, optionally filtered by
+// actor, action, or target.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	filter := userdb.AuditFilter{
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Action: strings.TrimSpace(query.Get("action")),
+		Target: strings.TrimSpace(query.Get("target")),
+		// One extra entry tells whether there is a next page.
+		Limit:  auditPageSize + 1,
+		Offset: (page - 1) * auditPageSize,
+	}
+	data := auditTemplateData{Filter: filter, Page: page}
+	entries, err := s.store.ListAuditEntries(r.Context(), filter)
+	if err != nil {
+		data.Error = s.tr(r, "監査ログの取得に失敗しました: %v", err)
+	}
+	if len(entries) > auditPageSize {
+		entries = entries[:auditPageSize]
+		data.NextLink = auditPageLink(filter, page+1)
+	}
+	if page > 1 {
+		data.PrevLink = auditPageLink(filter, page-1)
+	}
+	data.Entries = entries
+	s.render(w, r, s.auditTmpl, data)
+}
+
+func auditPageLink(filter userdb.AuditFilter, page int) string {
+	query := url.Values{}
+	for key, value := range map[string]string{"actor": filter.Actor, "action": filter.Action, "target": filter.Target} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("page", strconv.Itoa(page))
+	return "/admin/audit?" + query.Encode()
+}
+
+const auditTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "監査ログ"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; vertical-align: top; }
+                td.json { font-family: monospace; font-size: 0.85rem; word-break: break-all; max-width: 24rem; }
+                .error { color: red; }
+                nav a { margin-right: 1rem; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "監査ログ"}}</h1>
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="get" action="/admin/audit">
+                <label>{{t "実行者:"}} <input type="text" name="actor" value="{{.Filter.Actor}}"></label>
+                <label>{{t "操作:"}} <input type="text" name="action" value="{{.Filter.Action}}"></label>
+                <label>{{t "対象:"}} <input type="text" name="target" value="{{.Filter.Target}}"></label>
+                <button type="submit">{{t "絞り込み"}}</button>
+        </form>
+        <table>
+                <thead>
+                        <tr><th>{{t "日時 (UTC)"}}</th><th>{{t "実行者"}}</th><th>{{t "操作"}}</th><th>{{t "対象"}}</th><th>{{t "変更前"}}</th><th>{{t "変更後"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .Entries}}
+                        <tr>
+                                <td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td>
+                                <td>{{.Actor}}</td>
+                                <td>{{.Action}}</td>
+                                <td>{{.Target}}</td>
+                                <td class="json">{{.Before}}</td>
+                                <td class="json">{{.After}}</td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="6">{{t "記録はありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        <nav>
+                {{if .PrevLink}}<a href="{{.PrevLink}}">{{t "前のページ"}}</a>{{end}}
+                {{if .NextLink}}<a href="{{.NextLink}}">{{t "次のページ"}}</a>{{end}}
+        </nav>
+</body>
+</html>`
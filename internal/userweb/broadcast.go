@@ -0,0 +1,440 @@
+package userweb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+// broadcastPreview describes where one target of a rule would ring: a user in
+// the directory and their current bindings, or an outside URI that the proxy
+// forwards as is.
+type broadcastPreview struct {
+	Index     int
+	Position  int
+	Last      bool
+	URI       string
+	Invalid   string
+	User      string
+	Disabled  bool
+	Bindings  []apiRegistration
+	Registrar bool
+}
+
+type broadcastTemplateData struct {
+	CSRFToken string
+	Rule      *userdb.BroadcastRule
+	Address   string
+	Desc      string
+	Targets   string
+	Preview   []broadcastPreview
+	Message   string
+	Error     string
+}
+
+// handleBroadcastEditor creates a broadcast rule when no id is given, and
+// otherwise edits one rule: its address and description, and each target,
+// which can be changed, moved up or down in priority, or removed. Every
+// target is validated as a SIP URI before it is stored, and the page previews
+// which users and bindings the rule currently reaches.
+func (s *Server) handleBroadcastEditor(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	data := broadcastTemplateData{CSRFToken: sess.csrfToken}
+	var id int64
+	if raw := r.URL.Query().Get("id"); raw != "" {
+		var err error
+		if id, err = strconv.ParseInt(raw, 10, 64); err != nil || id <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+		rule, err := s.broadcastRule(r, id)
+		if errors.Is(err, userdb.ErrBroadcastRuleNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load broadcast rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		data.Rule = rule
+		if r.URL.Query().Get("created") != "" {
+			data.Message = s.tr(r, "%s のブロードキャストルールを作成しました", rule.Address)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		if data.Rule == nil {
+			s.createBroadcastRule(w, r, sess, &data)
+			if data.Error == "" {
+				return
+			}
+			break
+		}
+		if r.FormValue("action") == "rule-delete" {
+			before := toAPIBroadcastRule(*data.Rule)
+			if err := s.store.DeleteBroadcastRule(r.Context(), id); err != nil {
+				data.Error = s.tr(r, "ブロードキャストルールの削除に失敗しました: %v", err)
+				break
+			}
+			s.audit(r, sess.user, "broadcast.delete", strconv.FormatInt(id, 10), before, nil)
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return
+		}
+		s.editBroadcastRule(r, sess, &data)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if data.Rule != nil {
+		data.Preview = s.previewBroadcast(r, data.Rule.Targets)
+	}
+	s.render(w, r, s.broadcastTmpl, data)
+}
+
+// createBroadcastRule handles the creation form and, on success, sends the
+// browser to the new rule's editor.
+func (s *Server) createBroadcastRule(w http.ResponseWriter, r *http.Request, sess *session, data *broadcastTemplateData) {
+	data.Address = strings.TrimSpace(r.FormValue("broadcast_address"))
+	data.Desc = strings.TrimSpace(r.FormValue("broadcast_description"))
+	data.Targets = r.FormValue("broadcast_targets")
+	if data.Address == "" {
+		data.Error = s.tr(r, "ブロードキャスト対象アドレスを入力してください")
+		return
+	}
+	targets := parseBroadcastTargets(data.Targets)
+	if msg := s.validateBroadcastTargets(r, targets); msg != "" {
+		data.Error = msg
+		return
+	}
+	created, err := s.store.CreateBroadcastRule(r.Context(), userdb.BroadcastRule{
+		Address:     data.Address,
+		Description: data.Desc,
+		Targets:     targets,
+	})
+	if err != nil {
+		data.Error = s.tr(r, "ブロードキャストルールの作成に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "broadcast.create", strconv.FormatInt(created.ID, 10), nil, toAPIBroadcastRule(*created))
+	http.Redirect(w, r, fmt.Sprintf("/admin/broadcast?id=%d&created=1", created.ID), http.StatusSeeOther)
+}
+
+// editBroadcastRule applies one edit to an existing rule and reloads it.
+// Target edits name the target by position and by its current URI, so that a
+// form rendered before someone else's change cannot hit the wrong target.
+func (s *Server) editBroadcastRule(r *http.Request, sess *session, data *broadcastTemplateData) {
+	ctx := r.Context()
+	rule := data.Rule
+	before := toAPIBroadcastRule(*rule)
+	action := r.FormValue("action")
+
+	if action == "rule-update" {
+		address := strings.TrimSpace(r.FormValue("broadcast_address"))
+		if address == "" {
+			data.Error = s.tr(r, "ブロードキャスト対象アドレスを入力してください")
+			return
+		}
+		update := userdb.BroadcastRule{ID: rule.ID, Address: address, Description: strings.TrimSpace(r.FormValue("broadcast_description"))}
+		if err := s.store.UpdateBroadcastRule(ctx, update); err != nil {
+			data.Error = s.tr(r, "ブロードキャストルールの更新に失敗しました: %v", err)
+			return
+		}
+		s.finishBroadcastEdit(r, sess, data, before, s.tr(r, "ルールを更新しました"))
+		return
+	}
+
+	targets := append([]userdb.BroadcastTarget(nil), rule.Targets...)
+	var index int
+	if action != "target-add" {
+		var err error
+		index, err = strconv.Atoi(r.FormValue("index"))
+		if err != nil || index < 0 || index >= len(targets) || targets[index].ContactURI != r.FormValue("current") {
+			data.Error = s.tr(r, "宛先が他の操作で変更されています。画面を更新してもう一度操作してください")
+			return
+		}
+	}
+	var message string
+	switch action {
+	case "target-add":
+		uri := strings.TrimSpace(r.FormValue("uri"))
+		targets = append(targets, userdb.BroadcastTarget{ContactURI: uri})
+		message = s.tr(r, "宛先 %s を追加しました", uri)
+	case "target-update":
+		uri := strings.TrimSpace(r.FormValue("uri"))
+		targets[index].ContactURI = uri
+		message = s.tr(r, "宛先 %d を %s に変更しました", index+1, uri)
+	case "target-up", "target-down":
+		other := index - 1
+		if action == "target-down" {
+			other = index + 1
+		}
+		if other < 0 || other >= len(targets) {
+			data.Error = s.tr(r, "これ以上移動できません")
+			return
+		}
+		targets[index], targets[other] = targets[other], targets[index]
+		message = s.tr(r, "宛先の優先順位を変更しました")
+	case "target-delete":
+		message = s.tr(r, "宛先 %s を削除しました", targets[index].ContactURI)
+		targets = append(targets[:index], targets[index+1:]...)
+	default:
+		data.Error = s.tr(r, "不明な操作です")
+		return
+	}
+	if msg := s.validateBroadcastTargets(r, targets); msg != "" {
+		data.Error = msg
+		return
+	}
+	for i := range targets {
+		targets[i].Priority = i
+	}
+	if err := s.store.ReplaceBroadcastTargets(ctx, rule.ID, targets); err != nil {
+		data.Error = s.tr(r, "宛先URIの更新に失敗しました: %v", err)
+		return
+	}
+	s.finishBroadcastEdit(r, sess, data, before, message)
+}
+
+// finishBroadcastEdit reloads the edited rule and records the change.
+func (s *Server) finishBroadcastEdit(r *http.Request, sess *session, data *broadcastTemplateData, before apiBroadcastRule, message string) {
+	updated, err := s.broadcastRule(r, data.Rule.ID)
+	if err != nil {
+		data.Error = s.tr(r, "更新後のルールの取得に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "broadcast.update", strconv.FormatInt(updated.ID, 10), before, toAPIBroadcastRule(*updated))
+	data.Rule = updated
+	data.Message = message
+}
+
+// validateBroadcastTargets returns a message describing the first invalid or
+// repeated target, or "" when all are usable.
+func (s *Server) validateBroadcastTargets(r *http.Request, targets []userdb.BroadcastTarget) string {
+	seen := make(map[string]int, len(targets))
+	for i, target := range targets {
+		if target.ContactURI == "" {
+			return s.tr(r, "宛先 %d が空です", i+1)
+		}
+		if _, err := userdb.ParseContactURI(target.ContactURI); err != nil {
+			return s.tr(r, "宛先 %d (%s) は SIP URI として正しくありません。sip:user@host の形式で入力してください", i+1, target.ContactURI)
+		}
+		key := strings.ToLower(target.ContactURI)
+		if first, ok := seen[key]; ok {
+			return s.tr(r, "宛先 %d (%s) は宛先 %d と重複しています", i+1, target.ContactURI, first+1)
+		}
+		seen[key] = i
+	}
+	return ""
+}
+
+// previewBroadcast resolves each target the way the proxy routes it: a URI
+// naming a user in the directory rings that user's registered bindings, and
+// anything else is sent to the URI's host.
+func (s *Server) previewBroadcast(r *http.Request, targets []userdb.BroadcastTarget) []broadcastPreview {
+	preview := make([]broadcastPreview, 0, len(targets))
+	for i, target := range targets {
+		row := broadcastPreview{Index: i, Position: i + 1, Last: i == len(targets)-1, URI: target.ContactURI}
+		uri, err := userdb.ParseContactURI(target.ContactURI)
+		if err != nil {
+			row.Invalid = err.Error()
+			preview = append(preview, row)
+			continue
+		}
+		if uri.User != "" {
+			user, err := s.store.Lookup(r.Context(), uri.User, uri.Host)
+			if err == nil {
+				row.User = user.Username + "@" + user.Domain
+				row.Disabled = user.Disabled
+				if s.registrations != nil {
+					row.Registrar = true
+					for _, binding := range s.registrations.BindingsFor(user.Username, user.Domain) {
+						row.Bindings = append(row.Bindings, toAPIRegistration(binding))
+					}
+				}
+			} else if !errors.Is(err, userdb.ErrUserNotFound) {
+				row.Invalid = s.tr(r, "ユーザ情報の取得に失敗しました: %v", err)
+			}
+		}
+		preview = append(preview, row)
+	}
+	return preview
+}
+
+func parseBroadcastTargets(raw string) []userdb.BroadcastTarget {
+	var targets []userdb.BroadcastTarget
+	if strings.TrimSpace(raw) == "" {
+		return targets
+	}
+	parts := strings.FieldsFunc(raw, func(r rune) bool {
+		switch r {
+		case '\n', '\r', ',':
+			return true
+		default:
+			return false
+		}
+	})
+	order := 0
+	for _, part := range parts {
+		contact := strings.TrimSpace(part)
+		if contact == "" {
+			continue
+		}
+		targets = append(targets, userdb.BroadcastTarget{ContactURI: contact, Priority: order})
+		order++
+	}
+	return targets
+}
+
+const broadcastTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "ブロードキャストルール"}}</title>
+        <script src="/static/confirm.js" defer></script>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; vertical-align: top; }
+                td form { display: inline; margin: 0; }
+                form { margin-top: 1rem; }
+                .message { color: green; }
+                .error { color: red; }
+                .muted { color: #999; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        {{if .Rule}}
+        <h1>{{t "ブロードキャストルール:"}} {{.Rule.Address}}</h1>
+        {{else}}
+        <h1>{{t "ブロードキャストルール作成"}}</h1>
+        {{end}}
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+
+        {{with .Rule}}
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="action" value="rule-update">
+                <label>Address: <input type="text" name="broadcast_address" value="{{.Address}}" required></label><br>
+                <label>Description: <input type="text" name="broadcast_description" value="{{.Description}}"></label><br>
+                <button type="submit">{{t "保存"}}</button>
+        </form>
+
+        <h2>{{t "宛先 (上から優先順)"}}</h2>
+        <table>
+                <thead>
+                        <tr><th>{{t "順位"}}</th><th>URI</th><th>{{t "並べ替え"}}</th><th>{{t "削除"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range $.Preview}}
+                        <tr>
+                                <td>{{.Position}}</td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="target-update">
+                                                <input type="hidden" name="index" value="{{.Index}}">
+                                                <input type="hidden" name="current" value="{{.URI}}">
+                                                <input type="text" name="uri" value="{{.URI}}" size="40" required>
+                                                <button type="submit">{{t "変更"}}</button>
+                                        </form>
+                                </td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="target-up">
+                                                <input type="hidden" name="index" value="{{.Index}}">
+                                                <input type="hidden" name="current" value="{{.URI}}">
+                                                <button type="submit"{{if eq .Index 0}} disabled{{end}}>{{t "上へ"}}</button>
+                                        </form>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="target-down">
+                                                <input type="hidden" name="index" value="{{.Index}}">
+                                                <input type="hidden" name="current" value="{{.URI}}">
+                                                <button type="submit"{{if .Last}} disabled{{end}}>{{t "下へ"}}</button>
+                                        </form>
+                                </td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="target-delete">
+                                                <input type="hidden" name="index" value="{{.Index}}">
+                                                <input type="hidden" name="current" value="{{.URI}}">
+                                                <button type="submit">{{t "削除"}}</button>
+                                        </form>
+                                </td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="4">{{t "宛先はありません (着信には 404 を返します)"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="action" value="target-add">
+                <label>{{t "宛先を追加:"}} <input type="text" name="uri" size="40" placeholder="sip:user@example.com" required></label>
+                <button type="submit">{{t "追加"}}</button>
+        </form>
+
+        <h2>{{t "プレビュー"}}</h2>
+        <p>{{t "現在の登録状況で、このアドレスへの着信が鳴らす宛先です。"}}</p>
+        <table>
+                <thead>
+                        <tr><th>{{t "順位"}}</th><th>URI</th><th>{{t "解決先"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range $.Preview}}
+                        <tr>
+                                <td>{{.Position}}</td>
+                                <td>{{.URI}}</td>
+                                <td>
+                                        {{if .Invalid}}<span class="error">{{.Invalid}}</span>
+                                        {{else if .User}}
+                                        {{t "ユーザ"}} {{.User}}{{if .Disabled}} <span class="error">{{t "(停止中のため着信しません)"}}</span>{{end}}
+                                        {{if .Registrar}}
+                                        {{range .Bindings}}<div>{{.Contact}}{{if .Source}} ({{.Source}}){{end}}</div>{{else}}<div class="muted">{{t "登録中の端末なし (ディレクトリの Contact URI を使用)"}}</div>{{end}}
+                                        {{end}}
+                                        {{else}}
+                                        <span class="muted">{{t "ディレクトリ外の宛先 (URI のホストへ転送)"}}</span>
+                                        {{end}}
+                                </td>
+                        </tr>
+                        {{end}}
+                </tbody>
+        </table>
+
+        <h2>{{t "ルールの削除"}}</h2>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="action" value="rule-delete">
+                <button type="submit" data-confirm="{{t "このルールを削除しますか?"}}">{{t "削除"}}</button>
+        </form>
+        {{else}}
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <label>Address: <input type="text" name="broadcast_address" value="{{.Address}}" placeholder="sip:1000@example.com" required></label><br>
+                <label>Description: <input type="text" name="broadcast_description" value="{{.Desc}}"></label><br>
+                <label>{{t "Targets (1 行に 1 つ、優先順):"}}<br><textarea name="broadcast_targets" rows="4" cols="40" placeholder="sip:alice@example.com">{{.Targets}}</textarea></label><br>
+                <button type="submit">{{t "作成"}}</button>
+        </form>
+        {{end}}
+</body>
+</html>`
@@ -0,0 +1,106 @@
+package userweb
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"xylitol4/sip"
+)
+
+// probeTimeout bounds the checks behind a single probe request.
+const probeTimeout = 3 * time.Second
+
+// HealthSource reports the proxy's state to the probe endpoints.
+// *sip.SIPStack satisfies it.
+type HealthSource interface {
+	Health(ctx context.Context) sip.HealthReport
+}
+
+// BuildInfo identifies the running binary on /buildinfo.
+type BuildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"go_version"`
+}
+
+// ReadBuildInfo combines version, normally stamped at link time, with the
+// VCS revision the Go toolchain embeds in the binary.
+func ReadBuildInfo(version string) BuildInfo {
+	info := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" && build.Main.Version != "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+type probeResponse struct {
+	Status string            `json:"status"`
+	Checks []sip.HealthCheck `json:"checks,omitempty"`
+}
+
+// WithProbes serves /healthz, /readyz, and /buildinfo in front of next for
+// container orchestrators. The probes need no authentication, so they are
+// reachable even when next only redirects to HTTPS; a nil next answers every
+// other path with 404. /healthz fails while the SIP sockets are closed and
+// /readyz additionally while the user database or the pinged upstream is
+// unreachable.
+func WithProbes(next http.Handler, health HealthSource, build BuildInfo) http.Handler {
+	if next == nil {
+		next = http.NotFoundHandler()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", next)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveProbe(w, r, health, func(report sip.HealthReport) bool { return report.Live })
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveProbe(w, r, health, func(report sip.HealthReport) bool { return report.Ready })
+	})
+	mux.HandleFunc("/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, build)
+	})
+	return mux
+}
+
+func serveProbe(w http.ResponseWriter, r *http.Request, health HealthSource, passed func(sip.HealthReport) bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if health == nil {
+		writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+	report := health.Health(ctx)
+	if !passed(report) {
+		writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "unavailable", Checks: report.Checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ok", Checks: report.Checks})
+}
@@ -0,0 +1,250 @@
+package userweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sourceLanguage is the language the templates and handlers are written
+	// in. Its texts double as the message keys of every other catalog, so it
+	// needs no built-in catalog.
+	sourceLanguage = "ja"
+	// langCookieName remembers a language picked with ?lang=.
+	langCookieName = "xylitol_lang"
+	// langCookieLifetime keeps the chosen language for a year.
+	langCookieLifetime = 365 * 24 * time.Hour
+)
+
+// builtinCatalogs holds the translations shipped with the binary, keyed by
+// language and then by the Japanese source text.
+var builtinCatalogs = map[string]map[string]string{
+	"en": englishMessages,
+}
+
+// languageNames labels each language in the language switcher, in its own
+// language.
+var languageNames = map[string]string{
+	"ja": "日本語",
+	"en": "English",
+}
+
+type langContextKey struct{}
+
+// loadCatalogs returns the built-in catalogs merged with messages.<lang>.json
+// files from dir, which may translate additional languages or override
+// built-in texts. Each file is a JSON object from source text to translation;
+// messages.ja.json may reword the source texts themselves.
+func loadCatalogs(dir string) (map[string]map[string]string, error) {
+	catalogs := make(map[string]map[string]string, len(builtinCatalogs))
+	for lang, messages := range builtinCatalogs {
+		catalogs[lang] = make(map[string]string, len(messages))
+		for key, text := range messages {
+			catalogs[lang][key] = text
+		}
+	}
+	if dir == "" {
+		return catalogs, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "messages.*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("userweb: list message catalogs: %w", err)
+	}
+	for _, path := range paths {
+		lang := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "messages."), ".json"))
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("userweb: read message catalog %s: %w", path, err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return nil, fmt.Errorf("userweb: parse message catalog %s: %w", path, err)
+		}
+		if catalogs[lang] == nil {
+			catalogs[lang] = make(map[string]string, len(messages))
+		}
+		for key, text := range messages {
+			catalogs[lang][key] = text
+		}
+	}
+	return catalogs, nil
+}
+
+// loadTemplate parses the built-in template text, or <name>.html from dir when
+// that file exists. Every template may use {{t "text" args...}} to translate,
+// {{lang}} for the current language, and {{template "languages"}} for the
+// language switcher; the placeholders here are replaced at render time.
+func loadTemplate(dir, name, builtin string) (*template.Template, error) {
+	text := builtin
+	if dir != "" {
+		raw, err := os.ReadFile(filepath.Join(dir, name+".html"))
+		switch {
+		case err == nil:
+			text = string(raw)
+		case !errors.Is(err, fs.ErrNotExist):
+			return nil, fmt.Errorf("userweb: read %s template: %w", name, err)
+		}
+	}
+	tmpl := template.New(name).Funcs(template.FuncMap{
+		"t":     func(key string, args ...any) string { return key },
+		"lang":  func() string { return sourceLanguage },
+		"langs": func() []languageLink { return nil },
+	})
+	if _, err := tmpl.Parse(languagesTemplate); err != nil {
+		return nil, fmt.Errorf("userweb: parse languages template: %w", err)
+	}
+	if _, err := tmpl.Parse(text); err != nil {
+		return nil, fmt.Errorf("userweb: parse %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// withLanguage picks the language for each request and, when it was chosen
+// explicitly with ?lang=, remembers it in a cookie.
+func (s *Server) withLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := ""
+		if requested := strings.ToLower(r.URL.Query().Get("lang")); s.supportsLanguage(requested) {
+			lang = requested
+			http.SetCookie(w, &http.Cookie{
+				Name:     langCookieName,
+				Value:    lang,
+				Path:     "/",
+				MaxAge:   int(langCookieLifetime / time.Second),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		} else if cookie, err := r.Cookie(langCookieName); err == nil && s.supportsLanguage(cookie.Value) {
+			lang = cookie.Value
+		} else {
+			lang = s.negotiateLanguage(r.Header.Get("Accept-Language"))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), langContextKey{}, lang)))
+	})
+}
+
+func (s *Server) supportsLanguage(lang string) bool {
+	if lang == sourceLanguage {
+		return true
+	}
+	_, ok := s.catalogs[lang]
+	return ok
+}
+
+// negotiateLanguage picks the supported language the Accept-Language header
+// ranks highest, matching on the primary subtag so that "en-GB" selects
+// English. Without a match the source language is used.
+func (s *Server) negotiateLanguage(header string) string {
+	best, bestQ := sourceLanguage, 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if primary, _, ok := strings.Cut(tag, "-"); ok {
+			tag = primary
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > bestQ && s.supportsLanguage(tag) {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// requestLanguage returns the language withLanguage picked for r.
+func requestLanguage(r *http.Request) string {
+	if lang, ok := r.Context().Value(langContextKey{}).(string); ok {
+		return lang
+	}
+	return sourceLanguage
+}
+
+// translate looks key up in lang's catalog, falling back to the source text,
+// and formats it with args when there are any.
+func (s *Server) translate(lang, key string, args ...any) string {
+	text := key
+	if translated, ok := s.catalogs[lang][key]; ok && translated != "" {
+		text = translated
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// tr translates a message for the language of r.
+func (s *Server) tr(r *http.Request, key string, args ...any) string {
+	return s.translate(requestLanguage(r), key, args...)
+}
+
+// languageLink is one entry of the language switcher.
+type languageLink struct {
+	Code    string
+	Name    string
+	URL     string
+	Current bool
+}
+
+// render executes tmpl for r's language.
+func (s *Server) render(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data any) {
+	lang := requestLanguage(r)
+	page, err := tmpl.Clone()
+	if err != nil {
+		s.logger.Error("render template", "template", tmpl.Name(), "error", err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	page.Funcs(template.FuncMap{
+		"t":     func(key string, args ...any) string { return s.translate(lang, key, args...) },
+		"lang":  func() string { return lang },
+		"langs": func() []languageLink { return s.languageLinks(r, lang) },
+	})
+	w.Header().Set("Content-Language", lang)
+	if err := page.Execute(w, data); err != nil {
+		s.logger.Error("render template", "template", tmpl.Name(), "error", err)
+	}
+}
+
+// languageLinks links the current page in every supported language, keeping
+// its other query parameters.
+func (s *Server) languageLinks(r *http.Request, current string) []languageLink {
+	codes := []string{sourceLanguage}
+	for lang := range s.catalogs {
+		if lang != sourceLanguage {
+			codes = append(codes, lang)
+		}
+	}
+	sort.Strings(codes[1:])
+	links := make([]languageLink, 0, len(codes))
+	for _, code := range codes {
+		query := r.URL.Query()
+		query.Set("lang", code)
+		name := languageNames[code]
+		if name == "" {
+			name = code
+		}
+		links = append(links, languageLink{Code: code, Name: name, URL: r.URL.Path + "?" + query.Encode(), Current: code == current})
+	}
+	return links
+}
+
+// languagesTemplate is the language switcher shared by every page.
+const languagesTemplate = `{{define "languages"}}<nav class="languages" style="float: right">{{range langs}}{{if .Current}} <strong>{{.Name}}</strong>{{else}} <a href="{{.URL}}" lang="{{.Code}}">{{.Name}}</a>{{end}}{{end}}</nav>{{end}}`
@@ -0,0 +1,255 @@
+package userweb
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	s := &Server{catalogs: map[string]map[string]string{"en": {}, "fr": {}}}
+	for _, tt := range []struct {
+		header string
+		want   string
+	}{
+		{"", "ja"},
+		{"en", "en"},
+		{"en-GB", "en"},
+		{"EN-us", "en"},
+		{"de, it", "ja"},
+		{"de, fr;q=0.5", "fr"},
+		{"en;q=0.4, fr;q=0.8, ja;q=0.6", "fr"},
+		{"ja;q=0.5, en-US;q=0.9", "en"},
+		{"fr;q=0.7, en;q=0.7", "fr"},
+		{"*", "ja"},
+		{"en;q=0", "ja"},
+		{"en;q=bad", "en"},
+		{"fr ; q=0.3 , en ; q=0.2", "fr"},
+	} {
+		if got := s.negotiateLanguage(tt.header); got != tt.want {
+			t.Fatalf("%q: expected %s, got %s", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestWithLanguagePrefersTheQueryThenTheCookieThenTheHeader(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.Handler()
+	for _, tt := range []struct {
+		name     string
+		path     string
+		cookie   string
+		header   string
+		want     string
+		remember bool
+	}{
+		{"no preference", "/login", "", "", "ja", false},
+		{"header", "/login", "", "fr, en;q=0.5", "en", false},
+		{"unsupported header", "/login", "", "de", "ja", false},
+		{"cookie over header", "/login", "en", "ja", "en", false},
+		{"unsupported cookie", "/login", "de", "en", "en", false},
+		{"query over cookie", "/login?lang=ja", "en", "en", "ja", true},
+		{"unsupported query", "/login?lang=de", "", "en", "en", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Accept-Language", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: langCookieName, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Language"); got != tt.want {
+				t.Fatalf("expected %s, got %q", tt.want, got)
+			}
+			if want := `<html lang="` + tt.want + `">`; !strings.Contains(rec.Body.String(), want) {
+				t.Fatalf("expected the page to be rendered in %s", tt.want)
+			}
+			remembered := false
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == langCookieName {
+					remembered = cookie.Value == tt.want && cookie.HttpOnly && cookie.MaxAge > 0
+				}
+			}
+			if remembered != tt.remember {
+				t.Fatalf("expected the language to be remembered: %v, got %v", tt.remember, remembered)
+			}
+		})
+	}
+}
+
+func TestTranslateFallsBackToTheSourceText(t *testing.T) {
+	dir := t.TempDir()
+	catalog := `{"ログイン": "Connexion", "%s としてログイン中": "", "監査ログ": "Journal d'audit"}`
+	if err := os.WriteFile(filepath.Join(dir, "messages.fr.json"), []byte(catalog), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "messages.en.json"), []byte(`{"ログイン": "Log in"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	catalogs, err := loadCatalogs(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := &Server{catalogs: catalogs}
+	for _, tt := range []struct {
+		lang string
+		key  string
+		args []any
+		want string
+	}{
+		{"fr", "ログイン", nil, "Connexion"},
+		{"fr", "%s としてログイン中", []any{"alice"}, "alice としてログイン中"},
+		{"fr", "管理画面に戻る", nil, "管理画面に戻る"},
+		{"en", "ログイン", nil, "Log in"},
+		{"en", "管理画面に戻る", nil, "Back to administration"},
+		{"en", "%s としてログイン中", []any{"alice"}, "Signed in as alice"},
+		{"ja", "ログイン", nil, "ログイン"},
+		{"de", "ログイン", nil, "ログイン"},
+	} {
+		if got := s.translate(tt.lang, tt.key, tt.args...); got != tt.want {
+			t.Fatalf("%s %q: expected %q, got %q", tt.lang, tt.key, tt.want, got)
+		}
+	}
+	if englishMessages["ログイン"] != "Sign in" {
+		t.Fatalf("expected an override file to leave the built-in catalog alone")
+	}
+}
+
+// templateKey matches the literal key of a {{t "..."}} call in a template.
+var templateKey = regexp.MustCompile(`\{\{t ("(?:[^"\\]|\\.)*")`)
+
+// templateAction matches any template action.
+var templateAction = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// hasJapanese reports whether text contains kana or kanji.
+func hasJapanese(text string) bool {
+	for _, r := range text {
+		if unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceMessageKeys returns the Japanese message keys in the package's
+// source: the {{t}} keys of the templates and every other Japanese string
+// literal, which the handlers pass to tr. Template text outside an action
+// must not be Japanese, since it would never be translated.
+func sourceMessageKeys(t *testing.T) map[string]token.Position {
+	t.Helper()
+	fset := token.NewFileSet()
+	paths, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]token.Position)
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") || strings.HasPrefix(path, "messages_") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			if kv, ok := n.(*ast.KeyValueExpr); ok {
+				// The language switcher names each language in itself.
+				if key, ok := kv.Key.(*ast.BasicLit); ok && key.Value == strconv.Quote(sourceLanguage) {
+					return false
+				}
+			}
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			text, err := strconv.Unquote(lit.Value)
+			if err != nil || !hasJapanese(text) {
+				return true
+			}
+			pos := fset.Position(lit.Pos())
+			if !strings.Contains(text, "{{") {
+				keys[text] = pos
+				return true
+			}
+			for _, m := range templateKey.FindAllStringSubmatch(text, -1) {
+				key, err := strconv.Unquote(m[1])
+				if err != nil {
+					t.Fatalf("%s: bad template key %s", pos, m[1])
+				}
+				keys[key] = pos
+			}
+			for _, line := range strings.Split(templateAction.ReplaceAllString(text, ""), "\n") {
+				if hasJapanese(line) {
+					t.Errorf("%s: template text outside {{t}}: %q", pos, strings.TrimSpace(line))
+				}
+			}
+			return true
+		})
+	}
+	if len(keys) == 0 {
+		t.Fatalf("found no message keys")
+	}
+	return keys
+}
+
+// formatVerb matches a fmt verb of a message with its optional argument
+// index.
+var formatVerb = regexp.MustCompile(`%(?:\[(\d+)\])?[-+# 0-9.]*([a-zA-Z%])`)
+
+// messageArgs lists which argument each verb of text formats and how, sorted,
+// so that a translation may reorder its arguments with %[n]s.
+func messageArgs(text string) []string {
+	var args []string
+	next := 1
+	for _, m := range formatVerb.FindAllStringSubmatch(text, -1) {
+		if m[2] == "%" {
+			continue
+		}
+		if m[1] != "" {
+			next, _ = strconv.Atoi(m[1])
+		}
+		args = append(args, strconv.Itoa(next)+m[2])
+		next++
+	}
+	slices.Sort(args)
+	return args
+}
+
+func TestEveryMessageKeyIsInEveryCatalog(t *testing.T) {
+	keys := sourceMessageKeys(t)
+	for lang, catalog := range builtinCatalogs {
+		for key, pos := range keys {
+			translated, ok := catalog[key]
+			if !ok || translated == "" {
+				t.Errorf("%s: %q has no %s translation", pos, key, lang)
+				continue
+			}
+			if want, got := messageArgs(key), messageArgs(translated); !slices.Equal(want, got) {
+				t.Errorf("%s: the %s translation of %q formats %q, want %q", pos, lang, key, got, want)
+			}
+		}
+		for key := range catalog {
+			if _, ok := keys[key]; !ok {
+				t.Errorf("the %s catalog translates %q, which nothing uses", lang, key)
+			}
+		}
+	}
+	for lang := range builtinCatalogs {
+		if languageNames[lang] == "" {
+			t.Errorf("%s has no name in the language switcher", lang)
+		}
+	}
+}
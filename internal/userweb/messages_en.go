@@ -0,0 +1,283 @@
+package userweb
+
+// englishMessages translates the Japanese source texts of the templates and
+// handlers into English.
+var englishMessages = map[string]string{
+	"監査ログの取得に失敗しました: %v": "Failed to load the audit log: %v",
+	"監査ログ":     "Audit log",
+	"管理画面に戻る":  "Back to administration",
+	"実行者:":     "Actor:",
+	"操作:":      "Action:",
+	"対象:":      "Target:",
+	"絞り込み":     "Filter",
+	"日時 (UTC)": "Time (UTC)",
+	"実行者":      "Actor",
+	"操作":       "Action",
+	"対象":       "Target",
+	"変更前":      "Before",
+	"変更後":      "After",
+	"記録はありません": "No records",
+	"前のページ":    "Previous page",
+	"次のページ":    "Next page",
+	"%s のブロードキャストルールを作成しました":                                      "Created the broadcast rule for %s",
+	"フォームの解析に失敗しました: %v":                                          "Failed to parse the form: %v",
+	"フォームの有効期限が切れました。もう一度操作してください":                                "The form has expired. Please try again",
+	"ブロードキャストルールの削除に失敗しました: %v":                                   "Failed to delete the broadcast rule: %v",
+	"ブロードキャスト対象アドレスを入力してください":                                     "Enter the broadcast address",
+	"ブロードキャストルールの作成に失敗しました: %v":                                   "Failed to create the broadcast rule: %v",
+	"ブロードキャストルールの更新に失敗しました: %v":                                   "Failed to update the broadcast rule: %v",
+	"ルールを更新しました":                                                  "Updated the rule",
+	"宛先が他の操作で変更されています。画面を更新してもう一度操作してください":                        "The targets were changed by another operation. Reload the page and try again",
+	"宛先 %s を追加しました":                                               "Added target %s",
+	"宛先 %d を %s に変更しました":                                          "Changed target %d to %s",
+	"これ以上移動できません":                                                 "Cannot move any further",
+	"宛先の優先順位を変更しました":                                              "Changed the target order",
+	"宛先 %s を削除しました":                                               "Deleted target %s",
+	"不明な操作です":                                                     "Unknown action",
+	"宛先URIの更新に失敗しました: %v":                                         "Failed to update the target URIs: %v",
+	"更新後のルールの取得に失敗しました: %v":                                       "Failed to load the updated rule: %v",
+	"宛先 %d が空です":                                                  "Target %d is empty",
+	"宛先 %d (%s) は SIP URI として正しくありません。sip:user@host の形式で入力してください": "Target %d (%s) is not a valid SIP URI. Enter it as sip:user@host",
+	"宛先 %d (%s) は宛先 %d と重複しています":                                  "Target %d (%s) duplicates target %d",
+	"ユーザ情報の取得に失敗しました: %v":                                         "Failed to load users: %v",
+	"ブロードキャストルール":                                                 "Broadcast rules",
+	"ブロードキャストルール:":                                                "Broadcast rule:",
+	"ブロードキャストルール作成":                                               "Create broadcast rule",
+	"保存":          "Save",
+	"宛先 (上から優先順)": "Targets (in priority order)",
+	"順位":          "Priority",
+	"並べ替え":        "Reorder",
+	"削除":          "Delete",
+	"変更":          "Change",
+	"上へ":          "Up",
+	"下へ":          "Down",
+	"宛先はありません (着信には 404 を返します)": "No targets (calls are answered with 404)",
+	"宛先を追加:": "Add target:",
+	"追加":     "Add",
+	"プレビュー":  "Preview",
+	"現在の登録状況で、このアドレスへの着信が鳴らす宛先です。": "The destinations a call to this address would ring with the current registrations.",
+	"解決先":            "Resolved to",
+	"ユーザ":            "User",
+	"(停止中のため着信しません)": "(disabled, calls are not delivered)",
+	"登録中の端末なし (ディレクトリの Contact URI を使用)": "No registered devices (uses the directory Contact URI)",
+	"ディレクトリ外の宛先 (URI のホストへ転送)":           "Outside the directory (forwarded to the URI host)",
+	"ルールの削除":                  "Delete rule",
+	"このルールを削除しますか?":           "Delete this rule?",
+	"Targets (1 行に 1 つ、優先順):": "Targets (one per line, in priority order):",
+	"作成":                      "Create",
+	"フォームの有効期限が切れました。もう一度ログインしてください": "The form has expired. Please sign in again",
+	"ユーザ名、ドメイン、またはパスワードが正しくありません":    "Incorrect username, domain, or password",
+	"認証に失敗しました: %v":                             "Authentication failed: %v",
+	"転送先は SIP URI または user@domain の形式で入力してください": "Enter the forwarding target as a SIP URI or user@domain",
+	"転送設定の保存に失敗しました: %v":                        "Failed to save the forwarding target: %v",
+	"着信拒否設定の保存に失敗しました: %v":                      "Failed to save the do-not-disturb setting: %v",
+	"設定を保存しました":                                 "Settings saved",
+	"設定の取得に失敗しました: %v":                          "Failed to load settings: %v",
+	"新しいパスワードを入力してください":                         "Enter a new password",
+	"新しいパスワードが確認と一致しません":                        "The new password does not match the confirmation",
+	"現在のパスワードが正しくありません":                         "The current password is incorrect",
+	"パスワードの更新に失敗しました: %v":                       "Failed to update the password: %v",
+	"パスワードを更新しました":                              "Password updated",
+	"利用者ログイン":                                   "User sign-in",
+	"SIP 端末に設定しているユーザ名、ドメイン、パスワードでログインします。":     "Sign in with the username, domain, and password configured on your SIP device.",
+	"ユーザ名":        "Username",
+	"ドメイン":        "Domain",
+	"パスワード":       "Password",
+	"ログイン":        "Sign in",
+	"戻る":          "Back",
+	"利用者ポータル":     "User portal",
+	"%s としてログイン中": "Signed in as %s",
+	"ログアウト":       "Sign out",
+	"パスワード変更":     "Change password",
+	"登録中の端末":      "Registered devices",
+	"レジストラに接続されていません。": "Not connected to the registrar.",
+	"送信元":               "Source",
+	"有効期限 (UTC)":        "Expires (UTC)",
+	"登録中の端末はありません":      "No registered devices",
+	"着信設定":              "Call settings",
+	"転送先 (空欄で転送しない)":    "Forward to (leave empty to disable)",
+	"着信拒否 (転送先が優先されます)": "Do not disturb (forwarding takes precedence)",
+	"最近の通話":             "Recent calls",
+	"通話履歴は利用できません。":     "Call history is not available.",
+	"開始 (UTC)":          "Started (UTC)",
+	"方向":                "Direction",
+	"相手":                "Peer",
+	"結果":                "Result",
+	"通話時間":              "Duration",
+	"発信":                "Outgoing",
+	"着信":                "Incoming",
+	"応答":                "Answered",
+	"呼出中":               "Ringing",
+	"通話履歴はありません":        "No calls",
+	"この操作を行う権限がありません":   "You are not allowed to perform this action",
+	"レジストラに接続されていません":   "Not connected to the registrar",
+	"登録情報が指定されていません":    "No registration was specified",
+	"登録は既に解除されています":     "The registration has already been removed",
+	"登録の解除に失敗しました: %v":  "Failed to remove the registration: %v",
+	"%s の登録 %s を解除しました": "Removed registration %[2]s of %[1]s",
+	"登録状況":              "Registrations",
+	"ユーザ:":              "User:",
+	"(残り %s)":           "(%s left)",
+	"この登録を強制的に解除しますか?":  "Forcibly remove this registration?",
+	"強制解除":              "Remove",
+	"レジストラに接続されていないため、登録状況を表示できません。":             "Registrations cannot be shown because the registrar is not connected.",
+	"ユーザ名またはパスワードが正しくありません":                      "Incorrect username or password",
+	"ユーザ名とドメインを入力してください":                         "Enter a username and domain",
+	"ユーザ %s@%s は既に登録されています":                      "User %s@%s already exists",
+	"ユーザ作成に失敗しました: %v":                           "Failed to create the user: %v",
+	"ユーザ %s@%s を登録ました":                           "Registered user %s@%s",
+	"ユーザ削除に失敗しました: %v":                           "Failed to delete the user: %v",
+	"ユーザ %s@%s を削除しました":                          "Deleted user %s@%s",
+	"ユーザ状態の変更に失敗しました: %v":                        "Failed to change the user status: %v",
+	"ユーザ %s@%s を有効化しました":                         "Enabled user %s@%s",
+	"ユーザ %s@%s を停止しました":                          "Disabled user %s@%s",
+	"CSVファイルの読み込みに失敗しました: %v":                    "Failed to read the CSV file: %v",
+	"CSVインポートに失敗しました (新規 %d 件、更新 %d 件を反映済み): %v": "CSV import failed (%d created and %d updated before the error): %v",
+	"CSVインポートが完了しました (新規 %d 件、更新 %d 件)":          "CSV import completed (%d created, %d updated)",
+	"管理者名とパスワードを入力してください":                        "Enter an administrator name and password",
+	"権限の指定が正しくありません":                             "Invalid role",
+	"管理者の作成に失敗しました: %v":                          "Failed to create the administrator: %v",
+	"管理者 %s は既に登録されています":                         "Administrator %s already exists",
+	"管理者 %s を作成しました":                             "Created administrator %s",
+	"管理者名を入力してください":                              "Enter an administrator name",
+	"自分自身の権限は下げられません":                            "You cannot lower your own role",
+	"管理者の更新に失敗しました: %v":                          "Failed to update the administrator: %v",
+	"管理者 %s を更新しました":                             "Updated administrator %s",
+	"自分自身は削除できません":                               "You cannot delete yourself",
+	"管理者の削除に失敗しました: %v":                          "Failed to delete the administrator: %v",
+	"管理者 %s を削除しました":                             "Deleted administrator %s",
+	"二要素認証の解除に失敗しました: %v":                        "Failed to reset two-factor authentication: %v",
+	"管理者 %s の二要素認証を解除しました":                       "Reset two-factor authentication for administrator %s",
+	"不明な操作が指定されました":                              "Unknown action specified",
+	"ユーザ管理":            "User management",
+	"ユーザ管理ポータル":        "User management portal",
+	"管理者: ユーザ一覧/登録/削除": "Administrators: list, register, and delete users",
+	"利用者: 登録状況/着信設定/通話履歴/パスワード変更": "Users: registrations, call settings, call history, and password",
+	"管理者 - ユーザ管理":           "Administration - User management",
+	"%s (%s) としてログイン中":      "Signed in as %s (%s)",
+	"二要素認証の設定":              "Two-factor authentication settings",
+	"登録ユーザ一覧":               "Registered users",
+	"検索:":                   "Search:",
+	"ユーザ名・ドメイン・Contact URI": "Username, domain, or Contact URI",
+	"検索":    "Search",
+	"検索を解除": "Clear search",
+	"%d 件中 %d〜%d 件目 (%d/%d ページ)": "%[2]d-%[3]d of %[1]d (page %[4]d/%[5]d)",
+	"停止中":          "Disabled",
+	"有効化":          "Enable",
+	"停止":           "Disable",
+	"編集":           "Edit",
+	"有効":           "Enabled",
+	"該当するユーザはいません": "No matching users",
+	"登録されたユーザはいません":     "No users registered",
+	"新規ユーザ登録":           "Register a new user",
+	"ユーザ名:":             "Username:",
+	"ドメイン:":             "Domain:",
+	"初期パスワード (任意):":     "Initial password (optional):",
+	"Contact URI (任意):": "Contact URI (optional):",
+	"登録":                "Register",
+	"CSV一括登録・出力":        "CSV bulk import and export",
+	"列: username, domain, password または password_hash, contact_uri, enabled (1行目はヘッダ)": "Columns: username, domain, password or password_hash, contact_uri, enabled (the first row is a header)",
+	"CSVファイル:": "CSV file:",
+	"インポート":    "Import",
+	"ユーザ一覧をCSVでダウンロード": "Download the user list as CSV",
+	"ユーザ削除":         "Delete user",
+	"ルールを追加":        "Add rule",
+	"Targets (優先順)": "Targets (in priority order)",
+	"(なし)":          "(none)",
+	"登録されたルールはありません": "No rules registered",
+	"管理者アカウント":       "Administrator accounts",
+	"管理者名":           "Administrator",
+	"権限":             "Role",
+	"二要素認証":          "Two-factor authentication",
+	"新しいパスワード (任意)":  "New password (optional)",
+	"更新":             "Update",
+	"解除":             "Reset",
+	"無効":             "Off",
+	"データベースに登録された管理者はいません": "No administrators are registered in the database",
+	"管理者アカウント作成":           "Create administrator account",
+	"管理者名:":                "Administrator name:",
+	"パスワード:":               "Password:",
+	"権限:":                  "Role:",
+	"管理者ログイン":              "Administrator sign-in",
+	"現在のパスワード":             "Current password",
+	"新しいパスワード":             "New password",
+	"新しいパスワード(確認)":         "New password (confirm)",
+	"ポータルに戻る":              "Back to the portal",
+	"認証コードが正しくありません":       "Incorrect authentication code",
+	"二要素認証は既に有効です":         "Two-factor authentication is already enabled",
+	"シークレットが正しくありません。もう一度やり直してください":           "Invalid secret. Please start over",
+	"二要素認証の設定に失敗しました: %v":                     "Failed to set up two-factor authentication: %v",
+	"二要素認証を有効にしました。リカバリーコードを安全な場所に保管してください":   "Two-factor authentication enabled. Keep your recovery codes in a safe place",
+	"二要素認証は設定されていません":                         "Two-factor authentication is not set up",
+	"二要素認証を解除しました":                            "Two-factor authentication disabled",
+	"リカバリーコードの再発行に失敗しました: %v":                 "Failed to regenerate recovery codes: %v",
+	"リカバリーコードを再発行しました。以前のコードは使えません":           "Recovery codes regenerated. The previous codes no longer work",
+	"認証アプリに表示された6桁のコード、またはリカバリーコードを入力してください。": "Enter the 6-digit code shown in your authenticator app, or a recovery code.",
+	"認証コード":    "Authentication code",
+	"確認":       "Verify",
+	"最初からやり直す": "Start over",
+	"コマンドラインで指定した管理者 (%s) には二要素認証を設定できません。データベースに管理者アカウントを作成して利用してください。": "Two-factor authentication cannot be set up for the administrator given on the command line (%s). Create an administrator account in the database instead.",
+	"リカバリーコード": "Recovery codes",
+	"認証アプリを使えないときに、各コードを1回だけ認証コードの代わりに使えます。この画面を離れると再表示できません。": "Each code can be used once in place of an authentication code when your authenticator app is unavailable. They are not shown again after you leave this page.",
+	"%s の二要素認証は有効です。": "Two-factor authentication is enabled for %s.",
+	"リカバリーコードの再発行":    "Regenerate recovery codes",
+	"再発行":             "Regenerate",
+	"二要素認証の解除":        "Disable two-factor authentication",
+	"認証アプリで次のQRコードを読み取り、表示された6桁のコードを入力してください。": "Scan the following QR code with your authenticator app and enter the 6-digit code it shows.",
+	"QRコードを読み取れない場合はシークレットを手動で登録してください:":       "If you cannot scan the QR code, enter the secret manually:",
+	"有効にする": "Enable",
+	"ユーザの更新に失敗しました: %v":       "Failed to update the user: %v",
+	"更新後のユーザ情報の取得に失敗しました: %v": "Failed to load the updated user: %v",
+	"ユーザ %s@%s を更新しました":       "Updated user %s@%s",
+	"ユーザ編集":                   "Edit user",
+	"ユーザ編集:":                  "Edit user:",
+	"パスワードを再設定する場合のみ入力してください": "Enter a password only to reset it",
+	"現在:":            "current:",
+	"設定済み":           "set",
+	"未設定":            "not set",
+	"新しいパスワード:":      "New password:",
+	"新しいパスワード (確認):": "New password (confirm):",
+	"状態":             "Status",
+	"APIトークンの取得に失敗しました: %v": "Failed to load API tokens: %v",
+	"トークン名を入力してください":        "Enter a token name",
+	"スコープを1つ以上選択してください":     "Select at least one scope",
+	"APIトークンの作成に失敗しました: %v": "Failed to create the API token: %v",
+	"APIトークン %s を作成しました":    "Created API token %s",
+	"トークンが指定されていません":        "No token was specified",
+	"トークンは既に失効しています":        "The token has already been revoked",
+	"APIトークンの失効に失敗しました: %v": "Failed to revoke the API token: %v",
+	"APIトークンを失効させました":       "Revoked the API token",
+	"APIトークン": "API tokens",
+	"次のトークンを Authorization: Bearer ヘッダに指定してください。この画面を離れると再表示できません。": "Send the following token in an Authorization: Bearer header. It is not shown again after you leave this page.",
+	"名前":         "Name",
+	"スコープ":       "Scopes",
+	"作成者":        "Created by",
+	"作成日時 (UTC)": "Created (UTC)",
+	"このトークンを失効させますか?": "Revoke this token?",
+	"失効": "Revoke",
+	"登録されたトークンはありません": "No tokens registered",
+	"トークンの作成":         "Create token",
+	"名前:":             "Name:",
+	"スコープ (書き込みは読み取りを含みます):": "Scopes (write includes read):",
+	"短縮番号の取得に失敗しました: %v":     "Failed to load short numbers: %v",
+	"短縮番号の作成に失敗しました: %v":     "Failed to create the short number: %v",
+	"短縮番号の更新に失敗しました: %v":     "Failed to update the short number: %v",
+	"短縮番号の削除に失敗しました: %v":     "Failed to delete the short number: %v",
+	"短縮番号 %s@%s を作成しました":     "Created short number %s@%s",
+	"短縮番号 %s@%s を更新しました":     "Updated short number %s@%s",
+	"短縮番号 %s@%s を削除しました":     "Deleted short number %s@%s",
+	"短縮番号が指定されていません":         "No short number was specified",
+	"このドメインには同じ短縮番号が既にあります":  "The domain already has this short number",
+	"短縮番号は既に削除されています":        "The short number has already been deleted",
+	"短縮番号": "Short numbers",
+	"ドメイン内で短縮番号にかけると、登録・転送の前に宛先の URI へ書き換えます。": "Calls to a short number within its domain are rewritten to the target URI before registrations and forwarding are consulted.",
+	"番号":     "Number",
+	"宛先 URI": "Target URI",
+	"説明":     "Description",
+	"この短縮番号を削除しますか?":  "Delete this short number?",
+	"登録された短縮番号はありません": "No short numbers registered",
+	"短縮番号の追加":         "Add short number",
+	"番号:":             "Number:",
+	"宛先 URI:":         "Target URI:",
+	"説明:":             "Description:",
+}
@@ -0,0 +1,75 @@
+package userweb
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"xylitol4/internal/metrics"
+)
+
+// httpMetrics counts and times the web interface's requests. Paths are left
+// out of the labels so that user names in query strings and probing clients
+// cannot grow the series without bound.
+type httpMetrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func newHTTPMetrics(reg *metrics.Registry) *httpMetrics {
+	if reg == nil {
+		return nil
+	}
+	return &httpMetrics{
+		requests: reg.Counter("http_requests_total", "Web interface and API requests served, by method and status code.", "method", "code"),
+		duration: reg.Histogram("http_request_duration_seconds", "Time spent serving web interface and API requests, by method.", nil, "method"),
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrument records every request passing through next.
+func (m *httpMetrics) instrument(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+		m.requests.Inc(method, strconv.Itoa(rec.status))
+		m.duration.Observe(time.Since(started).Seconds(), method)
+	})
+}
@@ -0,0 +1,438 @@
+package userweb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"xylitol4/sip"
+	"xylitol4/sip/userdb"
+)
+
+// portalCallLimit is how many recent calls the portal shows.
+const portalCallLimit = 20
+
+// CallSource lists the calls the proxy has recently handled, as
+// *sip.SIPStack does.
+type CallSource interface {
+	RecentCalls(username, domain string, limit int) []sip.CallRecord
+}
+
+// passwordAuthenticator is implemented by stores that verify passwords
+// themselves, such as the LDAP store, whose hashes are not readable.
+type passwordAuthenticator interface {
+	Authenticate(ctx context.Context, username, domain, password string) error
+}
+
+// errPortalLogin is returned for every failed portal login so that the reason
+// (unknown user, wrong password, disabled account) is not disclosed.
+var errPortalLogin = errors.New("invalid SIP credentials")
+
+// authenticateUser checks a SIP user's own credentials. Disabled accounts and
+// accounts without a password cannot log in.
+func (s *Server) authenticateUser(r *http.Request, username, domain, password string) error {
+	if username == "" || domain == "" || password == "" {
+		return errPortalLogin
+	}
+	ctx := r.Context()
+	user, err := s.store.Lookup(ctx, username, domain)
+	if errors.Is(err, userdb.ErrUserNotFound) {
+		return errPortalLogin
+	}
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return errPortalLogin
+	}
+	if auth, ok := s.store.(passwordAuthenticator); ok {
+		err := auth.Authenticate(ctx, username, domain, password)
+		if errors.Is(err, userdb.ErrInvalidCredentials) || errors.Is(err, userdb.ErrUserNotFound) {
+			return errPortalLogin
+		}
+		return err
+	}
+	if user.PasswordHash == "" || !userdb.VerifyPassword(user.PasswordHash, username, domain, password) {
+		return errPortalLogin
+	}
+	return nil
+}
+
+// portalHandler serves a request from a SIP user logged in to the portal.
+type portalHandler func(w http.ResponseWriter, r *http.Request, sess *session)
+
+// requirePortal admits requests from a portal session. Anonymous requests are
+// sent to the portal login page, or refused outright for anything but GET.
+func (s *Server) requirePortal(next portalHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := s.currentSession(r)
+		if sess == nil || sess.sipUser == "" {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/portal/login?next="+url.QueryEscape(r.URL.Path), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, sess)
+	}
+}
+
+// safePortalRedirect keeps post-login redirects inside the portal.
+func safePortalRedirect(next string) string {
+	if next != "/portal" && !strings.HasPrefix(next, "/portal/") {
+		return "/portal"
+	}
+	return next
+}
+
+type portalLoginTemplateData struct {
+	CSRFToken string
+	Next      string
+	Username  string
+	Domain    string
+	Error     string
+}
+
+// handlePortalLogin logs a SIP user in with their own credentials, replacing
+// any existing session.
+func (s *Server) handlePortalLogin(w http.ResponseWriter, r *http.Request) {
+	data := portalLoginTemplateData{Next: safePortalRedirect(r.URL.Query().Get("next"))}
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		data.Next = safePortalRedirect(r.FormValue("next"))
+		data.Username = strings.TrimSpace(r.FormValue("username"))
+		data.Domain = strings.TrimSpace(r.FormValue("domain"))
+		sess := s.currentSession(r)
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度ログインしてください")
+			break
+		}
+		err := s.authenticateUser(r, data.Username, data.Domain, r.FormValue("password"))
+		if errors.Is(err, errPortalLogin) {
+			s.logger.Warn("failed portal login", "user", data.Username+"@"+data.Domain, "remote", r.RemoteAddr)
+			data.Error = s.tr(r, "ユーザ名、ドメイン、またはパスワードが正しくありません")
+			break
+		}
+		if err != nil {
+			data.Error = s.tr(r, "認証に失敗しました: %v", err)
+			break
+		}
+		s.sessions.delete(sess.id)
+		if _, err := s.startSession(w, r, session{sipUser: data.Username, sipDomain: data.Domain}); err != nil {
+			http.Error(w, "failed to start session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess, err := s.ensureSession(w, r)
+	if err != nil {
+		http.Error(w, "failed to start session", http.StatusInternalServerError)
+		return
+	}
+	data.CSRFToken = sess.csrfToken
+	s.render(w, r, s.portalLoginTmpl, data)
+}
+
+type portalCall struct {
+	Start    time.Time
+	Outgoing bool
+	Peer     string
+	Status   int
+	Answered bool
+	Duration time.Duration
+}
+
+type portalTemplateData struct {
+	CSRFToken     string
+	User          string
+	Registrations []apiRegistration
+	RegistrarOK   bool
+	ForwardTo     string
+	DoNotDisturb  bool
+	Calls         []portalCall
+	CallsOK       bool
+	Message       string
+	Error         string
+}
+
+// handlePortal shows a SIP user their registrations, call forwarding and
+// do-not-disturb settings, and recent calls, and saves changes to the
+// settings.
+func (s *Server) handlePortal(w http.ResponseWriter, r *http.Request, sess *session) {
+	username, domain := sess.sipUser, sess.sipDomain
+	aor := username + "@" + domain
+	data := portalTemplateData{CSRFToken: sess.csrfToken, User: aor}
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		forwardTo := strings.TrimSpace(r.FormValue("forward_to"))
+		if strings.ContainsAny(forwardTo, " \t<>\"") {
+			data.Error = s.tr(r, "転送先は SIP URI または user@domain の形式で入力してください")
+			break
+		}
+		dnd := r.FormValue("dnd") != ""
+		before, _ := s.store.UserSettings(ctx, username, domain)
+		if err := s.saveSetting(ctx, username, domain, userdb.SettingForwardTo, forwardTo); err != nil {
+			data.Error = s.tr(r, "転送設定の保存に失敗しました: %v", err)
+			break
+		}
+		dndValue := ""
+		if dnd {
+			dndValue = "true"
+		}
+		if err := s.saveSetting(ctx, username, domain, userdb.SettingDoNotDisturb, dndValue); err != nil {
+			data.Error = s.tr(r, "着信拒否設定の保存に失敗しました: %v", err)
+			break
+		}
+		s.audit(r, aor, "user.settings", aor,
+			portalSettings{ForwardTo: before.ForwardTo(), DoNotDisturb: before.DoNotDisturb()},
+			portalSettings{ForwardTo: forwardTo, DoNotDisturb: dnd})
+		data.Message = s.tr(r, "設定を保存しました")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	settings, err := s.store.UserSettings(ctx, username, domain)
+	if err != nil && data.Error == "" {
+		data.Error = s.tr(r, "設定の取得に失敗しました: %v", err)
+	}
+	data.ForwardTo = settings.ForwardTo()
+	data.DoNotDisturb = settings.DoNotDisturb()
+	if s.registrations != nil {
+		data.RegistrarOK = true
+		for _, binding := range s.registrations.BindingsFor(username, domain) {
+			data.Registrations = append(data.Registrations, toAPIRegistration(binding))
+		}
+	}
+	if s.calls != nil {
+		data.CallsOK = true
+		data.Calls = portalCalls(s.calls.RecentCalls(username, domain, portalCallLimit), strings.ToLower(aor))
+	}
+	s.render(w, r, s.portalTmpl, data)
+}
+
+// portalSettings is the audit snapshot of the settings a user edits in the
+// portal.
+type portalSettings struct {
+	ForwardTo    string `json:"forward_to"`
+	DoNotDisturb bool   `json:"dnd"`
+}
+
+// saveSetting stores value, or removes the setting when value is empty.
+func (s *Server) saveSetting(ctx context.Context, username, domain, name, value string) error {
+	if value == "" {
+		return s.store.DeleteUserSetting(ctx, username, domain, name)
+	}
+	return s.store.SetUserSetting(ctx, username, domain, name, value)
+}
+
+func portalCalls(records []sip.CallRecord, aor string) []portalCall {
+	calls := make([]portalCall, 0, len(records))
+	for _, record := range records {
+		call := portalCall{
+			Start:    record.Started,
+			Outgoing: record.Caller == aor,
+			Peer:     record.Caller,
+			Status:   record.Status,
+			Answered: !record.Answered.IsZero(),
+		}
+		if call.Outgoing {
+			call.Peer = record.Callee
+		}
+		if call.Answered && !record.Ended.IsZero() {
+			call.Duration = record.Ended.Sub(record.Answered).Round(time.Second)
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+type passwordTemplateData struct {
+	CSRFToken string
+	User      string
+	Message   string
+	Error     string
+}
+
+// handlePortalPassword lets a logged-in SIP user change their own password
+// after confirming the current one.
+func (s *Server) handlePortalPassword(w http.ResponseWriter, r *http.Request, sess *session) {
+	username, domain := sess.sipUser, sess.sipDomain
+	data := passwordTemplateData{CSRFToken: sess.csrfToken, User: username + "@" + domain}
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		newPassword := r.FormValue("new_password")
+		if newPassword == "" {
+			data.Error = s.tr(r, "新しいパスワードを入力してください")
+			break
+		}
+		if newPassword != r.FormValue("confirm_password") {
+			data.Error = s.tr(r, "新しいパスワードが確認と一致しません")
+			break
+		}
+		err := s.authenticateUser(r, username, domain, r.FormValue("current_password"))
+		if errors.Is(err, errPortalLogin) {
+			data.Error = s.tr(r, "現在のパスワードが正しくありません")
+			break
+		}
+		if err != nil {
+			data.Error = s.tr(r, "認証に失敗しました: %v", err)
+			break
+		}
+		hash := userdb.HashPassword(username, domain, newPassword)
+		if err := s.store.UpdatePassword(r.Context(), username, domain, hash); err != nil {
+			data.Error = s.tr(r, "パスワードの更新に失敗しました: %v", err)
+			break
+		}
+		// The user changed their own password, so they are the actor.
+		s.audit(r, data.User, "user.password", data.User, nil, nil)
+		data.Message = s.tr(r, "パスワードを更新しました")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.render(w, r, s.passwordTmpl, data)
+}
+
+const portalLoginTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "利用者ログイン"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                form { max-width: 400px; }
+                label { display: block; margin-bottom: 0.5rem; }
+                input { width: 100%; padding: 0.4rem; margin-top: 0.2rem; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "利用者ログイン"}}</h1>
+        <p>{{t "SIP 端末に設定しているユーザ名、ドメイン、パスワードでログインします。"}}</p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="next" value="{{.Next}}">
+                <label>{{t "ユーザ名"}}<input type="text" name="username" value="{{.Username}}" required autofocus></label>
+                <label>{{t "ドメイン"}}<input type="text" name="domain" value="{{.Domain}}" required></label>
+                <label>{{t "パスワード"}}<input type="password" name="password" required></label>
+                <button type="submit">{{t "ログイン"}}</button>
+        </form>
+        <a href="/">{{t "戻る"}}</a>
+</body>
+</html>`
+
+const portalTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "利用者ポータル"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; max-width: 800px; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; }
+                form.settings label { display: block; margin-bottom: 0.5rem; }
+                .message { color: green; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "利用者ポータル"}}</h1>
+        <form method="post" action="/logout">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                {{t "%s としてログイン中" .User}} <button type="submit">{{t "ログアウト"}}</button>
+        </form>
+        <p><a href="/portal/password">{{t "パスワード変更"}}</a></p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+
+        <h2>{{t "登録中の端末"}}</h2>
+        {{if not .RegistrarOK}}
+        <p>{{t "レジストラに接続されていません。"}}</p>
+        {{else}}
+        <table>
+                <thead>
+                        <tr><th>Contact</th><th>{{t "送信元"}}</th><th>User-Agent</th><th>{{t "有効期限 (UTC)"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .Registrations}}
+                        <tr><td>{{.Contact}}</td><td>{{.Source}}</td><td>{{.UserAgent}}</td><td>{{.Expires.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+                        {{else}}
+                        <tr><td colspan="4">{{t "登録中の端末はありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        {{end}}
+
+        <h2>{{t "着信設定"}}</h2>
+        <form method="post" class="settings">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <label>{{t "転送先 (空欄で転送しない)"}}<input type="text" name="forward_to" value="{{.ForwardTo}}" placeholder="sip:user@example.com"></label>
+                <label><input type="checkbox" name="dnd" value="1"{{if .DoNotDisturb}} checked{{end}}> {{t "着信拒否 (転送先が優先されます)"}}</label>
+                <button type="submit">{{t "保存"}}</button>
+        </form>
+
+        <h2>{{t "最近の通話"}}</h2>
+        {{if not .CallsOK}}
+        <p>{{t "通話履歴は利用できません。"}}</p>
+        {{else}}
+        <table>
+                <thead>
+                        <tr><th>{{t "開始 (UTC)"}}</th><th>{{t "方向"}}</th><th>{{t "相手"}}</th><th>{{t "結果"}}</th><th>{{t "通話時間"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .Calls}}
+                        <tr>
+                                <td>{{.Start.UTC.Format "2006-01-02 15:04:05"}}</td>
+                                <td>{{if .Outgoing}}{{t "発信"}}{{else}}{{t "着信"}}{{end}}</td>
+                                <td>{{.Peer}}</td>
+                                <td>{{if .Answered}}{{t "応答"}}{{else if .Status}}{{.Status}}{{else}}{{t "呼出中"}}{{end}}</td>
+                                <td>{{if .Duration}}{{.Duration}}{{end}}</td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="5">{{t "通話履歴はありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        {{end}}
+</body>
+</html>`
@@ -0,0 +1,186 @@
+package userweb
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"xylitol4/sip"
+	"xylitol4/sip/userdb"
+)
+
+type registrationRow struct {
+	AOR       string
+	Contact   string
+	Expires   time.Time
+	Remaining time.Duration
+	Source    string
+	UserAgent string
+}
+
+type registrationsTemplateData struct {
+	CSRFToken    string
+	CanEditUsers bool
+	Available    bool
+	Search       string
+	Rows         []registrationRow
+	Message      string
+	Error        string
+}
+
+// handleRegistrations lists the registrar's active bindings and lets
+// helpdesk administrators force a binding off.
+func (s *Server) handleRegistrations(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	data := registrationsTemplateData{
+		CSRFToken:    sess.csrfToken,
+		CanEditUsers: role.Allows(userdb.RoleHelpdesk),
+		Available:    s.registrations != nil,
+		Search:       strings.TrimSpace(r.URL.Query().Get("q")),
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		if !data.CanEditUsers {
+			s.logger.Warn("admin denied forced deregistration", "user", sess.user, "role", role, "remote", r.RemoteAddr)
+			data.Error = s.tr(r, "この操作を行う権限がありません")
+			break
+		}
+		if !data.Available {
+			data.Error = s.tr(r, "レジストラに接続されていません")
+			break
+		}
+		aor := r.FormValue("aor")
+		contact := r.FormValue("contact")
+		at := strings.LastIndex(aor, "@")
+		if at <= 0 || contact == "" {
+			data.Error = s.tr(r, "登録情報が指定されていません")
+			break
+		}
+		username, domain := aor[:at], aor[at+1:]
+		var before any
+		for _, binding := range s.registrations.BindingsFor(username, domain) {
+			if binding.Contact == contact {
+				before = toAPIRegistration(binding)
+			}
+		}
+		err := s.registrations.Deregister(username, domain, contact)
+		if errors.Is(err, sip.ErrBindingNotFound) {
+			data.Error = s.tr(r, "登録は既に解除されています")
+			break
+		}
+		if err != nil {
+			data.Error = s.tr(r, "登録の解除に失敗しました: %v", err)
+			break
+		}
+		s.audit(r, sess.user, "registration.deregister", aor, before, nil)
+		data.Message = s.tr(r, "%s の登録 %s を解除しました", aor, contact)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if data.Available {
+		data.Rows = registrationRows(s.registrations.AllBindings(), data.Search, time.Now())
+	}
+	s.render(w, r, s.registrationsTmpl, data)
+}
+
+// registrationRows flattens bindings into table rows ordered by AOR and
+// expiry, keeping AORs that contain search (case-insensitively).
+func registrationRows(all map[string][]sip.Registration, search string, now time.Time) []registrationRow {
+	search = strings.ToLower(search)
+	aors := make([]string, 0, len(all))
+	for aor := range all {
+		if strings.Contains(aor, search) {
+			aors = append(aors, aor)
+		}
+	}
+	sort.Strings(aors)
+	var rows []registrationRow
+	for _, aor := range aors {
+		for _, binding := range all[aor] {
+			rows = append(rows, registrationRow{
+				AOR:       aor,
+				Contact:   binding.Contact,
+				Expires:   binding.Expires,
+				Remaining: binding.Expires.Sub(now).Truncate(time.Second),
+				Source:    binding.Source,
+				UserAgent: binding.UserAgent,
+			})
+		}
+	}
+	return rows
+}
+
+const registrationsTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "登録状況"}}</title>
+        <script src="/static/confirm.js" defer></script>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; vertical-align: top; }
+                td.contact { font-family: monospace; word-break: break-all; }
+                td form { margin: 0; }
+                .message { color: green; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "登録状況"}}</h1>
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        {{if .Available}}
+        <form method="get" action="/admin/registrations">
+                <label>{{t "ユーザ:"}} <input type="search" name="q" value="{{.Search}}" placeholder="user@domain"></label>
+                <button type="submit">{{t "絞り込み"}}</button>
+        </form>
+        <table>
+                <thead>
+                        <tr><th>{{t "ユーザ"}}</th><th>Contact</th><th>{{t "有効期限 (UTC)"}}</th><th>{{t "送信元"}}</th><th>User-Agent</th>{{if .CanEditUsers}}<th>{{t "操作"}}</th>{{end}}</tr>
+                </thead>
+                <tbody>
+                        {{range .Rows}}
+                        <tr>
+                                <td>{{.AOR}}</td>
+                                <td class="contact">{{.Contact}}</td>
+                                <td>{{.Expires.UTC.Format "2006-01-02 15:04:05"}} {{t "(残り %s)" .Remaining}}</td>
+                                <td>{{if .Source}}{{.Source}}{{else}}-{{end}}</td>
+                                <td>{{if .UserAgent}}{{.UserAgent}}{{else}}-{{end}}</td>
+                                {{if $.CanEditUsers}}
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="aor" value="{{.AOR}}">
+                                                <input type="hidden" name="contact" value="{{.Contact}}">
+                                                <button type="submit" data-confirm="{{t "この登録を強制的に解除しますか?"}}">{{t "強制解除"}}</button>
+                                        </form>
+                                </td>
+                                {{end}}
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="6">{{t "登録中の端末はありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        {{else}}
+        <p>{{t "レジストラに接続されていないため、登録状況を表示できません。"}}</p>
+        {{end}}
+</body>
+</html>`
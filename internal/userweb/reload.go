@@ -0,0 +1,18 @@
+package userweb
+
+import "net/http"
+
+// apiReload reloads the proxy's configuration as SIGHUP does.
+func (s *Server) apiReload(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "configuration reload is not available")
+		return
+	}
+	if err := s.reload(r.Context()); err != nil {
+		s.logger.Error("configuration reload failed", "error", err)
+		writeAPIError(w, http.StatusUnprocessableEntity, "reload failed: "+err.Error())
+		return
+	}
+	s.audit(r, apiActor(r), "config.reload", "sip", nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
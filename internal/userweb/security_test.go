@@ -0,0 +1,86 @@
+package userweb
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// wantSecurityHeaders are the headers every response carries, spelled out
+// rather than taken from the constants so that a change to them shows here.
+var wantSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'none'; script-src 'self'; style-src 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'",
+	"X-Frame-Options":         "DENY",
+	"X-Content-Type-Options":  "nosniff",
+	"Referrer-Policy":         "same-origin",
+}
+
+func TestSecurityHeadersOnEveryResponse(t *testing.T) {
+	s, _ := newTestServer(t)
+	for _, tt := range []struct {
+		name    string
+		handler http.Handler
+		method  string
+		path    string
+	}{
+		{"login page", s.Handler(), http.MethodGet, "/login"},
+		{"admin redirect to login", s.Handler(), http.MethodGet, "/admin/users"},
+		{"refused post", s.Handler(), http.MethodPost, "/logout"},
+		{"script", s.Handler(), http.MethodGet, "/static/confirm.js"},
+		{"API without a token", s.Handler(), http.MethodGet, "/api/v1/users"},
+		{"unknown page", s.Handler(), http.MethodGet, "/no-such-page"},
+		{"admin handler", s.AdminHandler(), http.MethodGet, "/login"},
+		{"portal handler", s.PortalHandler(), http.MethodGet, "/portal/login"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, secure := range []bool{false, true} {
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				want := "max-age=31536000"
+				if secure {
+					req.TLS = &tls.ConnectionState{}
+				} else {
+					// Browsers ignore HSTS over plaintext, so none is sent.
+					want = ""
+				}
+				rec := httptest.NewRecorder()
+				tt.handler.ServeHTTP(rec, req)
+				for name, want := range wantSecurityHeaders {
+					if got := rec.Header().Values(name); len(got) != 1 || got[0] != want {
+						t.Fatalf("expected %s %q, got %q", name, want, got)
+					}
+				}
+				if got := rec.Header().Get("Strict-Transport-Security"); got != want {
+					t.Fatalf("TLS %v: expected Strict-Transport-Security %q, got %q", secure, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPSKeepsThePathAndQuery(t *testing.T) {
+	for _, tt := range []struct {
+		httpsAddr string
+		method    string
+		target    string
+		want      string
+	}{
+		{":443", http.MethodGet, "http://proxy.example/admin/users?page=2&sort=domain", "https://proxy.example/admin/users?page=2&sort=domain"},
+		{":443", http.MethodGet, "http://proxy.example/", "https://proxy.example/"},
+		{"", http.MethodGet, "http://proxy.example/login?next=%2Fadmin%2Fusers", "https://proxy.example/login?next=%2Fadmin%2Fusers"},
+		{":8443", http.MethodPost, "http://proxy.example:8080/login", "https://proxy.example:8443/login"},
+		{"0.0.0.0:8443", http.MethodGet, "http://proxy.example/a%20b/c?q=x%26y", "https://proxy.example:8443/a%20b/c?q=x%26y"},
+		{":8443", http.MethodGet, "http://[2001:db8::1]:8080/portal?lang=en", "https://[2001:db8::1]:8443/portal?lang=en"},
+		{":443", http.MethodDelete, "http://[2001:db8::1]/api/v1/users/alice@example.com", "https://[2001:db8::1]/api/v1/users/alice@example.com"},
+	} {
+		rec := httptest.NewRecorder()
+		RedirectToHTTPS(tt.httpsAddr).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		// A 302 would let clients turn a POST into a GET; 308 keeps it.
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Fatalf("%s %s: expected 308, got %d", tt.method, tt.target, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != tt.want {
+			t.Fatalf("%s %s: expected a redirect to %q, got %q", tt.method, tt.target, tt.want, got)
+		}
+	}
+}
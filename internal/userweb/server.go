@@ -1,34 +1,71 @@
 package userweb
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
-	"sort"
-	"strconv"
+	"net/url"
 	"strings"
 
+	"xylitol4/internal/metrics"
 	"xylitol4/sip/userdb"
 )
 
 // Config captures the dependencies required to expose the user management web UI.
+// APIToken enables the JSON API under /api/v1/ for clients presenting it as a
+// bearer token. Registrations optionally supplies the registrar's bindings to
+// the API. Metrics optionally receives request counts and latencies. Tracer
+// optionally exposes the SIP message tracer under /api/v1/trace. Reload
+// optionally reloads the proxy's configuration for POST /api/v1/reload.
 type Config struct {
-	Store     *userdb.SQLiteStore
-	AdminUser string
-	AdminPass string
-	Logger    *log.Logger
+	Store         userdb.Store
+	AdminUser     string
+	AdminPass     string
+	APIToken      string
+	Registrations RegistrationSource
+	Calls         CallSource
+	TemplateDir   string
+	Logger        *slog.Logger
+	Metrics       *metrics.Registry
+	Tracer        TraceSource
+	Reload        func(context.Context) error
 }
 
 // Server serves the combined administrative and self-service web interface.
 type Server struct {
-	store        *userdb.SQLiteStore
-	adminUser    string
-	adminPass    string
-	adminTmpl    *template.Template
-	passwordTmpl *template.Template
-	homeTmpl     *template.Template
-	logger       *log.Logger
+	store             userdb.Store
+	adminUser         string
+	adminPass         string
+	adminTmpl         *template.Template
+	passwordTmpl      *template.Template
+	homeTmpl          *template.Template
+	loginTmpl         *template.Template
+	factorTmpl        *template.Template
+	totpTmpl          *template.Template
+	auditTmpl         *template.Template
+	editUserTmpl      *template.Template
+	registrationsTmpl *template.Template
+	portalLoginTmpl   *template.Template
+	portalTmpl        *template.Template
+	broadcastTmpl     *template.Template
+	tokensTmpl        *template.Template
+	shortNumbersTmpl  *template.Template
+	catalogs          map[string]map[string]string
+	sessions          *sessionStore
+	totp              *totpGuard
+	apiToken          string
+	registrations     RegistrationSource
+	calls             CallSource
+	tracer            TraceSource
+	reload            func(context.Context) error
+	streams           context.Context
+	closeStreams      context.CancelFunc
+	metrics           *httpMetrics
+	logger            *slog.Logger
 }
 
 // New constructs a Server using the provided configuration.
@@ -38,40 +75,124 @@ func New(cfg Config) (*Server, error) {
 	}
 	logger := cfg.Logger
 	if logger == nil {
-		logger = log.Default()
+		logger = slog.Default()
 	}
 
-	adminTmpl, err := template.New("admin").Parse(adminTemplate)
+	catalogs, err := loadCatalogs(cfg.TemplateDir)
 	if err != nil {
-		return nil, fmt.Errorf("userweb: parse admin template: %w", err)
+		return nil, err
 	}
-	passwordTmpl, err := template.New("password").Parse(passwordTemplate)
-	if err != nil {
-		return nil, fmt.Errorf("userweb: parse password template: %w", err)
+	s := &Server{
+		store:         cfg.Store,
+		adminUser:     cfg.AdminUser,
+		adminPass:     cfg.AdminPass,
+		catalogs:      catalogs,
+		sessions:      newSessionStore(),
+		totp:          newTOTPGuard(),
+		apiToken:      strings.TrimSpace(cfg.APIToken),
+		registrations: cfg.Registrations,
+		calls:         cfg.Calls,
+		tracer:        cfg.Tracer,
+		reload:        cfg.Reload,
+		metrics:       newHTTPMetrics(cfg.Metrics),
+		logger:        logger,
 	}
-	homeTmpl, err := template.New("home").Parse(homeTemplate)
-	if err != nil {
-		return nil, fmt.Errorf("userweb: parse home template: %w", err)
+	for _, page := range []struct {
+		name string
+		text string
+		dest **template.Template
+	}{
+		{"admin", adminTemplate, &s.adminTmpl},
+		{"password", passwordTemplate, &s.passwordTmpl},
+		{"home", homeTemplate, &s.homeTmpl},
+		{"login", loginTemplate, &s.loginTmpl},
+		{"second-factor", secondFactorTemplate, &s.factorTmpl},
+		{"totp", totpTemplate, &s.totpTmpl},
+		{"audit", auditTemplate, &s.auditTmpl},
+		{"edit-user", editUserTemplate, &s.editUserTmpl},
+		{"registrations", registrationsTemplate, &s.registrationsTmpl},
+		{"portal-login", portalLoginTemplate, &s.portalLoginTmpl},
+		{"portal", portalTemplate, &s.portalTmpl},
+		{"broadcast", broadcastTemplate, &s.broadcastTmpl},
+		{"api-tokens", tokensTemplate, &s.tokensTmpl},
+		{"short-numbers", shortNumbersTemplate, &s.shortNumbersTmpl},
+	} {
+		tmpl, err := loadTemplate(cfg.TemplateDir, page.name, page.text)
+		if err != nil {
+			return nil, err
+		}
+		*page.dest = tmpl
 	}
-
-	return &Server{
-		store:        cfg.Store,
-		adminUser:    cfg.AdminUser,
-		adminPass:    cfg.AdminPass,
-		adminTmpl:    adminTmpl,
-		passwordTmpl: passwordTmpl,
-		homeTmpl:     homeTmpl,
-		logger:       logger,
-	}, nil
+	s.streams, s.closeStreams = context.WithCancel(context.Background())
+	return s, nil
 }
 
-// Handler returns an http.Handler wiring the user web routes.
+// Handler returns an http.Handler wiring the user web routes: the admin
+// pages and JSON API together with the self-service portal.
 func (s *Server) Handler() http.Handler {
+	return s.routes(true, true)
+}
+
+// AdminHandler serves only the admin pages, their login, and the JSON API,
+// for a listener kept apart from the portal, such as one bound to localhost.
+// The root redirects to the user list.
+func (s *Server) AdminHandler() http.Handler {
+	return s.routes(true, false)
+}
+
+// PortalHandler serves only the self-service portal for SIP users. The root
+// redirects to the portal.
+func (s *Server) PortalHandler() http.Handler {
+	return s.routes(false, true)
+}
+
+// routes wires the admin routes, the portal routes, or both.
+func (s *Server) routes(admin, portal bool) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.handleHome)
-	mux.HandleFunc("/admin/users", s.basicAuth(s.handleAdminUsers))
-	mux.HandleFunc("/password", s.handlePassword)
-	return mux
+	switch {
+	case admin && portal:
+		mux.HandleFunc("/", s.handleHome)
+	case admin:
+		mux.Handle("/", redirectRoot("/admin/users"))
+	default:
+		mux.Handle("/", redirectRoot("/portal"))
+	}
+	mux.HandleFunc("/static/confirm.js", s.handleConfirmScript)
+	if admin {
+		mux.HandleFunc("/admin/users", s.requireAdmin(userdb.RoleReadOnly, s.handleAdminUsers))
+		mux.HandleFunc("/admin/users/edit", s.requireAdmin(userdb.RoleHelpdesk, s.handleEditUser))
+		mux.HandleFunc("/admin/users/export", s.requireAdmin(userdb.RoleSuperadmin, s.handleExportUsers))
+		mux.HandleFunc("/admin/broadcast", s.requireAdmin(userdb.RoleSuperadmin, s.handleBroadcastEditor))
+		mux.HandleFunc("/admin/registrations", s.requireAdmin(userdb.RoleReadOnly, s.handleRegistrations))
+		mux.HandleFunc("/admin/totp", s.requireAdmin(userdb.RoleReadOnly, s.handleTOTP))
+		mux.HandleFunc("/admin/audit", s.requireAdmin(userdb.RoleSuperadmin, s.handleAudit))
+		mux.HandleFunc("/admin/tokens", s.requireAdmin(userdb.RoleSuperadmin, s.handleAPITokens))
+		mux.HandleFunc("/admin/short-numbers", s.requireAdmin(userdb.RoleSuperadmin, s.handleShortNumbers))
+		mux.HandleFunc("/login", s.handleLogin)
+		mux.HandleFunc("/login/totp", s.handleSecondFactor)
+		mux.HandleFunc("/logout", s.handleLogout)
+		s.registerAPI(mux)
+	}
+	if portal {
+		mux.HandleFunc("/portal", s.requirePortal(s.handlePortal))
+		mux.HandleFunc("/portal/login", s.handlePortalLogin)
+		mux.HandleFunc("/portal/password", s.requirePortal(s.handlePortalPassword))
+		// The password form used to be open to anyone at /password.
+		mux.Handle("/password", http.RedirectHandler("/portal/password", http.StatusMovedPermanently))
+	}
+	return s.metrics.instrument(withSecurityHeaders(s.withLanguage(mux)))
+}
+
+// redirectRoot redirects the root to target and answers any other path not
+// routed elsewhere with 404.
+func redirectRoot(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+	})
 }
 
 func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
@@ -79,24 +200,122 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if err := s.homeTmpl.Execute(w, nil); err != nil {
-		s.logger.Printf("render home: %v", err)
-	}
+	s.render(w, r, s.homeTmpl, nil)
+}
+
+type loginTemplateData struct {
+	CSRFToken string
+	Next      string
+	Error     string
 }
 
-func (s *Server) basicAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || !s.authorisedAdmin(user, pass) {
-			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
-			http.Error(w, "unauthorised", http.StatusUnauthorized)
+// handleLogin shows the admin login form and, on success, replaces the
+// anonymous session with an authenticated one, or with a pending one when the
+// account still has to present a TOTP code.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := loginTemplateData{Next: safeRedirect(r.URL.Query().Get("next"))}
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		data.Next = safeRedirect(r.FormValue("next"))
+		sess := s.currentSession(r)
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度ログインしてください")
+			break
+		}
+		user := strings.TrimSpace(r.FormValue("username"))
+		account, ok := s.authenticateAdmin(r, user, r.FormValue("password"))
+		if !ok {
+			s.logger.Warn("failed admin login", "user", user, "remote", r.RemoteAddr)
+			data.Error = s.tr(r, "ユーザ名またはパスワードが正しくありません")
+			break
+		}
+		s.sessions.delete(sess.id)
+		if account != nil && account.TOTPSecret != "" {
+			if _, err := s.startSession(w, r, session{pendingUser: user}); err != nil {
+				http.Error(w, "failed to start session", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/login/totp?next="+url.QueryEscape(data.Next), http.StatusSeeOther)
 			return
 		}
-		next(w, r)
+		if _, err := s.startSession(w, r, session{user: user, builtin: account == nil}); err != nil {
+			http.Error(w, "failed to start session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, data.Next, http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess, err := s.ensureSession(w, r)
+	if err != nil {
+		http.Error(w, "failed to start session", http.StatusInternalServerError)
+		return
+	}
+	data.CSRFToken = sess.csrfToken
+	s.render(w, r, s.loginTmpl, data)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	sess := s.currentSession(r)
+	if sess == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
+	if !validCSRF(r, sess) {
+		http.Error(w, "invalid CSRF token", http.StatusForbidden)
+		return
+	}
+	s.endSession(w, r, sess)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// safeRedirect keeps post-login redirects on this site, falling back to the
+// admin page.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin/users"
+	}
+	return next
+}
+
+// authenticateAdmin checks a login against the admin accounts in the store
+// and then against the bootstrap credentials from the command line. It
+// returns the matching stored account, or nil when the bootstrap credentials
+// matched. An account in the store shadows a bootstrap admin of the same name.
+func (s *Server) authenticateAdmin(r *http.Request, user, pass string) (*userdb.AdminAccount, bool) {
+	account, err := s.store.AdminAccount(r.Context(), user)
+	switch {
+	case err == nil:
+		return account, userdb.VerifyAdminPassword(account.PasswordHash, pass)
+	case !errors.Is(err, userdb.ErrAdminNotFound):
+		// Keep the bootstrap admin usable when the store cannot be read.
+		s.logger.Error("lookup admin account", "user", user, "error", err)
+	}
+	return nil, s.authorisedAdmin(user, pass)
+}
+
+// authorisedAdmin checks the bootstrap admin credentials. Without configured
+// credentials, as when only the API is enabled, nobody is a bootstrap admin.
 func (s *Server) authorisedAdmin(user, pass string) bool {
+	if s.adminUser == "" || s.adminPass == "" {
+		return false
+	}
 	return subtleCompare(user, s.adminUser) && subtleCompare(pass, s.adminPass)
 }
 
@@ -112,32 +331,70 @@ func subtleCompare(a, b string) bool {
 }
 
 type adminTemplateData struct {
+	CSRFToken      string
+	AdminUser      string
+	Role           userdb.AdminRole
+	CanEditUsers   bool
+	CanManage      bool
 	Users          []userdb.User
+	UserList       userListView
 	BroadcastRules []userdb.BroadcastRule
+	AdminAccounts  []userdb.AdminAccount
+	AdminRoles     []userdb.AdminRole
 	Message        string
 	Error          string
 }
 
-func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+// actionRoles maps each admin form action onto the least role allowed to
+// perform it. Viewing needs only RoleReadOnly.
+var actionRoles = map[string]userdb.AdminRole{
+	"create":           userdb.RoleHelpdesk,
+	"enable":           userdb.RoleHelpdesk,
+	"disable":          userdb.RoleHelpdesk,
+	"delete":           userdb.RoleSuperadmin,
+	"import":           userdb.RoleSuperadmin,
+	"admin-create":     userdb.RoleSuperadmin,
+	"admin-update":     userdb.RoleSuperadmin,
+	"admin-delete":     userdb.RoleSuperadmin,
+	"admin-reset-totp": userdb.RoleSuperadmin,
+}
+
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
 	ctx := r.Context()
-	data := adminTemplateData{}
+	data := adminTemplateData{
+		CSRFToken:    sess.csrfToken,
+		AdminUser:    sess.user,
+		Role:         role,
+		CanEditUsers: role.Allows(userdb.RoleHelpdesk),
+		CanManage:    role.Allows(userdb.RoleSuperadmin),
+		AdminRoles:   userdb.AdminRoles,
+	}
 
 	switch r.Method {
 	case http.MethodGet:
 		// no-op, fall through to listing
 	case http.MethodPost:
-		if err := r.ParseForm(); err != nil {
-			data.Error = fmt.Sprintf("フォームの解析に失敗しました: %v", err)
+		if err := parseAdminForm(w, r); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
 			break
 		}
 		action := r.FormValue("action")
+		if required, ok := actionRoles[action]; ok && !role.Allows(required) {
+			s.logger.Warn("admin denied action", "user", sess.user, "role", role, "action", action, "remote", r.RemoteAddr)
+			data.Error = s.tr(r, "この操作を行う権限がありません")
+			break
+		}
 		switch action {
 		case "create":
 			username := strings.TrimSpace(r.FormValue("username"))
 			domain := strings.TrimSpace(r.FormValue("domain"))
 			contact := strings.TrimSpace(r.FormValue("contact"))
 			if username == "" || domain == "" {
-				data.Error = "ユーザ名とドメインを入力してください"
+				data.Error = s.tr(r, "ユーザ名とドメインを入力してください")
 				break
 			}
 			password := r.FormValue("password")
@@ -145,225 +402,256 @@ func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
 			if password != "" {
 				hash = userdb.HashPassword(username, domain, password)
 			}
-			err := s.store.CreateUser(ctx, userdb.User{
+			user := userdb.User{
 				Username:     username,
 				Domain:       domain,
 				PasswordHash: hash,
 				ContactURI:   contact,
-			})
-			if err != nil {
-				data.Error = fmt.Sprintf("ユーザ作成に失敗しました: %v", err)
+			}
+			err := s.store.CreateUser(ctx, user)
+			if errors.Is(err, userdb.ErrUserExists) {
+				data.Error = s.tr(r, "ユーザ %s@%s は既に登録されています", username, domain)
+			} else if err != nil {
+				data.Error = s.tr(r, "ユーザ作成に失敗しました: %v", err)
 			} else {
-				data.Message = fmt.Sprintf("ユーザ %s@%s を登録ました", username, domain)
+				s.audit(r, sess.user, "user.create", username+"@"+domain, nil, toAPIUser(user))
+				data.Message = s.tr(r, "ユーザ %s@%s を登録ました", username, domain)
 			}
 		case "delete":
 			username := strings.TrimSpace(r.FormValue("username"))
 			domain := strings.TrimSpace(r.FormValue("domain"))
 			if username == "" || domain == "" {
-				data.Error = "ユーザ名とドメインを入力してください"
+				data.Error = s.tr(r, "ユーザ名とドメインを入力してください")
 				break
 			}
+			before := s.userSnapshot(r, username, domain)
 			if err := s.store.DeleteUser(ctx, username, domain); err != nil {
-				data.Error = fmt.Sprintf("ユーザ削除に失敗しました: %v", err)
+				data.Error = s.tr(r, "ユーザ削除に失敗しました: %v", err)
+			} else {
+				s.audit(r, sess.user, "user.delete", username+"@"+domain, before, nil)
+				data.Message = s.tr(r, "ユーザ %s@%s を削除しました", username, domain)
+			}
+		case "enable", "disable":
+			username := strings.TrimSpace(r.FormValue("username"))
+			domain := strings.TrimSpace(r.FormValue("domain"))
+			if username == "" || domain == "" {
+				data.Error = s.tr(r, "ユーザ名とドメインを入力してください")
+				break
+			}
+			enabled := action == "enable"
+			before := s.userSnapshot(r, username, domain)
+			if err := s.store.SetUserEnabled(ctx, username, domain, enabled); err != nil {
+				data.Error = s.tr(r, "ユーザ状態の変更に失敗しました: %v", err)
+				break
+			}
+			s.audit(r, sess.user, "user."+action, username+"@"+domain, before, s.userSnapshot(r, username, domain))
+			if enabled {
+				data.Message = s.tr(r, "ユーザ %s@%s を有効化しました", username, domain)
 			} else {
-				data.Message = fmt.Sprintf("ユーザ %s@%s を削除しました", username, domain)
+				data.Message = s.tr(r, "ユーザ %s@%s を停止しました", username, domain)
 			}
-		case "broadcast-create":
-			address := strings.TrimSpace(r.FormValue("broadcast_address"))
-			description := strings.TrimSpace(r.FormValue("broadcast_description"))
-			targets := parseBroadcastTargets(r.FormValue("broadcast_targets"))
-			if address == "" {
-				data.Error = "ブロードキャスト対象アドレスを入力してください"
+		case "import":
+			file, _, err := r.FormFile("csv")
+			if err != nil {
+				data.Error = s.tr(r, "CSVファイルの読み込みに失敗しました: %v", err)
 				break
 			}
-			_, err := s.store.CreateBroadcastRule(ctx, userdb.BroadcastRule{
-				Address:     address,
-				Description: description,
-				Targets:     targets,
-			})
+			result, err := userdb.ImportUsers(ctx, s.store, file)
+			file.Close()
+			if result.Created+result.Updated > 0 {
+				s.audit(r, sess.user, "user.import", "csv", nil, result)
+			}
 			if err != nil {
-				data.Error = fmt.Sprintf("ブロードキャストルールの作成に失敗しました: %v", err)
+				data.Error = s.tr(r, "CSVインポートに失敗しました (新規 %d 件、更新 %d 件を反映済み): %v", result.Created, result.Updated, err)
 			} else {
-				data.Message = fmt.Sprintf("%s のブロードキャストルールを作成しました", address)
+				data.Message = s.tr(r, "CSVインポートが完了しました (新規 %d 件、更新 %d 件)", result.Created, result.Updated)
+			}
+		case "admin-create":
+			username := strings.TrimSpace(r.FormValue("admin_username"))
+			password := r.FormValue("admin_password")
+			newRole, err := userdb.ParseAdminRole(r.FormValue("admin_role"))
+			if username == "" || password == "" {
+				data.Error = s.tr(r, "管理者名とパスワードを入力してください")
+				break
 			}
-		case "broadcast-update":
-			idStr := strings.TrimSpace(r.FormValue("broadcast_id"))
-			id, err := strconv.ParseInt(idStr, 10, 64)
-			if err != nil || id <= 0 {
-				data.Error = "更新対象のルールIDが正しくありません"
+			if err != nil {
+				data.Error = s.tr(r, "権限の指定が正しくありません")
 				break
 			}
-			address := strings.TrimSpace(r.FormValue("broadcast_address"))
-			description := strings.TrimSpace(r.FormValue("broadcast_description"))
-			targets := parseBroadcastTargets(r.FormValue("broadcast_targets"))
-			if address == "" {
-				data.Error = "ブロードキャスト対象アドレスを入力してください"
+			hash, err := userdb.HashAdminPassword(password)
+			if err != nil {
+				data.Error = s.tr(r, "管理者の作成に失敗しました: %v", err)
 				break
 			}
-			update := userdb.BroadcastRule{ID: id, Address: address, Description: description}
-			if err := s.store.UpdateBroadcastRule(ctx, update); err != nil {
-				data.Error = fmt.Sprintf("ブロードキャストルールの更新に失敗しました: %v", err)
+			account := userdb.AdminAccount{Username: username, PasswordHash: hash, Role: newRole}
+			err = s.store.CreateAdminAccount(ctx, account)
+			if errors.Is(err, userdb.ErrAdminExists) {
+				data.Error = s.tr(r, "管理者 %s は既に登録されています", username)
+			} else if err != nil {
+				data.Error = s.tr(r, "管理者の作成に失敗しました: %v", err)
+			} else {
+				s.audit(r, sess.user, "admin.create", username, nil, toAuditAdmin(account))
+				data.Message = s.tr(r, "管理者 %s を作成しました", username)
+			}
+		case "admin-update":
+			username := strings.TrimSpace(r.FormValue("admin_username"))
+			newRole, err := userdb.ParseAdminRole(r.FormValue("admin_role"))
+			if username == "" {
+				data.Error = s.tr(r, "管理者名を入力してください")
+				break
+			}
+			if err != nil {
+				data.Error = s.tr(r, "権限の指定が正しくありません")
+				break
+			}
+			if username == sess.user && !sess.builtin && newRole != userdb.RoleSuperadmin {
+				data.Error = s.tr(r, "自分自身の権限は下げられません")
+				break
+			}
+			update := userdb.AdminAccount{Username: username, Role: newRole}
+			if password := r.FormValue("admin_password"); password != "" {
+				if update.PasswordHash, err = userdb.HashAdminPassword(password); err != nil {
+					data.Error = s.tr(r, "管理者の更新に失敗しました: %v", err)
+					break
+				}
+			}
+			before := s.adminSnapshot(r, username)
+			if err := s.store.UpdateAdminAccount(ctx, update); err != nil {
+				data.Error = s.tr(r, "管理者の更新に失敗しました: %v", err)
+			} else {
+				action := "admin.update"
+				if update.PasswordHash != "" {
+					action = "admin.update-password"
+				}
+				s.audit(r, sess.user, action, username, before, s.adminSnapshot(r, username))
+				data.Message = s.tr(r, "管理者 %s を更新しました", username)
+			}
+		case "admin-delete":
+			username := strings.TrimSpace(r.FormValue("admin_username"))
+			if username == "" {
+				data.Error = s.tr(r, "管理者名を入力してください")
 				break
 			}
-			if err := s.store.ReplaceBroadcastTargets(ctx, id, targets); err != nil {
-				data.Error = fmt.Sprintf("宛先URIの更新に失敗しました: %v", err)
+			if username == sess.user && !sess.builtin {
+				data.Error = s.tr(r, "自分自身は削除できません")
 				break
 			}
-			data.Message = fmt.Sprintf("ルールID %d を更新しました", id)
-		case "broadcast-delete":
-			idStr := strings.TrimSpace(r.FormValue("broadcast_id"))
-			id, err := strconv.ParseInt(idStr, 10, 64)
-			if err != nil || id <= 0 {
-				data.Error = "削除対象のルールIDが正しくありません"
+			before := s.adminSnapshot(r, username)
+			if err := s.store.DeleteAdminAccount(ctx, username); err != nil {
+				data.Error = s.tr(r, "管理者の削除に失敗しました: %v", err)
+			} else {
+				s.audit(r, sess.user, "admin.delete", username, before, nil)
+				data.Message = s.tr(r, "管理者 %s を削除しました", username)
+			}
+		case "admin-reset-totp":
+			// For an admin who lost their authenticator; they can enroll
+			// again after logging in with the password alone.
+			username := strings.TrimSpace(r.FormValue("admin_username"))
+			if username == "" {
+				data.Error = s.tr(r, "管理者名を入力してください")
 				break
 			}
-			if err := s.store.DeleteBroadcastRule(ctx, id); err != nil {
-				data.Error = fmt.Sprintf("ブロードキャストルールの削除に失敗しました: %v", err)
+			before := s.adminSnapshot(r, username)
+			if err := s.store.SetAdminTOTP(ctx, username, "", nil); err != nil {
+				data.Error = s.tr(r, "二要素認証の解除に失敗しました: %v", err)
 			} else {
-				data.Message = fmt.Sprintf("ルールID %d を削除しました", id)
+				s.audit(r, sess.user, "admin.totp-reset", username, before, s.adminSnapshot(r, username))
+				data.Message = s.tr(r, "管理者 %s の二要素認証を解除しました", username)
 			}
 		default:
-			data.Error = "不明な操作が指定されました"
+			data.Error = s.tr(r, "不明な操作が指定されました")
 		}
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	users, err := s.store.AllUsers(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to list users: %v", err), http.StatusInternalServerError)
+	s.renderAdmin(w, r, data)
+}
+
+// maxImportSize bounds the CSV accepted by the bulk import form.
+const maxImportSize = 10 << 20
+
+func (s *Server) handleExportUsers(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	sort.Slice(users, func(i, j int) bool {
-		if users[i].Domain == users[j].Domain {
-			return users[i].Username < users[j].Username
-		}
-		return users[i].Domain < users[j].Domain
-	})
-	data.Users = users
-
-	rules, err := s.store.ListBroadcastRules(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to list broadcast rules: %v", err), http.StatusInternalServerError)
+	var buf bytes.Buffer
+	if err := userdb.ExportUsers(r.Context(), s.store, &buf); err != nil {
+		http.Error(w, fmt.Sprintf("failed to export users: %v", err), http.StatusInternalServerError)
 		return
 	}
-	data.BroadcastRules = rules
-
-	if err := s.adminTmpl.Execute(w, data); err != nil {
-		s.logger.Printf("render admin: %v", err)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		s.logger.Error("write user export", "error", err)
 	}
 }
 
-type passwordTemplateData struct {
-	Message string
-	Error   string
+// parseAdminForm parses url-encoded forms and the multipart form used for CSV
+// uploads, capping uploads at maxImportSize.
+func parseAdminForm(w http.ResponseWriter, r *http.Request) error {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		return r.ParseMultipartForm(maxImportSize)
+	}
+	return r.ParseForm()
 }
 
-func (s *Server) handlePassword(w http.ResponseWriter, r *http.Request) {
-	data := passwordTemplateData{}
-	switch r.Method {
-	case http.MethodGet:
-		// nothing to do
-	case http.MethodPost:
-		if err := r.ParseForm(); err != nil {
-			data.Error = fmt.Sprintf("フォームの解析に失敗しました: %v", err)
-			break
-		}
-		username := strings.TrimSpace(r.FormValue("username"))
-		domain := strings.TrimSpace(r.FormValue("domain"))
-		current := r.FormValue("current_password")
-		newPassword := r.FormValue("new_password")
-		confirm := r.FormValue("confirm_password")
-
-		if username == "" || domain == "" {
-			data.Error = "ユーザ名とドメインを入力してください"
-			break
-		}
-		if newPassword == "" {
-			data.Error = "新しいパスワードを入力してください"
-			break
-		}
-		if newPassword != confirm {
-			data.Error = "新しいパスワードが確認と一致しません"
-			break
-		}
-
-		ctx := r.Context()
-		user, err := s.store.Lookup(ctx, username, domain)
-		if err != nil {
-			data.Error = fmt.Sprintf("ユーザ情報の取得に失敗しました: %v", err)
-			break
-		}
-
-		if user.PasswordHash != "" && !userdb.VerifyPassword(user.PasswordHash, username, domain, current) {
-			data.Error = "現在のパスワードが正しくありません"
-			break
-		}
-
-		hash := userdb.HashPassword(username, domain, newPassword)
-		if err := s.store.UpdatePassword(ctx, username, domain, hash); err != nil {
-			data.Error = fmt.Sprintf("パスワードの更新に失敗しました: %v", err)
-			break
-		}
-		data.Message = "パスワードを更新しました"
-	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+func (s *Server) renderAdmin(w http.ResponseWriter, r *http.Request, data adminTemplateData) {
+	ctx := r.Context()
+	list := parseUserList(r.URL.Query())
+	page, err := s.store.QueryUsers(ctx, list.query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list users: %v", err), http.StatusInternalServerError)
 		return
 	}
+	data.Users = page.Users
+	data.UserList = list.view(page.Total)
 
-	if err := s.passwordTmpl.Execute(w, data); err != nil {
-		s.logger.Printf("render password: %v", err)
+	rules, err := s.store.ListBroadcastRules(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list broadcast rules: %v", err), http.StatusInternalServerError)
+		return
 	}
-}
+	data.BroadcastRules = rules
 
-func parseBroadcastTargets(raw string) []userdb.BroadcastTarget {
-	var targets []userdb.BroadcastTarget
-	if strings.TrimSpace(raw) == "" {
-		return targets
-	}
-	parts := strings.FieldsFunc(raw, func(r rune) bool {
-		switch r {
-		case '\n', '\r', ',', ';':
-			return true
-		default:
-			return false
-		}
-	})
-	order := 0
-	for _, part := range parts {
-		contact := strings.TrimSpace(part)
-		if contact == "" {
-			continue
+	if data.CanManage {
+		accounts, err := s.store.ListAdminAccounts(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list admin accounts: %v", err), http.StatusInternalServerError)
+			return
 		}
-		targets = append(targets, userdb.BroadcastTarget{ContactURI: contact, Priority: order})
-		order++
+		data.AdminAccounts = accounts
 	}
-	return targets
+
+	s.render(w, r, s.adminTmpl, data)
 }
 
 const homeTemplate = `<!DOCTYPE html>
-<html lang="ja">
+<html lang="{{lang}}">
 <head>
         <meta charset="UTF-8">
-        <title>ユーザ管理</title>
+        <title>{{t "ユーザ管理"}}</title>
         <style>
                 body { font-family: sans-serif; margin: 2rem; }
                 a { display: block; margin-bottom: 1rem; }
         </style>
 </head>
 <body>
-        <h1>ユーザ管理ポータル</h1>
-        <a href="/admin/users">管理者: ユーザ一覧/登録/削除</a>
-        <a href="/password">利用者: パスワード変更</a>
+        {{template "languages"}}
+        <h1>{{t "ユーザ管理ポータル"}}</h1>
+        <a href="/admin/users">{{t "管理者: ユーザ一覧/登録/削除"}}</a>
+        <a href="/portal">{{t "利用者: 登録状況/着信設定/通話履歴/パスワード変更"}}</a>
 </body>
 </html>`
 
 const adminTemplate = `<!DOCTYPE html>
-<html lang="ja">
+<html lang="{{lang}}">
 <head>
         <meta charset="UTF-8">
-        <title>管理者 - ユーザ管理</title>
+        <title>{{t "管理者 - ユーザ管理"}}</title>
         <style>
                 body { font-family: sans-serif; margin: 2rem; }
                 table { border-collapse: collapse; margin-top: 1rem; width: 100%; max-width: 800px; }
@@ -371,53 +659,109 @@ const adminTemplate = `<!DOCTYPE html>
                 form { margin-top: 1rem; }
                 .message { color: green; }
                 .error { color: red; }
+                tr.disabled td { color: #999; background: #f4f4f4; }
+                .badge { font-size: 0.8rem; padding: 0.1rem 0.4rem; border-radius: 0.2rem; }
+                .badge-disabled { background: #c0392b; color: #fff; }
+                td form { margin: 0; }
         </style>
 </head>
 <body>
-        <h1>管理者 - ユーザ管理</h1>
+        {{template "languages"}}
+        <h1>{{t "管理者 - ユーザ管理"}}</h1>
+        <form method="post" action="/logout" class="logout">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                {{t "%s (%s) としてログイン中" .AdminUser .Role}} <button type="submit">{{t "ログアウト"}}</button>
+        </form>
+        <p><a href="/admin/registrations">{{t "登録状況"}}</a> | <a href="/admin/totp">{{t "二要素認証の設定"}}</a>{{if .CanManage}} | <a href="/admin/audit">{{t "監査ログ"}}</a> | <a href="/admin/tokens">{{t "APIトークン"}}</a> | <a href="/admin/short-numbers">{{t "短縮番号"}}</a>{{end}}</p>
         {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
         {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
 
-        <h2>登録ユーザ一覧</h2>
+        <h2>{{t "登録ユーザ一覧"}}</h2>
+        <form method="get" action="/admin/users">
+                <input type="hidden" name="sort" value="{{.UserList.Sort}}">
+                {{if .UserList.Descending}}<input type="hidden" name="dir" value="desc">{{end}}
+                <label>{{t "検索:"}} <input type="search" name="q" value="{{.UserList.Search}}" placeholder="{{t "ユーザ名・ドメイン・Contact URI"}}"></label>
+                <button type="submit">{{t "検索"}}</button>
+                {{if .UserList.Search}}<a href="{{.UserList.ClearLink}}">{{t "検索を解除"}}</a>{{end}}
+        </form>
+        <p>{{t "%d 件中 %d〜%d 件目 (%d/%d ページ)" .UserList.Total .UserList.First .UserList.Last .UserList.Page .UserList.Pages}}</p>
         <table>
                 <thead>
-                        <tr><th>ユーザ名</th><th>ドメイン</th><th>Contact URI</th></tr>
+                        <tr>{{range .UserList.Columns}}<th><a href="{{.Link}}">{{t .Label}}</a>{{.Arrow}}</th>{{end}}</tr>
                 </thead>
                 <tbody>
                         {{range .Users}}
-                        <tr>
-                                <td>{{.Username}}</td>
+                        <tr{{if .Disabled}} class="disabled"{{end}}>
+                                <td>{{.Username}}{{if .Disabled}} <span class="badge badge-disabled">{{t "停止中"}}</span>{{end}}</td>
                                 <td>{{.Domain}}</td>
                                 <td>{{.ContactURI}}</td>
+                                <td>
+                                        {{if $.CanEditUsers}}
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="username" value="{{.Username}}">
+                                                <input type="hidden" name="domain" value="{{.Domain}}">
+                                                {{if .Disabled}}
+                                                <input type="hidden" name="action" value="enable">
+                                                <button type="submit">{{t "有効化"}}</button>
+                                                {{else}}
+                                                <input type="hidden" name="action" value="disable">
+                                                <button type="submit">{{t "停止"}}</button>
+                                                {{end}}
+                                        </form>
+                                        <a href="/admin/users/edit?username={{.Username}}&domain={{.Domain}}">{{t "編集"}}</a>
+                                        {{else if .Disabled}}{{t "停止中"}}{{else}}{{t "有効"}}{{end}}
+                                </td>
                         </tr>
                         {{else}}
-                        <tr><td colspan="3">登録されたユーザはいません</td></tr>
+                        <tr><td colspan="4">{{if .UserList.Search}}{{t "該当するユーザはいません"}}{{else}}{{t "登録されたユーザはいません"}}{{end}}</td></tr>
                         {{end}}
                 </tbody>
         </table>
+        <p>
+                {{if .UserList.PrevLink}}<a href="{{.UserList.PrevLink}}">{{t "前のページ"}}</a>{{end}}
+                {{if .UserList.NextLink}}<a href="{{.UserList.NextLink}}">{{t "次のページ"}}</a>{{end}}
+        </p>
 
-        <h2>新規ユーザ登録</h2>
+        {{if .CanEditUsers}}
+        <h2>{{t "新規ユーザ登録"}}</h2>
         <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
                 <input type="hidden" name="action" value="create">
-                <label>ユーザ名: <input type="text" name="username" required></label><br>
-                <label>ドメイン: <input type="text" name="domain" required></label><br>
-                <label>初期パスワード (任意): <input type="password" name="password"></label><br>
-                <label>Contact URI (任意): <input type="text" name="contact"></label><br>
-                <button type="submit">登録</button>
+                <label>{{t "ユーザ名:"}} <input type="text" name="username" required></label><br>
+                <label>{{t "ドメイン:"}} <input type="text" name="domain" required></label><br>
+                <label>{{t "初期パスワード (任意):"}} <input type="password" name="password"></label><br>
+                <label>{{t "Contact URI (任意):"}} <input type="text" name="contact"></label><br>
+                <button type="submit">{{t "登録"}}</button>
+        </form>
+        {{end}}
+
+        {{if .CanManage}}
+        <h2>{{t "CSV一括登録・出力"}}</h2>
+        <p>{{t "列: username, domain, password または password_hash, contact_uri, enabled (1行目はヘッダ)"}}</p>
+        <form method="post" enctype="multipart/form-data">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="action" value="import">
+                <label>{{t "CSVファイル:"}} <input type="file" name="csv" accept=".csv,text/csv" required></label>
+                <button type="submit">{{t "インポート"}}</button>
         </form>
+        <p><a href="/admin/users/export">{{t "ユーザ一覧をCSVでダウンロード"}}</a></p>
 
-        <h2>ユーザ削除</h2>
+        <h2>{{t "ユーザ削除"}}</h2>
         <form method="post">
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
                 <input type="hidden" name="action" value="delete">
-                <label>ユーザ名: <input type="text" name="username" required></label><br>
-                <label>ドメイン: <input type="text" name="domain" required></label><br>
-                <button type="submit">削除</button>
+                <label>{{t "ユーザ名:"}} <input type="text" name="username" required></label><br>
+                <label>{{t "ドメイン:"}} <input type="text" name="domain" required></label><br>
+                <button type="submit">{{t "削除"}}</button>
         </form>
+        {{end}}
 
-        <h2>ブロードキャストルール</h2>
+        <h2>{{t "ブロードキャストルール"}}</h2>
+        {{if .CanManage}}<p><a href="/admin/broadcast">{{t "ルールを追加"}}</a></p>{{end}}
         <table>
                 <thead>
-                        <tr><th>ID</th><th>Address</th><th>Description</th><th>Targets</th></tr>
+                        <tr><th>ID</th><th>Address</th><th>Description</th><th>{{t "Targets (優先順)"}}</th>{{if .CanManage}}<th>{{t "操作"}}</th>{{end}}</tr>
                 </thead>
                 <tbody>
                         {{range .BroadcastRules}}
@@ -429,49 +773,111 @@ const adminTemplate = `<!DOCTYPE html>
                                         {{range .Targets}}
                                         <div>{{.ContactURI}}</div>
                                         {{else}}
-                                        <div>(なし)</div>
+                                        <div>{{t "(なし)"}}</div>
                                         {{end}}
                                 </td>
+                                {{if $.CanManage}}<td><a href="/admin/broadcast?id={{.ID}}">{{t "編集"}}</a></td>{{end}}
                         </tr>
                         {{else}}
-                        <tr><td colspan="4">登録されたルールはありません</td></tr>
+                        <tr><td colspan="5">{{t "登録されたルールはありません"}}</td></tr>
                         {{end}}
                 </tbody>
         </table>
 
-        <h2>ブロードキャストルール作成</h2>
-        <form method="post">
-                <input type="hidden" name="action" value="broadcast-create">
-                <label>Address: <input type="text" name="broadcast_address" required></label><br>
-                <label>Description: <input type="text" name="broadcast_description"></label><br>
-                <label>Targets (改行・カンマ区切り):<br><textarea name="broadcast_targets" rows="4" cols="40"></textarea></label><br>
-                <button type="submit">作成</button>
-        </form>
+        {{if .CanManage}}
+        <h2>{{t "管理者アカウント"}}</h2>
+        <table>
+                <thead>
+                        <tr><th>{{t "管理者名"}}</th><th>{{t "権限"}}</th><th>{{t "二要素認証"}}</th><th>{{t "操作"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .AdminAccounts}}
+                        <tr>
+                                <td>{{.Username}}</td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="admin-update">
+                                                <input type="hidden" name="admin_username" value="{{.Username}}">
+                                                <select name="admin_role">
+                                                        {{$current := .Role}}
+                                                        {{range $.AdminRoles}}<option value="{{.}}"{{if eq . $current}} selected{{end}}>{{.}}</option>{{end}}
+                                                </select>
+                                                <input type="password" name="admin_password" placeholder="{{t "新しいパスワード (任意)"}}">
+                                                <button type="submit">{{t "更新"}}</button>
+                                        </form>
+                                </td>
+                                <td>
+                                        {{if .TOTPSecret}}
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="admin-reset-totp">
+                                                <input type="hidden" name="admin_username" value="{{.Username}}">
+                                                {{t "有効"}} <button type="submit">{{t "解除"}}</button>
+                                        </form>
+                                        {{else}}{{t "無効"}}{{end}}
+                                </td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="admin-delete">
+                                                <input type="hidden" name="admin_username" value="{{.Username}}">
+                                                <button type="submit">{{t "削除"}}</button>
+                                        </form>
+                                </td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="4">{{t "データベースに登録された管理者はいません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
 
-        <h2>ブロードキャストルール更新</h2>
+        <h2>{{t "管理者アカウント作成"}}</h2>
         <form method="post">
-                <input type="hidden" name="action" value="broadcast-update">
-                <label>ID: <input type="number" name="broadcast_id" min="1" required></label><br>
-                <label>Address: <input type="text" name="broadcast_address" required></label><br>
-                <label>Description: <input type="text" name="broadcast_description"></label><br>
-                <label>Targets (改行・カンマ区切り):<br><textarea name="broadcast_targets" rows="4" cols="40"></textarea></label><br>
-                <button type="submit">更新</button>
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <input type="hidden" name="action" value="admin-create">
+                <label>{{t "管理者名:"}} <input type="text" name="admin_username" required></label><br>
+                <label>{{t "パスワード:"}} <input type="password" name="admin_password" required></label><br>
+                <label>{{t "権限:"}} <select name="admin_role">{{range .AdminRoles}}<option value="{{.}}">{{.}}</option>{{end}}</select></label><br>
+                <button type="submit">{{t "作成"}}</button>
         </form>
+        {{end}}
+</body>
+</html>`
 
-        <h2>ブロードキャストルール削除</h2>
-        <form method="post">
-                <input type="hidden" name="action" value="broadcast-delete">
-                <label>ID: <input type="number" name="broadcast_id" min="1" required></label><br>
-                <button type="submit">削除</button>
+const loginTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "管理者ログイン"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                form { max-width: 400px; }
+                label { display: block; margin-bottom: 0.5rem; }
+                input { width: 100%; padding: 0.4rem; margin-top: 0.2rem; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "管理者ログイン"}}</h1>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="post" action="/login">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="next" value="{{.Next}}">
+                <label>{{t "ユーザ名"}}<input type="text" name="username" autocomplete="username" required></label>
+                <label>{{t "パスワード"}}<input type="password" name="password" autocomplete="current-password" required></label>
+                <button type="submit">{{t "ログイン"}}</button>
         </form>
+        <a href="/">{{t "戻る"}}</a>
 </body>
 </html>`
 
 const passwordTemplate = `<!DOCTYPE html>
-<html lang="ja">
+<html lang="{{lang}}">
 <head>
         <meta charset="UTF-8">
-        <title>パスワード変更</title>
+        <title>{{t "パスワード変更"}}</title>
         <style>
                 body { font-family: sans-serif; margin: 2rem; }
                 form { max-width: 400px; }
@@ -482,17 +888,18 @@ const passwordTemplate = `<!DOCTYPE html>
         </style>
 </head>
 <body>
-        <h1>パスワード変更</h1>
+        {{template "languages"}}
+        <h1>{{t "パスワード変更"}}</h1>
+        <p>{{.User}}</p>
         {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
         {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
         <form method="post">
-                <label>ユーザ名<input type="text" name="username" required></label>
-                <label>ドメイン<input type="text" name="domain" required></label>
-                <label>現在のパスワード<input type="password" name="current_password"></label>
-                <label>新しいパスワード<input type="password" name="new_password" required></label>
-                <label>新しいパスワード(確認)<input type="password" name="confirm_password" required></label>
-                <button type="submit">変更</button>
+                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                <label>{{t "現在のパスワード"}}<input type="password" name="current_password" required></label>
+                <label>{{t "新しいパスワード"}}<input type="password" name="new_password" required></label>
+                <label>{{t "新しいパスワード(確認)"}}<input type="password" name="confirm_password" required></label>
+                <button type="submit">{{t "変更"}}</button>
         </form>
-        <a href="/">戻る</a>
+        <a href="/portal">{{t "ポータルに戻る"}}</a>
 </body>
 </html>`
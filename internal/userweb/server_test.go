@@ -0,0 +1,86 @@
+package userweb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitHandlersServeOnlyTheirSide(t *testing.T) {
+	s, _ := newAPITestServer(t)
+	admin, err := s.sessions.create(session{user: "admin", builtin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sipUser, err := s.sessions.create(session{sipUser: "alice", sipDomain: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminPaths := []string{
+		"/admin/users", "/admin/users/edit?user=alice@example.com", "/admin/users/export",
+		"/admin/broadcast", "/admin/registrations", "/admin/totp", "/admin/audit",
+		"/admin/tokens", "/admin/short-numbers", "/admin/", "/admin/no-such-page",
+		"/api/v1/users", "/api/v1/users/alice@example.com", "/api/v1/broadcast-rules",
+		"/api/v1/trace", "/api/v1/no-such-endpoint",
+		"/metrics", "/login", "/login/totp", "/logout",
+	}
+	portalPaths := []string{"/portal", "/portal/login", "/portal/password", "/portal/no-such-page", "/password"}
+
+	for _, tt := range []struct {
+		name    string
+		handler http.Handler
+		paths   []string
+		sess    *session
+	}{
+		{"portal handler", s.PortalHandler(), adminPaths, admin},
+		{"admin handler", s.AdminHandler(), portalPaths, sipUser},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range tt.paths {
+				for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+					// Credentials for the other side must not reach it either.
+					req := httptest.NewRequest(method, path, nil)
+					req.Header.Set("Authorization", "Bearer "+staticToken)
+					req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.sess.id})
+					rec := httptest.NewRecorder()
+					tt.handler.ServeHTTP(rec, req)
+					if rec.Code != http.StatusNotFound {
+						t.Fatalf("%s %s: expected 404, got %d with Location %q", method, path, rec.Code, rec.Header().Get("Location"))
+					}
+				}
+			}
+		})
+	}
+
+	// Each handler still serves its own side.
+	for _, tt := range []struct {
+		name     string
+		handler  http.Handler
+		path     string
+		sess     *session
+		token    string
+		want     int
+		location string
+	}{
+		{"portal root", s.PortalHandler(), "/", nil, "", http.StatusSeeOther, "/portal"},
+		{"portal login", s.PortalHandler(), "/portal/login", nil, "", http.StatusOK, ""},
+		{"portal without a session", s.PortalHandler(), "/portal/password", nil, "", http.StatusSeeOther, "/portal/login?next=%2Fportal%2Fpassword"},
+		{"old password form", s.PortalHandler(), "/password", nil, "", http.StatusMovedPermanently, "/portal/password"},
+		{"admin root", s.AdminHandler(), "/", nil, "", http.StatusSeeOther, "/admin/users"},
+		{"admin login", s.AdminHandler(), "/login", nil, "", http.StatusOK, ""},
+		{"admin page", s.AdminHandler(), "/admin/users", admin, "", http.StatusOK, ""},
+		{"API", s.AdminHandler(), "/api/v1/users", nil, staticToken, http.StatusOK, ""},
+		{"both on one handler", s.Handler(), "/portal/login", nil, "", http.StatusOK, ""},
+		{"both on one handler", s.Handler(), "/api/v1/users", nil, staticToken, http.StatusOK, ""},
+	} {
+		var rec *httptest.ResponseRecorder
+		if tt.token != "" {
+			rec = apiRequest(tt.handler, http.MethodGet, tt.path, tt.token, "")
+		} else {
+			rec = getPage(tt.handler, tt.path, tt.sess)
+		}
+		if rec.Code != tt.want || rec.Header().Get("Location") != tt.location {
+			t.Fatalf("%s: expected %d to %q, got %d to %q", tt.name, tt.want, tt.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
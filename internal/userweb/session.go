@@ -0,0 +1,229 @@
+package userweb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+const (
+	// sessionCookieName names the cookie carrying the session ID.
+	sessionCookieName = "xylitol_session"
+	// sessionIdleTimeout ends a session that has not been used for a while.
+	sessionIdleTimeout = 30 * time.Minute
+	// sessionLifetime bounds a session regardless of activity.
+	sessionLifetime = 12 * time.Hour
+	// csrfFieldName is the hidden form field carrying the CSRF token.
+	csrfFieldName = "csrf_token"
+)
+
+// session is one browser session. Anonymous sessions (user and sipUser
+// empty) exist only to carry a CSRF token for the login forms. builtin marks the
+// bootstrap admin from the command line, whose role is always superadmin;
+// other admins' roles are re-read from the store on every request. A session
+// with pendingUser set has passed the password check but still owes a
+// second factor, and grants nothing until then. sipUser and sipDomain mark a
+// SIP user logged in to the self-service portal, which grants no admin access.
+type session struct {
+	id          string
+	csrfToken   string
+	user        string
+	builtin     bool
+	pendingUser string
+	sipUser     string
+	sipDomain   string
+	failures    int
+	created     time.Time
+	lastSeen    time.Time
+}
+
+// sessionStore keeps sessions in memory, so restarting the process logs
+// everybody out.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	now      func() time.Time
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session), now: time.Now}
+}
+
+// get returns the live session with id and marks it used, or nil.
+func (st *sessionStore) get(id string) *session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.sessions[id]
+	if !ok {
+		return nil
+	}
+	now := st.now()
+	if st.expired(sess, now) {
+		delete(st.sessions, id)
+		return nil
+	}
+	sess.lastSeen = now
+	return sess
+}
+
+// create starts a session carrying the user, builtin, pendingUser, sipUser,
+// and sipDomain of fields. Expired sessions are swept at the same time.
+func (st *sessionStore) create(fields session) (*session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := st.now()
+	for existing, sess := range st.sessions {
+		if st.expired(sess, now) {
+			delete(st.sessions, existing)
+		}
+	}
+	sess := &session{id: id, csrfToken: csrf, user: fields.user, builtin: fields.builtin, pendingUser: fields.pendingUser, sipUser: fields.sipUser, sipDomain: fields.sipDomain, created: now, lastSeen: now}
+	st.sessions[id] = sess
+	return sess, nil
+}
+
+// fail records a wrong second-factor code and returns the number so far.
+func (st *sessionStore) fail(sess *session) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess.failures++
+	return sess.failures
+}
+
+func (st *sessionStore) delete(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, id)
+}
+
+func (st *sessionStore) expired(sess *session, now time.Time) bool {
+	return now.Sub(sess.lastSeen) > sessionIdleTimeout || now.Sub(sess.created) > sessionLifetime
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// currentSession returns the request's live session, or nil.
+func (s *Server) currentSession(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	return s.sessions.get(cookie.Value)
+}
+
+// ensureSession returns the request's session, starting an anonymous one when
+// there is none so that forms can carry a CSRF token.
+func (s *Server) ensureSession(w http.ResponseWriter, r *http.Request) (*session, error) {
+	if sess := s.currentSession(r); sess != nil {
+		return sess, nil
+	}
+	return s.startSession(w, r, session{})
+}
+
+// startSession creates a session like fields and sets its cookie. Logging in
+// always starts a fresh session so an ID planted before login is useless.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, fields session) (*session, error) {
+	sess, err := s.sessions.create(fields)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sess.id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sess, nil
+}
+
+func (s *Server) endSession(w http.ResponseWriter, r *http.Request, sess *session) {
+	s.sessions.delete(sess.id)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// validCSRF reports whether the parsed form carries the session's token.
+func validCSRF(r *http.Request, sess *session) bool {
+	return sess != nil && subtleCompare(r.FormValue(csrfFieldName), sess.csrfToken)
+}
+
+// adminHandler serves a request from a logged-in admin holding role.
+type adminHandler func(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole)
+
+// requireAdmin admits requests from a logged-in admin session whose role
+// grants at least minimum. Anonymous requests are sent to the login page, or
+// refused outright for anything but GET. An admin whose account has since been
+// deleted is logged out.
+func (s *Server) requireAdmin(minimum userdb.AdminRole, next adminHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := s.currentSession(r)
+		var role userdb.AdminRole
+		if sess != nil && sess.user != "" {
+			var err error
+			role, err = s.sessionRole(r, sess)
+			if errors.Is(err, userdb.ErrAdminNotFound) {
+				s.endSession(w, r, sess)
+				sess = nil
+			} else if err != nil {
+				s.logger.Error("lookup admin account", "user", sess.user, "error", err)
+				http.Error(w, "failed to look up admin account", http.StatusInternalServerError)
+				return
+			}
+		}
+		if sess == nil || sess.user == "" {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.Path), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if !role.Allows(minimum) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r, sess, role)
+	}
+}
+
+// sessionRole returns the current role of a logged-in admin, so that role
+// changes and deletions apply to sessions that are already open.
+func (s *Server) sessionRole(r *http.Request, sess *session) (userdb.AdminRole, error) {
+	if sess.builtin {
+		return userdb.RoleSuperadmin, nil
+	}
+	account, err := s.store.AdminAccount(r.Context(), sess.user)
+	if err != nil {
+		return "", err
+	}
+	return account.Role, nil
+}
@@ -0,0 +1,219 @@
+package userweb
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// newTestServer returns a server backed by an in-memory SQLite directory,
+// with admin/secret as the bootstrap admin.
+func newTestServer(t *testing.T) (*Server, *userdb.SQLStore) {
+	t.Helper()
+	store, err := userdb.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	s, err := New(Config{
+		Store:     store,
+		AdminUser: "admin",
+		AdminPass: "secret",
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	return s, store
+}
+
+// getPage gets path from handler with the session cookie of sess.
+func getPage(handler http.Handler, path string, sess *session) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if sess != nil {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.id})
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// postForm posts form to path on handler with the session cookie of sess.
+func postForm(handler http.Handler, path string, sess *session, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if sess != nil {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.id})
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// sessionCookie returns the session cookie rec sets, or nil.
+func sessionCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestPostsWithoutTheSessionsCSRFTokenAreRefused(t *testing.T) {
+	s, store := newTestServer(t)
+	handler := s.Handler()
+	anonymous, err := s.sessions.create(session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := s.sessions.create(session{user: "admin", builtin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		token []string
+	}{
+		{"missing", nil},
+		{"wrong", []string{"forged"}},
+		{"another session's", []string{admin.csrfToken}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {"admin"}, "password": {"secret"}}
+			if tt.token != nil {
+				form[csrfFieldName] = tt.token
+			}
+			rec := postForm(handler, "/login", anonymous, form)
+			if rec.Code != http.StatusOK || sessionCookie(rec) != nil || !strings.Contains(rec.Body.String(), `class="error"`) {
+				t.Fatalf("expected the login form again without a session, got %d", rec.Code)
+			}
+
+			create := url.Values{"action": {"create"}, "username": {"mallory"}, "domain": {"example.com"}}
+			if tt.token != nil {
+				create[csrfFieldName] = []string{"forged"}
+			}
+			if rec := postForm(handler, "/admin/users", admin, create); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `class="error"`) {
+				t.Fatalf("expected the user list again with an error, got %d", rec.Code)
+			}
+			if _, err := store.Lookup(context.Background(), "mallory", "example.com"); !errors.Is(err, userdb.ErrUserNotFound) {
+				t.Fatalf("expected no user to be created, got %v", err)
+			}
+
+			form = url.Values{}
+			if tt.token != nil {
+				form[csrfFieldName] = []string{"forged"}
+			}
+			if rec := postForm(handler, "/logout", admin, form); rec.Code != http.StatusForbidden {
+				t.Fatalf("expected 403 for a logout without the session's token, got %d", rec.Code)
+			}
+			if s.sessions.get(admin.id) == nil {
+				t.Fatalf("expected the session to survive a refused logout")
+			}
+		})
+	}
+
+	create := url.Values{csrfFieldName: {admin.csrfToken}, "action": {"create"}, "username": {"mallory"}, "domain": {"example.com"}}
+	postForm(handler, "/admin/users", admin, create)
+	if _, err := store.Lookup(context.Background(), "mallory", "example.com"); err != nil {
+		t.Fatalf("expected the session's token to create the user, got %v", err)
+	}
+	rec := postForm(handler, "/login", anonymous, url.Values{csrfFieldName: {anonymous.csrfToken}, "username": {"admin"}, "password": {"secret"}})
+	if rec.Code != http.StatusSeeOther || sessionCookie(rec) == nil || sessionCookie(rec).Value == anonymous.id {
+		t.Fatalf("expected the token to log in with a fresh session, got %d", rec.Code)
+	}
+}
+
+func TestExpiredSessionsRedirectToLogin(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.Handler()
+	now := time.Unix(1_700_000_000, 0)
+	s.sessions.now = func() time.Time { return now }
+
+	// Each case uses the session every step until more than limit has
+	// passed since it was created.
+	for _, tt := range []struct {
+		name  string
+		step  time.Duration
+		limit time.Duration
+	}{
+		{"idle", sessionIdleTimeout + time.Second, sessionIdleTimeout},
+		{"past its lifetime while in use", sessionIdleTimeout - time.Minute, sessionLifetime},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sess, err := s.sessions.create(session{user: "admin", builtin: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec *httptest.ResponseRecorder
+			for elapsed := time.Duration(0); ; elapsed += tt.step {
+				rec = getPage(handler, "/admin/users", sess)
+				if elapsed > tt.limit {
+					break
+				}
+				if rec.Code != http.StatusOK {
+					t.Fatalf("expected the session to be live after %v, got %d", elapsed, rec.Code)
+				}
+				now = now.Add(tt.step)
+			}
+			if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?next=%2Fadmin%2Fusers" {
+				t.Fatalf("expected a redirect to the login page, got %d to %q", rec.Code, rec.Header().Get("Location"))
+			}
+			if _, ok := s.sessions.sessions[sess.id]; ok {
+				t.Fatalf("expected the expired session to be forgotten")
+			}
+		})
+	}
+}
+
+func TestLogoutInvalidatesTheSessionID(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.Handler()
+	sess, err := s.sessions.create(session{user: "admin", builtin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := postForm(handler, "/logout", sess, url.Values{csrfFieldName: {sess.csrfToken}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect after logging out, got %d", rec.Code)
+	}
+	if cookie := sessionCookie(rec); cookie == nil || cookie.Value != "" || cookie.MaxAge >= 0 {
+		t.Fatalf("expected the cookie to be cleared, got %v", cookie)
+	}
+	if rec := getPage(handler, "/admin/users", sess); rec.Code != http.StatusSeeOther || !strings.HasPrefix(rec.Header().Get("Location"), "/login") {
+		t.Fatalf("expected the old session ID to be logged out, got %d", rec.Code)
+	}
+	if rec := postForm(handler, "/admin/users", sess, url.Values{csrfFieldName: {sess.csrfToken}}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a post with the old session ID to be refused, got %d", rec.Code)
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	s, _ := newTestServer(t)
+	handler := s.Handler()
+
+	cookie := sessionCookie(getPage(handler, "/login", nil))
+	if cookie == nil || !cookie.HttpOnly || cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/" {
+		t.Fatalf("expected an HttpOnly, SameSite=Lax session cookie, got %v", cookie)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://proxy.example/login", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if cookie := sessionCookie(rec); cookie == nil || !cookie.Secure {
+		t.Fatalf("expected a Secure session cookie over TLS, got %v", cookie)
+	}
+}
@@ -0,0 +1,201 @@
+package userweb
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+type shortNumbersTemplateData struct {
+	CSRFToken string
+	Numbers   []userdb.ShortNumber
+	// New holds the creation form's values after a failed attempt.
+	New     userdb.ShortNumber
+	Message string
+	Error   string
+}
+
+// handleShortNumbers lists the short numbers, which stand for full addresses
+// of record when dialed within their domain, and lets superadmins create,
+// change, and delete them. Changes reach the proxy through the directory
+// reload like any other store write.
+func (s *Server) handleShortNumbers(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	data := shortNumbersTemplateData{CSRFToken: sess.csrfToken}
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		switch r.FormValue("action") {
+		case "create":
+			s.createShortNumber(r, sess, &data)
+		case "update":
+			s.updateShortNumber(r, sess, &data)
+		case "delete":
+			s.deleteShortNumber(r, sess, &data)
+		default:
+			data.Error = s.tr(r, "不明な操作です")
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	numbers, err := s.store.ListShortNumbers(r.Context())
+	if err != nil {
+		data.Error = s.tr(r, "短縮番号の取得に失敗しました: %v", err)
+	}
+	data.Numbers = numbers
+	s.render(w, r, s.shortNumbersTmpl, data)
+}
+
+// shortNumberForm reads the fields shared by the creation and edit forms.
+func shortNumberForm(r *http.Request) userdb.ShortNumber {
+	return userdb.ShortNumber{
+		Domain:      strings.ToLower(strings.TrimSpace(r.FormValue("domain"))),
+		Number:      strings.TrimSpace(r.FormValue("number")),
+		Target:      strings.TrimSpace(r.FormValue("target")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+	}
+}
+
+func (s *Server) createShortNumber(r *http.Request, sess *session, data *shortNumbersTemplateData) {
+	number := shortNumberForm(r)
+	data.New = number
+	created, err := s.store.CreateShortNumber(r.Context(), number)
+	if err != nil {
+		data.Error = s.shortNumberError(r, "短縮番号の作成に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "short-number.create", strconv.FormatInt(created.ID, 10), nil, toAPIShortNumber(*created))
+	data.New = userdb.ShortNumber{}
+	data.Message = s.tr(r, "短縮番号 %s@%s を作成しました", created.Number, created.Domain)
+}
+
+func (s *Server) updateShortNumber(r *http.Request, sess *session, data *shortNumbersTemplateData) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		data.Error = s.tr(r, "短縮番号が指定されていません")
+		return
+	}
+	before, err := s.shortNumber(r, id)
+	if err != nil {
+		data.Error = s.shortNumberError(r, "短縮番号の更新に失敗しました: %v", err)
+		return
+	}
+	number := shortNumberForm(r)
+	number.ID = id
+	if err := s.store.UpdateShortNumber(r.Context(), number); err != nil {
+		data.Error = s.shortNumberError(r, "短縮番号の更新に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "short-number.update", strconv.FormatInt(id, 10), toAPIShortNumber(*before), toAPIShortNumber(number))
+	data.Message = s.tr(r, "短縮番号 %s@%s を更新しました", number.Number, number.Domain)
+}
+
+func (s *Server) deleteShortNumber(r *http.Request, sess *session, data *shortNumbersTemplateData) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		data.Error = s.tr(r, "短縮番号が指定されていません")
+		return
+	}
+	before, err := s.shortNumber(r, id)
+	if err == nil {
+		err = s.store.DeleteShortNumber(r.Context(), id)
+	}
+	if err != nil {
+		data.Error = s.shortNumberError(r, "短縮番号の削除に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "short-number.delete", strconv.FormatInt(id, 10), toAPIShortNumber(*before), nil)
+	data.Message = s.tr(r, "短縮番号 %s@%s を削除しました", before.Number, before.Domain)
+}
+
+// shortNumberError describes a failed change, naming the usual causes in
+// place of the store's wording.
+func (s *Server) shortNumberError(r *http.Request, format string, err error) string {
+	switch {
+	case errors.Is(err, userdb.ErrShortNumberExists):
+		return s.tr(r, "このドメインには同じ短縮番号が既にあります")
+	case errors.Is(err, userdb.ErrShortNumberNotFound):
+		return s.tr(r, "短縮番号は既に削除されています")
+	}
+	return s.tr(r, format, strings.TrimPrefix(err.Error(), "userdb: "))
+}
+
+const shortNumbersTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "短縮番号"}}</title>
+        <script src="/static/confirm.js" defer></script>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; vertical-align: top; }
+                td form { display: inline; margin: 0; }
+                .message { color: green; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "短縮番号"}}</h1>
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        <p>{{t "ドメイン内で短縮番号にかけると、登録・転送の前に宛先の URI へ書き換えます。"}}</p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <table>
+                <thead>
+                        <tr><th>{{t "ドメイン"}}</th><th>{{t "番号"}}</th><th>{{t "宛先 URI"}}</th><th>{{t "説明"}}</th><th>{{t "操作"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .Numbers}}
+                        <tr>
+                                <td><input type="text" name="domain" value="{{.Domain}}" form="short-number-{{.ID}}" required></td>
+                                <td><input type="text" name="number" value="{{.Number}}" size="8" form="short-number-{{.ID}}" required></td>
+                                <td><input type="text" name="target" value="{{.Target}}" size="32" form="short-number-{{.ID}}" required></td>
+                                <td><input type="text" name="description" value="{{.Description}}" form="short-number-{{.ID}}"></td>
+                                <td>
+                                        <form method="post" id="short-number-{{.ID}}">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="update">
+                                                <input type="hidden" name="id" value="{{.ID}}">
+                                                <button type="submit">{{t "保存"}}</button>
+                                        </form>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="delete">
+                                                <input type="hidden" name="id" value="{{.ID}}">
+                                                <button type="submit" data-confirm="{{t "この短縮番号を削除しますか?"}}">{{t "削除"}}</button>
+                                        </form>
+                                </td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="5">{{t "登録された短縮番号はありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        <h2>{{t "短縮番号の追加"}}</h2>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="action" value="create">
+                <label>{{t "ドメイン:"}} <input type="text" name="domain" value="{{.New.Domain}}" placeholder="example.com" required></label><br>
+                <label>{{t "番号:"}} <input type="text" name="number" value="{{.New.Number}}" placeholder="100" required></label><br>
+                <label>{{t "宛先 URI:"}} <input type="text" name="target" value="{{.New.Target}}" size="32" placeholder="sip:alice@example.com" required></label><br>
+                <label>{{t "説明:"}} <input type="text" name="description" value="{{.New.Description}}"></label><br>
+                <button type="submit">{{t "追加"}}</button>
+        </form>
+</body>
+</html>`
@@ -0,0 +1,187 @@
+package userweb
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+// auditAPIToken is the audit snapshot of an API token. The secret's hash is
+// left out.
+type auditAPIToken struct {
+	ID     int64             `json:"id"`
+	Name   string            `json:"name"`
+	Scopes []userdb.APIScope `json:"scopes"`
+}
+
+func toAuditAPIToken(token userdb.APIToken) auditAPIToken {
+	return auditAPIToken{ID: token.ID, Name: token.Name, Scopes: token.Scopes}
+}
+
+type tokensTemplateData struct {
+	CSRFToken string
+	Scopes    []userdb.APIScope
+	Tokens    []userdb.APIToken
+	Name      string
+	Secret    string
+	Message   string
+	Error     string
+}
+
+// handleAPITokens lists the JSON API tokens and lets superadmins create and
+// revoke them. A new token's secret is shown once and never stored.
+func (s *Server) handleAPITokens(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	data := tokensTemplateData{CSRFToken: sess.csrfToken, Scopes: userdb.APIScopes}
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		switch r.FormValue("action") {
+		case "create":
+			s.createAPIToken(r, sess, &data)
+		case "revoke":
+			s.revokeAPIToken(r, sess, &data)
+		default:
+			data.Error = s.tr(r, "不明な操作です")
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokens, err := s.store.ListAPITokens(r.Context())
+	if err != nil {
+		data.Error = s.tr(r, "APIトークンの取得に失敗しました: %v", err)
+	}
+	data.Tokens = tokens
+	s.render(w, r, s.tokensTmpl, data)
+}
+
+func (s *Server) createAPIToken(r *http.Request, sess *session, data *tokensTemplateData) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		data.Error = s.tr(r, "トークン名を入力してください")
+		return
+	}
+	scopes, err := userdb.ParseAPIScopes(r.Form["scope"])
+	if err != nil || len(scopes) == 0 {
+		data.Name = name
+		data.Error = s.tr(r, "スコープを1つ以上選択してください")
+		return
+	}
+	secret, hash, err := userdb.GenerateAPIToken()
+	if err != nil {
+		data.Error = s.tr(r, "APIトークンの作成に失敗しました: %v", err)
+		return
+	}
+	created, err := s.store.CreateAPIToken(r.Context(), userdb.APIToken{Name: name, TokenHash: hash, Scopes: scopes, CreatedBy: sess.user})
+	if err != nil {
+		data.Error = s.tr(r, "APIトークンの作成に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "api-token.create", strconv.FormatInt(created.ID, 10), nil, toAuditAPIToken(*created))
+	data.Secret = secret
+	data.Message = s.tr(r, "APIトークン %s を作成しました", created.Name)
+}
+
+func (s *Server) revokeAPIToken(r *http.Request, sess *session, data *tokensTemplateData) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		data.Error = s.tr(r, "トークンが指定されていません")
+		return
+	}
+	var before any
+	if tokens, err := s.store.ListAPITokens(r.Context()); err == nil {
+		for _, token := range tokens {
+			if token.ID == id {
+				before = toAuditAPIToken(token)
+			}
+		}
+	}
+	err = s.store.DeleteAPIToken(r.Context(), id)
+	if errors.Is(err, userdb.ErrAPITokenNotFound) {
+		data.Error = s.tr(r, "トークンは既に失効しています")
+		return
+	}
+	if err != nil {
+		data.Error = s.tr(r, "APIトークンの失効に失敗しました: %v", err)
+		return
+	}
+	s.audit(r, sess.user, "api-token.revoke", strconv.FormatInt(id, 10), before, nil)
+	data.Message = s.tr(r, "APIトークンを失効させました")
+}
+
+const tokensTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "APIトークン"}}</title>
+        <script src="/static/confirm.js" defer></script>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                table { border-collapse: collapse; margin-top: 1rem; width: 100%; }
+                th, td { border: 1px solid #ccc; padding: 0.5rem; text-align: left; vertical-align: top; }
+                td form { margin: 0; }
+                .secret { font-family: monospace; font-size: 1.1rem; background: #f4f4f4; padding: 0.5rem; word-break: break-all; }
+                .message { color: green; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "APIトークン"}}</h1>
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        {{if .Secret}}
+        <p>{{t "次のトークンを Authorization: Bearer ヘッダに指定してください。この画面を離れると再表示できません。"}}</p>
+        <p class="secret">{{.Secret}}</p>
+        {{end}}
+        <table>
+                <thead>
+                        <tr><th>{{t "名前"}}</th><th>{{t "スコープ"}}</th><th>{{t "作成者"}}</th><th>{{t "作成日時 (UTC)"}}</th><th>{{t "操作"}}</th></tr>
+                </thead>
+                <tbody>
+                        {{range .Tokens}}
+                        <tr>
+                                <td>{{.Name}}</td>
+                                <td>{{range $i, $scope := .Scopes}}{{if $i}}, {{end}}{{$scope}}{{end}}</td>
+                                <td>{{.CreatedBy}}</td>
+                                <td>{{.Created.UTC.Format "2006-01-02 15:04:05"}}</td>
+                                <td>
+                                        <form method="post">
+                                                <input type="hidden" name="csrf_token" value="{{$.CSRFToken}}">
+                                                <input type="hidden" name="action" value="revoke">
+                                                <input type="hidden" name="id" value="{{.ID}}">
+                                                <button type="submit" data-confirm="{{t "このトークンを失効させますか?"}}">{{t "失効"}}</button>
+                                        </form>
+                                </td>
+                        </tr>
+                        {{else}}
+                        <tr><td colspan="5">{{t "登録されたトークンはありません"}}</td></tr>
+                        {{end}}
+                </tbody>
+        </table>
+        <h2>{{t "トークンの作成"}}</h2>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="action" value="create">
+                <label>{{t "名前:"}} <input type="text" name="name" value="{{.Name}}" required></label><br>
+                <p>{{t "スコープ (書き込みは読み取りを含みます):"}}</p>
+                {{range .Scopes}}<label><input type="checkbox" name="scope" value="{{.}}"> {{.}}</label><br>{{end}}
+                <button type="submit">{{t "作成"}}</button>
+        </form>
+</body>
+</html>`
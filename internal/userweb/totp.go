@@ -0,0 +1,472 @@
+package userweb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"xylitol4/internal/qrcode"
+	"xylitol4/sip/userdb"
+)
+
+// TOTP parameters (RFC 6238). They match the defaults of common authenticator
+// apps, which ignore anything else in the provisioning URI.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew accepts codes from this many periods either side of now to
+	// allow for clock drift.
+	totpSkew = 1
+	// totpIssuer labels the account in authenticator apps.
+	totpIssuer = "xylitol"
+	// recoveryCodeCount is how many single-use recovery codes enrollment
+	// hands out.
+	recoveryCodeCount = 10
+	// secondFactorTimeout bounds the time between the password and the code.
+	secondFactorTimeout = 5 * time.Minute
+	// secondFactorAttempts is how many wrong codes end a pending login.
+	secondFactorAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret in base32, the size RFC 4226
+// recommends for HMAC-SHA1.
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpURI is the otpauth:// URI authenticator apps scan from the QR code.
+func totpURI(account, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpCode computes the HOTP value (RFC 4226) for one counter.
+func totpCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step whose code equals code, within totpSkew of
+// now.
+func matchTOTP(secret, code string, now time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimSpace(secret)))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / uint64(totpPeriod/time.Second)
+	for delta := -totpSkew; delta <= totpSkew; delta++ {
+		counter := current + uint64(delta)
+		if hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// isTOTPCode reports whether input looks like a TOTP code rather than a
+// recovery code.
+func isTOTPCode(input string) bool {
+	if len(input) != totpDigits {
+		return false
+	}
+	for _, r := range input {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRecoveryCodes returns fresh recovery codes formatted as two groups of
+// five base32 characters.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := totpEncoding.EncodeToString(buf)[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+	return codes, nil
+}
+
+// totpGuard remembers the last time step accepted per admin so that a code
+// observed in transit cannot be replayed within its validity window.
+type totpGuard struct {
+	mu   sync.Mutex
+	used map[string]uint64
+}
+
+func newTOTPGuard() *totpGuard {
+	return &totpGuard{used: make(map[string]uint64)}
+}
+
+// accept checks code against secret for user and consumes its time step.
+func (g *totpGuard) accept(user, secret, code string, now time.Time) bool {
+	counter, ok := matchTOTP(secret, code, now)
+	if !ok {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if last, seen := g.used[user]; seen && counter <= last {
+		return false
+	}
+	g.used[user] = counter
+	return true
+}
+
+// validTOTPSecret reports whether secret decodes to at least the 128 bits RFC
+// 4226 requires.
+func validTOTPSecret(secret string) bool {
+	key, err := totpEncoding.DecodeString(secret)
+	return err == nil && len(key) >= 16
+}
+
+type secondFactorTemplateData struct {
+	CSRFToken string
+	Next      string
+	Error     string
+}
+
+// handleSecondFactor completes a login that passed the password check by
+// asking for a TOTP code or a recovery code.
+func (s *Server) handleSecondFactor(w http.ResponseWriter, r *http.Request) {
+	sess := s.currentSession(r)
+	if sess == nil || sess.pendingUser == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if s.sessions.now().Sub(sess.created) > secondFactorTimeout {
+		s.endSession(w, r, sess)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	data := secondFactorTemplateData{CSRFToken: sess.csrfToken, Next: safeRedirect(r.URL.Query().Get("next"))}
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		data.Next = safeRedirect(r.FormValue("next"))
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		user := sess.pendingUser
+		account, err := s.store.AdminAccount(r.Context(), user)
+		if err != nil || account.TOTPSecret == "" {
+			if err != nil && !errors.Is(err, userdb.ErrAdminNotFound) {
+				s.logger.Error("lookup admin account", "user", user, "error", err)
+			}
+			s.endSession(w, r, sess)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if s.verifySecondFactor(r, account, strings.TrimSpace(r.FormValue("code"))) {
+			s.sessions.delete(sess.id)
+			if _, err := s.startSession(w, r, session{user: user}); err != nil {
+				http.Error(w, "failed to start session", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		s.logger.Warn("failed second factor", "user", user, "remote", r.RemoteAddr)
+		if s.sessions.fail(sess) >= secondFactorAttempts {
+			s.endSession(w, r, sess)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		data.Error = s.tr(r, "認証コードが正しくありません")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.render(w, r, s.factorTmpl, data)
+}
+
+// verifySecondFactor accepts a current TOTP code or consumes a recovery code.
+func (s *Server) verifySecondFactor(r *http.Request, account *userdb.AdminAccount, code string) bool {
+	if code == "" {
+		return false
+	}
+	if isTOTPCode(code) {
+		return s.totp.accept(account.Username, account.TOTPSecret, code, s.sessions.now())
+	}
+	err := s.store.UseAdminRecoveryCode(r.Context(), account.Username, userdb.HashRecoveryCode(code))
+	if err == nil {
+		s.logger.Info("admin used a recovery code", "user", account.Username, "remote", r.RemoteAddr)
+		return true
+	}
+	if !errors.Is(err, userdb.ErrRecoveryCodeInvalid) {
+		s.logger.Error("use recovery code", "user", account.Username, "error", err)
+	}
+	return false
+}
+
+type totpTemplateData struct {
+	CSRFToken     string
+	AdminUser     string
+	Builtin       bool
+	Enrolled      bool
+	Secret        string
+	URI           string
+	QRCode        template.HTML
+	RecoveryCodes []string
+	Message       string
+	Error         string
+}
+
+// handleTOTP lets a logged-in admin enroll in two-factor authentication,
+// replace the recovery codes, or turn it off again. Every change has to be
+// confirmed with a current code.
+func (s *Server) handleTOTP(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	data := totpTemplateData{CSRFToken: sess.csrfToken, AdminUser: sess.user, Builtin: sess.builtin}
+	if sess.builtin {
+		s.renderTOTP(w, r, data)
+		return
+	}
+	ctx := r.Context()
+	account, err := s.store.AdminAccount(ctx, sess.user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load admin account: %v", err), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		code := strings.TrimSpace(r.FormValue("code"))
+		switch action := r.FormValue("action"); action {
+		case "enroll":
+			secret := r.FormValue("secret")
+			if account.TOTPSecret != "" {
+				data.Error = s.tr(r, "二要素認証は既に有効です")
+				break
+			}
+			if !validTOTPSecret(secret) {
+				data.Error = s.tr(r, "シークレットが正しくありません。もう一度やり直してください")
+				break
+			}
+			data.Secret = secret
+			if !s.totp.accept(account.Username, secret, code, s.sessions.now()) {
+				data.Error = s.tr(r, "認証コードが正しくありません")
+				break
+			}
+			codes, err := s.saveTOTP(ctx, account.Username, secret)
+			if err != nil {
+				data.Error = s.tr(r, "二要素認証の設定に失敗しました: %v", err)
+				break
+			}
+			s.audit(r, sess.user, "admin.totp-enroll", account.Username, toAuditAdmin(*account), toAuditAdmin(userdb.AdminAccount{Username: account.Username, Role: account.Role, TOTPSecret: secret}))
+			account.TOTPSecret = secret
+			data.RecoveryCodes = codes
+			data.Message = s.tr(r, "二要素認証を有効にしました。リカバリーコードを安全な場所に保管してください")
+		case "regenerate", "disable":
+			if account.TOTPSecret == "" {
+				data.Error = s.tr(r, "二要素認証は設定されていません")
+				break
+			}
+			if !s.totp.accept(account.Username, account.TOTPSecret, code, s.sessions.now()) {
+				data.Error = s.tr(r, "認証コードが正しくありません")
+				break
+			}
+			if action == "disable" {
+				if err := s.store.SetAdminTOTP(ctx, account.Username, "", nil); err != nil {
+					data.Error = s.tr(r, "二要素認証の解除に失敗しました: %v", err)
+					break
+				}
+				before := toAuditAdmin(*account)
+				account.TOTPSecret = ""
+				s.audit(r, sess.user, "admin.totp-disable", account.Username, before, toAuditAdmin(*account))
+				data.Message = s.tr(r, "二要素認証を解除しました")
+				break
+			}
+			codes, err := s.saveTOTP(ctx, account.Username, account.TOTPSecret)
+			if err != nil {
+				data.Error = s.tr(r, "リカバリーコードの再発行に失敗しました: %v", err)
+				break
+			}
+			s.audit(r, sess.user, "admin.recovery-codes", account.Username, nil, nil)
+			data.RecoveryCodes = codes
+			data.Message = s.tr(r, "リカバリーコードを再発行しました。以前のコードは使えません")
+		default:
+			data.Error = s.tr(r, "不明な操作が指定されました")
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data.Enrolled = account.TOTPSecret != ""
+	if !data.Enrolled {
+		if data.Secret == "" {
+			if data.Secret, err = newTOTPSecret(); err != nil {
+				http.Error(w, "failed to generate secret", http.StatusInternalServerError)
+				return
+			}
+		}
+		data.URI = totpURI(account.Username, data.Secret)
+		code, err := qrcode.Encode(data.URI)
+		if err != nil {
+			s.logger.Error("encode provisioning QR code", "error", err)
+		} else {
+			data.QRCode = template.HTML(code.SVG(4))
+		}
+	}
+	s.renderTOTP(w, r, data)
+}
+
+// saveTOTP stores secret with a fresh set of recovery codes and returns the
+// codes for display.
+func (s *Server) saveTOTP(ctx context.Context, username, secret string) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = userdb.HashRecoveryCode(code)
+	}
+	if err := s.store.SetAdminTOTP(ctx, username, secret, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *Server) renderTOTP(w http.ResponseWriter, r *http.Request, data totpTemplateData) {
+	s.render(w, r, s.totpTmpl, data)
+}
+
+const secondFactorTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "二要素認証"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                form { max-width: 400px; }
+                label { display: block; margin-bottom: 0.5rem; }
+                input { width: 100%; padding: 0.4rem; margin-top: 0.2rem; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "二要素認証"}}</h1>
+        <p>{{t "認証アプリに表示された6桁のコード、またはリカバリーコードを入力してください。"}}</p>
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="post" action="/login/totp">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="next" value="{{.Next}}">
+                <label>{{t "認証コード"}}<input type="text" name="code" autocomplete="one-time-code" required autofocus></label>
+                <button type="submit">{{t "確認"}}</button>
+        </form>
+        <a href="/login">{{t "最初からやり直す"}}</a>
+</body>
+</html>`
+
+const totpTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "二要素認証の設定"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                form { max-width: 400px; margin-top: 1rem; }
+                label { display: block; margin-bottom: 0.5rem; }
+                input { width: 100%; padding: 0.4rem; margin-top: 0.2rem; }
+                code { word-break: break-all; }
+                .message { color: green; }
+                .error { color: red; }
+                .codes { font-family: monospace; font-size: 1.1rem; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "二要素認証の設定"}}</h1>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        {{if .Builtin}}
+        <p>{{t "コマンドラインで指定した管理者 (%s) には二要素認証を設定できません。データベースに管理者アカウントを作成して利用してください。" .AdminUser}}</p>
+        {{else}}
+        {{if .RecoveryCodes}}
+        <h2>{{t "リカバリーコード"}}</h2>
+        <p>{{t "認証アプリを使えないときに、各コードを1回だけ認証コードの代わりに使えます。この画面を離れると再表示できません。"}}</p>
+        <ul class="codes">{{range .RecoveryCodes}}<li>{{.}}</li>{{end}}</ul>
+        {{end}}
+        {{if .Enrolled}}
+        <p>{{t "%s の二要素認証は有効です。" .AdminUser}}</p>
+        <h2>{{t "リカバリーコードの再発行"}}</h2>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="action" value="regenerate">
+                <label>{{t "認証コード"}}<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" required></label>
+                <button type="submit">{{t "再発行"}}</button>
+        </form>
+        <h2>{{t "二要素認証の解除"}}</h2>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="action" value="disable">
+                <label>{{t "認証コード"}}<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" required></label>
+                <button type="submit">{{t "解除"}}</button>
+        </form>
+        {{else}}
+        <p>{{t "認証アプリで次のQRコードを読み取り、表示された6桁のコードを入力してください。"}}</p>
+        {{if .QRCode}}<div>{{.QRCode}}</div>{{end}}
+        <p>{{t "QRコードを読み取れない場合はシークレットを手動で登録してください:"}} <code>{{.Secret}}</code></p>
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <input type="hidden" name="action" value="enroll">
+                <input type="hidden" name="secret" value="{{.Secret}}">
+                <label>{{t "認証コード"}}<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" required></label>
+                <button type="submit">{{t "有効にする"}}</button>
+        </form>
+        {{end}}
+        {{end}}
+        <a href="/admin/users">{{t "管理画面に戻る"}}</a>
+</body>
+</html>`
@@ -0,0 +1,126 @@
+package userweb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 Appendix B test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Appendix B gives eight digits; the proxy uses the last six.
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		counter := uint64(tt.unix) / uint64(totpPeriod/time.Second)
+		if got := totpCode(key, counter); got != tt.want[2:] {
+			t.Fatalf("T=%d: expected %s, got %s", tt.unix, tt.want[2:], got)
+		}
+		if step, ok := matchTOTP(strings.ToLower(rfc6238Secret), tt.want[2:], time.Unix(tt.unix, 0)); !ok || step != counter {
+			t.Fatalf("T=%d: expected the code to match step %d, got %d, %v", tt.unix, counter, step, ok)
+		}
+	}
+}
+
+func TestTOTPGuardAcceptsSkewAndRejectsReplay(t *testing.T) {
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	base := time.Unix(1111111109, 0)
+	step := func(delta int) string {
+		return totpCode(key, uint64(base.Unix())/30+uint64(delta))
+	}
+	for _, tt := range []struct {
+		name  string
+		delta int
+		ok    bool
+	}{
+		{"current", 0, true},
+		{"one period behind", -1, true},
+		{"one period ahead", 1, true},
+		{"two periods behind", -2, false},
+		{"two periods ahead", 2, false},
+	} {
+		g := newTOTPGuard()
+		if got := g.accept("carol", rfc6238Secret, step(tt.delta), base); got != tt.ok {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.ok, got)
+		}
+	}
+
+	g := newTOTPGuard()
+	if !g.accept("carol", rfc6238Secret, step(0), base) {
+		t.Fatalf("expected the current code to be accepted")
+	}
+	if g.accept("carol", rfc6238Secret, step(0), base.Add(time.Second)) {
+		t.Fatalf("expected a replayed code to be refused")
+	}
+	if g.accept("carol", rfc6238Secret, step(-1), base) {
+		t.Fatalf("expected a code older than the last one accepted to be refused")
+	}
+	if !g.accept("dave", rfc6238Secret, step(0), base) {
+		t.Fatalf("expected another admin's use of the same step to be accepted")
+	}
+	if !g.accept("carol", rfc6238Secret, step(1), base) {
+		t.Fatalf("expected the next step to be accepted")
+	}
+	if g.accept("carol", rfc6238Secret, "12345", base) || g.accept("carol", "not base32!", step(0), base) {
+		t.Fatalf("expected malformed codes and secrets to be refused")
+	}
+}
+
+func TestSecondFactorEndsLoginAfterTooManyWrongCodes(t *testing.T) {
+	s, store := newTestServer(t)
+	now := time.Unix(1111111109, 0)
+	s.sessions.now = func() time.Time { return now }
+	if err := store.CreateAdminAccount(context.Background(), userdb.AdminAccount{Username: "carol", PasswordHash: "unused", Role: userdb.RoleReadOnly, TOTPSecret: rfc6238Secret}); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := s.sessions.create(session{pendingUser: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Handler()
+	wrong := "000000"
+	if _, ok := matchTOTP(rfc6238Secret, wrong, now); ok {
+		t.Fatalf("test code %s is unexpectedly valid", wrong)
+	}
+	form := url.Values{csrfFieldName: {sess.csrfToken}, "code": {wrong}}
+
+	for attempt := 1; attempt < secondFactorAttempts; attempt++ {
+		rec := postForm(handler, "/login/totp", sess, form)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `class="error"`) {
+			t.Fatalf("attempt %d: expected the form again with an error, got %d", attempt, rec.Code)
+		}
+	}
+	rec := postForm(handler, "/login/totp", sess, form)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Fatalf("expected attempt %d to end the login, got %d to %q", secondFactorAttempts, rec.Code, rec.Header().Get("Location"))
+	}
+	if s.sessions.get(sess.id) != nil {
+		t.Fatalf("expected the pending session to be deleted")
+	}
+
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	form.Set("code", totpCode(key, uint64(now.Unix())/30))
+	if rec := postForm(handler, "/login/totp", sess, form); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Fatalf("expected even a correct code to need a new login, got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,118 @@
+package userweb
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"xylitol4/sip"
+)
+
+// TraceSource controls the SIP message tracer. *sip.Tracer satisfies it.
+type TraceSource interface {
+	Configure(enabled bool, filter sip.TraceFilter)
+	Status() (bool, sip.TraceFilter)
+	Recent() []sip.TraceEntry
+	Subscribe(buffer int) (<-chan sip.TraceEntry, func())
+}
+
+// apiTraceStatus is the JSON form of the tracer's configuration.
+type apiTraceStatus struct {
+	Enabled bool            `json:"enabled"`
+	Filter  sip.TraceFilter `json:"filter"`
+}
+
+func (s *Server) traceStatus() apiTraceStatus {
+	enabled, filter := s.tracer.Status()
+	return apiTraceStatus{Enabled: enabled, Filter: filter}
+}
+
+// requireTracer rejects trace requests when the process runs without a
+// tracer.
+func (s *Server) requireTracer(w http.ResponseWriter) bool {
+	if s.tracer == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "message tracing is not available")
+		return false
+	}
+	return true
+}
+
+func (s *Server) apiGetTrace(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTracer(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.traceStatus())
+}
+
+func (s *Server) apiSetTrace(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTracer(w) {
+		return
+	}
+	var in apiTraceStatus
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	before := s.traceStatus()
+	s.tracer.Configure(in.Enabled, in.Filter)
+	after := s.traceStatus()
+	s.audit(r, apiActor(r), "trace.update", "sip", before, after)
+	writeJSON(w, http.StatusOK, after)
+}
+
+func (s *Server) apiListTraces(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTracer(w) {
+		return
+	}
+	out := s.tracer.Recent()
+	if out == nil {
+		out = []sip.TraceEntry{}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// CloseStreams ends every open trace stream. Register it with
+// http.Server.RegisterOnShutdown so that Shutdown need not wait for streaming
+// clients to disconnect.
+func (s *Server) CloseStreams() {
+	s.closeStreams()
+}
+
+// apiStreamTraces writes each newly traced message as one line of JSON until
+// the client disconnects.
+func (s *Server) apiStreamTraces(w http.ResponseWriter, r *http.Request) {
+	if !s.requireTracer(w) {
+		return
+	}
+	rc := http.NewResponseController(w)
+	// The server's write timeout would otherwise end the stream.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		s.logger.Error("clear trace stream deadline", "error", err)
+	}
+	entries, cancel := s.tracer.Subscribe(256)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.streams.Done():
+			return
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(entry); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package userweb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+type editUserTemplateData struct {
+	CSRFToken string
+	User      userdb.User
+	Message   string
+	Error     string
+}
+
+// handleEditUser shows and saves the edit form for one user: contact URI,
+// enabled flag, and an optional new password set by the administrator.
+func (s *Server) handleEditUser(w http.ResponseWriter, r *http.Request, sess *session, role userdb.AdminRole) {
+	ctx := r.Context()
+	username := strings.TrimSpace(r.URL.Query().Get("username"))
+	domain := strings.TrimSpace(r.URL.Query().Get("domain"))
+	user, err := s.store.Lookup(ctx, username, domain)
+	if errors.Is(err, userdb.ErrUserNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load user: %v", err), http.StatusInternalServerError)
+		return
+	}
+	data := editUserTemplateData{CSRFToken: sess.csrfToken}
+
+	switch r.Method {
+	case http.MethodGet:
+		// nothing to do
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			data.Error = s.tr(r, "フォームの解析に失敗しました: %v", err)
+			break
+		}
+		if !validCSRF(r, sess) {
+			data.Error = s.tr(r, "フォームの有効期限が切れました。もう一度操作してください")
+			break
+		}
+		update := userdb.User{
+			Username:   user.Username,
+			Domain:     user.Domain,
+			ContactURI: strings.TrimSpace(r.FormValue("contact")),
+			Disabled:   r.FormValue("enabled") == "",
+		}
+		action := "user.update"
+		if password := r.FormValue("password"); password != "" {
+			if password != r.FormValue("confirm_password") {
+				data.Error = s.tr(r, "新しいパスワードが確認と一致しません")
+				break
+			}
+			update.PasswordHash = userdb.HashPassword(user.Username, user.Domain, password)
+			action = "user.update-password"
+		}
+		if err := s.store.UpdateUser(ctx, update); err != nil {
+			data.Error = s.tr(r, "ユーザの更新に失敗しました: %v", err)
+			break
+		}
+		updated, err := s.store.Lookup(ctx, user.Username, user.Domain)
+		if err != nil {
+			data.Error = s.tr(r, "更新後のユーザ情報の取得に失敗しました: %v", err)
+			break
+		}
+		s.audit(r, sess.user, action, user.Username+"@"+user.Domain, toAPIUser(*user), toAPIUser(*updated))
+		user = updated
+		data.Message = s.tr(r, "ユーザ %s@%s を更新しました", user.Username, user.Domain)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data.User = *user
+	s.render(w, r, s.editUserTmpl, data)
+}
+
+const editUserTemplate = `<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+        <meta charset="UTF-8">
+        <title>{{t "ユーザ編集"}}</title>
+        <style>
+                body { font-family: sans-serif; margin: 2rem; }
+                form { margin-top: 1rem; }
+                .message { color: green; }
+                .error { color: red; }
+        </style>
+</head>
+<body>
+        {{template "languages"}}
+        <h1>{{t "ユーザ編集:"}} {{.User.Username}}@{{.User.Domain}}</h1>
+        <p><a href="/admin/users">{{t "管理画面に戻る"}}</a></p>
+        {{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        <form method="post">
+                <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+                <label>Contact URI: <input type="text" name="contact" value="{{.User.ContactURI}}"></label><br>
+                <label><input type="checkbox" name="enabled" value="1"{{if not .User.Disabled}} checked{{end}}> {{t "有効"}}</label><br>
+                <p>{{t "パスワードを再設定する場合のみ入力してください"}} ({{t "現在:"}} {{if .User.PasswordHash}}{{t "設定済み"}}{{else}}{{t "未設定"}}{{end}})</p>
+                <label>{{t "新しいパスワード:"}} <input type="password" name="password" autocomplete="new-password"></label><br>
+                <label>{{t "新しいパスワード (確認):"}} <input type="password" name="confirm_password" autocomplete="new-password"></label><br>
+                <button type="submit">{{t "保存"}}</button>
+        </form>
+</body>
+</html>`
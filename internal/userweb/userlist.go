@@ -0,0 +1,137 @@
+package userweb
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"xylitol4/sip/userdb"
+)
+
+// userPageSize is how many users the admin page lists at a time.
+const userPageSize = 50
+
+// userList holds the search, sort, and page requested for the admin user
+// list. It is read from the query string so that links can be bookmarked
+// and the POST forms, which submit to the current URL, keep the view.
+type userList struct {
+	search     string
+	sort       userdb.UserSort
+	descending bool
+	page       int
+}
+
+func parseUserList(query url.Values) userList {
+	list := userList{search: strings.TrimSpace(query.Get("q"))}
+	var err error
+	if list.sort, err = userdb.ParseUserSort(query.Get("sort")); err != nil {
+		list.sort = userdb.SortByDomain
+	}
+	list.descending = query.Get("dir") == "desc"
+	list.page, err = strconv.Atoi(query.Get("page"))
+	if err != nil || list.page < 1 {
+		list.page = 1
+	}
+	return list
+}
+
+func (l userList) query() userdb.UserQuery {
+	return userdb.UserQuery{
+		Search:     l.search,
+		Sort:       l.sort,
+		Descending: l.descending,
+		Limit:      userPageSize,
+		Offset:     (l.page - 1) * userPageSize,
+	}
+}
+
+// link returns the admin page URL showing l.
+func (l userList) link() string {
+	query := url.Values{}
+	if l.search != "" {
+		query.Set("q", l.search)
+	}
+	query.Set("sort", string(l.sort))
+	if l.descending {
+		query.Set("dir", "desc")
+	}
+	if l.page > 1 {
+		query.Set("page", strconv.Itoa(l.page))
+	}
+	return "/admin/users?" + query.Encode()
+}
+
+type userListColumn struct {
+	Label string
+	Link  string
+	Arrow string
+}
+
+// userListView is what the admin template needs to render the list
+// controls.
+type userListView struct {
+	Search     string
+	Sort       userdb.UserSort
+	Descending bool
+	Page       int
+	Pages      int
+	Total      int
+	First      int
+	Last       int
+	Columns    []userListColumn
+	PrevLink   string
+	NextLink   string
+	ClearLink  string
+}
+
+func (l userList) view(total int) userListView {
+	v := userListView{
+		Search:     l.search,
+		Sort:       l.sort,
+		Descending: l.descending,
+		Page:       l.page,
+		Pages:      max((total+userPageSize-1)/userPageSize, 1),
+		Total:      total,
+	}
+	if offset := (l.page - 1) * userPageSize; offset < total {
+		v.First = offset + 1
+		v.Last = min(offset+userPageSize, total)
+	}
+	for _, col := range []struct {
+		label string
+		sort  userdb.UserSort
+	}{
+		{"ユーザ名", userdb.SortByUsername},
+		{"ドメイン", userdb.SortByDomain},
+		{"Contact URI", userdb.SortByContact},
+		{"状態", userdb.SortByEnabled},
+	} {
+		// Clicking the current column flips its direction; any other
+		// column starts ascending. Either way the list returns to page 1.
+		next := userList{search: l.search, sort: col.sort, page: 1}
+		column := userListColumn{Label: col.label}
+		if col.sort == l.sort {
+			next.descending = !l.descending
+			column.Arrow = " ▲"
+			if l.descending {
+				column.Arrow = " ▼"
+			}
+		}
+		column.Link = next.link()
+		v.Columns = append(v.Columns, column)
+	}
+	if l.page > 1 {
+		prev := l
+		prev.page = min(l.page-1, v.Pages)
+		v.PrevLink = prev.link()
+	}
+	if l.page < v.Pages {
+		next := l
+		next.page = l.page + 1
+		v.NextLink = next.link()
+	}
+	unfiltered := l
+	unfiltered.search, unfiltered.page = "", 1
+	v.ClearLink = unfiltered.link()
+	return v
+}
@@ -0,0 +1,152 @@
+package sip
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// staleCallAge is how long an answered call stays counted without its BYE
+// being seen, for calls whose BYE took another path or was lost.
+const staleCallAge = 24 * time.Hour
+
+// callAdmission counts the calls in progress, globally and per user, so that
+// new calls can be refused at the configured limits. A call is counted from
+// its initial INVITE until its final error response or, once answered, its
+// BYE. It belongs to the transaction user's goroutine.
+type callAdmission struct {
+	pending  map[string]*admittedCall // keyed by server transaction ID
+	answered map[string]*admittedCall // keyed by Call-ID
+	users    map[string]int           // calls in progress per user@domain
+	total    int
+	metrics  *Metrics
+	now      func() time.Time
+}
+
+// admittedCall is one counted call and the users it counts against.
+type admittedCall struct {
+	callID   string
+	parties  []string
+	answered time.Time
+}
+
+func newCallAdmission() *callAdmission {
+	return &callAdmission{
+		pending:  make(map[string]*admittedCall),
+		answered: make(map[string]*admittedCall),
+		users:    make(map[string]int),
+		now:      time.Now,
+	}
+}
+
+// active returns the number of calls in progress.
+func (a *callAdmission) active() int {
+	return a.total
+}
+
+// admit counts the initial INVITE received on serverTxID against parties,
+// the users placing and receiving it, unless one of them is already
+// in as many calls as limit allows, and reports whether it did.
+func (a *callAdmission) admit(serverTxID string, req *Message, parties []string, limit func(party string) int) bool {
+	a.prune()
+	for _, party := range parties {
+		if max := limit(party); max > 0 && a.users[party] >= max {
+			return false
+		}
+	}
+	call := &admittedCall{callID: req.GetHeader("Call-ID"), parties: parties}
+	if old, ok := a.pending[serverTxID]; ok {
+		a.release(old)
+	}
+	a.pending[serverTxID] = call
+	for _, party := range parties {
+		a.users[party]++
+	}
+	a.total++
+	a.metrics.callsActive(a.total)
+	return true
+}
+
+// finish records the final response sent on serverTxID: an answered call
+// stays counted until its BYE, and a failed one is released.
+func (a *callAdmission) finish(serverTxID string, status int) {
+	call, ok := a.pending[serverTxID]
+	if !ok || status < 200 {
+		return
+	}
+	delete(a.pending, serverTxID)
+	if status >= 300 || call.callID == "" {
+		a.release(call)
+		return
+	}
+	call.answered = a.now()
+	if old, ok := a.answered[call.callID]; ok {
+		a.release(old)
+	}
+	a.answered[call.callID] = call
+}
+
+// hangup releases the answered call a BYE for callID ends.
+func (a *callAdmission) hangup(callID string) {
+	if call, ok := a.answered[callID]; ok {
+		delete(a.answered, callID)
+		a.release(call)
+	}
+}
+
+// prune releases answered calls older than staleCallAge.
+func (a *callAdmission) prune() {
+	cutoff := a.now().Add(-staleCallAge)
+	for callID, call := range a.answered {
+		if call.answered.Before(cutoff) {
+			delete(a.answered, callID)
+			a.release(call)
+		}
+	}
+}
+
+func (a *callAdmission) release(call *admittedCall) {
+	for _, party := range call.parties {
+		if a.users[party]--; a.users[party] <= 0 {
+			delete(a.users, party)
+		}
+	}
+	a.total--
+	a.metrics.callsActive(a.total)
+}
+
+// admitCall counts an initial INVITE against the call limits of the users
+// placing and receiving it, answering it with 486 Busy Here when either is at
+// their limit, and reports whether it did. The callee is the user the
+// Request-URI names before their forwarding settings apply. Without a
+// registrar only the global count is kept.
+func (t *transactionUser) admitCall(ctx context.Context, event tuEvent, req *Message) bool {
+	if t.admission == nil || !isInitialInvite(req) {
+		return false
+	}
+	var parties []string
+	if t.registrar != nil {
+		if user, domain, err := parseAddressOfRecord(req.GetHeader("From")); err == nil {
+			parties = append(parties, registrarKey(user, t.registrar.canonicalDomain(domain)))
+		}
+		if uri, err := ParseURI(req.RequestURI); err == nil && uri.User != "" {
+			if callee := registrarKey(uri.User, t.registrar.canonicalDomain(uri.Host)); !slices.Contains(parties, callee) {
+				parties = append(parties, callee)
+			}
+		}
+	}
+	limit := func(party string) int {
+		user, domain, _ := strings.Cut(party, "@")
+		return t.registrar.UserSettings(req.Context(), user, domain).CallLimit()
+	}
+	if !t.admission.admit(event.ServerTxID, req, parties, limit) {
+		t.metrics.callLimitRejected()
+		resp := NewResponse(486, "Busy Here")
+		CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+		ensureToTag(resp)
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package sip
+
+import (
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// sendCall sends an initial INVITE to bob with its own Call-ID and returns
+// the request the proxy forwarded, or the response it answered with.
+func sendCall(t *testing.T, proxy *Proxy, id string) (*Message, *Message) {
+	t.Helper()
+	invite := newInvite()
+	invite.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+id)
+	invite.SetHeader("Call-ID", id+"@client.example")
+	proxy.SendFromClient(invite)
+	if forwarded, ok := proxy.NextToServer(100 * time.Millisecond); ok {
+		return forwarded, nil
+	}
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected call %s to be forwarded or answered", id)
+	}
+	return nil, resp
+}
+
+func TestProxyEnforcesPerUserCallLimit(t *testing.T) {
+	store := newMemoryStore()
+	store.settings[registrarKey("bob", "example.com")] = userdb.UserSettings{userdb.SettingCallLimit: "1"}
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)))
+	t.Cleanup(proxy.Stop)
+
+	first, _ := sendCall(t, proxy, "first")
+	if first == nil {
+		t.Fatalf("expected the first call to bob to be forwarded")
+	}
+	if _, resp := sendCall(t, proxy, "second"); resp == nil || resp.StatusCode != 486 {
+		t.Fatalf("expected 486 once bob is at the call limit, got %v", resp)
+	}
+
+	answer := buildResponseFrom(first, 200, "OK")
+	answer.SetHeader("To", "<sip:bob@example.com>;tag=bob1")
+	proxy.SendFromServer(answer)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the answer downstream, got %v", resp)
+	}
+	if _, resp := sendCall(t, proxy, "third"); resp == nil || resp.StatusCode != 486 {
+		t.Fatalf("expected the answered call to stay counted, got %v", resp)
+	}
+
+	bye := NewRequest("BYE", "sip:bob@client.example.com")
+	bye.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKbye")
+	bye.SetHeader("From", first.GetHeader("From"))
+	bye.SetHeader("To", "<sip:bob@example.com>;tag=bob1")
+	bye.SetHeader("Call-ID", "first@client.example")
+	bye.SetHeader("CSeq", "314160 BYE")
+	bye.SetHeader("Max-Forwards", "70")
+	proxy.SendFromClient(bye)
+	if msg, ok := proxy.NextToServer(100 * time.Millisecond); !ok || msg.Method != "BYE" {
+		t.Fatalf("expected the BYE to be forwarded, got %v", msg)
+	}
+	if forwarded, resp := sendCall(t, proxy, "fourth"); forwarded == nil {
+		t.Fatalf("expected a call after the BYE to be admitted, got %v", resp)
+	}
+}
+
+func TestProxyRefusesCallsAboveGlobalLimit(t *testing.T) {
+	proxy := NewProxy(WithOverloadControl(OverloadConfig{MaxCalls: 1}))
+	t.Cleanup(proxy.Stop)
+
+	first, _ := sendCall(t, proxy, "first")
+	if first == nil {
+		t.Fatalf("expected the first call to be forwarded")
+	}
+	if _, resp := sendCall(t, proxy, "second"); resp == nil || resp.StatusCode != 503 {
+		t.Fatalf("expected 503 at the global call limit, got %v", resp)
+	}
+	proxy.SendFromServer(buildResponseFrom(first, 486, "Busy Here"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 486 {
+		t.Fatalf("expected the failure downstream, got %v", resp)
+	}
+	if forwarded, resp := sendCall(t, proxy, "third"); forwarded == nil {
+		t.Fatalf("expected a call after the failed one to be admitted, got %v", resp)
+	}
+}
@@ -0,0 +1,81 @@
+package sip
+
+import (
+	"errors"
+	"net"
+)
+
+// batchSize is the most datagrams one batched read or write moves.
+const batchSize = 32
+
+// errBatchUnsupported reports that the platform fast path cannot handle a
+// batch, so the portable path must be used instead.
+var errBatchUnsupported = errors.New("sip: batched datagram I/O unsupported")
+
+// batchMessage is one datagram of a batch. For a write Buf is the payload and
+// Addr the destination; for a read Buf receives the datagram and N and Addr
+// are set to its length and source.
+type batchMessage struct {
+	Buf  []byte
+	N    int
+	Addr net.Addr
+}
+
+// batchConn reads and writes several datagrams per system call where the
+// platform supports it (recvmmsg and sendmmsg on Linux) and one at a time
+// through the net.PacketConn elsewhere, or whenever the fast path is
+// unavailable. One goroutine may read while another writes, but neither
+// ReadBatch nor WriteBatch may be called concurrently with itself.
+type batchConn struct {
+	conn net.PacketConn
+	sys  *mmsgConn
+}
+
+func newBatchConn(conn net.PacketConn) *batchConn {
+	return &batchConn{conn: conn, sys: newMmsgConn(conn)}
+}
+
+// ReadBatch waits for at least one datagram and fills msgs with as many as
+// are available, returning how many were read.
+func (c *batchConn) ReadBatch(msgs []batchMessage) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if c.sys != nil {
+		n, err := c.sys.readBatch(msgs)
+		if !errors.Is(err, errBatchUnsupported) {
+			return n, err
+		}
+	}
+	n, addr, err := c.conn.ReadFrom(msgs[0].Buf)
+	if err != nil {
+		return 0, err
+	}
+	msgs[0].N, msgs[0].Addr = n, addr
+	return 1, nil
+}
+
+// WriteBatch sends msgs in order. It returns how many were sent before the
+// first failure; err describes the failure of msgs[n].
+func (c *batchConn) WriteBatch(msgs []batchMessage) (int, error) {
+	sent := 0
+	for sent < len(msgs) {
+		if c.sys == nil {
+			break
+		}
+		n, err := c.sys.writeBatch(msgs[sent:])
+		if errors.Is(err, errBatchUnsupported) {
+			break
+		}
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	for ; sent < len(msgs); sent++ {
+		if _, err := c.conn.WriteTo(msgs[sent].Buf, msgs[sent].Addr); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
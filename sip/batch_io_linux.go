@@ -0,0 +1,243 @@
+package sip
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	Hdr syscall.Msghdr
+	Len uint32
+}
+
+// mmsgConn moves batches of datagrams with recvmmsg and sendmmsg. Each
+// direction keeps its own scratch headers, so one reader and one writer can
+// use it at the same time.
+type mmsgConn struct {
+	raw    syscall.RawConn
+	family int
+	// disabled is set once the kernel rejects the system calls, after which
+	// every batch takes the portable path.
+	disabled atomic.Bool
+
+	read  mmsgScratch
+	write mmsgScratch
+}
+
+type mmsgScratch struct {
+	hdrs  [batchSize]mmsghdr
+	iovs  [batchSize]syscall.Iovec
+	names [batchSize]syscall.RawSockaddrAny
+}
+
+// newMmsgConn returns a batching wrapper for a UDP socket, or nil when conn
+// is not one.
+func newMmsgConn(conn net.PacketConn) *mmsgConn {
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var sa syscall.Sockaddr
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sa, sockErr = syscall.Getsockname(int(fd))
+	}); err != nil || sockErr != nil {
+		return nil
+	}
+	c := &mmsgConn{raw: raw}
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		c.family = syscall.AF_INET
+	case *syscall.SockaddrInet6:
+		c.family = syscall.AF_INET6
+	default:
+		return nil
+	}
+	return c
+}
+
+func (c *mmsgConn) readBatch(msgs []batchMessage) (int, error) {
+	if c.disabled.Load() {
+		return 0, errBatchUnsupported
+	}
+	s := &c.read
+	count := min(len(msgs), batchSize)
+	for i := 0; i < count; i++ {
+		s.prepare(i, msgs[i].Buf)
+		s.hdrs[i].Hdr.Namelen = syscall.SizeofSockaddrAny
+	}
+	var got int
+	var errno syscall.Errno
+	err := c.raw.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(count), 0, 0, 0)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+			got, errno = int(r), e
+			return true
+		}
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, c.failed("recvmmsg", errno)
+	}
+	for i := 0; i < got; i++ {
+		msgs[i].N = int(s.hdrs[i].Len)
+		msgs[i].Addr = udpAddrFromRaw(&s.names[i])
+	}
+	return got, nil
+}
+
+func (c *mmsgConn) writeBatch(msgs []batchMessage) (int, error) {
+	if c.disabled.Load() {
+		return 0, errBatchUnsupported
+	}
+	s := &c.write
+	count := min(len(msgs), batchSize)
+	for i := 0; i < count; i++ {
+		namelen, ok := s.encodeAddr(i, c.family, msgs[i].Addr)
+		if !ok {
+			if i == 0 {
+				return 0, errBatchUnsupported
+			}
+			count = i
+			break
+		}
+		s.prepare(i, msgs[i].Buf)
+		s.hdrs[i].Hdr.Namelen = namelen
+	}
+	var sent int
+	var errno syscall.Errno
+	err := c.raw.Write(func(fd uintptr) bool {
+		for {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(count), 0, 0, 0)
+			switch e {
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				return false
+			}
+			sent, errno = int(r), e
+			return true
+		}
+	})
+	runtime.KeepAlive(msgs)
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, c.failed("sendmmsg", errno)
+	}
+	return sent, nil
+}
+
+// failed turns errno into an error, switching to the portable path for good
+// when the kernel does not implement the call.
+func (c *mmsgConn) failed(call string, errno syscall.Errno) error {
+	if errno == syscall.ENOSYS {
+		c.disabled.Store(true)
+		return errBatchUnsupported
+	}
+	return os.NewSyscallError(call, errno)
+}
+
+// prepare points header i at buf.
+func (s *mmsgScratch) prepare(i int, buf []byte) {
+	iov := &s.iovs[i]
+	iov.Base = nil
+	if len(buf) > 0 {
+		iov.Base = &buf[0]
+	}
+	iov.SetLen(len(buf))
+	hdr := &s.hdrs[i]
+	hdr.Hdr = syscall.Msghdr{
+		Name: (*byte)(unsafe.Pointer(&s.names[i])),
+		Iov:  iov,
+	}
+	hdr.Hdr.Iovlen = 1
+	hdr.Len = 0
+}
+
+// encodeAddr writes addr into name i in the socket's address family,
+// reporting false for an address the socket cannot send to.
+func (s *mmsgScratch) encodeAddr(i, family int, addr net.Addr) (uint32, bool) {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok || udp == nil {
+		return 0, false
+	}
+	name := unsafe.Pointer(&s.names[i])
+	if family == syscall.AF_INET {
+		ip := udp.IP.To4()
+		if ip == nil {
+			return 0, false
+		}
+		sa := (*syscall.RawSockaddrInet4)(name)
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		putPort(&sa.Port, udp.Port)
+		copy(sa.Addr[:], ip)
+		return syscall.SizeofSockaddrInet4, true
+	}
+	ip := udp.IP.To16()
+	if ip == nil {
+		return 0, false
+	}
+	sa := (*syscall.RawSockaddrInet6)(name)
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	putPort(&sa.Port, udp.Port)
+	copy(sa.Addr[:], ip)
+	if udp.Zone != "" {
+		if index, err := strconv.Atoi(udp.Zone); err == nil {
+			sa.Scope_id = uint32(index)
+		} else if ifi, err := net.InterfaceByName(udp.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6, true
+}
+
+// putPort stores port in network byte order.
+func putPort(field *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(field))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
+
+// udpAddrFromRaw decodes the source address recvmmsg stored.
+func udpAddrFromRaw(raw *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch raw.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]).To4(), Port: int(port[0])<<8 | int(port[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(raw))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		addr := &net.UDPAddr{IP: make(net.IP, net.IPv6len), Port: int(port[0])<<8 | int(port[1])}
+		copy(addr.IP, sa.Addr[:])
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	default:
+		return &net.UDPAddr{}
+	}
+}
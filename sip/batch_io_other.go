@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sip
+
+import "net"
+
+// mmsgConn is the batching fast path, which only Linux provides.
+type mmsgConn struct{}
+
+func newMmsgConn(net.PacketConn) *mmsgConn { return nil }
+
+func (*mmsgConn) readBatch([]batchMessage) (int, error) { return 0, errBatchUnsupported }
+
+func (*mmsgConn) writeBatch([]batchMessage) (int, error) { return 0, errBatchUnsupported }
@@ -0,0 +1,236 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// ErrInvalidBody is returned when a message body does not match its
+// Content-Type.
+var ErrInvalidBody = errors.New("invalid SIP message body")
+
+// bodyHeaders are the message headers that describe the body rather than the
+// message, and so move into a part when a single body becomes one part of
+// several, and back out again.
+var bodyHeaders = []string{"Content-Type", "Content-Disposition", "Content-Encoding", "Content-Language"}
+
+// BodyPart is one part of a message body: an SDP offer, an ISUP payload, a
+// PIDF-LO document, and so on. Header holds the part's MIME headers, such as
+// Content-Type and Content-Disposition, and Body its content.
+type BodyPart struct {
+	Header textproto.MIMEHeader
+	Body   string
+}
+
+// NewBodyPart returns a part of the given Content-Type holding body.
+func NewBodyPart(contentType, body string) BodyPart {
+	header := make(textproto.MIMEHeader)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return BodyPart{Header: header, Body: body}
+}
+
+// MediaType returns the part's media type in lower case without parameters,
+// such as "application/sdp", or "" when it has no valid Content-Type.
+func (p BodyPart) MediaType() string {
+	mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// ContentType parses the Content-Type header into its lower-case media type
+// and parameters. A message without one has the media type "".
+func (m *Message) ContentType() (string, map[string]string, error) {
+	raw := m.GetHeader("Content-Type")
+	if strings.TrimSpace(raw) == "" {
+		return "", nil, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: Content-Type %q: %v", ErrInvalidBody, raw, err)
+	}
+	return mediaType, params, nil
+}
+
+// SetBody replaces the body and its Content-Type, keeping Content-Length
+// consistent. An empty body removes the Content-Type.
+func (m *Message) SetBody(contentType, body string) {
+	m.Body = body
+	if body == "" || contentType == "" {
+		m.DelHeader("Content-Type")
+	} else {
+		m.SetHeader("Content-Type", contentType)
+	}
+	m.EnsureContentLength()
+}
+
+// BodyParts returns the parts of a multipart body in order. Any other
+// non-empty body is returned as a single part carrying the message's
+// Content-Type and other body headers, so a handler looking for, say, the
+// SDP need not care whether it was sent alone. Nested multipart parts are
+// returned whole.
+func (m *Message) BodyParts() ([]BodyPart, error) {
+	mediaType, params, err := m.ContentType()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if m.Body == "" {
+			return nil, nil
+		}
+		header := make(textproto.MIMEHeader)
+		for _, name := range bodyHeaders {
+			if values := m.HeaderValues(name); len(values) > 0 {
+				header[name] = values
+			}
+		}
+		return []BodyPart{{Header: header, Body: m.Body}}, nil
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: %s without boundary", ErrInvalidBody, mediaType)
+	}
+	reader := multipart.NewReader(strings.NewReader(m.Body), boundary)
+	var parts []BodyPart
+	for {
+		// NextRawPart leaves a quoted-printable part encoded, since the
+		// part is forwarded as it arrived.
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+		}
+		parts = append(parts, BodyPart{Header: part.Header, Body: string(body)})
+	}
+}
+
+// BodyPart returns the first part of the given media type, for example
+// "application/sdp". It reports false when there is none or the body cannot
+// be parsed.
+func (m *Message) BodyPart(mediaType string) (BodyPart, bool) {
+	parts, err := m.BodyParts()
+	if err != nil {
+		return BodyPart{}, false
+	}
+	for _, part := range parts {
+		if strings.EqualFold(part.MediaType(), mediaType) {
+			return part, true
+		}
+	}
+	return BodyPart{}, false
+}
+
+// SetBodyParts replaces the body with parts and keeps Content-Type and
+// Content-Length consistent with it. No parts leave an empty body. A single
+// part becomes the whole body, its headers becoming the message's body
+// headers. Several parts are encoded as multipart/mixed, or under the
+// message's current multipart type, reusing its boundary when no part
+// contains it; the preamble and epilogue of a received body are not kept.
+func (m *Message) SetBodyParts(parts []BodyPart) error {
+	switch len(parts) {
+	case 0:
+		for _, name := range bodyHeaders {
+			m.DelHeader(name)
+		}
+		m.Body = ""
+		m.EnsureContentLength()
+		return nil
+	case 1:
+		for _, name := range bodyHeaders {
+			if values := parts[0].Header.Values(name); len(values) > 0 {
+				m.SetHeader(name, values...)
+			} else {
+				m.DelHeader(name)
+			}
+		}
+		m.Body = parts[0].Body
+		m.EnsureContentLength()
+		return nil
+	}
+	return m.setMultipartBody(parts)
+}
+
+// setMultipartBody encodes parts as the message's multipart body.
+func (m *Message) setMultipartBody(parts []BodyPart) error {
+	mediaType, params, err := m.ContentType()
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		mediaType, params = "multipart/mixed", map[string]string{}
+	}
+	var body strings.Builder
+	writer := multipart.NewWriter(&body)
+	if boundary := params["boundary"]; boundary != "" && !partsContain(parts, boundary) {
+		if err := writer.SetBoundary(boundary); err != nil {
+			writer = multipart.NewWriter(&body)
+		}
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, part.Body); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	params["boundary"] = writer.Boundary()
+	contentType := mime.FormatMediaType(mediaType, params)
+	if contentType == "" {
+		contentType = mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()})
+	}
+	m.SetHeader("Content-Type", contentType)
+	for _, name := range bodyHeaders[1:] {
+		m.DelHeader(name)
+	}
+	m.Body = body.String()
+	m.EnsureContentLength()
+	return nil
+}
+
+// ReplaceBodyPart replaces the content of the first part of the given media
+// type, leaving the other parts and the body's structure as they were, and
+// reports whether there was such a part.
+func (m *Message) ReplaceBodyPart(mediaType, body string) (bool, error) {
+	parts, err := m.BodyParts()
+	if err != nil {
+		return false, err
+	}
+	for i, part := range parts {
+		if !strings.EqualFold(part.MediaType(), mediaType) {
+			continue
+		}
+		parts[i].Body = body
+		if current, _, _ := m.ContentType(); strings.HasPrefix(current, "multipart/") {
+			return true, m.setMultipartBody(parts)
+		}
+		return true, m.SetBodyParts(parts)
+	}
+	return false, nil
+}
+
+// partsContain reports whether any part's body contains the boundary
+// delimiter, which would cut the part short.
+func partsContain(parts []BodyPart, boundary string) bool {
+	for _, part := range parts {
+		if strings.Contains(part.Body, "--"+boundary) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,9 @@
 package sip
 
-import "strings"
+import (
+	"strings"
+	"sync"
+)
 
 // BroadcastRule describes a broadcast-enabled address and the contact URIs that
 // should ring in parallel when that address receives an INVITE.
@@ -10,14 +13,44 @@ type BroadcastRule struct {
 }
 
 // BroadcastPolicy exposes broadcast ringing targets keyed by their address of
-// record.
+// record. The rule set may be swapped at runtime with Replace, and addresses
+// of one domain looked up among the rules of another with SetNamespaces.
 type BroadcastPolicy struct {
+	mu      sync.RWMutex
 	targets map[string][]string
+	// namespaces maps a domain to the domain whose rules apply to it.
+	namespaces map[string]string
 }
 
 // NewBroadcastPolicy builds a BroadcastPolicy from the supplied rules.
 func NewBroadcastPolicy(rules []BroadcastRule) *BroadcastPolicy {
-	policy := &BroadcastPolicy{targets: make(map[string][]string)}
+	return &BroadcastPolicy{targets: buildBroadcastTargets(rules)}
+}
+
+// Replace atomically swaps the configured rules for the supplied set.
+func (p *BroadcastPolicy) Replace(rules []BroadcastRule) {
+	if p == nil {
+		return
+	}
+	targets := buildBroadcastTargets(rules)
+	p.mu.Lock()
+	p.targets = targets
+	p.mu.Unlock()
+}
+
+// SetNamespaces makes the rules of the domain namespaces maps a domain to
+// apply to addresses in that domain instead of the domain's own.
+func (p *BroadcastPolicy) SetNamespaces(namespaces map[string]string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.namespaces = namespaces
+	p.mu.Unlock()
+}
+
+func buildBroadcastTargets(rules []BroadcastRule) map[string][]string {
+	out := make(map[string][]string)
 	for _, rule := range rules {
 		addr := normaliseBroadcastAddress(rule.Address)
 		if addr == "" {
@@ -33,18 +66,23 @@ func NewBroadcastPolicy(rules []BroadcastRule) *BroadcastPolicy {
 		}
 		copyTargets := make([]string, len(cleaned))
 		copy(copyTargets, cleaned)
-		policy.targets[addr] = copyTargets
+		out[addr] = copyTargets
 	}
-	return policy
+	return out
 }
 
 // Targets returns a copy of the broadcast targets configured for the given
 // address. The lookup is case-insensitive and ignores surrounding whitespace.
 func (p *BroadcastPolicy) Targets(address string) []string {
-	if p == nil || len(p.targets) == 0 {
+	if p == nil {
 		return nil
 	}
-	addr := normaliseBroadcastAddress(address)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.targets) == 0 {
+		return nil
+	}
+	addr := p.namespaced(normaliseBroadcastAddress(address))
 	if addr == "" {
 		return nil
 	}
@@ -59,10 +97,15 @@ func (p *BroadcastPolicy) Targets(address string) []string {
 
 // Has reports whether the policy defines a broadcast rule for the provided address.
 func (p *BroadcastPolicy) Has(address string) bool {
-	if p == nil || len(p.targets) == 0 {
+	if p == nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.targets) == 0 {
 		return false
 	}
-	addr := normaliseBroadcastAddress(address)
+	addr := p.namespaced(normaliseBroadcastAddress(address))
 	if addr == "" {
 		return false
 	}
@@ -77,3 +120,21 @@ func normaliseBroadcastAddress(address string) string {
 	}
 	return strings.ToLower(trimmed)
 }
+
+// namespaced moves a normalised address into the namespace of its domain.
+// p.mu must be held.
+func (p *BroadcastPolicy) namespaced(addr string) string {
+	if len(p.namespaces) == 0 || addr == "" {
+		return addr
+	}
+	uri, err := ParseURI(addr)
+	if err != nil {
+		return addr
+	}
+	namespace, ok := p.namespaces[uri.Host]
+	if !ok {
+		return addr
+	}
+	uri.Host = namespace
+	return uri.String()
+}
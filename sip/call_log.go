@@ -0,0 +1,196 @@
+package sip
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCallLogSize is how many calls a CallLog remembers when no size is
+// given.
+const defaultCallLogSize = 1000
+
+// CallRecord summarises one call attempt seen by the proxy. Caller and Callee
+// are "user@domain" taken from the From and To headers of the initial INVITE,
+// lower-cased. Status is the final response sent to the caller, or zero while
+// the call is still being set up. Answered is set for 2xx answers and Ended
+// when the call finished: at the final response for failed attempts, or at
+// the first BYE for answered calls.
+type CallRecord struct {
+	CallID   string
+	Caller   string
+	Callee   string
+	Started  time.Time
+	Answered time.Time
+	Ended    time.Time
+	Status   int
+	// Route is the trunk, as user@domain, the call was last sent through
+	// by the dial plan, or empty.
+	Route string
+}
+
+// CallLog keeps the most recent calls in memory, oldest dropped first. It is
+// safe for concurrent use.
+type CallLog struct {
+	mu      sync.Mutex
+	records []*CallRecord
+	next    int
+	full    bool
+	pending map[string]*CallRecord // keyed by server transaction ID
+	byCall  map[string]*CallRecord // keyed by Call-ID
+	now     func() time.Time
+}
+
+// NewCallLog returns a log remembering up to size calls, or a default number
+// when size is not positive.
+func NewCallLog(size int) *CallLog {
+	if size <= 0 {
+		size = defaultCallLogSize
+	}
+	return &CallLog{
+		records: make([]*CallRecord, size),
+		pending: make(map[string]*CallRecord),
+		byCall:  make(map[string]*CallRecord),
+		now:     time.Now,
+	}
+}
+
+// begin records an initial INVITE received on serverTxID and returns the new
+// record.
+func (l *CallLog) begin(serverTxID string, req *Message) (CallRecord, bool) {
+	if l == nil || req == nil || serverTxID == "" {
+		return CallRecord{}, false
+	}
+	record := &CallRecord{
+		CallID:  req.GetHeader("Call-ID"),
+		Caller:  callParty(req.GetHeader("From")),
+		Callee:  callParty(req.GetHeader("To")),
+		Started: l.now(),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old := l.records[l.next]; old != nil {
+		l.forget(old)
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.pending[serverTxID] = record
+	if record.CallID != "" {
+		l.byCall[record.CallID] = record
+	}
+	return *record, true
+}
+
+// finish records the first final response sent on serverTxID and returns the
+// updated record.
+func (l *CallLog) finish(serverTxID string, status int) (CallRecord, bool) {
+	if l == nil || status < 200 {
+		return CallRecord{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record, ok := l.pending[serverTxID]
+	if !ok {
+		return CallRecord{}, false
+	}
+	delete(l.pending, serverTxID)
+	record.Status = status
+	if status < 300 {
+		record.Answered = l.now()
+		return *record, true
+	}
+	record.Ended = l.now()
+	delete(l.byCall, record.CallID)
+	return *record, true
+}
+
+// route records that the INVITE received on serverTxID is being sent
+// through trunk.
+func (l *CallLog) route(serverTxID, trunk string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if record, ok := l.pending[serverTxID]; ok {
+		record.Route = trunk
+	}
+}
+
+// hangup records a BYE for callID and returns the ended record. It reports
+// false when the call is unknown or had already ended.
+func (l *CallLog) hangup(callID string) (CallRecord, bool) {
+	if l == nil || callID == "" {
+		return CallRecord{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record, ok := l.byCall[callID]
+	if !ok {
+		return CallRecord{}, false
+	}
+	delete(l.byCall, callID)
+	if !record.Ended.IsZero() {
+		return CallRecord{}, false
+	}
+	record.Ended = l.now()
+	return *record, true
+}
+
+// forget drops an evicted record from the lookup maps.
+func (l *CallLog) forget(record *CallRecord) {
+	for id, pending := range l.pending {
+		if pending == record {
+			delete(l.pending, id)
+		}
+	}
+	if l.byCall[record.CallID] == record {
+		delete(l.byCall, record.CallID)
+	}
+}
+
+// Recent returns up to limit calls placed or received by username@domain,
+// newest first. A limit of zero returns every remembered call of the user.
+func (l *CallLog) Recent(username, domain string, limit int) []CallRecord {
+	if l == nil {
+		return nil
+	}
+	party := registrarKey(username, domain)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.records)
+	}
+	var out []CallRecord
+	for i := 1; i <= count; i++ {
+		record := l.records[(l.next-i+len(l.records))%len(l.records)]
+		if record.Caller != party && record.Callee != party {
+			continue
+		}
+		out = append(out, *record)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out
+}
+
+// callParty reduces a From or To header to "user@domain", or "" when it has
+// no user part.
+func callParty(header string) string {
+	user, domain, err := parseAddressOfRecord(header)
+	if err != nil {
+		return ""
+	}
+	return registrarKey(user, domain)
+}
+
+// isInitialInvite reports whether req starts a dialog rather than refreshing
+// one.
+func isInitialInvite(req *Message) bool {
+	return strings.EqualFold(req.Method, "INVITE") && !strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=")
+}
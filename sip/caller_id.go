@@ -0,0 +1,133 @@
+package sip
+
+import (
+	"strings"
+	"sync"
+
+	"xylitol4/sip/userdb"
+)
+
+// CallerIDRules rewrites the From header of requests leaving through a
+// trunk, and optionally adds P-Preferred-Identity, so that providers receive
+// the numbers they require. It is safe for concurrent use.
+type CallerIDRules struct {
+	mu    sync.RWMutex
+	rules []userdb.CallerIDRule
+}
+
+// NewCallerIDRules returns CallerIDRules holding rules.
+func NewCallerIDRules(rules []userdb.CallerIDRule) *CallerIDRules {
+	c := &CallerIDRules{}
+	c.Replace(rules)
+	return c
+}
+
+// Replace atomically swaps the rules for the supplied set.
+func (c *CallerIDRules) Replace(rules []userdb.CallerIDRule) {
+	if c == nil {
+		return
+	}
+	rules = append([]userdb.CallerIDRule(nil), rules...)
+	c.mu.Lock()
+	c.rules = rules
+	c.mu.Unlock()
+}
+
+// match returns the most specific rule for calls from caller, as
+// user@domain, through trunk: an exact caller beats the caller's domain,
+// which beats every caller, then a rule naming the trunk beats one for every
+// trunk, and the earliest rule wins a tie.
+func (c *CallerIDRules) match(caller, trunk string) (userdb.CallerIDRule, bool) {
+	_, domain, _ := strings.Cut(caller, "@")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var best userdb.CallerIDRule
+	bestScore := 0
+	for _, rule := range c.rules {
+		var score int
+		switch rule.Caller {
+		case caller:
+			score = 6
+		case domain:
+			score = 4
+		case "":
+			score = 2
+		default:
+			continue
+		}
+		switch {
+		case rule.Trunk == "":
+		case strings.EqualFold(rule.Trunk, trunk):
+			score++
+		default:
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// apply rewrites the From header of req, an out-of-dialog request other than
+// ACK on its way to a trunk, by the rule matching its caller and trunk,
+// reporting whether it did. The tag and other header parameters are kept, so
+// the dialog is unaffected.
+func (c *CallerIDRules) apply(req *Message) bool {
+	if c == nil || req.trunkName == "" || strings.EqualFold(req.Method, "ACK") || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return false
+	}
+	display, uri, params, ok := splitNameAddr(req.GetHeader("From"))
+	if !ok || uri.User == "" {
+		return false
+	}
+	rule, ok := c.match(strings.ToLower(uri.User+"@"+uri.Host), req.trunkName)
+	if !ok {
+		return false
+	}
+	if rule.DisplayName != "" {
+		display = `"` + rule.DisplayName + `"`
+	}
+	if rule.User != "" {
+		uri.User = rule.User
+	}
+	if rule.Host != "" {
+		uri.Host = rule.Host
+		uri.Port = 0
+	}
+	address := "<" + uri.String() + ">"
+	if display != "" {
+		address = display + " " + address
+	}
+	req.SetHeader("From", address+params)
+	if rule.PreferredIdentity {
+		req.SetHeader("P-Preferred-Identity", address)
+	}
+	return true
+}
+
+// splitNameAddr splits a From or To header value into its display name, as
+// written, its URI, and its header parameters, including the leading ';'.
+func splitNameAddr(value string) (string, *URI, string, bool) {
+	value = strings.TrimSpace(value)
+	var display, raw, params string
+	if start := quotedIndexByte(value, '<'); start >= 0 {
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return "", nil, "", false
+		}
+		display = strings.TrimSpace(value[:start])
+		raw = value[start+1 : start+end]
+		params = value[start+end+1:]
+	} else {
+		raw = value
+		if i := strings.IndexByte(value, ';'); i >= 0 {
+			raw, params = value[:i], value[i:]
+		}
+	}
+	uri, err := ParseURI(raw)
+	if err != nil {
+		return "", nil, "", false
+	}
+	return display, uri, strings.TrimSpace(params), true
+}
@@ -0,0 +1,72 @@
+package sip
+
+import (
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestProxyRewritesCallerIDOnTrunkCalls(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{
+		{Registrar: "203.0.113.5", Domain: "provider.example", Username: "main"},
+		{Registrar: "203.0.113.6", Domain: "other.example", Username: "backup"},
+	})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{
+		{Prefix: "0", Trunk: "main@provider.example"},
+		{Prefix: "9", Trunk: "backup@other.example"},
+	}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	rules := NewCallerIDRules([]userdb.CallerIDRule{
+		{ID: 1, Caller: "example.com", User: "0312345678", Host: "provider.example", PreferredIdentity: true},
+		{ID: 2, Caller: "alice@example.com", Trunk: "main@provider.example", DisplayName: "Sales", User: "0312340001", Host: "provider.example"},
+		{ID: 3, Caller: "alice@example.com", User: "0399999999"},
+	})
+	proxy := NewProxy(WithDialPlan(plan), WithCallerIDRules(rules))
+	t.Cleanup(proxy.Stop)
+
+	for _, tt := range []struct{ dialed, from, ppi string }{
+		{"0311112222", `"Sales" <sip:0312340001@provider.example>;tag=1928301774`, ""},
+		{"9311112222", `"Alice" <sip:0399999999@example.com>;tag=1928301774`, ""},
+	} {
+		invite := newInvite()
+		invite.RequestURI = "sip:" + tt.dialed + "@example.com"
+		invite.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+tt.dialed)
+		invite.SetHeader("Call-ID", tt.dialed+"@client.example")
+		proxy.SendFromClient(invite)
+		for {
+			msg, ok := proxy.NextToServer(200 * time.Millisecond)
+			if !ok {
+				t.Fatalf("expected the INVITE to %s to be forwarded", tt.dialed)
+			}
+			if msg.Method != "INVITE" || msg.GetHeader("Call-ID") != tt.dialed+"@client.example" {
+				continue
+			}
+			if got := msg.GetHeader("From"); got != tt.from {
+				t.Fatalf("INVITE to %s has From %q, want %q", tt.dialed, got, tt.from)
+			}
+			if got := msg.GetHeader("P-Preferred-Identity"); got != tt.ppi {
+				t.Fatalf("INVITE to %s has P-Preferred-Identity %q, want %q", tt.dialed, got, tt.ppi)
+			}
+			break
+		}
+	}
+
+	// The domain rule covers other callers, and requests not leaving
+	// through a trunk keep their caller ID.
+	req := newInvite()
+	req.SetHeader("From", "sip:bob@example.com;tag=77")
+	req.trunkName = "backup@other.example"
+	if !rules.apply(req) || req.GetHeader("From") != "<sip:0312345678@provider.example>;tag=77" || req.GetHeader("P-Preferred-Identity") != "<sip:0312345678@provider.example>" {
+		t.Fatalf("expected the domain rule to apply, got From %q, P-Preferred-Identity %q", req.GetHeader("From"), req.GetHeader("P-Preferred-Identity"))
+	}
+	local := newInvite()
+	if rules.apply(local) || local.GetHeader("From") != `"Alice" <sip:alice@example.com>;tag=1928301774` {
+		t.Fatalf("expected requests to local users to be left alone, got %q", local.GetHeader("From"))
+	}
+}
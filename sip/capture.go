@@ -0,0 +1,96 @@
+package sip
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// Packet is one datagram sent or received on one of the stack's sockets.
+type Packet struct {
+	Time time.Time
+	// Received is true for datagrams read from the network and false for
+	// datagrams the stack wrote.
+	Received bool
+	// Local is the address of the stack's socket and Remote the peer's.
+	Local  net.Addr
+	Remote net.Addr
+	Data   []byte
+	// Message is the parsed form of Data, or nil when it did not parse.
+	Message *Message
+}
+
+// Source returns the address the datagram was sent from.
+func (p Packet) Source() net.Addr {
+	if p.Received {
+		return p.Remote
+	}
+	return p.Local
+}
+
+// Destination returns the address the datagram was sent to.
+func (p Packet) Destination() net.Addr {
+	if p.Received {
+		return p.Local
+	}
+	return p.Remote
+}
+
+// endpoints returns the source and destination as UDP addresses for
+// exporters that must write both in one address family.
+func (p Packet) endpoints() (src, dst *net.UDPAddr) {
+	src, dst = udpAddrOf(p.Source()), udpAddrOf(p.Destination())
+	// A socket bound to every interface reports "::"; match the peer's
+	// family so IPv4 traffic is not exported as IPv6.
+	if src.IP.IsUnspecified() && dst.IP.To4() != nil {
+		src = &net.UDPAddr{IP: net.IPv4zero, Port: src.Port}
+	}
+	if dst.IP.IsUnspecified() && src.IP.To4() != nil {
+		dst = &net.UDPAddr{IP: net.IPv4zero, Port: dst.Port}
+	}
+	return src, dst
+}
+
+// udpAddrOf returns addr as a UDP address, using the unspecified IPv4
+// address when it has none.
+func udpAddrOf(addr net.Addr) *net.UDPAddr {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return &net.UDPAddr{IP: net.IPv4zero}
+	}
+	if udp.IP == nil {
+		return &net.UDPAddr{IP: net.IPv4zero, Port: udp.Port}
+	}
+	return udp
+}
+
+// PacketObserver is handed every datagram the stack sends or receives, for
+// capture and export. ObservePacket is called from the socket goroutines, so
+// it must not block and must not modify the packet.
+type PacketObserver interface {
+	ObservePacket(Packet)
+}
+
+// capture hands one datagram to the tracer and every packet observer. data
+// may be a pooled buffer, so observers are given their own copy.
+func (s *SIPStack) capture(side direction, received bool, conn net.PacketConn, remote net.Addr, data []byte, msg *Message) {
+	event := "sent"
+	if received {
+		event = "received"
+	}
+	s.cfg.Tracer.trace(event, side, remote, data, msg)
+	if len(s.cfg.Observers) == 0 {
+		return
+	}
+	packet := Packet{
+		Time:     time.Now(),
+		Received: received,
+		Local:    conn.LocalAddr(),
+		Remote:   remote,
+		Data:     bytes.Clone(data),
+		Message:  msg,
+	}
+	for _, observer := range s.cfg.Observers {
+		observer.ObservePacket(packet)
+	}
+}
@@ -0,0 +1,515 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// RouteRule is one entry of a dial plan. Its conditions all have to hold for
+// it to match a request; an empty condition always holds. A matching rule
+// either rejects the request or changes where it goes.
+type RouteRule struct {
+	// Name identifies the rule in errors.
+	Name string
+
+	// User is a regular expression the Request-URI's user part must match
+	// in full.
+	User string
+	// Prefix is a string the user part must start with.
+	Prefix string
+	// Domain is a regular expression the Request-URI's host must match in
+	// full, ignoring case.
+	Domain string
+	// Sources are the addresses and CIDR prefixes, such as 192.0.2.0/24,
+	// of which the request must come from one, as its top Via records.
+	Sources []string
+	// Days are the weekdays on which the rule applies, by three-letter
+	// name, listed or as ranges: "mon-fri" or "sat,sun".
+	Days string
+	// Time is the time of day at which the rule applies, as HH:MM-HH:MM,
+	// from inclusive to until exclusive. A window ending before it starts
+	// runs past midnight. Days and Time use the proxy's local clock.
+	Time string
+
+	// Rewrite replaces the user part, expanded against User's match so
+	// that $1 or ${1} stand for its first group.
+	Rewrite string
+	// Strip removes this many leading characters from the user part, after
+	// Rewrite, and Prepend is then put in front.
+	Strip   int
+	Prepend string
+	// Host replaces the Request-URI's host, and port when it has one.
+	Host string
+	// Upstream is a host:port to send the request to, instead of where its
+	// Request-URI leads.
+	Upstream string
+	// Trunk names configured trunks, as user@domain separated by commas, to
+	// send the request through: it goes to a trunk's registrar with the
+	// trunk's domain in its Request-URI, unless Host gives another, so that
+	// the trunk's credentials answer the provider's challenges. The cheapest
+	// trunk by TrunkConfig.Cost is tried first, and the request moves on to
+	// the next cheapest when one times out or answers 408 or 5xx.
+	Trunk string
+
+	// Reject answers the request with this status, 400 to 699, instead of
+	// forwarding it, with Reason as the reason phrase when it is set. It
+	// excludes the other actions.
+	Reject int
+	Reason string
+}
+
+// DialPlan routes out-of-dialog requests by an ordered list of rules, of
+// which the first that matches a request applies. The rule set may be
+// swapped at runtime with Replace. Requests no rule matches fall through to
+// the prefix table of trunk routes kept in the user directory, in which the
+// longest prefix matching the dialed number wins, and then to the trunk of
+// the caller's domain when the request leaves the served domains.
+type DialPlan struct {
+	mu     sync.RWMutex
+	rules  []*dialRule
+	trunks []TrunkConfig
+	// trunkRoutes are the directory's routes as loaded, and prefixes those
+	// of them naming a configured trunk, longest prefix first. domains are
+	// the directory's domain settings, served the domains requests stay
+	// among, and domainTrunks the rules sending requests from a domain
+	// through its trunk. skipped explains the routes and trunks left out.
+	trunkRoutes  []userdb.TrunkRoute
+	prefixes     []*dialRule
+	domains      []userdb.Domain
+	served       map[string]struct{}
+	domainTrunks map[string]*dialRule
+	skipped      []error
+}
+
+// dialRule is a RouteRule ready for matching.
+type dialRule struct {
+	RouteRule
+	user    *regexp.Regexp
+	domain  *regexp.Regexp
+	sources []*net.IPNet
+	// days has bit d set for each time.Weekday d the rule applies on; zero
+	// is every day.
+	days uint8
+	// from and until are minutes since midnight; timed says Time was set.
+	timed       bool
+	from, until int
+	host        string
+	port        int
+	// nextHop is the host:port Upstream sends the request to, and hops the
+	// trunks Trunk names, cheapest first.
+	nextHop string
+	hops    []trunkHop
+}
+
+// trunkHop is one of the trunks a rule sends requests through.
+type trunkHop struct {
+	// trunk names the trunk as user@domain.
+	trunk string
+	// host is the trunk's domain to put in the Request-URI, or empty when
+	// the rule's Host takes its place.
+	host    string
+	nextHop string
+	cost    int
+}
+
+// NewDialPlan compiles rules into a DialPlan. trunks are the configured trunk
+// accounts that rules may name.
+func NewDialPlan(rules []RouteRule, trunks []TrunkConfig) (*DialPlan, error) {
+	compiled, err := compileRouteRules(rules, trunks)
+	if err != nil {
+		return nil, err
+	}
+	return &DialPlan{rules: compiled, trunks: trunks}, nil
+}
+
+// Replace atomically swaps the plan's rules and trunks for the supplied set,
+// leaving the plan as it was when one of the rules is invalid.
+func (p *DialPlan) Replace(rules []RouteRule, trunks []TrunkConfig) error {
+	compiled, err := compileRouteRules(rules, trunks)
+	if err != nil {
+		return err
+	}
+	p.set(compiled, trunks)
+	return nil
+}
+
+func (p *DialPlan) set(rules []*dialRule, trunks []TrunkConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	p.trunks = trunks
+	p.compileDirectory()
+}
+
+// setTrunkRoutes replaces the prefix table with routes.
+func (p *DialPlan) setTrunkRoutes(routes []userdb.TrunkRoute) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trunkRoutes = routes
+	p.compileDirectory()
+}
+
+// setDomains replaces the domain settings whose trunks requests from the
+// domains' users leave through, and the served domains they never leave
+// through a domain trunk for.
+func (p *DialPlan) setDomains(domains []userdb.Domain, served map[string]struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.domains = domains
+	p.served = served
+	p.compileDirectory()
+}
+
+// compileDirectory compiles the routes taken from the user directory against
+// the configured trunks. p.mu must be held.
+func (p *DialPlan) compileDirectory() {
+	p.prefixes, p.skipped = compileTrunkRoutes(p.trunkRoutes, p.trunks)
+	p.domainTrunks = make(map[string]*dialRule)
+	for _, domain := range p.domains {
+		if domain.Trunk == "" {
+			continue
+		}
+		r, err := compileRouteRule(RouteRule{Name: "domain " + domain.Name, Trunk: domain.Trunk}, p.trunks)
+		if err != nil {
+			p.skipped = append(p.skipped, fmt.Errorf("domain %s: %w", domain.Name, err))
+			continue
+		}
+		p.domainTrunks[domain.Name] = r
+		for _, alias := range domain.Aliases {
+			p.domainTrunks[alias] = r
+		}
+	}
+}
+
+// skippedTrunkRoutes explains why trunk routes and domain trunks were left
+// out, typically because they name a trunk that is not configured.
+func (p *DialPlan) skippedTrunkRoutes() []error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.skipped
+}
+
+// compileTrunkRoutes turns the directory's trunk routes into rules matching
+// on their prefix, longest first, skipping those that cannot be used.
+func compileTrunkRoutes(routes []userdb.TrunkRoute, trunks []TrunkConfig) ([]*dialRule, []error) {
+	var compiled []*dialRule
+	var skipped []error
+	for _, route := range routes {
+		r, err := compileRouteRule(RouteRule{
+			Name:    "trunk route " + route.Prefix,
+			Prefix:  route.Prefix,
+			Strip:   route.Strip,
+			Prepend: route.Prepend,
+			Trunk:   route.Trunk,
+		}, trunks)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("trunk route %s: %w", route.Prefix, err))
+			continue
+		}
+		compiled = append(compiled, r)
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return len(compiled[i].Prefix) > len(compiled[j].Prefix)
+	})
+	return compiled, skipped
+}
+
+func compileRouteRules(rules []RouteRule, trunks []TrunkConfig) ([]*dialRule, error) {
+	compiled := make([]*dialRule, 0, len(rules))
+	for i, rule := range rules {
+		r, err := compileRouteRule(rule, trunks)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, fmt.Errorf("route %s: %w", name, err)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func compileRouteRule(rule RouteRule, trunks []TrunkConfig) (*dialRule, error) {
+	r := &dialRule{RouteRule: rule}
+	var err error
+	if rule.User != "" {
+		if r.user, err = regexp.Compile(`^(?:` + rule.User + `)$`); err != nil {
+			return nil, fmt.Errorf("invalid user pattern: %w", err)
+		}
+	}
+	if rule.Domain != "" {
+		if r.domain, err = regexp.Compile(`(?i)^(?:` + rule.Domain + `)$`); err != nil {
+			return nil, fmt.Errorf("invalid domain pattern: %w", err)
+		}
+	}
+	for _, source := range rule.Sources {
+		source = strings.TrimSpace(source)
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source %q", source)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			r.sources = append(r.sources, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q", source)
+		}
+		r.sources = append(r.sources, prefix)
+	}
+	if r.days, err = parseWeekdays(rule.Days); err != nil {
+		return nil, err
+	}
+	if rule.Time != "" {
+		from, until, ok := strings.Cut(rule.Time, "-")
+		r.from, err = parseClock(from)
+		if err == nil && ok {
+			r.until, err = parseClock(until)
+		}
+		if err != nil || !ok || r.from == r.until {
+			return nil, fmt.Errorf("invalid time %q: use HH:MM-HH:MM", rule.Time)
+		}
+		r.timed = true
+	}
+
+	if rule.Rewrite != "" && r.user == nil {
+		return nil, fmt.Errorf("rewrite needs a user pattern")
+	}
+	if rule.Strip < 0 {
+		return nil, fmt.Errorf("invalid strip %d", rule.Strip)
+	}
+	if rule.Host != "" {
+		host, port, err := net.SplitHostPort(rule.Host)
+		if err != nil {
+			host, port = strings.Trim(rule.Host, "[]"), ""
+		}
+		r.host = host
+		if port != "" {
+			if r.port, err = strconv.Atoi(port); err != nil || r.port < 1 || r.port > 65535 {
+				return nil, fmt.Errorf("invalid host %q", rule.Host)
+			}
+		}
+		if r.host == "" {
+			return nil, fmt.Errorf("invalid host %q", rule.Host)
+		}
+	}
+	if rule.Upstream != "" && rule.Trunk != "" {
+		return nil, fmt.Errorf("upstream and trunk are exclusive")
+	}
+	if rule.Upstream != "" {
+		if _, _, err := net.SplitHostPort(rule.Upstream); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: use host:port", rule.Upstream)
+		}
+		r.nextHop = rule.Upstream
+	}
+	if rule.Trunk != "" {
+		for _, name := range strings.Split(rule.Trunk, ",") {
+			name = strings.TrimPrefix(strings.TrimSpace(name), "sip:")
+			hop, ok := findTrunkHop(name, trunks)
+			if !ok {
+				return nil, fmt.Errorf("no trunk %s is configured", name)
+			}
+			if r.host != "" {
+				hop.host = ""
+			}
+			r.hops = append(r.hops, hop)
+		}
+		sort.SliceStable(r.hops, func(i, j int) bool { return r.hops[i].cost < r.hops[j].cost })
+	}
+	if rule.Reject != 0 {
+		if rule.Reject < 400 || rule.Reject > 699 {
+			return nil, fmt.Errorf("invalid reject status %d: use 400 to 699", rule.Reject)
+		}
+		if rule.Rewrite != "" || rule.Strip != 0 || rule.Prepend != "" || rule.Host != "" || r.nextHop != "" || len(r.hops) > 0 {
+			return nil, fmt.Errorf("reject cannot be combined with other actions")
+		}
+	}
+	return r, nil
+}
+
+// findTrunkHop looks up the trunk named user@domain among trunks.
+func findTrunkHop(name string, trunks []TrunkConfig) (trunkHop, bool) {
+	for _, trunk := range trunks {
+		if strings.EqualFold(trunk.Username+"@"+trunk.Domain, name) {
+			return trunkHop{trunk: trunk.Username + "@" + trunk.Domain, host: trunk.Domain, nextHop: trunk.Registrar, cost: trunk.Cost}, true
+		}
+	}
+	return trunkHop{}, false
+}
+
+// weekdayNames are the names Days takes, indexed by time.Weekday.
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseWeekdays reads a comma-separated list of weekdays and ranges, such as
+// "mon-fri,sun", into a bit set indexed by time.Weekday. A range ending
+// before it starts wraps past Saturday.
+func parseWeekdays(text string) (uint8, error) {
+	day := func(name string) (int, bool) {
+		for i, known := range weekdayNames {
+			if strings.EqualFold(strings.TrimSpace(name), known) {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	var days uint8
+	for _, part := range strings.Split(text, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := day(first)
+		until := from
+		if ok && isRange {
+			until, ok = day(last)
+		}
+		if !ok {
+			return 0, fmt.Errorf("invalid days %q: use names such as mon-fri or sat,sun", text)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if d == until {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock reads HH:MM as minutes since midnight.
+func parseClock(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// match returns the first rule matching req, received at now, or nil. uri is
+// req's parsed Request-URI.
+func (p *DialPlan) match(req *Message, uri *URI, now time.Time) *dialRule {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	rules, prefixes := p.rules, p.prefixes
+	served, domainTrunks := p.served, p.domainTrunks
+	p.mu.RUnlock()
+	if len(rules) == 0 && len(prefixes) == 0 && len(domainTrunks) == 0 {
+		return nil
+	}
+	source := viaSource(req)
+	for _, r := range rules {
+		if r.matches(uri, source, now) {
+			return r
+		}
+	}
+	for _, r := range prefixes {
+		if strings.HasPrefix(uri.User, r.Prefix) {
+			return r
+		}
+	}
+	if len(domainTrunks) == 0 {
+		return nil
+	}
+	if _, local := served[strings.ToLower(uri.Host)]; local {
+		return nil
+	}
+	if from, err := ParseAddress(req.GetHeader("From")); err == nil {
+		return domainTrunks[strings.ToLower(from.Host)]
+	}
+	return nil
+}
+
+func (r *dialRule) matches(uri *URI, source net.IP, now time.Time) bool {
+	if r.user != nil && !r.user.MatchString(uri.User) {
+		return false
+	}
+	if !strings.HasPrefix(uri.User, r.Prefix) {
+		return false
+	}
+	if r.domain != nil && !r.domain.MatchString(uri.Host) {
+		return false
+	}
+	if len(r.sources) > 0 {
+		from := false
+		for _, prefix := range r.sources {
+			if source != nil && prefix.Contains(source) {
+				from = true
+				break
+			}
+		}
+		if !from {
+			return false
+		}
+	}
+	if r.days != 0 && r.days&(1<<now.Weekday()) == 0 {
+		return false
+	}
+	if r.timed {
+		minute := now.Hour()*60 + now.Minute()
+		if r.from < r.until && (minute < r.from || minute >= r.until) {
+			return false
+		}
+		if r.from > r.until && minute < r.from && minute >= r.until {
+			return false
+		}
+	}
+	return true
+}
+
+// route applies the rule's rewriting to req, whose Request-URI is uri, and
+// sets where it is sent.
+func (r *dialRule) route(req *Message, uri *URI) {
+	if r.Rewrite != "" {
+		match := r.user.FindStringSubmatchIndex(uri.User)
+		uri.User = string(r.user.ExpandString(nil, r.Rewrite, uri.User, match))
+	}
+	if r.Strip > 0 {
+		if r.Strip < len(uri.User) {
+			uri.User = uri.User[r.Strip:]
+		} else {
+			uri.User = ""
+		}
+	}
+	uri.User = r.Prepend + uri.User
+	if r.host != "" {
+		uri.Host, uri.Port = r.host, r.port
+	}
+	req.RequestURI = uri.String()
+	if r.nextHop != "" {
+		req.nextHop = r.nextHop
+	}
+	if len(r.hops) > 0 {
+		req.sendThrough(r.hops)
+	}
+}
+
+// sendThrough points req at the first of hops, keeping the others for
+// failover.
+func (m *Message) sendThrough(hops []trunkHop) {
+	hop := hops[0]
+	if hop.host != "" {
+		if uri, err := ParseURI(m.RequestURI); err == nil {
+			uri.Host, uri.Port = hop.host, 0
+			m.RequestURI = uri.String()
+		}
+	}
+	m.nextHop = hop.nextHop
+	m.trunkName = hop.trunk
+	m.trunkAlternates = hops[1:]
+}
@@ -0,0 +1,335 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestDialPlanMatchesFirstRuleAndRewrites(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{{Registrar: "203.0.113.5", Domain: "provider.example", Username: "0312345678"}})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{
+		{Name: "premium", Prefix: "0990", Reject: 403, Reason: "Premium Numbers Barred"},
+		{Name: "night", User: `1\d{3}`, Domain: "example.com", Time: "22:00-06:00", Upstream: "192.0.2.99:5060"},
+		{Name: "lab", User: `1\d{3}`, Sources: []string{"198.51.100.0/24"}, Days: "sat,sun", Host: "lab.example.com:5070"},
+		{Name: "national", User: `0(\d{9,10})`, Rewrite: "+81$1", Trunk: "0312345678@provider.example"},
+		{Name: "outside-line", Prefix: "9", Strip: 1, Prepend: "00"},
+	}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+
+	weekday := time.Date(2026, 10, 14, 12, 0, 0, 0, time.Local)    // Wednesday noon
+	weekend := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)    // Saturday noon
+	lateNight := time.Date(2026, 10, 14, 23, 30, 0, 0, time.Local) // Wednesday night
+	cases := []struct {
+		name    string
+		uri     string
+		via     string
+		now     time.Time
+		rule    string
+		routed  string
+		nextHop string
+	}{
+		{name: "prefix reject", uri: "sip:0990123456@example.com", now: weekday, rule: "premium"},
+		{name: "time window wraps midnight", uri: "sip:1001@example.com", now: lateNight, rule: "night", routed: "sip:1001@example.com", nextHop: "192.0.2.99:5060"},
+		{name: "domain mismatch", uri: "sip:1001@other.example", now: lateNight},
+		{name: "outside time window", uri: "sip:1001@example.com", now: weekday},
+		{name: "source and days", uri: "sip:1001@example.com", via: "SIP/2.0/UDP pc.lab;branch=z9hG4bKx;received=198.51.100.7", now: weekend, rule: "lab", routed: "sip:1001@lab.example.com:5070"},
+		{name: "wrong source", uri: "sip:1001@example.com", via: "SIP/2.0/UDP 192.0.2.7;branch=z9hG4bKx", now: weekend},
+		{name: "regex rewrite through trunk", uri: "sip:0312345678@example.com:5062", now: weekday, rule: "national", routed: "sip:+81312345678@provider.example", nextHop: "203.0.113.5:5060"},
+		{name: "strip and prepend", uri: "sip:91234@example.com", now: weekday, rule: "outside-line", routed: "sip:001234@example.com"},
+		{name: "no match", uri: "sip:alice@example.com", now: weekday},
+	}
+	for _, tc := range cases {
+		req := newInvite()
+		req.RequestURI = tc.uri
+		if tc.via != "" {
+			req.SetHeader("Via", tc.via)
+		}
+		uri, err := ParseURI(req.RequestURI)
+		if err != nil {
+			t.Fatalf("%s: ParseURI returned error: %v", tc.name, err)
+		}
+		rule := plan.match(req, uri, tc.now)
+		if tc.rule == "" {
+			if rule != nil {
+				t.Fatalf("%s: expected no rule to match, got %q", tc.name, rule.Name)
+			}
+			continue
+		}
+		if rule == nil || rule.Name != tc.rule {
+			t.Fatalf("%s: expected rule %q to match, got %v", tc.name, tc.rule, rule)
+		}
+		if rule.Reject != 0 {
+			continue
+		}
+		rule.route(req, uri)
+		if req.RequestURI != tc.routed || req.nextHop != tc.nextHop {
+			t.Fatalf("%s: expected %q via %q, got %q via %q", tc.name, tc.routed, tc.nextHop, req.RequestURI, req.nextHop)
+		}
+	}
+}
+
+func TestNewDialPlanRejectsInvalidRules(t *testing.T) {
+	cases := []struct {
+		rule RouteRule
+		want string
+	}{
+		{RouteRule{User: "("}, "invalid user pattern"},
+		{RouteRule{Domain: "[a"}, "invalid domain pattern"},
+		{RouteRule{Sources: []string{"not-an-address"}}, "invalid source"},
+		{RouteRule{Days: "mon-funday"}, "invalid days"},
+		{RouteRule{Time: "9-17"}, "invalid time"},
+		{RouteRule{Time: "08:00-08:00"}, "invalid time"},
+		{RouteRule{Rewrite: "+81$1"}, "rewrite needs a user pattern"},
+		{RouteRule{Upstream: "192.0.2.1"}, "invalid upstream"},
+		{RouteRule{Trunk: "nobody@provider.example"}, "no trunk"},
+		{RouteRule{Upstream: "192.0.2.1:5060", Trunk: "a@b"}, "exclusive"},
+		{RouteRule{Reject: 302}, "invalid reject status"},
+		{RouteRule{Reject: 403, Prepend: "0"}, "cannot be combined"},
+	}
+	for _, tc := range cases {
+		_, err := NewDialPlan([]RouteRule{{Name: "ok", Prefix: "1"}, tc.rule}, nil)
+		if err == nil || !strings.Contains(err.Error(), tc.want) || !strings.Contains(err.Error(), "route #2") {
+			t.Fatalf("rule %+v: expected error mentioning %q, got %v", tc.rule, tc.want, err)
+		}
+	}
+}
+
+func TestProxyAppliesDialPlan(t *testing.T) {
+	plan, err := NewDialPlan([]RouteRule{
+		{User: "110", Reject: 403},
+		{User: `0(\d+)`, Rewrite: "+81$1", Upstream: "192.0.2.99:5060"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	proxy := NewProxy(WithDialPlan(plan))
+	t.Cleanup(proxy.Stop)
+
+	barred := newInvite()
+	barred.RequestURI = "sip:110@example.com"
+	proxy.SendFromClient(barred)
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 403 || !strings.Contains(resp.GetHeader("To"), ";tag=") {
+		t.Fatalf("expected 403 with a To tag for a barred number, got %v", resp)
+	}
+	if _, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("a rejected INVITE should not be forwarded")
+	}
+
+	cancel := newInvite()
+	cancel.Method = "CANCEL"
+	cancel.RequestURI = "sip:110@example.com"
+	cancel.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKcancel")
+	cancel.SetHeader("CSeq", "314159 CANCEL")
+	proxy.SendFromClient(cancel)
+	if forwarded, ok := proxy.NextToServer(100 * time.Millisecond); !ok || forwarded.Method != "CANCEL" {
+		t.Fatalf("expected a CANCEL to be forwarded rather than rejected, got %v", forwarded)
+	}
+
+	national := newInvite()
+	national.RequestURI = "sip:0312345678@example.com"
+	national.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKnational")
+	proxy.SendFromClient(national)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the rewritten INVITE to be forwarded")
+	}
+	if forwarded.RequestURI != "sip:+81312345678@example.com" || forwarded.nextHop != "192.0.2.99:5060" {
+		t.Fatalf("expected the Request-URI rewritten and sent to the rule's upstream, got %q via %q", forwarded.RequestURI, forwarded.nextHop)
+	}
+}
+
+func TestDialPlanTrunkRoutesMatchLongestPrefix(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{
+		{Registrar: "203.0.113.5", Domain: "provider.example", Username: "0312345678"},
+		{Registrar: "198.51.100.9:5080", Domain: "carrier.example", Username: "intl"},
+	})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Name: "emergency", User: "110|119", Upstream: "192.0.2.1:5060"}}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	plan.setTrunkRoutes([]userdb.TrunkRoute{
+		{Prefix: "0", Trunk: "0312345678@provider.example"},
+		{Prefix: "0120", Trunk: "intl@carrier.example", Strip: 1, Prepend: "+81"},
+		{Prefix: "00", Trunk: "nobody@provider.example"},
+	})
+	if skipped := plan.skippedTrunkRoutes(); len(skipped) != 1 || !strings.Contains(skipped[0].Error(), "trunk route 00") {
+		t.Fatalf("expected the route naming an unknown trunk to be skipped, got %v", skipped)
+	}
+
+	now := time.Now()
+	cases := []struct {
+		uri     string
+		rule    string
+		routed  string
+		nextHop string
+	}{
+		{"sip:110@example.com", "emergency", "sip:110@example.com", "192.0.2.1:5060"},
+		{"sip:0120444444@example.com", "trunk route 0120", "sip:+81120444444@carrier.example", "198.51.100.9:5080"},
+		{"sip:0312345678@example.com", "trunk route 0", "sip:0312345678@provider.example", "203.0.113.5:5060"},
+		{"sip:0012025550100@example.com", "trunk route 0", "sip:0012025550100@provider.example", "203.0.113.5:5060"},
+		{"sip:1001@example.com", "", "", ""},
+	}
+	for _, tc := range cases {
+		req := newInvite()
+		req.RequestURI = tc.uri
+		uri, err := ParseURI(req.RequestURI)
+		if err != nil {
+			t.Fatalf("%s: ParseURI returned error: %v", tc.uri, err)
+		}
+		rule := plan.match(req, uri, now)
+		if tc.rule == "" {
+			if rule != nil {
+				t.Fatalf("%s: expected no route, got %q", tc.uri, rule.Name)
+			}
+			continue
+		}
+		if rule == nil || rule.Name != tc.rule {
+			t.Fatalf("%s: expected %q to match, got %v", tc.uri, tc.rule, rule)
+		}
+		rule.route(req, uri)
+		if req.RequestURI != tc.routed || req.nextHop != tc.nextHop {
+			t.Fatalf("%s: expected %q via %q, got %q via %q", tc.uri, tc.routed, tc.nextHop, req.RequestURI, req.nextHop)
+		}
+	}
+
+	// A reload that adds the missing trunk brings its route into use.
+	trunks = append(trunks, TrunkConfig{Registrar: "192.0.2.50:5060", Domain: "provider.example", Username: "nobody"})
+	if err := plan.Replace(nil, trunks); err != nil {
+		t.Fatalf("Replace returned error: %v", err)
+	}
+	if skipped := plan.skippedTrunkRoutes(); len(skipped) != 0 {
+		t.Fatalf("expected no skipped routes after the trunk was added, got %v", skipped)
+	}
+	req := newInvite()
+	req.RequestURI = "sip:0012025550100@example.com"
+	uri, _ := ParseURI(req.RequestURI)
+	if rule := plan.match(req, uri, now); rule == nil || rule.Name != "trunk route 00" {
+		t.Fatalf("expected the longer 00 prefix to win once usable, got %v", rule)
+	}
+}
+
+func TestProxyFailsOverToNextCheapestTrunk(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{
+		{Registrar: "203.0.113.5", Domain: "premium.example", Username: "main", Cost: 10},
+		{Registrar: "198.51.100.9", Domain: "budget.example", Username: "cheap", Cost: 2},
+		{Registrar: "192.0.2.77", Domain: "spare.example", Username: "spare", Cost: 5},
+	})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "0", Trunk: "main@premium.example, cheap@budget.example, spare@spare.example"}}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	calls := NewCallLog(0)
+	proxy := NewProxy(WithDialPlan(plan), WithCallLog(calls))
+	t.Cleanup(proxy.Stop)
+
+	nextInvite := func() *Message {
+		t.Helper()
+		for {
+			msg, ok := proxy.NextToServer(200 * time.Millisecond)
+			if !ok {
+				t.Fatalf("expected an INVITE to be forwarded")
+			}
+			if msg.Method == "INVITE" {
+				return msg
+			}
+		}
+	}
+
+	invite := newInvite()
+	invite.RequestURI = "sip:0312345678@example.com"
+	proxy.SendFromClient(invite)
+	cheap := nextInvite()
+	if cheap.nextHop != "198.51.100.9:5060" || cheap.RequestURI != "sip:0312345678@budget.example" {
+		t.Fatalf("expected the cheapest trunk first, got %q via %q", cheap.RequestURI, cheap.nextHop)
+	}
+
+	proxy.SendFromServer(buildResponseFrom(cheap, 503, "Service Unavailable"))
+	spare := nextInvite()
+	if spare.nextHop != "192.0.2.77:5060" || spare.RequestURI != "sip:0312345678@spare.example" {
+		t.Fatalf("expected the next cheapest trunk after a 503, got %q via %q", spare.RequestURI, spare.nextHop)
+	}
+	if _, ok := proxy.NextToClient(50 * time.Millisecond); ok {
+		t.Fatalf("the failed attempt should not be relayed downstream")
+	}
+
+	proxy.SendFromServer(buildResponseFrom(spare, 486, "Busy Here"))
+	resp, ok := proxy.NextToClient(200 * time.Millisecond)
+	if !ok || resp.StatusCode != 486 {
+		t.Fatalf("expected a 486 to end the call rather than fail over, got %v", resp)
+	}
+	recent := calls.Recent("alice", "example.com", 0)
+	if len(recent) != 1 || recent[0].Route != "spare@spare.example" || recent[0].Status != 486 {
+		t.Fatalf("expected the call record to name the last trunk tried, got %+v", recent)
+	}
+}
+
+func TestDialPlanSendsDomainsOutThroughTheirTrunk(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{{Registrar: "203.0.113.5", Domain: "provider.example", Username: "tenant-a"}})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan(nil, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	plan.setDomains([]userdb.Domain{
+		{Name: "tenant-a.example", Trunk: "tenant-a@provider.example"},
+		{Name: "tenant-b.example", Trunk: "missing@provider.example"},
+	}, map[string]struct{}{"tenant-a.example": {}, "tenant-b.example": {}})
+	if skipped := plan.skippedTrunkRoutes(); len(skipped) != 1 || !strings.Contains(skipped[0].Error(), "domain tenant-b.example") {
+		t.Fatalf("expected the domain naming an unknown trunk to be skipped, got %v", skipped)
+	}
+
+	now := time.Now()
+	cases := []struct {
+		from, uri string
+		routed    bool
+	}{
+		{"<sip:alice@tenant-a.example>;tag=1", "sip:0312345678@pstn.example", true},
+		{"<sip:alice@tenant-a.example>;tag=1", "sip:bob@tenant-b.example", false},
+		{"<sip:carol@tenant-b.example>;tag=1", "sip:0312345678@pstn.example", false},
+	}
+	for _, tc := range cases {
+		req := newInvite()
+		req.RequestURI = tc.uri
+		req.SetHeader("From", tc.from)
+		uri, _ := ParseURI(req.RequestURI)
+		rule := plan.match(req, uri, now)
+		if (rule != nil) != tc.routed {
+			t.Fatalf("%s to %s: expected routed=%v, got %v", tc.from, tc.uri, tc.routed, rule)
+		}
+		if rule == nil {
+			continue
+		}
+		rule.route(req, uri)
+		if req.RequestURI != "sip:0312345678@provider.example" || req.nextHop != "203.0.113.5:5060" {
+			t.Fatalf("expected the tenant's trunk, got %q via %q", req.RequestURI, req.nextHop)
+		}
+	}
+}
+
+func TestBroadcastPolicyNamespaces(t *testing.T) {
+	policy := NewBroadcastPolicy([]BroadcastRule{{Address: "sip:sales@tenant-a.example", Targets: []string{"sip:alice@tenant-a.example"}}})
+	if policy.Has("sip:sales@tenant-b.example") {
+		t.Fatalf("expected another domain's rules not to apply without a namespace")
+	}
+	policy.SetNamespaces(map[string]string{"tenant-b.example": "tenant-a.example"})
+	if targets := policy.Targets("sip:sales@Tenant-B.example"); len(targets) != 1 || targets[0] != "sip:alice@tenant-a.example" {
+		t.Fatalf("expected the namespace's rule to apply, got %v", targets)
+	}
+}
@@ -0,0 +1,236 @@
+package sip
+
+import (
+	"context"
+	"encoding/xml"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialogInfoContentType is the dialog state document format (RFC 4235)
+// notified.
+const dialogInfoContentType = "application/dialog-info+xml"
+
+// DialogInfo is the dialog event package (RFC 4235), with which attendant
+// consoles and busy lamp fields watch the calls of a user. It follows the
+// calls the proxy sees, from their initial INVITE through trying,
+// proceeding, early (ringing), and confirmed to terminated, and notifies
+// the watchers of both caller and callee of every transition. Each NOTIFY
+// carries the user's full state; a dialog appears once as terminated and is
+// then forgotten. It belongs to the proxy core's goroutine.
+type DialogInfo struct {
+	dialogs []*trackedDialog
+	pending map[string]*trackedDialog // keyed by server transaction ID
+	now     func() time.Time
+}
+
+// trackedDialog is one call as the dialog package reports it.
+type trackedDialog struct {
+	id        string
+	callID    string
+	fromTag   string
+	toTag     string
+	caller    string
+	callee    string
+	state     string
+	confirmed time.Time
+}
+
+// NewDialogInfo returns a dialog package following no calls yet.
+func NewDialogInfo() *DialogInfo {
+	return &DialogInfo{
+		pending: make(map[string]*trackedDialog),
+		now:     time.Now,
+	}
+}
+
+// Event names the package.
+func (d *DialogInfo) Event() string {
+	return "dialog"
+}
+
+// Authorize accepts watchers who authenticated as a user of the watched
+// user's domain, since the calls of a user say whom they talk to, unless
+// they accept no dialog state documents.
+func (d *DialogInfo) Authorize(ctx context.Context, sub *Subscription) int {
+	if strings.HasPrefix(sub.Resource, "@") {
+		return 404
+	}
+	_, watcherDomain, _ := strings.Cut(sub.Identity, "@")
+	_, domain, _ := strings.Cut(sub.Resource, "@")
+	if sub.Identity == "" || !strings.EqualFold(watcherDomain, domain) {
+		return 403
+	}
+	if !acceptsType(sub.Accept, dialogInfoContentType) {
+		return 406
+	}
+	return 0
+}
+
+// State returns the dialog state document of sub.Resource, listing every
+// call it places or receives. Its version counts the subscription's NOTIFY
+// requests from zero.
+func (d *DialogInfo) State(ctx context.Context, sub *Subscription) (string, string) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<dialog-info xmlns="urn:ietf:params:xml:ns:dialog-info" version="` + strconv.Itoa(max(sub.cseq-1, 0)) + `" state="full" entity="` + escapeXML("sip:"+sub.Resource) + `">` + "\n")
+	for _, dialog := range d.dialogs {
+		direction, localTag, remoteTag, local, remote := "initiator", dialog.fromTag, dialog.toTag, dialog.caller, dialog.callee
+		switch sub.Resource {
+		case dialog.caller:
+		case dialog.callee:
+			direction, localTag, remoteTag, local, remote = "recipient", dialog.toTag, dialog.fromTag, dialog.callee, dialog.caller
+		default:
+			continue
+		}
+		b.WriteString(`<dialog id="` + escapeXML(dialog.id) + `" call-id="` + escapeXML(dialog.callID) + `"`)
+		if localTag != "" {
+			b.WriteString(` local-tag="` + escapeXML(localTag) + `"`)
+		}
+		if remoteTag != "" {
+			b.WriteString(` remote-tag="` + escapeXML(remoteTag) + `"`)
+		}
+		b.WriteString(` direction="` + direction + `">`)
+		b.WriteString(`<state>` + dialog.state + `</state>`)
+		b.WriteString(`<local><identity>` + escapeXML("sip:"+local) + `</identity></local>`)
+		b.WriteString(`<remote><identity>` + escapeXML("sip:"+remote) + `</identity></remote>`)
+		b.WriteString("</dialog>\n")
+	}
+	b.WriteString("</dialog-info>\n")
+	return dialogInfoContentType, b.String()
+}
+
+// begin follows the initial INVITE received on serverTxID from caller to
+// callee, returning them as the users whose state changed.
+func (d *DialogInfo) begin(serverTxID string, req *Message, caller, callee string) []string {
+	if d == nil {
+		return nil
+	}
+	d.prune()
+	dialog := &trackedDialog{
+		id:      newTag(),
+		callID:  req.GetHeader("Call-ID"),
+		fromTag: GetHeaderParam(req.GetHeader("From"), "tag"),
+		caller:  caller,
+		callee:  callee,
+		state:   "trying",
+	}
+	d.pending[serverTxID] = dialog
+	d.dialogs = append(d.dialogs, dialog)
+	return dialog.parties()
+}
+
+// respond moves the call of serverTxID on at the response sent to its
+// caller, returning the users whose state changed.
+func (d *DialogInfo) respond(serverTxID string, resp *Message) []string {
+	if d == nil {
+		return nil
+	}
+	dialog, ok := d.pending[serverTxID]
+	if !ok || resp.StatusCode == 100 {
+		return nil
+	}
+	if tag := GetHeaderParam(resp.GetHeader("To"), "tag"); tag != "" {
+		dialog.toTag = tag
+	}
+	state := "proceeding"
+	switch {
+	case resp.StatusCode >= 300:
+		state = "terminated"
+	case resp.StatusCode >= 200:
+		state = "confirmed"
+		dialog.confirmed = d.now()
+	case dialog.toTag != "":
+		state = "early"
+	}
+	if resp.StatusCode >= 200 {
+		delete(d.pending, serverTxID)
+	}
+	if state == dialog.state {
+		return nil
+	}
+	dialog.state = state
+	return dialog.parties()
+}
+
+// hangup ends the confirmed call a BYE for callID ends, returning the users
+// whose state changed.
+func (d *DialogInfo) hangup(callID string) []string {
+	if d == nil {
+		return nil
+	}
+	for _, dialog := range d.dialogs {
+		if dialog.callID == callID && dialog.state == "confirmed" {
+			dialog.state = "terminated"
+			return dialog.parties()
+		}
+	}
+	return nil
+}
+
+// forgetTerminated drops the dialogs whose termination has been notified.
+func (d *DialogInfo) forgetTerminated() {
+	d.dialogs = slices.DeleteFunc(d.dialogs, func(dialog *trackedDialog) bool {
+		return dialog.state == "terminated"
+	})
+}
+
+// prune forgets confirmed calls older than staleCallAge, whose BYE took
+// another path or was lost.
+func (d *DialogInfo) prune() {
+	cutoff := d.now().Add(-staleCallAge)
+	d.dialogs = slices.DeleteFunc(d.dialogs, func(dialog *trackedDialog) bool {
+		return dialog.state == "confirmed" && dialog.confirmed.Before(cutoff)
+	})
+}
+
+// parties returns the users placing and receiving the call.
+func (dialog *trackedDialog) parties() []string {
+	if dialog.caller == dialog.callee {
+		return []string{dialog.caller}
+	}
+	return []string{dialog.caller, dialog.callee}
+}
+
+func escapeXML(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// dialogChanged notifies the watchers of users whose calls changed state,
+// each before the next change, so that every transition is seen.
+func (t *transactionUser) dialogChanged(ctx context.Context, users []string) {
+	if len(users) == 0 {
+		return
+	}
+	for _, user := range users {
+		t.notifyResource(ctx, t.dialogs.Event(), user)
+	}
+	t.dialogs.forgetTerminated()
+}
+
+// beginDialog follows an initial INVITE for the dialog package, between the
+// users in its From and To headers.
+func (t *transactionUser) beginDialog(ctx context.Context, serverTxID string, req *Message) {
+	if t.dialogs == nil {
+		return
+	}
+	caller, callee := t.dialogParty(req.GetHeader("From")), t.dialogParty(req.GetHeader("To"))
+	if caller == "" || callee == "" {
+		return
+	}
+	t.dialogChanged(ctx, t.dialogs.begin(serverTxID, req, caller, callee))
+}
+
+// dialogParty reduces a From or To header to user@domain with domain aliases
+// resolved, or "" when it has no user part.
+func (t *transactionUser) dialogParty(header string) string {
+	user, domain, err := parseAddressOfRecord(header)
+	if err != nil {
+		return ""
+	}
+	return registrarKey(user, t.canonicalDomain(domain))
+}
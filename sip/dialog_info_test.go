@@ -0,0 +1,156 @@
+package sip
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// newWatchedProxy returns a proxy serving the dialog package, whose
+// registrar knows alice, bob, and the operator at example.com without
+// asking them for credentials, and mallory at elsewhere.example.
+func newWatchedProxy(t *testing.T) *Proxy {
+	t.Helper()
+	store := newMemoryStore()
+	for _, user := range []string{"alice", "bob", "operator"} {
+		store.add(&userdb.User{Username: user, Domain: "example.com"})
+	}
+	store.add(&userdb.User{Username: "mallory", Domain: "elsewhere.example"})
+	registrar := NewRegistrar(store, WithDomainSettings(func(string) userdb.Domain {
+		return userdb.Domain{AuthPolicy: userdb.AuthNone}
+	}))
+	dialogs := NewDialogInfo()
+	proxy := NewProxy(WithRegistrar(registrar), WithSubscriptions(NewSubscriptions(dialogs)), WithDialogInfo(dialogs))
+	t.Cleanup(proxy.Stop)
+	return proxy
+}
+
+// dialogState returns the state of the only dialog in a dialog-info NOTIFY,
+// or "" when it lists none.
+func dialogState(t *testing.T, notify *Message) string {
+	t.Helper()
+	if notify.GetHeader("Content-Type") != dialogInfoContentType {
+		t.Fatalf("expected a dialog-info body, got %q", notify.GetHeader("Content-Type"))
+	}
+	_, rest, ok := strings.Cut(notify.Body, "<state>")
+	if !ok {
+		return ""
+	}
+	state, _, _ := strings.Cut(rest, "</state>")
+	return state
+}
+
+func TestProxyReportsDialogTransitions(t *testing.T) {
+	proxy := newWatchedProxy(t)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "dialog", "blf"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the console's subscription to be accepted, got %v", resp)
+	}
+	if state := dialogState(t, nextNotify(t, proxy)); state != "" {
+		t.Fatalf("expected no dialogs before any call, got %q", state)
+	}
+
+	proxy.SendFromClient(newInvite())
+	trying := nextNotify(t, proxy)
+	if state := dialogState(t, trying); state != "trying" || !strings.Contains(trying.Body, `direction="recipient"`) || !strings.Contains(trying.Body, `version="1"`) {
+		t.Fatalf("expected bob's incoming call as trying, got %q", trying.Body)
+	}
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok || forwarded.Method != "INVITE" {
+		t.Fatalf("expected the INVITE to be forwarded, got %v", forwarded)
+	}
+
+	for _, tt := range []struct {
+		status int
+		reason string
+		state  string
+	}{
+		{180, "Ringing", "early"},
+		{200, "OK", "confirmed"},
+	} {
+		resp := buildResponseFrom(forwarded, tt.status, tt.reason)
+		resp.SetHeader("To", "<sip:bob@example.com>;tag=bob1")
+		proxy.SendFromServer(resp)
+		if relayed, ok := proxy.NextToClient(100 * time.Millisecond); !ok || relayed.StatusCode != tt.status {
+			t.Fatalf("expected %d downstream, got %v", tt.status, relayed)
+		}
+		notify := nextNotify(t, proxy)
+		if state := dialogState(t, notify); state != tt.state || !strings.Contains(notify.Body, `local-tag="bob1"`) {
+			t.Fatalf("expected the call %s after %d, got %q", tt.state, tt.status, notify.Body)
+		}
+	}
+
+	bye := NewRequest("BYE", "sip:bob@client.example.com")
+	bye.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKbye")
+	bye.SetHeader("From", forwarded.GetHeader("From"))
+	bye.SetHeader("To", "<sip:bob@example.com>;tag=bob1")
+	bye.SetHeader("Call-ID", forwarded.GetHeader("Call-ID"))
+	bye.SetHeader("CSeq", "314160 BYE")
+	bye.SetHeader("Max-Forwards", "70")
+	proxy.SendFromClient(bye)
+	if state := dialogState(t, nextNotify(t, proxy)); state != "terminated" {
+		t.Fatalf("expected the call terminated after the BYE, got %q", state)
+	}
+	if msg, ok := proxy.NextToServer(100 * time.Millisecond); !ok || msg.Method != "BYE" {
+		t.Fatalf("expected the BYE to be forwarded, got %v", msg)
+	}
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "dialog", "later"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected a second subscription to be accepted, got %v", resp)
+	}
+	if state := dialogState(t, nextNotify(t, proxy)); state != "" {
+		t.Fatalf("expected the ended call to be forgotten, got %q", state)
+	}
+}
+
+func TestProxyReportsFailedCallsAsTerminated(t *testing.T) {
+	proxy := newWatchedProxy(t)
+
+	watch := newSubscribe("sip:alice@example.com", "dialog", "caller")
+	watch.SetHeader("From", "<sip:operator@example.com>;tag=console")
+	proxy.SendFromClient(watch)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the console's subscription to be accepted, got %v", resp)
+	}
+	nextNotify(t, proxy)
+
+	proxy.SendFromClient(newInvite())
+	if notify := nextNotify(t, proxy); !strings.Contains(notify.Body, `direction="initiator"`) {
+		t.Fatalf("expected alice's outgoing call, got %q", notify.Body)
+	}
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be forwarded")
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 486, "Busy Here"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 486 {
+		t.Fatalf("expected the failure downstream, got %v", resp)
+	}
+	if state := dialogState(t, nextNotify(t, proxy)); state != "terminated" {
+		t.Fatalf("expected the failed call terminated, got %q", state)
+	}
+}
+
+func TestDialogInfoRefusesWatchersFromOtherDomains(t *testing.T) {
+	proxy := newWatchedProxy(t)
+
+	watch := newSubscribe("sip:bob@example.com", "dialog", "outsider")
+	watch.SetHeader("From", "<sip:mallory@elsewhere.example>;tag=outsider")
+	proxy.SendFromClient(watch)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a watcher from another domain, got %v", resp)
+	}
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected the refused watcher not to be notified, got %v", msg)
+	}
+
+	dialogs := NewDialogInfo()
+	if status := dialogs.Authorize(context.Background(), &Subscription{Resource: "bob@example.com"}); status != 403 {
+		t.Fatalf("expected 403 for an unauthenticated watcher, got %d", status)
+	}
+}
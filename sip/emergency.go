@@ -0,0 +1,135 @@
+package sip
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// EmergencyConfig designates emergency numbers, such as 110 and 119, and
+// where calls to them go. A request whose Request-URI user part is one of
+// Numbers skips overload shedding and draining, the dial plan, ENUM, and the
+// callee's forwarding and do-not-disturb settings, and is sent straight to
+// Route: a configured trunk as user@domain, or a SIP URI, which keeps the
+// dialed number as its user part when it has none of its own.
+type EmergencyConfig struct {
+	Numbers []string
+	Route   string
+}
+
+// Emergency routes requests to emergency numbers, logging each one. It is
+// safe for concurrent use.
+type Emergency struct {
+	logger *slog.Logger
+
+	mu      sync.RWMutex
+	numbers map[string]struct{}
+	// hop is the trunk calls go through, or target the URI they go to
+	// when Route is not a trunk.
+	hop    trunkHop
+	target *URI
+}
+
+// NewEmergency returns an Emergency for cfg, whose Route may name one of
+// trunks, logging calls to logger.
+func NewEmergency(cfg EmergencyConfig, trunks []TrunkConfig, logger *slog.Logger) (*Emergency, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	e := &Emergency{logger: logger}
+	if err := e.Configure(cfg, trunks); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Configure replaces the emergency numbers and route, leaving them as they
+// were when cfg is invalid.
+func (e *Emergency) Configure(cfg EmergencyConfig, trunks []TrunkConfig) error {
+	numbers, hop, target, err := compileEmergency(cfg, trunks)
+	if err != nil {
+		return err
+	}
+	e.set(numbers, hop, target)
+	return nil
+}
+
+func (e *Emergency) set(numbers map[string]struct{}, hop trunkHop, target *URI) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.numbers, e.hop, e.target = numbers, hop, target
+}
+
+func compileEmergency(cfg EmergencyConfig, trunks []TrunkConfig) (map[string]struct{}, trunkHop, *URI, error) {
+	numbers := make(map[string]struct{})
+	for _, number := range cfg.Numbers {
+		number = strings.TrimSpace(number)
+		if number == "" {
+			continue
+		}
+		if strings.Trim(number, "0123456789+*#") != "" {
+			return nil, trunkHop{}, nil, fmt.Errorf("emergency number %q may only contain digits, +, *, and #", number)
+		}
+		numbers[number] = struct{}{}
+	}
+	route := strings.TrimSpace(cfg.Route)
+	if len(numbers) == 0 {
+		if route != "" {
+			return nil, trunkHop{}, nil, fmt.Errorf("emergency route %q needs emergency numbers", route)
+		}
+		return nil, trunkHop{}, nil, nil
+	}
+	if route == "" {
+		return nil, trunkHop{}, nil, fmt.Errorf("emergency numbers need an emergency route")
+	}
+	if lower := strings.ToLower(route); strings.HasPrefix(lower, "sip:") || strings.HasPrefix(lower, "sips:") {
+		target, err := ParseURI(route)
+		if err != nil || target.Host == "" {
+			return nil, trunkHop{}, nil, fmt.Errorf("invalid emergency route %q", route)
+		}
+		return numbers, trunkHop{}, target, nil
+	}
+	hop, ok := findTrunkHop(route, trunks)
+	if !ok {
+		return nil, trunkHop{}, nil, fmt.Errorf("emergency route %q is neither a SIP URI nor a configured trunk", route)
+	}
+	return numbers, hop, nil, nil
+}
+
+// routes reports whether req, an out-of-dialog request other than ACK, is
+// addressed to an emergency number, and if so sends it on the emergency
+// route, returning the trunk or URI it goes to.
+func (e *Emergency) routes(req *Message) (string, bool) {
+	if e == nil || strings.EqualFold(req.Method, "ACK") || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return "", false
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil {
+		return "", false
+	}
+	e.mu.RLock()
+	_, emergency := e.numbers[uri.User]
+	hop, target := e.hop, e.target
+	e.mu.RUnlock()
+	if !emergency {
+		return "", false
+	}
+
+	route := hop.trunk
+	if target != nil {
+		direct := *target
+		if direct.User == "" {
+			direct.User = uri.User
+		}
+		req.RequestURI = direct.String()
+		req.nextHop = direct.HostPort()
+		req.trunkName = ""
+		req.trunkAlternates = nil
+		route = req.RequestURI
+	} else {
+		req.sendThrough([]trunkHop{hop})
+	}
+	e.logger.Warn("emergency request routed", "method", req.Method, "number", uri.User, "from", req.GetHeader("From"), "call_id", req.GetHeader("Call-ID"), "route", route)
+	return route, true
+}
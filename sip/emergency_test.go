@@ -0,0 +1,78 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyRoutesEmergencyNumbersAheadOfOtherChecks(t *testing.T) {
+	trunks, err := normalizeTrunks([]TrunkConfig{{Registrar: "203.0.113.5", Domain: "provider.example", Username: "main"}})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "1", Reject: 403}}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	emergency, err := NewEmergency(EmergencyConfig{Numbers: []string{"110", "119"}, Route: "main@provider.example"}, trunks, nil)
+	if err != nil {
+		t.Fatalf("NewEmergency returned error: %v", err)
+	}
+	calls := NewCallLog(0)
+	proxy := NewProxy(WithDialPlan(plan), WithEmergency(emergency), WithCallLog(calls))
+	t.Cleanup(proxy.Stop)
+	proxy.Drain()
+
+	invite := newInvite()
+	invite.RequestURI = "sip:110@example.com"
+	proxy.SendFromClient(invite)
+	for {
+		msg, ok := proxy.NextToServer(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the emergency INVITE to be forwarded while draining")
+		}
+		if msg.Method != "INVITE" {
+			continue
+		}
+		if msg.RequestURI != "sip:110@provider.example" || msg.nextHop != "203.0.113.5:5060" || msg.trunkName != "main@provider.example" {
+			t.Fatalf("expected the emergency trunk, got %q via %q", msg.RequestURI, msg.nextHop)
+		}
+		break
+	}
+	recent := calls.Recent("alice", "example.com", 0)
+	if len(recent) != 1 || recent[0].Route != "main@provider.example" {
+		t.Fatalf("expected the call record to name the emergency route, got %+v", recent)
+	}
+
+	other := newInvite()
+	other.RequestURI = "sip:111@example.com"
+	other.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKother")
+	other.SetHeader("Call-ID", "other@client.example")
+	proxy.SendFromClient(other)
+	resp, ok := proxy.NextToClient(200 * time.Millisecond)
+	if !ok || resp.StatusCode != 503 {
+		t.Fatalf("expected other calls to be refused while draining, got %v", resp)
+	}
+}
+
+func TestNewEmergencyRejectsIncompleteConfig(t *testing.T) {
+	for _, cfg := range []EmergencyConfig{
+		{Numbers: []string{"110"}},
+		{Route: "sip:psap.example"},
+		{Numbers: []string{"11x"}, Route: "sip:psap.example"},
+		{Numbers: []string{"110"}, Route: "unknown@provider.example"},
+	} {
+		if _, err := NewEmergency(cfg, nil, nil); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+	emergency, err := NewEmergency(EmergencyConfig{Numbers: []string{"119"}, Route: "sip:psap.example:5070"}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEmergency returned error: %v", err)
+	}
+	req := newInvite()
+	req.RequestURI = "sip:119@example.com"
+	if route, ok := emergency.routes(req); !ok || route != "sip:119@psap.example:5070" || req.nextHop != "psap.example:5070" {
+		t.Fatalf("expected the dialed number at the emergency URI, got %q via %q", route, req.nextHop)
+	}
+}
@@ -0,0 +1,443 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ENUMConfig turns on ENUM lookups (RFC 6116), which find the SIP URI a
+// telephone number is reachable at in DNS so that calls the dial plan sends
+// through trunks go straight there instead.
+//
+// Suffixes are the ENUM domains to look numbers up under, such as
+// "e164.arpa", tried in order until one has a SIP record; none turns lookups
+// off. Resolver is the DNS server to ask, as host:port; empty uses the first
+// nameserver of /etc/resolv.conf. Timeout bounds each query and defaults to
+// one second. CacheTTL is the longest a result is remembered, defaulting to
+// five minutes; an answer is kept no longer than its records' TTL, and a
+// number without records is remembered for CacheTTL.
+type ENUMConfig struct {
+	Suffixes []string
+	Resolver string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+const (
+	defaultENUMTimeout  = time.Second
+	defaultENUMCacheTTL = 5 * time.Minute
+	// enumCacheLimit bounds the cached numbers; a full cache is emptied.
+	enumCacheLimit = 10000
+)
+
+// ENUM looks up the SIP URIs of E.164 numbers and caches the results. It is
+// safe for concurrent use.
+type ENUM struct {
+	mu     sync.Mutex
+	cfg    ENUMConfig
+	server string
+	cache  map[string]enumResult
+}
+
+type enumResult struct {
+	uri     string
+	expires time.Time
+}
+
+// NewENUM returns an ENUM resolver for cfg, or an error when cfg is invalid.
+func NewENUM(cfg ENUMConfig) (*ENUM, error) {
+	e := &ENUM{}
+	if err := e.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Configure replaces the resolver's settings and forgets its cached results,
+// leaving it as it was when cfg is invalid.
+func (e *ENUM) Configure(cfg ENUMConfig) error {
+	cfg, server, err := normalizeENUM(cfg)
+	if err != nil {
+		return err
+	}
+	e.set(cfg, server)
+	return nil
+}
+
+func (e *ENUM) set(cfg ENUMConfig, server string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cfg = cfg
+	e.server = server
+	e.cache = make(map[string]enumResult)
+}
+
+func normalizeENUM(cfg ENUMConfig) (ENUMConfig, string, error) {
+	var suffixes []string
+	for _, suffix := range cfg.Suffixes {
+		suffix = strings.Trim(strings.TrimSpace(suffix), ".")
+		if suffix == "" {
+			continue
+		}
+		if strings.ContainsAny(suffix, " \t/:") {
+			return cfg, "", fmt.Errorf("invalid ENUM suffix %q", suffix)
+		}
+		suffixes = append(suffixes, strings.ToLower(suffix))
+	}
+	cfg.Suffixes = suffixes
+	if cfg.Timeout < 0 || cfg.CacheTTL < 0 {
+		return cfg, "", fmt.Errorf("ENUM timeout and cache TTL must not be negative")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultENUMTimeout
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = defaultENUMCacheTTL
+	}
+	cfg.Resolver = strings.TrimSpace(cfg.Resolver)
+	if len(suffixes) == 0 {
+		return cfg, "", nil
+	}
+	server := cfg.Resolver
+	if server == "" {
+		server = systemNameserver()
+	} else if _, _, err := net.SplitHostPort(server); err != nil {
+		return cfg, "", fmt.Errorf("invalid ENUM resolver %q: %v", server, err)
+	}
+	return cfg, server, nil
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf, or the
+// local host when there is none.
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Lookup returns the SIP URI ENUM gives for number, an E.164 number with or
+// without its leading '+'. It reports false when lookups are off, number is
+// not one, or no suffix has a SIP record for it.
+func (e *ENUM) Lookup(ctx context.Context, number string) (string, bool) {
+	digits := strings.TrimPrefix(number, "+")
+	if e == nil || len(digits) == 0 || len(digits) > 15 || strings.Trim(digits, "0123456789") != "" {
+		return "", false
+	}
+	e.mu.Lock()
+	cfg, server := e.cfg, e.server
+	cached, ok := e.cache[digits]
+	e.mu.Unlock()
+	if len(cfg.Suffixes) == 0 {
+		return "", false
+	}
+	now := time.Now()
+	if ok && now.Before(cached.expires) {
+		return cached.uri, cached.uri != ""
+	}
+
+	result := enumResult{expires: now.Add(cfg.CacheTTL)}
+	for _, suffix := range cfg.Suffixes {
+		queryCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		records, err := queryNAPTR(queryCtx, server, enumDomain(digits, suffix))
+		cancel()
+		if err != nil {
+			continue
+		}
+		if uri, ttl, ok := enumTarget(records, "+"+digits); ok {
+			result.uri = uri
+			if expires := now.Add(ttl); expires.Before(result.expires) {
+				result.expires = expires
+			}
+			break
+		}
+	}
+
+	e.mu.Lock()
+	if len(e.cache) >= enumCacheLimit {
+		e.cache = make(map[string]enumResult)
+	}
+	e.cache[digits] = result
+	e.mu.Unlock()
+	return result.uri, result.uri != ""
+}
+
+// enumDomain returns the domain ENUM keeps the records of digits under: the
+// digits in reverse order, each a label, followed by suffix.
+func enumDomain(digits, suffix string) string {
+	var b strings.Builder
+	for i := len(digits) - 1; i >= 0; i-- {
+		b.WriteByte(digits[i])
+		b.WriteByte('.')
+	}
+	b.WriteString(suffix)
+	return b.String()
+}
+
+// naptrRecord is a DNS NAPTR resource record (RFC 3403).
+type naptrRecord struct {
+	order, preference uint16
+	flags, services   string
+	regexp            string
+	replacement       string
+	ttl               time.Duration
+}
+
+// enumTarget picks the SIP URI from the NAPTR records of an ENUM domain,
+// applying the regular expression of the most preferred terminal record whose
+// service is E2U+sip to aus, the number with its '+'. Non-terminal records,
+// which would lead to further lookups, are not followed.
+func enumTarget(records []naptrRecord, aus string) (string, time.Duration, bool) {
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].order != records[j].order {
+			return records[i].order < records[j].order
+		}
+		return records[i].preference < records[j].preference
+	})
+	for _, record := range records {
+		if !strings.EqualFold(record.flags, "u") || !isSIPService(record.services) {
+			continue
+		}
+		uri, ok := applyNAPTRRegexp(record.regexp, aus)
+		if !ok {
+			continue
+		}
+		if lower := strings.ToLower(uri); strings.HasPrefix(lower, "sip:") || strings.HasPrefix(lower, "sips:") {
+			return uri, record.ttl, true
+		}
+	}
+	return "", 0, false
+}
+
+// isSIPService reports whether a NAPTR services field, such as "E2U+sip" or
+// "E2U+voice:sip+sip", offers SIP.
+func isSIPService(services string) bool {
+	rest, ok := strings.CutPrefix(strings.ToLower(services), "e2u+")
+	if !ok {
+		return false
+	}
+	for _, service := range strings.Split(rest, "+") {
+		if service == "sip" || strings.HasSuffix(service, ":sip") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyNAPTRRegexp applies a NAPTR substitution expression such as
+// "!^.*$!sip:info@example.com!" to aus. Its first character delimits the
+// pattern, the replacement, and the flags, of which "i" ignores case; \1 to
+// \9 in the replacement stand for the pattern's groups.
+func applyNAPTRRegexp(expr, aus string) (string, bool) {
+	if expr == "" {
+		return "", false
+	}
+	parts := strings.Split(expr[1:], expr[:1])
+	if len(parts) != 3 {
+		return "", false
+	}
+	pattern := parts[0]
+	if strings.Contains(parts[2], "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", false
+	}
+	match := re.FindStringSubmatchIndex(aus)
+	if match == nil {
+		return "", false
+	}
+	var template strings.Builder
+	for i := 0; i < len(parts[1]); i++ {
+		switch c := parts[1][i]; {
+		case c == '\\' && i+1 < len(parts[1]):
+			i++
+			if next := parts[1][i]; next >= '0' && next <= '9' {
+				template.WriteString("${" + string(next) + "}")
+			} else {
+				template.WriteByte(next)
+			}
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+	result := re.ExpandString(nil, template.String(), aus, match)
+	return aus[:match[0]] + string(result) + aus[match[1]:], true
+}
+
+const (
+	dnsTypeNAPTR = 35
+	dnsClassIN   = 1
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// queryNAPTR asks server for the NAPTR records of name over UDP. A name that
+// does not exist has no records.
+func queryNAPTR(ctx context.Context, server, name string) ([]naptrRecord, error) {
+	id := uint16(rand.Uint32())
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(query[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, dnsTypeNAPTR)
+	query = binary.BigEndian.AppendUint16(query, dnsClassIN)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Datagrams answering other queries are ignored.
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id && buf[2]&0x80 != 0 {
+			return parseNAPTRResponse(buf[:n])
+		}
+	}
+}
+
+// parseNAPTRResponse returns the NAPTR records among the answers of a DNS
+// response.
+func parseNAPTRResponse(msg []byte) ([]naptrRecord, error) {
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("DNS server answered with rcode %d", rcode)
+	}
+	questions := binary.BigEndian.Uint16(msg[4:])
+	answers := binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	var err error
+	for range questions {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	var records []naptrRecord
+	for range answers {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		end := off + length
+		if end > len(msg) {
+			return nil, errDNSMessage
+		}
+		if rrType == dnsTypeNAPTR {
+			record, err := parseNAPTR(msg, off, end)
+			if err != nil {
+				return nil, err
+			}
+			record.ttl = time.Duration(ttl) * time.Second
+			records = append(records, record)
+		}
+		off = end
+	}
+	return records, nil
+}
+
+// parseNAPTR reads the NAPTR data held in msg[off:end].
+func parseNAPTR(msg []byte, off, end int) (naptrRecord, error) {
+	var record naptrRecord
+	if off+4 > end {
+		return record, errDNSMessage
+	}
+	record.order = binary.BigEndian.Uint16(msg[off:])
+	record.preference = binary.BigEndian.Uint16(msg[off+2:])
+	off += 4
+	for _, field := range []*string{&record.flags, &record.services, &record.regexp} {
+		if off >= end || off+1+int(msg[off]) > end {
+			return record, errDNSMessage
+		}
+		*field = string(msg[off+1 : off+1+int(msg[off])])
+		off += 1 + int(msg[off])
+	}
+	replacement, _, err := readDNSName(msg, off)
+	record.replacement = replacement
+	return record, err
+}
+
+// readDNSName reads the possibly compressed domain name at msg[off:] and
+// returns it with the offset just past it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case length > 63 || off+1+length > len(msg):
+			return "", 0, errDNSMessage
+		default:
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
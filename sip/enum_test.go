@@ -0,0 +1,166 @@
+package sip
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveENUM answers NAPTR queries on a local UDP socket from records, keyed
+// by domain, and counts the queries it receives. Unknown domains get
+// NXDOMAIN.
+func serveENUM(t *testing.T, records map[string][]naptrRecord) (string, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			name, end, err := readDNSName(buf[:n], 12)
+			if err != nil {
+				continue
+			}
+			resp := append([]byte(nil), buf[:end+4]...)
+			resp[2] |= 0x80
+			answers := records[name]
+			if answers == nil {
+				resp[3] |= 3
+			}
+			binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+			for _, record := range answers {
+				var data []byte
+				data = binary.BigEndian.AppendUint16(data, record.order)
+				data = binary.BigEndian.AppendUint16(data, record.preference)
+				for _, field := range []string{record.flags, record.services, record.regexp} {
+					data = append(data, byte(len(field)))
+					data = append(data, field...)
+				}
+				data = append(data, 0)
+				resp = append(resp, 0xc0, 12) // the question's name
+				resp = binary.BigEndian.AppendUint16(resp, dnsTypeNAPTR)
+				resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+				resp = binary.BigEndian.AppendUint32(resp, uint32(record.ttl/time.Second))
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(data)))
+				resp = append(resp, data...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestENUMLookupPicksPreferredSIPRecordAndCaches(t *testing.T) {
+	server, queries := serveENUM(t, map[string][]naptrRecord{
+		"8.7.6.5.4.3.2.1.3.1.8.e164.example": {
+			{order: 100, preference: 20, flags: "u", services: "E2U+sip", regexp: "!^.*$!sip:backup@voip.example!", ttl: time.Hour},
+			{order: 100, preference: 10, flags: "u", services: "E2U+sip", regexp: `!^\+81(.*)$!sip:0\1@voip.example!`, ttl: time.Hour},
+			{order: 50, preference: 10, flags: "u", services: "E2U+email:mailto", regexp: "!^.*$!mailto:info@example.com!", ttl: time.Hour},
+		},
+	})
+	enum, err := NewENUM(ENUMConfig{Suffixes: []string{"missing.example", "e164.example."}, Resolver: server})
+	if err != nil {
+		t.Fatalf("NewENUM returned error: %v", err)
+	}
+
+	ctx := context.Background()
+	uri, ok := enum.Lookup(ctx, "+81312345678")
+	if !ok || uri != "sip:0312345678@voip.example" {
+		t.Fatalf("expected the preferred SIP record, got %q, %v", uri, ok)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Fatalf("expected one query per suffix, got %d", got)
+	}
+	if uri, ok := enum.Lookup(ctx, "81312345678"); !ok || uri != "sip:0312345678@voip.example" {
+		t.Fatalf("expected the cached result for the number without +, got %q, %v", uri, ok)
+	}
+	if _, ok := enum.Lookup(ctx, "+819012345678"); ok {
+		t.Fatalf("expected no URI for a number without records")
+	}
+	if _, ok := enum.Lookup(ctx, "+819012345678"); ok {
+		t.Fatalf("expected no URI for a number without records")
+	}
+	if got := queries.Load(); got != 4 {
+		t.Fatalf("expected cached results not to be queried again, got %d queries", got)
+	}
+	if _, ok := enum.Lookup(ctx, "alice"); ok {
+		t.Fatalf("expected names not to be looked up")
+	}
+}
+
+func TestApplyNAPTRRegexp(t *testing.T) {
+	tests := []struct {
+		expr, want string
+		ok         bool
+	}{
+		{"!^.*$!sip:info@example.com!", "sip:info@example.com", true},
+		{`!^\+(.*)$!sip:\1@example.com!`, "sip:81312345678@example.com", true},
+		{`/^\+81/sip:+81/i`, "sip:+81312345678", true},
+		{"!^\\+1.*$!sip:us@example.com!", "", false},
+		{"!^.*$!sip:x@example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := applyNAPTRRegexp(tt.expr, "+81312345678")
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("applyNAPTRRegexp(%q) = %q, %v; want %q, %v", tt.expr, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestProxyRoutesByENUMBeforeTrunks(t *testing.T) {
+	server, _ := serveENUM(t, map[string][]naptrRecord{
+		"8.7.6.5.4.3.2.1.3.1.8.e164.arpa": {
+			{order: 10, preference: 10, flags: "u", services: "E2U+sip", regexp: "!^.*$!sip:reception@192.0.2.44:5070!", ttl: time.Hour},
+		},
+	})
+	trunks, err := normalizeTrunks([]TrunkConfig{{Registrar: "203.0.113.5", Domain: "provider.example", Username: "main"}})
+	if err != nil {
+		t.Fatalf("normalizeTrunks returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "0", Strip: 1, Prepend: "+81", Trunk: "main@provider.example"}}, trunks)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	enum, err := NewENUM(ENUMConfig{Suffixes: []string{"e164.arpa"}, Resolver: server})
+	if err != nil {
+		t.Fatalf("NewENUM returned error: %v", err)
+	}
+	proxy := NewProxy(WithDialPlan(plan), WithENUM(enum))
+	t.Cleanup(proxy.Stop)
+
+	for _, tt := range []struct{ dialed, uri, nextHop string }{
+		{"0312345678", "sip:reception@192.0.2.44:5070", "192.0.2.44:5070"},
+		{"0398765432", "sip:+81398765432@provider.example", "203.0.113.5:5060"},
+	} {
+		invite := newInvite()
+		invite.RequestURI = "sip:" + tt.dialed + "@example.com"
+		invite.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+tt.dialed)
+		invite.SetHeader("Call-ID", tt.dialed+"@client.example")
+		proxy.SendFromClient(invite)
+		for {
+			msg, ok := proxy.NextToServer(2 * time.Second)
+			if !ok {
+				t.Fatalf("expected the INVITE to %s to be forwarded", tt.dialed)
+			}
+			if msg.Method != "INVITE" || msg.GetHeader("Call-ID") != tt.dialed+"@client.example" {
+				continue
+			}
+			if msg.RequestURI != tt.uri || msg.nextHop != tt.nextHop || strings.Contains(tt.uri, "reception") != (msg.trunkName == "") {
+				t.Fatalf("INVITE to %s went to %q via %q (trunk %q)", tt.dialed, msg.RequestURI, msg.nextHop, msg.trunkName)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package sip
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind identifies what an Event reports.
+type EventKind string
+
+const (
+	// EventRegistered is published when a REGISTER adds or refreshes a
+	// binding.
+	EventRegistered EventKind = "registered"
+	// EventUnregistered is published when a binding is removed by an
+	// expires=0 or wildcard REGISTER or by Deregister. Bindings that simply
+	// expire are not announced.
+	EventUnregistered EventKind = "unregistered"
+	// EventAuthFailed is published when the registrar rejects a REGISTER for
+	// an unknown or disabled user or for wrong credentials. Challenges are
+	// not failures.
+	EventAuthFailed EventKind = "auth_failed"
+	// EventTransactionTimeout is published when Timer B, C, F, or H ends a
+	// transaction without a final response or ACK.
+	EventTransactionTimeout EventKind = "transaction_timeout"
+	// EventCallStarted is published when an initial INVITE arrives.
+	EventCallStarted EventKind = "call_started"
+	// EventCallAnswered is published when a 2xx answers an initial INVITE.
+	EventCallAnswered EventKind = "call_answered"
+	// EventCallEnded is published at the error response that ends a call
+	// attempt or at the first BYE of an answered call.
+	EventCallEnded EventKind = "call_ended"
+)
+
+// Event is one occurrence published on an EventBus. Only the fields relevant
+// to the kind are set: AOR, Contact, and Source for registration and
+// authentication events; CallID, Caller, Callee, and Route for call events;
+// CallID, Method, and Timer for timeouts. Status is the final response of a
+// call or the rejection sent for an authentication failure, and Reason
+// explains the rejection.
+type Event struct {
+	Kind    EventKind `json:"kind"`
+	Time    time.Time `json:"time"`
+	AOR     string    `json:"aor,omitempty"`
+	Contact string    `json:"contact,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	CallID  string    `json:"call_id,omitempty"`
+	Caller  string    `json:"caller,omitempty"`
+	Callee  string    `json:"callee,omitempty"`
+	Method  string    `json:"method,omitempty"`
+	Timer   string    `json:"timer,omitempty"`
+	Status  int       `json:"status,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Route   string    `json:"route,omitempty"`
+}
+
+// defaultEventBuffer is the subscription buffer used when none is given.
+const defaultEventBuffer = 64
+
+// EventBus fans events published by the registrar, the transaction layer, and
+// the proxy core out to subscribers. Publishing never blocks the SIP path: an
+// event that does not fit a subscriber's buffer is dropped for that
+// subscriber and counted in Dropped. A nil *EventBus discards everything.
+type EventBus struct {
+	mu      sync.Mutex
+	nextID  int
+	subs    map[int]*eventSubscription
+	dropped atomic.Uint64
+	now     func() time.Time
+}
+
+type eventSubscription struct {
+	ch    chan Event
+	kinds map[EventKind]struct{}
+}
+
+// NewEventBus returns a bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]*eventSubscription), now: time.Now}
+}
+
+// Subscribe returns a channel receiving the events of the given kinds, or of
+// every kind when none are given, buffered to hold buffer events (a default
+// when not positive). cancel stops delivery and closes the channel; it is
+// safe to call more than once.
+func (b *EventBus) Subscribe(buffer int, kinds ...EventKind) (events <-chan Event, cancel func()) {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+	sub := &eventSubscription{ch: make(chan Event, buffer)}
+	if len(kinds) > 0 {
+		sub.kinds = make(map[EventKind]struct{}, len(kinds))
+		for _, kind := range kinds {
+			sub.kinds[kind] = struct{}{}
+		}
+	}
+	if b == nil {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = sub
+	b.mu.Unlock()
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			close(sub.ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Dropped reports how many deliveries were skipped because a subscriber's
+// buffer was full.
+func (b *EventBus) Dropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.dropped.Load()
+}
+
+// publish stamps evt with the current time and offers it to every interested
+// subscriber.
+func (b *EventBus) publish(evt Event) {
+	if b == nil {
+		return
+	}
+	evt.Time = b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if sub.kinds != nil {
+			if _, ok := sub.kinds[evt.Kind]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.ch <- evt:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// callEvent describes a call log transition.
+func callEvent(kind EventKind, record CallRecord) Event {
+	return Event{
+		Kind:   kind,
+		CallID: record.CallID,
+		Caller: record.Caller,
+		Callee: record.Callee,
+		Status: record.Status,
+		Route:  record.Route,
+	}
+}
+
+// timeoutEvent describes the transaction whose request data holds when timer
+// ends it.
+func timeoutEvent(timer byte, data *transactionData) Event {
+	evt := Event{Kind: EventTransactionTimeout, Timer: string(rune(timer))}
+	if data != nil && data.request != nil {
+		evt.CallID = data.request.GetHeader("Call-ID")
+		evt.Method = data.request.Method
+	}
+	return evt
+}
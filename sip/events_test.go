@@ -0,0 +1,133 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestEventBusFiltersAndDropsWhenFull(t *testing.T) {
+	bus := NewEventBus()
+	calls, cancelCalls := bus.Subscribe(1, EventCallStarted)
+	all, cancelAll := bus.Subscribe(10)
+	defer cancelAll()
+
+	bus.publish(Event{Kind: EventRegistered, AOR: "alice@example.com"})
+	bus.publish(Event{Kind: EventCallStarted, CallID: "one"})
+	bus.publish(Event{Kind: EventCallStarted, CallID: "two"})
+
+	if evt := <-calls; evt.CallID != "one" || evt.Time.IsZero() {
+		t.Fatalf("expected first call event with a timestamp, got %+v", evt)
+	}
+	if got := bus.Dropped(); got != 1 {
+		t.Fatalf("expected the second call event to be dropped, got %d drops", got)
+	}
+	if got := len(all); got != 3 {
+		t.Fatalf("expected unfiltered subscriber to receive 3 events, got %d", got)
+	}
+
+	cancelCalls()
+	cancelCalls()
+	if _, open := <-calls; open {
+		t.Fatalf("expected cancelled subscription to be closed")
+	}
+	bus.publish(Event{Kind: EventCallStarted})
+	if got := bus.Dropped(); got != 1 {
+		t.Fatalf("expected no deliveries to a cancelled subscription, got %d drops", got)
+	}
+
+	var nilBus *EventBus
+	nilBus.publish(Event{Kind: EventCallStarted})
+	if _, open := <-func() <-chan Event { ch, _ := nilBus.Subscribe(0); return ch }(); open {
+		t.Fatalf("expected a nil bus to hand out closed channels")
+	}
+}
+
+func TestProxyPublishesCallEvents(t *testing.T) {
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(10, EventCallStarted, EventCallAnswered, EventCallEnded)
+	defer cancel()
+	proxy := NewProxy(WithEventBus(bus))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded invite")
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	if _, ok := proxy.NextToClient(100 * time.Millisecond); !ok {
+		t.Fatalf("expected final response downstream")
+	}
+	bye := newInvite()
+	bye.Method = "BYE"
+	bye.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclientbye")
+	bye.SetHeader("To", "<sip:bob@example.com>;tag=callee")
+	bye.SetHeader("CSeq", "314160 BYE")
+	proxy.SendFromClient(bye)
+	if _, ok := proxy.NextToServer(100 * time.Millisecond); !ok {
+		t.Fatalf("expected forwarded BYE")
+	}
+
+	for _, want := range []EventKind{EventCallStarted, EventCallAnswered, EventCallEnded} {
+		select {
+		case evt := <-events:
+			if evt.Kind != want || evt.CallID != "a84b4c76e66710" || evt.Caller != "alice@example.com" || evt.Callee != "bob@example.com" {
+				t.Fatalf("expected %s for the call, got %+v", want, evt)
+			}
+			if want != EventCallStarted && evt.Status != 200 {
+				t.Fatalf("expected %s to carry the 200 answer, got %+v", want, evt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestRegistrarPublishesBindingAndAuthEvents(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(10)
+	defer cancel()
+	registrar := NewRegistrar(store,
+		WithRegistrarEvents(bus),
+		WithSourceLookup(func(req *Message) string { return "192.0.2.7:5062" }),
+	)
+
+	resp, _ := registrar.handleRegister(context.Background(), newRegisterRequest())
+	nonce := extractNonce(t, resp)
+	if len(events) != 0 {
+		t.Fatalf("expected a challenge not to publish events, got %+v", <-events)
+	}
+
+	bad := newRegisterRequest()
+	bad.SetHeader("Authorization", buildAuthorization("alice", realm, md5Hex("wrong"), nonce, 1, "cnonce", bad.Method, bad.RequestURI))
+	if resp, _ := registrar.handleRegister(context.Background(), bad); resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for wrong credentials, got %d", resp.StatusCode)
+	}
+	if evt := <-events; evt.Kind != EventAuthFailed || evt.AOR != "alice@example.com" || evt.Status != 403 || evt.Source != "192.0.2.7:5062" || evt.Reason == "" {
+		t.Fatalf("unexpected auth failure event: %+v", evt)
+	}
+
+	req := newRegisterRequest()
+	req.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, 2, "cnonce", req.Method, req.RequestURI))
+	if resp, _ := registrar.handleRegister(context.Background(), req); resp.StatusCode != 200 {
+		t.Fatalf("expected registration to succeed, got %d", resp.StatusCode)
+	}
+	if evt := <-events; evt.Kind != EventRegistered || evt.Contact != "<sip:alice@client.example.com>" {
+		t.Fatalf("unexpected registration event: %+v", evt)
+	}
+
+	if err := registrar.Deregister(context.Background(), "alice", realm, "<sip:alice@client.example.com>"); err != nil {
+		t.Fatalf("Deregister returned error: %v", err)
+	}
+	if evt := <-events; evt.Kind != EventUnregistered || evt.AOR != "alice@example.com" || evt.Contact != "<sip:alice@client.example.com>" {
+		t.Fatalf("unexpected deregistration event: %+v", evt)
+	}
+}
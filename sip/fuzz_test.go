@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzParseMessage(f *testing.F) {
+	for _, tc := range tortureCases {
+		f.Add(tc.raw)
+	}
+	f.Add(newInvite().String())
+	f.Fuzz(func(t *testing.T, raw string) {
+		for _, p := range []Parser{{}, {Lenient: true}} {
+			msg, err := p.Parse(raw)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidMessage) {
+					t.Fatalf("lenient=%v: unexpected error %v", p.Lenient, err)
+				}
+				continue
+			}
+			// Whatever parses must render to something that parses again,
+			// since the proxy forwards what it receives.
+			wire := string(msg.AppendWire(nil))
+			again, err := ParseMessage(wire)
+			if err != nil {
+				t.Fatalf("lenient=%v: rendered message does not parse: %v\n%q", p.Lenient, err, wire)
+			}
+			if again.Body != msg.Body || again.StatusCode != msg.StatusCode || again.Method != msg.Method {
+				t.Fatalf("lenient=%v: round trip changed the message\n%q\n%q", p.Lenient, raw, wire)
+			}
+			msg.HeaderList("Via")
+			msg.HeaderList("Contact")
+		}
+	})
+}
+
+func FuzzParseURI(f *testing.F) {
+	for _, seed := range []string{
+		"sip:alice@example.com",
+		"sips:bob:secret@[2001:db8::1]:5061;transport=tcp;lr?subject=hi&priority=urgent",
+		"sip:user;par=u%40example.net@example.com",
+		"sip:+1-212-555-1212:1234@gateway.com;user=phone",
+		"\"Alice\" <sip:alice@example.com;lr>;tag=1",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		ParseAddress(raw)
+		u, err := ParseURI(raw)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidURI) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		again, err := ParseURI(u.String())
+		if err != nil {
+			t.Fatalf("%q renders as %q, which does not parse: %v", raw, u.String(), err)
+		}
+		if !u.Equal(again) {
+			t.Fatalf("%q renders as %q, which is not equal", raw, u.String())
+		}
+		u.HostPort()
+	})
+}
+
+func FuzzParseDigestAuthorization(f *testing.F) {
+	for _, seed := range []string{
+		`Digest username="alice", realm="example.com", nonce="abc", uri="sip:example.com", response="0123456789abcdef0123456789abcdef", algorithm=MD5`,
+		`Digest realm="a,b", qop="auth,auth-int", nc=00000001, cnonce="x\"y"`,
+		`digest username=`,
+		`Basic dXNlcjpwYXNz`,
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		params, ok := parseDigestAuthorization(header)
+		if ok && len(params) == 0 {
+			t.Fatalf("%q reported success without parameters", header)
+		}
+		for key := range params {
+			if key == "" || key != strings.ToLower(key) {
+				t.Fatalf("%q yielded parameter name %q", header, key)
+			}
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package sip
+
+import "strings"
+
+// HeaderList returns the elements of a list-valued header such as Via,
+// Route, Record-Route, or Contact. RFC 3261 section 7.3.1 allows the
+// elements to arrive on separate lines, comma-separated on one line, or any
+// mix of the two, so every line is split; commas inside quoted strings and
+// angle brackets do not separate elements. Elements are trimmed and empty
+// ones skipped.
+func (m *Message) HeaderList(name string) []string {
+	if m.Headers == nil {
+		return nil
+	}
+	values := m.Headers[canonicalHeader(name)]
+	if len(values) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		out = appendHeaderList(out, value)
+	}
+	return out
+}
+
+// appendHeaderList appends the trimmed, non-empty comma-separated elements
+// of value to dst.
+func appendHeaderList(dst []string, value string) []string {
+	inQuote, escaped, depth, start := false, false, 0, 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '<':
+			depth++
+		case c == '>':
+			if depth > 0 {
+				depth--
+			}
+		case c == ',' && depth == 0:
+			if element := strings.TrimSpace(value[start:i]); element != "" {
+				dst = append(dst, element)
+			}
+			start = i + 1
+		}
+	}
+	if element := strings.TrimSpace(value[start:]); element != "" {
+		dst = append(dst, element)
+	}
+	return dst
+}
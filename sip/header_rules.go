@@ -0,0 +1,324 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// HeaderRule is one step of the header manipulation pipeline, which fixes
+// interoperability quirks, such as proprietary headers or an unwelcome
+// Contact format, by configuration. Its conditions all have to hold for it to
+// apply to a message; an empty condition always holds.
+type HeaderRule struct {
+	// Name identifies the rule in errors.
+	Name string
+
+	// Direction is "in" for messages the proxy receives, "out" for those
+	// it sends, or empty for both.
+	Direction string
+	// Methods are the request methods, such as INVITE, of which a request,
+	// or the request a response answers, must be one.
+	Methods []string
+	// Peers are the addresses, CIDR prefixes, and host names of which the
+	// other side must be one: where a received request came from, where a
+	// sent request is addressed, or the side a response travels from or
+	// to.
+	Peers []string
+
+	// Header is the header acted on.
+	Header string
+	// Action is "add", appending Value; "set", replacing every value with
+	// Value; "remove", deleting the values Match matches, or all of them
+	// without Match; or "rewrite", replacing what Match matches in each
+	// value with Value, in which $1 or ${1} stand for Match's first group.
+	Action string
+	Match  string
+	Value  string
+}
+
+// protectedHeaders are the canonical keys of the headers transactions are
+// matched by and the message is framed by, which rules may not change.
+var protectedHeaders = map[string]bool{
+	"Via":            true,
+	"Call-Id":        true,
+	"Cseq":           true,
+	"Content-Length": true,
+}
+
+type headerRule struct {
+	HeaderRule
+	methods map[string]bool
+	peers   peerSet
+	match   *regexp.Regexp
+}
+
+// peerSet is a list of peers given as addresses, CIDR prefixes, and host
+// names.
+type peerSet struct {
+	prefixes []*net.IPNet
+	names    []string
+}
+
+func parsePeers(peers []string) (peerSet, error) {
+	var set peerSet
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		switch {
+		case peer == "":
+		case strings.Contains(peer, "/"):
+			_, prefix, err := net.ParseCIDR(peer)
+			if err != nil {
+				return peerSet{}, fmt.Errorf("invalid peer %q", peer)
+			}
+			set.prefixes = append(set.prefixes, prefix)
+		case net.ParseIP(peer) != nil:
+			ip := net.ParseIP(peer)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			set.prefixes = append(set.prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case validHostname(peer):
+			set.names = append(set.names, peer)
+		default:
+			return peerSet{}, fmt.Errorf("invalid peer %q", peer)
+		}
+	}
+	return set, nil
+}
+
+func (p peerSet) empty() bool {
+	return len(p.prefixes) == 0 && len(p.names) == 0
+}
+
+// contains reports whether peer, an address or host name, is in the set.
+func (p peerSet) contains(peer string) bool {
+	if ip := net.ParseIP(peer); ip != nil {
+		for _, prefix := range p.prefixes {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range p.names {
+		if strings.EqualFold(name, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderRules applies an ordered pipeline of header rules to the messages
+// the transaction user receives and sends. The rules may be swapped at
+// runtime with Replace. It is safe for concurrent use.
+type HeaderRules struct {
+	mu    sync.RWMutex
+	rules []*headerRule
+}
+
+// NewHeaderRules compiles rules into a pipeline.
+func NewHeaderRules(rules []HeaderRule) (*HeaderRules, error) {
+	compiled, err := compileHeaderRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderRules{rules: compiled}, nil
+}
+
+// Replace swaps the pipeline for rules, leaving it as it was when one is
+// invalid.
+func (h *HeaderRules) Replace(rules []HeaderRule) error {
+	compiled, err := compileHeaderRules(rules)
+	if err != nil {
+		return err
+	}
+	h.set(compiled)
+	return nil
+}
+
+func (h *HeaderRules) set(rules []*headerRule) {
+	h.mu.Lock()
+	h.rules = rules
+	h.mu.Unlock()
+}
+
+func compileHeaderRules(rules []HeaderRule) ([]*headerRule, error) {
+	compiled := make([]*headerRule, 0, len(rules))
+	for i, rule := range rules {
+		r, err := compileHeaderRule(rule)
+		if err != nil {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("header rule %s: %w", name, err)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func compileHeaderRule(rule HeaderRule) (*headerRule, error) {
+	rule.Direction = strings.ToLower(strings.TrimSpace(rule.Direction))
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.Header = strings.TrimSpace(rule.Header)
+	r := &headerRule{HeaderRule: rule}
+	switch rule.Direction {
+	case "", "in", "out":
+	default:
+		return nil, fmt.Errorf("direction %q must be in or out", rule.Direction)
+	}
+	if rule.Header == "" || strings.ContainsAny(rule.Header, " \t:") {
+		return nil, fmt.Errorf("invalid header %q", rule.Header)
+	}
+	if protectedHeaders[canonicalHeader(rule.Header)] {
+		return nil, fmt.Errorf("header %s cannot be changed", rule.Header)
+	}
+	for _, method := range rule.Methods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			if r.methods == nil {
+				r.methods = make(map[string]bool)
+			}
+			r.methods[method] = true
+		}
+	}
+	var err error
+	if r.peers, err = parsePeers(rule.Peers); err != nil {
+		return nil, err
+	}
+	if rule.Match != "" {
+		if r.match, err = regexp.Compile(rule.Match); err != nil {
+			return nil, fmt.Errorf("invalid match pattern: %w", err)
+		}
+	}
+	switch rule.Action {
+	case "add", "set":
+		if rule.Value == "" || rule.Match != "" {
+			return nil, fmt.Errorf("%s needs a value and no match", rule.Action)
+		}
+	case "remove":
+		if rule.Value != "" {
+			return nil, fmt.Errorf("remove takes no value")
+		}
+	case "rewrite":
+		if r.match == nil {
+			return nil, fmt.Errorf("rewrite needs a match pattern")
+		}
+	default:
+		return nil, fmt.Errorf("action %q must be add, set, remove, or rewrite", rule.Action)
+	}
+	return r, nil
+}
+
+// active reports whether the pipeline has any rules.
+func (h *HeaderRules) active() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rules) > 0
+}
+
+// apply runs the pipeline over msg, which travels in direction ("in" or
+// "out") to or from peer, a host address or name that may be empty when
+// unknown.
+func (h *HeaderRules) apply(msg *Message, direction, peer string) {
+	if h == nil || msg == nil {
+		return
+	}
+	h.mu.RLock()
+	rules := h.rules
+	h.mu.RUnlock()
+	if len(rules) == 0 {
+		return
+	}
+	method := msg.Method
+	if !msg.IsRequest() {
+		method = cseqMethod(msg)
+	}
+	method = strings.ToUpper(method)
+	for _, r := range rules {
+		if r.matches(direction, method, peer) {
+			r.run(msg)
+		}
+	}
+}
+
+func (r *headerRule) matches(direction, method, peer string) bool {
+	if r.Direction != "" && r.Direction != direction {
+		return false
+	}
+	if r.methods != nil && !r.methods[method] {
+		return false
+	}
+	return r.peers.empty() || r.peers.contains(peer)
+}
+
+func (r *headerRule) run(msg *Message) {
+	switch r.Action {
+	case "add":
+		msg.AddHeader(r.Header, r.Value)
+	case "set":
+		msg.SetHeader(r.Header, r.Value)
+	case "remove":
+		values := msg.HeaderValues(r.Header)
+		if len(values) == 0 {
+			return
+		}
+		if r.match == nil {
+			msg.DelHeader(r.Header)
+			return
+		}
+		kept := values[:0]
+		for _, value := range values {
+			if !r.match.MatchString(value) {
+				kept = append(kept, value)
+			}
+		}
+		if len(kept) == 0 {
+			msg.DelHeader(r.Header)
+		} else if len(kept) != len(values) {
+			msg.SetHeader(r.Header, kept...)
+		}
+	case "rewrite":
+		values := msg.HeaderValues(r.Header)
+		changed := false
+		for i, value := range values {
+			if rewritten := r.match.ReplaceAllString(value, r.Value); rewritten != value {
+				values[i], changed = rewritten, true
+			}
+		}
+		if changed {
+			msg.SetHeader(r.Header, values...)
+		}
+	}
+}
+
+// requestPeer returns the host a request the proxy sends is addressed to:
+// the next hop a dial plan rule chose, else its Request-URI's host.
+func requestPeer(req *Message) string {
+	if req.nextHop != "" {
+		if host, _, err := net.SplitHostPort(req.nextHop); err == nil {
+			return host
+		}
+		return req.nextHop
+	}
+	if uri, err := ParseURI(req.RequestURI); err == nil {
+		return uri.Host
+	}
+	return ""
+}
+
+// viaPeer returns the address a received request came from, or a sent
+// response goes back to, according to msg's top Via, or "" when unknown.
+func viaPeer(msg *Message) string {
+	if ip := viaSource(msg); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
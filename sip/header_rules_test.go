@@ -0,0 +1,84 @@
+package sip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyAppliesHeaderRules(t *testing.T) {
+	headers, err := NewHeaderRules([]HeaderRule{
+		{Name: "strip vendor", Direction: "out", Header: "X-Vendor-Info", Action: "remove"},
+		{Name: "tag trunk calls", Direction: "out", Methods: []string{"invite"}, Peers: []string{"203.0.113.0/24"}, Header: "X-Account", Action: "add", Value: "main"},
+		{Name: "contact format", Direction: "out", Methods: []string{"INVITE"}, Header: "Contact", Action: "rewrite", Match: `^<sip:([^@>]+)@[^>]*>$`, Value: "<sip:$1@proxy.example>"},
+		{Name: "provider quirk", Direction: "in", Peers: []string{"203.0.113.5"}, Header: "Server", Action: "set", Value: "provider"},
+		{Name: "unrelated peer", Direction: "in", Peers: []string{"198.51.100.1"}, Header: "X-Never", Action: "add", Value: "1"},
+	})
+	if err != nil {
+		t.Fatalf("NewHeaderRules returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "0", Upstream: "203.0.113.5:5060"}}, nil)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	proxy := NewProxy(WithDialPlan(plan), WithHeaderRules(headers))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	invite.RequestURI = "sip:0312345678@example.com"
+	invite.SetHeader("X-Vendor-Info", "build 42")
+	proxy.SendFromClient(invite)
+	var forwarded *Message
+	for forwarded == nil {
+		msg, ok := proxy.NextToServer(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the INVITE to be forwarded")
+		}
+		if msg.Method == "INVITE" {
+			forwarded = msg
+		}
+	}
+	if got := forwarded.GetHeader("X-Vendor-Info"); got != "" {
+		t.Fatalf("expected the vendor header to be removed, got %q", got)
+	}
+	if got := forwarded.GetHeader("X-Account"); got != "main" {
+		t.Fatalf("expected X-Account for the peer, got %q", got)
+	}
+	if got := forwarded.GetHeader("Contact"); got != "<sip:alice@proxy.example>" {
+		t.Fatalf("expected the Contact to be rewritten, got %q", got)
+	}
+
+	resp := buildResponseFrom(forwarded, 486, "Busy Here")
+	resp.SetHeader("Server", "PBX 1.0")
+	proxy.SendFromServer(resp)
+	for {
+		msg, ok := proxy.NextToClient(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the response to be relayed")
+		}
+		if msg.StatusCode != 486 {
+			continue
+		}
+		if got := msg.GetHeader("Server"); got != "provider" || msg.GetHeader("X-Never") != "" {
+			t.Fatalf("expected only the rule for the responding peer to apply, got Server %q, X-Never %q", got, msg.GetHeader("X-Never"))
+		}
+		break
+	}
+}
+
+func TestNewHeaderRulesRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []HeaderRule{
+		{Header: "Via", Action: "remove"},
+		{Header: "i", Action: "set", Value: "x"},
+		{Header: "CSeq", Action: "remove"},
+		{Header: "X-A", Action: "replace", Value: "x"},
+		{Header: "X-A", Action: "add"},
+		{Header: "X-A", Action: "rewrite", Value: "x"},
+		{Header: "X-A", Action: "rewrite", Match: "(", Value: "x"},
+		{Header: "X-A", Action: "remove", Direction: "up"},
+		{Header: "X-A", Action: "remove", Peers: []string{"10.0.0.0/33"}},
+	} {
+		if _, err := NewHeaderRules([]HeaderRule{rule}); err == nil {
+			t.Errorf("expected %+v to be rejected", rule)
+		}
+	}
+}
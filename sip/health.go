@@ -0,0 +1,218 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// HealthCheck is the state of one component probed by SIPStack.Health.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// HealthReport summarises the stack for liveness and readiness probes. Live
+// means the SIP sockets are open; Ready additionally requires every check to
+// pass.
+type HealthReport struct {
+	Live   bool          `json:"live"`
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Health reports the state of the SIP sockets, the user directory, and the
+// default upstreams as seen by the most recent OPTIONS pings; the upstream
+// check passes while any of them answers. A draining stack
+// adds a failing "drain" check, so it is no longer ready.
+func (s *SIPStack) Health(ctx context.Context) HealthReport {
+	s.mu.Lock()
+	running := s.started && !s.stopped
+	draining := s.draining
+	var (
+		downstream, upstream net.PacketConn
+		store                userdb.Store
+		upstreams            *upstreamPool
+	)
+	if running {
+		downstream, upstream = s.downstreamConn, s.upstreamConn
+		store, upstreams = s.userStore, s.upstreams
+	}
+	s.mu.Unlock()
+
+	sockets := HealthCheck{Name: "sip_sockets", Detail: "SIP stack is not running"}
+	if running && downstream != nil && upstream != nil {
+		sockets = HealthCheck{
+			Name:    "sip_sockets",
+			Healthy: true,
+			Detail:  fmt.Sprintf("downstream %s, upstream %s", downstream.LocalAddr(), upstream.LocalAddr()),
+		}
+	}
+
+	directory := HealthCheck{Name: "user_db", Detail: "user database is not open"}
+	if store != nil {
+		if err := userdb.Ping(ctx, store); err != nil {
+			directory.Detail = err.Error()
+		} else {
+			directory = HealthCheck{Name: "user_db", Healthy: true}
+		}
+	}
+
+	reachability := HealthCheck{Name: "upstream", Healthy: true}
+	switch {
+	case !running:
+		reachability = HealthCheck{Name: "upstream", Detail: "SIP stack is not running"}
+	case upstreams == nil:
+		reachability.Detail = "no default upstream configured"
+	case s.cfg.UpstreamPing <= 0:
+		reachability.Detail = "OPTIONS ping disabled"
+	default:
+		reachability = upstreams.check()
+	}
+
+	report := HealthReport{Live: sockets.Healthy, Checks: []HealthCheck{sockets, directory, reachability}}
+	if draining {
+		report.Checks = append(report.Checks, HealthCheck{Name: "drain", Detail: "refusing new calls before shutdown"})
+	}
+	report.Ready = report.Live
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.Healthy
+	}
+	return report
+}
+
+// upstreamProbe tracks the OPTIONS pings sent to the default upstream. Only
+// one ping is outstanding at a time; one left unanswered when the next is due
+// counts as a failure.
+type upstreamProbe struct {
+	mu      sync.Mutex
+	branch  string
+	sent    time.Time
+	checked bool
+	ok      bool
+	status  int
+	rtt     time.Duration
+	failure string
+}
+
+func (p *upstreamProbe) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.record(false, "")
+	p.branch, p.sent = "", time.Time{}
+	p.checked = false
+}
+
+func (p *upstreamProbe) start(branch string, now time.Time, interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.branch != "" {
+		p.record(false, fmt.Sprintf("no response to OPTIONS within %s", interval))
+	}
+	p.branch = branch
+	p.sent = now
+}
+
+func (p *upstreamProbe) fail(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.branch = ""
+	p.record(false, reason)
+}
+
+// answer consumes resp when it answers the outstanding ping. Any response
+// shows the upstream is reachable, whatever its status.
+func (p *upstreamProbe) answer(resp *Message) bool {
+	if resp == nil || resp.IsRequest() {
+		return false
+	}
+	branch := topViaBranch(resp)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if branch == "" || branch != p.branch {
+		return false
+	}
+	p.branch = ""
+	p.record(true, "")
+	p.status = resp.StatusCode
+	p.rtt = time.Since(p.sent)
+	return true
+}
+
+func (p *upstreamProbe) record(ok bool, failure string) {
+	p.checked = true
+	p.ok = ok
+	p.failure = failure
+	p.status = 0
+	p.rtt = 0
+}
+
+func (p *upstreamProbe) check(addr net.Addr) HealthCheck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case !p.checked:
+		return HealthCheck{Name: "upstream", Detail: fmt.Sprintf("awaiting first OPTIONS response from %s", addr)}
+	case !p.ok:
+		return HealthCheck{Name: "upstream", Detail: fmt.Sprintf("%s: %s", addr, p.failure)}
+	default:
+		return HealthCheck{
+			Name:    "upstream",
+			Healthy: true,
+			Detail:  fmt.Sprintf("%s answered OPTIONS with %d in %s", addr, p.status, p.rtt.Round(time.Microsecond)),
+		}
+	}
+}
+
+// runUpstreamPing sends an OPTIONS request to each default upstream every
+// UpstreamPing interval, starting immediately. Responses are consumed by the
+// upstream reader.
+func (s *SIPStack) runUpstreamPing() {
+	defer s.wg.Done()
+
+	interval := s.cfg.UpstreamPing
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, server := range s.upstreams.servers {
+			s.sendUpstreamPing(server, interval)
+		}
+		select {
+		case <-s.runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *SIPStack) sendUpstreamPing(server *upstreamServer, interval time.Duration) {
+	conn, addr := s.upstreamConn, server.addr
+	local := conn.LocalAddr().String()
+	branch := newBranchID()
+	req := NewRequest("OPTIONS", "sip:"+addr.String())
+	req.SetHeader("Via", "SIP/2.0/UDP "+local+";branch="+branch+";rport")
+	req.SetHeader("Max-Forwards", "70")
+	req.SetHeader("From", "<sip:ping@"+local+">;tag="+newTag())
+	req.SetHeader("To", "<sip:"+addr.String()+">")
+	req.SetHeader("Call-ID", strings.TrimPrefix(branch, "z9hG4bK")+"@"+local)
+	req.SetHeader("CSeq", "1 OPTIONS")
+	req.SetHeader("Content-Length", "0")
+	payload := req.AppendWire(nil)
+
+	server.probe.start(branch, time.Now(), interval)
+	if _, err := conn.WriteTo(payload, addr); err != nil {
+		if s.runCtx.Err() != nil {
+			return
+		}
+		s.logger.Warn("failed to send OPTIONS ping upstream", "destination", addr.String(), "error", err)
+		server.probe.fail(err.Error())
+		return
+	}
+	s.capture(directionUpstream, false, conn, addr, payload, req)
+}
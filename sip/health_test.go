@@ -0,0 +1,109 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestSIPStackHealthPingsUpstream(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := ParseMessage(string(buf[:n]))
+			if err != nil || req.Method != "OPTIONS" {
+				continue
+			}
+			upstream.WriteTo([]byte(buildResponseFrom(req, 200, "OK").String()), addr)
+		}
+	}()
+
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamAddr: upstream.LocalAddr().String(),
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		UpstreamPing: time.Hour,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if report := stack.Health(context.Background()); report.Live || report.Ready {
+		t.Fatalf("expected a stopped stack to fail its probes, got %+v", report)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		report := stack.Health(context.Background())
+		if report.Ready {
+			if !report.Live || len(report.Checks) != 3 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stack did not become ready: %+v", report)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.Close()
+	report := stack.Health(context.Background())
+	if !report.Live || report.Ready || report.Checks[1].Name != "user_db" || report.Checks[1].Healthy {
+		t.Fatalf("expected a closed database to fail readiness only, got %+v", report)
+	}
+}
+
+func TestSIPStackDrainStopsOnceIdle(t *testing.T) {
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := stack.Drain(ctx); err != nil {
+		t.Fatalf("Drain returned error: %v", err)
+	}
+	if report := stack.Health(context.Background()); report.Live {
+		t.Fatalf("expected a drained stack to be stopped, got %+v", report)
+	}
+}
@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HEPv3 chunk types from the HEP/EEP specification. Every chunk used here
+// belongs to the generic vendor (0).
+const (
+	hepChunkFamily        = 0x0001
+	hepChunkProtocol      = 0x0002
+	hepChunkIPv4Source    = 0x0003
+	hepChunkIPv4Dest      = 0x0004
+	hepChunkIPv6Source    = 0x0005
+	hepChunkIPv6Dest      = 0x0006
+	hepChunkSourcePort    = 0x0007
+	hepChunkDestPort      = 0x0008
+	hepChunkSeconds       = 0x0009
+	hepChunkMicroseconds  = 0x000a
+	hepChunkProtocolType  = 0x000b
+	hepChunkAgentID       = 0x000c
+	hepChunkAuthKey       = 0x000e
+	hepChunkPayload       = 0x000f
+	hepChunkCorrelationID = 0x0011
+
+	hepFamilyIPv4   = 2
+	hepFamilyIPv6   = 10
+	hepProtocolUDP  = 17
+	hepProtocolSIP  = 1
+	hepQueueLength  = 1024
+	hepMaxChunkData = 0xffff - 6
+)
+
+// HEPConfig describes the capture server a HEPExporter sends to.
+type HEPConfig struct {
+	// Addr is the capture server's UDP address (host:port).
+	Addr string
+	// AgentID identifies this proxy among the capture agents.
+	AgentID uint32
+	// Password is sent as the HEP authentication key when non-empty.
+	Password string
+	Logger   *slog.Logger
+}
+
+// HEPExporter is a PacketObserver that copies every SIP datagram to a
+// Homer/SIPCAPTURE server as a HEPv3 packet, with the Call-ID as correlation
+// ID. Packets are queued and sent from a separate goroutine; when the queue
+// is full they are dropped rather than delaying SIP traffic.
+type HEPExporter struct {
+	cfg    HEPConfig
+	conn   net.Conn
+	queue  chan Packet
+	logger *slog.Logger
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewHEPExporter connects to the capture server and starts the sender.
+func NewHEPExporter(cfg HEPConfig) (*HEPExporter, error) {
+	cfg.Addr = strings.TrimSpace(cfg.Addr)
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("sip: HEP capture server address is required")
+	}
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("sip: connect to HEP capture server %s: %w", cfg.Addr, err)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	e := &HEPExporter{
+		cfg:    cfg,
+		conn:   conn,
+		queue:  make(chan Packet, hepQueueLength),
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// ObservePacket queues a datagram for export. Datagrams that did not parse
+// as SIP are skipped.
+func (e *HEPExporter) ObservePacket(p Packet) {
+	if e == nil || p.Message == nil {
+		return
+	}
+	select {
+	case <-e.done:
+	case e.queue <- p:
+	default:
+	}
+}
+
+// Close stops the sender and closes the socket. Queued packets are dropped.
+func (e *HEPExporter) Close() error {
+	if e == nil {
+		return nil
+	}
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.done)
+		err = e.conn.Close()
+	})
+	return err
+}
+
+func (e *HEPExporter) run() {
+	failing := false
+	for {
+		select {
+		case <-e.done:
+			return
+		case p := <-e.queue:
+			packet, err := encodeHEP(p, e.cfg.AgentID, e.cfg.Password)
+			if err != nil {
+				e.logger.Warn("cannot encode HEP packet", append(messageAttrs(p.Message), "error", err)...)
+				continue
+			}
+			_, err = e.conn.Write(packet)
+			switch {
+			case err != nil && !failing:
+				select {
+				case <-e.done:
+					return
+				default:
+				}
+				// Log once per outage rather than once per packet.
+				e.logger.Warn("failed to send to HEP capture server", "addr", e.cfg.Addr, "error", err)
+				failing = true
+			case err == nil && failing:
+				e.logger.Info("HEP capture server reachable again", "addr", e.cfg.Addr)
+				failing = false
+			}
+		}
+	}
+}
+
+// encodeHEP renders p as a HEPv3 packet.
+func encodeHEP(p Packet, agentID uint32, password string) ([]byte, error) {
+	src, dst := p.endpoints()
+	if len(p.Data) > hepMaxChunkData {
+		return nil, fmt.Errorf("payload of %d bytes exceeds a HEP chunk", len(p.Data))
+	}
+
+	buf := []byte{'H', 'E', 'P', '3', 0, 0}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		buf = appendHEPChunk(buf, hepChunkFamily, []byte{hepFamilyIPv4})
+		buf = appendHEPChunk(buf, hepChunkProtocol, []byte{hepProtocolUDP})
+		buf = appendHEPChunk(buf, hepChunkIPv4Source, src.IP.To4())
+		buf = appendHEPChunk(buf, hepChunkIPv4Dest, dst.IP.To4())
+	} else {
+		buf = appendHEPChunk(buf, hepChunkFamily, []byte{hepFamilyIPv6})
+		buf = appendHEPChunk(buf, hepChunkProtocol, []byte{hepProtocolUDP})
+		buf = appendHEPChunk(buf, hepChunkIPv6Source, src.IP.To16())
+		buf = appendHEPChunk(buf, hepChunkIPv6Dest, dst.IP.To16())
+	}
+	buf = appendHEPChunk(buf, hepChunkSourcePort, binary.BigEndian.AppendUint16(nil, uint16(src.Port)))
+	buf = appendHEPChunk(buf, hepChunkDestPort, binary.BigEndian.AppendUint16(nil, uint16(dst.Port)))
+	ts := p.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	buf = appendHEPChunk(buf, hepChunkSeconds, binary.BigEndian.AppendUint32(nil, uint32(ts.Unix())))
+	buf = appendHEPChunk(buf, hepChunkMicroseconds, binary.BigEndian.AppendUint32(nil, uint32(ts.Nanosecond()/1000)))
+	buf = appendHEPChunk(buf, hepChunkProtocolType, []byte{hepProtocolSIP})
+	buf = appendHEPChunk(buf, hepChunkAgentID, binary.BigEndian.AppendUint32(nil, agentID))
+	if password != "" {
+		buf = appendHEPChunk(buf, hepChunkAuthKey, []byte(password))
+	}
+	buf = appendHEPChunk(buf, hepChunkPayload, p.Data)
+	if p.Message != nil {
+		if callID := strings.TrimSpace(p.Message.GetHeader("Call-ID")); callID != "" {
+			buf = appendHEPChunk(buf, hepChunkCorrelationID, []byte(callID))
+		}
+	}
+	if len(buf) > 0xffff {
+		return nil, fmt.Errorf("HEP packet of %d bytes is too large", len(buf))
+	}
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(buf)))
+	return buf, nil
+}
+
+func appendHEPChunk(buf []byte, chunkType uint16, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, chunkType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(6+len(data)))
+	return append(buf, data...)
+}
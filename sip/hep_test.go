@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeHEPCarriesAddressesAndCorrelationID(t *testing.T) {
+	invite := newInvite()
+	packet := Packet{
+		Time:     time.Unix(1700000000, 123456000),
+		Received: true,
+		Local:    &net.UDPAddr{IP: net.IPv6unspecified, Port: 5060},
+		Remote:   &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5062},
+		Data:     []byte(invite.String()),
+		Message:  invite,
+	}
+	buf, err := encodeHEP(packet, 2001, "secret")
+	if err != nil {
+		t.Fatalf("encodeHEP: %v", err)
+	}
+	if string(buf[:4]) != "HEP3" || int(binary.BigEndian.Uint16(buf[4:6])) != len(buf) {
+		t.Fatalf("bad HEP header % x", buf[:6])
+	}
+	chunks := make(map[uint16][]byte)
+	for rest := buf[6:]; len(rest) > 0; {
+		if len(rest) < 6 {
+			t.Fatalf("truncated chunk header % x", rest)
+		}
+		vendor, kind, length := binary.BigEndian.Uint16(rest), binary.BigEndian.Uint16(rest[2:]), int(binary.BigEndian.Uint16(rest[4:]))
+		if vendor != 0 || length < 6 || length > len(rest) {
+			t.Fatalf("bad chunk vendor %d length %d", vendor, length)
+		}
+		chunks[kind] = rest[6:length]
+		rest = rest[length:]
+	}
+
+	if chunks[hepChunkFamily][0] != hepFamilyIPv4 || chunks[hepChunkProtocol][0] != hepProtocolUDP {
+		t.Fatalf("expected IPv4/UDP, got %v %v", chunks[hepChunkFamily], chunks[hepChunkProtocol])
+	}
+	if !net.IP(chunks[hepChunkIPv4Source]).Equal(net.IPv4(192, 0, 2, 10)) || !net.IP(chunks[hepChunkIPv4Dest]).Equal(net.IPv4zero) {
+		t.Fatalf("unexpected addresses %v -> %v", net.IP(chunks[hepChunkIPv4Source]), net.IP(chunks[hepChunkIPv4Dest]))
+	}
+	if binary.BigEndian.Uint16(chunks[hepChunkSourcePort]) != 5062 || binary.BigEndian.Uint16(chunks[hepChunkDestPort]) != 5060 {
+		t.Fatalf("unexpected ports")
+	}
+	if binary.BigEndian.Uint32(chunks[hepChunkSeconds]) != 1700000000 || binary.BigEndian.Uint32(chunks[hepChunkMicroseconds]) != 123456 {
+		t.Fatalf("unexpected timestamp")
+	}
+	if binary.BigEndian.Uint32(chunks[hepChunkAgentID]) != 2001 || string(chunks[hepChunkAuthKey]) != "secret" {
+		t.Fatalf("unexpected agent or key")
+	}
+	if string(chunks[hepChunkPayload]) != invite.String() || string(chunks[hepChunkCorrelationID]) != "a84b4c76e66710" {
+		t.Fatalf("unexpected payload or correlation ID %q", chunks[hepChunkCorrelationID])
+	}
+}
+
+func TestHEPExporterSendsToCaptureServer(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+	exporter, err := NewHEPExporter(HEPConfig{Addr: server.LocalAddr().String(), AgentID: 7})
+	if err != nil {
+		t.Fatalf("NewHEPExporter: %v", err)
+	}
+	defer exporter.Close()
+
+	exporter.ObservePacket(Packet{Local: server.LocalAddr(), Remote: server.LocalAddr(), Data: []byte("junk")})
+	options := newOptions()
+	exporter.ObservePacket(Packet{Local: server.LocalAddr(), Remote: server.LocalAddr(), Data: []byte(options.String()), Message: options})
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65535)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected a HEP packet: %v", err)
+	}
+	if string(buf[:4]) != "HEP3" || int(binary.BigEndian.Uint16(buf[4:6])) != n {
+		t.Fatalf("unexpected packet % x", buf[:6])
+	}
+	if !strings.Contains(string(buf[:n]), "OPTIONS sip:bob@example.com") {
+		t.Fatalf("expected the unparsed datagram to be skipped, got %q", buf[:n])
+	}
+}
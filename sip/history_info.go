@@ -0,0 +1,101 @@
+package sip
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// causeUnconditional is the RFC 4458 cause, given in the Reason of the
+// History-Info entry a request is retargeted from, of call forwarding.
+const causeUnconditional = 302
+
+// Diversion adds a Diversion header (RFC 5806) naming the Request-URI a
+// request is retargeted from, for equipment that predates History-Info. It is
+// safe for concurrent use.
+type Diversion struct {
+	enabled atomic.Bool
+}
+
+// NewDiversion returns a Diversion that adds the header when enabled is set.
+func NewDiversion(enabled bool) *Diversion {
+	d := &Diversion{}
+	d.enabled.Store(enabled)
+	return d
+}
+
+// SetEnabled turns the Diversion header on or off for requests retargeted
+// from then on.
+func (d *Diversion) SetEnabled(enabled bool) {
+	d.enabled.Store(enabled)
+}
+
+// add puts a Diversion entry for req's Request-URI above those it carries,
+// giving reason, such as unconditional, as RFC 5806 names them.
+func (d *Diversion) add(req *Message, reason string) {
+	if d == nil || !d.enabled.Load() {
+		return
+	}
+	entry := "<" + req.RequestURI + ">;reason=" + reason + ";counter=1"
+	req.SetHeader("Diversion", append([]string{entry}, req.HeaderList("Diversion")...)...)
+}
+
+// retarget points req at target instead of its Request-URI, recording the
+// change so that downstream voicemail and billing systems know whom the
+// caller dialed: History-Info always, and Diversion when it is enabled. fork
+// numbers target among the several the Request-URI is retargeted to at once,
+// starting at 1. cause, when not zero, is the RFC 4458 cause of the
+// retargeting, and reason its Diversion name.
+func (t *transactionUser) retarget(req *Message, target string, fork, cause int, reason string) {
+	t.diversion.add(req, reason)
+	addHistoryInfo(req, target, fork, cause)
+	req.RequestURI = target
+}
+
+// addHistoryInfo appends to req's History-Info (RFC 7044) an entry for target
+// whose index is numbered fork under the entry for the Request-URI. That entry
+// is the last one when the request arrived through a proxy recording history,
+// and is added otherwise; it is given cause as its Reason.
+func addHistoryInfo(req *Message, target string, fork, cause int) {
+	entries := req.HeaderList("History-Info")
+	parent, parentAt := "", -1
+	if n := len(entries); n > 0 {
+		if _, uri, params, ok := splitNameAddr(entries[n-1]); ok && sameTarget(uri, req.RequestURI) {
+			parent, parentAt = GetHeaderParam(params, "index"), n-1
+		}
+	}
+	if parentAt < 0 {
+		parent = "1"
+		if n := len(entries); n > 0 {
+			if last := GetHeaderParam(entries[n-1], "index"); last != "" {
+				parent = last + ".1"
+			}
+		}
+		entries = append(entries, "<"+req.RequestURI+">;index="+parent)
+		parentAt = len(entries) - 1
+	}
+	if cause != 0 {
+		if display, uri, params, ok := splitNameAddr(entries[parentAt]); ok {
+			uri.Headers = append(uri.Headers, URIParam{Name: "Reason", Value: "SIP;cause=" + strconv.Itoa(cause)})
+			entry := "<" + uri.String() + ">" + params
+			if display != "" {
+				entry = display + " " + entry
+			}
+			entries[parentAt] = entry
+		}
+	}
+	entries = append(entries, "<"+target+">;index="+parent+"."+strconv.Itoa(fork)+";mp="+parent)
+	req.SetHeader("History-Info", entries...)
+}
+
+// sameTarget reports whether uri, from a History-Info entry, addresses
+// requestURI, ignoring the headers such as Reason that the entry carries.
+func sameTarget(uri *URI, requestURI string) bool {
+	target, err := ParseURI(requestURI)
+	if err != nil {
+		return false
+	}
+	entry := *uri
+	entry.Headers = nil
+	return strings.EqualFold(entry.String(), target.String())
+}
@@ -0,0 +1,65 @@
+package sip
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestProxyRecordsHistoryOfForwardedCalls(t *testing.T) {
+	store := newMemoryStore()
+	store.settings[registrarKey("carol", "example.com")] = userdb.UserSettings{userdb.SettingForwardTo: "dave@voicemail.example.com"}
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)), WithDiversion(NewDiversion(true)))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	invite.RequestURI = "sip:carol@example.com"
+	invite.SetHeader("History-Info", "<sip:sales@example.com>;index=1", "<sip:carol@example.com>;index=1.1;mp=1")
+	proxy.SendFromClient(invite)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded INVITE")
+	}
+	want := []string{
+		"<sip:sales@example.com>;index=1",
+		"<sip:carol@example.com?Reason=SIP%3Bcause%3D302>;index=1.1;mp=1",
+		"<sip:dave@voicemail.example.com>;index=1.1.1;mp=1.1",
+	}
+	if got := forwarded.HeaderList("History-Info"); !slices.Equal(got, want) {
+		t.Fatalf("unexpected History-Info %q", got)
+	}
+	if got := forwarded.GetHeader("Diversion"); got != "<sip:carol@example.com>;reason=unconditional;counter=1" {
+		t.Fatalf("unexpected Diversion %q", got)
+	}
+}
+
+func TestProxyRecordsHistoryOfBroadcastForks(t *testing.T) {
+	policy := NewBroadcastPolicy([]BroadcastRule{{
+		Address: "sip:team@example.com",
+		Targets: []string{"sip:alice@example.com", "sip:bob@example.com"},
+	}})
+	proxy := NewProxy(WithBroadcastPolicy(policy))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	invite.RequestURI = "sip:team@example.com"
+	proxy.SendFromClient(invite)
+	for i, target := range []string{"sip:alice@example.com", "sip:bob@example.com"} {
+		fork, ok := proxy.NextToServer(100 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected a fork to %s", target)
+		}
+		want := []string{
+			"<sip:team@example.com>;index=1",
+			"<" + target + ">;index=1." + string(rune('1'+i)) + ";mp=1",
+		}
+		if got := fork.HeaderList("History-Info"); !slices.Equal(got, want) {
+			t.Fatalf("unexpected History-Info %q", got)
+		}
+		if fork.GetHeader("Diversion") != "" {
+			t.Fatalf("expected no Diversion unless enabled")
+		}
+	}
+}
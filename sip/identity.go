@@ -0,0 +1,138 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IdentityConfig draws the trust domain of RFC 3325 around the proxy. The
+// TrustedPeers, given as addresses, CIDR prefixes, and host names, may send
+// P-Asserted-Identity and are sent it; every other peer is untrusted. Without
+// trusted peers identity headers are passed on untouched.
+type IdentityConfig struct {
+	TrustedPeers []string
+}
+
+// Identity asserts the identity of callers the registrar has authenticated
+// and keeps asserted identities inside the trust domain (RFC 3325), honouring
+// Privacy: id (RFC 3323). It is safe for concurrent use.
+type Identity struct {
+	mu      sync.RWMutex
+	trusted peerSet
+}
+
+// NewIdentity returns an Identity for cfg.
+func NewIdentity(cfg IdentityConfig) (*Identity, error) {
+	trusted, err := compileIdentity(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{trusted: trusted}, nil
+}
+
+func (i *Identity) set(trusted peerSet) {
+	i.mu.Lock()
+	i.trusted = trusted
+	i.mu.Unlock()
+}
+
+func compileIdentity(cfg IdentityConfig) (peerSet, error) {
+	trusted, err := parsePeers(cfg.TrustedPeers)
+	if err != nil {
+		return peerSet{}, fmt.Errorf("trusted %w", err)
+	}
+	return trusted, nil
+}
+
+// enabled reports whether a trust domain is configured.
+func (i *Identity) enabled() bool {
+	if i == nil {
+		return false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return !i.trusted.empty()
+}
+
+// untrusted reports whether a trust domain is configured and peer, an
+// address or host name that may be empty when unknown, is outside it.
+func (i *Identity) untrusted(peer string) bool {
+	if i == nil {
+		return false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return !i.trusted.empty() && !i.trusted.contains(peer)
+}
+
+// outside reports whether peer is outside the trust domain, as every peer is
+// when none is configured.
+func (i *Identity) outside(peer string) bool {
+	if i == nil {
+		return true
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.trusted.empty() || !i.trusted.contains(peer)
+}
+
+// assertIdentity replaces the identity headers of req, a request received
+// from outside the trust domain: any P-Asserted-Identity it carries is
+// forged, so it is removed, and a caller whose registration came from the
+// address the request did is asserted as their address of record instead of
+// any P-Preferred-Identity.
+func (t *transactionUser) assertIdentity(ctx context.Context, req *Message) {
+	source := viaPeer(req)
+	if !t.identity.untrusted(source) {
+		return
+	}
+	req.DelHeader("P-Asserted-Identity")
+	display, uri, _, ok := splitNameAddr(req.GetHeader("From"))
+	if !ok || uri.User == "" || source == "" || t.registrar == nil {
+		return
+	}
+	domain := t.registrar.canonicalDomain(strings.ToLower(uri.Host))
+	for _, binding := range t.registrar.bindingsFor(ctx, uri.User, domain) {
+		host, _, err := net.SplitHostPort(binding.Source)
+		if err != nil || !net.ParseIP(host).Equal(net.ParseIP(source)) {
+			continue
+		}
+		asserted := (&URI{Scheme: "sip", User: uri.User, Host: domain}).String()
+		identity := "<" + asserted + ">"
+		if display != "" {
+			identity = display + " " + identity
+		}
+		req.SetHeader("P-Asserted-Identity", identity)
+		req.DelHeader("P-Preferred-Identity")
+		return
+	}
+}
+
+// withholdIdentity removes the asserted identity from msg, a request or
+// response about to be sent to peer, when peer is outside the trust domain.
+// A request asking for Privacy: id loses P-Preferred-Identity too, which
+// would otherwise reveal the same identity.
+func (t *transactionUser) withholdIdentity(msg *Message, peer string) {
+	if !t.identity.untrusted(peer) {
+		return
+	}
+	msg.DelHeader("P-Asserted-Identity")
+	if msg.IsRequest() && requestsPrivacy(msg, "id") {
+		msg.DelHeader("P-Preferred-Identity")
+	}
+}
+
+// requestsPrivacy reports whether msg's Privacy header lists value.
+func requestsPrivacy(msg *Message, value string) bool {
+	for _, header := range msg.HeaderValues("Privacy") {
+		for _, token := range strings.FieldsFunc(header, func(r rune) bool { return r == ';' || r == ',' }) {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package sip
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProxyAssertsIdentityWithinTrustDomain(t *testing.T) {
+	registrar := NewRegistrar(nil)
+	if err := registrar.bindings.PutBinding(context.Background(), registrarKey("alice", "example.com"), Registration{
+		Contact: "<sip:alice@192.0.2.10:5060>",
+		Expires: time.Now().Add(time.Hour),
+		Source:  "192.0.2.10:5060",
+	}); err != nil {
+		t.Fatalf("PutBinding returned error: %v", err)
+	}
+	identity, err := NewIdentity(IdentityConfig{TrustedPeers: []string{"203.0.113.0/24"}})
+	if err != nil {
+		t.Fatalf("NewIdentity returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "0", Upstream: "203.0.113.5:5060"}}, nil)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	proxy := NewProxy(WithRegistrar(registrar), WithIdentity(identity), WithDialPlan(plan))
+	t.Cleanup(proxy.Stop)
+
+	next := func(callID string) *Message {
+		t.Helper()
+		for {
+			msg, ok := proxy.NextToServer(200 * time.Millisecond)
+			if !ok {
+				t.Fatalf("expected the INVITE %s to be forwarded", callID)
+			}
+			if msg.Method == "INVITE" && msg.GetHeader("Call-ID") == callID {
+				return msg
+			}
+		}
+	}
+
+	// A registered caller sending from its registration's address is
+	// asserted toward the trusted peer, replacing the forged identity.
+	invite := newInvite()
+	invite.RequestURI = "sip:0312345678@example.com"
+	invite.SetHeader("Via", "SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bKtrusted")
+	invite.SetHeader("Call-ID", "trusted@client.example")
+	invite.SetHeader("P-Asserted-Identity", "<sip:boss@example.com>")
+	invite.SetHeader("P-Preferred-Identity", "<sip:alice@example.com>")
+	proxy.SendFromClient(invite)
+	forwarded := next("trusted@client.example")
+	if got := forwarded.GetHeader("P-Asserted-Identity"); got != `"Alice" <sip:alice@example.com>` {
+		t.Fatalf("expected the caller to be asserted, got %q", got)
+	}
+	if got := forwarded.GetHeader("P-Preferred-Identity"); got != "" {
+		t.Fatalf("expected P-Preferred-Identity to be consumed, got %q", got)
+	}
+
+	// The trusted peer's asserted identity stops at the untrusted caller.
+	resp := buildResponseFrom(forwarded, 180, "Ringing")
+	resp.SetHeader("P-Asserted-Identity", "<sip:+81312345678@provider.example>")
+	proxy.SendFromServer(resp)
+	for {
+		msg, ok := proxy.NextToClient(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the response to be relayed")
+		}
+		if msg.StatusCode != 180 {
+			continue
+		}
+		if got := msg.GetHeader("P-Asserted-Identity"); got != "" {
+			t.Fatalf("expected the asserted identity to be withheld from the caller, got %q", got)
+		}
+		break
+	}
+
+	// Nothing identifies a caller asking for privacy to an untrusted peer.
+	private := newInvite()
+	private.SetHeader("Via", "SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bKprivate")
+	private.SetHeader("Call-ID", "private@client.example")
+	private.SetHeader("Privacy", "id")
+	private.SetHeader("P-Preferred-Identity", "<sip:alice@example.com>")
+	proxy.SendFromClient(private)
+	forwarded = next("private@client.example")
+	if forwarded.GetHeader("P-Asserted-Identity") != "" || forwarded.GetHeader("P-Preferred-Identity") != "" {
+		t.Fatalf("expected identity to be withheld, got P-Asserted-Identity %q, P-Preferred-Identity %q", forwarded.GetHeader("P-Asserted-Identity"), forwarded.GetHeader("P-Preferred-Identity"))
+	}
+
+	// Another address claiming to be alice is not asserted.
+	spoofed := newInvite()
+	spoofed.RequestURI = "sip:0312345678@example.com"
+	spoofed.SetHeader("Via", "SIP/2.0/UDP 198.51.100.7:5060;branch=z9hG4bKspoofed")
+	spoofed.SetHeader("Call-ID", "spoofed@client.example")
+	proxy.SendFromClient(spoofed)
+	if got := next("spoofed@client.example").GetHeader("P-Asserted-Identity"); got != "" {
+		t.Fatalf("expected no identity for an unregistered address, got %q", got)
+	}
+}
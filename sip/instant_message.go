@@ -0,0 +1,249 @@
+package sip
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// messageDeliveryAttempts bounds how many times a stored message is sent
+// before it is given up on.
+const messageDeliveryAttempts = 3
+
+// MessageStore keeps pager-mode MESSAGE requests (RFC 3428) sent to users who
+// are offline, and delivers them when the user next registers. Messages are
+// held in memory only, so those not yet delivered are lost when the proxy
+// stops. It belongs to the transaction user's goroutine.
+type MessageStore struct {
+	limit   int
+	queued  map[string][]*storedMessage // keyed by user@domain
+	sending map[string]*storedMessage   // keyed by client transaction ID
+	now     func() time.Time
+}
+
+// storedMessage is a MESSAGE waiting for, or on, its way to aor.
+type storedMessage struct {
+	aor      string
+	msg      *Message
+	attempts int
+}
+
+// NewMessageStore returns a store keeping up to limit messages for each
+// offline user; further messages are refused until some are delivered.
+func NewMessageStore(limit int) *MessageStore {
+	return &MessageStore{
+		limit:   limit,
+		queued:  make(map[string][]*storedMessage),
+		sending: make(map[string]*storedMessage),
+		now:     time.Now,
+	}
+}
+
+// store queues req for aor, reporting whether there was room. The copy kept
+// has no Via, since it will be sent afresh, and a Date telling the recipient
+// when it was sent, unless it had one already.
+func (s *MessageStore) store(aor string, req *Message) bool {
+	if s == nil || len(s.queued[aor]) >= s.limit {
+		return false
+	}
+	msg := req.Clone()
+	msg.DelHeader("Via")
+	if msg.GetHeader("Date") == "" {
+		msg.SetHeader("Date", s.now().UTC().Format(http.TimeFormat))
+	}
+	s.queued[aor] = append(s.queued[aor], &storedMessage{aor: aor, msg: msg})
+	return true
+}
+
+// take removes and returns the messages queued for aor.
+func (s *MessageStore) take(aor string) []*storedMessage {
+	queued := s.queued[aor]
+	delete(s.queued, aor)
+	return queued
+}
+
+// delivery returns the stored message sent on clientTxID.
+func (s *MessageStore) delivery(clientTxID string) (*storedMessage, bool) {
+	if s == nil {
+		return nil, false
+	}
+	stored, ok := s.sending[clientTxID]
+	return stored, ok
+}
+
+// requeue puts a message whose delivery failed back at the head of its
+// user's queue.
+func (s *MessageStore) requeue(stored *storedMessage) {
+	s.queued[stored.aor] = append([]*storedMessage{stored}, s.queued[stored.aor]...)
+}
+
+// messageFanout is a MESSAGE sent to every target of a broadcast rule. The
+// first 2xx is relayed as soon as it arrives; without one, the sender is
+// told the message was stored when it was for some offline target, or else
+// given the best failure.
+type messageFanout struct {
+	request  *Message
+	forks    map[string]struct{} // client transactions still pending
+	stored   bool
+	answered bool
+	best     *Message
+}
+
+// handleMessage delivers a MESSAGE outside a dialog, reporting whether it was
+// answered or sent here rather than left to be forwarded. A user of the
+// registrar must authenticate to send one. One for a user who is offline is
+// stored, and answered with 202 Accepted, or refused with 480 Temporarily
+// Unavailable when there is no store or no room in it. One for a broadcast
+// address goes to every target at once.
+func (t *transactionUser) handleMessage(ctx context.Context, event tuEvent, req *Message) bool {
+	if !strings.EqualFold(req.Method, "MESSAGE") || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return false
+	}
+	if t.registrar != nil {
+		if _, resp := t.registrar.authenticateSender(req.Context(), req); resp != nil {
+			t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+			return true
+		}
+	}
+	if t.broadcast == nil || !t.broadcast.Has(req.RequestURI) {
+		aor, offline := t.offlineUser(req.Context(), req.RequestURI)
+		if !offline {
+			return false
+		}
+		t.messageStored(ctx, event, req, t.messages.store(aor, req))
+		return true
+	}
+
+	targets := t.broadcast.Targets(req.RequestURI)
+	if len(targets) == 0 {
+		resp := registrarResponse(req, 404, "Not Found")
+		ensureToTag(resp)
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+		return true
+	}
+	fanout := &messageFanout{request: req.Clone(), forks: make(map[string]struct{}, len(targets))}
+	for i, target := range targets {
+		if aor, offline := t.offlineUser(req.Context(), target); offline {
+			fanout.stored = t.messages.store(aor, req) || fanout.stored
+			continue
+		}
+		clone := req.Clone()
+		t.retarget(clone, target, i+1, 0, "unknown")
+		branch := newBranchID()
+		prependVia(clone, branch)
+		decrementMaxForwards(clone)
+		clientTxID := transactionKey(branch, "MESSAGE")
+		fanout.forks[clientTxID] = struct{}{}
+		t.sendAction(ctx, tuAction{Kind: tuActionForwardRequest, ServerTxID: event.ServerTxID, ClientTxID: clientTxID, Message: clone})
+	}
+	if len(fanout.forks) == 0 {
+		t.messageStored(ctx, event, req, fanout.stored)
+		return true
+	}
+	t.fanouts[event.ServerTxID] = fanout
+	return true
+}
+
+// offlineUser reports whether target is a user of the registrar with neither
+// a registered contact nor one in the directory, and their address of
+// record.
+func (t *transactionUser) offlineUser(ctx context.Context, target string) (string, bool) {
+	if t.registrar == nil || t.registrar.store == nil {
+		return "", false
+	}
+	uri, err := ParseURI(target)
+	if err != nil || uri.User == "" {
+		return "", false
+	}
+	domain := t.registrar.canonicalDomain(uri.Host)
+	user, err := t.registrar.store.Lookup(ctx, uri.User, domain)
+	if err != nil || user.ContactURI != "" {
+		return "", false
+	}
+	if len(t.registrar.bindingsFor(ctx, uri.User, domain)) > 0 {
+		return "", false
+	}
+	return registrarKey(uri.User, domain), true
+}
+
+// messageStored answers a MESSAGE for an offline user: 202 Accepted when it
+// was stored, else 480 Temporarily Unavailable.
+func (t *transactionUser) messageStored(ctx context.Context, event tuEvent, req *Message, stored bool) {
+	resp := registrarResponse(req, 480, "Temporarily Unavailable")
+	if stored {
+		resp = registrarResponse(req, 202, "Accepted")
+	}
+	ensureToTag(resp)
+	t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+}
+
+// deliverStored sends the messages stored for the user a successful
+// REGISTER, resp being its answer, just bound a contact for.
+func (t *transactionUser) deliverStored(ctx context.Context, register, resp *Message) {
+	if t.messages == nil || resp.StatusCode != 200 || resp.GetHeader("Contact") == "" {
+		return
+	}
+	user, domain, err := parseAddressOfRecord(register.GetHeader("To"))
+	if err != nil {
+		return
+	}
+	for _, stored := range t.messages.take(registrarKey(user, t.registrar.canonicalDomain(domain))) {
+		msg := stored.msg.Clone()
+		branch := newBranchID()
+		prependVia(msg, branch)
+		clientTxID := transactionKey(branch, "MESSAGE")
+		stored.attempts++
+		t.messages.sending[clientTxID] = stored
+		t.sendAction(ctx, tuAction{Kind: tuActionForwardRequest, ClientTxID: clientTxID, Message: msg})
+	}
+}
+
+// messageResponse consumes the responses to stored messages the proxy
+// delivered and to the forks of broadcast messages, reporting whether resp
+// was one. A stored message that was not delivered waits for the user's next
+// REGISTER, unless it has been tried too often.
+func (t *transactionUser) messageResponse(ctx context.Context, event tuEvent, resp *Message) bool {
+	if stored, ok := t.messages.delivery(event.ClientTxID); ok {
+		if resp.StatusCode < 200 {
+			return true
+		}
+		delete(t.messages.sending, event.ClientTxID)
+		if (event.TimedOut || resp.StatusCode >= 300) && stored.attempts < messageDeliveryAttempts {
+			t.messages.requeue(stored)
+		}
+		return true
+	}
+	fanout, ok := t.fanouts[event.ServerTxID]
+	if !ok {
+		return false
+	}
+	if _, ok := fanout.forks[event.ClientTxID]; !ok {
+		return false
+	}
+	removeTopViaWithBranch(resp, keyBranch(event.ClientTxID))
+	if resp.StatusCode < 200 {
+		return true
+	}
+	delete(fanout.forks, event.ClientTxID)
+	switch {
+	case fanout.answered:
+	case resp.StatusCode < 300:
+		fanout.answered = true
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, ClientTxID: event.ClientTxID, Message: resp})
+	case fanout.best == nil || resp.StatusCode > fanout.best.StatusCode:
+		fanout.best = resp
+	}
+	if len(fanout.forks) > 0 {
+		return true
+	}
+	delete(t.fanouts, event.ServerTxID)
+	switch {
+	case fanout.answered:
+	case fanout.stored:
+		t.messageStored(ctx, event, fanout.request, true)
+	default:
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: fanout.best})
+	}
+	return true
+}
@@ -0,0 +1,163 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func newMessage(target, branch string) *Message {
+	msg := NewRequest("MESSAGE", target)
+	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+branch)
+	msg.SetHeader("From", "<sip:alice@example.com>;tag=im")
+	msg.SetHeader("To", "<"+target+">")
+	msg.SetHeader("Call-ID", "im-"+branch+"@client.example")
+	msg.SetHeader("CSeq", "1 MESSAGE")
+	msg.SetHeader("Max-Forwards", "70")
+	msg.SetHeader("Content-Type", "text/plain")
+	msg.Body = "hello"
+	return msg
+}
+
+func TestProxyAuthenticatesMessageSenders(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newMessage("sip:carol@elsewhere.example", "first"))
+	challenge, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || challenge.StatusCode != 407 {
+		t.Fatalf("expected a 407 challenge, got %v", challenge)
+	}
+	params, ok := parseDigestAuthorization(challenge.GetHeader("Proxy-Authenticate"))
+	if !ok || params["nonce"] == "" {
+		t.Fatalf("expected a Proxy-Authenticate challenge, got %q", challenge.GetHeader("Proxy-Authenticate"))
+	}
+
+	authorized := newMessage("sip:carol@elsewhere.example", "second")
+	authorized.SetHeader("CSeq", "2 MESSAGE")
+	authorized.SetHeader("Proxy-Authorization", buildAuthorization("alice", realm, ha1, params["nonce"], 1, "cnonce", "MESSAGE", authorized.RequestURI))
+	proxy.SendFromClient(authorized)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok || forwarded.Method != "MESSAGE" || forwarded.Body != "hello" {
+		t.Fatalf("expected the authenticated MESSAGE to be forwarded, got %v", forwarded)
+	}
+	if forwarded.GetHeader("Proxy-Authorization") != "" {
+		t.Fatalf("expected the proxy's credentials to be removed")
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the delivery receipt to be relayed, got %v", resp)
+	}
+}
+
+func TestProxyStoresMessagesForOfflineUsers(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "bob", Domain: "example.com"})
+	registrar := NewRegistrar(store, WithDomainSettings(func(string) userdb.Domain {
+		return userdb.Domain{AuthPolicy: userdb.AuthNone}
+	}))
+	proxy := NewProxy(WithRegistrar(registrar), WithMessageStore(NewMessageStore(1)))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newMessage("sip:bob@example.com", "stored"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 202 {
+		t.Fatalf("expected 202 for a stored message, got %v", resp)
+	}
+	proxy.SendFromClient(newMessage("sip:bob@example.com", "full"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 480 {
+		t.Fatalf("expected 480 once the store is full, got %v", resp)
+	}
+
+	register := newRegisterRequest()
+	register.SetHeader("From", "<sip:bob@example.com>;tag=reg")
+	register.SetHeader("To", "<sip:bob@example.com>")
+	register.SetHeader("Contact", "<sip:bob@192.0.2.20:5060>")
+	proxy.SendFromClient(register)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the registration to succeed, got %v", resp)
+	}
+	delivered, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok || delivered.Method != "MESSAGE" || delivered.RequestURI != "sip:bob@example.com" || delivered.Body != "hello" {
+		t.Fatalf("expected the stored message to be delivered, got %v", delivered)
+	}
+	if vias := delivered.HeaderList("Via"); len(vias) != 1 || delivered.GetHeader("Date") == "" {
+		t.Fatalf("expected only the proxy's Via and a Date, got %q and %q", vias, delivered.GetHeader("Date"))
+	}
+	proxy.SendFromServer(buildResponseFrom(delivered, 200, "OK"))
+	if resp, ok := proxy.NextToClient(50 * time.Millisecond); ok {
+		t.Fatalf("expected the delivery receipt to be consumed, got %v", resp)
+	}
+}
+
+func TestProxyRefusesMessagesForOfflineUsersWithoutStore(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "bob", Domain: "example.com"})
+	store.add(&userdb.User{Username: "desk", Domain: "example.com", ContactURI: "sip:desk@192.0.2.30"})
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newMessage("sip:bob@example.com", "offline"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 480 {
+		t.Fatalf("expected 480 for an offline user, got %v", resp)
+	}
+	proxy.SendFromClient(newMessage("sip:desk@example.com", "static"))
+	if msg, ok := proxy.NextToServer(100 * time.Millisecond); !ok || msg.Method != "MESSAGE" {
+		t.Fatalf("expected a user with a directory contact to be sent the message, got %v", msg)
+	}
+}
+
+func TestProxyFansMessagesOutToBroadcastTargets(t *testing.T) {
+	policy := NewBroadcastPolicy([]BroadcastRule{{
+		Address: "sip:team@example.com",
+		Targets: []string{"sip:alice@example.com", "sip:bob@example.com"},
+	}})
+	proxy := NewProxy(WithBroadcastPolicy(policy))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newMessage("sip:team@example.com", "team"))
+	var forks []*Message
+	for range 2 {
+		fork, ok := proxy.NextToServer(100 * time.Millisecond)
+		if !ok || fork.Method != "MESSAGE" {
+			t.Fatalf("expected a MESSAGE to each target, got %v", fork)
+		}
+		forks = append(forks, fork)
+	}
+	proxy.SendFromServer(buildResponseFrom(forks[0], 480, "Temporarily Unavailable"))
+	if resp, ok := proxy.NextToClient(50 * time.Millisecond); ok {
+		t.Fatalf("expected the failure to wait for the other target, got %v", resp)
+	}
+	proxy.SendFromServer(buildResponseFrom(forks[1], 200, "OK"))
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the 2xx to be relayed, got %v", resp)
+	}
+	if vias := resp.HeaderList("Via"); len(vias) != 1 {
+		t.Fatalf("expected the proxy's Via removed, got %q", vias)
+	}
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected no CANCEL for a MESSAGE, got %v", msg)
+	}
+}
+
+func TestRegistrarAuthenticatesOnlyItsUsers(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", Disabled: true})
+	registrar := NewRegistrar(store)
+
+	req := newMessage("sip:bob@example.com", "foreign")
+	req.SetHeader("From", "<sip:mallory@elsewhere.example>;tag=x")
+	if identity, resp := registrar.authenticateSender(context.Background(), req); resp != nil || identity != "" {
+		t.Fatalf("expected a sender from elsewhere to pass unidentified, got %q and %v", identity, resp)
+	}
+	if _, resp := registrar.authenticateSender(context.Background(), newMessage("sip:bob@example.com", "disabled")); resp == nil || resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a disabled sender, got %v", resp)
+	}
+}
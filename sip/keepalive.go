@@ -0,0 +1,151 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// keepalivePong is the answer to a double-CRLF keepalive ping (RFC 5626
+// section 4.4.1).
+var keepalivePong = []byte("\r\n")
+
+// keepaliveKind tells a datagram holding only line endings, which clients
+// send to keep NAT bindings open, from a SIP message.
+type keepaliveKind int
+
+const (
+	notKeepalive keepaliveKind = iota
+	// keepalivePing is a double CRLF, which is answered with a CRLF pong.
+	keepalivePing
+	// keepaliveOther is any other run of line endings, such as a pong or
+	// the single CRLF some phones send, which is silently dropped.
+	keepaliveOther
+)
+
+func classifyKeepalive(data []byte) keepaliveKind {
+	if len(data) == 0 {
+		return notKeepalive
+	}
+	for _, c := range data {
+		if c != '\r' && c != '\n' {
+			return notKeepalive
+		}
+	}
+	if string(data) == "\r\n\r\n" {
+		return keepalivePing
+	}
+	return keepaliveOther
+}
+
+// proxyAllow and proxyAccept are advertised in the proxy's own answer to
+// OPTIONS. The proxy adds no option tags of its own, so Supported is sent
+// empty.
+const (
+	proxyAllow  = "INVITE, ACK, CANCEL, BYE, OPTIONS, MESSAGE"
+	proxyAccept = "application/sdp"
+)
+
+// answersOptions reports whether req is an OPTIONS the proxy should answer
+// itself rather than forward: one whose Request-URI has no user part and
+// names one of the proxy's local names (RFC 3261 section 11), or one that
+// has run out of hops (section 16.3).
+func (t *transactionUser) answersOptions(req *Message) bool {
+	if !strings.EqualFold(req.Method, "OPTIONS") {
+		return false
+	}
+	if strings.TrimSpace(req.GetHeader("Max-Forwards")) == "0" {
+		return true
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil || uri.User != "" {
+		return false
+	}
+	for _, name := range t.localNames {
+		if localNameMatches(name, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// localNameMatches reports whether uri names the host, or host:port, name.
+// A name without a port matches any port.
+func localNameMatches(name string, uri *URI) bool {
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		host, port = strings.Trim(name, "[]"), ""
+	}
+	if !strings.EqualFold(host, uri.Host) {
+		return false
+	}
+	if port == "" {
+		return true
+	}
+	_, uriPort, _ := net.SplitHostPort(uri.HostPort())
+	return port == uriPort
+}
+
+// optionsResponse is the proxy's own 200 answer to OPTIONS, listing what it
+// accepts.
+func (t *transactionUser) optionsResponse(req *Message) *Message {
+	resp := NewResponse(200, "OK")
+	CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+	ensureToTag(resp)
+	allow := proxyAllow
+	if t.registrar != nil {
+		allow += ", REGISTER"
+	}
+	if t.subscriptions != nil {
+		allow += ", SUBSCRIBE"
+		resp.SetHeader("Allow-Events", t.subscriptions.allowEvents())
+	}
+	if t.presence != nil {
+		allow += ", PUBLISH"
+	}
+	resp.SetHeader("Allow", allow)
+	resp.SetHeader("Accept", proxyAccept)
+	resp.SetHeader("Supported", "")
+	resp.EnsureContentLength()
+	return resp
+}
+
+// localNames lists the names the stack answers to: the configured ones, and
+// the address it listens on. A wildcard listen address contributes every
+// interface address at the listening port.
+func (s *SIPStack) localNames() []string {
+	names := append([]string(nil), s.cfg.LocalNames...)
+	udp, ok := s.downstreamConn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return names
+	}
+	port := strconv.Itoa(udp.Port)
+	if !udp.IP.IsUnspecified() {
+		return append(names, net.JoinHostPort(udp.IP.String(), port))
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return names
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			names = append(names, net.JoinHostPort(ipnet.IP.String(), port))
+		}
+	}
+	return names
+}
+
+// answerKeepalive reports whether data is a keepalive rather than a message,
+// answering a ping with a pong on conn.
+func (s *SIPStack) answerKeepalive(conn net.PacketConn, addr net.Addr, data []byte) bool {
+	switch classifyKeepalive(data) {
+	case keepalivePing:
+		if _, err := conn.WriteTo(keepalivePong, addr); err != nil {
+			s.logger.Debug("failed to answer keepalive", "destination", addr.String(), "error", err)
+		}
+		return true
+	case keepaliveOther:
+		return true
+	}
+	return false
+}
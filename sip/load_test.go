@@ -0,0 +1,234 @@
+package sip
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+var (
+	loadRate     = flag.Int("load.rate", 0, "transactions per second pumped through the proxy by TestProxyLoad; 0 skips it")
+	loadDuration = flag.Duration("load.duration", 5*time.Second, "how long TestProxyLoad generates traffic")
+	loadRegister = flag.Float64("load.register", 0.5, "fraction of TestProxyLoad transactions that are REGISTERs")
+	loadMaxP99   = flag.Duration("load.max-p99", 0, "fail TestProxyLoad when the P99 latency exceeds this; 0 disables the check")
+)
+
+// loadConfig describes the traffic the load harness generates.
+type loadConfig struct {
+	// Rate is the number of transactions started per second, or 0 to start
+	// them as fast as Concurrency allows.
+	Rate int
+	// Transactions stops the run after this many transactions when
+	// positive; otherwise Duration bounds it.
+	Transactions int
+	Duration     time.Duration
+	// RegisterRatio is the fraction of transactions that are REGISTERs
+	// answered by the local registrar; the rest are INVITEs answered 200 by
+	// a simulated upstream.
+	RegisterRatio float64
+	// Concurrency bounds the transactions in flight. The proxy's internal
+	// queues block when full, so it must stay well below their capacity.
+	Concurrency int
+}
+
+// loadReport summarises one run of the load harness.
+type loadReport struct {
+	Sent       int
+	Completed  int
+	Elapsed    time.Duration
+	Throughput float64
+	P50        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+func (r loadReport) String() string {
+	return fmt.Sprintf("sent=%d completed=%d elapsed=%s throughput=%.0f/s p50=%s p99=%s max=%s",
+		r.Sent, r.Completed, r.Elapsed.Round(time.Millisecond), r.Throughput, r.P50, r.P99, r.Max)
+}
+
+// newLoadProxy returns a proxy with a registrar that challenges REGISTERs
+// for alice@example.com.
+func newLoadProxy(opts ...ProxyOption) *Proxy {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: md5Hex("alice:example.com:secret")})
+	return NewProxy(append([]ProxyOption{WithRegistrar(NewRegistrar(store))}, opts...)...)
+}
+
+// runProxyLoad pumps INVITE and REGISTER transactions through proxy and
+// measures the time from SendFromClient to the final response leaving
+// NextToClient. It plays both the downstream clients and an upstream server
+// that answers every forwarded request with 200 OK.
+func runProxyLoad(proxy *Proxy, cfg loadConfig) loadReport {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 16
+	}
+	var (
+		mu        sync.Mutex
+		started   = make(map[string]time.Time)
+		latencies []time.Duration
+	)
+	slots := make(chan struct{}, cfg.Concurrency)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			req, ok := proxy.NextToServer(50 * time.Millisecond)
+			if !ok {
+				select {
+				case <-done:
+					return
+				default:
+					continue
+				}
+			}
+			proxy.SendFromServer(buildResponseFrom(req, 200, "OK"))
+		}
+	}()
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		for {
+			resp, ok := proxy.NextToClient(50 * time.Millisecond)
+			if !ok {
+				select {
+				case <-done:
+					return
+				default:
+					continue
+				}
+			}
+			if resp.StatusCode < 200 {
+				continue
+			}
+			now := time.Now()
+			mu.Lock()
+			if at, ok := started[resp.GetHeader("Call-ID")]; ok {
+				delete(started, resp.GetHeader("Call-ID"))
+				latencies = append(latencies, now.Sub(at))
+				<-slots
+			}
+			mu.Unlock()
+		}
+	}()
+
+	var interval time.Duration
+	if cfg.Rate > 0 {
+		interval = time.Second / time.Duration(cfg.Rate)
+	}
+	begin := time.Now()
+	sent := 0
+	registerEvery := 0
+	if cfg.RegisterRatio > 0 {
+		registerEvery = int(1 / cfg.RegisterRatio)
+	}
+	for {
+		if cfg.Transactions > 0 && sent >= cfg.Transactions {
+			break
+		}
+		if cfg.Transactions <= 0 && time.Since(begin) >= cfg.Duration {
+			break
+		}
+		if interval > 0 {
+			if wait := time.Until(begin.Add(time.Duration(sent) * interval)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		slots <- struct{}{}
+		id := strconv.Itoa(sent)
+		var req *Message
+		if registerEvery > 0 && sent%registerEvery == 0 {
+			req = newRegisterRequest()
+			req.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKloadreg"+id)
+		} else {
+			req = newInvite()
+			req.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKloadinv"+id)
+		}
+		callID := "load-" + id
+		req.SetHeader("Call-ID", callID)
+		mu.Lock()
+		started[callID] = time.Now()
+		mu.Unlock()
+		proxy.SendFromClient(req)
+		sent++
+	}
+	for i := 0; i < cap(slots); i++ {
+		select {
+		case slots <- struct{}{}:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	elapsed := time.Since(begin)
+	close(done)
+	<-received
+
+	mu.Lock()
+	defer mu.Unlock()
+	report := loadReport{Sent: sent, Completed: len(latencies), Elapsed: elapsed}
+	if elapsed > 0 {
+		report.Throughput = float64(report.Completed) / elapsed.Seconds()
+	}
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		report.P50 = latencies[len(latencies)*50/100]
+		report.P99 = latencies[len(latencies)*99/100]
+		report.Max = latencies[len(latencies)-1]
+	}
+	return report
+}
+
+// TestProxyLoad runs the load harness at -load.rate transactions per second
+// for -load.duration, for example:
+//
+//	go test ./sip -run TestProxyLoad -load.rate 2000 -load.duration 10s -v
+func TestProxyLoad(t *testing.T) {
+	if *loadRate <= 0 {
+		t.Skip("set -load.rate to run the load harness")
+	}
+	proxy := newLoadProxy(WithTransactionShards(0))
+	t.Cleanup(proxy.Stop)
+
+	report := runProxyLoad(proxy, loadConfig{Rate: *loadRate, Duration: *loadDuration, RegisterRatio: *loadRegister})
+	t.Log(report)
+	if report.Completed != report.Sent {
+		t.Fatalf("expected every transaction to complete, got %d of %d", report.Completed, report.Sent)
+	}
+	if *loadMaxP99 > 0 && report.P99 > *loadMaxP99 {
+		t.Fatalf("P99 latency %s exceeds %s", report.P99, *loadMaxP99)
+	}
+}
+
+func TestProxyLoadHarnessCompletesTransactions(t *testing.T) {
+	proxy := newLoadProxy()
+	t.Cleanup(proxy.Stop)
+
+	report := runProxyLoad(proxy, loadConfig{Transactions: 50, RegisterRatio: 0.5})
+	if report.Sent != 50 || report.Completed != 50 {
+		t.Fatalf("expected 50 completed transactions, got %s", report)
+	}
+	if report.P99 <= 0 || report.P99 < report.P50 || report.Max < report.P99 {
+		t.Fatalf("expected ordered latency percentiles, got %s", report)
+	}
+}
+
+// BenchmarkProxyLoad reports the throughput and P99 latency of a mixed
+// INVITE/REGISTER load with the default concurrency.
+func BenchmarkProxyLoad(b *testing.B) {
+	proxy := newLoadProxy()
+	b.Cleanup(proxy.Stop)
+	b.ReportAllocs()
+	b.ResetTimer()
+	report := runProxyLoad(proxy, loadConfig{Transactions: b.N, RegisterRatio: 0.5})
+	b.StopTimer()
+	if report.Completed != report.Sent {
+		b.Fatalf("expected every transaction to complete, got %s", report)
+	}
+	b.ReportMetric(report.Throughput, "tx/s")
+	b.ReportMetric(float64(report.P99.Microseconds()), "p99-µs")
+}
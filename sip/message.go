@@ -1,15 +1,14 @@
 package sip
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/textproto"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // Message represents a SIP message which can be either a request or a response.
@@ -20,8 +19,33 @@ type Message struct {
 	Proto        string
 	StatusCode   int
 	ReasonPhrase string
-	Headers      map[string][]string
-	Body         string
+	// Headers may be shared with clones of the message until it is first
+	// modified, so change it only through SetHeader, AddHeader, and
+	// DelHeader.
+	Headers map[string][]string
+	Body    string
+
+	// headerOrder lists the keys of Headers in the order they were first
+	// received or added, so a message is rendered with its headers in their
+	// original order. It belongs to whoever owns Headers.
+	headerOrder []string
+	// headerRefs counts the messages sharing Headers, or is nil when the
+	// map has never been shared.
+	headerRefs *atomic.Int32
+
+	trace messageTrace
+	// ctx is the context of the transaction the message belongs to, or of
+	// the stack that received it; see Context.
+	ctx context.Context
+	// nextHop is the host:port a dial plan rule sends a request to instead
+	// of where its Request-URI leads; clones, such as the CANCEL Timer C
+	// sends, go there too.
+	nextHop string
+	// trunkName is the trunk, as user@domain, that nextHop belongs to, and
+	// trunkAlternates the trunks to try next, cheapest first, when it
+	// fails.
+	trunkName       string
+	trunkAlternates []trunkHop
 }
 
 // ErrInvalidMessage is returned when the SIP message cannot be parsed.
@@ -38,6 +62,7 @@ func NewRequest(method, uri string) *Message {
 		RequestURI: uri,
 		Proto:      "SIP/2.0",
 		Headers:    make(map[string][]string),
+		headerRefs: newHeaderRefs(),
 	}
 }
 
@@ -51,6 +76,7 @@ func NewResponse(statusCode int, reason string) *Message {
 		StatusCode:   statusCode,
 		ReasonPhrase: reason,
 		Headers:      make(map[string][]string),
+		headerRefs:   newHeaderRefs(),
 	}
 }
 
@@ -85,18 +111,71 @@ func defaultReason(code int) string {
 	}
 }
 
-// Clone creates a deep copy of the message.
+// Clone returns an independent copy of the message. The header map is shared
+// copy-on-write: whichever copy is modified first takes a private map, so a
+// clone that is only read costs a single allocation.
 func (m *Message) Clone() *Message {
 	clone := *m
-	clone.Headers = make(map[string][]string, len(m.Headers))
-	for k, v := range m.Headers {
-		values := make([]string, len(v))
-		copy(values, v)
-		clone.Headers[k] = values
+	if m.headerRefs == nil {
+		clone.headerRefs = nil
+		clone.Headers = copyHeaders(m.Headers)
+		clone.headerOrder = slices.Clone(m.headerOrder)
+		return &clone
 	}
+	m.headerRefs.Add(1)
 	return &clone
 }
 
+// ownHeaders gives m a header map no other message refers to before it is
+// modified. A message created by NewRequest, NewResponse, or the parser
+// starts out owning its map; one built as a literal gets a counter here so
+// later clones can share.
+func (m *Message) ownHeaders() {
+	if m.Headers == nil {
+		m.Headers = make(map[string][]string)
+	}
+	if m.headerRefs == nil {
+		m.headerRefs = newHeaderRefs()
+		return
+	}
+	if m.headerRefs.Load() == 1 {
+		return
+	}
+	m.Headers = copyHeaders(m.Headers)
+	m.headerOrder = slices.Clone(m.headerOrder)
+	m.headerRefs.Add(-1)
+	m.headerRefs = newHeaderRefs()
+}
+
+func newHeaderRefs() *atomic.Int32 {
+	refs := new(atomic.Int32)
+	refs.Store(1)
+	return refs
+}
+
+// copyHeaders copies the header map. Value slices are clipped rather than
+// copied: values are never modified in place, and an append to a clipped
+// slice reallocates instead of writing into the shared array.
+func copyHeaders(headers map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(headers))
+	for k, v := range headers {
+		out[k] = slices.Clip(v)
+	}
+	return out
+}
+
+// Context returns the context work done on the message's behalf should use,
+// such as user store lookups and DNS resolution. Once the transaction layer
+// has taken the message in, it is the transaction's context, which ends when
+// the transaction is deleted or has waited as long as a final response can
+// take; a message outside any transaction gets context.Background.
+func (m *Message) Context() context.Context {
+	if m == nil || m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
 // IsRequest reports whether the message is a request.
 func (m *Message) IsRequest() bool {
 	return m != nil && m.isRequest
@@ -104,21 +183,19 @@ func (m *Message) IsRequest() bool {
 
 // SetHeader sets the header to the provided values replacing any previous values.
 func (m *Message) SetHeader(name string, values ...string) {
-	if m.Headers == nil {
-		m.Headers = make(map[string][]string)
-	}
+	m.ownHeaders()
 	key := canonicalHeader(name)
 	copied := make([]string, len(values))
 	copy(copied, values)
+	m.noteHeader(key)
 	m.Headers[key] = copied
 }
 
 // AddHeader appends a value to the header.
 func (m *Message) AddHeader(name, value string) {
-	if m.Headers == nil {
-		m.Headers = make(map[string][]string)
-	}
+	m.ownHeaders()
 	key := canonicalHeader(name)
+	m.noteHeader(key)
 	m.Headers[key] = append(m.Headers[key], value)
 }
 
@@ -127,7 +204,23 @@ func (m *Message) DelHeader(name string) {
 	if m.Headers == nil {
 		return
 	}
-	delete(m.Headers, canonicalHeader(name))
+	m.ownHeaders()
+	key := canonicalHeader(name)
+	if _, ok := m.Headers[key]; !ok {
+		return
+	}
+	delete(m.Headers, key)
+	if i := slices.Index(m.headerOrder, key); i >= 0 {
+		m.headerOrder = slices.Delete(m.headerOrder, i, i+1)
+	}
+}
+
+// noteHeader records key as the last header in order if the message does
+// not have it yet. The caller owns the headers.
+func (m *Message) noteHeader(key string) {
+	if _, ok := m.Headers[key]; !ok {
+		m.headerOrder = append(m.headerOrder, key)
+	}
 }
 
 // GetHeader returns the first value for the given header name.
@@ -158,111 +251,181 @@ func (m *Message) EnsureContentLength() {
 	if m == nil {
 		return
 	}
-	m.SetHeader("Content-Length", strconv.Itoa(len(m.Body)))
+	length := strconv.Itoa(len(m.Body))
+	if values := m.Headers["Content-Length"]; len(values) == 1 && values[0] == length {
+		return
+	}
+	m.SetHeader("Content-Length", length)
 }
 
-// String renders the message to wire format.
+// String renders the message to wire format. Unlike AppendWire it also
+// fills in a missing Proto and stores the Content-Length it writes.
 func (m *Message) String() string {
 	if m == nil {
 		return ""
 	}
-	var buf bytes.Buffer
+	if m.Proto == "" {
+		m.Proto = "SIP/2.0"
+	}
+	m.EnsureContentLength()
+	return string(m.AppendWire(make([]byte, 0, 512+len(m.Body))))
+}
+
+// AppendWire appends the message in wire format to dst and returns the
+// extended buffer. Headers are written in the order they were received or
+// added, and Content-Length, last unless the message has one, is always
+// taken from the body. The message is not modified, so a caller can render
+// into a reused buffer without allocating.
+func (m *Message) AppendWire(dst []byte) []byte {
+	return m.appendWire(dst, false)
+}
+
+// AppendWireCompact is AppendWire using the compact form of every header
+// name that has one (RFC 3261 section 7.3.3), which keeps large requests
+// under the UDP size limit for longer.
+func (m *Message) AppendWireCompact(dst []byte) []byte {
+	return m.appendWire(dst, true)
+}
+
+func (m *Message) appendWire(dst []byte, compact bool) []byte {
+	if m == nil {
+		return dst
+	}
+	proto := m.Proto
+	if proto == "" {
+		proto = "SIP/2.0"
+	}
 	if m.IsRequest() {
-		if m.Proto == "" {
-			m.Proto = "SIP/2.0"
-		}
-		fmt.Fprintf(&buf, "%s %s %s\r\n", m.Method, m.RequestURI, m.Proto)
+		dst = append(dst, m.Method...)
+		dst = append(dst, ' ')
+		dst = append(dst, m.RequestURI...)
+		dst = append(dst, ' ')
+		dst = append(dst, proto...)
 	} else {
-		if m.Proto == "" {
-			m.Proto = "SIP/2.0"
-		}
 		reason := m.ReasonPhrase
 		if reason == "" {
 			reason = defaultReason(m.StatusCode)
 		}
-		fmt.Fprintf(&buf, "%s %d %s\r\n", m.Proto, m.StatusCode, reason)
+		dst = append(dst, proto...)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, int64(m.StatusCode), 10)
+		dst = append(dst, ' ')
+		dst = append(dst, reason...)
+	}
+	dst = append(dst, "\r\n"...)
+
+	wroteLength := false
+	written := 0
+	for _, key := range m.headerOrder {
+		if values, ok := m.Headers[key]; ok {
+			dst = m.appendHeader(dst, key, values, compact)
+			wroteLength = wroteLength || key == "Content-Length"
+			written++
+		}
 	}
-
-	m.EnsureContentLength()
-
-	keys := make([]string, 0, len(m.Headers))
-	for k := range m.Headers {
-		keys = append(keys, k)
+	if written < len(m.Headers) {
+		// Headers stored into the map directly have no recorded order and
+		// follow the others, sorted.
+		var stack [32]string
+		rest := stack[:0]
+		for key := range m.Headers {
+			if !slices.Contains(m.headerOrder, key) {
+				rest = append(rest, key)
+			}
+		}
+		slices.Sort(rest)
+		for _, key := range rest {
+			dst = m.appendHeader(dst, key, m.Headers[key], compact)
+			wroteLength = wroteLength || key == "Content-Length"
+		}
+	}
+	if !wroteLength {
+		dst = m.appendHeader(dst, "Content-Length", nil, compact)
 	}
-	sort.Strings(keys)
-	for _, key := range keys {
-		for _, value := range m.Headers[key] {
-			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	dst = append(dst, "\r\n"...)
+	return append(dst, m.Body...)
+}
+
+// appendHeader writes one header line per value, or for Content-Length a
+// single line holding the body's length.
+func (m *Message) appendHeader(dst []byte, key string, values []string, compact bool) []byte {
+	name := key
+	if compact {
+		if short, ok := compactForms[key]; ok {
+			name = short
 		}
 	}
-	buf.WriteString("\r\n")
-	buf.WriteString(m.Body)
-	return buf.String()
+	if key == "Content-Length" {
+		dst = append(dst, name...)
+		dst = append(dst, ": "...)
+		dst = strconv.AppendInt(dst, int64(len(m.Body)), 10)
+		return append(dst, "\r\n"...)
+	}
+	for _, value := range values {
+		dst = append(dst, name...)
+		dst = append(dst, ": "...)
+		dst = append(dst, value...)
+		dst = append(dst, "\r\n"...)
+	}
+	return dst
 }
 
-// ParseMessage parses a SIP message from a raw string.
+// ParseMessage parses a SIP message from a raw string with the strict
+// Parser.
 func ParseMessage(raw string) (*Message, error) {
-	reader := bufio.NewReader(strings.NewReader(raw))
-	tp := textproto.NewReader(reader)
+	return parseMessage(raw, false)
+}
 
-	startLine, err := tp.ReadLine()
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			return nil, ErrInvalidMessage
-		}
-		return nil, err
+// ParseMessageBytes parses a SIP message from a datagram with the strict
+// Parser. The datagram is copied once and every header value and the body
+// share that copy, so the returned message does not refer to data and the
+// buffer can be reused.
+func ParseMessageBytes(data []byte) (*Message, error) {
+	return parseMessage(string(data), false)
+}
+
+// Parser parses SIP messages. The zero value follows the RFC 3261 grammar:
+// lines end in CRLF, the elements of the start line are separated by single
+// spaces, and a status line has a space after its code even when the reason
+// phrase is empty.
+type Parser struct {
+	// Lenient also accepts what broken endpoints send: lines ending in a
+	// bare LF, extra whitespace around and between the start line's
+	// elements, and a status line with no reason phrase, which is then
+	// filled in from the status code.
+	Lenient bool
+}
+
+// Parse parses a SIP message from a raw string.
+func (p Parser) Parse(raw string) (*Message, error) {
+	return parseMessage(raw, p.Lenient)
+}
+
+// ParseBytes parses a SIP message from a datagram, copying it as
+// ParseMessageBytes does.
+func (p Parser) ParseBytes(data []byte) (*Message, error) {
+	return parseMessage(string(data), p.Lenient)
+}
+
+// parseMessage parses raw in place: the start line, header values, and body
+// of the result are substrings of raw.
+func parseMessage(raw string, lenient bool) (*Message, error) {
+	startLine, rest, ok := nextLine(raw, lenient)
+	if !ok {
+		return nil, ErrInvalidMessage
 	}
-	startLine = strings.TrimSpace(startLine)
-	if startLine == "" {
+	msg := &Message{}
+	if !parseStartLine(msg, startLine, lenient) {
 		return nil, ErrInvalidMessage
 	}
 
-	mimeHeader, err := tp.ReadMIMEHeader()
+	headers, order, rest, err := parseHeaders(rest, lenient)
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			return nil, ErrInvalidMessage
-		}
 		return nil, err
 	}
-
-	msg := &Message{
-		Headers: make(map[string][]string, len(mimeHeader)),
-	}
-
-	if strings.HasPrefix(strings.ToUpper(startLine), "SIP/") {
-		// Response
-		parts := strings.SplitN(startLine, " ", 3)
-		if len(parts) < 2 {
-			return nil, ErrInvalidMessage
-		}
-		statusCode, err := strconv.Atoi(parts[1])
-		if err != nil {
-			return nil, ErrInvalidMessage
-		}
-		msg.Proto = parts[0]
-		msg.StatusCode = statusCode
-		if len(parts) == 3 {
-			msg.ReasonPhrase = strings.TrimSpace(parts[2])
-		} else {
-			msg.ReasonPhrase = defaultReason(statusCode)
-		}
-	} else {
-		parts := strings.SplitN(startLine, " ", 3)
-		if len(parts) != 3 {
-			return nil, ErrInvalidMessage
-		}
-		msg.isRequest = true
-		msg.Method = strings.ToUpper(strings.TrimSpace(parts[0]))
-		msg.RequestURI = strings.TrimSpace(parts[1])
-		msg.Proto = strings.TrimSpace(parts[2])
-	}
-
-	for key, values := range mimeHeader {
-		canonical := canonicalHeader(key)
-		copyValues := make([]string, len(values))
-		copy(copyValues, values)
-		msg.Headers[canonical] = copyValues
-	}
+	msg.Headers = headers
+	msg.headerOrder = order
+	msg.headerRefs = newHeaderRefs()
 
 	contentLength := 0
 	if rawLength := msg.GetHeader("Content-Length"); rawLength != "" {
@@ -277,26 +440,193 @@ func ParseMessage(raw string) (*Message, error) {
 	}
 
 	if contentLength > 0 {
-		body := make([]byte, contentLength)
-		if _, err := io.ReadFull(reader, body); err != nil {
+		if len(rest) < contentLength {
 			return nil, ErrInvalidMessage
 		}
-		msg.Body = string(body)
+		msg.Body = rest[:contentLength]
+	} else {
+		msg.Body = rest
+	}
+	return msg, nil
+}
+
+// parseStartLine fills in msg from a request or status line.
+func parseStartLine(msg *Message, line string, lenient bool) bool {
+	var fields []string
+	if lenient {
+		fields = strings.Fields(line)
 	} else {
-		remainder, err := io.ReadAll(reader)
-		if err != nil {
-			return nil, err
+		fields = strings.SplitN(line, " ", 3)
+	}
+	if len(fields) < 2 {
+		return false
+	}
+	if isSIPVersion(fields[0]) {
+		// A status line; the reason phrase may contain spaces and be empty.
+		code := fields[1]
+		if len(code) != 3 || code[0] < '1' || code[0] > '6' || strings.Trim(code, "0123456789") != "" {
+			return false
 		}
-		msg.Body = string(remainder)
+		msg.Proto = fields[0]
+		msg.StatusCode, _ = strconv.Atoi(code)
+		switch {
+		case lenient:
+			after := strings.TrimLeft(line, " \t")[len(fields[0]):]
+			after = strings.TrimLeft(after, " \t")[len(code):]
+			msg.ReasonPhrase = strings.TrimSpace(after)
+			if msg.ReasonPhrase == "" {
+				msg.ReasonPhrase = defaultReason(msg.StatusCode)
+			}
+		case len(fields) == 3:
+			msg.ReasonPhrase = fields[2]
+		default:
+			return false
+		}
+		return true
+	}
+	if len(fields) != 3 || !isToken(fields[0]) || fields[1] == "" || fields[1][0] == '<' || !isSIPVersion(fields[2]) {
+		return false
+	}
+	msg.isRequest = true
+	msg.Method = strings.ToUpper(fields[0])
+	msg.RequestURI = fields[1]
+	msg.Proto = fields[2]
+	return true
+}
+
+// isSIPVersion reports whether s is "SIP/" followed by digits, a dot, and
+// digits. Versions other than 2.0 parse, so they can be answered with 505.
+func isSIPVersion(s string) bool {
+	if len(s) < 4 || !strings.EqualFold(s[:4], "SIP/") {
+		return false
 	}
+	major, minor, ok := strings.Cut(s[4:], ".")
+	return ok && major != "" && minor != "" && strings.Trim(major, "0123456789") == "" && strings.Trim(minor, "0123456789") == ""
+}
 
-	return msg, nil
+// isToken reports whether s is a token (RFC 3261 section 25.1), the syntax of
+// methods and header names.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isAlphaNum(c) && strings.IndexByte("-.!%*_+`'~", c) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaders reads header lines up to the empty line ending them and
+// returns the headers, their names in order of first appearance, and what
+// follows. Folded continuation lines are joined
+// to the previous value with a single space. All single values share one
+// backing array, so a typical message costs one allocation for its values.
+func parseHeaders(raw string, lenient bool) (map[string][]string, []string, string, error) {
+	lines := strings.Count(raw, "\n")
+	headers := make(map[string][]string, min(lines, 32))
+	values := make([]string, 0, lines)
+	order := make([]string, 0, min(lines, 32))
+	lastKey := ""
+	for {
+		line, rest, ok := nextLine(raw, lenient)
+		if !ok {
+			return nil, nil, "", ErrInvalidMessage
+		}
+		raw = rest
+		if line == "" {
+			return headers, order, raw, nil
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastKey == "" {
+				return nil, nil, "", ErrInvalidMessage
+			}
+			previous := headers[lastKey]
+			continued := strings.Trim(line, " \t")
+			if last := previous[len(previous)-1]; last == "" {
+				previous[len(previous)-1] = continued
+			} else if continued != "" {
+				previous[len(previous)-1] = last + " " + continued
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimRight(name, " \t")
+		if !ok || !isToken(name) {
+			return nil, nil, "", ErrInvalidMessage
+		}
+		key := canonicalHeader(name)
+		value = strings.Trim(value, " \t")
+		if existing, ok := headers[key]; ok {
+			headers[key] = append(existing, value)
+		} else {
+			values = append(values, value)
+			headers[key] = values[len(values)-1 : len(values) : len(values)]
+			order = append(order, key)
+		}
+		lastKey = key
+	}
+}
+
+// nextLine splits the first line, without its CRLF or LF, from s. ok is
+// false when s holds no complete line.
+func nextLine(s string, lenient bool) (line, rest string, ok bool) {
+	i := strings.IndexByte(s, '\n')
+	if i < 0 {
+		return "", s, false
+	}
+	line = s[:i]
+	if strings.HasSuffix(line, "\r") {
+		line = line[:len(line)-1]
+	} else if !lenient {
+		return "", s, false
+	}
+	return line, s[i+1:], true
 }
 
+// canonicalHeader maps a header name, in any case and in compact or full
+// form, to the key it is stored under.
 func canonicalHeader(name string) string {
+	if len(name) == 1 {
+		if full, ok := fullForms[name[0]|0x20]; ok {
+			return full
+		}
+	}
 	return textproto.CanonicalMIMEHeaderKey(name)
 }
 
+// fullForms maps the compact header names of RFC 3261 section 7.3.3 and the
+// extensions registering one (RFC 3265, 3515, 3892, 4028) to their canonical
+// keys, and compactForms maps them back.
+var (
+	fullForms = map[byte]string{
+		'b': "Referred-By",
+		'c': "Content-Type",
+		'e': "Content-Encoding",
+		'f': "From",
+		'i': "Call-Id",
+		'k': "Supported",
+		'l': "Content-Length",
+		'm': "Contact",
+		'o': "Event",
+		'r': "Refer-To",
+		's': "Subject",
+		't': "To",
+		'u': "Allow-Events",
+		'v': "Via",
+		'x': "Session-Expires",
+	}
+	compactForms = func() map[string]string {
+		forms := make(map[string]string, len(fullForms))
+		for short, full := range fullForms {
+			forms[full] = string(short)
+		}
+		return forms
+	}()
+)
+
 // helper functions ----------------------------------------------------------
 
 // CopyHeaders copies the provided headers from src to dst.
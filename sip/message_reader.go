@@ -0,0 +1,152 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// defaultMaxStreamMessage bounds a message read from a stream unless
+// NewMessageReader is given another limit.
+const defaultMaxStreamMessage = 256 << 10
+
+// ErrMessageTooLarge is returned by MessageReader for a message whose header
+// block or body exceeds the reader's limit.
+var ErrMessageTooLarge = errors.New("sip: message too large")
+
+// MessageReader reads SIP messages from a byte stream, such as a TCP, TLS, or
+// WebSocket connection, where nothing but Content-Length marks where one
+// message ends and the next begins (RFC 3261 section 18.3). Bytes read past
+// the end of a message stay buffered for the next call.
+//
+// After any error other than io.EOF the reader has lost track of message
+// boundaries, so the connection should be closed.
+type MessageReader struct {
+	// Parser parses each message once it is framed. The zero value is
+	// strict.
+	Parser Parser
+	// Ping, when set, is called for each double-CRLF keepalive read
+	// between messages, so the caller can write the single-CRLF pong of
+	// RFC 5626 section 4.4.1 back on the connection.
+	Ping func()
+
+	r       *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+// NewMessageReader reads messages from r, refusing any larger than maxSize
+// bytes, or 256 KiB when maxSize is not positive.
+func NewMessageReader(r io.Reader, maxSize int) *MessageReader {
+	if maxSize <= 0 {
+		maxSize = defaultMaxStreamMessage
+	}
+	return &MessageReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadMessage reads the next message. Empty lines before it, such as the
+// CRLF keepalives of RFC 5626, are skipped, every pair of them reported to
+// Ping. It returns io.EOF when the stream
+// ends between messages and io.ErrUnexpectedEOF when it ends inside one. A
+// message without Content-Length cannot be framed and is an error.
+func (mr *MessageReader) ReadMessage() (*Message, error) {
+	buf := mr.buf[:0]
+	contentLength := -1
+	started := false
+	blanks := 0
+	for {
+		line, err := mr.readLine(buf)
+		if err != nil {
+			if err == io.EOF && (started || len(line) > len(buf)) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		text := line[len(buf):]
+		blank := len(bytes.TrimRight(text, "\r\n")) == 0
+		if !started {
+			if blank {
+				if blanks++; blanks == 2 {
+					blanks = 0
+					if mr.Ping != nil {
+						mr.Ping()
+					}
+				}
+				continue
+			}
+			started = true
+		}
+		buf = line
+		if len(buf) > mr.maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		if blank {
+			break
+		}
+		if n, ok, err := contentLengthLine(text); err != nil {
+			return nil, err
+		} else if ok {
+			contentLength = n
+		}
+	}
+	if contentLength < 0 {
+		return nil, fmt.Errorf("%w: stream message without Content-Length", ErrInvalidMessage)
+	}
+	if len(buf)+contentLength > mr.maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	head := len(buf)
+	buf = slices.Grow(buf, contentLength)[:head+contentLength]
+	if _, err := io.ReadFull(mr.r, buf[head:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	mr.buf = buf
+	return mr.Parser.ParseBytes(buf)
+}
+
+// Buffered reports how many bytes have been read from the stream but not yet
+// returned as part of a message.
+func (mr *MessageReader) Buffered() int {
+	return mr.r.Buffered()
+}
+
+// contentLengthLine reports the value of line if it is a Content-Length
+// header, in full or compact form. Folded continuation lines are not
+// considered: Content-Length is a single number.
+func contentLengthLine(line []byte) (int, bool, error) {
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
+		return 0, false, nil
+	}
+	name := bytes.TrimRight(line[:colon], " \t")
+	if !bytes.EqualFold(name, []byte("Content-Length")) && !bytes.EqualFold(name, []byte("l")) {
+		return 0, false, nil
+	}
+	value := string(bytes.TrimSpace(line[colon+1:]))
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false, fmt.Errorf("%w: Content-Length %q", ErrInvalidMessage, value)
+	}
+	return n, true, nil
+}
+
+// readLine appends the next line, with its line ending, to buf.
+func (mr *MessageReader) readLine(buf []byte) ([]byte, error) {
+	for {
+		chunk, err := mr.r.ReadSlice('\n')
+		buf = append(buf, chunk...)
+		if err != bufio.ErrBufferFull {
+			return buf, err
+		}
+		if len(buf) > mr.maxSize {
+			return buf, ErrMessageTooLarge
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package sip
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseMessageBytesHandlesFoldingAndBody(t *testing.T) {
+	data := []byte("INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"via: SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"Via: SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1\r\n" +
+		"Subject: lunch\r\n" +
+		"\tat noon \r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"v=0\ntrailing")
+	msg, err := ParseMessageBytes(data)
+	if err != nil {
+		t.Fatalf("ParseMessageBytes returned error: %v", err)
+	}
+	copy(data, make([]byte, len(data)))
+
+	if !msg.IsRequest() || msg.Method != "INVITE" || msg.RequestURI != "sip:bob@example.com" || msg.Proto != "SIP/2.0" {
+		t.Fatalf("unexpected start line: %+v", msg)
+	}
+	if vias := msg.HeaderValues("Via"); len(vias) != 2 || vias[1] != "SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1" {
+		t.Fatalf("expected both Via values in order, got %q", vias)
+	}
+	if got := msg.GetHeader("Subject"); got != "lunch at noon" {
+		t.Fatalf("expected folded Subject to be joined, got %q", got)
+	}
+	if msg.Body != "v=0\n" {
+		t.Fatalf("expected body limited by Content-Length, got %q", msg.Body)
+	}
+
+	msg.AddHeader("Via", "SIP/2.0/UDP edge.example.com;branch=z9hG4bKedge")
+	if got := msg.GetHeader("Subject"); got != "lunch at noon" {
+		t.Fatalf("appending a Via must not disturb other headers, got Subject %q", got)
+	}
+
+	for _, raw := range []string{
+		"",
+		"INVITE sip:bob@example.com\r\n\r\n",
+		"SIP/2.0 abc OK\r\n\r\n",
+		"SIP/2.0 200 OK\r\nContent-Length: 0\r\n",
+		"SIP/2.0 200 OK\r\n continued\r\n\r\n",
+		"SIP/2.0 200 OK\r\nno colon\r\n\r\n",
+		"SIP/2.0 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+	} {
+		if _, err := ParseMessage(raw); !errors.Is(err, ErrInvalidMessage) {
+			t.Fatalf("expected ErrInvalidMessage for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestAppendWireRendersWithoutModifyingMessage(t *testing.T) {
+	msg := NewResponse(180, "")
+	msg.Proto = ""
+	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1")
+	msg.SetHeader("Content-Length", "99")
+	msg.Body = "hello"
+
+	wire := string(msg.AppendWire([]byte("prefix|")))
+	want := "prefix|SIP/2.0 180 Ringing\r\n" +
+		"Via: SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\nhello"
+	if wire != want {
+		t.Fatalf("unexpected wire format:\n%q\nwant\n%q", wire, want)
+	}
+	if msg.Proto != "" || msg.GetHeader("Content-Length") != "99" {
+		t.Fatalf("AppendWire must not modify the message, got Proto %q Content-Length %q", msg.Proto, msg.GetHeader("Content-Length"))
+	}
+	if got := msg.String(); got != want[len("prefix|"):] {
+		t.Fatalf("expected String to match AppendWire, got %q", got)
+	}
+
+	parsed, err := ParseMessage(msg.String())
+	if err != nil || parsed.StatusCode != 180 || parsed.Body != "hello" {
+		t.Fatalf("expected the rendered message to parse back, got %+v, %v", parsed, err)
+	}
+}
+
+func TestCompactHeaderFormsAreNormalised(t *testing.T) {
+	raw := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"Via: SIP/2.0/UDP edge.example.com;branch=z9hG4bKedge1\r\n" +
+		"f: <sip:alice@example.com>;tag=1\r\n" +
+		"t: <sip:bob@example.com>\r\n" +
+		"i: call-1@example.com\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		"M: <sip:alice@192.0.2.1>\r\n" +
+		"c: application/sdp\r\n" +
+		"l: 4\r\n" +
+		"\r\n" +
+		"v=0\ntrailing"
+	msg, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if vias := msg.HeaderValues("Via"); len(vias) != 2 {
+		t.Fatalf("expected compact and full Via values to merge, got %q", vias)
+	}
+	for name, want := range map[string]string{
+		"From":         "<sip:alice@example.com>;tag=1",
+		"To":           "<sip:bob@example.com>",
+		"Call-ID":      "call-1@example.com",
+		"Contact":      "<sip:alice@192.0.2.1>",
+		"Content-Type": "application/sdp",
+		"i":            "call-1@example.com",
+	} {
+		if got := msg.GetHeader(name); got != want {
+			t.Fatalf("expected %s %q, got %q", name, want, got)
+		}
+	}
+	if msg.Body != "v=0\n" {
+		t.Fatalf("expected the compact Content-Length to bound the body, got %q", msg.Body)
+	}
+
+	wire := string(msg.AppendWireCompact(nil))
+	for _, line := range []string{"\r\nv: SIP/2.0/UDP client.example.com", "\r\ni: call-1@example.com\r\n", "\r\nl: 4\r\n", "\r\nCseq: 1 INVITE\r\n"} {
+		if !strings.Contains(wire, line) {
+			t.Fatalf("expected compact output to contain %q, got %q", line, wire)
+		}
+	}
+	if strings.Contains(wire, "Via:") || strings.Contains(wire, "Call-Id:") {
+		t.Fatalf("expected no full header names with a compact form, got %q", wire)
+	}
+	if reparsed, err := ParseMessage(wire); err != nil || reparsed.GetHeader("Call-ID") != "call-1@example.com" {
+		t.Fatalf("expected compact output to parse back, got %v", err)
+	}
+}
+
+func TestHeaderListSplitsCommaSeparatedElements(t *testing.T) {
+	msg := NewRequest("REGISTER", "sip:example.com")
+	msg.AddHeader("Contact", `"Smith, Alice" <sip:alice@192.0.2.1;a=1,2>;expires=60, <sip:alice@192.0.2.2>`)
+	msg.AddHeader("Contact", " <sip:alice@192.0.2.3> ")
+	msg.AddHeader("Contact", `"quoted \" comma," <sip:alice@192.0.2.4>,`)
+
+	got := msg.HeaderList("Contact")
+	want := []string{
+		`"Smith, Alice" <sip:alice@192.0.2.1;a=1,2>;expires=60`,
+		"<sip:alice@192.0.2.2>",
+		"<sip:alice@192.0.2.3>",
+		`"quoted \" comma," <sip:alice@192.0.2.4>`,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected elements:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestHeadersKeepReceivedOrder(t *testing.T) {
+	raw := "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1\r\n" +
+		"Record-Route: <sip:proxy.example.com;lr>\r\n" +
+		"Via: SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"To: <sip:bob@example.com>;tag=2\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"Call-Id: call-1@example.com\r\n" +
+		"Cseq: 1 INVITE\r\n" +
+		"Subject: folded\r\n" +
+		" subject\r\n" +
+		"\r\n"
+	msg, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := "SIP/2.0 200 OK\r\n" +
+		"Via: SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1\r\n" +
+		"Via: SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"Record-Route: <sip:proxy.example.com;lr>\r\n" +
+		"To: <sip:bob@example.com>;tag=2\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"Call-Id: call-1@example.com\r\n" +
+		"Cseq: 1 INVITE\r\n" +
+		"Subject: folded subject\r\n" +
+		"Content-Length: 0\r\n" +
+		"\r\n"
+	if got := string(msg.AppendWire(nil)); got != want {
+		t.Fatalf("expected received order:\n%q\nwant\n%q", got, want)
+	}
+
+	clone := msg.Clone()
+	clone.DelHeader("Record-Route")
+	clone.SetHeader("Max-Forwards", "69")
+	clone.SetHeader("To", "<sip:carol@example.com>")
+	wire := string(clone.AppendWire(nil))
+	if !strings.Contains(wire, "branch=z9hG4bKclient1\r\nTo: <sip:carol@example.com>\r\n") ||
+		!strings.HasSuffix(wire, "Subject: folded subject\r\nMax-Forwards: 69\r\nContent-Length: 0\r\n\r\n") {
+		t.Fatalf("expected replaced headers in place and new ones last, got %q", wire)
+	}
+	if got := string(msg.AppendWire(nil)); got != want {
+		t.Fatalf("expected the original's order untouched by its clone, got %q", got)
+	}
+}
+
+func TestMessageReaderFramesStreamByContentLength(t *testing.T) {
+	first := "INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP client.example.com;branch=z9hG4bKclient1\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"v=0\r\n"
+	second := "SIP/2.0 200 OK\r\n" +
+		"Subject: folded\r\n" +
+		"  line\r\n" +
+		"l: 0\r\n" +
+		"\r\n"
+	stream := "\r\n\r\n" + first + "\r\n\r\n" + second
+	reader := NewMessageReader(iotest.OneByteReader(strings.NewReader(stream)), 0)
+
+	msg, err := reader.ReadMessage()
+	if err != nil || msg.Method != "INVITE" || msg.Body != "v=0\r\n" {
+		t.Fatalf("expected the INVITE and its body, got %+v, %v", msg, err)
+	}
+	msg, err = reader.ReadMessage()
+	if err != nil || msg.StatusCode != 200 || msg.GetHeader("Subject") != "folded line" || msg.Body != "" {
+		t.Fatalf("expected the 200 OK, got %+v, %v", msg, err)
+	}
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF between messages, got %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		stream string
+		max    int
+		want   error
+	}{
+		"truncated body":    {first[:len(first)-2], 0, io.ErrUnexpectedEOF},
+		"truncated headers": {first[:40], 0, io.ErrUnexpectedEOF},
+		"no length":         {"OPTIONS sip:example.com SIP/2.0\r\n\r\n", 0, ErrInvalidMessage},
+		"bad length":        {"OPTIONS sip:example.com SIP/2.0\r\nContent-Length: -1\r\n\r\n", 0, ErrInvalidMessage},
+		"too large":         {first, len(first) - 1, ErrMessageTooLarge},
+		"huge header":       {"OPTIONS sip:example.com SIP/2.0\r\nX: " + strings.Repeat("a", 8192), 4096, ErrMessageTooLarge},
+	} {
+		_, err := NewMessageReader(strings.NewReader(tc.stream), tc.max).ReadMessage()
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
+
+func TestMessageReaderReportsKeepalivePings(t *testing.T) {
+	stream := "\r\n\r\n\r\n" + "OPTIONS sip:example.com SIP/2.0\r\nContent-Length: 0\r\n\r\n" + "\r\n\r\n\r\n\r\n"
+	pings := 0
+	reader := NewMessageReader(strings.NewReader(stream), 0)
+	reader.Ping = func() { pings++ }
+
+	if msg, err := reader.ReadMessage(); err != nil || msg.Method != "OPTIONS" {
+		t.Fatalf("expected the OPTIONS, got %+v, %v", msg, err)
+	}
+	if pings != 1 {
+		t.Fatalf("expected one ping before the message, got %d", pings)
+	}
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if pings != 3 {
+		t.Fatalf("expected two more pings after the message, got %d", pings)
+	}
+	for data, want := range map[string]keepaliveKind{
+		"\r\n\r\n": keepalivePing,
+		"\r\n":     keepaliveOther,
+		"":         notKeepalive,
+		"\r\nX":    notKeepalive,
+	} {
+		if got := classifyKeepalive([]byte(data)); got != want {
+			t.Fatalf("classifyKeepalive(%q) = %d, want %d", data, got, want)
+		}
+	}
+}
+
+func TestCloneSharesHeadersUntilModified(t *testing.T) {
+	for name, original := range map[string]*Message{
+		"constructed": newInvite(),
+		"literal":     {isRequest: true, Method: "INVITE", Headers: map[string][]string{"Via": {"SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1"}}},
+	} {
+		clone := original.Clone()
+		second := original.Clone()
+		clone.AddHeader("Via", "SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1")
+		second.AddHeader("Via", "SIP/2.0/UDP edge.example.com;branch=z9hG4bKedge")
+		original.SetHeader("Max-Forwards", "10")
+		second.DelHeader("Call-ID")
+
+		if vias := original.HeaderValues("Via"); len(vias) != 1 {
+			t.Fatalf("%s: expected clones not to modify the original's Via, got %q", name, vias)
+		}
+		if vias := clone.HeaderValues("Via"); len(vias) != 2 || !strings.Contains(vias[1], "proxy.example.com") {
+			t.Fatalf("%s: unexpected clone Via: %q", name, vias)
+		}
+		if vias := second.HeaderValues("Via"); len(vias) != 2 || !strings.Contains(vias[1], "edge.example.com") {
+			t.Fatalf("%s: unexpected second clone Via: %q", name, vias)
+		}
+		if clone.GetHeader("Max-Forwards") == "10" || second.GetHeader("Max-Forwards") == "10" {
+			t.Fatalf("%s: expected the original's change not to reach its clones", name)
+		}
+		if original.GetHeader("Call-ID") != clone.GetHeader("Call-ID") {
+			t.Fatalf("%s: expected deleting from one clone to leave the others intact", name)
+		}
+	}
+}
+
+func TestMultipartBodyPartsCanBeReadAndReplaced(t *testing.T) {
+	body := "--unique-boundary-1\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\n" +
+		"\r\n--unique-boundary-1\r\n" +
+		"Content-Type: application/ISUP; version=itu-t92+\r\n" +
+		"Content-Disposition: signal; handling=optional\r\n" +
+		"\r\n" +
+		"\x01\x00\x49\x00\x00\x03\x02\x00\x07" +
+		"\r\n--unique-boundary-1--\r\n"
+	msg, err := ParseMessage("INVITE sip:bob@example.com SIP/2.0\r\n" +
+		"c: multipart/mixed; boundary=unique-boundary-1\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" + body)
+	if err != nil {
+		t.Fatalf("ParseMessage returned error: %v", err)
+	}
+
+	parts, err := msg.BodyParts()
+	if err != nil {
+		t.Fatalf("BodyParts returned error: %v", err)
+	}
+	if len(parts) != 2 || parts[0].MediaType() != "application/sdp" || parts[1].MediaType() != "application/isup" {
+		t.Fatalf("unexpected parts: %+v", parts)
+	}
+	if parts[1].Body != "\x01\x00\x49\x00\x00\x03\x02\x00\x07" || parts[1].Header.Get("Content-Disposition") != "signal; handling=optional" {
+		t.Fatalf("unexpected ISUP part: %+v", parts[1])
+	}
+
+	replaced, err := msg.ReplaceBodyPart("application/sdp", "v=0\r\no=- 1 2 IN IP4 198.51.100.1\r\n")
+	if err != nil || !replaced {
+		t.Fatalf("ReplaceBodyPart = %v, %v", replaced, err)
+	}
+	again, err := ParseMessage(msg.String())
+	if err != nil {
+		t.Fatalf("rendered message does not parse: %v", err)
+	}
+	if got := again.GetHeader("Content-Length"); got != strconv.Itoa(len(again.Body)) {
+		t.Fatalf("expected Content-Length %d, got %q", len(again.Body), got)
+	}
+	if sdp, ok := again.BodyPart("application/sdp"); !ok || !strings.Contains(sdp.Body, "198.51.100.1") {
+		t.Fatalf("expected the replaced SDP, got %+v", sdp)
+	}
+	if isup, ok := again.BodyPart("application/isup"); !ok || isup.Body != parts[1].Body {
+		t.Fatalf("expected the ISUP part to be kept, got %+v", isup)
+	}
+	if mediaType, params, _ := again.ContentType(); mediaType != "multipart/mixed" || params["boundary"] != "unique-boundary-1" {
+		t.Fatalf("expected the boundary to be kept, got %s %v", mediaType, params)
+	}
+
+	if err := msg.SetBodyParts([]BodyPart{parts[1]}); err != nil {
+		t.Fatalf("SetBodyParts returned error: %v", err)
+	}
+	if msg.GetHeader("Content-Type") != "application/ISUP; version=itu-t92+" || msg.GetHeader("Content-Disposition") != "signal; handling=optional" || msg.Body != parts[1].Body {
+		t.Fatalf("expected a single part to become the body, got %q %q", msg.Headers, msg.Body)
+	}
+
+	plain := newInvite()
+	plain.SetBody("application/sdp", "v=0\r\n")
+	if sdp, ok := plain.BodyPart("application/sdp"); !ok || sdp.Body != "v=0\r\n" || plain.GetHeader("Content-Length") != "5" {
+		t.Fatalf("expected a plain SDP body to read as one part, got %+v", sdp)
+	}
+	plain.SetHeader("Content-Type", "multipart/mixed")
+	if _, err := plain.BodyParts(); !errors.Is(err, ErrInvalidBody) {
+		t.Fatalf("expected ErrInvalidBody without a boundary, got %v", err)
+	}
+}
+
+func TestValidateReportsPreciseReasons(t *testing.T) {
+	if err := newInvite().Validate(); err != nil {
+		t.Fatalf("expected a complete INVITE to be valid, got %v", err)
+	}
+	resp := NewResponse(200, "")
+	CopyHeaders(resp, newInvite(), "Via", "From", "To", "Call-ID", "CSeq")
+	if err := resp.Validate(); err != nil {
+		t.Fatalf("expected a response without Max-Forwards to be valid, got %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		modify func(*Message)
+		reason string
+		want   error
+	}{
+		"missing call-id":        {func(m *Message) { m.DelHeader("Call-ID") }, "Missing Call-ID Header", ErrMissingHeader},
+		"missing max-forwards":   {func(m *Message) { m.DelHeader("Max-Forwards") }, "Missing Max-Forwards Header", ErrMissingHeader},
+		"invite without contact": {func(m *Message) { m.DelHeader("Contact") }, "Missing Contact Header", ErrMissingHeader},
+		"duplicate from":         {func(m *Message) { m.AddHeader("From", "<sip:mallory@example.com>;tag=1") }, "Duplicate From Header", ErrInvalidMessage},
+		"cseq without method":    {func(m *Message) { m.SetHeader("CSeq", "314159") }, "Malformed CSeq Header", ErrInvalidMessage},
+		"cseq out of range":      {func(m *Message) { m.SetHeader("CSeq", "2147483648 INVITE") }, "Malformed CSeq Header", ErrInvalidMessage},
+		"cseq method mismatch":   {func(m *Message) { m.SetHeader("CSeq", "314159 BYE") }, "CSeq Method Mismatch", ErrInvalidMessage},
+		"max-forwards too big":   {func(m *Message) { m.SetHeader("Max-Forwards", "256") }, "Malformed Max-Forwards Header", ErrInvalidMessage},
+		"short body":             {func(m *Message) { m.Body = "v=0\r\n" }, "Content-Length Mismatch", ErrInvalidMessage},
+	} {
+		msg := newInvite()
+		tc.modify(msg)
+		err := msg.Validate()
+		var invalid *ValidationError
+		if !errors.As(err, &invalid) || invalid.Reason != tc.reason || !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %q wrapping %v, got %v", name, tc.reason, tc.want, err)
+		}
+	}
+}
+
+// benchmarkMessage keeps benchmark results alive so the compiler cannot
+// elide the work.
+var benchmarkMessage *Message
+
+func benchmarkDatagram() []byte {
+	msg := newInvite()
+	msg.AddHeader("Via", "SIP/2.0/UDP proxy.example.com;branch=z9hG4bKproxy1")
+	msg.SetHeader("Content-Type", "application/sdp")
+	msg.Body = "v=0\r\no=alice 2890844526 2890844526 IN IP4 client.example.com\r\ns=-\r\nc=IN IP4 192.0.2.101\r\nt=0 0\r\nm=audio 49172 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n"
+	return msg.AppendWire(nil)
+}
+
+func BenchmarkParseMessageBytes(b *testing.B) {
+	data := benchmarkDatagram()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseMessageBytes(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessageAppendWire(b *testing.B) {
+	msg, err := ParseMessageBytes(benchmarkDatagram())
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 0, maxDatagramSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = msg.AppendWire(buf[:0])
+	}
+}
+
+func BenchmarkMessageCloneAndModify(b *testing.B) {
+	msg, err := ParseMessageBytes(benchmarkDatagram())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		clone := msg.Clone()
+		clone.SetHeader("Max-Forwards", "69")
+	}
+}
+
+func BenchmarkParseMessage(b *testing.B) {
+	raw := string(benchmarkDatagram())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseMessage(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessageString(b *testing.B) {
+	msg, err := ParseMessageBytes(benchmarkDatagram())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = msg.String()
+	}
+}
+
+func BenchmarkMessageClone(b *testing.B) {
+	msg, err := ParseMessageBytes(benchmarkDatagram())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkMessage = msg.Clone()
+	}
+}
@@ -0,0 +1,201 @@
+package sip
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"xylitol4/internal/metrics"
+)
+
+// Metrics instruments the proxy layers and the stack's sockets. A nil
+// *Metrics records nothing, so the layers call it unconditionally.
+type Metrics struct {
+	requests        *metrics.CounterVec
+	responses       *metrics.CounterVec
+	retransmissions *metrics.CounterVec
+	invalid         *metrics.CounterVec
+	dropped         *metrics.CounterVec
+	transactions    *metrics.GaugeVec
+	duration        *metrics.HistogramVec
+	timeouts        *metrics.CounterVec
+	broadcasts      *metrics.CounterVec
+	queues          *metrics.GaugeVec
+	overflows       *metrics.CounterVec
+	shed            *metrics.CounterVec
+	registrations   *metrics.GaugeVec
+	routes          *metrics.GaugeVec
+	routeEvictions  *metrics.CounterVec
+	failovers       *metrics.CounterVec
+	trunkFailovers  *metrics.CounterVec
+	emergencyCalls  *metrics.CounterVec
+	challenges      *metrics.CounterVec
+	calls           *metrics.GaugeVec
+	callLimits      *metrics.CounterVec
+}
+
+// NewMetrics registers the SIP metric families in reg.
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		requests:        reg.Counter("sip_requests_received_total", "SIP requests received, by source side and method.", "source", "method"),
+		responses:       reg.Counter("sip_responses_received_total", "SIP responses received, by source side and status class.", "source", "class"),
+		retransmissions: reg.Counter("sip_retransmissions_total", "Retransmissions: requests resent upstream, responses resent downstream, and duplicate requests absorbed.", "kind"),
+		invalid:         reg.Counter("sip_invalid_datagrams_total", "Datagrams discarded because they did not parse as SIP, by source side.", "source"),
+		dropped:         reg.Counter("sip_datagrams_dropped_total", "Datagrams dropped unparsed because the parse workers' queues were full, by source side.", "source"),
+		transactions:    reg.Gauge("sip_transactions_active", "Transactions currently held by the transaction layer.", "kind"),
+		duration:        reg.Histogram("sip_client_transaction_duration_seconds", "Time from forwarding a request to its final response or timeout, by method.", nil, "method"),
+		timeouts:        reg.Counter("sip_client_transaction_timeouts_total", "Forwarded requests that timed out without a final response, by method.", "method"),
+		broadcasts:      reg.Counter("sip_broadcast_outcomes_total", "Finished broadcast (parallel fork) calls, by outcome.", "outcome"),
+		queues:          reg.Gauge("sip_queue_depth", "Messages waiting in each internal queue of the proxy.", "queue"),
+		overflows:       reg.Counter("sip_queue_overflows_total", "Messages that found an edge queue of the proxy full, by queue and whether they were dropped or rejected with 503.", "queue", "action"),
+		shed:            reg.Counter("sip_overload_rejections_total", "New INVITEs answered 503 because the proxy was over an overload threshold or draining, by the threshold exceeded or \"draining\".", "reason"),
+		registrations:   reg.Gauge("sip_registrations_active", "Active registrar bindings."),
+		routes:          reg.Gauge("sip_routes", "Downstream transaction routes held by the stack, including expired ones not yet cleaned up."),
+		routeEvictions:  reg.Counter("sip_route_evictions_total", "Downstream transaction routes evicted before expiring because the route table was full."),
+		failovers:       reg.Counter("sip_upstream_failovers_total", "Forwarded requests retried on another upstream server after a timeout or 503."),
+		trunkFailovers:  reg.Counter("sip_trunk_failovers_total", "Requests sent through the next cheapest trunk after the previous one timed out or answered 408 or 5xx."),
+		emergencyCalls:  reg.Counter("sip_emergency_calls_total", "INVITEs to emergency numbers sent on the emergency route."),
+		challenges:      reg.Counter("sip_upstream_challenges_answered_total", "Requests sent upstream again with trunk credentials after a 401 or 407 challenge."),
+		calls:           reg.Gauge("sip_calls_active", "Calls in progress: initial INVITEs admitted and not yet failed or ended by BYE."),
+		callLimits:      reg.Counter("sip_call_limit_rejections_total", "New INVITEs answered 486 because the caller or callee was at their call limit."),
+	}
+}
+
+// sourceLabel names the side a message arrived from.
+func sourceLabel(dir direction) string {
+	if dir == directionUpstream {
+		return "server"
+	}
+	return "client"
+}
+
+func (m *Metrics) messageReceived(evt transportEvent) {
+	if m == nil || evt.Message == nil {
+		return
+	}
+	if evt.Message.IsRequest() {
+		m.requests.Inc(sourceLabel(evt.Direction), strings.ToUpper(evt.Message.Method))
+		return
+	}
+	m.responses.Inc(sourceLabel(evt.Direction), statusClass(evt.Message.StatusCode))
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 699 {
+		return "invalid"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func (m *Metrics) retransmitted(kind string) {
+	if m == nil {
+		return
+	}
+	m.retransmissions.Inc(kind)
+}
+
+func (m *Metrics) invalidDatagram(dir direction) {
+	if m == nil {
+		return
+	}
+	m.invalid.Inc(sourceLabel(dir))
+}
+
+func (m *Metrics) droppedDatagram(dir direction) {
+	if m == nil {
+		return
+	}
+	m.dropped.Inc(sourceLabel(dir))
+}
+
+func (m *Metrics) transactionsActive(server, client int) {
+	if m == nil {
+		return
+	}
+	m.transactions.Set(float64(server), "server")
+	m.transactions.Set(float64(client), "client")
+}
+
+// clientTransactionDone records a forwarded request reaching its final
+// response, or timing out. Only the first call per transaction counts, as
+// final responses are retransmitted.
+func (m *Metrics) clientTransactionDone(data *transactionData, timedOut bool) {
+	if m == nil || data == nil || data.started.IsZero() {
+		return
+	}
+	m.duration.Observe(time.Since(data.started).Seconds(), data.method)
+	data.started = time.Time{}
+	if timedOut {
+		m.timeouts.Inc(data.method)
+	}
+}
+
+func (m *Metrics) queueOverflow(queue, action string) {
+	if m == nil {
+		return
+	}
+	m.overflows.Inc(queue, action)
+}
+
+func (m *Metrics) overloadRejected(reason string) {
+	if m == nil {
+		return
+	}
+	m.shed.Inc(reason)
+}
+
+func (m *Metrics) routeEvicted() {
+	if m == nil {
+		return
+	}
+	m.routeEvictions.Inc()
+}
+
+func (m *Metrics) upstreamFailover() {
+	if m == nil {
+		return
+	}
+	m.failovers.Inc()
+}
+
+func (m *Metrics) trunkFailover() {
+	if m == nil {
+		return
+	}
+	m.trunkFailovers.Inc()
+}
+
+func (m *Metrics) emergencyCall() {
+	if m == nil {
+		return
+	}
+	m.emergencyCalls.Inc()
+}
+
+func (m *Metrics) upstreamChallengeAnswered() {
+	if m == nil {
+		return
+	}
+	m.challenges.Inc()
+}
+
+func (m *Metrics) broadcastFinished(outcome string) {
+	if m == nil {
+		return
+	}
+	m.broadcasts.Inc(outcome)
+}
+
+func (m *Metrics) callsActive(calls int) {
+	if m == nil {
+		return
+	}
+	m.calls.Set(float64(calls))
+}
+
+func (m *Metrics) callLimitRejected() {
+	if m == nil {
+		return
+	}
+	m.callLimits.Inc()
+}
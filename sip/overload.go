@@ -0,0 +1,74 @@
+package sip
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadConfig sets when the proxy sheds load by refusing new calls. A
+// threshold that is not positive is not checked, so the zero value never
+// refuses anything.
+type OverloadConfig struct {
+	// MaxQueueDepth is the number of messages waiting in the proxy's queues
+	// above which new INVITEs are refused.
+	MaxQueueDepth int
+	// MaxTransactions is the number of live server and client transactions
+	// above which new INVITEs are refused.
+	MaxTransactions int
+	// MaxCalls is the number of calls in progress at which new INVITEs are
+	// refused; see callAdmission.
+	MaxCalls int
+	// RetryAfter is advertised in the Retry-After header of every 503 the
+	// proxy sends for overload, rounded up to whole seconds; zero omits it.
+	RetryAfter time.Duration
+}
+
+// overloadControl decides, for each initial INVITE, whether the proxy is too
+// busy to take on another call. Requests within existing dialogs and other
+// methods are always served, so calls in progress can finish.
+type overloadControl struct {
+	cfg          OverloadConfig
+	queued       func() int
+	transactions func() int
+	calls        func() int
+	// draining refuses every new call while the proxy shuts down; see
+	// Proxy.Drain.
+	draining atomic.Bool
+}
+
+// shed reports why a new call should be refused, or "" when it can be
+// accepted. A nil control never sheds.
+func (o *overloadControl) shed() string {
+	if o == nil {
+		return ""
+	}
+	if o.draining.Load() {
+		return "draining"
+	}
+	if o.cfg.MaxQueueDepth > 0 && o.queued() > o.cfg.MaxQueueDepth {
+		return "queue_depth"
+	}
+	if o.cfg.MaxTransactions > 0 && o.transactions() > o.cfg.MaxTransactions {
+		return "transactions"
+	}
+	if o.cfg.MaxCalls > 0 && o.calls() >= o.cfg.MaxCalls {
+		return "calls"
+	}
+	return ""
+}
+
+// overloadResponse is the 503 Service Unavailable answering a request the
+// proxy has no capacity for (RFC 3261 section 16.2 and 21.5.4), with a
+// Retry-After when retryAfter is positive.
+func overloadResponse(req *Message, retryAfter time.Duration) *Message {
+	resp := NewResponse(503, "Service Unavailable")
+	CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+	ensureToTag(resp)
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		resp.SetHeader("Retry-After", strconv.Itoa(seconds))
+	}
+	resp.EnsureContentLength()
+	return resp
+}
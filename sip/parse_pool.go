@@ -0,0 +1,96 @@
+package sip
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// parseQueueDepth is how many datagrams wait for each parse worker before
+// further datagrams for it are dropped.
+const parseQueueDepth = 64
+
+// rawDatagram is one datagram read from a socket. buf is a pooled buffer
+// holding exactly the datagram; whoever handles it returns it to the pool.
+type rawDatagram struct {
+	buf      *[]byte
+	addr     net.Addr
+	received time.Time
+}
+
+// parsePool parses datagrams off the socket goroutine, so a burst of large
+// messages does not stall reads. Datagrams are assigned to workers by source
+// address, which keeps each peer's datagrams in arrival order. Each worker's
+// queue is bounded: a datagram for a worker that has fallen behind is
+// refused, as a full socket buffer would drop it.
+type parsePool struct {
+	queues []chan rawDatagram
+	handle func(rawDatagram)
+	wg     sync.WaitGroup
+}
+
+// newParsePool starts workers goroutines calling handle, or one per
+// available CPU when workers is not positive.
+func newParsePool(workers int, handle func(rawDatagram)) *parsePool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := &parsePool{handle: handle}
+	for i := 0; i < workers; i++ {
+		queue := make(chan rawDatagram, parseQueueDepth)
+		p.queues = append(p.queues, queue)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range queue {
+				p.handle(d)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues d for its source's worker, reporting false when that
+// worker's queue is full.
+func (p *parsePool) submit(d rawDatagram) bool {
+	select {
+	case p.queues[p.workerFor(d.addr)] <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the workers once they have handled everything queued.
+func (p *parsePool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// workerFor maps a source address to a worker with FNV-1a over its IP and
+// port, avoiding the allocation of formatting the address.
+func (p *parsePool) workerFor(addr net.Addr) int {
+	if len(p.queues) == 1 {
+		return 0
+	}
+	hash := uint32(2166136261)
+	mix := func(b byte) {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		for _, b := range udp.IP {
+			mix(b)
+		}
+		mix(byte(udp.Port >> 8))
+		mix(byte(udp.Port))
+	} else if addr != nil {
+		for _, b := range []byte(addr.String()) {
+			mix(b)
+		}
+	}
+	return int(hash % uint32(len(p.queues)))
+}
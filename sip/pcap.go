@@ -0,0 +1,291 @@
+package sip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pcapLinkTypeRaw marks records that start directly with an IPv4 or IPv6
+	// header, so no link-layer header has to be invented.
+	pcapLinkTypeRaw = 101
+	pcapSnapLen     = 65535
+	pcapQueueLength = 1024
+
+	defaultPcapMaxBytes = 100 << 20
+	defaultPcapMaxFiles = 5
+)
+
+// PcapConfig describes where a PcapWriter writes and when it rotates.
+type PcapConfig struct {
+	// Path is the active capture file. Rotated files get the suffixes .1
+	// (newest) to .N.
+	Path string
+	// MaxBytes rotates the file once it would grow past this size (100 MiB
+	// when not positive).
+	MaxBytes int64
+	// MaxFiles is how many rotated files to keep besides the active one (5
+	// when not positive).
+	MaxFiles int
+	Logger   *slog.Logger
+}
+
+// PcapWriter is a PacketObserver that writes every datagram to a rotating
+// pcap file, synthesising the IP and UDP headers, so traffic can be analysed
+// in Wireshark without capturing on the host. Writes happen on a separate
+// goroutine; when the queue is full packets are dropped rather than delaying
+// SIP traffic.
+type PcapWriter struct {
+	cfg    PcapConfig
+	logger *slog.Logger
+	queue  chan Packet
+
+	file    *os.File
+	buf     *bufio.Writer
+	written int64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	finished  chan struct{}
+}
+
+// NewPcapWriter opens cfg.Path, rotating any existing capture out of the way,
+// and starts the writer.
+func NewPcapWriter(cfg PcapConfig) (*PcapWriter, error) {
+	cfg.Path = strings.TrimSpace(cfg.Path)
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("sip: pcap path is required")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultPcapMaxBytes
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = defaultPcapMaxFiles
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	w := &PcapWriter{
+		cfg:      cfg,
+		logger:   logger,
+		queue:    make(chan Packet, pcapQueueLength),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// ObservePacket queues a datagram for writing.
+func (w *PcapWriter) ObservePacket(p Packet) {
+	if w == nil {
+		return
+	}
+	select {
+	case <-w.done:
+	case w.queue <- p:
+	default:
+	}
+}
+
+// Close writes the queued packets and closes the file.
+func (w *PcapWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.closeOnce.Do(func() { close(w.done) })
+	<-w.finished
+	return w.closeFile()
+}
+
+func (w *PcapWriter) run() {
+	defer close(w.finished)
+	for {
+		select {
+		case p := <-w.queue:
+			w.write(p)
+		case <-w.done:
+			for {
+				select {
+				case p := <-w.queue:
+					w.write(p)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *PcapWriter) write(p Packet) {
+	record := pcapRecord(p)
+	if w.file == nil || w.written+int64(len(record)) > w.cfg.MaxBytes {
+		if err := w.rotate(); err != nil {
+			w.logger.Error("failed to rotate pcap file", "path", w.cfg.Path, "error", err)
+			return
+		}
+	}
+	n, err := w.buf.Write(record)
+	w.written += int64(n)
+	if err == nil && len(w.queue) == 0 {
+		err = w.buf.Flush()
+	}
+	if err != nil {
+		w.logger.Error("failed to write pcap file", "path", w.cfg.Path, "error", err)
+	}
+}
+
+// rotate closes the active file, shifts the rotated files up by one, and
+// starts a new file with a pcap header.
+func (w *PcapWriter) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(w.cfg.Path); err == nil {
+		os.Remove(w.rotatedPath(w.cfg.MaxFiles))
+		for i := w.cfg.MaxFiles - 1; i >= 1; i-- {
+			os.Rename(w.rotatedPath(i), w.rotatedPath(i+1))
+		}
+		if err := os.Rename(w.cfg.Path, w.rotatedPath(1)); err != nil {
+			return fmt.Errorf("sip: rotate pcap file: %w", err)
+		}
+	}
+	file, err := os.OpenFile(w.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("sip: create pcap file: %w", err)
+	}
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	header := make([]byte, 0, 24)
+	header = binary.LittleEndian.AppendUint32(header, 0xa1b2c3d4)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint32(header, 0) // GMT offset
+	header = binary.LittleEndian.AppendUint32(header, 0) // timestamp accuracy
+	header = binary.LittleEndian.AppendUint32(header, pcapSnapLen)
+	header = binary.LittleEndian.AppendUint32(header, pcapLinkTypeRaw)
+	n, err := w.buf.Write(header)
+	w.written = int64(n)
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("sip: write pcap header: %w", err)
+	}
+	return nil
+}
+
+func (w *PcapWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	flushErr := w.buf.Flush()
+	closeErr := w.file.Close()
+	w.file, w.buf = nil, nil
+	if flushErr != nil {
+		return fmt.Errorf("sip: flush pcap file: %w", flushErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("sip: close pcap file: %w", closeErr)
+	}
+	return nil
+}
+
+func (w *PcapWriter) rotatedPath(n int) string {
+	return w.cfg.Path + "." + strconv.Itoa(n)
+}
+
+// pcapRecord renders p as a pcap record holding a synthesised IP/UDP packet.
+func pcapRecord(p Packet) []byte {
+	src, dst := p.endpoints()
+	data := p.Data
+	if len(data) > pcapSnapLen-48 {
+		data = data[:pcapSnapLen-48]
+	}
+
+	udp := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	udp = append(udp, data...)
+
+	var packet []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, 20-byte header
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64 // TTL
+		ip[9] = 17 // UDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], internetChecksum(ip, 0))
+		pseudo := append(append([]byte{}, src4...), dst4...)
+		pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+		packet = append(ip, udp...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17 // UDP
+		ip[7] = 64 // hop limit
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+		pseudo := append(append([]byte{}, src.IP.To16()...), dst.IP.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(udp)))
+		pseudo = append(pseudo, 0, 0, 0, 17)
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+		packet = append(ip, udp...)
+	}
+
+	ts := p.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	return append(record, packet...)
+}
+
+// udpChecksum computes the UDP checksum over the pseudo-header and segment;
+// a zero result is sent as all ones.
+func udpChecksum(pseudo, segment []byte) uint16 {
+	sum := internetChecksum(segment, checksumSum(pseudo, 0))
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
+// internetChecksum is the RFC 1071 checksum of b added to a partial sum.
+func internetChecksum(b []byte, partial uint32) uint16 {
+	sum := checksumSum(b, partial)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func checksumSum(b []byte, sum uint32) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
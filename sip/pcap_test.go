@@ -0,0 +1,89 @@
+package sip
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPcapRecordSynthesisesValidHeaders(t *testing.T) {
+	options := newOptions()
+	record := pcapRecord(Packet{
+		Time:    time.Unix(1700000000, 5000),
+		Local:   &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060},
+		Remote:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5062},
+		Data:    []byte(options.String()),
+		Message: options,
+	})
+	if binary.LittleEndian.Uint32(record[0:]) != 1700000000 || binary.LittleEndian.Uint32(record[4:]) != 5 {
+		t.Fatalf("unexpected record timestamp % x", record[:8])
+	}
+	packet := record[16:]
+	if int(binary.LittleEndian.Uint32(record[8:])) != len(packet) || packet[0] != 0x45 {
+		t.Fatalf("unexpected IPv4 packet % x", packet[:20])
+	}
+	if internetChecksum(packet[:20], 0) != 0 {
+		t.Fatal("IPv4 header checksum does not verify")
+	}
+	if !net.IP(packet[12:16]).Equal(net.IPv4(10, 0, 0, 1)) || !net.IP(packet[16:20]).Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("sent packet should go from the local to the remote address")
+	}
+	udp := packet[20:]
+	if binary.BigEndian.Uint16(udp[0:]) != 5060 || binary.BigEndian.Uint16(udp[2:]) != 5062 || string(udp[8:]) != options.String() {
+		t.Fatalf("unexpected UDP segment % x", udp[:8])
+	}
+	pseudo := append(append([]byte{}, packet[12:20]...), 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	if internetChecksum(udp, checksumSum(pseudo, 0)) != 0 {
+		t.Fatal("UDP checksum does not verify")
+	}
+
+	v6 := pcapRecord(Packet{
+		Received: true,
+		Local:    &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060},
+		Remote:   &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5062},
+		Data:     []byte("x"),
+	})
+	if v6[16]>>4 != 6 || !net.IP(v6[16+8:16+24]).Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("unexpected IPv6 packet % x", v6[16:56])
+	}
+}
+
+func TestPcapWriterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sip.pcap")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := NewPcapWriter(PcapConfig{Path: path, MaxBytes: 1500, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("NewPcapWriter: %v", err)
+	}
+	invite := newInvite()
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5060}
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5062}
+	for i := 0; i < 12; i++ {
+		writer.ObservePacket(Packet{Received: true, Local: local, Remote: remote, Data: []byte(invite.String()), Message: invite})
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		if len(data) > 1500 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+			t.Fatalf("%s is not a bounded pcap file (%d bytes)", name, len(data))
+		}
+		if !strings.Contains(string(data), "INVITE sip:bob@example.com") {
+			t.Fatalf("%s holds no captured INVITE", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected at most two rotated files, got %v", err)
+	}
+}
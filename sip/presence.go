@@ -0,0 +1,230 @@
+package sip
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pidfContentType is the presence document format (RFC 3863) published and
+// notified.
+const pidfContentType = "application/pidf+xml"
+
+// Presence is the presence event package (RFC 3856) and the event state
+// compositor (RFC 3903) behind it: endpoints PUBLISH presence documents for
+// their address of record, and its watchers are notified of the one
+// published most recently that has not expired, or of a closed status when
+// there is none. Publications are held in memory only. It belongs to the
+// proxy core's goroutine.
+type Presence struct {
+	publications map[string]map[string]*publication // user@domain to entity tag
+	now          func() time.Time
+}
+
+// publication is one presence document in force, as a PUBLISH set it.
+type publication struct {
+	body      string
+	published time.Time
+	expires   time.Time
+}
+
+// NewPresence returns a presence package with nothing published.
+func NewPresence() *Presence {
+	return &Presence{
+		publications: make(map[string]map[string]*publication),
+		now:          time.Now,
+	}
+}
+
+// Event names the package.
+func (p *Presence) Event() string {
+	return "presence"
+}
+
+// Authorize accepts every watcher of a user, unless it accepts no presence
+// documents.
+func (p *Presence) Authorize(ctx context.Context, sub *Subscription) int {
+	if strings.HasPrefix(sub.Resource, "@") {
+		return 404
+	}
+	if !acceptsType(sub.Accept, pidfContentType) {
+		return 406
+	}
+	return 0
+}
+
+// State returns the presence document of sub.Resource.
+func (p *Presence) State(ctx context.Context, sub *Subscription) (string, string) {
+	var latest *publication
+	now := p.now()
+	for _, pub := range p.publications[sub.Resource] {
+		if pub.expires.After(now) && (latest == nil || pub.published.After(latest.published)) {
+			latest = pub
+		}
+	}
+	if latest != nil {
+		return pidfContentType, latest.body
+	}
+	return pidfContentType, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<presence xmlns="urn:ietf:params:xml:ns:pidf" entity="` + escapeXML("sip:"+sub.Resource) + `">` +
+		`<tuple id="offline"><status><basic>closed</basic></status></tuple></presence>` + "\n"
+}
+
+// publish applies a PUBLISH for aor (RFC 3903 section 6): without ifMatch it
+// publishes body, and with it refreshes, replaces with body when not empty,
+// or, when expires is zero, removes the publication it names. It returns the
+// publication's new entity tag, whether the state watchers see may have
+// changed, and zero, or the status to refuse the request with.
+func (p *Presence) publish(aor, ifMatch, body string, expires int) (string, bool, int) {
+	now := p.now()
+	pubs := p.publications[aor]
+	if ifMatch == "" {
+		if body == "" || expires == 0 {
+			return "", false, 400
+		}
+		if pubs == nil {
+			pubs = make(map[string]*publication)
+			p.publications[aor] = pubs
+		}
+		etag := newTag()
+		pubs[etag] = &publication{body: body, published: now, expires: now.Add(time.Duration(expires) * time.Second)}
+		return etag, true, 0
+	}
+	pub, ok := pubs[ifMatch]
+	if !ok || !pub.expires.After(now) {
+		return "", false, 412
+	}
+	delete(pubs, ifMatch)
+	if expires == 0 {
+		if len(pubs) == 0 {
+			delete(p.publications, aor)
+		}
+		return ifMatch, true, 0
+	}
+	changed := body != ""
+	if changed {
+		pub.body = body
+		pub.published = now
+	}
+	pub.expires = now.Add(time.Duration(expires) * time.Second)
+	etag := newTag()
+	pubs[etag] = pub
+	return etag, changed, 0
+}
+
+// expire forgets the publications that were not refreshed in time,
+// returning the addresses of record whose state changed.
+func (p *Presence) expire() []string {
+	if p == nil {
+		return nil
+	}
+	now := p.now()
+	var changed []string
+	for aor, pubs := range p.publications {
+		for etag, pub := range pubs {
+			if !pub.expires.After(now) {
+				delete(pubs, etag)
+				if !slices.Contains(changed, aor) {
+					changed = append(changed, aor)
+				}
+			}
+		}
+		if len(pubs) == 0 {
+			delete(p.publications, aor)
+		}
+	}
+	return changed
+}
+
+// acceptsType reports whether the Accept headers accept lets contentType
+// through; a subscriber that gave none accepts the package's default.
+func acceptsType(accept []string, contentType string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, header := range accept {
+		for _, value := range strings.Split(header, ",") {
+			value, _, _ = strings.Cut(value, ";")
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == contentType || value == "*/*" || value == "application/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handlePublish answers req when it is a PUBLISH the proxy is the presence
+// compositor for, reporting whether it was. A user of the registrar must
+// authenticate and may only publish their own presence. Watchers of the
+// address of record are notified of what changed.
+func (t *transactionUser) handlePublish(ctx context.Context, event tuEvent, req *Message) bool {
+	if t.presence == nil || !strings.EqualFold(req.Method, "PUBLISH") {
+		return false
+	}
+	respond := func(status int, reason string, headers ...string) {
+		resp := registrarResponse(req, status, reason)
+		ensureToTag(resp)
+		for i := 0; i+1 < len(headers); i += 2 {
+			resp.SetHeader(headers[i], headers[i+1])
+		}
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+	}
+	t.expirePublications()
+	if t.registrar != nil {
+		if _, resp := t.registrar.authenticateSender(req.Context(), req); resp != nil {
+			t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+			return true
+		}
+	}
+	if name, _ := parseEventHeader(req.GetHeader("Event")); name != t.presence.Event() {
+		respond(489, "Bad Event", "Allow-Events", t.presence.Event())
+		return true
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil || uri.User == "" {
+		respond(404, "Not Found")
+		return true
+	}
+	aor := registrarKey(uri.User, t.canonicalDomain(uri.Host))
+	if t.registrar != nil {
+		user, domain, err := parseAddressOfRecord(req.GetHeader("From"))
+		if err != nil || registrarKey(user, t.canonicalDomain(domain)) != aor {
+			respond(403, "Forbidden")
+			return true
+		}
+	}
+	contentType, _, _ := strings.Cut(req.GetHeader("Content-Type"), ";")
+	if req.Body != "" && !strings.EqualFold(strings.TrimSpace(contentType), pidfContentType) {
+		respond(415, "Unsupported Media Type", "Accept", pidfContentType)
+		return true
+	}
+	expires, ok := subscriptionExpires(req)
+	if !ok {
+		respond(423, "Interval Too Brief", "Min-Expires", strconv.Itoa(minSubscriptionExpires))
+		return true
+	}
+	etag, changed, status := t.presence.publish(aor, strings.TrimSpace(req.GetHeader("SIP-If-Match")), req.Body, expires)
+	switch status {
+	case 400:
+		respond(400, "Bad Request")
+		return true
+	case 412:
+		respond(412, "Conditional Request Failed")
+		return true
+	}
+	respond(200, "OK", "SIP-ETag", etag, "Expires", strconv.Itoa(expires))
+	if changed {
+		t.subscriptions.Changed(t.presence.Event(), aor)
+	}
+	return true
+}
+
+// expirePublications notifies the watchers of presence that expired.
+func (t *transactionUser) expirePublications() {
+	for _, aor := range t.presence.expire() {
+		t.subscriptions.Changed(t.presence.Event(), aor)
+	}
+}
@@ -0,0 +1,119 @@
+package sip
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPublish(branch, ifMatch, body string) *Message {
+	msg := NewRequest("PUBLISH", "sip:bob@example.com")
+	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+branch)
+	msg.SetHeader("From", "<sip:bob@example.com>;tag=pub")
+	msg.SetHeader("To", "<sip:bob@example.com>")
+	msg.SetHeader("Call-ID", "pub-"+branch+"@client.example")
+	msg.SetHeader("CSeq", "1 PUBLISH")
+	msg.SetHeader("Max-Forwards", "70")
+	msg.SetHeader("Event", "presence")
+	msg.SetHeader("Expires", "600")
+	if ifMatch != "" {
+		msg.SetHeader("SIP-If-Match", ifMatch)
+	}
+	if body != "" {
+		msg.SetHeader("Content-Type", pidfContentType)
+		msg.Body = body
+	}
+	return msg
+}
+
+func TestProxyComposesPublishedPresence(t *testing.T) {
+	presence := NewPresence()
+	proxy := NewProxy(WithSubscriptions(NewSubscriptions(presence)), WithPresence(presence))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "presence", "watch"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the watcher to be accepted, got %v", resp)
+	}
+	if notify := nextNotify(t, proxy); !strings.Contains(notify.Body, "<basic>closed</basic>") || notify.GetHeader("Content-Type") != pidfContentType {
+		t.Fatalf("expected a closed presence before anything is published, got %q", notify.Body)
+	}
+
+	proxy.SendFromClient(newPublish("initial", "", "<presence>open</presence>"))
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 200 || resp.GetHeader("SIP-ETag") == "" || resp.GetHeader("Expires") != "600" {
+		t.Fatalf("expected the publication to be accepted, got %v", resp)
+	}
+	if notify := nextNotify(t, proxy); notify.Body != "<presence>open</presence>" {
+		t.Fatalf("expected the published document, got %q", notify.Body)
+	}
+
+	proxy.SendFromClient(newPublish("refresh", resp.GetHeader("SIP-ETag"), ""))
+	refreshed, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || refreshed.StatusCode != 200 || refreshed.GetHeader("SIP-ETag") == resp.GetHeader("SIP-ETag") {
+		t.Fatalf("expected a refresh to get a new entity tag, got %v", refreshed)
+	}
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected no NOTIFY for a refresh, got %v", msg)
+	}
+
+	proxy.SendFromClient(newPublish("stale", resp.GetHeader("SIP-ETag"), ""))
+	if stale, ok := proxy.NextToClient(100 * time.Millisecond); !ok || stale.StatusCode != 412 {
+		t.Fatalf("expected 412 for a replaced entity tag, got %v", stale)
+	}
+
+	remove := newPublish("remove", refreshed.GetHeader("SIP-ETag"), "")
+	remove.SetHeader("Expires", "0")
+	proxy.SendFromClient(remove)
+	if removed, ok := proxy.NextToClient(100 * time.Millisecond); !ok || removed.StatusCode != 200 {
+		t.Fatalf("expected the publication to be removed, got %v", removed)
+	}
+	if notify := nextNotify(t, proxy); !strings.Contains(notify.Body, "<basic>closed</basic>") {
+		t.Fatalf("expected a closed presence once removed, got %q", notify.Body)
+	}
+}
+
+func TestProxyRefusesInvalidPublications(t *testing.T) {
+	presence := NewPresence()
+	proxy := NewProxy(WithSubscriptions(NewSubscriptions(presence)), WithPresence(presence))
+	t.Cleanup(proxy.Stop)
+
+	for _, tt := range []struct {
+		name   string
+		req    *Message
+		status int
+	}{
+		{"no body", newPublish("empty", "", ""), 400},
+		{"unknown package", func() *Message {
+			req := newPublish("dialog", "", "<presence/>")
+			req.SetHeader("Event", "dialog")
+			return req
+		}(), 489},
+		{"wrong type", func() *Message {
+			req := newPublish("plain", "", "open")
+			req.SetHeader("Content-Type", "text/plain")
+			return req
+		}(), 415},
+	} {
+		proxy.SendFromClient(tt.req)
+		if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %v", tt.name, tt.status, resp)
+		}
+	}
+}
+
+func TestPresenceExpiresPublications(t *testing.T) {
+	presence := NewPresence()
+	now := time.Unix(1_700_000_000, 0)
+	presence.now = func() time.Time { return now }
+	if _, _, status := presence.publish("bob@example.com", "", "<presence/>", 60); status != 0 {
+		t.Fatalf("expected the publication to be accepted, got %d", status)
+	}
+	if changed := presence.expire(); len(changed) != 0 {
+		t.Fatalf("expected nothing to expire yet, got %q", changed)
+	}
+	now = now.Add(time.Minute)
+	if changed := presence.expire(); len(changed) != 1 || changed[0] != "bob@example.com" {
+		t.Fatalf("expected bob's presence to expire, got %q", changed)
+	}
+}
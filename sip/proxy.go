@@ -17,13 +17,41 @@ type Proxy struct {
 	serverOut chan *Message
 
 	transport    *transportLayer
-	transactions *transactionLayer
+	transactions *transactionShards
 	core         *transactionUser
+
+	queues   map[string]func() int
+	overflow *queueOverflow
 }
 
 type proxyConfig struct {
 	registrar *Registrar
 	broadcast *BroadcastPolicy
+	shortNums *ShortNumbers
+	callerIDs *CallerIDRules
+	headers   *HeaderRules
+	identity  *Identity
+	topology  *TopologyHiding
+	diversion *Diversion
+	// subscriptions serves SUBSCRIBE; see WithSubscriptions.
+	subscriptions *Subscriptions
+	presence      *Presence
+	dialogs       *DialogInfo
+	messages      *MessageStore
+	dialPlan      *DialPlan
+	enum          *ENUM
+	emergency     *Emergency
+	calls         *CallLog
+	metrics       *Metrics
+	events        *EventBus
+	shards        int
+	capacity      int
+	policy        QueuePolicy
+	overload      OverloadConfig
+	names         []string
+	failover      func(*Message) bool
+	auth          func(req, challenge *Message) (string, string, bool)
+	timers        TimerConfig
 }
 
 // ProxyOption customises the behaviour of a Proxy during construction.
@@ -44,27 +72,244 @@ func WithBroadcastPolicy(policy *BroadcastPolicy) ProxyOption {
 	}
 }
 
+// WithShortNumbers rewrites requests for short extensions to the addresses
+// of record they stand for before the dial plan and registrar see them.
+func WithShortNumbers(numbers *ShortNumbers) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.shortNums = numbers
+	}
+}
+
+// WithCallerIDRules rewrites the From header of requests leaving through a
+// trunk by rules.
+func WithCallerIDRules(rules *CallerIDRules) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.callerIDs = rules
+	}
+}
+
+// WithHeaderRules runs the header manipulation pipeline over every message
+// the transaction user receives and sends.
+func WithHeaderRules(rules *HeaderRules) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.headers = rules
+	}
+}
+
+// WithIdentity asserts the identity of authenticated callers and keeps
+// asserted identities inside the trust domain identity describes.
+func WithIdentity(identity *Identity) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.identity = identity
+	}
+}
+
+// WithTopologyHiding hides the Via and Record-Route headers of requests sent
+// outside the trust domain, restoring them on their responses.
+func WithTopologyHiding(topology *TopologyHiding) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.topology = topology
+	}
+}
+
+// WithDiversion adds a Diversion header, besides History-Info, to requests
+// retargeted by call forwarding or broadcast rules when diversion is enabled.
+func WithDiversion(diversion *Diversion) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.diversion = diversion
+	}
+}
+
+// WithSubscriptions makes the proxy the notifier for SUBSCRIBE requests
+// outside a dialog, serving the event packages of subs.
+func WithSubscriptions(subs *Subscriptions) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.subscriptions = subs
+	}
+}
+
+// WithPresence makes the proxy the presence compositor for PUBLISH requests.
+// presence should also be one of the packages of WithSubscriptions, so that
+// its watchers are notified of what is published.
+func WithPresence(presence *Presence) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.presence = presence
+	}
+}
+
+// WithDialogInfo has dialogs follow the calls through the proxy. dialogs
+// should also be one of the packages of WithSubscriptions, so that its
+// watchers are notified as the calls move on.
+func WithDialogInfo(dialogs *DialogInfo) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.dialogs = dialogs
+	}
+}
+
+// WithMessageStore stores MESSAGE requests for users of the registrar who
+// are offline, delivering them when the user next registers. Without it
+// such requests are refused with 480 Temporarily Unavailable.
+func WithMessageStore(store *MessageStore) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.messages = store
+	}
+}
+
+// WithDialPlan routes out-of-dialog requests by plan before the broadcast
+// rules and the callee's settings are applied, so that those see the
+// rewritten Request-URI.
+func WithDialPlan(plan *DialPlan) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.dialPlan = plan
+	}
+}
+
+// WithENUM looks up in ENUM the numbers of requests the dial plan sends
+// through trunks, and sends those ENUM has a SIP URI for straight to it.
+func WithENUM(enum *ENUM) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.enum = enum
+	}
+}
+
+// WithEmergency sends requests to emergency numbers on their designated
+// route ahead of every other check, as EmergencyConfig describes.
+func WithEmergency(emergency *Emergency) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.emergency = emergency
+	}
+}
+
+// WithCallLog records the calls passing through the proxy in log.
+func WithCallLog(log *CallLog) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.calls = log
+	}
+}
+
+// WithMetrics records the proxy's traffic and transaction statistics in m.
+func WithMetrics(m *Metrics) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.metrics = m
+	}
+}
+
+// WithEventBus publishes call starts, answers, and ends and transaction
+// timeouts on bus. Call events follow the call log, so a proxy given a bus
+// but no WithCallLog keeps a private one.
+func WithEventBus(bus *EventBus) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.events = bus
+	}
+}
+
+// WithTransactionShards runs the transaction layer as count independent
+// shards, each on its own goroutine; transactions are assigned by a hash of
+// their key. A count that is not positive uses one shard per available CPU.
+// Without this option the proxy runs a single shard, so the relative order of
+// messages from different transactions is deterministic.
+func WithTransactionShards(count int) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.shards = count
+	}
+}
+
+// WithQueueCapacity sets the buffer size of every internal queue, 32 by
+// default. A capacity that is not positive keeps the default.
+func WithQueueCapacity(capacity int) ProxyOption {
+	return func(cfg *proxyConfig) {
+		if capacity > 0 {
+			cfg.capacity = capacity
+		}
+	}
+}
+
+// WithQueuePolicy sets what happens to a message arriving at a full edge
+// queue; see QueuePolicy. The default is QueueBlock.
+func WithQueuePolicy(policy QueuePolicy) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.policy = policy
+	}
+}
+
+// WithOverloadControl makes the proxy answer new INVITEs with 503 Service
+// Unavailable while its queues or live transactions exceed the thresholds in
+// cfg, instead of letting the calls time out. cfg.RetryAfter also applies to
+// the 503s sent under QueueReject.
+func WithOverloadControl(cfg OverloadConfig) ProxyOption {
+	return func(c *proxyConfig) {
+		c.overload = cfg
+	}
+}
+
+// WithLocalNames sets the host names and addresses, as host or host:port,
+// that identify the proxy itself. An OPTIONS request whose Request-URI has no
+// user part and names one of them is answered by the proxy with 200 OK
+// instead of being forwarded. A name without a port matches any port.
+func WithLocalNames(names ...string) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.names = append(cfg.names, names...)
+	}
+}
+
+// WithUpstreamFailover lets the proxy retry a forwarded request whose client
+// transaction timed out or was answered 503. failover is given the request as
+// it was forwarded and reports whether it should be sent again, for example
+// because the server it went to has been marked down and another is
+// available. The retry is a new client transaction with a new branch; the
+// failure is relayed downstream only when failover declines.
+func WithUpstreamFailover(failover func(req *Message) bool) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.failover = failover
+	}
+}
+
+// WithUpstreamCredentials lets the proxy answer a 401 or 407 challenge to a
+// request it forwarded or generated itself, such as the BYE ending a losing
+// broadcast fork, instead of relaying it. credentials is given the request as
+// it was sent and the challenge, and returns the header, Authorization or
+// Proxy-Authorization, and value to send the request again with, or false to
+// relay the challenge. The retry has the next CSeq; for a forwarded request
+// the rest of its dialog's requests from the same side are renumbered to
+// match, and the responses relayed back with the sender's numbers.
+func WithUpstreamCredentials(credentials func(req, challenge *Message) (header, value string, ok bool)) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.auth = credentials
+	}
+}
+
+// WithTimers tunes the transaction timers, for example lowering T1 on a
+// network with short round trips; see TimerConfig.
+func WithTimers(timers TimerConfig) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.timers = timers
+	}
+}
+
 // NewProxy constructs and starts a stateful SIP proxy.
 func NewProxy(opts ...ProxyOption) *Proxy {
-	cfg := &proxyConfig{}
+	cfg := &proxyConfig{shards: 1, capacity: defaultQueueCapacity}
 	for _, opt := range opts {
 		if opt == nil {
 			continue
 		}
 		opt(cfg)
 	}
+	if cfg.events != nil && cfg.calls == nil {
+		cfg.calls = NewCallLog(0)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	clientIn := make(chan *Message, 32)
-	serverIn := make(chan *Message, 32)
-	clientOut := make(chan *Message, 32)
-	serverOut := make(chan *Message, 32)
+	clientIn := make(chan *Message, cfg.capacity)
+	serverIn := make(chan *Message, cfg.capacity)
+	clientOut := make(chan *Message, cfg.capacity)
+	serverOut := make(chan *Message, cfg.capacity)
 
-	transportToTxn := make(chan transportEvent, 32)
-	txnToTransport := make(chan transportEvent, 32)
-	txnToTU := make(chan tuEvent, 32)
-	tuToTxn := make(chan tuAction, 32)
+	transportToTxn := make(chan transportEvent, cfg.capacity)
+	txnToTransport := make(chan transportEvent, cfg.capacity)
+	txnToTU := make(chan tuEvent, cfg.capacity)
+	tuToTxn := make(chan tuAction, cfg.capacity)
 
 	proxy := &Proxy{
 		ctx:       ctx,
@@ -73,11 +318,56 @@ func NewProxy(opts ...ProxyOption) *Proxy {
 		serverIn:  serverIn,
 		clientOut: clientOut,
 		serverOut: serverOut,
+		overflow:  newQueueOverflow(cfg.policy, cfg.metrics, clientOut),
+		queues: map[string]func() int{
+			queueClientIn:      func() int { return len(clientIn) },
+			queueServerIn:      func() int { return len(serverIn) },
+			queueClientOut:     func() int { return len(clientOut) },
+			queueServerOut:     func() int { return len(serverOut) },
+			"transport_to_txn": func() int { return len(transportToTxn) },
+			"txn_to_transport": func() int { return len(txnToTransport) },
+			"txn_to_tu":        func() int { return len(txnToTU) },
+			"tu_to_txn":        func() int { return len(tuToTxn) },
+		},
 	}
+	proxy.transactions = newTransactionShards(cfg.shards, cfg.capacity, transportToTxn, txnToTransport, txnToTU, tuToTxn)
+	proxy.queues["txn_shards"] = proxy.transactions.queued
 
 	proxy.transport = newTransportLayer(clientIn, serverIn, clientOut, serverOut, transportToTxn, txnToTransport)
-	proxy.transactions = newTransactionLayer(transportToTxn, txnToTransport, txnToTU, tuToTxn)
+	proxy.transport.overflow = proxy.overflow
 	proxy.core = newTransactionUser(txnToTU, tuToTxn, cfg.registrar, cfg.broadcast)
+	proxy.transactions.each(func(layer *transactionLayer) {
+		layer.metrics = cfg.metrics
+		layer.events = cfg.events
+		cfg.timers.apply(layer)
+	})
+	proxy.overflow.retryAfter = cfg.overload.RetryAfter
+	proxy.core.overload = &overloadControl{
+		cfg:          cfg.overload,
+		queued:       proxy.queued,
+		transactions: proxy.transactions.stats.active,
+		calls:        proxy.core.admission.active,
+	}
+	proxy.core.dialPlan = cfg.dialPlan
+	proxy.core.shortNums = cfg.shortNums
+	proxy.core.callerIDs = cfg.callerIDs
+	proxy.core.headers = cfg.headers
+	proxy.core.identity = cfg.identity
+	proxy.core.topology = cfg.topology
+	proxy.core.diversion = cfg.diversion
+	proxy.core.subscriptions = cfg.subscriptions
+	proxy.core.presence = cfg.presence
+	proxy.core.dialogs = cfg.dialogs
+	proxy.core.messages = cfg.messages
+	proxy.core.enum = cfg.enum
+	proxy.core.emergency = cfg.emergency
+	proxy.core.calls = cfg.calls
+	proxy.core.metrics = cfg.metrics
+	proxy.core.admission.metrics = cfg.metrics
+	proxy.core.bus = cfg.events
+	proxy.core.localNames = cfg.names
+	proxy.core.failover = cfg.failover
+	proxy.core.credentials = cfg.auth
 
 	proxy.transport.start(ctx)
 	proxy.transactions.start(ctx)
@@ -87,31 +377,21 @@ func NewProxy(opts ...ProxyOption) *Proxy {
 }
 
 // SendFromClient enqueues a message as if it was received from a downstream
-// client.
+// client. When the queue is full the proxy's QueuePolicy applies.
 func (p *Proxy) SendFromClient(msg *Message) {
 	if p == nil || msg == nil {
 		return
 	}
-	clone := msg.Clone()
-	select {
-	case <-p.ctx.Done():
-		return
-	case p.clientIn <- clone:
-	}
+	p.overflow.send(p.ctx, queueClientIn, p.clientIn, msg.Clone())
 }
 
 // SendFromServer enqueues a message as if it was received from an upstream
-// server.
+// server. When the queue is full the proxy's QueuePolicy applies.
 func (p *Proxy) SendFromServer(msg *Message) {
 	if p == nil || msg == nil {
 		return
 	}
-	clone := msg.Clone()
-	select {
-	case <-p.ctx.Done():
-		return
-	case p.serverIn <- clone:
-	}
+	p.overflow.send(p.ctx, queueServerIn, p.serverIn, msg.Clone())
 }
 
 // NextToClient returns the next message ready to be sent toward the downstream
@@ -180,6 +460,99 @@ func (p *Proxy) NextToServer(timeout time.Duration) (*Message, bool) {
 	}
 }
 
+// pollToClient returns a message waiting for the downstream client without
+// blocking, so a sender can fill a batch with whatever is already queued.
+func (p *Proxy) pollToClient() (*Message, bool) {
+	select {
+	case msg, ok := <-p.clientOut:
+		return msg, ok
+	default:
+		return nil, false
+	}
+}
+
+// pollToServer is pollToClient for the upstream server.
+func (p *Proxy) pollToServer() (*Message, bool) {
+	select {
+	case msg, ok := <-p.serverOut:
+		return msg, ok
+	default:
+		return nil, false
+	}
+}
+
+// QueueDepths reports how many messages wait in each internal queue, keyed by
+// queue name.
+func (p *Proxy) QueueDepths() map[string]int {
+	if p == nil {
+		return nil
+	}
+	depths := make(map[string]int, len(p.queues))
+	for name, depth := range p.queues {
+		depths[name] = depth()
+	}
+	return depths
+}
+
+// queued reports how many messages wait in all of the proxy's queues.
+func (p *Proxy) queued() int {
+	total := 0
+	for _, depth := range p.queues {
+		total += depth()
+	}
+	return total
+}
+
+// QueueDrops reports how many messages each edge queue has discarded or
+// rejected under the QueuePolicy, keyed by queue name.
+func (p *Proxy) QueueDrops() map[string]uint64 {
+	if p == nil {
+		return nil
+	}
+	return p.overflow.drops()
+}
+
+// TransactionStats reports the transaction layer's active transactions, timer
+// firings, retransmissions, and timeouts.
+func (p *Proxy) TransactionStats() TransactionStats {
+	if p == nil {
+		return (&transactionCounters{}).snapshot()
+	}
+	return p.transactions.stats.snapshot()
+}
+
+// Drain makes the proxy refuse new calls, answering initial INVITEs with 503
+// Service Unavailable as it does under overload, while requests within
+// dialogs and other methods are still served so calls in progress can end.
+// It cannot be undone.
+func (p *Proxy) Drain() {
+	if p == nil {
+		return
+	}
+	p.core.overload.draining.Store(true)
+}
+
+// SetTimers changes the transaction timers while the proxy runs, as
+// WithTimers sets them at construction. Transactions already started keep
+// the timers they were started with.
+func (p *Proxy) SetTimers(timers TimerConfig) {
+	if p == nil {
+		return
+	}
+	p.transactions.each(func(layer *transactionLayer) {
+		layer.retimeTo(timers)
+	})
+}
+
+// InFlight reports how many server transactions still wait for a final
+// response, such as INVITEs whose forks are still ringing.
+func (p *Proxy) InFlight() int {
+	if p == nil {
+		return 0
+	}
+	return p.transactions.stats.unanswered()
+}
+
 // Stop shuts down the proxy and waits for all layers to exit.
 func (p *Proxy) Stop() {
 	if p == nil {
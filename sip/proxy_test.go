@@ -1,9 +1,14 @@
 package sip
 
 import (
+	"context"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"xylitol4/internal/metrics"
+	"xylitol4/sip/userdb"
 )
 
 func TestProxyInviteTransactionFlow(t *testing.T) {
@@ -182,6 +187,9 @@ func TestProxyBroadcastFirstResponseWins(t *testing.T) {
 	if cancel.RequestURI != "sip:bob@example.com" {
 		t.Fatalf("unexpected CANCEL target: %s", cancel.RequestURI)
 	}
+	if got := cancel.GetHeader("Reason"); got != `SIP;cause=200;text="Call completed elsewhere"` {
+		t.Fatalf("unexpected CANCEL Reason %q", got)
+	}
 
 	lateOK := buildResponseFrom(second, 200, "OK")
 	proxy.SendFromServer(lateOK)
@@ -190,6 +198,9 @@ func TestProxyBroadcastFirstResponseWins(t *testing.T) {
 	if !ok || bye.Method != "BYE" {
 		t.Fatalf("expected BYE for late OK, got %+v", bye)
 	}
+	if got := bye.GetHeader("Reason"); got != `SIP;cause=200;text="Call completed elsewhere"` {
+		t.Fatalf("unexpected BYE Reason %q", got)
+	}
 
 	terminated := buildResponseFrom(second, 487, "Request Terminated")
 	proxy.SendFromServer(terminated)
@@ -277,6 +288,465 @@ func buildResponseFrom(req *Message, status int, reason string) *Message {
 	return resp
 }
 
+func TestProxyAppliesCalleeSettings(t *testing.T) {
+	store := newMemoryStore()
+	store.settings[registrarKey("bob", "example.com")] = userdb.UserSettings{userdb.SettingDoNotDisturb: "true"}
+	store.settings[registrarKey("carol", "example.com")] = userdb.UserSettings{
+		userdb.SettingDoNotDisturb: "true",
+		userdb.SettingForwardTo:    "dave@voicemail.example.com",
+	}
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 486 {
+		t.Fatalf("expected 486 for do-not-disturb callee, got %v", resp)
+	}
+	if _, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("INVITE to a do-not-disturb callee should not be forwarded")
+	}
+
+	forwardedInvite := newInvite()
+	forwardedInvite.RequestURI = "sip:carol@example.com"
+	forwardedInvite.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient-fwd")
+	proxy.SendFromClient(forwardedInvite)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded INVITE")
+	}
+	if forwarded.RequestURI != "sip:dave@voicemail.example.com" {
+		t.Fatalf("expected Request-URI to be retargeted, got %q", forwarded.RequestURI)
+	}
+}
+
+func TestProxyRecordsCalls(t *testing.T) {
+	calls := NewCallLog(0)
+	proxy := NewProxy(WithCallLog(calls))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	proxy.SendFromClient(invite)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded invite")
+	}
+	if recent := calls.Recent("alice", "example.com", 0); len(recent) != 1 || recent[0].Status != 0 {
+		t.Fatalf("expected one pending call, got %+v", recent)
+	}
+
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	if _, ok := proxy.NextToClient(100 * time.Millisecond); !ok {
+		t.Fatalf("expected final response downstream")
+	}
+	recent := calls.Recent("bob", "example.com", 0)
+	if len(recent) != 1 {
+		t.Fatalf("expected call for callee, got %+v", recent)
+	}
+	call := recent[0]
+	if call.CallID != "a84b4c76e66710" || call.Caller != "alice@example.com" || call.Callee != "bob@example.com" {
+		t.Fatalf("unexpected call record: %+v", call)
+	}
+	if call.Status != 200 || call.Answered.IsZero() || !call.Ended.IsZero() {
+		t.Fatalf("expected answered call in progress, got %+v", call)
+	}
+
+	bye := newInvite()
+	bye.Method = "BYE"
+	bye.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclientbye")
+	bye.SetHeader("To", "<sip:bob@example.com>;tag=callee")
+	bye.SetHeader("CSeq", "314160 BYE")
+	proxy.SendFromClient(bye)
+	if _, ok := proxy.NextToServer(100 * time.Millisecond); !ok {
+		t.Fatalf("expected forwarded BYE")
+	}
+	if recent := calls.Recent("alice", "example.com", 0); len(recent) != 1 || recent[0].Ended.IsZero() {
+		t.Fatalf("expected ended call, got %+v", recent)
+	}
+}
+
+func TestProxyRecordsMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	proxy := NewProxy(WithMetrics(NewMetrics(reg)))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	proxy.SendFromClient(invite)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded invite")
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	if _, ok := proxy.NextToClient(100 * time.Millisecond); !ok {
+		t.Fatalf("expected final response downstream")
+	}
+	proxy.SendFromClient(invite)
+	if _, ok := proxy.NextToClient(100 * time.Millisecond); !ok {
+		t.Fatalf("expected cached final response for the retransmission")
+	}
+
+	var out strings.Builder
+	if err := reg.WriteText(&out); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	for _, want := range []string{
+		`sip_requests_received_total{source="client",method="INVITE"} 2`,
+		`sip_responses_received_total{source="server",class="2xx"} 1`,
+		`sip_retransmissions_total{kind="absorbed"} 1`,
+		`sip_client_transaction_duration_seconds_count{method="INVITE"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics output missing %q:\n%s", want, out.String())
+		}
+	}
+	if stats := proxy.TransactionStats(); stats.ResponseRetransmissions != 1 || stats.TimerFirings["B"] != 0 {
+		t.Fatalf("unexpected transaction stats %+v", stats)
+	}
+	if depths := proxy.QueueDepths(); len(depths) != 9 || depths["client_in"] != 0 || depths["txn_shards"] != 0 {
+		t.Fatalf("unexpected queue depths %v", depths)
+	}
+}
+
+func TestQueuePolicyDropsOrRejectsWhenFull(t *testing.T) {
+	reg := metrics.NewRegistry()
+	clientOut := make(chan *Message, 1)
+	overflow := newQueueOverflow(QueueReject, NewMetrics(reg), clientOut)
+	clientIn := make(chan *Message, 1)
+	ctx := context.Background()
+
+	if !overflow.send(ctx, queueClientIn, clientIn, newInvite()) {
+		t.Fatalf("expected the first request to be queued")
+	}
+	if overflow.send(ctx, queueClientIn, clientIn, newOptions()) {
+		t.Fatalf("expected a request to a full queue to be refused")
+	}
+	select {
+	case resp := <-clientOut:
+		if resp.StatusCode != 503 || resp.GetHeader("Call-ID") != "b84b4c76e66711" || !strings.Contains(resp.GetHeader("To"), ";tag=") {
+			t.Fatalf("unexpected overload response %v", resp)
+		}
+	default:
+		t.Fatalf("expected a 503 for the refused request")
+	}
+	ack := newInvite()
+	ack.Method = "ACK"
+	overflow.send(ctx, queueClientIn, clientIn, ack)
+	if len(clientOut) != 0 {
+		t.Fatalf("expected an ACK to be dropped without an answer")
+	}
+	if drops := overflow.drops(); drops[queueClientIn] != 2 || drops[queueClientOut] != 0 {
+		t.Fatalf("unexpected drop counts %v", drops)
+	}
+
+	var out strings.Builder
+	if err := reg.WriteText(&out); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	for _, want := range []string{
+		`sip_queue_overflows_total{queue="client_in",action="rejected"} 1`,
+		`sip_queue_overflows_total{queue="client_in",action="dropped"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	if policy, err := ParseQueuePolicy("Drop"); err != nil || policy != QueueDrop {
+		t.Fatalf("expected drop policy, got %v, %v", policy, err)
+	}
+	if _, err := ParseQueuePolicy("shed"); err == nil {
+		t.Fatalf("expected an unknown policy to be rejected")
+	}
+}
+
+func TestProxyDropsResponsesForSlowConsumer(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: md5Hex("alice:example.com:secret")})
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)), WithQueueCapacity(1), WithQueuePolicy(QueueDrop))
+	t.Cleanup(proxy.Stop)
+
+	for i := 0; i < 3; i++ {
+		req := newRegisterRequest()
+		req.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKslow"+strconv.Itoa(i))
+		for proxy.QueueDepths()[queueClientIn] != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		proxy.SendFromClient(req)
+	}
+	deadline := time.Now().Add(time.Second)
+	for proxy.QueueDrops()[queueClientOut] < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if drops := proxy.QueueDrops(); drops[queueClientOut] != 2 {
+		t.Fatalf("expected two challenges dropped at the full client queue, got %v", drops)
+	}
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 401 {
+		t.Fatalf("expected the queued challenge to remain, got %v", resp)
+	}
+}
+
+func TestProxyShedsNewInvitesWhenOverloaded(t *testing.T) {
+	reg := metrics.NewRegistry()
+	proxy := NewProxy(WithMetrics(NewMetrics(reg)), WithOverloadControl(OverloadConfig{MaxTransactions: 1, RetryAfter: 1500 * time.Millisecond}))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	if _, ok := proxy.NextToServer(100 * time.Millisecond); !ok {
+		t.Fatalf("expected the first INVITE to be forwarded")
+	}
+
+	second := newInvite()
+	second.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient2")
+	second.SetHeader("Call-ID", "overloaded")
+	proxy.SendFromClient(second)
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 503 || resp.GetHeader("Retry-After") != "2" || resp.GetHeader("Call-ID") != "overloaded" {
+		t.Fatalf("expected 503 with Retry-After for the new call, got %v", resp)
+	}
+	if _, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("a shed INVITE must not be forwarded")
+	}
+
+	proxy.SendFromClient(newOptions())
+	if _, ok := proxy.NextToServer(100 * time.Millisecond); !ok {
+		t.Fatalf("expected requests other than new INVITEs to be served")
+	}
+
+	var out strings.Builder
+	if err := reg.WriteText(&out); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	if want := `sip_overload_rejections_total{reason="transactions"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("metrics output missing %q:\n%s", want, out.String())
+	}
+}
+
+func TestProxyAnswersOptionsAddressedToItself(t *testing.T) {
+	proxy := NewProxy(WithLocalNames("proxy.example.com", "192.0.2.10:5060"))
+	t.Cleanup(proxy.Stop)
+
+	for name, tc := range map[string]struct {
+		uri  string
+		hops string
+		self bool
+	}{
+		"local name":       {"sip:proxy.example.com", "70", true},
+		"local name, port": {"sip:192.0.2.10:5060", "70", true},
+		"other port":       {"sip:192.0.2.10:5070", "70", false},
+		"user at proxy":    {"sip:bob@proxy.example.com", "70", false},
+		"last hop":         {"sip:bob@example.com", "0", true},
+	} {
+		req := newOptions()
+		req.RequestURI = tc.uri
+		req.SetHeader("Max-Forwards", tc.hops)
+		req.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+strings.ReplaceAll(name, " ", ""))
+		proxy.SendFromClient(req)
+		if !tc.self {
+			if _, ok := proxy.NextToServer(100 * time.Millisecond); !ok {
+				t.Fatalf("%s: expected the OPTIONS to be forwarded", name)
+			}
+			continue
+		}
+		resp, ok := proxy.NextToClient(100 * time.Millisecond)
+		if !ok || resp.StatusCode != 200 {
+			t.Fatalf("%s: expected 200 from the proxy, got %v", name, resp)
+		}
+		if resp.GetHeader("Allow") != proxyAllow || resp.GetHeader("Accept") != proxyAccept || !strings.Contains(resp.GetHeader("To"), ";tag=") {
+			t.Fatalf("%s: unexpected capabilities in %v", name, resp.Headers)
+		}
+		if _, ok := proxy.NextToServer(20 * time.Millisecond); ok {
+			t.Fatalf("%s: an OPTIONS answered by the proxy must not be forwarded", name)
+		}
+	}
+}
+
+func TestProxyDrainRefusesNewCallsUntilInFlightConclude(t *testing.T) {
+	reg := metrics.NewRegistry()
+	proxy := NewProxy(WithMetrics(NewMetrics(reg)))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be forwarded")
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 180, "Ringing"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 180 {
+		t.Fatalf("expected 180 downstream, got %v", resp)
+	}
+	if n := proxy.InFlight(); n != 1 {
+		t.Fatalf("expected the ringing INVITE in flight, got %d", n)
+	}
+
+	proxy.Drain()
+	second := newInvite()
+	second.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient2")
+	second.SetHeader("Call-ID", "draining")
+	proxy.SendFromClient(second)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 503 || resp.GetHeader("Call-ID") != "draining" {
+		t.Fatalf("expected 503 for a new call while draining, got %v", resp)
+	}
+	proxy.SendFromClient(newOptions())
+	options, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected requests other than new INVITEs to be served while draining")
+	}
+
+	proxy.SendFromServer(buildResponseFrom(options, 200, "OK"))
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	for i := 0; i < 2; i++ {
+		if _, ok := proxy.NextToClient(100 * time.Millisecond); !ok {
+			t.Fatalf("expected both final responses downstream")
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for proxy.InFlight() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no transactions in flight, got %d", proxy.InFlight())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var out strings.Builder
+	if err := reg.WriteText(&out); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	if want := `sip_overload_rejections_total{reason="draining"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("metrics output missing %q:\n%s", want, out.String())
+	}
+}
+
+func TestProxyRetriesFailedForwardsThroughFailover(t *testing.T) {
+	var tried []string
+	proxy := NewProxy(WithUpstreamFailover(func(req *Message) bool {
+		tried = append(tried, viaBranch(req.GetHeader("Via")))
+		return len(tried) == 1
+	}))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	first, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be forwarded")
+	}
+	proxy.SendFromServer(buildResponseFrom(first, 503, "Service Unavailable"))
+	second, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be retried after a 503")
+	}
+	if viaBranch(second.HeaderValues("Via")[0]) == viaBranch(first.HeaderValues("Via")[0]) || len(second.HeaderValues("Via")) != 2 {
+		t.Fatalf("expected the retry to carry one new proxy Via, got %v", second.HeaderValues("Via"))
+	}
+	if mf := second.GetHeader("Max-Forwards"); mf != "69" {
+		t.Fatalf("expected Max-Forwards to be decremented once, got %s", mf)
+	}
+	if resp, ok := proxy.NextToClient(20 * time.Millisecond); ok && resp.StatusCode >= 200 {
+		t.Fatalf("a retried failure must not reach the client, got %d", resp.StatusCode)
+	}
+
+	proxy.SendFromServer(buildResponseFrom(second, 503, "Service Unavailable"))
+	for {
+		resp, ok := proxy.NextToClient(100 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the 503 downstream once failover declines")
+		}
+		if resp.StatusCode == 503 {
+			break
+		}
+	}
+	if len(tried) != 2 || tried[0] != viaBranch(first.GetHeader("Via")) {
+		t.Fatalf("expected failover to be asked about both attempts, got %v", tried)
+	}
+}
+
+func TestProxyAnswersUpstreamChallengeWithCredentials(t *testing.T) {
+	proxy := NewProxy(WithUpstreamCredentials(func(req, challenge *Message) (string, string, bool) {
+		return "Proxy-Authorization", `Digest username="trunk"`, challenge.StatusCode == 407
+	}))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newInvite())
+	first, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be forwarded")
+	}
+	proxy.SendFromServer(buildResponseFrom(first, 407, "Proxy Authentication Required"))
+	second, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected the INVITE to be sent again with credentials")
+	}
+	if got := second.GetHeader("Proxy-Authorization"); got != `Digest username="trunk"` {
+		t.Fatalf("expected credentials on the retry, got %q", got)
+	}
+	if got := second.GetHeader("CSeq"); got != "314160 INVITE" {
+		t.Fatalf("expected the retry to take the next CSeq, got %q", got)
+	}
+	if viaBranch(second.GetHeader("Via")) == viaBranch(first.GetHeader("Via")) || len(second.HeaderValues("Via")) != 2 {
+		t.Fatalf("expected the retry to carry one new proxy Via, got %v", second.HeaderValues("Via"))
+	}
+
+	ok200 := buildResponseFrom(second, 200, "OK")
+	ok200.SetHeader("To", second.GetHeader("To")+";tag=callee")
+	proxy.SendFromServer(ok200)
+	for {
+		resp, ok := proxy.NextToClient(100 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the 200 downstream")
+		}
+		if resp.StatusCode == 407 {
+			t.Fatalf("an answered challenge must not reach the client")
+		}
+		if resp.StatusCode == 200 {
+			if got := resp.GetHeader("CSeq"); got != "314159 INVITE" {
+				t.Fatalf("expected the client's CSeq to be restored, got %q", got)
+			}
+			break
+		}
+	}
+
+	bye := newInvite()
+	bye.Method = "BYE"
+	bye.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclientbye")
+	bye.SetHeader("To", ok200.GetHeader("To"))
+	bye.SetHeader("CSeq", "314160 BYE")
+	proxy.SendFromClient(bye)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok || forwarded.Method != "BYE" {
+		t.Fatalf("expected the BYE to be forwarded")
+	}
+	if got := forwarded.GetHeader("CSeq"); got != "314161 BYE" {
+		t.Fatalf("expected the BYE to follow the renumbered INVITE, got %q", got)
+	}
+	proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.GetHeader("CSeq") != "314160 BYE" {
+		t.Fatalf("expected the BYE's 200 with the client's CSeq, got %v", resp)
+	}
+}
+
+func TestCallLogKeepsMostRecentCalls(t *testing.T) {
+	calls := NewCallLog(2)
+	for i, callID := range []string{"one", "two", "three"} {
+		req := newInvite()
+		req.SetHeader("Call-ID", callID)
+		calls.begin(callID, req)
+		calls.finish(callID, 486+i)
+	}
+	recent := calls.Recent("Alice", "EXAMPLE.com", 0)
+	if len(recent) != 2 || recent[0].CallID != "three" || recent[1].CallID != "two" {
+		t.Fatalf("expected the two newest calls, got %+v", recent)
+	}
+	if recent[0].Status != 488 || recent[0].Ended.IsZero() {
+		t.Fatalf("expected failed call to be ended, got %+v", recent[0])
+	}
+	if limited := calls.Recent("alice", "example.com", 1); len(limited) != 1 {
+		t.Fatalf("expected limit to apply, got %d", len(limited))
+	}
+	if other := calls.Recent("carol", "example.com", 0); len(other) != 0 {
+		t.Fatalf("expected no calls for carol, got %+v", other)
+	}
+}
+
 func newInvite() *Message {
 	msg := NewRequest("INVITE", "sip:bob@example.com")
 	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1")
@@ -301,3 +771,24 @@ func newOptions() *Message {
 	msg.SetHeader("Content-Length", "0")
 	return msg
 }
+
+func BenchmarkProxyRequestResponseRoundTrip(b *testing.B) {
+	proxy := NewProxy()
+	b.Cleanup(proxy.Stop)
+	options := newOptions()
+	options.Body = "v=0\r\ns=-\r\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		options.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKbench"+strconv.Itoa(i))
+		proxy.SendFromClient(options)
+		forwarded, ok := proxy.NextToServer(time.Second)
+		if !ok {
+			b.Fatalf("expected forwarded request")
+		}
+		proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+		if _, ok := proxy.NextToClient(time.Second); !ok {
+			b.Fatalf("expected response downstream")
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueCapacity is the buffer size of every internal queue unless
+// WithQueueCapacity says otherwise.
+const defaultQueueCapacity = 32
+
+// Names of the queues at the edge of the proxy, where the queue policy
+// applies.
+const (
+	queueClientIn  = "client_in"
+	queueServerIn  = "server_in"
+	queueClientOut = "client_out"
+	queueServerOut = "server_out"
+)
+
+// QueuePolicy decides what happens to a message that reaches one of the
+// proxy's edge queues while it is full: the inbound queues filled by
+// SendFromClient and SendFromServer and the outbound queues drained by
+// NextToClient and NextToServer. The queues between the layers always wait,
+// since dropping there would desynchronise transaction state.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits for room, so a slow consumer pushes back on the
+	// producer. It is the default.
+	QueueBlock QueuePolicy = iota
+	// QueueDrop discards the message. Peers retransmit over UDP, so a
+	// transient overload costs latency rather than calls.
+	QueueDrop
+	// QueueReject answers a client request other than ACK with 503 Service
+	// Unavailable, carrying the OverloadConfig's Retry-After and sent
+	// straight to the client queue if it has room, and discards everything
+	// else like QueueDrop.
+	QueueReject
+)
+
+// ParseQueuePolicy parses "block", "drop", or "reject".
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "block":
+		return QueueBlock, nil
+	case "drop":
+		return QueueDrop, nil
+	case "reject":
+		return QueueReject, nil
+	default:
+		return QueueBlock, fmt.Errorf("sip: unknown queue policy %q", name)
+	}
+}
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueDrop:
+		return "drop"
+	case QueueReject:
+		return "reject"
+	default:
+		return "block"
+	}
+}
+
+// queueOverflow applies the queue policy to the edge queues and counts the
+// messages it discards or rejects.
+type queueOverflow struct {
+	policy     QueuePolicy
+	metrics    *Metrics
+	clientOut  chan<- *Message
+	retryAfter time.Duration
+	dropped    map[string]*atomic.Uint64
+}
+
+func newQueueOverflow(policy QueuePolicy, metrics *Metrics, clientOut chan<- *Message) *queueOverflow {
+	q := &queueOverflow{
+		policy:    policy,
+		metrics:   metrics,
+		clientOut: clientOut,
+		dropped:   make(map[string]*atomic.Uint64),
+	}
+	for _, queue := range []string{queueClientIn, queueServerIn, queueClientOut, queueServerOut} {
+		q.dropped[queue] = new(atomic.Uint64)
+	}
+	return q
+}
+
+// send puts msg on the named queue, waiting for room only under QueueBlock.
+// It reports whether the message was queued; when ctx ends first the
+// message is neither queued nor counted.
+func (q *queueOverflow) send(ctx context.Context, queue string, ch chan<- *Message, msg *Message) bool {
+	if q.policy == QueueBlock {
+		select {
+		case ch <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case ch <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	default:
+	}
+	if q.policy == QueueReject && queue == queueClientIn && msg.IsRequest() && !strings.EqualFold(msg.Method, "ACK") {
+		select {
+		case q.clientOut <- overloadResponse(msg, q.retryAfter):
+			q.count(queue, "rejected")
+			return false
+		default:
+		}
+	}
+	q.count(queue, "dropped")
+	return false
+}
+
+func (q *queueOverflow) count(queue, action string) {
+	q.dropped[queue].Add(1)
+	q.metrics.queueOverflow(queue, action)
+}
+
+// drops reports how many messages each edge queue discarded or rejected.
+func (q *queueOverflow) drops() map[string]uint64 {
+	out := make(map[string]uint64, len(q.dropped))
+	for queue, count := range q.dropped {
+		out[queue] = count.Load()
+	}
+	return out
+}
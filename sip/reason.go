@@ -0,0 +1,15 @@
+package sip
+
+// Reason header values (RFC 3326) the proxy gives the CANCEL and BYE
+// requests it sends on its own, so that the equipment receiving them can log
+// why the call ended.
+const (
+	// reasonCompletedElsewhere tells a broadcast target that another one
+	// answered the call (RFC 3326 section 2).
+	reasonCompletedElsewhere = `SIP;cause=200;text="Call completed elsewhere"`
+	// reasonNoUserResponding and reasonNoAnswer are the Q.850 causes of a
+	// Timer C expiry before and after the callee was alerted, as a
+	// provisional response other than 100 Trying shows.
+	reasonNoUserResponding = `Q.850;cause=18;text="No user responding"`
+	reasonNoAnswer         = `Q.850;cause=19;text="No answer from user (user alerted)"`
+)
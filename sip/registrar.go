@@ -9,50 +9,112 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"xylitol4/sip/userdb"
 )
 
 // RegistrarStore exposes the credential lookup required by the registrar. It is
-// satisfied by user directory backends such as userdb.SQLiteStore.
+// satisfied by user directory backends such as userdb.SQLStore.
 type RegistrarStore interface {
 	Lookup(ctx context.Context, username, domain string) (*userdb.User, error)
 }
 
+// UserSettingsStore is implemented by registrar stores that also keep
+// per-user settings. The registrar and the transaction user consult it for
+// features such as binding limits, do-not-disturb, and call forwarding;
+// stores without it behave as though every user has default settings.
+type UserSettingsStore interface {
+	UserSettings(ctx context.Context, username, domain string) (userdb.UserSettings, error)
+}
+
 // Registrar maintains client bindings registered via SIP REGISTER requests.
 type Registrar struct {
-	store RegistrarStore
+	store    RegistrarStore
+	bindings RegistrationStore
+	source   func(req *Message) string
+	events   *EventBus
+	domains  func(domain string) userdb.Domain
 
 	clock func() time.Time
 	nonce func() string
+}
 
-	mu       sync.RWMutex
-	bindings map[string][]registrationBinding
+// Registration describes an active contact binding stored by the registrar.
+// Source is the transport address the REGISTER arrived from and UserAgent its
+// User-Agent header; either is empty when unknown.
+type Registration struct {
+	Contact   string
+	Expires   time.Time
+	Source    string
+	UserAgent string
 }
 
-type registrationBinding struct {
-	contact string
-	expires time.Time
+// ErrBindingNotFound is returned by Deregister when the user has no active
+// binding for the contact.
+var ErrBindingNotFound = errors.New("registration binding not found")
+
+// nonceLifetime bounds how long a challenge nonce may be reused before the
+// registrar answers with a stale challenge.
+const nonceLifetime = 5 * time.Minute
+
+// RegistrarOption customises a Registrar during construction.
+type RegistrarOption func(*Registrar)
+
+// WithRegistrationStore replaces the default in-memory binding and nonce
+// storage, for example with a RedisRegistrationStore shared by several proxies.
+func WithRegistrationStore(store RegistrationStore) RegistrarOption {
+	return func(r *Registrar) {
+		if store != nil {
+			r.bindings = store
+		}
+	}
 }
 
-// Registration describes an active contact binding stored by the registrar.
-type Registration struct {
-	Contact string
-	Expires time.Time
+// WithSourceLookup reports the transport address each REGISTER arrived from,
+// which the registrar records with the binding for display. Messages carry no
+// source themselves, so the stack supplies it from its transaction routes.
+func WithSourceLookup(lookup func(req *Message) string) RegistrarOption {
+	return func(r *Registrar) {
+		r.source = lookup
+	}
+}
+
+// WithRegistrarEvents publishes binding changes and authentication failures
+// on bus.
+func WithRegistrarEvents(bus *EventBus) RegistrarOption {
+	return func(r *Registrar) {
+		r.events = bus
+	}
+}
+
+// WithDomainSettings looks up the settings of the domain a REGISTER is for,
+// whose AuthPolicy decides whether it is challenged, accepted as it is, or
+// refused, and whose DefaultExpires is granted to contacts asking for no
+// particular lifetime. Looking up an alias returns its domain's settings,
+// whose Name then stands for the alias in addresses of record.
+func WithDomainSettings(lookup func(domain string) userdb.Domain) RegistrarOption {
+	return func(r *Registrar) {
+		r.domains = lookup
+	}
 }
 
 // NewRegistrar constructs a registrar backed by the provided store. A nil
 // store is permitted but causes all REGISTER requests to fail with a 500
 // response.
-func NewRegistrar(store RegistrarStore) *Registrar {
-	return &Registrar{
+func NewRegistrar(store RegistrarStore, opts ...RegistrarOption) *Registrar {
+	r := &Registrar{
 		store:    store,
+		bindings: NewMemoryRegistrationStore(),
 		clock:    time.Now,
 		nonce:    newNonce,
-		bindings: make(map[string][]registrationBinding),
 	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(r)
+		}
+	}
+	return r
 }
 
 func newNonce() string {
@@ -81,43 +143,43 @@ func (r *Registrar) handleRegister(ctx context.Context, req *Message) (*Message,
 		resp := registrarResponse(req, 500, "Server Internal Error")
 		return resp, true
 	}
+	settings := r.domainSettings(domain)
+	if settings.Name != "" {
+		// An alias registers, and is challenged, as its domain.
+		domain = settings.Name
+	}
+	if settings.AuthPolicy == userdb.AuthReject {
+		r.authFailed(req, registrarKey(username, domain), 403, "domain refuses registrations")
+		resp := registrarResponse(req, 403, "Forbidden")
+		ensureToTag(resp)
+		return resp, true
+	}
 
 	user, err := r.store.Lookup(ctx, username, domain)
 	if err != nil {
 		if errors.Is(err, userdb.ErrUserNotFound) {
+			r.authFailed(req, registrarKey(username, domain), 404, "unknown user")
 			resp := registrarResponse(req, 404, "Not Found")
 			return resp, true
 		}
 		resp := registrarResponse(req, 500, "Server Internal Error")
 		return resp, true
 	}
-
-	authParams, ok := parseDigestAuthorization(req.GetHeader("Authorization"))
-	if !ok {
-		resp := registrarResponse(req, 401, "Unauthorized")
-		challenge := fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", algorithm=MD5, qop=\"auth\"", domain, r.nonce())
-		resp.SetHeader("WWW-Authenticate", challenge)
-		ensureToTag(resp)
-		return resp, true
-	}
-
-	realm := authParams["realm"]
-	if realm == "" {
-		realm = domain
-	}
-	if !strings.EqualFold(authParams["username"], user.Username) || !strings.EqualFold(realm, user.Domain) {
+	if user.Disabled {
+		r.authFailed(req, registrarKey(username, domain), 403, "user disabled")
 		resp := registrarResponse(req, 403, "Forbidden")
 		ensureToTag(resp)
 		return resp, true
 	}
 
-	if err := verifyDigest(authParams, req, user, realm); err != nil {
-		resp := registrarResponse(req, 403, "Forbidden")
-		ensureToTag(resp)
-		return resp, true
+	if settings.AuthPolicy != userdb.AuthNone {
+		if resp := r.authenticate(ctx, req, user, username, domain, registrarAuth); resp != nil {
+			return resp, true
+		}
 	}
 
-	bindings, regErr := r.applyRegistration(registrarKey(user.Username, user.Domain), req)
+	maxContacts := r.UserSettings(ctx, user.Username, user.Domain).MaxContacts()
+	bindings, regErr := r.applyRegistration(ctx, registrarKey(user.Username, user.Domain), req, maxContacts, settings.DefaultExpires)
 	if regErr != nil {
 		resp := registrarResponse(req, regErr.status, regErr.reason)
 		ensureToTag(resp)
@@ -129,11 +191,11 @@ func (r *Registrar) handleRegister(ctx context.Context, req *Message) (*Message,
 		now := r.clock()
 		contacts := make([]string, 0, len(bindings))
 		for _, binding := range bindings {
-			remaining := int(binding.expires.Sub(now) / time.Second)
+			remaining := int(binding.Expires.Sub(now) / time.Second)
 			if remaining < 0 {
 				remaining = 0
 			}
-			contacts = append(contacts, withContactExpires(binding.contact, remaining))
+			contacts = append(contacts, withContactExpires(binding.Contact, remaining))
 		}
 		resp.SetHeader("Contact", contacts...)
 	}
@@ -141,6 +203,116 @@ func (r *Registrar) handleRegister(ctx context.Context, req *Message) (*Message,
 	return resp, true
 }
 
+// domainSettings returns the settings of domain, or of the domain it is an
+// alias of, or the defaults when the registrar has no lookup.
+func (r *Registrar) domainSettings(domain string) userdb.Domain {
+	if r.domains == nil {
+		return userdb.Domain{}
+	}
+	return r.domains(strings.ToLower(domain))
+}
+
+// canonicalDomain returns the domain that domain is an alias of, or domain
+// itself.
+func (r *Registrar) canonicalDomain(domain string) string {
+	if name := r.domainSettings(domain).Name; name != "" {
+		return name
+	}
+	return domain
+}
+
+// digestScheme names the status and headers of one side of digest
+// authentication (RFC 3261 section 22): the registrar's own, or a proxy's.
+type digestScheme struct {
+	status      int
+	reason      string
+	challenge   string
+	credentials string
+}
+
+var (
+	registrarAuth = digestScheme{401, "Unauthorized", "WWW-Authenticate", "Authorization"}
+	proxyAuth     = digestScheme{407, "Proxy Authentication Required", "Proxy-Authenticate", "Proxy-Authorization"}
+)
+
+// authenticate checks the digest credentials of req for user in scheme,
+// returning the challenge or refusal to answer with, or nil when they are
+// valid.
+func (r *Registrar) authenticate(ctx context.Context, req *Message, user *userdb.User, username, domain string, scheme digestScheme) *Message {
+	authParams, ok := parseDigestAuthorization(req.GetHeader(scheme.credentials))
+	if !ok {
+		return r.challenge(ctx, req, domain, false, scheme)
+	}
+
+	realm := authParams["realm"]
+	if realm == "" {
+		realm = domain
+	}
+	if !strings.EqualFold(authParams["username"], user.Username) || !strings.EqualFold(realm, user.Domain) {
+		r.authFailed(req, registrarKey(username, domain), 403, "username or realm mismatch")
+		resp := registrarResponse(req, 403, "Forbidden")
+		ensureToTag(resp)
+		return resp
+	}
+
+	if err := verifyDigest(authParams, req, user, realm); err != nil {
+		r.authFailed(req, registrarKey(username, domain), 403, err.Error())
+		resp := registrarResponse(req, 403, "Forbidden")
+		ensureToTag(resp)
+		return resp
+	}
+
+	valid, err := r.bindings.NonceValid(ctx, authParams["nonce"], r.clock())
+	if err != nil {
+		return registrarResponse(req, 500, "Server Internal Error")
+	}
+	if !valid {
+		return r.challenge(ctx, req, domain, true, scheme)
+	}
+	return nil
+}
+
+// authenticateSender checks the proxy credentials of a request sent by one
+// of the registrar's users. It returns the user@domain the sender proved to
+// be, or "" when they are not a user here, together with nil, or else the
+// challenge or refusal to answer with. Their domain's AuthPolicy applies as
+// it does to REGISTER, so a user of a domain that accepts REGISTER as it is
+// is taken at their word. Credentials that were checked are removed, since
+// they are meant for this proxy only.
+func (r *Registrar) authenticateSender(ctx context.Context, req *Message) (string, *Message) {
+	if r.store == nil {
+		return "", nil
+	}
+	username, domain, err := parseAddressOfRecord(req.GetHeader("From"))
+	if err != nil {
+		return "", registrarResponse(req, 400, "Bad Request")
+	}
+	settings := r.domainSettings(domain)
+	if settings.Name != "" {
+		domain = settings.Name
+	}
+	user, err := r.store.Lookup(ctx, username, domain)
+	if errors.Is(err, userdb.ErrUserNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", registrarResponse(req, 500, "Server Internal Error")
+	}
+	if user.Disabled || settings.AuthPolicy == userdb.AuthReject {
+		r.authFailed(req, registrarKey(username, domain), 403, "sender refused")
+		resp := registrarResponse(req, 403, "Forbidden")
+		ensureToTag(resp)
+		return "", resp
+	}
+	if settings.AuthPolicy != userdb.AuthNone {
+		if resp := r.authenticate(ctx, req, user, username, domain, proxyAuth); resp != nil {
+			return "", resp
+		}
+		req.DelHeader(proxyAuth.credentials)
+	}
+	return registrarKey(user.Username, user.Domain), nil
+}
+
 type registrarError struct {
 	status int
 	reason string
@@ -150,37 +322,51 @@ func (e *registrarError) Error() string {
 	return fmt.Sprintf("registrar error %d: %s", e.status, e.reason)
 }
 
-func (r *Registrar) applyRegistration(key string, req *Message) ([]registrationBinding, *registrarError) {
-	now := r.clock()
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	existing := r.bindings[key]
-	filtered := make([]registrationBinding, 0, len(existing))
-	for _, binding := range existing {
-		if binding.expires.After(now) {
-			filtered = append(filtered, binding)
-		}
+// challenge builds scheme's 401 or 407 response carrying a freshly issued
+// nonce. A stale challenge tells the client its credentials were fine but the
+// nonce expired.
+func (r *Registrar) challenge(ctx context.Context, req *Message, domain string, stale bool, scheme digestScheme) *Message {
+	nonce := r.nonce()
+	if err := r.bindings.IssueNonce(ctx, nonce, r.clock().Add(nonceLifetime)); err != nil {
+		return registrarResponse(req, 500, "Server Internal Error")
 	}
+	resp := registrarResponse(req, scheme.status, scheme.reason)
+	challenge := fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\", algorithm=MD5, qop=\"auth\"", domain, nonce)
+	if stale {
+		challenge += ", stale=true"
+	}
+	resp.SetHeader(scheme.challenge, challenge)
+	ensureToTag(resp)
+	return resp
+}
 
-	contacts := expandContactValues(req.HeaderValues("Contact"))
-	defaultExpires := parseExpires(req.GetHeader("Expires"))
+// applyRegistration validates every Contact before touching the binding store
+// so that a malformed request, or one that would exceed maxContacts (when
+// positive), leaves existing registrations unchanged. Contacts asking for no
+// lifetime get lifetime seconds when it is positive, else an hour.
+func (r *Registrar) applyRegistration(ctx context.Context, key string, req *Message, maxContacts, lifetime int) ([]Registration, *registrarError) {
+	now := r.clock()
 
-	if len(contacts) == 0 {
-		r.bindings[key] = filtered
-		return filtered, nil
-	}
+	contacts := req.HeaderList("Contact")
+	defaultExpires := parseExpires(req.GetHeader("Expires"))
 
 	if len(contacts) == 1 && strings.EqualFold(strings.TrimSpace(contacts[0]), "*") {
 		if defaultExpires != 0 {
 			return nil, &registrarError{status: 400, reason: "Invalid wildcard contact"}
 		}
-		delete(r.bindings, key)
+		if err := r.bindings.ClearBindings(ctx, key); err != nil {
+			return nil, &registrarError{status: 500, reason: "Server Internal Error"}
+		}
+		r.events.publish(Event{Kind: EventUnregistered, AOR: key, Contact: "*", Source: r.sourceOf(req)})
 		return nil, nil
 	}
 
-	result := filtered
+	type update struct {
+		address string
+		expires int
+		raw     string
+	}
+	updates := make([]update, 0, len(contacts))
 	for _, raw := range contacts {
 		address := contactAddress(raw)
 		if address == "" {
@@ -190,53 +376,154 @@ func (r *Registrar) applyRegistration(key string, req *Message) ([]registrationB
 		if expires < 0 {
 			expires = defaultExpires
 		}
+		if expires < 0 && lifetime > 0 {
+			expires = lifetime
+		}
 		if expires < 0 {
 			expires = 3600
 		}
-		result = removeBindingByAddress(result, address)
-		if expires == 0 {
-			continue
+		updates = append(updates, update{address: address, expires: expires, raw: raw})
+	}
+
+	if maxContacts > 0 {
+		current, err := r.bindings.Bindings(ctx, key, now)
+		if err != nil {
+			return nil, &registrarError{status: 500, reason: "Server Internal Error"}
+		}
+		active := make(map[string]struct{}, len(current)+len(updates))
+		for _, binding := range current {
+			active[contactKey(binding.Contact)] = struct{}{}
+		}
+		for _, u := range updates {
+			if u.expires == 0 {
+				delete(active, contactKey(u.address))
+			} else {
+				active[contactKey(u.address)] = struct{}{}
+			}
+		}
+		if len(active) > maxContacts {
+			return nil, &registrarError{status: 403, reason: "Too Many Contacts"}
+		}
+	}
+
+	source := r.sourceOf(req)
+	userAgent := strings.TrimSpace(req.GetHeader("User-Agent"))
+	for _, u := range updates {
+		var err error
+		kind := EventRegistered
+		if u.expires == 0 {
+			kind = EventUnregistered
+			err = r.bindings.RemoveBinding(ctx, key, u.address)
+		} else {
+			err = r.bindings.PutBinding(ctx, key, Registration{
+				Contact:   normalizeContact(u.raw, u.expires),
+				Expires:   now.Add(time.Duration(u.expires) * time.Second),
+				Source:    source,
+				UserAgent: userAgent,
+			})
 		}
-		normalized := normalizeContact(raw, expires)
-		binding := registrationBinding{
-			contact: normalized,
-			expires: now.Add(time.Duration(expires) * time.Second),
+		if err != nil {
+			return nil, &registrarError{status: 500, reason: "Server Internal Error"}
 		}
-		result = append(result, binding)
+		r.events.publish(Event{Kind: kind, AOR: key, Contact: u.address, Source: source})
 	}
 
-	r.bindings[key] = result
+	result, err := r.bindings.Bindings(ctx, key, now)
+	if err != nil {
+		return nil, &registrarError{status: 500, reason: "Server Internal Error"}
+	}
 	return result, nil
 }
 
+// UserSettings returns the settings stored for a user. Lookup failures and
+// stores without settings support yield nil, which reports every setting as
+// unset.
+func (r *Registrar) UserSettings(ctx context.Context, username, domain string) userdb.UserSettings {
+	if r == nil {
+		return nil
+	}
+	store, ok := r.store.(UserSettingsStore)
+	if !ok {
+		return nil
+	}
+	settings, err := store.UserSettings(ctx, username, r.canonicalDomain(domain))
+	if err != nil {
+		return nil
+	}
+	return settings
+}
+
 // BindingsFor returns active registrations for the provided username and domain.
 func (r *Registrar) BindingsFor(username, domain string) []Registration {
+	return r.bindingsFor(context.Background(), username, domain)
+}
+
+// bindingsFor is BindingsFor giving up on the binding store when ctx ends.
+func (r *Registrar) bindingsFor(ctx context.Context, username, domain string) []Registration {
 	if r == nil {
 		return nil
 	}
-	key := registrarKey(username, domain)
-	now := r.clock()
+	bindings, err := r.bindings.Bindings(ctx, registrarKey(username, r.canonicalDomain(domain)), r.clock())
+	if err != nil {
+		return nil
+	}
+	return bindings
+}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// AllBindings returns every active registration keyed by address of record
+// ("user@domain", lower-cased).
+func (r *Registrar) AllBindings() map[string][]Registration {
+	if r == nil {
+		return nil
+	}
+	bindings, err := r.bindings.AllBindings(context.Background(), r.clock())
+	if err != nil {
+		return nil
+	}
+	return bindings
+}
 
-	existing := r.bindings[key]
-	filtered := make([]registrationBinding, 0, len(existing))
-	for _, binding := range existing {
-		if binding.expires.After(now) {
-			filtered = append(filtered, binding)
+// Deregister removes a user's binding for contact, as an expires=0 REGISTER
+// would. contact is compared by address, as in Registration.Contact. It
+// returns ErrBindingNotFound when no active binding matches.
+func (r *Registrar) Deregister(ctx context.Context, username, domain, contact string) error {
+	if r == nil {
+		return ErrBindingNotFound
+	}
+	key := registrarKey(username, domain)
+	current, err := r.bindings.Bindings(ctx, key, r.clock())
+	if err != nil {
+		return err
+	}
+	target := contactKey(contact)
+	for _, binding := range current {
+		if contactKey(binding.Contact) == target {
+			if err := r.bindings.RemoveBinding(ctx, key, binding.Contact); err != nil {
+				return err
+			}
+			r.events.publish(Event{Kind: EventUnregistered, AOR: key, Contact: contactAddress(binding.Contact)})
+			return nil
 		}
 	}
-	if len(filtered) == 0 {
-		delete(r.bindings, key)
-		return nil
+	return ErrBindingNotFound
+}
+
+// sourceOf returns the transport address req arrived from, or "" when the
+// registrar has no source lookup.
+func (r *Registrar) sourceOf(req *Message) string {
+	if r.source == nil {
+		return ""
 	}
-	r.bindings[key] = filtered
-	out := make([]Registration, len(filtered))
-	for i, binding := range filtered {
-		out[i] = Registration{Contact: binding.contact, Expires: binding.expires}
+	return r.source(req)
+}
+
+// authFailed publishes the rejection of a REGISTER, or of another request
+// the registrar authenticated, for aor.
+func (r *Registrar) authFailed(req *Message, aor string, status int, reason string) {
+	if r.events == nil {
+		return
 	}
-	return out
+	r.events.publish(Event{Kind: EventAuthFailed, AOR: aor, Source: r.sourceOf(req), Status: status, Reason: reason})
 }
 
 func registrarKey(username, domain string) string {
@@ -268,47 +555,31 @@ func ensureToTag(resp *Message) {
 }
 
 func parseAddressOfRecord(to string) (string, string, error) {
-	to = strings.TrimSpace(to)
-	if to == "" {
+	if strings.TrimSpace(to) == "" {
 		return "", "", fmt.Errorf("registrar: missing To header")
 	}
-	if idx := strings.Index(to, "<"); idx != -1 {
-		if end := strings.Index(to[idx:], ">"); end != -1 {
-			to = to[idx+1 : idx+end]
-		}
-	}
-	if idx := strings.Index(to, ">"); idx != -1 {
-		to = to[:idx]
-	}
-	to = strings.TrimSpace(to)
-	if strings.HasPrefix(strings.ToLower(to), "sip:") {
-		to = to[4:]
-	}
-	if idx := strings.Index(to, ";"); idx != -1 {
-		to = to[:idx]
-	}
-	parts := strings.SplitN(to, "@", 2)
-	if len(parts) != 2 {
-		return "", "", fmt.Errorf("registrar: invalid address of record")
-	}
-	user := strings.TrimSpace(parts[0])
-	domain := strings.TrimSpace(parts[1])
-	if user == "" || domain == "" {
+	uri, err := ParseAddress(to)
+	if err != nil || uri.User == "" {
 		return "", "", fmt.Errorf("registrar: invalid address of record")
 	}
-	return user, domain, nil
+	return uri.User, uri.Host, nil
 }
 
+// parseDigestAuthorization reads the parameters of a Digest credentials or
+// challenge header into a map keyed by lower-cased name. Quoted values are
+// unescaped. A header with an unterminated quoted string or a repeated
+// parameter is refused, so that a crafted header cannot make the verifier
+// and a downstream element read different values.
 func parseDigestAuthorization(header string) (map[string]string, bool) {
 	header = strings.TrimSpace(header)
-	if header == "" {
+	const scheme = "digest "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
 		return nil, false
 	}
-	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+	segments, ok := splitAuthParams(header[len(scheme):])
+	if !ok {
 		return nil, false
 	}
-	params := header[len("Digest "):]
-	segments := splitAuthParams(params)
 	values := make(map[string]string, len(segments))
 	for _, segment := range segments {
 		segment = strings.TrimSpace(segment)
@@ -320,8 +591,16 @@ func parseDigestAuthorization(header string) (map[string]string, bool) {
 			continue
 		}
 		key := strings.ToLower(strings.TrimSpace(kv[0]))
-		value := strings.TrimSpace(kv[1])
-		value = strings.Trim(value, "\"")
+		if key == "" {
+			continue
+		}
+		if _, dup := values[key]; dup {
+			return nil, false
+		}
+		value, ok := unquoteAuthValue(strings.TrimSpace(kv[1]))
+		if !ok {
+			return nil, false
+		}
 		values[key] = value
 	}
 	if len(values) == 0 {
@@ -330,32 +609,58 @@ func parseDigestAuthorization(header string) (map[string]string, bool) {
 	return values, true
 }
 
-func splitAuthParams(input string) []string {
-	var (
-		parts []string
-		buf   strings.Builder
-		inQ   bool
-	)
-	for _, r := range input {
-		switch r {
-		case '"':
+// splitAuthParams splits input at the commas outside quoted strings. It
+// reports false when a quoted string is left open.
+func splitAuthParams(input string) ([]string, bool) {
+	var parts []string
+	inQ, escaped := false, false
+	start := 0
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inQ && c == '\\':
+			escaped = true
+		case c == '"':
 			inQ = !inQ
-			buf.WriteRune(r)
-		case ',':
-			if inQ {
-				buf.WriteRune(r)
-				continue
+		case c == ',' && !inQ:
+			parts = append(parts, input[start:i])
+			start = i + 1
+		}
+	}
+	if inQ {
+		return nil, false
+	}
+	if start < len(input) {
+		parts = append(parts, input[start:])
+	}
+	return parts, true
+}
+
+// unquoteAuthValue returns an auth-param value with its quotes removed and
+// quoted-pairs resolved. A token value is returned as is.
+func unquoteAuthValue(value string) (string, bool) {
+	if !strings.HasPrefix(value, "\"") {
+		return value, !strings.Contains(value, "\"")
+	}
+	var b strings.Builder
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch c {
+		case '\\':
+			if i+1 >= len(value) {
+				return "", false
 			}
-			parts = append(parts, buf.String())
-			buf.Reset()
+			i++
+			b.WriteByte(value[i])
+		case '"':
+			return b.String(), i == len(value)-1
 		default:
-			buf.WriteRune(r)
+			b.WriteByte(c)
 		}
 	}
-	if buf.Len() > 0 {
-		parts = append(parts, buf.String())
-	}
-	return parts
+	return "", false
 }
 
 func verifyDigest(params map[string]string, req *Message, user *userdb.User, realm string) error {
@@ -415,59 +720,6 @@ func isHex(value string) bool {
 	return true
 }
 
-func expandContactValues(values []string) []string {
-	var contacts []string
-	for _, value := range values {
-		parts := splitContactList(value)
-		for _, part := range parts {
-			trimmed := strings.TrimSpace(part)
-			if trimmed != "" {
-				contacts = append(contacts, trimmed)
-			}
-		}
-	}
-	return contacts
-}
-
-func splitContactList(value string) []string {
-	var (
-		parts []string
-		buf   strings.Builder
-		inQ   bool
-		depth int
-	)
-	for _, r := range value {
-		switch r {
-		case '"':
-			inQ = !inQ
-			buf.WriteRune(r)
-		case '<':
-			if !inQ {
-				depth++
-			}
-			buf.WriteRune(r)
-		case '>':
-			if !inQ && depth > 0 {
-				depth--
-			}
-			buf.WriteRune(r)
-		case ',':
-			if inQ || depth > 0 {
-				buf.WriteRune(r)
-				continue
-			}
-			parts = append(parts, buf.String())
-			buf.Reset()
-		default:
-			buf.WriteRune(r)
-		}
-	}
-	if buf.Len() > 0 {
-		parts = append(parts, buf.String())
-	}
-	return parts
-}
-
 func contactAddress(value string) string {
 	value = strings.TrimSpace(value)
 	if value == "" {
@@ -481,21 +733,6 @@ func contactKey(value string) string {
 	return strings.ToLower(contactAddress(value))
 }
 
-func removeBindingByAddress(bindings []registrationBinding, address string) []registrationBinding {
-	key := contactKey(address)
-	if key == "" {
-		return bindings
-	}
-	filtered := make([]registrationBinding, 0, len(bindings))
-	for _, binding := range bindings {
-		if contactKey(binding.contact) == key {
-			continue
-		}
-		filtered = append(filtered, binding)
-	}
-	return filtered
-}
-
 func normalizeContact(value string, expires int) string {
 	value = strings.TrimSpace(value)
 	if value == "" {
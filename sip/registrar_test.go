@@ -11,11 +11,12 @@ import (
 )
 
 type memoryRegistrarStore struct {
-	users map[string]*userdb.User
+	users    map[string]*userdb.User
+	settings map[string]userdb.UserSettings
 }
 
 func newMemoryStore() *memoryRegistrarStore {
-	return &memoryRegistrarStore{users: make(map[string]*userdb.User)}
+	return &memoryRegistrarStore{users: make(map[string]*userdb.User), settings: make(map[string]userdb.UserSettings)}
 }
 
 func (m *memoryRegistrarStore) add(user *userdb.User) {
@@ -36,6 +37,10 @@ func (m *memoryRegistrarStore) Lookup(ctx context.Context, username, domain stri
 	return &clone, nil
 }
 
+func (m *memoryRegistrarStore) UserSettings(ctx context.Context, username, domain string) (userdb.UserSettings, error) {
+	return m.settings[registrarKey(username, domain)], nil
+}
+
 func TestRegistrarChallengesWithoutAuth(t *testing.T) {
 	store := newMemoryStore()
 	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: md5Hex("alice:example.com:secret")})
@@ -71,6 +76,16 @@ func TestRegistrarRejectsUnknownUser(t *testing.T) {
 	}
 }
 
+func TestRegistrarRejectsDisabledUser(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: "secret", Disabled: true})
+	registrar := NewRegistrar(store)
+	resp, _ := registrar.handleRegister(context.Background(), newRegisterRequest())
+	if resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for disabled user, got %d", resp.StatusCode)
+	}
+}
+
 func TestRegistrarAcceptsValidDigest(t *testing.T) {
 	password := "supersecret"
 	realm := "example.com"
@@ -112,6 +127,179 @@ func TestRegistrarAcceptsValidDigest(t *testing.T) {
 	}
 }
 
+func TestRegistrarAppliesDomainSettings(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: md5Hex("alice:example.com:secret")})
+	store.add(&userdb.User{Username: "bob", Domain: "suspended.example", PasswordHash: md5Hex("bob:suspended.example:secret")})
+	domains := map[string]userdb.Domain{
+		"example.com":       {Name: "example.com", AuthPolicy: userdb.AuthNone, DefaultExpires: 120},
+		"suspended.example": {Name: "suspended.example", AuthPolicy: userdb.AuthReject},
+	}
+	registrar := NewRegistrar(store, WithDomainSettings(func(domain string) userdb.Domain { return domains[domain] }))
+	now := time.Unix(1_700_000_000, 0)
+	registrar.clock = func() time.Time { return now }
+
+	req := newRegisterRequest()
+	req.SetHeader("Contact", "<sip:alice@client.example.com>")
+	resp, _ := registrar.handleRegister(context.Background(), req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected REGISTER without credentials to be accepted, got %d", resp.StatusCode)
+	}
+	bindings := registrar.BindingsFor("alice", "example.com")
+	if len(bindings) != 1 || !bindings[0].Expires.Equal(now.Add(120*time.Second)) {
+		t.Fatalf("expected one binding with the domain's default expiry, got %+v", bindings)
+	}
+
+	suspended := newRegisterRequest()
+	suspended.RequestURI = "sip:suspended.example"
+	suspended.SetHeader("To", "<sip:bob@suspended.example>")
+	suspended.SetHeader("From", "<sip:bob@suspended.example>;tag=1")
+	resp, _ = registrar.handleRegister(context.Background(), suspended)
+	if resp.StatusCode != 403 {
+		t.Fatalf("expected the suspended domain to refuse REGISTER, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegistrarRegistersAliasesAsTheirDomain(t *testing.T) {
+	ha1 := md5Hex("alice:example.com:secret")
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: ha1})
+	domain := userdb.Domain{Name: "example.com", Aliases: []string{"sip.example.com"}}
+	registrar := NewRegistrar(store, WithDomainSettings(func(name string) userdb.Domain {
+		if name == domain.Name || name == domain.Aliases[0] {
+			return domain
+		}
+		return userdb.Domain{}
+	}))
+
+	req := newRegisterRequest()
+	req.RequestURI = "sip:sip.example.com"
+	req.SetHeader("To", "<sip:alice@SIP.example.com>")
+	resp, _ := registrar.handleRegister(context.Background(), req)
+	if challenge := resp.GetHeader("WWW-Authenticate"); resp.StatusCode != 401 || !strings.Contains(challenge, `realm="example.com"`) {
+		t.Fatalf("expected a challenge in the domain's realm, got %d %q", resp.StatusCode, challenge)
+	}
+	nonce := extractNonce(t, resp)
+
+	authReq := newRegisterRequest()
+	authReq.RequestURI = "sip:sip.example.com"
+	authReq.SetHeader("To", "<sip:alice@SIP.example.com>")
+	authReq.SetHeader("Authorization", buildAuthorization("alice", "example.com", ha1, nonce, 1, "cnonce-value", authReq.Method, authReq.RequestURI))
+	resp, _ = registrar.handleRegister(context.Background(), authReq)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200 OK, got %d", resp.StatusCode)
+	}
+	if len(registrar.BindingsFor("alice", "example.com")) != 1 || len(registrar.BindingsFor("alice", "sip.example.com")) != 1 {
+		t.Fatalf("expected one binding found under both the domain and its alias")
+	}
+}
+
+func TestRegistrarEnforcesMaxContacts(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+	store.settings[registrarKey("alice", realm)] = userdb.UserSettings{userdb.SettingMaxContacts: "1"}
+	registrar := NewRegistrar(store)
+
+	resp, _ := registrar.handleRegister(context.Background(), newRegisterRequest())
+	nonce := extractNonce(t, resp)
+	register := func(nc int, contact string) *Message {
+		req := newRegisterRequest()
+		req.SetHeader("Contact", contact)
+		req.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, nc, "cnonce", req.Method, req.RequestURI))
+		resp, _ := registrar.handleRegister(context.Background(), req)
+		return resp
+	}
+
+	if resp := register(1, "<sip:alice@desk.example.com>;expires=600"); resp.StatusCode != 200 {
+		t.Fatalf("expected first contact to register, got %d", resp.StatusCode)
+	}
+	if resp := register(2, "<sip:alice@desk.example.com>;expires=300"); resp.StatusCode != 200 {
+		t.Fatalf("expected refresh of an existing contact to succeed, got %d", resp.StatusCode)
+	}
+	if resp := register(3, "<sip:alice@mobile.example.com>;expires=600"); resp.StatusCode != 403 {
+		t.Fatalf("expected second contact to be rejected, got %d", resp.StatusCode)
+	}
+	if bindings := registrar.BindingsFor("alice", realm); len(bindings) != 1 || !strings.Contains(bindings[0].Contact, "desk") {
+		t.Fatalf("expected rejected request to leave bindings unchanged, got %v", bindings)
+	}
+	swap := "<sip:alice@desk.example.com>;expires=0, <sip:alice@mobile.example.com>;expires=600"
+	if resp := register(4, swap); resp.StatusCode != 200 {
+		t.Fatalf("expected contact swap within the limit to succeed, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegistrarRecordsSourceAndForcedDeregistration(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+	registrar := NewRegistrar(store, WithSourceLookup(func(req *Message) string { return "192.0.2.7:5062" }))
+
+	resp, _ := registrar.handleRegister(context.Background(), newRegisterRequest())
+	nonce := extractNonce(t, resp)
+	req := newRegisterRequest()
+	req.SetHeader("Contact", "<sip:alice@desk.example.com>;expires=600, <sip:alice@mobile.example.com>;expires=600")
+	req.SetHeader("User-Agent", "DeskPhone/1.2")
+	req.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, 1, "cnonce", req.Method, req.RequestURI))
+	if resp, _ := registrar.handleRegister(context.Background(), req); resp.StatusCode != 200 {
+		t.Fatalf("expected registration to succeed, got %d", resp.StatusCode)
+	}
+
+	all := registrar.AllBindings()
+	bindings := all["alice@example.com"]
+	if len(all) != 1 || len(bindings) != 2 {
+		t.Fatalf("expected two bindings for alice, got %v", all)
+	}
+	for _, binding := range bindings {
+		if binding.Source != "192.0.2.7:5062" || binding.UserAgent != "DeskPhone/1.2" {
+			t.Fatalf("expected source and user agent to be recorded, got %+v", binding)
+		}
+	}
+
+	if err := registrar.Deregister(context.Background(), "Alice", realm, "<sip:alice@desk.example.com>"); err != nil {
+		t.Fatalf("Deregister returned error: %v", err)
+	}
+	if bindings := registrar.BindingsFor("alice", realm); len(bindings) != 1 || !strings.Contains(bindings[0].Contact, "mobile") {
+		t.Fatalf("expected only the mobile binding to remain, got %v", bindings)
+	}
+	if err := registrar.Deregister(context.Background(), "alice", realm, "<sip:alice@desk.example.com>"); err != ErrBindingNotFound {
+		t.Fatalf("expected ErrBindingNotFound for a removed binding, got %v", err)
+	}
+}
+
+func TestRegistrarIssuesStaleChallengeForUnknownNonce(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+	registrar := NewRegistrar(store)
+	now := time.Unix(1_700_000_000, 0)
+	registrar.clock = func() time.Time { return now }
+
+	req := newRegisterRequest()
+	req.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, "forged-nonce", 1, "cnonce", req.Method, req.RequestURI))
+	resp, _ := registrar.handleRegister(context.Background(), req)
+	if resp.StatusCode != 401 {
+		t.Fatalf("expected 401 for unknown nonce, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(resp.GetHeader("WWW-Authenticate"), "stale=true") {
+		t.Fatalf("expected stale challenge, got %q", resp.GetHeader("WWW-Authenticate"))
+	}
+
+	nonce := extractNonce(t, resp)
+	now = now.Add(nonceLifetime + time.Second)
+	expired := newRegisterRequest()
+	expired.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, 1, "cnonce", expired.Method, expired.RequestURI))
+	if resp, _ := registrar.handleRegister(context.Background(), expired); resp.StatusCode != 401 {
+		t.Fatalf("expected expired nonce to be challenged again, got %d", resp.StatusCode)
+	}
+	if len(registrar.BindingsFor("alice", realm)) != 0 {
+		t.Fatalf("stale nonce must not create bindings")
+	}
+}
+
 func TestRegistrarRejectsInvalidDigest(t *testing.T) {
 	realm := "example.com"
 	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
@@ -182,6 +370,28 @@ func TestRegistrarDeregistersWildcard(t *testing.T) {
 	}
 }
 
+func TestParseDigestAuthorizationQuoting(t *testing.T) {
+	params, ok := parseDigestAuthorization(`Digest username="al\"ice", realm="a,b", qop=auth, nc=00000001`)
+	if !ok {
+		t.Fatalf("expected header to parse")
+	}
+	if params["username"] != `al"ice` || params["realm"] != "a,b" || params["qop"] != "auth" || params["nc"] != "00000001" {
+		t.Fatalf("unexpected parameters: %v", params)
+	}
+	for _, header := range []string{
+		`Digest username="alice`,
+		`Digest username="alice", username="bob"`,
+		`Digest username="alice"x`,
+		`Digest username=al"ice`,
+		`Basic dXNlcjpwYXNz`,
+		`Digest`,
+	} {
+		if params, ok := parseDigestAuthorization(header); ok {
+			t.Fatalf("expected %q to be refused, got %v", header, params)
+		}
+	}
+}
+
 func TestProxyHandlesRegisterLocally(t *testing.T) {
 	realm := "example.com"
 	password := "secret"
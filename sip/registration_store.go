@@ -0,0 +1,163 @@
+package sip
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegistrationStore persists registrar bindings and the nonces issued in
+// Digest challenges. The default in-memory implementation serves a single
+// proxy; shared implementations such as RedisRegistrationStore let several
+// instances behind a load balancer observe the same state.
+//
+// Bindings are keyed by the normalised address of record and, within an AOR,
+// by contact address so that re-registering a contact replaces its entry.
+type RegistrationStore interface {
+	// Bindings returns the bindings for aor that are still active at now.
+	Bindings(ctx context.Context, aor string, now time.Time) ([]Registration, error)
+	// AllBindings returns the bindings still active at now for every aor.
+	AllBindings(ctx context.Context, now time.Time) (map[string][]Registration, error)
+	// PutBinding inserts or replaces the binding for the contact's address.
+	PutBinding(ctx context.Context, aor string, binding Registration) error
+	// RemoveBinding drops the binding whose contact address matches contact.
+	RemoveBinding(ctx context.Context, aor, contact string) error
+	// ClearBindings drops every binding for aor.
+	ClearBindings(ctx context.Context, aor string) error
+	// IssueNonce records a challenge nonce that stays valid until expires.
+	IssueNonce(ctx context.Context, nonce string, expires time.Time) error
+	// NonceValid reports whether nonce was issued and has not yet expired.
+	NonceValid(ctx context.Context, nonce string, now time.Time) (bool, error)
+}
+
+type memoryRegistrationStore struct {
+	mu       sync.Mutex
+	bindings map[string][]Registration
+	nonces   map[string]time.Time
+}
+
+// NewMemoryRegistrationStore returns a process-local RegistrationStore.
+func NewMemoryRegistrationStore() RegistrationStore {
+	return &memoryRegistrationStore{
+		bindings: make(map[string][]Registration),
+		nonces:   make(map[string]time.Time),
+	}
+}
+
+func (m *memoryRegistrationStore) Bindings(ctx context.Context, aor string, now time.Time) ([]Registration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing := m.bindings[aor]
+	filtered := make([]Registration, 0, len(existing))
+	for _, binding := range existing {
+		if binding.Expires.After(now) {
+			filtered = append(filtered, binding)
+		}
+	}
+	if len(filtered) == 0 {
+		delete(m.bindings, aor)
+		return nil, nil
+	}
+	m.bindings[aor] = filtered
+	return append([]Registration(nil), filtered...), nil
+}
+
+func (m *memoryRegistrationStore) AllBindings(ctx context.Context, now time.Time) (map[string][]Registration, error) {
+	m.mu.Lock()
+	aors := make([]string, 0, len(m.bindings))
+	for aor := range m.bindings {
+		aors = append(aors, aor)
+	}
+	m.mu.Unlock()
+	all := make(map[string][]Registration, len(aors))
+	for _, aor := range aors {
+		bindings, err := m.Bindings(ctx, aor, now)
+		if err != nil {
+			return nil, err
+		}
+		if len(bindings) > 0 {
+			all[aor] = bindings
+		}
+	}
+	return all, nil
+}
+
+func (m *memoryRegistrationStore) PutBinding(ctx context.Context, aor string, binding Registration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bindings[aor] = append(removeRegistration(m.bindings[aor], binding.Contact), binding)
+	return nil
+}
+
+func (m *memoryRegistrationStore) RemoveBinding(ctx context.Context, aor, contact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	remaining := removeRegistration(m.bindings[aor], contact)
+	if len(remaining) == 0 {
+		delete(m.bindings, aor)
+		return nil
+	}
+	m.bindings[aor] = remaining
+	return nil
+}
+
+func (m *memoryRegistrationStore) ClearBindings(ctx context.Context, aor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bindings, aor)
+	return nil
+}
+
+func (m *memoryRegistrationStore) IssueNonce(ctx context.Context, nonce string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	issued := expires.Add(-nonceLifetime)
+	for existing, deadline := range m.nonces {
+		if !deadline.After(issued) {
+			delete(m.nonces, existing)
+		}
+	}
+	m.nonces[nonce] = expires
+	return nil
+}
+
+func (m *memoryRegistrationStore) NonceValid(ctx context.Context, nonce string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadline, ok := m.nonces[nonce]
+	if !ok {
+		return false, nil
+	}
+	if !deadline.After(now) {
+		delete(m.nonces, nonce)
+		return false, nil
+	}
+	return true, nil
+}
+
+func removeRegistration(bindings []Registration, contact string) []Registration {
+	key := contactKey(contact)
+	if key == "" {
+		return bindings
+	}
+	filtered := make([]Registration, 0, len(bindings))
+	for _, binding := range bindings {
+		if contactKey(binding.Contact) == key {
+			continue
+		}
+		filtered = append(filtered, binding)
+	}
+	return filtered
+}
+
+// sortRegistrations orders bindings by expiry and then contact so that stores
+// without an inherent ordering return stable results.
+func sortRegistrations(bindings []Registration) {
+	sort.Slice(bindings, func(i, j int) bool {
+		if !bindings[i].Expires.Equal(bindings[j].Expires) {
+			return bindings[i].Expires.Before(bindings[j].Expires)
+		}
+		return bindings[i].Contact < bindings[j].Contact
+	})
+}
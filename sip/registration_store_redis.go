@@ -0,0 +1,258 @@
+package sip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"xylitol4/internal/redis"
+)
+
+// RedisRegistrationStore keeps registrar bindings and challenge nonces in
+// Redis so that several proxy instances behind a load balancer share one
+// binding set and accept each other's nonces.
+//
+// Each AOR maps to a hash whose fields are contact addresses and whose values
+// hold a JSON-encoded redisBinding; values written by older versions as
+// "<expiry-unix-ns> <contact>" are still read. The hash itself expires with its
+// longest-lived binding, which relies on the NX/GT flags of PEXPIREAT
+// (Redis 7.0 or newer). Nonces are plain keys with an absolute expiry.
+type RedisRegistrationStore struct {
+	client *redis.Client
+	prefix string
+}
+
+var _ RegistrationStore = (*RedisRegistrationStore)(nil)
+
+// DefaultRedisKeyPrefix namespaces the keys written by RedisRegistrationStore.
+const DefaultRedisKeyPrefix = "xylitol4:"
+
+// OpenRedisRegistrationStore connects to the Redis server described by
+// rawURL (redis://[user:password@]host:port[/db] or host:port).
+func OpenRedisRegistrationStore(rawURL string) (*RedisRegistrationStore, error) {
+	cfg, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("sip: registration store: %w", err)
+	}
+	client, err := redis.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("sip: registration store: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("sip: registration store: %w", err)
+	}
+	return NewRedisRegistrationStore(client, DefaultRedisKeyPrefix), nil
+}
+
+// NewRedisRegistrationStore wraps an existing client. Keys are prefixed with
+// prefix so several deployments can share one Redis database.
+func NewRedisRegistrationStore(client *redis.Client, prefix string) *RedisRegistrationStore {
+	return &RedisRegistrationStore{client: client, prefix: prefix}
+}
+
+// Close releases the underlying connections.
+func (s *RedisRegistrationStore) Close() error {
+	if s == nil || s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+func (s *RedisRegistrationStore) bindingKey(aor string) string {
+	return s.prefix + "reg:" + aor
+}
+
+func (s *RedisRegistrationStore) nonceKey(nonce string) string {
+	return s.prefix + "nonce:" + nonce
+}
+
+// Bindings returns the active bindings for aor, pruning expired fields.
+func (s *RedisRegistrationStore) Bindings(ctx context.Context, aor string, now time.Time) ([]Registration, error) {
+	key := s.bindingKey(aor)
+	reply, err := s.client.Do(ctx, "HGETALL", key)
+	if err != nil {
+		return nil, fmt.Errorf("sip: load bindings for %s: %w", aor, err)
+	}
+	fields, err := redis.Strings(reply)
+	if err != nil {
+		return nil, fmt.Errorf("sip: load bindings for %s: %w", aor, err)
+	}
+	var (
+		bindings []Registration
+		expired  []string
+	)
+	for i := 0; i+1 < len(fields); i += 2 {
+		binding, ok := decodeRedisBinding(fields[i+1])
+		if !ok || !binding.Expires.After(now) {
+			expired = append(expired, fields[i])
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	if len(expired) > 0 {
+		args := append([]string{"HDEL", key}, expired...)
+		if _, err := s.client.Do(ctx, args...); err != nil {
+			return nil, fmt.Errorf("sip: prune bindings for %s: %w", aor, err)
+		}
+	}
+	sortRegistrations(bindings)
+	return bindings, nil
+}
+
+// AllBindings walks every binding hash under the prefix with SCAN and returns
+// the active bindings of each.
+func (s *RedisRegistrationStore) AllBindings(ctx context.Context, now time.Time) (map[string][]Registration, error) {
+	pattern := s.bindingKey("*")
+	all := make(map[string][]Registration)
+	cursor := "0"
+	for {
+		reply, err := s.client.Do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, fmt.Errorf("sip: scan bindings: %w", err)
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("sip: scan bindings: unexpected reply %T", reply)
+		}
+		next, ok := page[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("sip: scan bindings: unexpected cursor %T", page[0])
+		}
+		keys, err := redis.Strings(page[1])
+		if err != nil {
+			return nil, fmt.Errorf("sip: scan bindings: %w", err)
+		}
+		for _, key := range keys {
+			aor := strings.TrimPrefix(key, s.bindingKey(""))
+			bindings, err := s.Bindings(ctx, aor, now)
+			if err != nil {
+				return nil, err
+			}
+			if len(bindings) > 0 {
+				all[aor] = bindings
+			}
+		}
+		if next == "0" {
+			return all, nil
+		}
+		cursor = next
+	}
+}
+
+// PutBinding stores binding under its contact address and extends the hash
+// expiry when the new binding outlives the current one.
+func (s *RedisRegistrationStore) PutBinding(ctx context.Context, aor string, binding Registration) error {
+	key := s.bindingKey(aor)
+	field := contactKey(binding.Contact)
+	if field == "" {
+		return fmt.Errorf("sip: binding for %s has no contact", aor)
+	}
+	value, err := encodeRedisBinding(binding)
+	if err != nil {
+		return fmt.Errorf("sip: encode binding for %s: %w", aor, err)
+	}
+	if _, err := s.client.Do(ctx, "HSET", key, field, value); err != nil {
+		return fmt.Errorf("sip: store binding for %s: %w", aor, err)
+	}
+	at := strconv.FormatInt(binding.Expires.UnixMilli(), 10)
+	for _, flag := range []string{"NX", "GT"} {
+		if _, err := s.client.Do(ctx, "PEXPIREAT", key, at, flag); err != nil {
+			return fmt.Errorf("sip: set binding expiry for %s: %w", aor, err)
+		}
+	}
+	return nil
+}
+
+// RemoveBinding deletes the binding registered for contact's address.
+func (s *RedisRegistrationStore) RemoveBinding(ctx context.Context, aor, contact string) error {
+	field := contactKey(contact)
+	if field == "" {
+		return nil
+	}
+	if _, err := s.client.Do(ctx, "HDEL", s.bindingKey(aor), field); err != nil {
+		return fmt.Errorf("sip: remove binding for %s: %w", aor, err)
+	}
+	return nil
+}
+
+// ClearBindings deletes every binding for aor.
+func (s *RedisRegistrationStore) ClearBindings(ctx context.Context, aor string) error {
+	if _, err := s.client.Do(ctx, "DEL", s.bindingKey(aor)); err != nil {
+		return fmt.Errorf("sip: clear bindings for %s: %w", aor, err)
+	}
+	return nil
+}
+
+// IssueNonce records nonce until expires.
+func (s *RedisRegistrationStore) IssueNonce(ctx context.Context, nonce string, expires time.Time) error {
+	at := strconv.FormatInt(expires.UnixMilli(), 10)
+	if _, err := s.client.Do(ctx, "SET", s.nonceKey(nonce), "1", "PXAT", at); err != nil {
+		return fmt.Errorf("sip: store nonce: %w", err)
+	}
+	return nil
+}
+
+// NonceValid reports whether nonce is still present. Redis enforces the
+// expiry, so now is not consulted.
+func (s *RedisRegistrationStore) NonceValid(ctx context.Context, nonce string, now time.Time) (bool, error) {
+	if nonce == "" {
+		return false, nil
+	}
+	reply, err := s.client.Do(ctx, "EXISTS", s.nonceKey(nonce))
+	if err != nil {
+		return false, fmt.Errorf("sip: check nonce: %w", err)
+	}
+	count, err := redis.Int(reply)
+	if err != nil {
+		return false, fmt.Errorf("sip: check nonce: %w", err)
+	}
+	return count > 0, nil
+}
+
+// redisBinding is the stored form of a Registration.
+type redisBinding struct {
+	Expires   int64  `json:"expires"`
+	Contact   string `json:"contact"`
+	Source    string `json:"source,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+func encodeRedisBinding(binding Registration) (string, error) {
+	raw, err := json.Marshal(redisBinding{
+		Expires:   binding.Expires.UnixNano(),
+		Contact:   binding.Contact,
+		Source:    binding.Source,
+		UserAgent: binding.UserAgent,
+	})
+	return string(raw), err
+}
+
+func decodeRedisBinding(value string) (Registration, bool) {
+	if strings.HasPrefix(value, "{") {
+		var stored redisBinding
+		if err := json.Unmarshal([]byte(value), &stored); err != nil || stored.Contact == "" {
+			return Registration{}, false
+		}
+		return Registration{
+			Contact:   stored.Contact,
+			Expires:   time.Unix(0, stored.Expires),
+			Source:    stored.Source,
+			UserAgent: stored.UserAgent,
+		}, true
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return Registration{}, false
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Registration{}, false
+	}
+	return Registration{Contact: parts[1], Expires: time.Unix(0, ns)}, true
+}
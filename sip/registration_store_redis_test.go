@@ -0,0 +1,256 @@
+package sip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"xylitol4/internal/redis"
+	"xylitol4/sip/userdb"
+)
+
+// fakeRedis implements the handful of commands used by RedisRegistrationStore.
+// Expiry is ignored; the store filters expired bindings itself.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+}
+
+func startFakeRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &fakeRedis{strings: make(map[string]string), hashes: make(map[string]map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(f.exec(args)))
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		f.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EXISTS":
+		if _, ok := f.strings[args[1]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "HSET":
+		hash := f.hashes[args[1]]
+		if hash == nil {
+			hash = make(map[string]string)
+			f.hashes[args[1]] = hash
+		}
+		hash[args[2]] = args[3]
+		return ":1\r\n"
+	case "HDEL":
+		for _, field := range args[2:] {
+			delete(f.hashes[args[1]], field)
+		}
+		return ":1\r\n"
+	case "HGETALL":
+		hash := f.hashes[args[1]]
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(hash)*2)
+		for k, v := range hash {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+		}
+		return b.String()
+	case "DEL":
+		delete(f.hashes, args[1])
+		delete(f.strings, args[1])
+		return ":1\r\n"
+	case "PEXPIREAT":
+		return ":1\r\n"
+	case "SCAN":
+		// Every matching key in one page; args are cursor MATCH pattern COUNT n.
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range f.hashes {
+			if strings.HasPrefix(key, prefix) && len(f.hashes[key]) > 0 {
+				keys = append(keys, key)
+			}
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(key), key)
+		}
+		return b.String()
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func newRedisRegistrar(t *testing.T, addr string, store RegistrarStore) *Registrar {
+	t.Helper()
+	client, err := redis.NewClient(redis.Config{Addr: addr})
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return NewRegistrar(store, WithRegistrationStore(NewRedisRegistrationStore(client, "test:")))
+}
+
+func TestRedisRegistrationStoreSharedAcrossRegistrars(t *testing.T) {
+	realm := "example.com"
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", "alice", realm, "secret"))
+	users := newMemoryStore()
+	users.add(&userdb.User{Username: "alice", Domain: realm, PasswordHash: ha1})
+
+	addr := startFakeRedis(t)
+	first := newRedisRegistrar(t, addr, users)
+	second := newRedisRegistrar(t, addr, users)
+
+	ctx := t.Context()
+	challenge, _ := first.handleRegister(ctx, newRegisterRequest())
+	if challenge.StatusCode != 401 {
+		t.Fatalf("expected 401 challenge, got %d", challenge.StatusCode)
+	}
+	nonce := extractNonce(t, challenge)
+
+	req := newRegisterRequest()
+	req.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, 1, "cnonce", req.Method, req.RequestURI))
+	resp, _ := second.handleRegister(ctx, req)
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected nonce issued by another instance to be accepted, got %d", resp.StatusCode)
+	}
+
+	bindings := first.BindingsFor("alice", realm)
+	if len(bindings) != 1 {
+		t.Fatalf("expected binding to be visible from the first registrar, got %v", bindings)
+	}
+	if !strings.Contains(bindings[0].Contact, "<sip:alice@client.example.com>") {
+		t.Fatalf("unexpected shared contact %q", bindings[0].Contact)
+	}
+	if remaining := time.Until(bindings[0].Expires); remaining <= 0 || remaining > 600*time.Second {
+		t.Fatalf("unexpected binding expiry in %v", remaining)
+	}
+
+	dereg := newRegisterRequest()
+	dereg.SetHeader("Contact", "*")
+	dereg.SetHeader("Expires", "0")
+	dereg.SetHeader("Authorization", buildAuthorization("alice", realm, ha1, nonce, 2, "cnonce", dereg.Method, dereg.RequestURI))
+	if resp, _ := first.handleRegister(ctx, dereg); resp.StatusCode != 200 {
+		t.Fatalf("expected wildcard deregistration to succeed, got %d", resp.StatusCode)
+	}
+	if bindings := second.BindingsFor("alice", realm); len(bindings) != 0 {
+		t.Fatalf("expected bindings to be cleared for every instance, got %v", bindings)
+	}
+}
+
+func TestRedisRegistrationStoreListsAllBindings(t *testing.T) {
+	addr := startFakeRedis(t)
+	client, err := redis.NewClient(redis.Config{Addr: addr})
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	store := NewRedisRegistrationStore(client, "test:")
+
+	ctx := t.Context()
+	now := time.Unix(1_700_000_000, 0)
+	binding := Registration{
+		Contact:   "<sip:alice@desk.example.com>;expires=600",
+		Expires:   now.Add(10 * time.Minute),
+		Source:    "192.0.2.7:5062",
+		UserAgent: "DeskPhone/1.2",
+	}
+	if err := store.PutBinding(ctx, "alice@example.com", binding); err != nil {
+		t.Fatalf("PutBinding returned error: %v", err)
+	}
+	// A binding written before sources were recorded.
+	legacy := strconv.FormatInt(now.Add(time.Minute).UnixNano(), 10) + " <sip:bob@192.0.2.20>;expires=60"
+	if _, err := client.Do(ctx, "HSET", "test:reg:bob@example.com", "sip:bob@192.0.2.20", legacy); err != nil {
+		t.Fatalf("HSET returned error: %v", err)
+	}
+
+	all, err := store.AllBindings(ctx, now)
+	if err != nil {
+		t.Fatalf("AllBindings returned error: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected bindings for two AORs, got %v", all)
+	}
+	if got := all["alice@example.com"]; len(got) != 1 || got[0].Source != binding.Source || got[0].UserAgent != binding.UserAgent || !got[0].Expires.Equal(binding.Expires) {
+		t.Fatalf("unexpected round-tripped binding %+v", got)
+	}
+	if got := all["bob@example.com"]; len(got) != 1 || got[0].Contact != "<sip:bob@192.0.2.20>;expires=60" || got[0].Source != "" {
+		t.Fatalf("unexpected legacy binding %+v", got)
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	cfg, err := redis.ParseURL("redis://user:pw@cache.example.com/2")
+	if err != nil {
+		t.Fatalf("ParseURL returned error: %v", err)
+	}
+	if cfg.Addr != "cache.example.com:6379" || cfg.Username != "user" || cfg.Password != "pw" || cfg.DB != 2 {
+		t.Fatalf("unexpected config: %#v", cfg)
+	}
+	if cfg, err := redis.ParseURL("127.0.0.1:6380"); err != nil || cfg.Addr != "127.0.0.1:6380" {
+		t.Fatalf("expected bare address to be accepted, got %#v, %v", cfg, err)
+	}
+}
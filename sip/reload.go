@@ -0,0 +1,116 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReloadConfig is the part of SIPStackConfig that Reload changes on a
+// running stack. Its fields mean what they do there.
+type ReloadConfig struct {
+	Timers         TimerConfig
+	Trunks         []TrunkConfig
+	TrunkDIDs      map[string]string
+	Routes         []RouteRule
+	ENUM           ENUMConfig
+	Emergency      EmergencyConfig
+	Identity       IdentityConfig
+	TopologyHiding bool
+	Diversion      bool
+	HeaderRules    []HeaderRule
+}
+
+// Reload applies cfg to the running stack without closing its sockets or
+// forgetting registrations. It reads the user directory again, and with it
+// the managed domains and broadcast rules, gives transactions started from
+// then on the new timers, and routes requests received from then on by the
+// new dial plan, emergency route, ENUM settings, trust domain, topology
+// hiding, Diversion setting, and header rules, forgetting cached ENUM results. Trunks whose configuration is unchanged keep their registrations,
+// new ones register, and removed ones are no longer refreshed, so their
+// registrations lapse at the provider. When cfg is invalid or the directory
+// cannot be read, the stack is left as it was.
+func (s *SIPStack) Reload(ctx context.Context, cfg ReloadConfig) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if err := cfg.Timers.validate(); err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	configs, err := normalizeTrunks(cfg.Trunks)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	dids, err := normalizeDIDs(cfg.TrunkDIDs)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	routes, err := compileRouteRules(cfg.Routes, configs)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	enum, server, err := normalizeENUM(cfg.ENUM)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	numbers, emergencyHop, emergencyTarget, err := compileEmergency(cfg.Emergency, configs)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	trusted, err := compileIdentity(cfg.Identity)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	headers, err := compileHeaderRules(cfg.HeaderRules)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	current := s.currentTrunks()
+	trunks, added, err := resolveTrunks(ctx, configs, current)
+	if err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started || s.stopped {
+		return fmt.Errorf("sip: stack is not running")
+	}
+	users, rules, err := s.reloadDirectory(ctx)
+	if err != nil {
+		return err
+	}
+	s.proxy.SetTimers(cfg.Timers)
+	s.dialPlan.set(routes, configs)
+	s.logSkippedTrunkRoutes()
+	s.enum.set(enum, server)
+	s.emergency.set(numbers, emergencyHop, emergencyTarget)
+	s.identity.set(trusted)
+	s.topology.SetEnabled(cfg.TopologyHiding)
+	s.diversion.SetEnabled(cfg.Diversion)
+	s.headers.set(headers)
+
+	s.trunkMu.Lock()
+	s.trunks = trunks
+	s.dids = dids
+	s.trunkMu.Unlock()
+	kept := make(map[*trunk]bool, len(trunks))
+	for _, t := range trunks {
+		kept[t] = true
+	}
+	for _, t := range current {
+		if !kept[t] {
+			t.stop()
+		}
+	}
+	for _, t := range added {
+		s.launchTrunk(t)
+	}
+	s.cfg.Timers = cfg.Timers
+	s.cfg.Trunks = configs
+	s.cfg.TrunkDIDs = cfg.TrunkDIDs
+	s.cfg.Routes = cfg.Routes
+	s.cfg.HeaderRules = cfg.HeaderRules
+
+	s.logger.Info("reloaded configuration", "users", users, "rules", rules, "trunks", len(trunks), "trunks_added", len(added), "trunks_removed", len(current)+len(added)-len(trunks), "dids", len(dids), "routes", len(routes))
+	return nil
+}
@@ -0,0 +1,124 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestSIPStackReloadReplacesTrunksWithoutRestarting(t *testing.T) {
+	provider, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer provider.Close()
+	registered := make(chan *Message, 8)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := provider.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := ParseMessage(string(buf[:n]))
+			if err != nil || req.Method != "REGISTER" {
+				continue
+			}
+			provider.WriteTo([]byte(buildResponseFrom(req, 200, "OK").String()), addr)
+			registered <- req
+		}
+	}()
+
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+	listen := stack.downstreamConn.LocalAddr().String()
+
+	alice := TrunkConfig{Registrar: provider.LocalAddr().String(), Domain: "provider.example", Username: "0311111111", Password: "a"}
+	reload := ReloadConfig{
+		Trunks:    []TrunkConfig{alice},
+		TrunkDIDs: map[string]string{"0311111111": "alice@example.com"},
+		Timers:    TimerConfig{T1: 250 * time.Millisecond},
+	}
+	if err := stack.Reload(context.Background(), reload); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	select {
+	case req := <-registered:
+		if got := req.GetHeader("To"); got != "<sip:0311111111@provider.example>" {
+			t.Fatalf("unexpected address of record %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("trunk added by reload did not register")
+	}
+	first := stack.currentTrunks()[0]
+
+	invite := NewRequest("INVITE", "sip:0311111111@192.0.2.10")
+	invite.SetHeader("To", "<sip:0311111111@provider.example>")
+	if !stack.routeDID(invite) || invite.RequestURI != "sip:alice@example.com" {
+		t.Fatalf("expected the reloaded DID to be routed, got %q", invite.RequestURI)
+	}
+
+	bob := TrunkConfig{Registrar: provider.LocalAddr().String(), Domain: "provider.example", Username: "0322222222", Password: "b"}
+	reload.Trunks = append(reload.Trunks, bob)
+	reload.TrunkDIDs = nil
+	if err := stack.Reload(context.Background(), reload); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	select {
+	case req := <-registered:
+		if got := req.GetHeader("To"); got != "<sip:0322222222@provider.example>" {
+			t.Fatalf("expected only the added trunk to register, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("second trunk did not register")
+	}
+	trunks := stack.currentTrunks()
+	if len(trunks) != 2 || trunks[0] != first {
+		t.Fatalf("expected the unchanged trunk to keep its registration, got %d trunks", len(trunks))
+	}
+	if first.ctx.Err() != nil {
+		t.Fatalf("unchanged trunk was stopped")
+	}
+	if stack.routeDID(NewRequest("INVITE", "sip:0311111111@192.0.2.10")) {
+		t.Fatalf("expected removed DIDs to stop routing")
+	}
+
+	reload.Trunks = reload.Trunks[1:]
+	if err := stack.Reload(context.Background(), reload); err != nil {
+		t.Fatalf("Reload returned error: %v", err)
+	}
+	if first.ctx.Err() == nil {
+		t.Fatalf("expected the removed trunk to stop refreshing")
+	}
+
+	if err := stack.Reload(context.Background(), ReloadConfig{Trunks: []TrunkConfig{{Username: "x"}}}); err == nil {
+		t.Fatalf("expected an invalid trunk to be refused")
+	}
+	if got := len(stack.currentTrunks()); got != 1 {
+		t.Fatalf("a refused reload changed the trunks to %d", got)
+	}
+	if stack.downstreamConn == nil || stack.downstreamConn.LocalAddr().String() != listen {
+		t.Fatalf("reload must keep the sockets open")
+	}
+}
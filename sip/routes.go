@@ -0,0 +1,221 @@
+package sip
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routeShards is how many independently locked parts the route table is
+// split into.
+const routeShards = 32
+
+// transactionRouter remembers which downstream address each client
+// transaction came from, so responses can be sent back to it. The table is
+// split into shards by a hash of the transaction key. Lookups, which far
+// outnumber insertions, take only a shared lock and extend an entry's expiry
+// atomically, so they never wait for each other.
+//
+// When maxEntries is positive each shard holds at most its share of it, and
+// inserting into a full shard evicts the least recently used entry first.
+// Recency is tracked with the second-chance (CLOCK) approximation: a lookup
+// only sets a flag, and eviction skips an entry whose flag is set once,
+// clearing it, so the read path never reorders anything.
+type transactionRouter struct {
+	shards   [routeShards]routeShard
+	ttl      time.Duration
+	perShard int
+	metrics  *Metrics
+}
+
+type routeShard struct {
+	mu     sync.RWMutex
+	routes map[string]*routeEntry
+	// order lists the keys oldest first for eviction; it is only kept when
+	// the table is bounded.
+	order routeList
+}
+
+type routeEntry struct {
+	key     string
+	addr    net.Addr
+	expires atomic.Int64
+	used    atomic.Bool
+
+	prev, next *routeEntry
+}
+
+func newTransactionRouter(ttl time.Duration, maxEntries int) *transactionRouter {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	r := &transactionRouter{ttl: ttl}
+	if maxEntries > 0 {
+		r.perShard = (maxEntries + routeShards - 1) / routeShards
+	}
+	for i := range r.shards {
+		r.shards[i].routes = make(map[string]*routeEntry)
+	}
+	return r
+}
+
+func (r *transactionRouter) Remember(key string, addr net.Addr) {
+	if r == nil || key == "" || addr == nil {
+		return
+	}
+	addr = copyAddr(addr)
+	now := time.Now()
+	expires := now.Add(r.ttl).UnixNano()
+	shard := r.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if entry, ok := shard.routes[key]; ok {
+		entry.addr = addr
+		entry.expires.Store(expires)
+		return
+	}
+	entry := &routeEntry{key: key, addr: addr}
+	entry.expires.Store(expires)
+	if r.perShard > 0 {
+		for len(shard.routes) >= r.perShard {
+			shard.evict(now.UnixNano())
+			r.metrics.routeEvicted()
+		}
+		shard.order.pushBack(entry)
+	}
+	shard.routes[key] = entry
+}
+
+func (r *transactionRouter) Lookup(key string) (net.Addr, bool) {
+	if r == nil || key == "" {
+		return nil, false
+	}
+	now := time.Now()
+	shard := r.shardFor(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	entry, ok := shard.routes[key]
+	if !ok || now.UnixNano() > entry.expires.Load() {
+		// Expired entries are left for cleanup, which holds the write lock.
+		return nil, false
+	}
+	entry.expires.Store(now.Add(r.ttl).UnixNano())
+	entry.used.Store(true)
+	return entry.addr, true
+}
+
+// Len reports how many routes are stored, including expired ones not yet
+// cleaned up.
+func (r *transactionRouter) Len() int {
+	if r == nil {
+		return 0
+	}
+	total := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		total += len(shard.routes)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+func (r *transactionRouter) shardFor(key string) *routeShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &r.shards[hash%routeShards]
+}
+
+func (r *transactionRouter) cleanup(now time.Time) {
+	if r == nil {
+		return
+	}
+	cutoff := now.UnixNano()
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.Lock()
+		for key, entry := range shard.routes {
+			if cutoff > entry.expires.Load() {
+				shard.remove(key, entry)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (r *transactionRouter) RunCleanup(ctx context.Context, interval time.Duration) {
+	if r == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.cleanup(now)
+		}
+	}
+}
+
+// evict removes one entry from a full shard: the oldest that has expired or
+// has not been looked up since it was last passed over. The caller holds the
+// write lock.
+func (s *routeShard) evict(now int64) {
+	for {
+		entry := s.order.head
+		if entry.used.Swap(false) && now <= entry.expires.Load() {
+			s.order.remove(entry)
+			s.order.pushBack(entry)
+			continue
+		}
+		s.remove(entry.key, entry)
+		return
+	}
+}
+
+func (s *routeShard) remove(key string, entry *routeEntry) {
+	delete(s.routes, key)
+	if s.order.head != nil {
+		s.order.remove(entry)
+	}
+}
+
+// routeList is an intrusive doubly linked list of route entries, avoiding an
+// allocation per route.
+type routeList struct {
+	head, tail *routeEntry
+}
+
+func (l *routeList) pushBack(e *routeEntry) {
+	e.prev, e.next = l.tail, nil
+	if l.tail != nil {
+		l.tail.next = e
+	} else {
+		l.head = e
+	}
+	l.tail = e
+}
+
+func (l *routeList) remove(e *routeEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		l.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		l.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
@@ -0,0 +1,59 @@
+package sip
+
+import (
+	"strings"
+	"sync"
+
+	"xylitol4/sip/userdb"
+)
+
+// ShortNumbers rewrites requests for short extensions, such as 100, to the
+// full addresses of record they stand for. It is safe for concurrent use.
+type ShortNumbers struct {
+	mu sync.RWMutex
+	// targets maps "number@domain", with the domain in lower case, to the
+	// URI the number stands for.
+	targets map[string]string
+}
+
+// NewShortNumbers returns ShortNumbers holding numbers.
+func NewShortNumbers(numbers []userdb.ShortNumber) *ShortNumbers {
+	s := &ShortNumbers{}
+	s.Replace(numbers)
+	return s
+}
+
+// Replace atomically swaps the short numbers for the supplied set.
+func (s *ShortNumbers) Replace(numbers []userdb.ShortNumber) {
+	if s == nil {
+		return
+	}
+	targets := make(map[string]string, len(numbers))
+	for _, number := range numbers {
+		targets[number.Number+"@"+strings.ToLower(number.Domain)] = number.Target
+	}
+	s.mu.Lock()
+	s.targets = targets
+	s.mu.Unlock()
+}
+
+// rewrite replaces the Request-URI of req, an out-of-dialog request other
+// than ACK, with the address of record its user part stands for in its
+// domain, reporting whether it did.
+func (s *ShortNumbers) rewrite(req *Message) bool {
+	if s == nil || strings.EqualFold(req.Method, "ACK") || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return false
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil || uri.User == "" {
+		return false
+	}
+	s.mu.RLock()
+	target, ok := s.targets[uri.User+"@"+strings.ToLower(uri.Host)]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	req.RequestURI = target
+	return true
+}
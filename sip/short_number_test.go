@@ -0,0 +1,50 @@
+package sip
+
+import (
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestProxyRewritesShortNumbersBeforeDialPlan(t *testing.T) {
+	numbers := NewShortNumbers([]userdb.ShortNumber{
+		{Domain: "example.com", Number: "100", Target: "sip:reception@example.com"},
+		{Domain: "example.org", Number: "200", Target: "sip:bob@example.org"},
+	})
+	plan, err := NewDialPlan([]RouteRule{{Prefix: "1", Reject: 403}}, nil)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	proxy := NewProxy(WithShortNumbers(numbers), WithDialPlan(plan))
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	invite.RequestURI = "sip:100@Example.com"
+	proxy.SendFromClient(invite)
+	for {
+		msg, ok := proxy.NextToServer(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the INVITE to the short number to be forwarded")
+		}
+		if msg.Method != "INVITE" {
+			continue
+		}
+		if msg.RequestURI != "sip:reception@example.com" {
+			t.Fatalf("expected the short number to be rewritten, got %q", msg.RequestURI)
+		}
+		break
+	}
+
+	// Short numbers only apply within their own domain.
+	req := newInvite()
+	req.RequestURI = "sip:200@example.com"
+	if numbers.rewrite(req) || req.RequestURI != "sip:200@example.com" {
+		t.Fatalf("expected another domain's short number to be left alone, got %q", req.RequestURI)
+	}
+	numbers.Replace(nil)
+	req.RequestURI = "sip:100@example.com"
+	if numbers.rewrite(req) {
+		t.Fatalf("expected replaced short numbers to stop applying")
+	}
+}
@@ -0,0 +1,123 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"xylitol4/internal/tracing"
+)
+
+// Span names emitted along the proxy pipeline. Every received datagram starts
+// a trace with a sip.receive span; each layer it then crosses adds a hop span
+// covering the time since the previous hop, queueing included, so the spans of
+// one message tile its path from socket to socket.
+const (
+	spanReceive           = "sip.receive"
+	spanHopTransport      = "sip.transport"
+	spanHopTransaction    = "sip.transaction"
+	spanHopTU             = "sip.tu"
+	spanHopSend           = "sip.send"
+	spanClientTransaction = "sip.client_transaction"
+	spanServerTransaction = "sip.server_transaction"
+)
+
+// messageTrace is the span context a message carries between layers. It is a
+// value so that Clone gives every copy, such as each fork of a broadcast, its
+// own hop clock.
+type messageTrace struct {
+	tracer   *tracing.Tracer
+	parent   tracing.SpanContext
+	hopStart time.Time
+}
+
+// startTrace records the sip.receive span for a datagram read at received
+// and attaches its context to msg.
+func (m *Message) startTrace(tracer *tracing.Tracer, side direction, peer net.Addr, received time.Time) {
+	if tracer == nil || m == nil {
+		return
+	}
+	attrs := []tracing.Attribute{
+		tracing.String("sip.side", sideLabel(side)),
+		tracing.String("sip.call_id", strings.TrimSpace(m.GetHeader("Call-ID"))),
+	}
+	if m.IsRequest() {
+		attrs = append(attrs, tracing.String("sip.method", m.Method))
+	} else {
+		attrs = append(attrs, tracing.Int("sip.status_code", m.StatusCode), tracing.String("sip.method", traceMethod(m)))
+	}
+	if peer != nil {
+		attrs = append(attrs, tracing.String("net.peer.name", peer.String()))
+	}
+	now := time.Now()
+	ctx := tracer.Record(spanReceive, tracing.KindServer, tracing.SpanContext{}, received, now, attrs...)
+	m.trace = messageTrace{tracer: tracer, parent: ctx, hopStart: now}
+}
+
+// traceHop records the time since the previous hop as a span called name and
+// restarts the hop clock.
+func (m *Message) traceHop(name string) {
+	if m == nil || m.trace.tracer == nil {
+		return
+	}
+	now := time.Now()
+	m.trace.tracer.Record(name, tracing.KindInternal, m.trace.parent, m.trace.hopStart, now)
+	m.trace.hopStart = now
+}
+
+// startSpan begins a span that is a child of the message's trace. It returns
+// nil when the message is not traced.
+func (m *Message) startSpan(name string, kind tracing.Kind, attrs ...tracing.Attribute) *tracing.Span {
+	if m == nil || m.trace.tracer == nil {
+		return nil
+	}
+	return m.trace.tracer.Start(name, kind, m.trace.parent, time.Time{}, attrs...)
+}
+
+// untraced drops the message's trace so that copies kept for retransmission
+// do not report stale hops.
+func (m *Message) untraced() *Message {
+	m.trace = messageTrace{}
+	return m
+}
+
+// startTransactionSpan opens the span covering a transaction from creation
+// to its final response.
+func (d *transactionData) startTransactionSpan(name string, kind tracing.Kind, msg *Message) {
+	d.span = msg.startSpan(name, kind,
+		tracing.String("sip.method", d.method),
+		tracing.String("sip.branch", d.branch),
+		tracing.String("sip.call_id", strings.TrimSpace(msg.GetHeader("Call-ID"))),
+	)
+}
+
+// withinSpan returns a copy of msg whose later hops are children of the
+// transaction's span, carrying the transaction's context.
+func (d *transactionData) withinSpan(msg *Message) *Message {
+	clone := d.bind(msg.Clone())
+	if d.span != nil {
+		clone.trace.parent = d.span.Context()
+	}
+	return clone
+}
+
+// finishSpan ends the transaction's span, if still open, with the final
+// status. A timed-out transaction or a 5xx/6xx final response marks the span
+// as failed.
+func (d *transactionData) finishSpan(status int, timedOut bool) {
+	if d == nil || d.span == nil {
+		return
+	}
+	if status > 0 {
+		d.span.SetAttributes(tracing.Int("sip.status_code", status))
+	}
+	switch {
+	case timedOut:
+		d.span.SetError("transaction timed out")
+	case status >= 500:
+		d.span.SetError("final response " + strconv.Itoa(status))
+	}
+	d.span.End(time.Time{})
+	d.span = nil
+}
@@ -0,0 +1,93 @@
+package sip
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"xylitol4/internal/tracing"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *recordingExporter) Export(ctx context.Context, spans []tracing.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestProxyEmitsSpansPerHopAndTransaction(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(tracing.Config{Exporter: exporter, Interval: time.Hour})
+	proxy := NewProxy()
+	t.Cleanup(proxy.Stop)
+
+	invite := newInvite()
+	invite.startTrace(tracer, directionDownstream, nil, time.Now())
+	proxy.SendFromClient(invite)
+	forwarded, ok := proxy.NextToServer(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected forwarded invite")
+	}
+	forwarded.traceHop(spanHopSend)
+
+	resp := buildResponseFrom(forwarded, 200, "OK")
+	resp.startTrace(tracer, directionUpstream, nil, time.Now())
+	proxy.SendFromServer(resp)
+	final, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok {
+		t.Fatalf("expected final response downstream")
+	}
+	final.traceHop(spanHopSend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tracer.Shutdown(ctx)
+
+	byName := make(map[string][]tracing.SpanData)
+	for _, span := range exporter.spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	if n := len(byName[spanReceive]); n != 2 {
+		t.Fatalf("expected a receive span per datagram, got %d", n)
+	}
+	server := byName[spanServerTransaction]
+	client := byName[spanClientTransaction]
+	if len(server) != 1 || len(client) != 1 {
+		t.Fatalf("expected one span per transaction, got %d server and %d client", len(server), len(client))
+	}
+	requestTrace := invite.trace.parent.TraceID
+	if server[0].Context.TraceID != requestTrace || client[0].Parent != server[0].Context.SpanID {
+		t.Fatalf("expected client transaction nested in the server transaction of the request's trace")
+	}
+	for _, span := range append(server, client...) {
+		if !hasIntAttribute(span, "sip.status_code", 200) {
+			t.Errorf("expected %s to record the final status, got %+v", span.Name, span.Attributes)
+		}
+	}
+	for _, name := range []string{spanHopTransport, spanHopTransaction, spanHopTU, spanHopSend} {
+		hops := 0
+		for _, span := range byName[name] {
+			if span.Context.TraceID == requestTrace {
+				hops++
+			}
+		}
+		if hops == 0 {
+			t.Errorf("expected %s hop on the request path", name)
+		}
+	}
+}
+
+func hasIntAttribute(span tracing.SpanData, key string, value int) bool {
+	for _, attr := range span.Attributes {
+		if attr.Key == key && attr.IsInt && attr.Int == int64(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,50 +4,209 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"xylitol4/internal/metrics"
+	"xylitol4/internal/tracing"
 	"xylitol4/sip/userdb"
 )
 
 // SIPStackConfig describes the runtime configuration for a SIP stack instance.
+// Zero values select the defaults noted on each field; only UserDBPath, or
+// UserStore in its place, is required.
 type SIPStackConfig struct {
-	ListenAddr      string
-	UpstreamAddr    string
-	UpstreamBind    string
-	RouteTTL        time.Duration
-	UserDBPath      string
-	Logger          *log.Logger
-	UserLoadTimeout time.Duration
+	// ListenAddr is the downstream UDP address (":5060" when empty).
+	ListenAddr string
+	// UpstreamAddr may list several comma-separated servers in priority
+	// order. Requests go to the first one not marked down; one whose request
+	// times out or is answered 503 is marked down and the request is retried
+	// on the next.
+	UpstreamAddr string
+	// UpstreamBind is the local address of the upstream socket.
+	UpstreamBind string
+	// RouteTTL is how long the address a downstream transaction came from is
+	// remembered after its last use.
+	RouteTTL time.Duration
+	// RouteMaxEntries, when positive, bounds how many such routes are held,
+	// evicting the least recently used to make room.
+	RouteMaxEntries int
+	// UserDBPath locates the user directory for UserDBDriver.
+	UserDBPath string
+	// UserDBDriver selects the directory backend used to open UserDBPath
+	// ("sqlite" by default, "postgres", "mysql", or "ldap").
+	UserDBDriver string
+	// UserStore optionally supplies a pre-opened backend; when set,
+	// UserDBPath is ignored and the stack leaves the store open on Stop.
+	UserStore userdb.Store
+	// RegistrationStore optionally replaces the registrar's in-memory
+	// bindings, for example with a RedisRegistrationStore shared between
+	// proxy instances; the caller remains responsible for closing it.
+	RegistrationStore RegistrationStore
+	// DirectoryRefresh, when positive, reloads the directory at this
+	// interval, besides whenever a store implementing userdb.ChangeNotifier
+	// reports a write.
+	DirectoryRefresh time.Duration
+	Logger           *slog.Logger
+	UserLoadTimeout  time.Duration
+	// Metrics optionally receives the SIP metric families; the stack samples
+	// its queue depths, route count, and registration count whenever the
+	// registry is scraped.
+	Metrics *metrics.Registry
+	// Tracer optionally records the wire image of every datagram the stack
+	// sends or receives while it is enabled.
+	Tracer *Tracer
+	// Observers are handed every such datagram, for example to export it to
+	// a HEP capture server.
+	Observers []PacketObserver
+	// Tracing optionally records spans following each received message
+	// through the transport, transaction, and transaction-user layers to the
+	// socket it leaves by, plus one span per transaction.
+	Tracing *tracing.Tracer
+	// UpstreamPing, when positive, is how often an OPTIONS request is sent to
+	// each default upstream so that Health can report whether they are
+	// reachable; a server marked down stays down until it answers one.
+	UpstreamPing time.Duration
+	// UpstreamHoldDown is how long a server stays down without pings (30
+	// seconds when not positive).
+	UpstreamHoldDown time.Duration
+	// TransactionShards is how many goroutines run the transaction layer,
+	// each owning the transactions whose keys hash to it; zero uses one per
+	// available CPU.
+	TransactionShards int
+	// QueueCapacity sizes the proxy's internal queues (32 when not positive).
+	QueueCapacity int
+	// QueuePolicy decides what happens when an edge queue is full.
+	QueuePolicy QueuePolicy
+	// Overload sets the thresholds above which new INVITEs are answered with
+	// 503.
+	Overload OverloadConfig
+	// ParseWorkers is how many goroutines parse downstream datagrams, so that
+	// the socket is read without waiting for parsing; zero uses one per
+	// available CPU.
+	ParseWorkers int
+	// CompactHeaders makes the stack send header names in their compact form
+	// (RFC 3261 section 7.3.3). Received messages are accepted in either form.
+	CompactHeaders bool
+	// LenientParsing accepts received messages that bend the RFC 3261
+	// grammar in ways common among broken endpoints, as Parser.Lenient
+	// describes.
+	LenientParsing bool
+	// LocalNames are host names and addresses, besides the listen address, by
+	// which clients address the proxy itself; OPTIONS sent to any of them is
+	// answered by the proxy, as WithLocalNames describes.
+	LocalNames []string
+	// ListenConn and UpstreamConn, when set, are UDP sockets already bound,
+	// such as those systemd passes to a socket-activated service, used
+	// instead of listening on ListenAddr and binding UpstreamBind. The stack
+	// closes them when it stops.
+	ListenConn   net.PacketConn
+	UpstreamConn net.PacketConn
+	// Timers tunes the transaction timers; NewSIPStack rejects timers outside
+	// the ranges TimerConfig allows.
+	Timers TimerConfig
+	// Trunks are accounts at upstream providers the stack registers to from
+	// its upstream socket, refreshing each registration halfway through its
+	// lifetime and answering the provider's digest challenges.
+	Trunks []TrunkConfig
+	// TrunkDIDs maps numbers, such as "+81312345678", to the local users, as
+	// user@domain, that calls to them arriving from upstream are delivered
+	// to.
+	TrunkDIDs map[string]string
+	// Routes is the dial plan: the first rule matching an out-of-dialog
+	// request rewrites its Request-URI, picks where it is sent, or rejects
+	// it. Rules may send requests through the Trunks.
+	Routes []RouteRule
+	// ENUM, when it names suffixes, has the numbers of requests the dial plan
+	// sends through trunks looked up in DNS first.
+	ENUM ENUMConfig
+	// Emergency designates emergency numbers sent on their own route ahead of
+	// every other check.
+	Emergency EmergencyConfig
+	// Identity draws the trust domain within which P-Asserted-Identity is
+	// accepted and sent.
+	Identity IdentityConfig
+	// TopologyHiding hides the Via and Record-Route headers of requests sent
+	// to peers outside that trust domain, or to every peer without one.
+	TopologyHiding bool
+	// Diversion adds a Diversion header (RFC 5806), besides the History-Info
+	// header (RFC 7044) always recorded, to requests retargeted by call
+	// forwarding or broadcast rules.
+	Diversion bool
+	// MessageStore, when positive, is how many MESSAGE requests (RFC 3428)
+	// the stack keeps for each offline user, delivering them when the user
+	// next registers; otherwise such requests are refused with 480, as
+	// WithMessageStore describes.
+	MessageStore int
+	// EventPackages names the event packages the stack serves SUBSCRIBE for
+	// itself, rather than forwarding it: "presence" also makes it the
+	// presence compositor for PUBLISH, as Presence describes, and "dialog"
+	// reports the state of the calls through it, as DialogInfo describes.
+	EventPackages []string
+	// HeaderRules is the header manipulation pipeline, run in order over
+	// every message the proxy receives and sends.
+	HeaderRules []HeaderRule
 }
 
 // SIPStack wires together the registrar, proxy, transport, and transaction
 // routing helpers used by the command-line entrypoint.
 type SIPStack struct {
 	cfg    SIPStackConfig
-	logger *log.Logger
+	logger *slog.Logger
 
-	mu      sync.Mutex
-	started bool
-	stopped bool
+	mu       sync.Mutex
+	started  bool
+	stopped  bool
+	draining bool
 
-	userStore *userdb.SQLiteStore
+	userStore userdb.Store
+	ownsStore bool
 	registrar *Registrar
 	proxy     *Proxy
 	broadcast *BroadcastPolicy
+	shortNums *ShortNumbers
+	callerIDs *CallerIDRules
+	dialPlan  *DialPlan
+	enum      *ENUM
+	emergency *Emergency
+	identity  *Identity
+	topology  *TopologyHiding
+	diversion *Diversion
+	headers   *HeaderRules
+	calls     *CallLog
+	metrics   *Metrics
+	events    *EventBus
+	// subscriptions serves the configured event packages, among them
+	// presence and dialogs when they are configured.
+	subscriptions *Subscriptions
+	presence      *Presence
+	dialogs       *DialogInfo
 
 	downstreamConn net.PacketConn
 	upstreamConn   net.PacketConn
 	upstreamAddr   net.Addr
+	upstreams      *upstreamPool
 
+	// trunkMu guards the trunks and DID routes, which Reload replaces.
+	trunkMu sync.RWMutex
+	trunks  []*trunk
+	dids    map[string]string
+	// reloadMu serialises reloads.
+	reloadMu sync.Mutex
+
+	dirMu          sync.RWMutex
 	managedDomains map[string]struct{}
+	domains        map[string]userdb.Domain
 	directory      map[string]userdb.User
+	disabledUsers  map[string]struct{}
 
 	routes *transactionRouter
+	parser Parser
 
 	runCtx context.Context
 	cancel context.CancelFunc
@@ -67,9 +226,12 @@ func NewSIPStack(cfg SIPStackConfig) (*SIPStack, error) {
 	cfg.UpstreamBind = strings.TrimSpace(cfg.UpstreamBind)
 
 	cfg.UserDBPath = strings.TrimSpace(cfg.UserDBPath)
-	if cfg.UserDBPath == "" {
+	if cfg.UserDBPath == "" && cfg.UserStore == nil {
 		return nil, fmt.Errorf("sip: user database path is required")
 	}
+	if err := userdb.CheckBackend(cfg.UserDBDriver); err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
 
 	if cfg.RouteTTL <= 0 {
 		cfg.RouteTTL = 5 * time.Minute
@@ -77,16 +239,81 @@ func NewSIPStack(cfg SIPStackConfig) (*SIPStack, error) {
 	if cfg.UserLoadTimeout <= 0 {
 		cfg.UserLoadTimeout = 5 * time.Second
 	}
+	if cfg.UpstreamHoldDown <= 0 {
+		cfg.UpstreamHoldDown = 30 * time.Second
+	}
+
+	if err := cfg.Timers.validate(); err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+
+	trunks, err := normalizeTrunks(cfg.Trunks)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	cfg.Trunks = trunks
+	dids, err := normalizeDIDs(cfg.TrunkDIDs)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	dialPlan, err := NewDialPlan(cfg.Routes, trunks)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	enum, err := NewENUM(cfg.ENUM)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
 
 	logger := cfg.Logger
 	if logger == nil {
-		logger = log.Default()
+		logger = slog.Default()
 	}
-
-	return &SIPStack{
-		cfg:    cfg,
-		logger: logger,
-	}, nil
+	emergency, err := NewEmergency(cfg.Emergency, trunks, logger)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	identity, err := NewIdentity(cfg.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	topology, err := NewTopologyHiding(cfg.TopologyHiding)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	headers, err := NewHeaderRules(cfg.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	subscriptions, presence, dialogs, err := eventPackages(cfg.EventPackages)
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+
+	stack := &SIPStack{
+		cfg:       cfg,
+		logger:    logger,
+		calls:     NewCallLog(0),
+		events:    NewEventBus(),
+		parser:    Parser{Lenient: cfg.LenientParsing},
+		dids:      dids,
+		dialPlan:  dialPlan,
+		enum:      enum,
+		emergency: emergency,
+		identity:  identity,
+		topology:  topology,
+		diversion: NewDiversion(cfg.Diversion),
+		headers:   headers,
+
+		subscriptions: subscriptions,
+		presence:      presence,
+		dialogs:       dialogs,
+	}
+	if cfg.Metrics != nil {
+		stack.metrics = NewMetrics(cfg.Metrics)
+		cfg.Metrics.BeforeScrape(stack.sampleMetrics)
+	}
+	return stack, nil
 }
 
 // Start initialises all stack components and starts the background goroutines
@@ -103,89 +330,148 @@ func (s *SIPStack) Start(ctx context.Context) error {
 	}
 	s.mu.Unlock()
 
-	store, err := userdb.OpenSQLite(s.cfg.UserDBPath)
-	if err != nil {
-		return fmt.Errorf("sip: open user database %s: %w", s.cfg.UserDBPath, err)
+	store := s.cfg.UserStore
+	s.ownsStore = false
+	if store == nil {
+		opened, err := userdb.OpenStore(s.cfg.UserDBDriver, s.cfg.UserDBPath)
+		if err != nil {
+			return fmt.Errorf("sip: open user database %s: %w", s.cfg.UserDBPath, err)
+		}
+		store = opened
+		s.ownsStore = true
 	}
 	s.userStore = store
 
-	loadCtx, cancelLoad := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
-	users, err := store.AllUsers(loadCtx)
-	cancelLoad()
+	s.broadcast = NewBroadcastPolicy(nil)
+	s.shortNums = NewShortNumbers(nil)
+	s.callerIDs = NewCallerIDRules(nil)
+	users, rules, err := s.reloadDirectory(ctx)
 	if err != nil {
 		s.cleanupOnError()
-		return fmt.Errorf("sip: load users from %s: %w", s.cfg.UserDBPath, err)
+		return err
 	}
-	s.logger.Printf("loaded %d user directory entries from %s", len(users), s.cfg.UserDBPath)
+	s.logger.Info("loaded user directory", "users", users, "store", s.storeLabel())
+	s.logger.Info("loaded broadcast ringing rules", "rules", rules)
+	s.logSkippedTrunkRoutes()
 
-	s.managedDomains = make(map[string]struct{})
-	s.directory = make(map[string]userdb.User, len(users))
-	for _, user := range users {
-		key := registrarKey(user.Username, user.Domain)
-		s.directory[key] = user
-		domain := strings.ToLower(strings.TrimSpace(user.Domain))
-		if domain != "" {
-			s.managedDomains[domain] = struct{}{}
+	downstreamConn := s.cfg.ListenConn
+	if downstreamConn == nil {
+		downstreamConn, err = net.ListenPacket("udp", s.cfg.ListenAddr)
+		if err != nil {
+			s.cleanupOnError()
+			return fmt.Errorf("sip: listen on %s: %w", s.cfg.ListenAddr, err)
 		}
 	}
-
-	ruleCtx, cancelRules := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
-	rules, err := store.ListBroadcastRules(ruleCtx)
-	cancelRules()
-	if err != nil {
-		s.cleanupOnError()
-		return fmt.Errorf("sip: load broadcast rules from %s: %w", s.cfg.UserDBPath, err)
-	}
-	policy := convertBroadcastRules(rules)
-	s.broadcast = policy
-	s.logger.Printf("loaded %d broadcast ringing rules", len(rules))
-
-	downstreamConn, err := net.ListenPacket("udp", s.cfg.ListenAddr)
-	if err != nil {
-		s.cleanupOnError()
-		return fmt.Errorf("sip: listen on %s: %w", s.cfg.ListenAddr, err)
-	}
 	s.downstreamConn = downstreamConn
 
-	upstreamConn, err := net.ListenPacket("udp", s.cfg.UpstreamBind)
-	if err != nil {
-		s.cleanupOnError()
-		return fmt.Errorf("sip: open upstream socket on %s: %w", s.cfg.UpstreamBind, err)
+	upstreamConn := s.cfg.UpstreamConn
+	if upstreamConn == nil {
+		upstreamConn, err = net.ListenPacket("udp", s.cfg.UpstreamBind)
+		if err != nil {
+			s.cleanupOnError()
+			return fmt.Errorf("sip: open upstream socket on %s: %w", s.cfg.UpstreamBind, err)
+		}
 	}
 	s.upstreamConn = upstreamConn
 
 	if s.cfg.UpstreamAddr != "" {
-		upstreamAddr, err := net.ResolveUDPAddr("udp", s.cfg.UpstreamAddr)
+		addrs, err := resolveUpstreams(s.cfg.UpstreamAddr)
 		if err != nil {
 			s.cleanupOnError()
-			return fmt.Errorf("sip: resolve upstream address %s: %w", s.cfg.UpstreamAddr, err)
+			return fmt.Errorf("sip: %w", err)
+		}
+		holdDown := s.cfg.UpstreamHoldDown
+		if s.cfg.UpstreamPing > 0 {
+			holdDown = 0
+		}
+		s.upstreams = newUpstreamPool(addrs, holdDown, s.cfg.RouteTTL)
+		if primary := s.upstreams.primary(); primary != nil {
+			s.upstreamAddr = primary
 		}
-		s.upstreamAddr = upstreamAddr
 	}
 
-	registrar := NewRegistrar(store)
-	s.registrar = registrar
-	opts := []ProxyOption{WithRegistrar(registrar)}
-	if policy != nil {
-		opts = append(opts, WithBroadcastPolicy(policy))
+	if err := s.startTrunks(ctx); err != nil {
+		s.cleanupOnError()
+		return fmt.Errorf("sip: %w", err)
 	}
-	s.proxy = NewProxy(opts...)
-	s.routes = newTransactionRouter(s.cfg.RouteTTL)
+
+	s.routes = newTransactionRouter(s.cfg.RouteTTL, s.cfg.RouteMaxEntries)
+	s.routes.metrics = s.metrics
+	routes := s.routes
+	registrar := NewRegistrar(store,
+		WithRegistrationStore(s.cfg.RegistrationStore),
+		WithSourceLookup(func(req *Message) string {
+			if addr, ok := routes.Lookup(transactionKeyFromRequest(req)); ok {
+				return addr.String()
+			}
+			return ""
+		}),
+		WithRegistrarEvents(s.events),
+		WithDomainSettings(s.domainSettings),
+	)
+	s.registrar = registrar
+	var messages *MessageStore
+	if s.cfg.MessageStore > 0 {
+		messages = NewMessageStore(s.cfg.MessageStore)
+	}
+	s.proxy = NewProxy(
+		WithRegistrar(registrar),
+		WithBroadcastPolicy(s.broadcast),
+		WithShortNumbers(s.shortNums),
+		WithCallerIDRules(s.callerIDs),
+		WithHeaderRules(s.headers),
+		WithIdentity(s.identity),
+		WithTopologyHiding(s.topology),
+		WithDiversion(s.diversion),
+		WithSubscriptions(s.subscriptions),
+		WithPresence(s.presence),
+		WithDialogInfo(s.dialogs),
+		WithMessageStore(messages),
+		WithDialPlan(s.dialPlan),
+		WithENUM(s.enum),
+		WithEmergency(s.emergency),
+		WithCallLog(s.calls),
+		WithMetrics(s.metrics),
+		WithEventBus(s.events),
+		WithTransactionShards(s.cfg.TransactionShards),
+		WithQueueCapacity(s.cfg.QueueCapacity),
+		WithQueuePolicy(s.cfg.QueuePolicy),
+		WithOverloadControl(s.cfg.Overload),
+		WithLocalNames(s.localNames()...),
+		WithUpstreamFailover(s.failover),
+		// Only trunk accounts answer upstream challenges. The hook is
+		// installed even without trunks, since a reload may add them.
+		WithUpstreamCredentials(s.trunkCredentials),
+		WithTimers(s.cfg.Timers),
+	)
 
 	s.runCtx, s.cancel = context.WithCancel(context.Background())
 
-	s.wg.Add(5)
+	s.wg.Add(6)
 	go s.runDownstreamReader()
 	go s.runUpstreamReader()
 	go s.runUpstreamSender()
 	go s.runDownstreamSender()
 	go s.runRouteCleanup()
+	go s.runDirectoryWatch(s.subscribeDirectory())
+	s.upstreams.reset()
+	if s.upstreams != nil && s.upstreams.sent != nil {
+		s.wg.Add(1)
+		go s.runUpstreamCleanup()
+	}
+	if s.cfg.UpstreamPing > 0 && s.upstreamAddr != nil {
+		s.wg.Add(1)
+		go s.runUpstreamPing()
+	}
+	for _, trunk := range s.trunks {
+		s.launchTrunk(trunk)
+	}
 
 	upstreamLabel := "(dynamic)"
 	if s.upstreamAddr != nil {
 		upstreamLabel = s.upstreamAddr.String()
 	}
-	s.logger.Printf("listening on %s, upstream %s (local upstream %s)", s.downstreamConn.LocalAddr(), upstreamLabel, s.upstreamConn.LocalAddr())
+	s.logger.Info("listening", "listen", s.downstreamConn.LocalAddr().String(), "upstream", upstreamLabel, "local_upstream", s.upstreamConn.LocalAddr().String())
 
 	s.mu.Lock()
 	s.started = true
@@ -194,6 +480,120 @@ func (s *SIPStack) Start(ctx context.Context) error {
 	return nil
 }
 
+// Validate checks that the stack could start, without starting it. It opens
+// the user directory as Start would, which creates or upgrades an SQL schema,
+// requires the schema to be the version this build expects, and loads the
+// users and broadcast rules. It then binds the SIP sockets and resolves the
+// upstream servers and trunk registrars. Everything it opens is closed again;
+// sockets passed in ListenConn and UpstreamConn are taken as bound.
+func (s *SIPStack) Validate(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	store := s.cfg.UserStore
+	if store == nil {
+		opened, err := userdb.OpenStore(s.cfg.UserDBDriver, s.cfg.UserDBPath)
+		if err != nil {
+			return fmt.Errorf("sip: open user database %s: %w", s.cfg.UserDBPath, err)
+		}
+		defer opened.Close()
+		store = opened
+	}
+	if versioned, ok := store.(interface {
+		SchemaVersion(context.Context) (int, error)
+	}); ok {
+		version, err := versioned.SchemaVersion(ctx)
+		if err != nil {
+			return fmt.Errorf("sip: %w", err)
+		}
+		if version != userdb.LatestSchemaVersion() {
+			return fmt.Errorf("sip: user database schema is at version %d, this build expects %d", version, userdb.LatestSchemaVersion())
+		}
+	}
+	loadCtx, cancelLoad := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	defer cancelLoad()
+	if _, err := store.AllUsers(loadCtx); err != nil {
+		return fmt.Errorf("sip: load users from %s: %w", s.storeLabel(), err)
+	}
+	if _, err := store.ListBroadcastRules(loadCtx); err != nil {
+		return fmt.Errorf("sip: load broadcast rules from %s: %w", s.storeLabel(), err)
+	}
+	if _, err := store.ListTrunkRoutes(loadCtx); err != nil {
+		return fmt.Errorf("sip: load trunk routes from %s: %w", s.storeLabel(), err)
+	}
+	if _, err := store.ListDomains(loadCtx); err != nil {
+		return fmt.Errorf("sip: load domains from %s: %w", s.storeLabel(), err)
+	}
+	if _, err := store.ListShortNumbers(loadCtx); err != nil {
+		return fmt.Errorf("sip: load short numbers from %s: %w", s.storeLabel(), err)
+	}
+	if _, err := store.ListCallerIDRules(loadCtx); err != nil {
+		return fmt.Errorf("sip: load caller-id rules from %s: %w", s.storeLabel(), err)
+	}
+
+	if s.cfg.ListenConn == nil {
+		conn, err := net.ListenPacket("udp", s.cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("sip: listen on %s: %w", s.cfg.ListenAddr, err)
+		}
+		conn.Close()
+	}
+	if s.cfg.UpstreamConn == nil {
+		conn, err := net.ListenPacket("udp", s.cfg.UpstreamBind)
+		if err != nil {
+			return fmt.Errorf("sip: open upstream socket on %s: %w", s.cfg.UpstreamBind, err)
+		}
+		conn.Close()
+	}
+
+	if s.cfg.UpstreamAddr != "" {
+		if _, err := resolveUpstreams(s.cfg.UpstreamAddr); err != nil {
+			return fmt.Errorf("sip: %w", err)
+		}
+	}
+	if _, _, err := resolveTrunks(ctx, s.cfg.Trunks, nil); err != nil {
+		return fmt.Errorf("sip: %w", err)
+	}
+	return nil
+}
+
+// drainPoll is how often Drain checks whether the proxy's transactions have
+// concluded.
+const drainPoll = 50 * time.Millisecond
+
+// Drain shuts the stack down gracefully. New INVITEs are answered with 503
+// and readiness probes fail, while requests within dialogs are still served
+// and transactions in progress, including ringing forks, run until they have
+// a final response. The stack then stops as Stop does. When ctx ends first
+// the remaining transactions are cut off and Drain returns ctx's error.
+func (s *SIPStack) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started || s.stopped {
+		s.mu.Unlock()
+		return nil
+	}
+	s.draining = true
+	proxy := s.proxy
+	s.mu.Unlock()
+	defer s.Stop()
+
+	proxy.Drain()
+	s.logger.Info("draining SIP transactions", "in_flight", proxy.InFlight())
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for proxy.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			s.logger.Warn("drain deadline reached, abandoning transactions", "in_flight", proxy.InFlight())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	s.logger.Info("SIP transactions drained")
+	return nil
+}
+
 // Stop stops all background goroutines and releases resources. It is safe to
 // call multiple times.
 func (s *SIPStack) Stop() {
@@ -208,6 +608,7 @@ func (s *SIPStack) Stop() {
 	downstream := s.downstreamConn
 	upstream := s.upstreamConn
 	store := s.userStore
+	ownsStore := s.ownsStore
 	s.mu.Unlock()
 
 	if cancel != nil {
@@ -225,26 +626,90 @@ func (s *SIPStack) Stop() {
 
 	s.wg.Wait()
 
-	if store != nil {
+	if store != nil && ownsStore {
 		if err := store.Close(); err != nil {
-			s.logger.Printf("error closing user database: %v", err)
+			s.logger.Error("error closing user database", "error", err)
 		}
 	}
 
 	s.mu.Lock()
 	s.started = false
+	s.draining = false
 	s.cancel = nil
 	s.proxy = nil
 	s.downstreamConn = nil
 	s.upstreamConn = nil
 	s.upstreamAddr = nil
+	s.upstreams = nil
 	s.managedDomains = nil
+	s.domains = nil
 	s.directory = nil
+	s.disabledUsers = nil
 	s.routes = nil
 	s.registrar = nil
 	s.runCtx = nil
 	s.userStore = nil
+	s.ownsStore = false
+	s.mu.Unlock()
+}
+
+// BindingsFor returns the active registrations for a user, or nil while the
+// stack is not running.
+func (s *SIPStack) BindingsFor(username, domain string) []Registration {
+	s.mu.Lock()
+	registrar := s.registrar
+	s.mu.Unlock()
+	return registrar.BindingsFor(username, domain)
+}
+
+// AllBindings returns every active registration keyed by address of record
+// ("user@domain", lower-cased), or nil while the stack is not running.
+func (s *SIPStack) AllBindings() map[string][]Registration {
+	s.mu.Lock()
+	registrar := s.registrar
+	s.mu.Unlock()
+	return registrar.AllBindings()
+}
+
+// Deregister forcibly removes a user's binding for contact. It returns
+// ErrBindingNotFound when there is no such binding or the stack is not
+// running.
+func (s *SIPStack) Deregister(username, domain, contact string) error {
+	s.mu.Lock()
+	registrar := s.registrar
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return registrar.Deregister(ctx, username, domain, contact)
+}
+
+// TransactionStats reports the transaction layer's counters, or zeroes while
+// the stack is not running.
+func (s *SIPStack) TransactionStats() TransactionStats {
+	s.mu.Lock()
+	proxy := s.proxy
 	s.mu.Unlock()
+	return proxy.TransactionStats()
+}
+
+// Events returns the bus on which the stack publishes registration changes,
+// authentication failures, call progress, and transaction timeouts.
+// Subscriptions survive Stop and a later Start.
+func (s *SIPStack) Events() *EventBus {
+	return s.events
+}
+
+// RecentCalls returns up to limit of the most recent calls placed or received
+// by a user, newest first.
+func (s *SIPStack) RecentCalls(username, domain string, limit int) []CallRecord {
+	return s.calls.Recent(username, domain, limit)
+}
+
+func (s *SIPStack) storeLabel() string {
+	if s.cfg.UserStore != nil || s.cfg.UserDBPath == "" {
+		return "configured user store"
+	}
+	return s.cfg.UserDBPath
 }
 
 func (s *SIPStack) cleanupOnError() {
@@ -260,7 +725,7 @@ func (s *SIPStack) cleanupOnError() {
 	if s.upstreamConn != nil {
 		s.upstreamConn.Close()
 	}
-	if s.userStore != nil {
+	if s.userStore != nil && s.ownsStore {
 		s.userStore.Close()
 	}
 	s.cancel = nil
@@ -268,12 +733,62 @@ func (s *SIPStack) cleanupOnError() {
 	s.downstreamConn = nil
 	s.upstreamConn = nil
 	s.upstreamAddr = nil
+	s.upstreams = nil
 	s.managedDomains = nil
+	s.domains = nil
 	s.directory = nil
+	s.disabledUsers = nil
 	s.routes = nil
 	s.registrar = nil
 	s.runCtx = nil
 	s.userStore = nil
+	s.ownsStore = false
+}
+
+// sampleMetrics refreshes the gauges that are read from other components
+// rather than updated as traffic flows.
+func (s *SIPStack) sampleMetrics() {
+	s.mu.Lock()
+	proxy, registrar, routes := s.proxy, s.registrar, s.routes
+	s.mu.Unlock()
+	for queue, depth := range proxy.QueueDepths() {
+		s.metrics.queues.Set(float64(depth), queue)
+	}
+	s.metrics.routes.Set(float64(routes.Len()))
+	if registrar != nil {
+		bindings := 0
+		for _, regs := range registrar.AllBindings() {
+			bindings += len(regs)
+		}
+		s.metrics.registrations.Set(float64(bindings))
+	}
+}
+
+// maxDatagramSize is the largest UDP payload the stack reads.
+const maxDatagramSize = 65535
+
+// datagramPool recycles the buffers datagrams are read into and rendered in.
+// Parsed messages and captured packets never refer to a pooled buffer, so it
+// can go back to the pool as soon as the datagram has been handled.
+var datagramPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, maxDatagramSize)
+		return &buf
+	},
+}
+
+func getDatagramBuffer() *[]byte {
+	return datagramPool.Get().(*[]byte)
+}
+
+// putDatagramBuffer returns buf to the pool unless a message too large for a
+// datagram grew it.
+func putDatagramBuffer(buf *[]byte) {
+	if cap(*buf) > maxDatagramSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	datagramPool.Put(buf)
 }
 
 func (s *SIPStack) runDownstreamReader() {
@@ -283,9 +798,14 @@ func (s *SIPStack) runDownstreamReader() {
 		return
 	}
 
-	buf := make([]byte, 65535)
+	workers := newParsePool(s.cfg.ParseWorkers, s.handleDownstreamDatagram)
+	defer workers.close()
+	in := newBatchConn(s.downstreamConn)
+	batch, bufs := newReadBatch()
+	defer releaseReadBatch(bufs)
 	for {
-		n, addr, err := s.downstreamConn.ReadFrom(buf)
+		n, err := in.ReadBatch(batch)
+		received := time.Now()
 		if err != nil {
 			if s.runCtx != nil && s.runCtx.Err() != nil {
 				return
@@ -296,22 +816,66 @@ func (s *SIPStack) runDownstreamReader() {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				continue
 			}
-			s.logger.Printf("error reading from downstream: %v", err)
-			continue
-		}
-		raw := string(buf[:n])
-		msg, err := ParseMessage(raw)
-		if err != nil {
-			s.logger.Printf("discarding invalid downstream datagram from %s: %v", addr.String(), err)
+			s.logger.Error("error reading from downstream", "error", err)
 			continue
 		}
-		if msg.IsRequest() {
-			if key := transactionKeyFromRequest(msg); key != "" {
-				s.routes.Remember(key, addr)
+		for i := 0; i < n; i++ {
+			buf, addr := bufs[i], batch[i].Addr
+			*buf = (*buf)[:batch[i].N]
+			if !workers.submit(rawDatagram{buf: buf, addr: addr, received: received}) {
+				s.logger.Debug("dropping downstream datagram; parse workers are busy", "source", addr.String())
+				s.metrics.droppedDatagram(directionDownstream)
+				continue
 			}
+			// The worker owns the submitted buffer now; read into a fresh one.
+			bufs[i] = getDatagramBuffer()
+			batch[i].Buf = (*bufs[i])[:maxDatagramSize]
+		}
+	}
+}
+
+// newReadBatch prepares a batch of pooled buffers to read datagrams into.
+func newReadBatch() ([]batchMessage, []*[]byte) {
+	batch := make([]batchMessage, batchSize)
+	bufs := make([]*[]byte, batchSize)
+	for i := range batch {
+		bufs[i] = getDatagramBuffer()
+		batch[i].Buf = (*bufs[i])[:maxDatagramSize]
+	}
+	return batch, bufs
+}
+
+func releaseReadBatch(bufs []*[]byte) {
+	for _, buf := range bufs {
+		putDatagramBuffer(buf)
+	}
+}
+
+// handleDownstreamDatagram parses one downstream datagram on a parse worker
+// and hands it to the proxy.
+func (s *SIPStack) handleDownstreamDatagram(d rawDatagram) {
+	defer putDatagramBuffer(d.buf)
+	data := *d.buf
+	if s.answerKeepalive(s.downstreamConn, d.addr, data) {
+		return
+	}
+	msg, err := s.parser.ParseBytes(data)
+	s.capture(directionDownstream, true, s.downstreamConn, d.addr, data, msg)
+	if err != nil {
+		s.logger.Warn("discarding invalid downstream datagram", "source", d.addr.String(), "error", err)
+		s.metrics.invalidDatagram(directionDownstream)
+		return
+	}
+	s.logger.Debug("received downstream message", append(messageAttrs(msg), "source", d.addr.String())...)
+	msg.startTrace(s.cfg.Tracing, directionDownstream, d.addr, d.received)
+	msg.ctx = s.runCtx
+	if msg.IsRequest() {
+		stampVia(msg, d.addr)
+		if key := transactionKeyFromRequest(msg); key != "" {
+			s.routes.Remember(key, d.addr)
 		}
-		s.proxy.SendFromClient(msg)
 	}
+	s.proxy.SendFromClient(msg)
 }
 
 func (s *SIPStack) runUpstreamReader() {
@@ -321,9 +885,12 @@ func (s *SIPStack) runUpstreamReader() {
 		return
 	}
 
-	buf := make([]byte, 65535)
+	in := newBatchConn(s.upstreamConn)
+	batch, bufs := newReadBatch()
+	defer releaseReadBatch(bufs)
 	for {
-		n, addr, err := s.upstreamConn.ReadFrom(buf)
+		n, err := in.ReadBatch(batch)
+		received := time.Now()
 		if err != nil {
 			if s.runCtx != nil && s.runCtx.Err() != nil {
 				return
@@ -334,19 +901,41 @@ func (s *SIPStack) runUpstreamReader() {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				continue
 			}
-			s.logger.Printf("error reading from upstream: %v", err)
+			s.logger.Error("error reading from upstream", "error", err)
 			continue
 		}
-		raw := string(buf[:n])
-		msg, err := ParseMessage(raw)
-		if err != nil {
-			s.logger.Printf("discarding invalid upstream datagram from %s: %v", addr.String(), err)
-			continue
+		for i := 0; i < n; i++ {
+			s.handleUpstreamDatagram(batch[i].Buf[:batch[i].N], batch[i].Addr, received)
 		}
-		s.proxy.SendFromServer(msg)
 	}
 }
 
+// handleUpstreamDatagram parses one upstream datagram on the reader
+// goroutine and hands it to the proxy.
+func (s *SIPStack) handleUpstreamDatagram(data []byte, addr net.Addr, received time.Time) {
+	if s.answerKeepalive(s.upstreamConn, addr, data) {
+		return
+	}
+	msg, err := s.parser.ParseBytes(data)
+	s.capture(directionUpstream, true, s.upstreamConn, addr, data, msg)
+	if err != nil {
+		s.logger.Warn("discarding invalid upstream datagram", "source", addr.String(), "error", err)
+		s.metrics.invalidDatagram(directionUpstream)
+		return
+	}
+	s.logger.Debug("received upstream message", append(messageAttrs(msg), "source", addr.String())...)
+	if s.upstreams.answer(msg) || s.answerTrunk(msg) {
+		return
+	}
+	if msg.IsRequest() {
+		stampVia(msg, addr)
+		s.routeDID(msg)
+	}
+	msg.startTrace(s.cfg.Tracing, directionUpstream, addr, received)
+	msg.ctx = s.runCtx
+	s.proxy.SendFromServer(msg)
+}
+
 func (s *SIPStack) runUpstreamSender() {
 	defer s.wg.Done()
 
@@ -354,31 +943,18 @@ func (s *SIPStack) runUpstreamSender() {
 		return
 	}
 
-	for {
-		msg, ok := s.proxy.NextToServer(250 * time.Millisecond)
-		if !ok {
-			if s.runCtx != nil && s.runCtx.Err() != nil {
-				return
-			}
-			continue
-		}
+	s.runSender(directionUpstream, s.upstreamConn, s.proxy.NextToServer, s.proxy.pollToServer, func(msg *Message) net.Addr {
 		addr, err := s.selectUpstreamTarget(msg)
 		if err != nil {
-			s.logger.Printf("failed to resolve upstream target for %s: %v", summarizeMessage(msg), err)
-			continue
+			s.logger.Warn("failed to resolve upstream target", append(messageAttrs(msg), "error", err)...)
+			return nil
 		}
 		if addr == nil {
-			s.logger.Printf("no upstream target for %s; dropping message", summarizeMessage(msg))
-			continue
-		}
-		payload := []byte(msg.String())
-		if _, err := s.upstreamConn.WriteTo(payload, addr); err != nil {
-			if (s.runCtx != nil && s.runCtx.Err() != nil) || errors.Is(err, net.ErrClosed) {
-				return
-			}
-			s.logger.Printf("failed to send upstream message to %s: %v", addr.String(), err)
+			s.logger.Warn("no upstream target; dropping message", messageAttrs(msg)...)
+			return nil
 		}
-	}
+		return addr
+	})
 }
 
 func (s *SIPStack) runDownstreamSender() {
@@ -388,32 +964,113 @@ func (s *SIPStack) runDownstreamSender() {
 		return
 	}
 
+	s.runSender(directionDownstream, s.downstreamConn, s.proxy.NextToClient, s.proxy.pollToClient, s.resolveDownstreamTarget)
+}
+
+// resolveDownstreamTarget returns where a message for the downstream side
+// goes, or nil after logging why it is dropped.
+func (s *SIPStack) resolveDownstreamTarget(msg *Message) net.Addr {
+	// A response to a request that asked for rport goes straight back to
+	// the address and port the request came from.
+	via, symmetric := viaResponseTarget(msg)
+	if symmetric {
+		if addr, err := resolveUDPAddr(msg.Context(), via); err == nil {
+			return addr
+		}
+	}
+	key := transactionKeyFromMessage(msg)
+	if key == "" {
+		s.logger.Warn("dropping downstream message without transaction key", messageAttrs(msg)...)
+		return nil
+	}
+	if addr, ok := s.routes.Lookup(key); ok && addr != nil {
+		return addr
+	}
+	if via != "" && !msg.IsRequest() {
+		// The route is gone, after a restart or once it expired or was
+		// evicted, so the response is routed statelessly by its Via.
+		addr, err := resolveUDPAddr(msg.Context(), via)
+		if err == nil {
+			s.logger.Debug("no downstream route; routing response by Via", append(messageAttrs(msg), "destination", addr.String())...)
+			return addr
+		}
+		s.logger.Warn("no downstream route and Via does not resolve; dropping message", append(messageAttrs(msg), "error", err)...)
+		return nil
+	}
+	s.logger.Warn("no downstream route; dropping message", messageAttrs(msg)...)
+	return nil
+}
+
+// runSender drains one of the proxy's outbound queues onto conn. Messages
+// already queued behind the first one are gathered into a batch and sent
+// together. resolve returns each message's destination, or nil after
+// logging why the message is dropped.
+func (s *SIPStack) runSender(side direction, conn net.PacketConn, next func(time.Duration) (*Message, bool), poll func() (*Message, bool), resolve func(*Message) net.Addr) {
+	out := newBatchConn(conn)
+	batch := make([]batchMessage, 0, batchSize)
+	msgs := make([]*Message, 0, batchSize)
+	bufs := make([]*[]byte, 0, batchSize)
 	for {
-		msg, ok := s.proxy.NextToClient(250 * time.Millisecond)
+		msg, ok := next(250 * time.Millisecond)
 		if !ok {
 			if s.runCtx != nil && s.runCtx.Err() != nil {
 				return
 			}
 			continue
 		}
-		key := transactionKeyFromMessage(msg)
-		if key == "" {
-			s.logger.Printf("dropping downstream message without transaction key: %s", summarizeMessage(msg))
-			continue
+		batch, msgs, bufs = batch[:0], msgs[:0], bufs[:0]
+		for {
+			if addr := resolve(msg); addr != nil {
+				buf := getDatagramBuffer()
+				if s.cfg.CompactHeaders {
+					*buf = msg.AppendWireCompact(*buf)
+				} else {
+					*buf = msg.AppendWire(*buf)
+				}
+				batch = append(batch, batchMessage{Buf: *buf, Addr: addr})
+				msgs = append(msgs, msg)
+				bufs = append(bufs, buf)
+			}
+			if len(batch) == batchSize {
+				break
+			}
+			if msg, ok = poll(); !ok {
+				break
+			}
+		}
+		closed := s.sendBatch(side, conn, out, batch, msgs)
+		for _, buf := range bufs {
+			putDatagramBuffer(buf)
 		}
-		addr, ok := s.routes.Lookup(key)
-		if !ok || addr == nil {
-			s.logger.Printf("no downstream route for transaction %s; dropping message", key)
+		if closed {
+			return
+		}
+	}
+}
+
+// sendBatch writes a batch of rendered messages, capturing each one sent and
+// logging and skipping any the socket refuses. It reports whether the stack
+// is shutting down.
+func (s *SIPStack) sendBatch(side direction, conn net.PacketConn, out *batchConn, batch []batchMessage, msgs []*Message) bool {
+	label := sideLabel(side)
+	for start := 0; start < len(batch); {
+		n, err := out.WriteBatch(batch[start:])
+		for i := start; i < start+n; i++ {
+			msgs[i].traceHop(spanHopSend)
+			s.capture(side, false, conn, batch[i].Addr, batch[i].Buf, msgs[i])
+			s.logger.Debug("sent "+label+" message", append(messageAttrs(msgs[i]), "destination", batch[i].Addr.String())...)
+		}
+		start += n
+		if err == nil {
 			continue
 		}
-		payload := []byte(msg.String())
-		if _, err := s.downstreamConn.WriteTo(payload, addr); err != nil {
-			if (s.runCtx != nil && s.runCtx.Err() != nil) || errors.Is(err, net.ErrClosed) {
-				return
-			}
-			s.logger.Printf("failed to send message to downstream %s: %v", addr.String(), err)
+		if (s.runCtx != nil && s.runCtx.Err() != nil) || errors.Is(err, net.ErrClosed) {
+			return true
 		}
+		s.logger.Error("failed to send "+label+" message", append(messageAttrs(msgs[start]), "destination", batch[start].Addr.String(), "error", err)...)
+		start++
 	}
+	return false
 }
 
 func (s *SIPStack) runRouteCleanup() {
@@ -425,78 +1082,307 @@ func (s *SIPStack) runRouteCleanup() {
 	s.routes.RunCleanup(s.runCtx, time.Minute)
 }
 
+func (s *SIPStack) runUpstreamCleanup() {
+	defer s.wg.Done()
+	s.upstreams.sent.RunCleanup(s.runCtx, time.Minute)
+}
+
+// reloadDirectory fetches users, broadcast rules, trunk routes, domain
+// settings, and short numbers from the store and swaps them in, resolving
+// domain aliases to their domains. Routing keeps using the previous snapshot
+// until the new one is complete, so a failed reload leaves the stack
+// unchanged.
+func (s *SIPStack) reloadDirectory(ctx context.Context) (int, int, error) {
+	loadCtx, cancelLoad := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	users, err := s.userStore.AllUsers(loadCtx)
+	cancelLoad()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load users from %s: %w", s.storeLabel(), err)
+	}
+
+	ruleCtx, cancelRules := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	rules, err := s.userStore.ListBroadcastRules(ruleCtx)
+	cancelRules()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load broadcast rules from %s: %w", s.storeLabel(), err)
+	}
+
+	routeCtx, cancelRoutes := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	trunkRoutes, err := s.userStore.ListTrunkRoutes(routeCtx)
+	cancelRoutes()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load trunk routes from %s: %w", s.storeLabel(), err)
+	}
+
+	domainCtx, cancelDomains := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	domainList, err := s.userStore.ListDomains(domainCtx)
+	cancelDomains()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load domains from %s: %w", s.storeLabel(), err)
+	}
+
+	numberCtx, cancelNumbers := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	shortNumbers, err := s.userStore.ListShortNumbers(numberCtx)
+	cancelNumbers()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load short numbers from %s: %w", s.storeLabel(), err)
+	}
+
+	callerCtx, cancelCallers := context.WithTimeout(ctx, s.cfg.UserLoadTimeout)
+	callerIDRules, err := s.userStore.ListCallerIDRules(callerCtx)
+	cancelCallers()
+	if err != nil {
+		return 0, 0, fmt.Errorf("sip: load caller-id rules from %s: %w", s.storeLabel(), err)
+	}
+
+	domains := make(map[string]struct{})
+	directory := make(map[string]userdb.User, len(users))
+	disabled := make(map[string]struct{})
+	for _, user := range users {
+		key := registrarKey(user.Username, user.Domain)
+		domain := strings.ToLower(strings.TrimSpace(user.Domain))
+		if domain != "" {
+			domains[domain] = struct{}{}
+		}
+		if user.Disabled {
+			disabled[key] = struct{}{}
+			continue
+		}
+		directory[key] = user
+	}
+	settings := make(map[string]userdb.Domain, len(domainList))
+	for _, domain := range domainList {
+		domains[domain.Name] = struct{}{}
+	}
+	namespaces := make(map[string]string)
+	for i, domain := range domainList {
+		namespace := domain.BroadcastNamespace
+		if namespace == "" {
+			namespace = domain.Name
+		}
+		if namespace != domain.Name {
+			namespaces[domain.Name] = namespace
+		}
+		// An alias of another domain would take that domain's users
+		// away, so the first domain to claim a free name keeps it.
+		aliases := domain.Aliases[:0:0]
+		for _, alias := range domain.Aliases {
+			if _, taken := domains[alias]; taken {
+				s.logger.Warn("ignoring domain alias already in use", "domain", domain.Name, "alias", alias)
+				continue
+			}
+			domains[alias] = struct{}{}
+			namespaces[alias] = namespace
+			aliases = append(aliases, alias)
+		}
+		domainList[i].Aliases = aliases
+		settings[domain.Name] = domainList[i]
+		for _, alias := range aliases {
+			settings[alias] = domainList[i]
+		}
+	}
+	// Short numbers can be dialed in every alias of their domain.
+	for _, number := range shortNumbers {
+		for _, alias := range settings[number.Domain].Aliases {
+			number.Domain = alias
+			shortNumbers = append(shortNumbers, number)
+		}
+	}
+	// Likewise callers are matched in every alias of their domain.
+	for _, rule := range callerIDRules {
+		user, domain, hasUser := strings.Cut(rule.Caller, "@")
+		if !hasUser {
+			domain = user
+		}
+		for _, alias := range settings[domain].Aliases {
+			rule.Caller = alias
+			if hasUser {
+				rule.Caller = user + "@" + alias
+			}
+			callerIDRules = append(callerIDRules, rule)
+		}
+	}
+
+	s.dirMu.Lock()
+	s.managedDomains = domains
+	s.domains = settings
+	s.directory = directory
+	s.disabledUsers = disabled
+	s.dirMu.Unlock()
+	s.broadcast.Replace(convertBroadcastRules(rules))
+	s.broadcast.SetNamespaces(namespaces)
+	s.shortNums.Replace(shortNumbers)
+	s.callerIDs.Replace(callerIDRules)
+	s.dialPlan.setTrunkRoutes(trunkRoutes)
+	s.dialPlan.setDomains(domainList, domains)
+	return len(users), len(rules), nil
+}
+
+// domainSettings returns the directory's settings for domain, or for the
+// domain it is an alias of, or the defaults when it has none.
+func (s *SIPStack) domainSettings(domain string) userdb.Domain {
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	return s.domains[domain]
+}
+
+// logSkippedTrunkRoutes warns of the directory's trunk routes the dial plan
+// cannot use.
+func (s *SIPStack) logSkippedTrunkRoutes() {
+	for _, err := range s.dialPlan.skippedTrunkRoutes() {
+		s.logger.Warn("ignoring trunk route", "error", err)
+	}
+}
+
+// subscribeDirectory registers for store change notifications before the
+// watcher goroutine starts so that no write made after Start is missed.
+func (s *SIPStack) subscribeDirectory() (<-chan struct{}, func()) {
+	notifier, ok := s.userStore.(userdb.ChangeNotifier)
+	if !ok {
+		return nil, func() {}
+	}
+	return notifier.Subscribe()
+}
+
+// runDirectoryWatch reloads the directory whenever the store reports a change
+// and, if DirectoryRefresh is set, on a fixed interval to pick up writes made
+// by other processes.
+func (s *SIPStack) runDirectoryWatch(changes <-chan struct{}, unsubscribe func()) {
+	defer s.wg.Done()
+	defer unsubscribe()
+
+	if s.runCtx == nil || s.userStore == nil {
+		return
+	}
+	var tick <-chan time.Time
+	if s.cfg.DirectoryRefresh > 0 {
+		ticker := time.NewTicker(s.cfg.DirectoryRefresh)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if changes == nil && tick == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-s.runCtx.Done():
+			return
+		case <-changes:
+		case <-tick:
+		}
+		users, rules, err := s.reloadDirectory(s.runCtx)
+		if err != nil {
+			if s.runCtx.Err() != nil {
+				return
+			}
+			s.logger.Error("directory reload failed", "error", err)
+			continue
+		}
+		s.logger.Info("reloaded user directory", "users", users, "rules", rules)
+		s.logSkippedTrunkRoutes()
+	}
+}
+
 func (s *SIPStack) selectUpstreamTarget(msg *Message) (*net.UDPAddr, error) {
 	if msg == nil {
 		return nil, fmt.Errorf("sip: nil message")
 	}
 	if !msg.IsRequest() {
-		return s.cloneDefaultUpstream()
+		// A response to a request that came in on the upstream socket
+		// with rport goes back to where the request came from.
+		if target, symmetric := viaResponseTarget(msg); symmetric {
+			return resolveUDPAddr(msg.Context(), target)
+		}
+		return s.defaultUpstream(msg)
 	}
 
-	user, host, port, err := parseSIPURI(msg.RequestURI)
-	if err != nil {
-		return s.cloneDefaultUpstream()
+	// A dial plan rule chose where the request goes.
+	if msg.nextHop != "" {
+		return resolveUDPAddr(msg.Context(), msg.nextHop)
 	}
-	lowerHost := strings.ToLower(host)
-	if _, ok := s.managedDomains[lowerHost]; ok {
-		if target := s.resolveRegistrarTarget(user, lowerHost); target != nil {
+
+	uri, err := ParseURI(msg.RequestURI)
+	if err != nil {
+		return s.defaultUpstream(msg)
+	}
+	user := uri.User
+	lowerHost := strings.ToLower(uri.Host)
+	s.dirMu.RLock()
+	if domain, ok := s.domains[lowerHost]; ok {
+		lowerHost = domain.Name
+	}
+	_, managed := s.managedDomains[lowerHost]
+	_, disabled := s.disabledUsers[registrarKey(user, lowerHost)]
+	s.dirMu.RUnlock()
+	// Suspended accounts keep their registrations but are never routed to;
+	// requests fall through to Request-URI resolution like unknown users.
+	ctx := msg.Context()
+	if managed && !disabled {
+		if target := s.resolveRegistrarTarget(ctx, user, lowerHost); target != nil {
 			return target, nil
 		}
-		if target := s.resolveDirectoryTarget(user, lowerHost); target != nil {
+		if target := s.resolveDirectoryTarget(ctx, user, lowerHost); target != nil {
 			return target, nil
 		}
 	}
 
-	if host != "" {
-		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
-		if err == nil {
-			return addr, nil
-		}
+	if addr, err := resolveUDPAddr(ctx, uri.HostPort()); err == nil {
+		return addr, nil
 	}
 
-	return s.cloneDefaultUpstream()
+	return s.defaultUpstream(msg)
 }
 
-func (s *SIPStack) resolveRegistrarTarget(user, domain string) *net.UDPAddr {
+func (s *SIPStack) resolveRegistrarTarget(ctx context.Context, user, domain string) *net.UDPAddr {
 	if s.registrar == nil || user == "" || domain == "" {
 		return nil
 	}
-	bindings := s.registrar.BindingsFor(user, domain)
+	bindings := s.registrar.bindingsFor(ctx, user, domain)
 	for _, binding := range bindings {
-		contact := contactAddress(binding.Contact)
-		if contact == "" {
-			contact = binding.Contact
-		}
-		if addr, err := sipURIToUDPAddr(contact); err == nil {
+		if addr, err := sipURIToUDPAddr(ctx, binding.Contact); err == nil {
 			return addr
 		}
 	}
 	return nil
 }
 
-func (s *SIPStack) resolveDirectoryTarget(user, domain string) *net.UDPAddr {
+func (s *SIPStack) resolveDirectoryTarget(ctx context.Context, user, domain string) *net.UDPAddr {
 	if user == "" || domain == "" {
 		return nil
 	}
-	if s.directory == nil {
-		return nil
-	}
-	key := registrarKey(user, domain)
-	entry, ok := s.directory[key]
+	s.dirMu.RLock()
+	entry, ok := s.directory[registrarKey(user, domain)]
+	s.dirMu.RUnlock()
 	if !ok {
 		return nil
 	}
 	if entry.ContactURI == "" {
 		return nil
 	}
-	addr, err := sipURIToUDPAddr(entry.ContactURI)
+	addr, err := sipURIToUDPAddr(ctx, entry.ContactURI)
 	if err != nil {
 		return nil
 	}
 	return addr
 }
 
-func (s *SIPStack) cloneDefaultUpstream() (*net.UDPAddr, error) {
+// failover marks down the upstream server req went to and reports whether
+// there is another to retry it on.
+func (s *SIPStack) failover(req *Message) bool {
+	if !s.upstreams.failover(req, time.Now()) {
+		return false
+	}
+	s.logger.Warn("upstream server failed; retrying on the next", messageAttrs(req)...)
+	return true
+}
+
+// defaultUpstream returns the default upstream server msg goes to: the
+// first of the pool not marked down.
+func (s *SIPStack) defaultUpstream(msg *Message) (*net.UDPAddr, error) {
+	if addr := s.upstreams.pick(msg, time.Now()); addr != nil {
+		return addr, nil
+	}
 	if s.upstreamAddr == nil {
 		return nil, fmt.Errorf("sip: no upstream address configured")
 	}
@@ -511,98 +1397,46 @@ func (s *SIPStack) cloneDefaultUpstream() (*net.UDPAddr, error) {
 	return addr, nil
 }
 
-func sipURIToUDPAddr(uri string) (*net.UDPAddr, error) {
-	_, host, port, err := parseSIPURI(uri)
+// sipURIToUDPAddr resolves the URI in a Contact value or directory entry,
+// bracketed or not, to the address to send to.
+func sipURIToUDPAddr(ctx context.Context, contact string) (*net.UDPAddr, error) {
+	uri, err := ParseAddress(contact)
 	if err != nil {
 		return nil, err
 	}
-	if host == "" {
-		return nil, fmt.Errorf("sip: uri missing host")
-	}
-	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	return resolveUDPAddr(ctx, uri.HostPort())
 }
 
-func parseSIPURI(uri string) (user, host, port string, err error) {
-	uri = strings.TrimSpace(uri)
-	if uri == "" {
-		return "", "", "", fmt.Errorf("sip: empty uri")
-	}
-
-	if idx := strings.Index(uri, "<"); idx != -1 {
-		if end := strings.Index(uri[idx:], ">"); end != -1 {
-			uri = uri[idx+1 : idx+end]
-		}
-	}
-	if idx := strings.Index(uri, ">"); idx != -1 {
-		uri = uri[:idx]
-	}
-
-	lower := strings.ToLower(uri)
-	switch {
-	case strings.HasPrefix(lower, "sip:"):
-		uri = uri[4:]
-	case strings.HasPrefix(lower, "sips:"):
-		uri = uri[5:]
-	}
-
-	if idx := strings.Index(uri, "?"); idx != -1 {
-		uri = uri[:idx]
-	}
-	if idx := strings.Index(uri, ";"); idx != -1 {
-		uri = uri[:idx]
+// resolveUDPAddr resolves hostport as net.ResolveUDPAddr does, preferring an
+// IPv4 address, but gives up when ctx ends, such as once the transaction of
+// the message being routed has died.
+func resolveUDPAddr(ctx context.Context, hostport string) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
 	}
-
-	uri = strings.TrimSpace(uri)
-	if uri == "" {
-		return "", "", "", fmt.Errorf("sip: empty uri host")
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
 	}
-
-	hostPort := uri
-	if at := strings.LastIndex(uri, "@"); at != -1 {
-		user = strings.TrimSpace(uri[:at])
-		hostPort = uri[at+1:]
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
 	}
-
-	hostPort = strings.TrimSpace(hostPort)
-	if hostPort == "" {
-		return user, "", "", fmt.Errorf("sip: missing host")
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
 	}
-
-	if strings.HasPrefix(hostPort, "[") {
-		end := strings.Index(hostPort, "]")
-		if end == -1 {
-			return "", "", "", fmt.Errorf("sip: invalid ipv6 literal")
-		}
-		host = strings.TrimSpace(hostPort[1:end])
-		rest := strings.TrimSpace(hostPort[end+1:])
-		if strings.HasPrefix(rest, ":") {
-			port = strings.TrimSpace(rest[1:])
-		}
-	} else {
-		colon := strings.LastIndex(hostPort, ":")
-		if colon != -1 && !strings.Contains(hostPort[colon+1:], ":") {
-			port = strings.TrimSpace(hostPort[colon+1:])
-			host = strings.TrimSpace(hostPort[:colon])
-		} else {
-			host = hostPort
+	best := ips[0]
+	for _, ip := range ips {
+		if ip.Unmap().Is4() {
+			best = ip
+			break
 		}
 	}
-
-	host = strings.Trim(host, "[]")
-	host = strings.TrimSpace(host)
-	if host == "" {
-		return user, "", "", fmt.Errorf("sip: missing host")
-	}
-	if port == "" {
-		port = "5060"
-	}
-	return strings.TrimSpace(user), host, port, nil
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(best.Unmap(), uint16(port))), nil
 }
 
-func convertBroadcastRules(rules []userdb.BroadcastRule) *BroadcastPolicy {
-	if len(rules) == 0 {
-		return nil
-	}
+func convertBroadcastRules(rules []userdb.BroadcastRule) []BroadcastRule {
 	converted := make([]BroadcastRule, 0, len(rules))
 	for _, rule := range rules {
 		targets := make([]string, 0, len(rule.Targets))
@@ -615,10 +1449,7 @@ func convertBroadcastRules(rules []userdb.BroadcastRule) *BroadcastPolicy {
 		}
 		converted = append(converted, BroadcastRule{Address: rule.Address, Targets: targets})
 	}
-	if len(converted) == 0 {
-		return nil
-	}
-	return NewBroadcastPolicy(converted)
+	return converted
 }
 
 func summarizeMessage(msg *Message) string {
@@ -631,6 +1462,19 @@ func summarizeMessage(msg *Message) string {
 	return strconv.Itoa(msg.StatusCode) + " " + msg.ReasonPhrase
 }
 
+// messageAttrs returns the log attributes identifying msg: a one-line
+// summary, its Call-ID, and the branch of its top Via.
+func messageAttrs(msg *Message) []any {
+	if msg == nil {
+		return []any{slog.String("message", summarizeMessage(msg))}
+	}
+	return []any{
+		slog.String("message", summarizeMessage(msg)),
+		slog.String("call_id", strings.TrimSpace(msg.GetHeader("Call-ID"))),
+		slog.String("branch", topViaBranch(msg)),
+	}
+}
+
 func transactionKeyFromMessage(msg *Message) string {
 	if msg == nil {
 		return ""
@@ -681,85 +1525,3 @@ func copyAddr(addr net.Addr) net.Addr {
 	}
 	return addr
 }
-
-type transactionRouter struct {
-	mu     sync.RWMutex
-	routes map[string]routeEntry
-	ttl    time.Duration
-}
-
-type routeEntry struct {
-	addr    net.Addr
-	expires time.Time
-}
-
-func newTransactionRouter(ttl time.Duration) *transactionRouter {
-	if ttl <= 0 {
-		ttl = 5 * time.Minute
-	}
-	return &transactionRouter{
-		routes: make(map[string]routeEntry),
-		ttl:    ttl,
-	}
-}
-
-func (r *transactionRouter) Remember(key string, addr net.Addr) {
-	if r == nil || key == "" || addr == nil {
-		return
-	}
-	addr = copyAddr(addr)
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.routes[key] = routeEntry{addr: addr, expires: time.Now().Add(r.ttl)}
-}
-
-func (r *transactionRouter) Lookup(key string) (net.Addr, bool) {
-	if r == nil || key == "" {
-		return nil, false
-	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	entry, ok := r.routes[key]
-	if !ok {
-		return nil, false
-	}
-	if time.Now().After(entry.expires) {
-		delete(r.routes, key)
-		return nil, false
-	}
-	entry.expires = time.Now().Add(r.ttl)
-	r.routes[key] = entry
-	return entry.addr, true
-}
-
-func (r *transactionRouter) cleanup(now time.Time) {
-	if r == nil {
-		return
-	}
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	for key, entry := range r.routes {
-		if now.After(entry.expires) {
-			delete(r.routes, key)
-		}
-	}
-}
-
-func (r *transactionRouter) RunCleanup(ctx context.Context, interval time.Duration) {
-	if r == nil {
-		return
-	}
-	if interval <= 0 {
-		interval = time.Minute
-	}
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case now := <-ticker.C:
-			r.cleanup(now)
-		}
-	}
-}
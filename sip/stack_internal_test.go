@@ -1,9 +1,20 @@
 package sip
 
 import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
 	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"xylitol4/sip/userdb"
 )
 
 func TestTransactionKeyFromRequest(t *testing.T) {
@@ -27,8 +38,70 @@ func TestTransactionKeyFromResponse(t *testing.T) {
 	}
 }
 
+func TestMessageAttrsIdentifyTransaction(t *testing.T) {
+	var out strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	logger.Info("test", messageAttrs(newInvite())...)
+	for _, want := range []string{
+		`"message":"INVITE sip:bob@example.com"`,
+		`"call_id":"a84b4c76e66710"`,
+		`"branch":"z9hG4bKclient1"`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log line missing %s: %s", want, out.String())
+		}
+	}
+}
+
+func TestViaRecordsSourceForSymmetricResponses(t *testing.T) {
+	source := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40123}
+
+	req := newInvite()
+	req.SetHeader("Via", "SIP/2.0/UDP 10.0.0.5:5060;rport;branch=z9hG4bKnat1", "SIP/2.0/UDP edge.example.com;branch=z9hG4bKedge1")
+	if !stampVia(req, source) {
+		t.Fatalf("expected the Via to be stamped")
+	}
+	vias := req.HeaderList("Via")
+	if len(vias) != 2 || vias[0] != "SIP/2.0/UDP 10.0.0.5:5060;rport=40123;branch=z9hG4bKnat1;received=203.0.113.7" {
+		t.Fatalf("unexpected Via after stamping: %q", vias)
+	}
+	resp := NewResponse(200, "OK")
+	CopyHeaders(resp, req, "Via", "CSeq")
+	if target, symmetric := viaResponseTarget(resp); !symmetric || target != source.String() {
+		t.Fatalf("expected the response to go back to %s, got %q (symmetric %v)", source, target, symmetric)
+	}
+
+	// Without rport only a differing host is recorded, and the response
+	// goes to the received address at the sent-by port.
+	plain := newInvite()
+	plain.SetHeader("Via", "SIP/2.0/UDP 10.0.0.5:5070;branch=z9hG4bKplain1")
+	stampVia(plain, source)
+	if got := plain.GetHeader("Via"); got != "SIP/2.0/UDP 10.0.0.5:5070;branch=z9hG4bKplain1;received=203.0.113.7" {
+		t.Fatalf("unexpected Via without rport: %q", got)
+	}
+	if target, symmetric := viaResponseTarget(plain); symmetric || target != "203.0.113.7:5070" {
+		t.Fatalf("expected the received address at the sent-by port, got %q (symmetric %v)", target, symmetric)
+	}
+
+	direct := newInvite()
+	direct.SetHeader("Via", "SIP/2.0/UDP [2001:db8::1];branch=z9hG4bKv6")
+	if stampVia(direct, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5060}) {
+		t.Fatalf("expected a Via whose host is the source to be left alone, got %q", direct.GetHeader("Via"))
+	}
+	if target, _ := viaResponseTarget(direct); target != "[2001:db8::1]:5060" {
+		t.Fatalf("expected the sent-by address with the default port, got %q", target)
+	}
+	if target, _ := viaResponseTarget(newInvite()); target != "client.example.com:5060" {
+		t.Fatalf("expected the sent-by host name, got %q", target)
+	}
+	direct.SetHeader("Via", "SIP/2.0/UDP client.example.com:5070;branch=z9hG4bKm;maddr=239.255.255.1;received=192.0.2.1")
+	if target, _ := viaResponseTarget(direct); target != "239.255.255.1:5070" {
+		t.Fatalf("expected maddr to take precedence over received, got %q", target)
+	}
+}
+
 func TestTransactionRouterRememberClone(t *testing.T) {
-	router := newTransactionRouter(time.Minute)
+	router := newTransactionRouter(time.Minute, 0)
 	key := "INVITE|z9hG4bKclient1"
 	original := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5060}
 
@@ -52,13 +125,12 @@ func TestTransactionRouterRememberClone(t *testing.T) {
 
 func TestTransactionRouterLookupExtendsTTL(t *testing.T) {
 	ttl := 30 * time.Millisecond
-	router := newTransactionRouter(ttl)
+	router := newTransactionRouter(ttl, 0)
 	key := "INVITE|z9hG4bKclient1"
 	router.Remember(key, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 20), Port: 5060})
 
-	router.mu.RLock()
-	initialExpiry := router.routes[key].expires
-	router.mu.RUnlock()
+	entry := router.shardFor(key).routes[key]
+	initialExpiry := entry.expires.Load()
 
 	time.Sleep(ttl / 2)
 
@@ -66,18 +138,16 @@ func TestTransactionRouterLookupExtendsTTL(t *testing.T) {
 		t.Fatalf("expected lookup to succeed before TTL expires")
 	}
 
-	router.mu.RLock()
-	extendedExpiry := router.routes[key].expires
-	router.mu.RUnlock()
+	extendedExpiry := entry.expires.Load()
 
-	if !extendedExpiry.After(initialExpiry) {
+	if extendedExpiry <= initialExpiry {
 		t.Fatalf("expected TTL to be extended, initial %v, extended %v", initialExpiry, extendedExpiry)
 	}
 }
 
 func TestTransactionRouterExpires(t *testing.T) {
 	ttl := 20 * time.Millisecond
-	router := newTransactionRouter(ttl)
+	router := newTransactionRouter(ttl, 0)
 	key := "INVITE|z9hG4bKclient1"
 	router.Remember(key, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 30), Port: 5060})
 
@@ -87,3 +157,353 @@ func TestTransactionRouterExpires(t *testing.T) {
 		t.Fatalf("expected route to expire after TTL")
 	}
 }
+
+func TestTransactionRouterEvictsLeastRecentlyUsed(t *testing.T) {
+	router := newTransactionRouter(time.Minute, routeShards*2)
+	// Find three keys that land in the same shard, which holds two routes.
+	var keys []string
+	shard := router.shardFor("INVITE|z9hG4bK0")
+	for i := 0; len(keys) < 3; i++ {
+		key := "INVITE|z9hG4bK" + strconv.Itoa(i)
+		if router.shardFor(key) == shard {
+			keys = append(keys, key)
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 40), Port: 5060}
+
+	router.Remember(keys[0], addr)
+	router.Remember(keys[1], addr)
+	if _, ok := router.Lookup(keys[0]); !ok {
+		t.Fatalf("expected %s to be remembered", keys[0])
+	}
+	router.Remember(keys[2], addr)
+
+	if _, ok := router.Lookup(keys[1]); ok {
+		t.Fatalf("expected the least recently used route %s to be evicted", keys[1])
+	}
+	for _, key := range []string{keys[0], keys[2]} {
+		if _, ok := router.Lookup(key); !ok {
+			t.Fatalf("expected %s to survive eviction", key)
+		}
+	}
+	if got := router.Len(); got != 2 {
+		t.Fatalf("expected 2 routes, got %d", got)
+	}
+}
+
+func TestNewSIPStackAcceptsUserStoreWithoutPath(t *testing.T) {
+	if _, err := NewSIPStack(SIPStackConfig{}); err == nil {
+		t.Fatalf("expected error when neither path nor store is configured")
+	}
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	stack, err := NewSIPStack(SIPStackConfig{UserStore: store})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if stack.storeLabel() != "configured user store" {
+		t.Fatalf("unexpected store label %q", stack.storeLabel())
+	}
+}
+
+func TestSIPStackServesOnProvidedSockets(t *testing.T) {
+	listen, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	// ListenAddr is taken by the provided socket, so binding it would fail.
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   listen.LocalAddr().String(),
+		ListenConn:   listen,
+		UpstreamConn: upstream,
+		UserStore:    store,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	if stack.downstreamConn != listen || stack.upstreamConn != upstream {
+		t.Fatalf("expected the stack to use the provided sockets")
+	}
+
+	client, err := net.Dial("udp", listen.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("\r\n\r\n"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != string(keepalivePong) {
+		t.Fatalf("expected a keepalive answer on the provided socket, got %q, %v", buf[:n], err)
+	}
+
+	stack.Stop()
+	if _, err := listen.WriteTo([]byte("x"), client.LocalAddr()); err == nil {
+		t.Fatalf("expected Stop to close the provided socket")
+	}
+}
+
+func TestSIPStackValidateBindsAndReleasesSockets(t *testing.T) {
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	taken, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer taken.Close()
+
+	cfg := SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UpstreamAddr: "127.0.0.1:5070",
+		UserStore:    store,
+	}
+	stack, err := NewSIPStack(cfg)
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Validate(context.Background()); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if stack.downstreamConn != nil || stack.userStore != nil {
+		t.Fatalf("expected Validate to leave the stack unstarted")
+	}
+
+	cfg.ListenAddr = taken.LocalAddr().String()
+	stack, err = NewSIPStack(cfg)
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Validate(context.Background()); err == nil || !strings.Contains(err.Error(), "listen on") {
+		t.Fatalf("expected Validate to fail on a listen address in use, got %v", err)
+	}
+}
+
+func TestSIPStackReloadsDirectoryOnStoreChange(t *testing.T) {
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, userdb.User{Username: "carol", Domain: "new.example", ContactURI: "sip:carol@192.0.2.77"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if _, err := store.CreateBroadcastRule(ctx, userdb.BroadcastRule{
+		Address: "sip:all@new.example",
+		Targets: []userdb.BroadcastTarget{{ContactURI: "sip:carol@192.0.2.77"}},
+	}); err != nil {
+		t.Fatalf("CreateBroadcastRule returned error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stack.dirMu.RLock()
+		_, managed := stack.managedDomains["new.example"]
+		_, known := stack.directory[registrarKey("carol", "new.example")]
+		stack.dirMu.RUnlock()
+		if managed && known && stack.broadcast.Has("sip:all@new.example") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("directory was not reloaded after store change (managed=%v known=%v)", managed, known)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openStackTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+t.Name()+"?mode=memory")
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %v", err)
+	}
+	return db
+}
+
+func TestParsePoolKeepsSourceOrderAndRefusesWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	pool := newParsePool(4, func(d rawDatagram) {
+		<-release
+		mu.Lock()
+		handled[d.addr.String()] = append(handled[d.addr.String()], len(*d.buf))
+		mu.Unlock()
+	})
+
+	peers := []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 5060},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 5060},
+		{IP: net.IPv4(192, 0, 2, 1), Port: 5062},
+	}
+	for i := 1; i <= 10; i++ {
+		for _, peer := range peers {
+			buf := make([]byte, i)
+			if !pool.submit(rawDatagram{buf: &buf, addr: peer}) {
+				t.Fatalf("expected datagram %d from %s to be queued", i, peer)
+			}
+		}
+	}
+
+	blocked := peers[0]
+	refused := false
+	for i := 0; i < parseQueueDepth+1 && !refused; i++ {
+		buf := make([]byte, 100)
+		refused = !pool.submit(rawDatagram{buf: &buf, addr: blocked})
+	}
+	if !refused {
+		t.Fatalf("expected a busy worker's full queue to refuse datagrams")
+	}
+
+	close(release)
+	pool.close()
+	for _, peer := range peers {
+		got := handled[peer.String()]
+		for i := 0; i < 10; i++ {
+			if got[i] != i+1 {
+				t.Fatalf("expected %s's datagrams in arrival order, got %v", peer, got)
+			}
+		}
+	}
+}
+
+func TestBatchConnRoundTripsDatagrams(t *testing.T) {
+	for _, portable := range []bool{false, true} {
+		sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer sender.Close()
+		receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer receiver.Close()
+		out, in := newBatchConn(sender), newBatchConn(receiver)
+		if portable {
+			out.sys, in.sys = nil, nil
+		} else if runtime.GOOS == "linux" && (out.sys == nil || in.sys == nil) {
+			t.Fatalf("expected recvmmsg/sendmmsg batching for UDP sockets on linux")
+		}
+
+		const count = 5
+		batch := make([]batchMessage, count)
+		for i := range batch {
+			batch[i] = batchMessage{Buf: []byte(strings.Repeat("x", i+1)), Addr: receiver.LocalAddr()}
+		}
+		if n, err := out.WriteBatch(batch); err != nil || n != count {
+			t.Fatalf("WriteBatch sent %d, %v; want %d", n, err, count)
+		}
+
+		receiver.SetReadDeadline(time.Now().Add(2 * time.Second))
+		reads, readBufs := newReadBatch()
+		defer releaseReadBatch(readBufs)
+		var got []int
+		for len(got) < count {
+			n, err := in.ReadBatch(reads)
+			if err != nil {
+				t.Fatalf("ReadBatch after %d datagrams: %v", len(got), err)
+			}
+			for _, msg := range reads[:n] {
+				if msg.Addr.String() != sender.LocalAddr().String() {
+					t.Fatalf("expected source %s, got %s", sender.LocalAddr(), msg.Addr)
+				}
+				got = append(got, msg.N)
+			}
+		}
+		for i, n := range got {
+			if n != i+1 {
+				t.Fatalf("portable=%v: expected datagrams in order, got lengths %v", portable, got)
+			}
+		}
+	}
+}
+
+func TestSIPStackReloadIgnoresAliasesInUse(t *testing.T) {
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, userdb.User{Username: "carol", Domain: "users.example"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	for _, domain := range []userdb.Domain{
+		{Name: "a.example", Aliases: []string{"shared.example", "b.example"}, BroadcastNamespace: "rules.example"},
+		{Name: "b.example", Aliases: []string{"shared.example", "users.example", "sip.b.example"}},
+	} {
+		if err := store.CreateDomain(ctx, domain); err != nil {
+			t.Fatalf("CreateDomain returned error: %v", err)
+		}
+	}
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(ctx); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+
+	for alias, want := range map[string]string{
+		"shared.example": "a.example",
+		"b.example":      "b.example",
+		"users.example":  "",
+		"sip.b.example":  "b.example",
+	} {
+		if got := stack.domainSettings(alias).Name; got != want {
+			t.Errorf("%s: expected settings of %q, got %q", alias, want, got)
+		}
+		// An alias shares its domain's settings, refused aliases left out.
+		if got, primary := stack.domainSettings(alias).Aliases, stack.domainSettings(want).Aliases; !slices.Equal(got, primary) {
+			t.Errorf("%s: expected aliases %q, got %q", alias, primary, got)
+		}
+	}
+	if got := stack.domainSettings("shared.example").Aliases; !slices.Equal(got, []string{"shared.example"}) {
+		t.Errorf("expected a.example to keep only shared.example, got %q", got)
+	}
+	stack.broadcast.Replace([]BroadcastRule{{Address: "sip:all@rules.example", Targets: []string{"sip:carol@users.example"}}})
+	if !stack.broadcast.Has("sip:all@shared.example") {
+		t.Fatalf("expected an alias to use its domain's broadcast namespace")
+	}
+}
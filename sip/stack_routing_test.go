@@ -1,7 +1,11 @@
 package sip
 
 import (
+	"context"
+	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,10 +16,12 @@ func TestSelectUpstreamTargetUsesRegistrarBinding(t *testing.T) {
 	registrar := NewRegistrar(nil)
 	now := time.Now()
 	registrar.clock = func() time.Time { return now }
-	registrar.bindings[registrarKey("bob", "example.com")] = []registrationBinding{{
-		contact: "<sip:bob@192.0.2.55:5070>",
-		expires: now.Add(time.Hour),
-	}}
+	if err := registrar.bindings.PutBinding(context.Background(), registrarKey("bob", "example.com"), Registration{
+		Contact: "<sip:bob@192.0.2.55:5070>",
+		Expires: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("PutBinding returned error: %v", err)
+	}
 
 	stack := &SIPStack{
 		registrar:      registrar,
@@ -37,6 +43,26 @@ func TestSelectUpstreamTargetUsesRegistrarBinding(t *testing.T) {
 	}
 }
 
+func TestSelectUpstreamTargetResolvesDomainAliases(t *testing.T) {
+	domain := userdb.Domain{Name: "example.com", Aliases: []string{"192.0.2.1"}}
+	stack := &SIPStack{
+		managedDomains: map[string]struct{}{"example.com": {}, "192.0.2.1": {}},
+		domains:        map[string]userdb.Domain{"example.com": domain, "192.0.2.1": domain},
+		directory: map[string]userdb.User{
+			registrarKey("bob", "example.com"): {Username: "bob", Domain: "example.com", ContactURI: "sip:bob@198.51.100.10:5090"},
+		},
+		upstreamAddr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060},
+	}
+
+	addr, err := stack.selectUpstreamTarget(NewRequest("INVITE", "sip:bob@192.0.2.1"))
+	if err != nil {
+		t.Fatalf("selectUpstreamTarget returned error: %v", err)
+	}
+	if got := addr.String(); got != "198.51.100.10:5090" {
+		t.Fatalf("expected the alias to reach the domain's user, got %s", got)
+	}
+}
+
 func TestSelectUpstreamTargetFallsBackToDirectory(t *testing.T) {
 	stack := &SIPStack{
 		managedDomains: map[string]struct{}{"example.com": {}},
@@ -63,6 +89,32 @@ func TestSelectUpstreamTargetFallsBackToDirectory(t *testing.T) {
 	}
 }
 
+func TestSelectUpstreamTargetSkipsDisabledUser(t *testing.T) {
+	registrar := NewRegistrar(nil)
+	key := registrarKey("bob", "192.0.2.1")
+	if err := registrar.bindings.PutBinding(context.Background(), key, Registration{
+		Contact: "<sip:bob@192.0.2.55:5070>",
+		Expires: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("PutBinding returned error: %v", err)
+	}
+	stack := &SIPStack{
+		registrar:      registrar,
+		managedDomains: map[string]struct{}{"192.0.2.1": {}},
+		directory:      make(map[string]userdb.User),
+		disabledUsers:  map[string]struct{}{key: {}},
+		upstreamAddr:   &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060},
+	}
+
+	addr, err := stack.selectUpstreamTarget(NewRequest("INVITE", "sip:bob@192.0.2.1"))
+	if err != nil {
+		t.Fatalf("selectUpstreamTarget returned error: %v", err)
+	}
+	if got := addr.String(); got != "192.0.2.1:5060" {
+		t.Fatalf("expected disabled user to fall through to Request-URI resolution, got %s", got)
+	}
+}
+
 func TestSelectUpstreamTargetResolvesRequestURI(t *testing.T) {
 	stack := &SIPStack{
 		managedDomains: make(map[string]struct{}),
@@ -109,3 +161,124 @@ func TestSelectUpstreamTargetErrorsWithoutRoute(t *testing.T) {
 		t.Fatalf("expected error when no route is available")
 	}
 }
+
+func TestSelectUpstreamTargetReturnsResponsesToRequestSource(t *testing.T) {
+	fallback := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060}
+	stack := &SIPStack{upstreamAddr: fallback}
+	source := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 20), Port: 31000}
+
+	bye := NewRequest("BYE", "sip:alice@client.example.com")
+	bye.SetHeader("Via", "SIP/2.0/UDP callee.example.com;branch=z9hG4bKbye1;rport")
+	bye.SetHeader("CSeq", "2 BYE")
+	stampVia(bye, source)
+	if got := bye.GetHeader("Via"); got != "SIP/2.0/UDP callee.example.com;branch=z9hG4bKbye1;rport=31000;received=198.51.100.20" {
+		t.Fatalf("unexpected stamped Via: %q", got)
+	}
+
+	resp := NewResponse(200, "OK")
+	CopyHeaders(resp, bye, "Via", "CSeq")
+	addr, err := stack.selectUpstreamTarget(resp)
+	if err != nil || addr.String() != source.String() {
+		t.Fatalf("expected the response to go to %s, got %v, %v", source, addr, err)
+	}
+
+	resp.SetHeader("Via", "SIP/2.0/UDP callee.example.com;branch=z9hG4bKbye1")
+	if addr, err := stack.selectUpstreamTarget(resp); err != nil || addr.String() != fallback.String() {
+		t.Fatalf("expected a response without rport to use the upstream, got %v, %v", addr, err)
+	}
+}
+
+func TestResolveDownstreamTargetFallsBackToVia(t *testing.T) {
+	stack := &SIPStack{
+		routes: newTransactionRouter(time.Minute, 0),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	remembered := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 50), Port: 5099}
+	stack.routes.Remember("INVITE|z9hG4bKcached", remembered)
+
+	resp := NewResponse(180, "Ringing")
+	resp.SetHeader("CSeq", "1 INVITE")
+	resp.SetHeader("Via", "SIP/2.0/UDP 10.0.0.5:5062;branch=z9hG4bKcached;received=192.0.2.60")
+	if addr := stack.resolveDownstreamTarget(resp); addr == nil || addr.String() != remembered.String() {
+		t.Fatalf("expected the cached route %s, got %v", remembered, addr)
+	}
+
+	resp.SetHeader("Via", "SIP/2.0/UDP 10.0.0.5:5062;branch=z9hG4bKforgotten;received=192.0.2.60")
+	if addr := stack.resolveDownstreamTarget(resp); addr == nil || addr.String() != "192.0.2.60:5062" {
+		t.Fatalf("expected the received address at the sent-by port, got %v", addr)
+	}
+
+	resp.SetHeader("Via", "SIP/2.0/UDP localhost:5070;branch=z9hG4bKforgotten")
+	if addr := stack.resolveDownstreamTarget(resp); addr == nil || !strings.HasSuffix(addr.String(), ":5070") {
+		t.Fatalf("expected the sent-by host name to be resolved, got %v", addr)
+	}
+
+	req := NewRequest("BYE", "sip:alice@client.example.com")
+	req.SetHeader("Via", "SIP/2.0/UDP 10.0.0.5:5062;branch=z9hG4bKforgotten")
+	if addr := stack.resolveDownstreamTarget(req); addr != nil {
+		t.Fatalf("expected a request without a route to be dropped, got %v", addr)
+	}
+}
+
+func TestResolveUDPAddrGivesUpWithContext(t *testing.T) {
+	addr, err := resolveUDPAddr(context.Background(), "[2001:db8::1]:5070")
+	if err != nil || addr.String() != "[2001:db8::1]:5070" {
+		t.Fatalf("expected a literal address to resolve, got %v, %v", addr, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolveUDPAddr(ctx, "sip.invalid:5060"); err == nil {
+		t.Fatalf("expected resolution to fail once the context has ended")
+	}
+}
+
+func TestUpstreamPoolFailsOverAndRecoversOnPing(t *testing.T) {
+	primary := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060}
+	backup := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 5060}
+	pool := newUpstreamPool([]*net.UDPAddr{primary, backup}, 0, time.Minute)
+	now := time.Now()
+
+	first := newOptions()
+	if addr := pool.pick(first, now); addr.String() != primary.String() {
+		t.Fatalf("expected the primary first, got %v", addr)
+	}
+	if !pool.failover(first, now) {
+		t.Fatalf("expected failover to the backup")
+	}
+	second := newInvite()
+	if addr := pool.pick(second, now); addr.String() != backup.String() {
+		t.Fatalf("expected the backup while the primary is down, got %v", addr)
+	}
+	if addr := pool.pick(first, now); addr.String() != primary.String() {
+		t.Fatalf("expected retransmissions to stay with their server, got %v", addr)
+	}
+	if pool.failover(second, now) {
+		t.Fatalf("expected no failover once every server is down")
+	}
+	if addr := pool.pick(newRequestWithBranch("z9hG4bKthird"), now); addr.String() != primary.String() {
+		t.Fatalf("expected the primary while every server is down, got %v", addr)
+	}
+
+	pool.servers[1].probe.start("z9hG4bKping", now, time.Minute)
+	pong := NewResponse(200, "OK")
+	pong.SetHeader("Via", "SIP/2.0/UDP 127.0.0.1:5070;branch=z9hG4bKping")
+	if !pool.answer(pong) {
+		t.Fatalf("expected the ping answer to be consumed")
+	}
+	if addr := pool.pick(newRequestWithBranch("z9hG4bKfourth"), now); addr.String() != backup.String() {
+		t.Fatalf("expected the backup to be back after answering a ping, got %v", addr)
+	}
+
+	held := newUpstreamPool([]*net.UDPAddr{primary, backup}, time.Second, time.Minute)
+	held.pick(first, now)
+	held.failover(first, now)
+	if addr := held.pick(newRequestWithBranch("z9hG4bKfifth"), now.Add(time.Second)); addr.String() != primary.String() {
+		t.Fatalf("expected the primary back after its hold-down, got %v", addr)
+	}
+}
+
+func newRequestWithBranch(branch string) *Message {
+	req := newOptions()
+	req.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch="+branch)
+	return req
+}
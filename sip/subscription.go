@@ -0,0 +1,540 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription lifetimes, in seconds: what a SUBSCRIBE without Expires is
+// granted, the longest granted, and the shortest accepted (RFC 6665 section
+// 4.2.1.1).
+const (
+	defaultSubscriptionExpires = 3600
+	maxSubscriptionExpires     = 3600
+	minSubscriptionExpires     = 60
+)
+
+// subscriptionSweep is how often subscriptions are checked for expiry.
+const subscriptionSweep = time.Second
+
+// maxSubscriptions bounds the subscriptions held at once, and
+// maxSubscriptionsPerSubscriber those of any one subscriber, so that
+// SUBSCRIBE requests cannot exhaust the proxy's memory. Beyond them new
+// subscriptions are refused with 503 and 403 respectively.
+const (
+	maxSubscriptions              = 10000
+	maxSubscriptionsPerSubscriber = 100
+)
+
+// EventPackage is an event package (RFC 6665 section 7), such as presence or
+// dialog, whose state the proxy serves to subscribers. Its methods are called
+// from the proxy core's goroutine, one at a time.
+type EventPackage interface {
+	// Event is the package name carried in the Event header.
+	Event() string
+	// Authorize decides whether sub may be created, returning zero to
+	// accept it or the status, such as 403 or 404, to refuse it with.
+	Authorize(ctx context.Context, sub *Subscription) int
+	// State returns the body of a NOTIFY describing the state of
+	// sub.Resource, and its content type; an empty content type sends the
+	// NOTIFY without a body.
+	State(ctx context.Context, sub *Subscription) (contentType, body string)
+}
+
+// Subscription is one subscription of a watcher to the state of a resource,
+// as event packages see it.
+type Subscription struct {
+	// Event is the package name and ID the id parameter of the Event
+	// header, which tells apart subscriptions sharing a dialog.
+	Event string
+	ID    string
+	// Resource is the user@domain the SUBSCRIBE was addressed to, and
+	// Subscriber the user@domain it came from, with domain aliases
+	// resolved.
+	Resource   string
+	Subscriber string
+	// Identity is the user@domain the subscriber authenticated as, empty
+	// when the proxy has no registrar to authenticate them.
+	Identity string
+	// Accept lists the body types the subscriber accepts, empty when it
+	// gave none.
+	Accept  []string
+	Expires time.Time
+
+	// The dialog the NOTIFY requests are sent in: the From and To headers
+	// they carry, the Request-URI and route set from the SUBSCRIBE's
+	// Contact and Record-Route, and the last CSeq number used.
+	callID string
+	from   string
+	to     string
+	target string
+	routes []string
+	cseq   int
+	// header is the Event header NOTIFY requests carry.
+	header string
+}
+
+// Subscriptions makes the proxy the notifier (RFC 6665) for the event
+// packages registered with it. Every SUBSCRIBE outside a dialog is answered
+// by the proxy: with 489 Bad Event when its package is unknown, and otherwise
+// by creating a subscription, sending a NOTIFY with the resource's state at
+// once, whenever Changed reports the state changed, and when the
+// subscription ends. Its subscriptions belong to the proxy core's goroutine;
+// Changed may be called from any goroutine.
+type Subscriptions struct {
+	packages map[string]EventPackage
+	now      func() time.Time
+	// limit and perSubscriber are maxSubscriptions and
+	// maxSubscriptionsPerSubscriber, which tests lower.
+	limit         int
+	perSubscriber int
+
+	// changed holds the event packages and resources whose state changed
+	// and have not been notified yet, and signal wakes the proxy core to
+	// notify them.
+	mu      sync.Mutex
+	changed map[[2]string]struct{}
+	signal  chan struct{}
+
+	active   map[string]*Subscription // keyed by subscriptionKey
+	notifies map[string]string        // NOTIFY client transaction to subscription key
+}
+
+// NewSubscriptions returns Subscriptions serving packages; a later package
+// with the same event name replaces an earlier one.
+func NewSubscriptions(packages ...EventPackage) *Subscriptions {
+	s := &Subscriptions{
+		packages: make(map[string]EventPackage, len(packages)),
+		now:      time.Now,
+		changed:  make(map[[2]string]struct{}),
+		signal:   make(chan struct{}, 1),
+		active:   make(map[string]*Subscription),
+		notifies: make(map[string]string),
+
+		limit:         maxSubscriptions,
+		perSubscriber: maxSubscriptionsPerSubscriber,
+	}
+	for _, pkg := range packages {
+		s.packages[strings.ToLower(pkg.Event())] = pkg
+	}
+	return s
+}
+
+// Changed reports that the state of resource, as user@domain, changed in the
+// event package event, so that its subscribers are sent a NOTIFY. It never
+// blocks; changes reported before the proxy core gets to them are notified
+// once.
+func (s *Subscriptions) Changed(event, resource string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.changed[[2]string{strings.ToLower(event), strings.ToLower(resource)}] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// eventPackages builds the event packages named, as SIPStackConfig's
+// EventPackages lists them, returning the Subscriptions serving them and the
+// Presence and DialogInfo among them; all are nil when names is empty.
+func eventPackages(names []string) (*Subscriptions, *Presence, *DialogInfo, error) {
+	var packages []EventPackage
+	var presence *Presence
+	var dialogs *DialogInfo
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "presence":
+			if presence == nil {
+				presence = NewPresence()
+				packages = append(packages, presence)
+			}
+		case "dialog":
+			if dialogs == nil {
+				dialogs = NewDialogInfo()
+				packages = append(packages, dialogs)
+			}
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown event package %q", name)
+		}
+	}
+	if len(packages) == 0 {
+		return nil, nil, nil, nil
+	}
+	return NewSubscriptions(packages...), presence, dialogs, nil
+}
+
+// wake returns the channel that signals reported changes, or nil, which
+// never does, for nil Subscriptions.
+func (s *Subscriptions) wake() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.signal
+}
+
+// takeChanged returns and forgets the changes reported since the last call.
+func (s *Subscriptions) takeChanged() [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := make([][2]string, 0, len(s.changed))
+	for change := range s.changed {
+		changes = append(changes, change)
+	}
+	clear(s.changed)
+	return changes
+}
+
+// count returns the number of subscriptions subscriber holds.
+func (s *Subscriptions) count(subscriber string) int {
+	n := 0
+	for _, sub := range s.active {
+		if sub.Subscriber == subscriber {
+			n++
+		}
+	}
+	return n
+}
+
+// allowEvents lists the packages served, for the Allow-Events header.
+func (s *Subscriptions) allowEvents() string {
+	events := make([]string, 0, len(s.packages))
+	for event := range s.packages {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return strings.Join(events, ", ")
+}
+
+// subscriptionKey identifies a subscription by its dialog, as seen from the
+// notifier, and its Event header.
+func subscriptionKey(callID, localTag, remoteTag, event, id string) string {
+	return callID + "|" + localTag + "|" + remoteTag + "|" + strings.ToLower(event) + "|" + id
+}
+
+// parseEventHeader splits an Event header into its package name, in lower
+// case, and its id parameter.
+func parseEventHeader(value string) (string, string) {
+	event, _, _ := strings.Cut(value, ";")
+	return strings.ToLower(strings.TrimSpace(event)), GetHeaderParam(value, "id")
+}
+
+// handleSubscribe answers req when it is a SUBSCRIBE the proxy is the
+// notifier for, reporting whether it was: one outside a dialog, or one
+// refreshing or ending a subscription the proxy holds. SUBSCRIBE requests
+// inside other dialogs are forwarded. With a registrar, only its users may
+// subscribe, and they must authenticate as for MESSAGE.
+func (t *transactionUser) handleSubscribe(ctx context.Context, event tuEvent, req *Message) bool {
+	subs := t.subscriptions
+	if subs == nil || !strings.EqualFold(req.Method, "SUBSCRIBE") {
+		return false
+	}
+	t.expireSubscriptions(ctx)
+	name, id := parseEventHeader(req.GetHeader("Event"))
+	callID := req.GetHeader("Call-ID")
+	localTag := GetHeaderParam(req.GetHeader("To"), "tag")
+	remoteTag := GetHeaderParam(req.GetHeader("From"), "tag")
+	respond := func(status int, reason string, headers ...string) {
+		resp := NewResponse(status, reason)
+		CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+		ensureToTag(resp)
+		for i := 0; i+1 < len(headers); i += 2 {
+			resp.SetHeader(headers[i], headers[i+1])
+		}
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+	}
+
+	if localTag != "" {
+		key := subscriptionKey(callID, localTag, remoteTag, name, id)
+		sub, ok := subs.active[key]
+		if !ok {
+			return false
+		}
+		expires, ok := subscriptionExpires(req)
+		if !ok {
+			respond(423, "Interval Too Brief", "Min-Expires", strconv.Itoa(minSubscriptionExpires))
+			return true
+		}
+		sub.Expires = subs.now().Add(time.Duration(expires) * time.Second)
+		if target := contactTarget(req); target != "" {
+			sub.target = target
+		}
+		respond(200, "OK", "Expires", strconv.Itoa(expires), "Contact", t.notifierContact())
+		if expires == 0 {
+			t.endSubscription(ctx, key, sub, "timeout")
+			return true
+		}
+		t.notify(ctx, key, sub, "active")
+		return true
+	}
+
+	pkg, ok := subs.packages[name]
+	if !ok {
+		respond(489, "Bad Event", "Allow-Events", subs.allowEvents())
+		return true
+	}
+	var identity string
+	if t.registrar != nil {
+		var resp *Message
+		if identity, resp = t.registrar.authenticateSender(req.Context(), req); resp != nil {
+			t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+			return true
+		}
+		if identity == "" {
+			respond(403, "Forbidden")
+			return true
+		}
+	}
+	target := contactTarget(req)
+	if target == "" {
+		respond(400, "Bad Request")
+		return true
+	}
+	expires, ok := subscriptionExpires(req)
+	if !ok {
+		respond(423, "Interval Too Brief", "Min-Expires", strconv.Itoa(minSubscriptionExpires))
+		return true
+	}
+	sub := &Subscription{
+		Event:   name,
+		ID:      id,
+		Accept:  req.HeaderList("Accept"),
+		Expires: subs.now().Add(time.Duration(expires) * time.Second),
+		callID:  callID,
+		to:      req.GetHeader("From"),
+		target:  target,
+		routes:  req.HeaderList("Record-Route"),
+		header:  req.GetHeader("Event"),
+	}
+	if user, domain, err := parseAddressOfRecord(req.GetHeader("From")); err == nil {
+		sub.Subscriber = registrarKey(user, t.canonicalDomain(domain))
+	}
+	if uri, err := ParseURI(req.RequestURI); err == nil {
+		sub.Resource = registrarKey(uri.User, t.canonicalDomain(uri.Host))
+	}
+	sub.Identity = identity
+	if status := pkg.Authorize(req.Context(), sub); status != 0 {
+		respond(status, statusReason(status))
+		return true
+	}
+	if expires > 0 {
+		if len(subs.active) >= subs.limit {
+			respond(503, "Service Unavailable")
+			return true
+		}
+		if subs.count(sub.Subscriber) >= subs.perSubscriber {
+			respond(403, "Too Many Subscriptions")
+			return true
+		}
+	}
+	localTag = newTag()
+	sub.from = replaceHeaderParam(req.GetHeader("To"), "tag", localTag)
+	resp := NewResponse(200, "OK")
+	CopyHeaders(resp, req, "Via", "From", "Call-ID", "CSeq")
+	resp.SetHeader("To", sub.from)
+	resp.SetHeader("Expires", strconv.Itoa(expires))
+	resp.SetHeader("Contact", t.notifierContact())
+	t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+
+	key := subscriptionKey(callID, localTag, remoteTag, name, id)
+	if expires == 0 {
+		// A fetch: the state is sent once and the subscription ends.
+		t.endSubscription(ctx, key, sub, "timeout")
+		return true
+	}
+	subs.active[key] = sub
+	t.notify(ctx, key, sub, "active")
+	return true
+}
+
+// subscriptionExpires returns the lifetime, in seconds, to grant the
+// SUBSCRIBE req, or false when it asks for less than the minimum.
+func subscriptionExpires(req *Message) (int, bool) {
+	raw := strings.TrimSpace(req.GetHeader("Expires"))
+	if raw == "" {
+		return defaultSubscriptionExpires, true
+	}
+	expires, err := strconv.Atoi(raw)
+	if err != nil || expires < 0 {
+		return defaultSubscriptionExpires, true
+	}
+	if expires == 0 {
+		return 0, true
+	}
+	if expires < minSubscriptionExpires {
+		return 0, false
+	}
+	return min(expires, maxSubscriptionExpires), true
+}
+
+// contactTarget returns the URI of req's Contact, or "" when it has none.
+func contactTarget(req *Message) string {
+	contacts := req.HeaderList("Contact")
+	if len(contacts) == 0 {
+		return ""
+	}
+	uri, err := ParseAddress(contacts[0])
+	if err != nil {
+		return ""
+	}
+	return uri.String()
+}
+
+// canonicalDomain resolves a domain alias when the proxy has a registrar.
+func (t *transactionUser) canonicalDomain(domain string) string {
+	if t.registrar == nil {
+		return domain
+	}
+	return t.registrar.canonicalDomain(domain)
+}
+
+// notifierContact is the Contact the proxy gives as notifier, which
+// subscribers send their refreshes to.
+func (t *transactionUser) notifierContact() string {
+	host := "proxy.local"
+	if len(t.localNames) > 0 {
+		host = t.localNames[0]
+	}
+	return "<sip:" + host + ">"
+}
+
+// statusReason is the reason phrase sent with a package's refusal.
+func statusReason(status int) string {
+	switch status {
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not Found"
+	case 406:
+		return "Not Acceptable"
+	case 480:
+		return "Temporarily Unavailable"
+	}
+	return "Refused"
+}
+
+// notify sends sub's subscriber a NOTIFY with the resource's state and
+// state, the Subscription-State value: active, or terminated once the
+// subscription has ended.
+func (t *transactionUser) notify(ctx context.Context, key string, sub *Subscription, state string) {
+	pkg, ok := t.subscriptions.packages[sub.Event]
+	if !ok {
+		return
+	}
+	notify := NewRequest("NOTIFY", sub.target)
+	notify.SetHeader("From", sub.from)
+	notify.SetHeader("To", sub.to)
+	notify.SetHeader("Call-ID", sub.callID)
+	sub.cseq++
+	notify.SetHeader("CSeq", formatCSeq(sub.cseq, "NOTIFY"))
+	notify.SetHeader("Max-Forwards", "70")
+	notify.SetHeader("Contact", t.notifierContact())
+	notify.SetHeader("Event", sub.header)
+	if state == "active" {
+		remaining := int(sub.Expires.Sub(t.subscriptions.now()).Round(time.Second) / time.Second)
+		state += ";expires=" + strconv.Itoa(max(remaining, 0))
+	}
+	notify.SetHeader("Subscription-State", state)
+	if len(sub.routes) > 0 {
+		notify.SetHeader("Route", sub.routes...)
+		if route, err := ParseAddress(sub.routes[0]); err == nil {
+			notify.nextHop = route.HostPort()
+		}
+	} else if target, err := ParseURI(sub.target); err == nil {
+		notify.nextHop = target.HostPort()
+	}
+	if contentType, body := pkg.State(ctx, sub); contentType != "" {
+		notify.SetHeader("Content-Type", contentType)
+		notify.Body = body
+	}
+	branch := newBranchID()
+	prependVia(notify, branch)
+	clientTxID := transactionKey(branch, "NOTIFY")
+	t.subscriptions.notifies[clientTxID] = key
+	t.sendAction(ctx, tuAction{Kind: tuActionForwardRequest, ClientTxID: clientTxID, Message: notify})
+}
+
+// endSubscription removes sub, sending its last NOTIFY with reason.
+func (t *transactionUser) endSubscription(ctx context.Context, key string, sub *Subscription, reason string) {
+	delete(t.subscriptions.active, key)
+	t.notify(ctx, key, sub, "terminated;reason="+reason)
+}
+
+// notifyResponse consumes the response to a NOTIFY the proxy sent,
+// reporting whether resp was one. A subscriber answering with an error, or
+// not at all, no longer has the subscription, so it is removed.
+func (t *transactionUser) notifyResponse(event tuEvent, resp *Message) bool {
+	if t.subscriptions == nil {
+		return false
+	}
+	key, ok := t.subscriptions.notifies[event.ClientTxID]
+	if !ok {
+		return false
+	}
+	if resp.StatusCode >= 200 {
+		delete(t.subscriptions.notifies, event.ClientTxID)
+	}
+	if event.TimedOut || resp.StatusCode >= 300 {
+		delete(t.subscriptions.active, key)
+	}
+	return true
+}
+
+// notifyChanged sends a NOTIFY to the subscribers of each resource whose
+// state was reported changed.
+func (t *transactionUser) notifyChanged(ctx context.Context) {
+	changes := t.subscriptions.takeChanged()
+	keys := make([]string, 0, len(t.subscriptions.active))
+	for key := range t.subscriptions.active {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sub := t.subscriptions.active[key]
+		if slices.Contains(changes, [2]string{sub.Event, sub.Resource}) {
+			t.notify(ctx, key, sub, "active")
+		}
+	}
+}
+
+// notifyResource sends a NOTIFY at once to the subscribers of resource in
+// the event package event, for a package whose every change must be seen
+// rather than the latest state.
+func (t *transactionUser) notifyResource(ctx context.Context, event, resource string) {
+	if t.subscriptions == nil {
+		return
+	}
+	keys := make([]string, 0, len(t.subscriptions.active))
+	for key, sub := range t.subscriptions.active {
+		if sub.Event == event && sub.Resource == resource {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t.notify(ctx, key, t.subscriptions.active[key], "active")
+	}
+}
+
+// expireSubscriptions ends the subscriptions that were not refreshed in
+// time.
+func (t *transactionUser) expireSubscriptions(ctx context.Context) {
+	if t.subscriptions == nil {
+		return
+	}
+	now := t.subscriptions.now()
+	for key, sub := range t.subscriptions.active {
+		if !sub.Expires.After(now) {
+			t.endSubscription(ctx, key, sub, "timeout")
+		}
+	}
+}
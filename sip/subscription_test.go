@@ -0,0 +1,197 @@
+package sip
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+// stubPackage serves a counter as the state of every resource but
+// forbidden@example.com.
+type stubPackage struct {
+	state atomic.Int32
+}
+
+func (p *stubPackage) Event() string { return "test" }
+
+func (p *stubPackage) Authorize(ctx context.Context, sub *Subscription) int {
+	if sub.Resource == "forbidden@example.com" {
+		return 403
+	}
+	return 0
+}
+
+func (p *stubPackage) State(ctx context.Context, sub *Subscription) (string, string) {
+	return "text/plain", sub.Resource + "=" + string(rune('0'+p.state.Load()))
+}
+
+func newSubscribe(target, event, branch string) *Message {
+	msg := NewRequest("SUBSCRIBE", target)
+	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bK"+branch)
+	msg.SetHeader("From", "<sip:alice@example.com>;tag=watcher")
+	msg.SetHeader("To", "<"+target+">")
+	msg.SetHeader("Call-ID", "sub-"+branch+"@client.example")
+	msg.SetHeader("CSeq", "1 SUBSCRIBE")
+	msg.SetHeader("Max-Forwards", "70")
+	msg.SetHeader("Contact", "<sip:alice@192.0.2.10:5062>")
+	msg.SetHeader("Event", event)
+	msg.SetHeader("Expires", "600")
+	return msg
+}
+
+// nextNotify returns the next NOTIFY the proxy sends, answering it with 200.
+func nextNotify(t *testing.T, proxy *Proxy) *Message {
+	t.Helper()
+	notify, ok := proxy.NextToServer(200 * time.Millisecond)
+	if !ok || notify.Method != "NOTIFY" {
+		t.Fatalf("expected a NOTIFY, got %v", notify)
+	}
+	proxy.SendFromServer(buildResponseFrom(notify, 200, "OK"))
+	return notify
+}
+
+func TestProxyServesSubscriptions(t *testing.T) {
+	pkg := &stubPackage{}
+	subs := NewSubscriptions(pkg)
+	proxy := NewProxy(WithSubscriptions(subs))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "test", "first"))
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 200 || resp.GetHeader("Expires") != "600" {
+		t.Fatalf("expected the subscription to be accepted, got %v", resp)
+	}
+	localTag := GetHeaderParam(resp.GetHeader("To"), "tag")
+	if localTag == "" || resp.GetHeader("Contact") == "" {
+		t.Fatalf("expected a To tag and Contact, got %v", resp)
+	}
+
+	notify := nextNotify(t, proxy)
+	if notify.RequestURI != "sip:alice@192.0.2.10:5062" || notify.nextHop != "192.0.2.10:5062" {
+		t.Fatalf("expected the NOTIFY at the subscriber's contact, got %q via %q", notify.RequestURI, notify.nextHop)
+	}
+	if GetHeaderParam(notify.GetHeader("From"), "tag") != localTag || notify.GetHeader("To") != "<sip:alice@example.com>;tag=watcher" {
+		t.Fatalf("expected the NOTIFY in the subscription's dialog, got From %q To %q", notify.GetHeader("From"), notify.GetHeader("To"))
+	}
+	if state := notify.GetHeader("Subscription-State"); !strings.HasPrefix(state, "active;expires=") || notify.Body != "bob@example.com=0" {
+		t.Fatalf("unexpected NOTIFY %q with %q", state, notify.Body)
+	}
+
+	pkg.state.Store(1)
+	subs.Changed("test", "bob@example.com")
+	changed := nextNotify(t, proxy)
+	if changed.GetHeader("CSeq") != "2 NOTIFY" || changed.Body != "bob@example.com=1" {
+		t.Fatalf("expected a NOTIFY with the new state, got %q with %q", changed.GetHeader("CSeq"), changed.Body)
+	}
+
+	unsubscribe := newSubscribe("sip:bob@example.com", "test", "second")
+	unsubscribe.RequestURI = "sip:proxy.local"
+	unsubscribe.SetHeader("To", resp.GetHeader("To"))
+	unsubscribe.SetHeader("Call-ID", "sub-first@client.example")
+	unsubscribe.SetHeader("CSeq", "2 SUBSCRIBE")
+	unsubscribe.SetHeader("Expires", "0")
+	proxy.SendFromClient(unsubscribe)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the unsubscription to be accepted, got %v", resp)
+	}
+	if last := nextNotify(t, proxy); last.GetHeader("Subscription-State") != "terminated;reason=timeout" {
+		t.Fatalf("expected a final NOTIFY, got %q", last.GetHeader("Subscription-State"))
+	}
+	subs.Changed("test", "bob@example.com")
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected no NOTIFY after the subscription ended, got %v", msg)
+	}
+}
+
+func TestProxyRefusesSubscriptions(t *testing.T) {
+	subs := NewSubscriptions(&stubPackage{})
+	proxy := NewProxy(WithSubscriptions(subs))
+	t.Cleanup(proxy.Stop)
+
+	for _, tt := range []struct {
+		name   string
+		req    *Message
+		status int
+		header string
+		value  string
+	}{
+		{"unknown package", newSubscribe("sip:bob@example.com", "presence", "unknown"), 489, "Allow-Events", "test"},
+		{"unauthorized", newSubscribe("sip:forbidden@example.com", "test", "forbidden"), 403, "", ""},
+		{"too brief", func() *Message {
+			req := newSubscribe("sip:bob@example.com", "test", "brief")
+			req.SetHeader("Expires", "10")
+			return req
+		}(), 423, "Min-Expires", "60"},
+	} {
+		proxy.SendFromClient(tt.req)
+		resp, ok := proxy.NextToClient(100 * time.Millisecond)
+		if !ok || resp.StatusCode != tt.status || tt.header != "" && resp.GetHeader(tt.header) != tt.value {
+			t.Fatalf("%s: expected %d, got %v", tt.name, tt.status, resp)
+		}
+	}
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected refused subscriptions not to be notified, got %v", msg)
+	}
+}
+
+func TestProxyExpiresSubscriptions(t *testing.T) {
+	var offset atomic.Int64
+	subs := NewSubscriptions(&stubPackage{})
+	subs.now = func() time.Time { return time.Now().Add(time.Duration(offset.Load())) }
+	proxy := NewProxy(WithSubscriptions(subs))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "test", "expiring"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the subscription to be accepted, got %v", resp)
+	}
+	nextNotify(t, proxy)
+	offset.Store(int64(time.Hour))
+	notify, ok := proxy.NextToServer(2 * subscriptionSweep)
+	if !ok || notify.GetHeader("Subscription-State") != "terminated;reason=timeout" {
+		t.Fatalf("expected a final NOTIFY once the subscription expired, got %v", notify)
+	}
+}
+
+func TestProxyAuthenticatesSubscribers(t *testing.T) {
+	store := newMemoryStore()
+	store.add(&userdb.User{Username: "alice", Domain: "example.com", PasswordHash: md5Hex("alice:example.com:secret")})
+	proxy := NewProxy(WithRegistrar(NewRegistrar(store)), WithSubscriptions(NewSubscriptions(&stubPackage{})))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "test", "unauthenticated"))
+	resp, ok := proxy.NextToClient(100 * time.Millisecond)
+	if !ok || resp.StatusCode != 407 || resp.GetHeader("Proxy-Authenticate") == "" {
+		t.Fatalf("expected a 407 challenge, got %v", resp)
+	}
+	stranger := newSubscribe("sip:bob@example.com", "test", "stranger")
+	stranger.SetHeader("From", "<sip:mallory@elsewhere.example>;tag=watcher")
+	proxy.SendFromClient(stranger)
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 403 {
+		t.Fatalf("expected 403 for a subscriber who is not a user here, got %v", resp)
+	}
+	if msg, ok := proxy.NextToServer(50 * time.Millisecond); ok {
+		t.Fatalf("expected refused subscribers not to be notified, got %v", msg)
+	}
+}
+
+func TestProxyLimitsSubscriptionsPerSubscriber(t *testing.T) {
+	subs := NewSubscriptions(&stubPackage{})
+	subs.perSubscriber = 1
+	proxy := NewProxy(WithSubscriptions(subs))
+	t.Cleanup(proxy.Stop)
+
+	proxy.SendFromClient(newSubscribe("sip:bob@example.com", "test", "first"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 200 {
+		t.Fatalf("expected the first subscription to be accepted, got %v", resp)
+	}
+	nextNotify(t, proxy)
+	proxy.SendFromClient(newSubscribe("sip:carol@example.com", "test", "second"))
+	if resp, ok := proxy.NextToClient(100 * time.Millisecond); !ok || resp.StatusCode != 403 {
+		t.Fatalf("expected 403 beyond the subscriber's limit, got %v", resp)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build linux && !amd64 && !386
+
+package sip
+
+import "syscall"
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
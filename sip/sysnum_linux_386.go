@@ -0,0 +1,5 @@
+package sip
+
+// sysSendmmsg is the sendmmsg system call, which package syscall does not
+// define for 386.
+const sysSendmmsg = 345
@@ -0,0 +1,5 @@
+package sip
+
+// sysSendmmsg is the sendmmsg system call, which package syscall does not
+// define for amd64.
+const sysSendmmsg = 307
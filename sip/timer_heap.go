@@ -0,0 +1,102 @@
+package sip
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// scheduledTimer is one pending transaction timer. index is its position in
+// the heap, or -1 once it has fired or been cancelled.
+type scheduledTimer struct {
+	at    time.Time
+	seq   uint64
+	fire  func(ctx context.Context, now time.Time)
+	index int
+}
+
+// timerHeap orders pending transaction timers by expiry so the transaction
+// layer can sleep until exactly the next one is due. Times carry the
+// monotonic clock reading from time.Now, so wall-clock jumps do not move
+// them. Timers due at the same instant fire in the order they were
+// scheduled. It is owned by the transaction layer's goroutine.
+type timerHeap struct {
+	items []*scheduledTimer
+	seq   uint64
+}
+
+func (h *timerHeap) Len() int { return len(h.items) }
+
+func (h *timerHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if a.at.Equal(b.at) {
+		return a.seq < b.seq
+	}
+	return a.at.Before(b.at)
+}
+
+func (h *timerHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	timer := x.(*scheduledTimer)
+	timer.index = len(h.items)
+	h.items = append(h.items, timer)
+}
+
+func (h *timerHeap) Pop() any {
+	last := len(h.items) - 1
+	timer := h.items[last]
+	h.items[last] = nil
+	h.items = h.items[:last]
+	timer.index = -1
+	return timer
+}
+
+// rearm makes *slot a timer calling fire at at. A timer already pending for
+// the same instant is kept, any other is cancelled, and a zero at leaves the
+// slot empty.
+func (h *timerHeap) rearm(slot **scheduledTimer, at time.Time, fire func(ctx context.Context, now time.Time)) {
+	if current := *slot; current != nil {
+		if current.index >= 0 && current.at.Equal(at) {
+			return
+		}
+		h.cancel(current)
+		*slot = nil
+	}
+	if at.IsZero() {
+		return
+	}
+	h.seq++
+	timer := &scheduledTimer{at: at, seq: h.seq, fire: fire}
+	heap.Push(h, timer)
+	*slot = timer
+}
+
+// cancel removes timer if it is still pending.
+func (h *timerHeap) cancel(timer *scheduledTimer) {
+	if timer == nil || timer.index < 0 {
+		return
+	}
+	heap.Remove(h, timer.index)
+}
+
+// next reports when the earliest pending timer is due.
+func (h *timerHeap) next() (time.Time, bool) {
+	if len(h.items) == 0 {
+		return time.Time{}, false
+	}
+	return h.items[0].at, true
+}
+
+// popDue removes and returns the earliest timer due at or before now, or nil
+// when none is.
+func (h *timerHeap) popDue(now time.Time) *scheduledTimer {
+	if len(h.items) == 0 || h.items[0].at.After(now) {
+		return nil
+	}
+	return heap.Pop(h).(*scheduledTimer)
+}
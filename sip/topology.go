@@ -0,0 +1,128 @@
+package sip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// topologyParam is the parameter of the proxy's Via that carries the hidden
+// headers of a request.
+const topologyParam = "xth"
+
+// TopologyHiding keeps the Via and Record-Route headers a request collected
+// inside the trust domain from leaving it. When enabled, a request sent to a
+// peer outside the domain has them removed and sealed, with a key known only
+// to this process, into a parameter of the proxy's own Via, which the peer
+// returns in its responses, so that they are restored before the response
+// is relayed. It is safe for concurrent use.
+type TopologyHiding struct {
+	enabled atomic.Bool
+	aead    cipher.AEAD
+}
+
+// hiddenHeaders are the headers sealed into the proxy's Via.
+type hiddenHeaders struct {
+	Via         []string `json:"v,omitempty"`
+	RecordRoute []string `json:"r,omitempty"`
+}
+
+// NewTopologyHiding returns a TopologyHiding with a fresh key, hiding
+// topology when enabled is set.
+func NewTopologyHiding(enabled bool) (*TopologyHiding, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("topology hiding key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("topology hiding key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("topology hiding key: %w", err)
+	}
+	h := &TopologyHiding{aead: aead}
+	h.enabled.Store(enabled)
+	return h, nil
+}
+
+// SetEnabled turns topology hiding on or off for requests sent from then
+// on. Responses to requests hidden earlier are still restored.
+func (h *TopologyHiding) SetEnabled(enabled bool) {
+	h.enabled.Store(enabled)
+}
+
+// hide seals the Via headers below the proxy's own, and the Record-Route
+// headers, of req into the proxy's Via.
+func (h *TopologyHiding) hide(req *Message) {
+	if h == nil || !h.enabled.Load() {
+		return
+	}
+	vias := req.HeaderList("Via")
+	hidden := hiddenHeaders{RecordRoute: req.HeaderList("Record-Route")}
+	if len(vias) > 1 {
+		hidden.Via = vias[1:]
+	}
+	if len(hidden.Via) == 0 && len(hidden.RecordRoute) == 0 {
+		return
+	}
+	top, ok := parseVia(vias[0])
+	if !ok {
+		return
+	}
+	plain, err := json.Marshal(hidden)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, h.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return
+	}
+	top.setParam(topologyParam, base64.RawURLEncoding.EncodeToString(h.aead.Seal(nonce, nonce, plain, nil)))
+	req.SetHeader("Via", top.String())
+	req.DelHeader("Record-Route")
+}
+
+// restore puts the headers hidden from the request resp answers back: the
+// Via headers below the proxy's own, and the Record-Route headers after any
+// the response carries. A parameter that does not open with the key is left
+// alone.
+func (h *TopologyHiding) restore(resp *Message) {
+	if h == nil {
+		return
+	}
+	vias := resp.HeaderList("Via")
+	if len(vias) == 0 {
+		return
+	}
+	top, ok := parseVia(vias[0])
+	if !ok {
+		return
+	}
+	sealed, ok := top.param(topologyParam)
+	if !ok {
+		return
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < h.aead.NonceSize() {
+		return
+	}
+	size := h.aead.NonceSize()
+	plain, err := h.aead.Open(nil, raw[:size], raw[size:], nil)
+	if err != nil {
+		return
+	}
+	var hidden hiddenHeaders
+	if err := json.Unmarshal(plain, &hidden); err != nil {
+		return
+	}
+	resp.SetHeader("Via", append(vias[:1:1], hidden.Via...)...)
+	if len(hidden.RecordRoute) > 0 {
+		resp.SetHeader("Record-Route", append(resp.HeaderList("Record-Route"), hidden.RecordRoute...)...)
+	}
+}
@@ -0,0 +1,85 @@
+package sip
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHidesTopologyOutsideTrustDomain(t *testing.T) {
+	topology, err := NewTopologyHiding(true)
+	if err != nil {
+		t.Fatalf("NewTopologyHiding returned error: %v", err)
+	}
+	identity, err := NewIdentity(IdentityConfig{TrustedPeers: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("NewIdentity returned error: %v", err)
+	}
+	plan, err := NewDialPlan([]RouteRule{
+		{Prefix: "0", Upstream: "203.0.113.5:5060"},
+		{Prefix: "1", Upstream: "10.0.0.5:5060"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewDialPlan returned error: %v", err)
+	}
+	proxy := NewProxy(WithDialPlan(plan), WithIdentity(identity), WithTopologyHiding(topology))
+	t.Cleanup(proxy.Stop)
+
+	internal := []string{
+		"SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK0312345678",
+		"SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1",
+	}
+	send := func(dialed string) *Message {
+		t.Helper()
+		invite := newInvite()
+		invite.RequestURI = "sip:" + dialed + "@example.com"
+		invite.SetHeader("Via", "SIP/2.0/UDP 10.1.2.3:5060;branch=z9hG4bK"+dialed, internal[1])
+		invite.SetHeader("Call-ID", dialed+"@client.example")
+		invite.SetHeader("Record-Route", "<sip:10.1.2.3;lr>")
+		proxy.SendFromClient(invite)
+		for {
+			msg, ok := proxy.NextToServer(200 * time.Millisecond)
+			if !ok {
+				t.Fatalf("expected the INVITE to %s to be forwarded", dialed)
+			}
+			if msg.Method == "INVITE" && msg.GetHeader("Call-ID") == dialed+"@client.example" {
+				return msg
+			}
+		}
+	}
+
+	forwarded := send("0312345678")
+	vias := forwarded.HeaderList("Via")
+	if len(vias) != 1 || !strings.Contains(vias[0], ";xth=") || strings.Contains(forwarded.String(), "10.1.2.3") {
+		t.Fatalf("expected only the proxy's Via with the hidden headers sealed in it, got %q", vias)
+	}
+	if got := forwarded.GetHeader("Record-Route"); got != "" {
+		t.Fatalf("expected Record-Route to be hidden, got %q", got)
+	}
+	resp := buildResponseFrom(forwarded, 180, "Ringing")
+	resp.SetHeader("Record-Route", "<sip:edge.provider.example;lr>")
+	proxy.SendFromServer(resp)
+	for {
+		msg, ok := proxy.NextToClient(200 * time.Millisecond)
+		if !ok {
+			t.Fatalf("expected the response to be relayed")
+		}
+		if msg.StatusCode != 180 {
+			continue
+		}
+		if got := msg.HeaderList("Via"); !slices.Equal(got, internal) {
+			t.Fatalf("expected the hidden Vias to be restored, got %q", got)
+		}
+		if got := msg.HeaderList("Record-Route"); !slices.Equal(got, []string{"<sip:edge.provider.example;lr>", "<sip:10.1.2.3;lr>"}) {
+			t.Fatalf("expected the hidden Record-Route after the peer's, got %q", got)
+		}
+		break
+	}
+
+	// Peers inside the trust domain see the whole path.
+	trusted := send("1234")
+	if got := trusted.HeaderList("Via"); len(got) != 3 || trusted.GetHeader("Record-Route") == "" {
+		t.Fatalf("expected a trusted peer to get every Via and Record-Route, got %q", got)
+	}
+}
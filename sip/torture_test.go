@@ -0,0 +1,292 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// tortureMessage joins lines with CRLF, ending the header block with an empty
+// line before body.
+func tortureMessage(body string, lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n\r\n" + body
+}
+
+// tortureCases are adapted from the SIP torture test messages of RFC 4475,
+// trimmed to what the message parser is responsible for, plus the malformed
+// but common forms that the lenient Parser accepts.
+var tortureCases = []struct {
+	name    string
+	raw     string
+	strict  bool
+	lenient bool
+	check   func(*Message) bool
+}{
+	{
+		// RFC 4475 section 3.1.1.1: odd but legal whitespace, folding, and
+		// compact header names.
+		name: "wsinv",
+		raw: tortureMessage("v=0\r\n",
+			"INVITE sip:vivekg@chair-dnrc.example.com;unknownparam SIP/2.0",
+			"TO :",
+			" sip:vivekg@chair-dnrc.example.com ;   tag    = 1918181833n",
+			"from   : \"J Rosenberg \\\\\\\"\"       <sip:jdrosen@example.com>",
+			"  ;",
+			"  tag = 98asjd8",
+			"MaX-fOrWaRdS: 0068",
+			"Call-ID: wsinv.ndaksdj@192.0.2.1",
+			"Content-Length   : 5",
+			"cseq: 0009",
+			"  INVITE",
+			"Via  : SIP  /   2.0",
+			" /UDP",
+			"    192.0.2.2;branch=390skdjuw",
+			"s :",
+			"NewFangledHeader:   newfangled value",
+			" continued newfangled value",
+			"UnknownHeaderWithUnusualValue: ;;,,;;,;",
+			"Content-Type: application/sdp",
+			"Route:",
+			" <sip:services.example.com;lr;unknownwith=value;unknown-no-value>",
+			"v:  SIP  / 2.0  / TCP     spindle.example.com   ;",
+			"  branch  =   z9hG4bK9ikj8  ,",
+			" SIP  /    2.0   / UDP  192.168.255.111   ; branch=",
+			" z9hG4bK30239",
+			"m:\"Quoted string \\\"\\\"\" <sip:jdrosen@example.com> ; newparam =",
+			"      newvalue ;",
+			"  secondparam ; q = 0.33",
+		),
+		strict:  true,
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.Method == "INVITE" && m.GetHeader("Cseq") == "0009 INVITE" &&
+				len(m.HeaderList("Via")) == 3 && m.GetHeader("Subject") == "" &&
+				m.GetHeader("Contact") != "" && m.Body == "v=0\r\n"
+		},
+	},
+	{
+		// Section 3.1.1.2: every token character in the method and the
+		// Request-URI's user part.
+		name: "intmeth",
+		raw: tortureMessage("",
+			"!interesting-Method0123456789_*+`.%indeed'~ sip:1_unusual.URI~(to-be!sure)&isn't+it$/crazy?,/;;*:&it+has=1,weird!*pas$wo~d_too.(doesn't-it)@example.com SIP/2.0",
+			"Via: SIP/2.0/TCP host1.example.com;branch=z9hG4bK-.!%66*_+`'~",
+			"Call-ID: intmeth.word%ZK-!.*_+'@word`~)(><:\\/\"][?}{",
+			"CSeq: 139122385 !interesting-Method0123456789_*+`.%indeed'~",
+			"Content-Length: 0",
+		),
+		strict:  true,
+		lenient: true,
+	},
+	{
+		// Section 3.1.1.3: escaped characters in the Request-URI.
+		name: "esc01",
+		raw: tortureMessage("",
+			"OPTIONS sip:user;par=u%40example.net@example.com SIP/2.0",
+			"Call-ID: esc01.239409asdfakjkn23onasd0-3234",
+			"CSeq: 234234 OPTIONS",
+			"Content-Length: 0",
+		),
+		strict:  true,
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.RequestURI == "sip:user;par=u%40example.net@example.com"
+		},
+	},
+	{
+		// Section 3.1.1.6: a status line whose reason phrase is empty.
+		name: "noreason",
+		raw: tortureMessage("",
+			"SIP/2.0 100 ",
+			"Via: SIP/2.0/UDP 192.0.2.105;branch=z9hG4bK2398ndaoe",
+			"CSeq: 35 INVITE",
+			"Content-Length: 0",
+		),
+		strict:  true,
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.StatusCode == 100
+		},
+	},
+	{
+		// Section 3.1.1.9: a reason phrase in UTF-8.
+		name: "unreason",
+		raw: tortureMessage("",
+			"SIP/2.0 200 = 2**3 * 5**2 но сто девяносто девять - простое",
+			"CSeq: 35 INVITE",
+			"Content-Length: 0",
+		),
+		strict:  true,
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.StatusCode == 200 && strings.HasSuffix(m.ReasonPhrase, "простое")
+		},
+	},
+	{
+		// Section 3.3.14: a SIP version this proxy does not speak still
+		// parses, so it can be answered with 505.
+		name: "badvers",
+		raw: tortureMessage("",
+			"OPTIONS sip:t.watson@example.org SIP/7.0",
+			"CSeq: 3 OPTIONS",
+			"Content-Length: 0",
+		),
+		strict:  true,
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.Proto == "SIP/7.0"
+		},
+	},
+	{
+		// Section 3.1.2.2: Content-Length larger than the body.
+		name: "clerr",
+		raw: tortureMessage("v=0\r\n",
+			"INVITE sip:user@example.com SIP/2.0",
+			"CSeq: 193942 INVITE",
+			"Content-Length: 9999",
+		),
+	},
+	{
+		// Section 3.1.2.4: a negative Content-Length.
+		name: "ncl",
+		raw: tortureMessage("v=0\r\n",
+			"INVITE sip:user@example.com SIP/2.0",
+			"CSeq: 0 INVITE",
+			"Content-Length: -999",
+		),
+	},
+	{
+		// Section 3.1.2.5: a Content-Length that overflows.
+		name: "scalar02",
+		raw: tortureMessage("",
+			"REGISTER sip:example.com SIP/2.0",
+			"CSeq: 36 REGISTER",
+			"Content-Length: 18446744073709551616",
+		),
+	},
+	{
+		// Section 3.1.2.6: a status code beyond three digits.
+		name: "bigcode",
+		raw: tortureMessage("",
+			"SIP/2.0 4294967301 better not break the receiver",
+			"CSeq: 353494 INVITE",
+			"Content-Length: 0",
+		),
+	},
+	{
+		// Section 3.1.2.11: the Request-URI in angle brackets.
+		name: "ltgtruri",
+		raw: tortureMessage("",
+			"INVITE <sip:user@example.com> SIP/2.0",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+		),
+	},
+	{
+		// Section 3.1.2.12: two spaces before the Request-URI.
+		name: "lwsruri",
+		raw: tortureMessage("",
+			"INVITE  sip:user@example.com SIP/2.0",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+		),
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.RequestURI == "sip:user@example.com"
+		},
+	},
+	{
+		// Section 3.1.2.13: whitespace before the method.
+		name: "lwsstart",
+		raw: tortureMessage("",
+			" INVITE sip:user@example.com SIP/2.0",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+		),
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.Method == "INVITE"
+		},
+	},
+	{
+		// Section 3.1.2.14: whitespace after the SIP version.
+		name: "trws",
+		raw: tortureMessage("",
+			"OPTIONS sip:remote-target@example.com SIP/2.0  ",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+		),
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.Proto == "SIP/2.0"
+		},
+	},
+	{
+		// Section 3.1.2.16: a Request-URI with a space in it.
+		name: "escruri-space",
+		raw: tortureMessage("",
+			"INVITE sip:user@example.com; lr SIP/2.0",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+		),
+	},
+	{
+		name: "bad-header-name",
+		raw: tortureMessage("",
+			"OPTIONS sip:user@example.com SIP/2.0",
+			"Call ID: spaces-are-not-token-characters",
+			"Content-Length: 0",
+		),
+	},
+	{
+		name: "lf-only",
+		raw: strings.ReplaceAll(tortureMessage("",
+			"OPTIONS sip:user@example.com SIP/2.0",
+			"Via: SIP/2.0/UDP client.example.com;branch=z9hG4bKlf",
+			"CSeq: 1 OPTIONS",
+			"Content-Length: 0",
+		), "\r\n", "\n"),
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.GetHeader("Cseq") == "1 OPTIONS"
+		},
+	},
+	{
+		name: "missing-reason",
+		raw: tortureMessage("",
+			"SIP/2.0 180",
+			"CSeq: 1 INVITE",
+			"Content-Length: 0",
+		),
+		lenient: true,
+		check: func(m *Message) bool {
+			return m.StatusCode == 180 && m.ReasonPhrase == "Ringing"
+		},
+	},
+}
+
+func TestParserTortureMessages(t *testing.T) {
+	for _, tc := range tortureCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, p := range []Parser{{}, {Lenient: true}} {
+				want := tc.strict
+				if p.Lenient {
+					want = tc.lenient
+				}
+				msg, err := p.Parse(tc.raw)
+				if !want {
+					if !errors.Is(err, ErrInvalidMessage) {
+						t.Fatalf("lenient=%v: expected ErrInvalidMessage, got %v", p.Lenient, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("lenient=%v: Parse returned error: %v", p.Lenient, err)
+				}
+				if tc.check != nil && !tc.check(msg) {
+					t.Fatalf("lenient=%v: unexpected message %+v", p.Lenient, msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package sip
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTraceHistory is how many traced datagrams a Tracer keeps when no
+// limit is given.
+const defaultTraceHistory = 500
+
+// TraceFilter selects the datagrams a Tracer records. Every non-empty field
+// must match, so the zero filter records everything, including datagrams that
+// do not parse as SIP.
+type TraceFilter struct {
+	// CallID matches the Call-ID header exactly.
+	CallID string `json:"call_id,omitempty"`
+	// Method matches a request's method, or the CSeq method of a response,
+	// case-insensitively.
+	Method string `json:"method,omitempty"`
+	// Peer matches the remote address, either as host:port or as a bare
+	// host matching every port.
+	Peer string `json:"peer,omitempty"`
+}
+
+func (f TraceFilter) normalised() TraceFilter {
+	return TraceFilter{
+		CallID: strings.TrimSpace(f.CallID),
+		Method: strings.ToUpper(strings.TrimSpace(f.Method)),
+		Peer:   strings.TrimSpace(f.Peer),
+	}
+}
+
+func (f TraceFilter) matches(entry TraceEntry) bool {
+	if f.CallID != "" && f.CallID != entry.CallID {
+		return false
+	}
+	if f.Method != "" && f.Method != entry.Method {
+		return false
+	}
+	if f.Peer != "" && f.Peer != entry.Peer {
+		host, _, err := net.SplitHostPort(entry.Peer)
+		if err != nil || host != f.Peer {
+			return false
+		}
+	}
+	return true
+}
+
+// TraceEntry is one traced datagram and its full wire image.
+type TraceEntry struct {
+	Time time.Time `json:"time"`
+	// Direction is "received" or "sent".
+	Direction string `json:"direction"`
+	// Side is "downstream" for the client-facing socket and "upstream" for
+	// the server-facing one.
+	Side    string `json:"side"`
+	Peer    string `json:"peer"`
+	CallID  string `json:"call_id,omitempty"`
+	Method  string `json:"method,omitempty"`
+	Summary string `json:"summary"`
+	Wire    string `json:"wire"`
+}
+
+// Tracer records the wire image of datagrams crossing the stack's sockets
+// while it is enabled. Matching datagrams are logged, kept in a bounded
+// history, and delivered to subscribers. It can be reconfigured at any time
+// and is safe for concurrent use; while disabled it costs one atomic load per
+// datagram.
+type Tracer struct {
+	enabled atomic.Bool
+	logger  *slog.Logger
+
+	mu          sync.Mutex
+	filter      TraceFilter
+	history     []TraceEntry
+	limit       int
+	next        int
+	subscribers map[int]chan TraceEntry
+	nextID      int
+}
+
+// NewTracer returns a disabled tracer that logs matching datagrams to logger,
+// when non-nil, and keeps the most recent limit of them (500 when limit is
+// not positive).
+func NewTracer(logger *slog.Logger, limit int) *Tracer {
+	if limit <= 0 {
+		limit = defaultTraceHistory
+	}
+	return &Tracer{logger: logger, limit: limit, subscribers: make(map[int]chan TraceEntry)}
+}
+
+// Configure enables or disables tracing and replaces the filter.
+func (t *Tracer) Configure(enabled bool, filter TraceFilter) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.filter = filter.normalised()
+	t.mu.Unlock()
+	t.enabled.Store(enabled)
+}
+
+// Status reports whether tracing is enabled and the current filter.
+func (t *Tracer) Status() (bool, TraceFilter) {
+	if t == nil {
+		return false, TraceFilter{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.enabled.Load(), t.filter
+}
+
+// Recent returns the retained entries, oldest first.
+func (t *Tracer) Recent() []TraceEntry {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]TraceEntry, 0, len(t.history))
+	if len(t.history) == t.limit {
+		out = append(out, t.history[t.next:]...)
+		out = append(out, t.history[:t.next]...)
+		return out
+	}
+	return append(out, t.history...)
+}
+
+// Subscribe streams newly traced entries until cancel is called. Entries are
+// dropped rather than delaying SIP traffic when the subscriber falls more
+// than buffer entries behind.
+func (t *Tracer) Subscribe(buffer int) (<-chan TraceEntry, func()) {
+	if buffer <= 0 {
+		buffer = 64
+	}
+	ch := make(chan TraceEntry, buffer)
+	if t == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	t.mu.Lock()
+	id := t.nextID
+	t.nextID++
+	t.subscribers[id] = ch
+	t.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subscribers, id)
+			t.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// trace records one datagram; event is "received" or "sent". msg is nil when
+// raw did not parse.
+func (t *Tracer) trace(event string, side direction, peer net.Addr, raw []byte, msg *Message) {
+	if t == nil || !t.enabled.Load() {
+		return
+	}
+	entry := TraceEntry{
+		Time:      time.Now().UTC(),
+		Direction: event,
+		Side:      sideLabel(side),
+		Wire:      string(raw),
+		Summary:   "(invalid)",
+	}
+	if peer != nil {
+		entry.Peer = peer.String()
+	}
+	if msg != nil {
+		entry.CallID = strings.TrimSpace(msg.GetHeader("Call-ID"))
+		entry.Method = traceMethod(msg)
+		entry.Summary = summarizeMessage(msg)
+	}
+
+	t.mu.Lock()
+	if !t.filter.matches(entry) {
+		t.mu.Unlock()
+		return
+	}
+	if len(t.history) < t.limit {
+		t.history = append(t.history, entry)
+	} else {
+		t.history[t.next] = entry
+		t.next = (t.next + 1) % t.limit
+	}
+	for _, ch := range t.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+	t.mu.Unlock()
+
+	if t.logger != nil {
+		t.logger.Info("sip trace", "direction", entry.Direction, "side", entry.Side, "peer", entry.Peer,
+			"message", entry.Summary, "call_id", entry.CallID, "wire", entry.Wire)
+	}
+}
+
+// traceMethod is the request method, or the CSeq method of a response.
+func traceMethod(msg *Message) string {
+	if msg.IsRequest() {
+		return strings.ToUpper(msg.Method)
+	}
+	fields := strings.Fields(msg.GetHeader("CSeq"))
+	if len(fields) != 2 {
+		return ""
+	}
+	return strings.ToUpper(fields[1])
+}
+
+func sideLabel(side direction) string {
+	if side == directionUpstream {
+		return "upstream"
+	}
+	return "downstream"
+}
@@ -0,0 +1,55 @@
+package sip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTracerFiltersAndRetainsEntries(t *testing.T) {
+	tracer := NewTracer(nil, 2)
+	peer := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5062}
+	invite := newInvite()
+
+	tracer.trace("received", directionDownstream, peer, []byte(invite.String()), invite)
+	if got := tracer.Recent(); len(got) != 0 {
+		t.Fatalf("disabled tracer recorded %+v", got)
+	}
+
+	tracer.Configure(true, TraceFilter{Method: "invite", Peer: "192.0.2.10"})
+	entries, cancel := tracer.Subscribe(4)
+	defer cancel()
+
+	options := newOptions()
+	tracer.trace("received", directionDownstream, peer, []byte(options.String()), options)
+	ringing := buildResponseFrom(invite, 180, "Ringing")
+	tracer.trace("sent", directionDownstream, peer, []byte(ringing.String()), ringing)
+	tracer.trace("received", directionUpstream, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060}, []byte(invite.String()), invite)
+	tracer.trace("received", directionDownstream, peer, []byte(invite.String()), invite)
+
+	got := tracer.Recent()
+	if len(got) != 2 {
+		t.Fatalf("expected the 180 and the INVITE, got %+v", got)
+	}
+	if got[0].Summary != "180 Ringing" || got[0].Direction != "sent" || got[0].Method != "INVITE" {
+		t.Fatalf("unexpected first entry %+v", got[0])
+	}
+	if got[1].Wire != invite.String() || got[1].CallID != "a84b4c76e66710" || got[1].Peer != "192.0.2.10:5062" || got[1].Side != "downstream" {
+		t.Fatalf("unexpected second entry %+v", got[1])
+	}
+	if first := <-entries; first.Summary != "180 Ringing" {
+		t.Fatalf("unexpected streamed entry %+v", first)
+	}
+
+	tracer.Configure(true, TraceFilter{CallID: "other"})
+	tracer.trace("received", directionDownstream, peer, []byte(invite.String()), invite)
+	tracer.trace("received", directionDownstream, peer, []byte("garbage"), nil)
+	if len(tracer.Recent()) != 2 {
+		t.Fatalf("Call-ID filter let messages through: %+v", tracer.Recent())
+	}
+
+	tracer.Configure(true, TraceFilter{})
+	tracer.trace("received", directionDownstream, peer, []byte("garbage"), nil)
+	if got := tracer.Recent(); len(got) != 2 || got[1].Summary != "(invalid)" || got[0].Summary != "INVITE sip:bob@example.com" {
+		t.Fatalf("expected the oldest entry to be evicted, got %+v", got)
+	}
+}
@@ -2,9 +2,13 @@ package sip
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
+
+	"xylitol4/internal/tracing"
 )
 
 type tuEventKind int
@@ -19,6 +23,9 @@ type tuEvent struct {
 	ServerTxID string
 	ClientTxID string
 	Message    *Message
+	// TimedOut marks the 408 standing in for a response that never came,
+	// on Timer B or F.
+	TimedOut bool
 }
 
 type tuActionKind int
@@ -41,6 +48,46 @@ type transactionData struct {
 	method       string
 	request      *Message
 	lastResponse *Message
+	// alerted records that a client INVITE transaction received a
+	// provisional response other than 100 Trying, so that the callee's
+	// phone is known to be ringing when Timer C fires.
+	alerted bool
+	// started is when a client transaction's request was first sent; it is
+	// cleared once the transaction's duration has been recorded.
+	started time.Time
+	// span covers the transaction until its final response when the
+	// message that created it is traced.
+	span *tracing.Span
+	// ctx is handed on with the transaction's messages; see
+	// Message.Context. cancel ends it when the transaction is deleted.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// startContext derives the transaction's context from parent, the context of
+// the message that created it. It lasts as long as the proxy waits for the
+// final response: Timer C for an INVITE and Timer F otherwise.
+func (t *transactionLayer) startContext(d *transactionData, parent context.Context) {
+	wait := t.timerF()
+	if d.method == "INVITE" {
+		wait = t.timerC()
+	}
+	d.ctx, d.cancel = context.WithTimeout(parent, wait)
+}
+
+// endContext cancels the transaction's context.
+func (d *transactionData) endContext() {
+	if d != nil && d.cancel != nil {
+		d.cancel()
+	}
+}
+
+// bind returns msg carrying the transaction's context.
+func (d *transactionData) bind(msg *Message) *Message {
+	if d != nil && d.ctx != nil {
+		msg.ctx = d.ctx
+	}
+	return msg
 }
 
 type serverTransaction interface {
@@ -78,22 +125,37 @@ type transactionLayer struct {
 	serverTxns map[string]serverTransactionEntry
 	clientTxns map[string]clientTransactionEntry
 
-	serverTxTTL     time.Duration
-	cleanupInterval time.Duration
-	timerGInitial   time.Duration
-	timerGMax       time.Duration
-	timerHDuration  time.Duration
-	timerIDuration  time.Duration
-	timerJDuration  time.Duration
-	timerAInitial   time.Duration
-	timerAMax       time.Duration
-	timerBDuration  time.Duration
-	timerCDuration  time.Duration
-	timerDDuration  time.Duration
-	timerEInitial   time.Duration
-	timerEMax       time.Duration
-	timerFDuration  time.Duration
-	timerKDuration  time.Duration
+	serverTxTTL    time.Duration
+	timerGInitial  time.Duration
+	timerGMax      time.Duration
+	timerHDuration time.Duration
+	timerIDuration time.Duration
+	timerJDuration time.Duration
+	timerAInitial  time.Duration
+	timerAMax      time.Duration
+	timerBDuration time.Duration
+	timerCDuration time.Duration
+	timerDDuration time.Duration
+	timerEInitial  time.Duration
+	timerEMax      time.Duration
+	timerFDuration time.Duration
+	timerKDuration time.Duration
+	// retime carries timers changed while the layer runs; see retimeTo.
+	retime chan TimerConfig
+
+	timers  timerHeap
+	metrics *Metrics
+	stats   *transactionCounters
+	events  *EventBus
+
+	// reportedServer and reportedClient are this layer's share of the active
+	// counts in stats, which shards of one proxy add to.
+	reportedServer int
+	reportedClient int
+	// unanswered counts the server transactions still waiting for a final
+	// response, and reportedUnanswered is its share in stats.
+	unanswered         int
+	reportedUnanswered int
 
 	wg sync.WaitGroup
 }
@@ -102,11 +164,24 @@ type serverTransactionEntry struct {
 	txn      serverTransaction
 	expires  time.Time
 	deadline time.Time
+	// answered is set once a final response has been sent.
+	answered bool
 
 	retransmitAt       time.Time
 	retransmitInterval time.Duration
+
+	// timers are the scheduled callbacks for deadline, retransmitAt, and
+	// expires, kept in step by storeServer.
+	timers [serverTimerCount]*scheduledTimer
 }
 
+const (
+	serverTimerDeadline = iota
+	serverTimerRetransmit
+	serverTimerExpiry
+	serverTimerCount
+)
+
 type clientTransactionEntry struct {
 	txn                clientTransaction
 	deadline           time.Time
@@ -114,75 +189,181 @@ type clientTransactionEntry struct {
 	retransmitInterval time.Duration
 	terminateAt        time.Time
 	timerCDeadline     time.Time
+
+	// timers are the scheduled callbacks for the times above, kept in step
+	// by storeClient.
+	timers [clientTimerCount]*scheduledTimer
 }
 
 const (
-	defaultServerTransactionTTL      = 32 * time.Second
-	serverTransactionCleanupInterval = time.Second
-	defaultTimerT1                   = 500 * time.Millisecond
-	defaultTimerT2                   = 4 * time.Second
-	defaultTimerT4                   = 5 * time.Second
-	defaultTimerGInitial             = defaultTimerT1
-	defaultTimerGMax                 = defaultTimerT2
-	defaultTimerH                    = 64 * defaultTimerT1
-	defaultTimerI                    = defaultTimerT4
-	defaultTimerJ                    = 64 * defaultTimerT1
-	defaultTimerAInitial             = defaultTimerT1
-	defaultTimerAMax                 = defaultTimerT2
-	defaultTimerB                    = 64 * defaultTimerT1
-	defaultTimerC                    = 3 * time.Minute
-	defaultTimerD                    = 32 * time.Second
-	defaultTimerEInitial             = defaultTimerT1
-	defaultTimerEMax                 = defaultTimerT2
-	defaultTimerF                    = 64 * defaultTimerT1
-	defaultTimerK                    = defaultTimerT4
+	clientTimerDeadline = iota
+	clientTimerC
+	clientTimerRetransmit
+	clientTimerTerminate
+	clientTimerCount
 )
 
+const (
+	defaultServerTransactionTTL = 32 * time.Second
+	defaultTimerT1              = 500 * time.Millisecond
+	defaultTimerT2              = 4 * time.Second
+	defaultTimerT4              = 5 * time.Second
+	defaultTimerGInitial        = defaultTimerT1
+	defaultTimerGMax            = defaultTimerT2
+	defaultTimerH               = 64 * defaultTimerT1
+	defaultTimerI               = defaultTimerT4
+	defaultTimerJ               = 64 * defaultTimerT1
+	defaultTimerAInitial        = defaultTimerT1
+	defaultTimerAMax            = defaultTimerT2
+	defaultTimerB               = 64 * defaultTimerT1
+	defaultTimerC               = 3 * time.Minute
+	defaultTimerD               = 32 * time.Second
+	defaultTimerEInitial        = defaultTimerT1
+	defaultTimerEMax            = defaultTimerT2
+	defaultTimerF               = 64 * defaultTimerT1
+	defaultTimerK               = defaultTimerT4
+)
+
+// TimerConfig tunes the RFC 3261 transaction timers. T1, the round-trip
+// estimate, sets the first retransmission intervals and, as 64*T1, Timers B,
+// F, H, and J; T2 caps the retransmission intervals; T4, how long the network
+// may hold a message, sets Timers I and K. TimerC bounds how long a forwarded
+// INVITE may go without a final response. A zero field keeps its default:
+// 500ms, 4s, 5s, and 3 minutes.
+type TimerConfig struct {
+	T1     time.Duration
+	T2     time.Duration
+	T4     time.Duration
+	TimerC time.Duration
+}
+
+// Bounds of the timers validate accepts. Values outside them are more likely
+// a mistyped unit than a network that needs them.
+const (
+	minTimerT1 = 10 * time.Millisecond
+	maxTimerT1 = 10 * time.Second
+	maxTimerT2 = time.Minute
+	minTimerT4 = 10 * time.Millisecond
+	maxTimerT4 = time.Minute
+	maxTimerC  = time.Hour
+)
+
+// withDefaults returns c with every zero field set to its default.
+func (c TimerConfig) withDefaults() TimerConfig {
+	if c.T1 <= 0 {
+		c.T1 = defaultTimerT1
+	}
+	if c.T2 <= 0 {
+		c.T2 = defaultTimerT2
+	}
+	if c.T4 <= 0 {
+		c.T4 = defaultTimerT4
+	}
+	if c.TimerC <= 0 {
+		c.TimerC = defaultTimerC
+	}
+	return c
+}
+
+// validate reports timers out of range once the defaults are filled in: T1
+// from 10ms to 10s, T2 from T1 to a minute, T4 from 10ms to a minute, and
+// TimerC from Timer B (64*T1), so that an INVITE times out before Timer C
+// cancels it, to an hour.
+func (c TimerConfig) validate() error {
+	if c.T1 < 0 || c.T2 < 0 || c.T4 < 0 || c.TimerC < 0 {
+		return errors.New("timers must not be negative")
+	}
+	c = c.withDefaults()
+	switch {
+	case c.T1 < minTimerT1 || c.T1 > maxTimerT1:
+		return fmt.Errorf("timer T1 %v is outside %v to %v", c.T1, minTimerT1, maxTimerT1)
+	case c.T2 < c.T1 || c.T2 > maxTimerT2:
+		return fmt.Errorf("timer T2 %v is outside T1 (%v) to %v", c.T2, c.T1, maxTimerT2)
+	case c.T4 < minTimerT4 || c.T4 > maxTimerT4:
+		return fmt.Errorf("timer T4 %v is outside %v to %v", c.T4, minTimerT4, maxTimerT4)
+	case c.TimerC < 64*c.T1 || c.TimerC > maxTimerC:
+		return fmt.Errorf("timer C %v is outside 64*T1 (%v) to %v", c.TimerC, 64*c.T1, maxTimerC)
+	}
+	return nil
+}
+
+// apply sets the timers derived from c on a transaction layer, restoring the
+// default of every zero field.
+func (c TimerConfig) apply(t *transactionLayer) {
+	c = c.withDefaults()
+	t.timerAInitial, t.timerEInitial, t.timerGInitial = c.T1, c.T1, c.T1
+	t.timerBDuration, t.timerFDuration = 64*c.T1, 64*c.T1
+	t.timerHDuration, t.timerJDuration = 64*c.T1, 64*c.T1
+	t.timerAMax, t.timerEMax, t.timerGMax = c.T2, c.T2, c.T2
+	t.timerIDuration, t.timerKDuration = c.T4, c.T4
+	t.timerCDuration = c.TimerC
+}
+
+// retimeTo hands the layer's goroutine new timers, which apply to the
+// transactions it creates from then on. A pending change not yet picked up
+// is replaced.
+func (t *transactionLayer) retimeTo(c TimerConfig) {
+	for {
+		select {
+		case t.retime <- c:
+			return
+		default:
+		}
+		select {
+		case <-t.retime:
+		default:
+		}
+	}
+}
+
 func newTransactionLayer(fromTransport <-chan transportEvent, toTransport chan<- transportEvent, toTU chan<- tuEvent, fromTU <-chan tuAction) *transactionLayer {
 	return &transactionLayer{
-		fromTransport:   fromTransport,
-		toTransport:     toTransport,
-		toTU:            toTU,
-		fromTU:          fromTU,
-		serverTxns:      make(map[string]serverTransactionEntry),
-		clientTxns:      make(map[string]clientTransactionEntry),
-		serverTxTTL:     defaultServerTransactionTTL,
-		cleanupInterval: serverTransactionCleanupInterval,
-		timerGInitial:   defaultTimerGInitial,
-		timerGMax:       defaultTimerGMax,
-		timerHDuration:  defaultTimerH,
-		timerIDuration:  defaultTimerI,
-		timerJDuration:  defaultTimerJ,
-		timerAInitial:   defaultTimerAInitial,
-		timerAMax:       defaultTimerAMax,
-		timerBDuration:  defaultTimerB,
-		timerCDuration:  defaultTimerC,
-		timerDDuration:  defaultTimerD,
-		timerEInitial:   defaultTimerEInitial,
-		timerEMax:       defaultTimerEMax,
-		timerFDuration:  defaultTimerF,
-		timerKDuration:  defaultTimerK,
+		fromTransport:  fromTransport,
+		toTransport:    toTransport,
+		toTU:           toTU,
+		fromTU:         fromTU,
+		serverTxns:     make(map[string]serverTransactionEntry),
+		clientTxns:     make(map[string]clientTransactionEntry),
+		serverTxTTL:    defaultServerTransactionTTL,
+		timerGInitial:  defaultTimerGInitial,
+		timerGMax:      defaultTimerGMax,
+		timerHDuration: defaultTimerH,
+		timerIDuration: defaultTimerI,
+		timerJDuration: defaultTimerJ,
+		timerAInitial:  defaultTimerAInitial,
+		timerAMax:      defaultTimerAMax,
+		timerBDuration: defaultTimerB,
+		timerCDuration: defaultTimerC,
+		timerDDuration: defaultTimerD,
+		timerEInitial:  defaultTimerEInitial,
+		timerEMax:      defaultTimerEMax,
+		timerFDuration: defaultTimerF,
+		timerKDuration: defaultTimerK,
+		stats:          &transactionCounters{},
+		retime:         make(chan TimerConfig, 1),
 	}
 }
 
+// start runs the transaction layer's goroutine. Between messages it sleeps
+// until the earliest pending timer is due rather than polling. The output
+// queues are left open for their owner to close, as shards share them.
 func (t *transactionLayer) start(ctx context.Context) {
-	interval := t.cleanupInterval
-	if interval <= 0 {
-		interval = serverTransactionCleanupInterval
-	}
 	t.wg.Add(1)
 	go func() {
 		defer t.wg.Done()
-		defer close(t.toTransport)
-		defer close(t.toTU)
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
+		wake := time.NewTimer(time.Hour)
+		defer wake.Stop()
 		for {
+			var due <-chan time.Time
+			if at, ok := t.timers.next(); ok {
+				wake.Reset(time.Until(at))
+				due = wake.C
+			}
 			select {
 			case <-ctx.Done():
 				return
-			case now := <-ticker.C:
-				t.cleanupTransactions(ctx, now)
+			case <-due:
+				t.fireTimers(ctx, time.Now())
 			case evt, ok := <-t.fromTransport:
 				if !ok {
 					return
@@ -196,11 +377,29 @@ func (t *transactionLayer) start(ctx context.Context) {
 					return
 				}
 				t.handleTUAction(ctx, action)
+			case timers := <-t.retime:
+				timers.apply(t)
 			}
+			t.reportActive()
 		}
 	}()
 }
 
+// reportActive adds the change in this layer's transaction counts since the
+// last report to the shared active counts.
+func (t *transactionLayer) reportActive() {
+	server, client := len(t.serverTxns), len(t.clientTxns)
+	if server == t.reportedServer && client == t.reportedClient && t.unanswered == t.reportedUnanswered {
+		return
+	}
+	t.stats.serverActive.Add(int64(server - t.reportedServer))
+	t.stats.clientActive.Add(int64(client - t.reportedClient))
+	t.stats.unansweredActive.Add(int64(t.unanswered - t.reportedUnanswered))
+	t.reportedServer, t.reportedClient = server, client
+	t.reportedUnanswered = t.unanswered
+	t.metrics.transactionsActive(int(t.stats.serverActive.Load()), int(t.stats.clientActive.Load()))
+}
+
 func (t *transactionLayer) wait() {
 	t.wg.Wait()
 }
@@ -209,6 +408,7 @@ func (t *transactionLayer) handleTransportEvent(ctx context.Context, evt transpo
 	if evt.Message == nil {
 		return
 	}
+	t.metrics.messageReceived(evt)
 	if evt.Message.IsRequest() {
 		t.handleRequest(ctx, evt)
 		return
@@ -218,42 +418,58 @@ func (t *transactionLayer) handleTransportEvent(ctx context.Context, evt transpo
 
 func (t *transactionLayer) handleRequest(ctx context.Context, evt transportEvent) {
 	req := evt.Message
+	method := strings.ToUpper(req.Method)
+	if err := req.Validate(); err != nil {
+		// An ACK cannot be answered, so a malformed one is dropped.
+		var invalid *ValidationError
+		if method != "ACK" && errors.As(err, &invalid) {
+			t.rejectRequest(ctx, req, 400, invalid.Reason)
+		}
+		return
+	}
 	branch := topViaBranch(req)
 	if branch == "" {
 		t.rejectRequest(ctx, req, 400, "Missing branch")
 		return
 	}
-	method := strings.ToUpper(req.Method)
 	if method == "ACK" {
 		t.handleAck(branch)
 		return
 	}
 	key := transactionKey(branch, method)
 	if entry, ok := t.serverTxns[key]; ok {
+		t.metrics.retransmitted("absorbed")
 		if data := entry.txn.data(); data != nil && data.lastResponse != nil {
 			resp := data.lastResponse.Clone()
+			t.stats.responseRetransmissions.Add(1)
 			t.sendToTransport(ctx, transportEvent{Direction: directionDownstream, Message: resp})
 		}
 		entry.expires = time.Now().Add(t.serverTransactionRetention())
-		t.serverTxns[key] = entry
+		t.storeServer(key, entry)
 		return
 	}
 	txnData := &transactionData{
 		id:      key,
 		branch:  branch,
 		method:  method,
-		request: req.Clone(),
+		request: req.Clone().untraced(),
+	}
+	parent := req.ctx
+	if parent == nil {
+		parent = ctx
 	}
+	t.startContext(txnData, parent)
+	txnData.startTransactionSpan(spanServerTransaction, tracing.KindServer, req)
 	txn := newServerTransactionForMethod(method, txnData)
 	now := time.Now()
-	t.serverTxns[key] = serverTransactionEntry{
+	t.storeServer(key, serverTransactionEntry{
 		txn:     txn,
 		expires: now.Add(t.serverTransactionRetention()),
-	}
+	})
 	event := tuEvent{
 		Kind:       tuEventRequest,
 		ServerTxID: key,
-		Message:    req.Clone(),
+		Message:    txnData.withinSpan(req),
 	}
 	t.sendToTU(ctx, event)
 }
@@ -274,11 +490,18 @@ func (t *transactionLayer) handleResponse(ctx context.Context, evt transportEven
 		return
 	}
 	txn := entry.txn
+	status := resp.StatusCode
 	if data := txn.data(); data != nil {
-		data.lastResponse = resp.Clone()
+		data.lastResponse = resp.Clone().untraced()
+		if status > 100 && status < 200 {
+			data.alerted = true
+		}
 	}
-	status := resp.StatusCode
 	completed := txn.onReceiveResponse(status)
+	if status >= 200 {
+		t.metrics.clientTransactionDone(txn.data(), false)
+		txn.data().finishSpan(status, false)
+	}
 	now := time.Now()
 	switch txn.(type) {
 	case *inviteClientTransaction:
@@ -291,20 +514,20 @@ func (t *transactionLayer) handleResponse(ctx context.Context, evt transportEven
 					entry.timerCDeadline = now.Add(timeout)
 				}
 			}
-			t.clientTxns[key] = entry
+			t.storeClient(key, entry)
 			break
 		}
 		entry.timerCDeadline = time.Time{}
 		if status < 300 {
-			delete(t.clientTxns, key)
+			t.deleteClient(key)
 			break
 		}
 		if timeout := t.timerD(); timeout > 0 {
 			entry.terminateAt = now.Add(timeout)
-			t.clientTxns[key] = entry
+			t.storeClient(key, entry)
 		} else {
 			txn.onTimeout()
-			delete(t.clientTxns, key)
+			t.deleteClient(key)
 		}
 	default:
 		if status < 200 {
@@ -316,7 +539,7 @@ func (t *transactionLayer) handleResponse(ctx context.Context, evt transportEven
 				entry.retransmitInterval = interval
 				entry.retransmitAt = now.Add(interval)
 			}
-			t.clientTxns[key] = entry
+			t.storeClient(key, entry)
 			break
 		}
 		entry.deadline = time.Time{}
@@ -324,20 +547,20 @@ func (t *transactionLayer) handleResponse(ctx context.Context, evt transportEven
 		entry.retransmitInterval = 0
 		if timeout := t.timerK(); timeout > 0 {
 			entry.terminateAt = now.Add(timeout)
-			t.clientTxns[key] = entry
+			t.storeClient(key, entry)
 		} else {
 			txn.onTimeout()
-			delete(t.clientTxns, key)
+			t.deleteClient(key)
 		}
 	}
 	if completed {
-		delete(t.clientTxns, key)
+		t.deleteClient(key)
 	}
 	event := tuEvent{
 		Kind:       tuEventResponse,
 		ServerTxID: txn.serverID(),
 		ClientTxID: key,
-		Message:    resp.Clone(),
+		Message:    resp,
 	}
 	t.sendToTU(ctx, event)
 }
@@ -364,8 +587,15 @@ func (t *transactionLayer) handleTUAction(ctx context.Context, action tuAction)
 			id:      key,
 			branch:  branch,
 			method:  method,
-			request: action.Message.Clone(),
+			request: action.Message.Clone().untraced(),
+			started: time.Now(),
 		}
+		parent := action.Message.ctx
+		if parent == nil {
+			parent = ctx
+		}
+		t.startContext(txnData, parent)
+		txnData.startTransactionSpan(spanClientTransaction, tracing.KindClient, action.Message)
 		txn := newClientTransactionForMethod(method, txnData, action.ServerTxID)
 		entry := clientTransactionEntry{txn: txn}
 		now := time.Now()
@@ -390,8 +620,8 @@ func (t *transactionLayer) handleTUAction(ctx context.Context, action tuAction)
 				entry.deadline = now.Add(timeout)
 			}
 		}
-		t.clientTxns[key] = entry
-		t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: action.Message.Clone()})
+		t.storeClient(key, entry)
+		t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: txnData.withinSpan(action.Message)})
 	case tuActionSendResponse:
 		if action.Message == nil {
 			return
@@ -400,15 +630,19 @@ func (t *transactionLayer) handleTUAction(ctx context.Context, action tuAction)
 		if !ok {
 			return
 		}
-		resp := action.Message.Clone()
+		resp := action.Message
 		if data := entry.txn.data(); data != nil {
-			data.lastResponse = resp.Clone()
+			data.lastResponse = resp.Clone().untraced()
 		}
 		status := resp.StatusCode
 		entry.txn.onSendResponse(status)
+		if status >= 200 {
+			entry.txn.data().finishSpan(status, false)
+		}
 		now := time.Now()
 		entry.expires = now.Add(t.serverTransactionRetention())
 		if status >= 200 {
+			entry.answered = true
 			switch entry.txn.(type) {
 			case *inviteServerTransaction:
 				if status >= 300 {
@@ -426,7 +660,7 @@ func (t *transactionLayer) handleTUAction(ctx context.Context, action tuAction)
 				entry.retransmitAt = time.Time{}
 			}
 		}
-		t.serverTxns[action.ServerTxID] = entry
+		t.storeServer(action.ServerTxID, entry)
 		t.sendToTransport(ctx, transportEvent{Direction: directionDownstream, Message: resp})
 	}
 }
@@ -434,6 +668,7 @@ func (t *transactionLayer) handleTUAction(ctx context.Context, action tuAction)
 func (t *transactionLayer) sendToTransport(ctx context.Context, evt transportEvent) {
 	if evt.Message != nil {
 		evt.Message.EnsureContentLength()
+		evt.Message.traceHop(spanHopTransaction)
 	}
 	select {
 	case t.toTransport <- evt:
@@ -444,6 +679,7 @@ func (t *transactionLayer) sendToTransport(ctx context.Context, evt transportEve
 func (t *transactionLayer) sendToTU(ctx context.Context, event tuEvent) {
 	if event.Message != nil {
 		event.Message.EnsureContentLength()
+		event.Message.traceHop(spanHopTransaction)
 	}
 	select {
 	case t.toTU <- event:
@@ -467,7 +703,7 @@ func topViaBranch(msg *Message) string {
 	if msg == nil {
 		return ""
 	}
-	values := msg.HeaderValues("Via")
+	values := msg.HeaderList("Via")
 	if len(values) == 0 {
 		return ""
 	}
@@ -620,112 +856,255 @@ func (t *transactionLayer) timerK() time.Duration {
 	return t.timerKDuration
 }
 
-func (t *transactionLayer) cleanupTransactions(ctx context.Context, now time.Time) {
-	if len(t.serverTxns) > 0 {
-		retention := t.serverTransactionRetention()
-		maxInterval := t.timerGMaxInterval()
-		for key, entry := range t.serverTxns {
-			if !entry.deadline.IsZero() && now.After(entry.deadline) {
-				delete(t.serverTxns, key)
-				continue
-			}
+// fireTimers runs every transaction timer due at or before now, earliest
+// first. Callbacks may schedule further timers; those already due run in the
+// same pass.
+func (t *transactionLayer) fireTimers(ctx context.Context, now time.Time) {
+	for {
+		timer := t.timers.popDue(now)
+		if timer == nil {
+			return
+		}
+		timer.fire(ctx, now)
+	}
+}
 
-			if !entry.retransmitAt.IsZero() && (now.Equal(entry.retransmitAt) || now.After(entry.retransmitAt)) {
-				if data := entry.txn.data(); data != nil && data.lastResponse != nil {
-					t.sendToTransport(ctx, transportEvent{Direction: directionDownstream, Message: data.lastResponse.Clone()})
-					if entry.retransmitInterval <= 0 {
-						entry.retransmitInterval = t.timerGStart()
-					} else {
-						entry.retransmitInterval *= 2
-						if maxInterval > 0 && entry.retransmitInterval > maxInterval {
-							entry.retransmitInterval = maxInterval
-						}
-					}
-					entry.retransmitAt = now.Add(entry.retransmitInterval)
-					entry.expires = now.Add(retention)
-					t.serverTxns[key] = entry
-				} else {
-					entry.retransmitAt = time.Time{}
-					entry.retransmitInterval = 0
-					t.serverTxns[key] = entry
-				}
-				continue
-			}
+// storeServer records entry under key and arms its timers to match its
+// deadlines.
+func (t *transactionLayer) storeServer(key string, entry serverTransactionEntry) {
+	if old, ok := t.serverTxns[key]; !ok && !entry.answered {
+		t.unanswered++
+	} else if ok && !old.answered && entry.answered {
+		t.unanswered--
+	}
+	t.timers.rearm(&entry.timers[serverTimerDeadline], entry.deadline, func(ctx context.Context, now time.Time) {
+		t.serverDeadlineExpired(key)
+	})
+	t.timers.rearm(&entry.timers[serverTimerRetransmit], entry.retransmitAt, func(ctx context.Context, now time.Time) {
+		t.retransmitResponse(ctx, key, now)
+	})
+	t.timers.rearm(&entry.timers[serverTimerExpiry], entry.expires, func(ctx context.Context, now time.Time) {
+		t.serverExpired(key)
+	})
+	t.serverTxns[key] = entry
+}
 
-			if now.After(entry.expires) {
-				delete(t.serverTxns, key)
-			}
-		}
+// deleteServer forgets the server transaction key and cancels its timers.
+func (t *transactionLayer) deleteServer(key string) {
+	entry, ok := t.serverTxns[key]
+	if !ok {
+		return
+	}
+	for _, timer := range entry.timers {
+		t.timers.cancel(timer)
 	}
+	if !entry.answered {
+		t.unanswered--
+	}
+	entry.txn.data().endContext()
+	delete(t.serverTxns, key)
+}
+
+// storeClient records entry under key and arms its timers to match its
+// deadlines.
+func (t *transactionLayer) storeClient(key string, entry clientTransactionEntry) {
+	t.timers.rearm(&entry.timers[clientTimerDeadline], entry.deadline, func(ctx context.Context, now time.Time) {
+		t.clientDeadlineExpired(ctx, key)
+	})
+	t.timers.rearm(&entry.timers[clientTimerC], entry.timerCDeadline, func(ctx context.Context, now time.Time) {
+		t.timerCExpired(ctx, key)
+	})
+	t.timers.rearm(&entry.timers[clientTimerRetransmit], entry.retransmitAt, func(ctx context.Context, now time.Time) {
+		t.retransmitRequest(ctx, key, now)
+	})
+	t.timers.rearm(&entry.timers[clientTimerTerminate], entry.terminateAt, func(ctx context.Context, now time.Time) {
+		t.clientTerminated(key)
+	})
+	t.clientTxns[key] = entry
+}
 
-	if len(t.clientTxns) == 0 {
+// deleteClient forgets the client transaction key and cancels its timers.
+func (t *transactionLayer) deleteClient(key string) {
+	entry, ok := t.clientTxns[key]
+	if !ok {
 		return
 	}
-	inviteMax := t.timerAMaxInterval()
-	nonInviteMax := t.timerEMaxInterval()
-	for key, entry := range t.clientTxns {
-		txn := entry.txn
-		data := txn.data()
+	for _, timer := range entry.timers {
+		t.timers.cancel(timer)
+	}
+	entry.txn.data().endContext()
+	delete(t.clientTxns, key)
+}
 
-		if !entry.deadline.IsZero() && (now.Equal(entry.deadline) || now.After(entry.deadline)) {
-			if resp := timeoutResponseFromRequest(data, 408, "Request Timeout"); resp != nil {
-				txn.onTimeout()
-				t.sendToTU(ctx, tuEvent{Kind: tuEventResponse, ServerTxID: txn.serverID(), ClientTxID: key, Message: resp})
-			}
-			delete(t.clientTxns, key)
-			continue
-		}
+// serverDeadlineExpired ends a server transaction on Timer H, I, or J.
+func (t *transactionLayer) serverDeadlineExpired(key string) {
+	entry, ok := t.serverTxns[key]
+	if !ok {
+		return
+	}
+	t.serverDeadlineFired(entry.txn)
+	entry.txn.data().finishSpan(0, false)
+	t.deleteServer(key)
+}
 
-		if !entry.timerCDeadline.IsZero() && (now.Equal(entry.timerCDeadline) || now.After(entry.timerCDeadline)) {
-			if cancel := cancelFromRequest(data); cancel != nil {
-				t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: cancel})
-			}
-			if resp := timeoutResponseFromRequest(data, 408, "Request Timeout"); resp != nil {
-				txn.onTimeout()
-				t.sendToTU(ctx, tuEvent{Kind: tuEventResponse, ServerTxID: txn.serverID(), ClientTxID: key, Message: resp})
-			}
-			delete(t.clientTxns, key)
-			continue
+// retransmitResponse resends the final response on Timer G, doubling the
+// interval up to T2.
+func (t *transactionLayer) retransmitResponse(ctx context.Context, key string, now time.Time) {
+	entry, ok := t.serverTxns[key]
+	if !ok {
+		return
+	}
+	data := entry.txn.data()
+	if data == nil || data.lastResponse == nil {
+		entry.retransmitAt = time.Time{}
+		entry.retransmitInterval = 0
+		t.storeServer(key, entry)
+		return
+	}
+	t.sendToTransport(ctx, transportEvent{Direction: directionDownstream, Message: data.lastResponse.Clone()})
+	t.metrics.retransmitted("response")
+	t.stats.responseRetransmissions.Add(1)
+	t.stats.fired('G')
+	if entry.retransmitInterval <= 0 {
+		entry.retransmitInterval = t.timerGStart()
+	} else {
+		entry.retransmitInterval *= 2
+		if maxInterval := t.timerGMaxInterval(); maxInterval > 0 && entry.retransmitInterval > maxInterval {
+			entry.retransmitInterval = maxInterval
 		}
+	}
+	entry.retransmitAt = now.Add(entry.retransmitInterval)
+	entry.expires = now.Add(t.serverTransactionRetention())
+	t.storeServer(key, entry)
+}
 
-		if !entry.retransmitAt.IsZero() && (now.Equal(entry.retransmitAt) || now.After(entry.retransmitAt)) {
-			if data != nil && data.request != nil {
-				t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: data.request.Clone()})
-				switch txn.(type) {
-				case *inviteClientTransaction:
-					if entry.retransmitInterval <= 0 {
-						entry.retransmitInterval = t.timerAStart()
-					} else {
-						entry.retransmitInterval *= 2
-						if inviteMax > 0 && entry.retransmitInterval > inviteMax {
-							entry.retransmitInterval = inviteMax
-						}
-					}
-				default:
-					if entry.retransmitInterval <= 0 {
-						entry.retransmitInterval = t.timerEStart()
-					} else {
-						entry.retransmitInterval *= 2
-						if nonInviteMax > 0 && entry.retransmitInterval > nonInviteMax {
-							entry.retransmitInterval = nonInviteMax
-						}
-					}
-				}
-				entry.retransmitAt = now.Add(entry.retransmitInterval)
-				t.clientTxns[key] = entry
-			} else {
-				entry.retransmitAt = time.Time{}
-				entry.retransmitInterval = 0
-				t.clientTxns[key] = entry
-			}
-			continue
+// serverExpired evicts a server transaction once its retention has passed.
+func (t *transactionLayer) serverExpired(key string) {
+	entry, ok := t.serverTxns[key]
+	if !ok {
+		return
+	}
+	entry.txn.data().finishSpan(0, false)
+	t.deleteServer(key)
+}
+
+// clientDeadlineExpired times a client transaction out on Timer B or F and
+// answers the TU with a 408.
+func (t *transactionLayer) clientDeadlineExpired(ctx context.Context, key string) {
+	entry, ok := t.clientTxns[key]
+	if !ok {
+		return
+	}
+	txn := entry.txn
+	data := txn.data()
+	timer := byte('F')
+	if _, invite := txn.(*inviteClientTransaction); invite {
+		timer = 'B'
+	}
+	t.stats.fired(timer)
+	t.events.publish(timeoutEvent(timer, data))
+	t.metrics.clientTransactionDone(data, true)
+	data.finishSpan(0, true)
+	t.deleteClient(key)
+	if resp := timeoutResponseFromRequest(data, 408, "Request Timeout"); resp != nil {
+		txn.onTimeout()
+		t.sendToTU(ctx, tuEvent{Kind: tuEventResponse, ServerTxID: txn.serverID(), ClientTxID: key, Message: resp, TimedOut: true})
+	}
+}
+
+// timerCExpired cancels an INVITE that has been proceeding for too long,
+// giving the Q.850 cause in a Reason header, and answers the TU with a 408.
+func (t *transactionLayer) timerCExpired(ctx context.Context, key string) {
+	entry, ok := t.clientTxns[key]
+	if !ok {
+		return
+	}
+	txn := entry.txn
+	data := txn.data()
+	t.stats.fired('C')
+	t.events.publish(timeoutEvent('C', data))
+	if cancel := cancelFromRequest(data); cancel != nil {
+		reason := reasonNoUserResponding
+		if data.alerted {
+			reason = reasonNoAnswer
 		}
+		cancel.SetHeader("Reason", reason)
+		t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: cancel})
+	}
+	t.metrics.clientTransactionDone(data, true)
+	data.finishSpan(0, true)
+	t.deleteClient(key)
+	if resp := timeoutResponseFromRequest(data, 408, "Request Timeout"); resp != nil {
+		txn.onTimeout()
+		t.sendToTU(ctx, tuEvent{Kind: tuEventResponse, ServerTxID: txn.serverID(), ClientTxID: key, Message: resp})
+	}
+}
 
-		if !entry.terminateAt.IsZero() && (now.Equal(entry.terminateAt) || now.After(entry.terminateAt)) {
-			txn.onTimeout()
-			delete(t.clientTxns, key)
+// retransmitRequest resends the request on Timer A or E, doubling the
+// interval up to T2.
+func (t *transactionLayer) retransmitRequest(ctx context.Context, key string, now time.Time) {
+	entry, ok := t.clientTxns[key]
+	if !ok {
+		return
+	}
+	data := entry.txn.data()
+	if data == nil || data.request == nil {
+		entry.retransmitAt = time.Time{}
+		entry.retransmitInterval = 0
+		t.storeClient(key, entry)
+		return
+	}
+	t.sendToTransport(ctx, transportEvent{Direction: directionUpstream, Message: data.bind(data.request.Clone())})
+	t.metrics.retransmitted("request")
+	t.stats.requestRetransmissions.Add(1)
+	start, maxInterval := t.timerEStart(), t.timerEMaxInterval()
+	if _, invite := entry.txn.(*inviteClientTransaction); invite {
+		t.stats.fired('A')
+		start, maxInterval = t.timerAStart(), t.timerAMaxInterval()
+	} else {
+		t.stats.fired('E')
+	}
+	if entry.retransmitInterval <= 0 {
+		entry.retransmitInterval = start
+	} else {
+		entry.retransmitInterval *= 2
+		if maxInterval > 0 && entry.retransmitInterval > maxInterval {
+			entry.retransmitInterval = maxInterval
 		}
 	}
+	entry.retransmitAt = now.Add(entry.retransmitInterval)
+	t.storeClient(key, entry)
+}
+
+// clientTerminated drops a completed client transaction on Timer D or K.
+func (t *transactionLayer) clientTerminated(key string) {
+	entry, ok := t.clientTxns[key]
+	if !ok {
+		return
+	}
+	if _, invite := entry.txn.(*inviteClientTransaction); invite {
+		t.stats.fired('D')
+	} else {
+		t.stats.fired('K')
+	}
+	entry.txn.onTimeout()
+	t.deleteClient(key)
+}
+
+// serverDeadlineFired records which timer ended a server transaction: Timer J
+// for non-INVITE, Timer I once an INVITE error response was acknowledged, and
+// Timer H while it was not.
+func (t *transactionLayer) serverDeadlineFired(txn serverTransaction) {
+	invite, ok := txn.(*inviteServerTransaction)
+	switch {
+	case !ok:
+		t.stats.fired('J')
+	case invite.state == inviteServerTransactionStateConfirmed:
+		t.stats.fired('I')
+	case invite.state == inviteServerTransactionStateCompleted:
+		t.stats.fired('H')
+		t.events.publish(timeoutEvent('H', txn.data()))
+	}
 }
 
 func (t *transactionLayer) handleAck(branch string) {
@@ -746,7 +1125,7 @@ func (t *transactionLayer) handleAck(branch string) {
 	}
 	timeout := t.timerI()
 	if timeout <= 0 {
-		delete(t.serverTxns, key)
+		t.deleteServer(key)
 		return
 	}
 	now := time.Now()
@@ -754,7 +1133,7 @@ func (t *transactionLayer) handleAck(branch string) {
 	entry.retransmitInterval = 0
 	entry.retransmitAt = time.Time{}
 	entry.expires = now.Add(t.serverTransactionRetention())
-	t.serverTxns[key] = entry
+	t.storeServer(key, entry)
 }
 
 func timeoutResponseFromRequest(data *transactionData, status int, reason string) *Message {
@@ -2,6 +2,7 @@ package sip
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -21,13 +22,74 @@ func TestTransactionLayerCleansUpExpiredServerTransactions(t *testing.T) {
 	}
 
 	time.Sleep(15 * time.Millisecond)
-	layer.cleanupTransactions(context.Background(), time.Now())
+	layer.fireTimers(context.Background(), time.Now())
 
 	if len(layer.serverTxns) != 0 {
 		t.Fatalf("expected expired server transaction to be cleaned up, got %d remaining", len(layer.serverTxns))
 	}
 }
 
+func TestTransactionContextEndsWithTransaction(t *testing.T) {
+	toTU := make(chan tuEvent, 1)
+	layer := newTransactionLayer(nil, make(chan transportEvent, 1), toTU, nil)
+	layer.serverTxTTL = 10 * time.Millisecond
+	layer.timerCDuration = time.Minute
+
+	type key struct{}
+	req := newInvite()
+	req.ctx = context.WithValue(context.Background(), key{}, "stack")
+	start := time.Now()
+	layer.handleRequest(context.Background(), transportEvent{Direction: directionDownstream, Message: req})
+
+	ctx := (<-toTU).Message.Context()
+	if ctx.Value(key{}) != "stack" {
+		t.Fatalf("expected the transaction context to derive from the message's")
+	}
+	if deadline, ok := ctx.Deadline(); !ok || deadline.Before(start.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected a deadline Timer C away, got %v, %v", deadline, ok)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("expected a live transaction's context to be live")
+	}
+
+	time.Sleep(15 * time.Millisecond)
+	layer.fireTimers(context.Background(), time.Now())
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("expected the context to end with the transaction, got %v", ctx.Err())
+	}
+}
+
+func TestTransactionLayerRejectsInvalidRequests(t *testing.T) {
+	toTransport := make(chan transportEvent, 1)
+	toTU := make(chan tuEvent, 1)
+	layer := newTransactionLayer(nil, toTransport, toTU, nil)
+
+	req := newInvite()
+	req.SetHeader("CSeq", "314159 OPTIONS")
+	layer.handleRequest(context.Background(), transportEvent{Direction: directionDownstream, Message: req})
+
+	select {
+	case evt := <-toTransport:
+		if evt.Message == nil || evt.Message.StatusCode != 400 || evt.Message.ReasonPhrase != "CSeq Method Mismatch" {
+			t.Fatalf("expected 400 CSeq Method Mismatch, got %#v", evt.Message)
+		}
+	default:
+		t.Fatalf("expected the invalid request to be answered")
+	}
+	if len(layer.serverTxns) != 0 || len(toTU) != 0 {
+		t.Fatalf("expected the invalid request not to start a transaction")
+	}
+
+	ack := newInvite()
+	ack.Method = "ACK"
+	ack.SetHeader("CSeq", "314159 ACK")
+	ack.DelHeader("Max-Forwards")
+	layer.handleRequest(context.Background(), transportEvent{Direction: directionDownstream, Message: ack})
+	if len(toTransport) != 0 {
+		t.Fatalf("expected an invalid ACK to be dropped without a response")
+	}
+}
+
 func TestTransactionLayerRetransmitsFinalResponses(t *testing.T) {
 	ctx := context.Background()
 	toTransport := make(chan transportEvent, 10)
@@ -47,7 +109,7 @@ func TestTransactionLayerRetransmitsFinalResponses(t *testing.T) {
 	layer.handleTUAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: key, Message: resp})
 
 	time.Sleep(2 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTransport:
@@ -59,7 +121,7 @@ func TestTransactionLayerRetransmitsFinalResponses(t *testing.T) {
 	}
 
 	time.Sleep(5 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.serverTxns[key]; ok {
 		t.Fatalf("expected server transaction to be removed after timer H expiry")
@@ -91,7 +153,7 @@ func TestInviteServerTransactionStopsRetransmissionsAfterAck(t *testing.T) {
 	}
 
 	time.Sleep(2 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case <-toTransport:
@@ -105,7 +167,7 @@ func TestInviteServerTransactionStopsRetransmissionsAfterAck(t *testing.T) {
 	layer.handleRequest(ctx, transportEvent{Direction: directionDownstream, Message: ack})
 
 	time.Sleep(3 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTransport:
@@ -114,7 +176,7 @@ func TestInviteServerTransactionStopsRetransmissionsAfterAck(t *testing.T) {
 	}
 
 	time.Sleep(4 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.serverTxns[key]; ok {
 		t.Fatalf("expected server transaction to be removed after timer I expiry")
@@ -143,7 +205,7 @@ func TestNonInviteServerTransactionRetainedForTimerJ(t *testing.T) {
 	}
 
 	time.Sleep(3 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.serverTxns[key]; !ok {
 		t.Fatalf("expected server transaction to persist until timer J expires")
@@ -158,7 +220,7 @@ func TestNonInviteServerTransactionRetainedForTimerJ(t *testing.T) {
 	}
 
 	time.Sleep(4 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.serverTxns[key]; ok {
 		t.Fatalf("expected server transaction to be removed after timer J expiry")
@@ -187,7 +249,7 @@ func TestInviteClientTransactionRetransmitsUntilProvisional(t *testing.T) {
 	}
 
 	time.Sleep(2 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	var retrans transportEvent
 	select {
@@ -203,7 +265,7 @@ func TestInviteClientTransactionRetransmitsUntilProvisional(t *testing.T) {
 	layer.handleResponse(ctx, transportEvent{Direction: directionUpstream, Message: ringing})
 
 	time.Sleep(3 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTransport:
@@ -231,7 +293,7 @@ func TestInviteClientTransactionTimerBGeneratesTimeout(t *testing.T) {
 	<-toTransport
 
 	time.Sleep(7 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTU:
@@ -290,7 +352,7 @@ func TestInviteClientTransactionCancelsTimerBAfterProvisional(t *testing.T) {
 	}
 
 	time.Sleep(7 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.clientTxns[key]; !ok {
 		t.Fatalf("expected invite transaction to persist until timer C expiry")
@@ -334,7 +396,7 @@ func TestInviteClientTransactionTimerDTerminatesAfterFinal(t *testing.T) {
 	}
 
 	time.Sleep(6 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.clientTxns[transactionKey(branch, "INVITE")]; ok {
 		t.Fatalf("expected invite client transaction to be removed after timer D")
@@ -360,7 +422,7 @@ func TestInviteClientTransactionTimerCSendsCancel(t *testing.T) {
 	<-toTransport
 
 	time.Sleep(5 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	cancelSeen := false
 	for {
@@ -368,6 +430,9 @@ func TestInviteClientTransactionTimerCSendsCancel(t *testing.T) {
 		case evt := <-toTransport:
 			if evt.Message != nil && strings.EqualFold(evt.Message.Method, "CANCEL") {
 				cancelSeen = true
+				if got := evt.Message.GetHeader("Reason"); got != reasonNoUserResponding {
+					t.Fatalf("expected the Q.850 cause of an unanswered INVITE, got %q", got)
+				}
 			}
 		default:
 			goto done
@@ -388,6 +453,50 @@ done:
 	}
 }
 
+func TestInviteClientTransactionTimerCReasonFollowsAlerting(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		reason string
+		want   string
+	}{
+		{"trying only", 100, "Trying", reasonNoUserResponding},
+		{"ringing", 180, "Ringing", reasonNoAnswer},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			toTransport := make(chan transportEvent, 10)
+			toTU := make(chan tuEvent, 10)
+			layer := newTransactionLayer(nil, toTransport, toTU, nil)
+			layer.timerCDuration = 4 * time.Millisecond
+
+			invite := newInvite()
+			branch := newBranchID()
+			prependVia(invite, branch)
+			layer.handleTUAction(ctx, tuAction{Kind: tuActionForwardRequest, ServerTxID: "down", ClientTxID: transactionKey(branch, "INVITE"), Message: invite})
+			first := <-toTransport
+			layer.handleResponse(ctx, transportEvent{Direction: directionUpstream, Message: buildResponseFrom(first.Message, tt.status, tt.reason)})
+
+			time.Sleep(5 * time.Millisecond)
+			layer.fireTimers(ctx, time.Now())
+
+			for {
+				select {
+				case evt := <-toTransport:
+					if evt.Message != nil && strings.EqualFold(evt.Message.Method, "CANCEL") {
+						if got := evt.Message.GetHeader("Reason"); got != tt.want {
+							t.Fatalf("expected Reason %q after a %d, got %q", tt.want, tt.status, got)
+						}
+						return
+					}
+				default:
+					t.Fatalf("expected CANCEL to be sent on timer C expiry")
+				}
+			}
+		})
+	}
+}
+
 func TestNonInviteClientTransactionRetransmitsAndTerminates(t *testing.T) {
 	ctx := context.Background()
 	toTransport := make(chan transportEvent, 10)
@@ -407,7 +516,7 @@ func TestNonInviteClientTransactionRetransmitsAndTerminates(t *testing.T) {
 	first, _ := <-toTransport
 
 	time.Sleep(2 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTransport:
@@ -431,14 +540,14 @@ func TestNonInviteClientTransactionRetransmitsAndTerminates(t *testing.T) {
 	}
 
 	time.Sleep(2 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if entry, ok := layer.clientTxns[transactionKey(branch, "OPTIONS")]; !ok || entry.terminateAt.IsZero() {
 		t.Fatalf("expected non-INVITE client transaction to wait for timer K")
 	}
 
 	time.Sleep(3 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	if _, ok := layer.clientTxns[transactionKey(branch, "OPTIONS")]; ok {
 		t.Fatalf("expected non-INVITE client transaction to be removed after timer K")
@@ -467,7 +576,7 @@ func TestNonInviteClientTransactionTimerFGeneratesTimeout(t *testing.T) {
 	<-toTransport
 
 	time.Sleep(7 * time.Millisecond)
-	layer.cleanupTransactions(ctx, time.Now())
+	layer.fireTimers(ctx, time.Now())
 
 	select {
 	case evt := <-toTU:
@@ -482,3 +591,234 @@ func TestNonInviteClientTransactionTimerFGeneratesTimeout(t *testing.T) {
 		t.Fatalf("expected non-INVITE client transaction to be removed after timer F")
 	}
 }
+
+func TestTransactionStatsCountTimersAndRetransmissions(t *testing.T) {
+	ctx := context.Background()
+	toTransport := make(chan transportEvent, 10)
+	toTU := make(chan tuEvent, 10)
+	layer := newTransactionLayer(nil, toTransport, toTU, nil)
+	layer.timerEInitial = time.Millisecond
+	layer.timerEMax = 2 * time.Millisecond
+	layer.timerFDuration = 6 * time.Millisecond
+
+	options := newOptions()
+	branch := newBranchID()
+	prependVia(options, branch)
+	layer.handleTUAction(ctx, tuAction{Kind: tuActionForwardRequest, ServerTxID: "down", ClientTxID: transactionKey(branch, "OPTIONS"), Message: options})
+	<-toTransport
+	sent := time.Now()
+
+	// Timer E fires at 1ms and again 2ms later; Timer F at 6ms ends the
+	// transaction before the third retransmission.
+	layer.fireTimers(ctx, sent.Add(2*time.Millisecond))
+	layer.fireTimers(ctx, sent.Add(10*time.Millisecond))
+
+	stats := layer.stats.snapshot()
+	if stats.TimerFirings["E"] != 2 || stats.TimerFirings["F"] != 1 || stats.TimerFirings["A"] != 0 {
+		t.Fatalf("unexpected timer firings %v", stats.TimerFirings)
+	}
+	if stats.RequestRetransmissions != 2 || stats.ResponseRetransmissions != 0 || stats.Timeouts != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(stats.TimerFirings) != 11 {
+		t.Fatalf("expected every timer from A to K, got %v", stats.TimerFirings)
+	}
+}
+
+func TestTimerConfigDerivesTransactionTimers(t *testing.T) {
+	layer := newTransactionLayer(nil, nil, nil, nil)
+	TimerConfig{T1: 100 * time.Millisecond, T4: time.Second}.apply(layer)
+
+	if layer.timerAInitial != 100*time.Millisecond || layer.timerEInitial != 100*time.Millisecond {
+		t.Fatalf("expected T1 to set the first retransmission intervals, got %v and %v", layer.timerAInitial, layer.timerEInitial)
+	}
+	if layer.timerBDuration != 6400*time.Millisecond || layer.timerFDuration != 6400*time.Millisecond || layer.timerHDuration != 6400*time.Millisecond {
+		t.Fatalf("expected Timers B, F, and H to be 64*T1, got %v, %v, %v", layer.timerBDuration, layer.timerFDuration, layer.timerHDuration)
+	}
+	if layer.timerKDuration != time.Second {
+		t.Fatalf("expected T4 to set Timer K, got %v", layer.timerKDuration)
+	}
+	if layer.timerEMax != defaultTimerT2 || layer.timerCDuration != defaultTimerC {
+		t.Fatalf("expected unset fields to keep their defaults, got %v and %v", layer.timerEMax, layer.timerCDuration)
+	}
+}
+
+func TestTimerConfigValidateRejectsOutOfRangeTimers(t *testing.T) {
+	valid := []TimerConfig{
+		{},
+		{T1: 100 * time.Millisecond, T2: time.Second, T4: time.Second, TimerC: 10 * time.Minute},
+		{T1: 10 * time.Second, T2: 10 * time.Second, TimerC: time.Hour},
+	}
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Fatalf("expected %+v to be valid, got %v", c, err)
+		}
+	}
+	invalid := []TimerConfig{
+		{T1: -time.Second},
+		{T1: time.Millisecond},
+		{T1: time.Minute},
+		{T1: 5 * time.Second},
+		{T1: time.Second, T2: 500 * time.Millisecond},
+		{T4: time.Hour},
+		{TimerC: 10 * time.Second},
+		{TimerC: 2 * time.Hour},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Fatalf("expected %+v to be rejected", c)
+		}
+	}
+}
+
+func TestRetimeToKeepsOnlyTheLatestTimers(t *testing.T) {
+	layer := newTransactionLayer(nil, nil, nil, nil)
+	layer.retimeTo(TimerConfig{T1: time.Second})
+	layer.retimeTo(TimerConfig{T4: time.Second})
+
+	(<-layer.retime).apply(layer)
+	if layer.timerAInitial != defaultTimerT1 || layer.timerKDuration != time.Second {
+		t.Fatalf("expected the latest timers, with T1 back at its default, got %v and %v", layer.timerAInitial, layer.timerKDuration)
+	}
+}
+
+func TestTimerHeapFiresDueTimersInOrder(t *testing.T) {
+	var h timerHeap
+	var fired []string
+	record := func(name string) func(context.Context, time.Time) {
+		return func(context.Context, time.Time) { fired = append(fired, name) }
+	}
+	base := time.Now()
+	var first, second, third, moved *scheduledTimer
+	h.rearm(&second, base.Add(2*time.Millisecond), record("second"))
+	h.rearm(&first, base.Add(time.Millisecond), record("first"))
+	h.rearm(&third, base.Add(2*time.Millisecond), record("third"))
+	h.rearm(&moved, base.Add(time.Millisecond), record("moved"))
+	h.rearm(&moved, base.Add(time.Hour), record("moved"))
+	cancelled := second
+	h.rearm(&second, time.Time{}, nil)
+	if second != nil || cancelled.index >= 0 {
+		t.Fatalf("expected a zero time to cancel the timer")
+	}
+
+	if at, ok := h.next(); !ok || !at.Equal(base.Add(time.Millisecond)) {
+		t.Fatalf("expected the earliest timer next, got %v", at)
+	}
+	for timer := h.popDue(base.Add(2 * time.Millisecond)); timer != nil; timer = h.popDue(base.Add(2 * time.Millisecond)) {
+		timer.fire(context.Background(), base)
+	}
+	if strings.Join(fired, ",") != "first,third" {
+		t.Fatalf("unexpected firing order %v", fired)
+	}
+	if h.Len() != 1 || moved.index < 0 {
+		t.Fatalf("expected only the rescheduled timer to remain pending, got %d", h.Len())
+	}
+}
+
+func TestTransactionLayerFiresTimersWithoutPolling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fromTU := make(chan tuAction, 1)
+	toTransport := make(chan transportEvent, 10)
+	toTU := make(chan tuEvent, 1)
+	layer := newTransactionLayer(make(chan transportEvent), toTransport, toTU, fromTU)
+	layer.timerEInitial = time.Hour
+	layer.timerFDuration = 20 * time.Millisecond
+	layer.start(ctx)
+
+	options := newOptions()
+	branch := newBranchID()
+	prependVia(options, branch)
+	started := time.Now()
+	fromTU <- tuAction{Kind: tuActionForwardRequest, ServerTxID: "down", ClientTxID: transactionKey(branch, "OPTIONS"), Message: options}
+
+	select {
+	case evt := <-toTU:
+		if evt.Message == nil || evt.Message.StatusCode != 408 {
+			t.Fatalf("expected a 408 from Timer F, got %#v", evt.Message)
+		}
+		if elapsed := time.Since(started); elapsed < 20*time.Millisecond || elapsed > 500*time.Millisecond {
+			t.Fatalf("expected Timer F to fire after 20ms, fired after %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for Timer F")
+	}
+	cancel()
+	layer.wait()
+}
+
+func TestTransactionShardsKeepEachTransactionOnOneShard(t *testing.T) {
+	shards := newTransactionShards(4, defaultQueueCapacity, nil, nil, nil, nil)
+	invite := newInvite()
+	key := transactionKey(topViaBranch(invite), "INVITE")
+	ack := newInvite()
+	ack.Method = "ACK"
+	resp := buildResponseFrom(invite, 486, "Busy Here")
+
+	want := shards.shardFor(key)
+	for name, got := range map[string]int{
+		"request":  shards.shardFor(transportShardKey(invite)),
+		"ACK":      shards.shardFor(transportShardKey(ack)),
+		"response": shards.shardFor(transportShardKey(resp)),
+		"answer":   shards.shardFor(actionShardKey(tuAction{Kind: tuActionSendResponse, ServerTxID: key, Message: resp})),
+		"forward":  shards.shardFor(actionShardKey(tuAction{Kind: tuActionForwardRequest, Message: invite})),
+	} {
+		if got != want {
+			t.Fatalf("expected the %s to use shard %d, got %d", name, want, got)
+		}
+	}
+}
+
+func TestProxyRoutesTransactionsAcrossShards(t *testing.T) {
+	proxy := NewProxy(WithTransactionShards(4))
+	t.Cleanup(proxy.Stop)
+
+	const calls = 20
+	for i := 0; i < calls; i++ {
+		invite := newInvite()
+		invite.SetHeader("Via", fmt.Sprintf("SIP/2.0/UDP client.example.com;branch=z9hG4bKshard%d", i))
+		proxy.SendFromClient(invite)
+	}
+	for i := 0; i < calls; i++ {
+		forwarded, ok := proxy.NextToServer(time.Second)
+		if !ok {
+			t.Fatalf("expected %d forwarded invites, got %d", calls, i)
+		}
+		proxy.SendFromServer(buildResponseFrom(forwarded, 200, "OK"))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < calls; i++ {
+		resp, ok := proxy.NextToClient(time.Second)
+		if !ok {
+			t.Fatalf("expected %d responses, got %d", calls, i)
+		}
+		seen[topViaBranch(resp)] = true
+	}
+	if len(seen) != calls {
+		t.Fatalf("expected one response per call, got %v", seen)
+	}
+	deadline := time.Now().Add(time.Second)
+	for proxy.TransactionStats().ServerTransactions != calls {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the shards' server transactions to add up to %d, got %+v", calls, proxy.TransactionStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestViaHandlingSplitsCommaSeparatedHops(t *testing.T) {
+	msg := NewRequest("INVITE", "sip:bob@example.com")
+	msg.SetHeader("Via", "SIP/2.0/UDP client.example.com;branch=z9hG4bKclient1, SIP/2.0/UDP edge.example.com;branch=z9hG4bKedge1")
+
+	if branch := topViaBranch(msg); branch != "z9hG4bKclient1" {
+		t.Fatalf("expected the branch of the first hop, got %q", branch)
+	}
+
+	prependVia(msg, "z9hG4bKproxy1")
+	removeTopViaWithBranch(msg, "z9hG4bKproxy1")
+	removeTopViaWithBranch(msg, "z9hG4bKclient1")
+	vias := msg.HeaderList("Via")
+	if len(vias) != 1 || viaBranch(vias[0]) != "z9hG4bKedge1" {
+		t.Fatalf("expected only the second hop to remain, got %q", vias)
+	}
+}
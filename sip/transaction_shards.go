@@ -0,0 +1,185 @@
+package sip
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// transactionShards spreads the transaction layer over several independent
+// transactionLayer shards, each with its own maps, timers, and goroutine.
+// Messages and TU actions are routed by a hash of their transaction key, so
+// everything belonging to one transaction reaches the same shard in order
+// while different transactions are processed in parallel. The shards share
+// the output queues, which are closed once all of them have stopped.
+type transactionShards struct {
+	fromTransport <-chan transportEvent
+	toTransport   chan<- transportEvent
+	toTU          chan<- tuEvent
+	fromTU        <-chan tuAction
+
+	shards      []*transactionLayer
+	transportIn []chan transportEvent
+	tuIn        []chan tuAction
+	stats       *transactionCounters
+
+	wg   sync.WaitGroup
+	done chan struct{}
+}
+
+// newTransactionShards prepares count shards, or one per available CPU when
+// count is not positive, each with input queues of the given capacity.
+func newTransactionShards(count, capacity int, fromTransport <-chan transportEvent, toTransport chan<- transportEvent, toTU chan<- tuEvent, fromTU <-chan tuAction) *transactionShards {
+	if count <= 0 {
+		count = runtime.GOMAXPROCS(0)
+	}
+	s := &transactionShards{
+		fromTransport: fromTransport,
+		toTransport:   toTransport,
+		toTU:          toTU,
+		fromTU:        fromTU,
+		stats:         &transactionCounters{},
+		done:          make(chan struct{}),
+	}
+	for i := 0; i < count; i++ {
+		transportIn := make(chan transportEvent, capacity)
+		tuIn := make(chan tuAction, capacity)
+		shard := newTransactionLayer(transportIn, toTransport, toTU, tuIn)
+		shard.stats = s.stats
+		s.shards = append(s.shards, shard)
+		s.transportIn = append(s.transportIn, transportIn)
+		s.tuIn = append(s.tuIn, tuIn)
+	}
+	return s
+}
+
+// each applies configure to every shard before start.
+func (s *transactionShards) each(configure func(*transactionLayer)) {
+	for _, shard := range s.shards {
+		configure(shard)
+	}
+}
+
+func (s *transactionShards) start(ctx context.Context) {
+	for _, shard := range s.shards {
+		shard.start(ctx)
+	}
+	s.wg.Add(2)
+	go s.dispatchTransport(ctx)
+	go s.dispatchTU(ctx)
+	go func() {
+		s.wg.Wait()
+		for _, shard := range s.shards {
+			shard.wait()
+		}
+		close(s.toTransport)
+		close(s.toTU)
+		close(s.done)
+	}()
+}
+
+func (s *transactionShards) wait() {
+	<-s.done
+}
+
+// queued reports how many messages wait in the shards' input queues.
+func (s *transactionShards) queued() int {
+	total := 0
+	for i := range s.shards {
+		total += len(s.transportIn[i]) + len(s.tuIn[i])
+	}
+	return total
+}
+
+func (s *transactionShards) dispatchTransport(ctx context.Context) {
+	defer s.wg.Done()
+	defer func() {
+		for _, in := range s.transportIn {
+			close(in)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt, ok := <-s.fromTransport:
+			if !ok {
+				return
+			}
+			if evt.Message == nil {
+				continue
+			}
+			select {
+			case s.transportIn[s.shardFor(transportShardKey(evt.Message))] <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *transactionShards) dispatchTU(ctx context.Context) {
+	defer s.wg.Done()
+	defer func() {
+		for _, in := range s.tuIn {
+			close(in)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case action, ok := <-s.fromTU:
+			if !ok {
+				return
+			}
+			select {
+			case s.tuIn[s.shardFor(actionShardKey(action))] <- action:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// shardFor maps a transaction key to a shard with FNV-1a.
+func (s *transactionShards) shardFor(key string) int {
+	if len(s.shards) == 1 {
+		return 0
+	}
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+// transportShardKey is the key of the transaction msg belongs to, matching
+// the keys the transaction layer stores. An ACK belongs to the INVITE
+// transaction it acknowledges.
+func transportShardKey(msg *Message) string {
+	branch := topViaBranch(msg)
+	if !msg.IsRequest() {
+		return transactionKey(branch, cseqMethod(msg))
+	}
+	method := strings.ToUpper(msg.Method)
+	if method == "ACK" {
+		method = "INVITE"
+	}
+	return transactionKey(branch, method)
+}
+
+// actionShardKey is the key of the transaction action applies to: the client
+// transaction a forwarded request creates or the server transaction a
+// response answers.
+func actionShardKey(action tuAction) string {
+	if action.Kind != tuActionForwardRequest {
+		return action.ServerTxID
+	}
+	if action.ClientTxID != "" || action.Message == nil {
+		return action.ClientTxID
+	}
+	return transactionKey(topViaBranch(action.Message), action.Message.Method)
+}
@@ -0,0 +1,72 @@
+package sip
+
+import "sync/atomic"
+
+// TransactionStats is a snapshot of the transaction layer's counters since
+// the proxy started.
+type TransactionStats struct {
+	ServerTransactions int `json:"server_transactions"`
+	ClientTransactions int `json:"client_transactions"`
+	// TimerFirings counts RFC 3261 timer expiries, keyed by timer letter
+	// ("A" to "K"). Timer H only counts when an error response went
+	// unacknowledged; the proxy keeps 2xx INVITE transactions for the same
+	// interval without firing it.
+	TimerFirings map[string]uint64 `json:"timer_firings"`
+	// RequestRetransmissions counts requests resent by client transactions
+	// (Timers A and E).
+	RequestRetransmissions uint64 `json:"request_retransmissions"`
+	// ResponseRetransmissions counts responses resent by server
+	// transactions, on Timer G or to answer a retransmitted request.
+	ResponseRetransmissions uint64 `json:"response_retransmissions"`
+	// Timeouts counts client transactions ended by Timers B, C, or F and
+	// INVITE server transactions ended by Timer H.
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// transactionCounters backs TransactionStats. It is written by the
+// transaction layer's goroutine and read from any other.
+type transactionCounters struct {
+	serverActive            atomic.Int64
+	clientActive            atomic.Int64
+	unansweredActive        atomic.Int64
+	timers                  ['K' - 'A' + 1]atomic.Uint64
+	requestRetransmissions  atomic.Uint64
+	responseRetransmissions atomic.Uint64
+	timeouts                atomic.Uint64
+}
+
+// fired records the expiry of the timer with the given letter; timers that
+// end a transaction unsuccessfully also count as a timeout.
+func (c *transactionCounters) fired(timer byte) {
+	c.timers[timer-'A'].Add(1)
+	switch timer {
+	case 'B', 'C', 'F', 'H':
+		c.timeouts.Add(1)
+	}
+}
+
+// active reports the live server and client transactions.
+func (c *transactionCounters) active() int {
+	return int(c.serverActive.Load() + c.clientActive.Load())
+}
+
+// unanswered reports the live server transactions that have not yet sent a
+// final response, such as INVITEs whose forks are still ringing.
+func (c *transactionCounters) unanswered() int {
+	return int(c.unansweredActive.Load())
+}
+
+func (c *transactionCounters) snapshot() TransactionStats {
+	stats := TransactionStats{
+		ServerTransactions:      int(c.serverActive.Load()),
+		ClientTransactions:      int(c.clientActive.Load()),
+		TimerFirings:            make(map[string]uint64, len(c.timers)),
+		RequestRetransmissions:  c.requestRetransmissions.Load(),
+		ResponseRetransmissions: c.responseRetransmissions.Load(),
+		Timeouts:                c.timeouts.Load(),
+	}
+	for i := range c.timers {
+		stats.TimerFirings[string(rune('A'+i))] = c.timers[i].Load()
+	}
+	return stats
+}
@@ -39,19 +39,79 @@ type transactionUser struct {
 	actions   chan<- tuAction
 	registrar *Registrar
 	broadcast *BroadcastPolicy
-	sessions  map[string]*broadcastSession
-	callIndex map[string]string
-	wg        sync.WaitGroup
+	shortNums *ShortNumbers
+	callerIDs *CallerIDRules
+	headers   *HeaderRules
+	identity  *Identity
+	topology  *TopologyHiding
+	diversion *Diversion
+	dialPlan  *DialPlan
+	enum      *ENUM
+	emergency *Emergency
+	calls     *CallLog
+	metrics   *Metrics
+	bus       *EventBus
+	overload  *overloadControl
+	admission *callAdmission
+	// subscriptions makes the proxy the notifier for SUBSCRIBE; see
+	// WithSubscriptions.
+	subscriptions *Subscriptions
+	// presence composes PUBLISH requests; see WithPresence.
+	presence *Presence
+	// dialogs follows calls for the dialog package; see WithDialogInfo.
+	dialogs *DialogInfo
+	// messages stores MESSAGE requests for offline users, and fanouts
+	// tracks those sent to broadcast addresses; see WithMessageStore.
+	messages *MessageStore
+	fanouts  map[string]*messageFanout
+	// localNames identify the proxy itself; see WithLocalNames.
+	localNames []string
+	// failover decides whether a failed forward is retried; see
+	// WithUpstreamFailover. attempts holds the requests that may be,
+	// keyed by client transaction.
+	failover func(*Message) bool
+	// credentials answers upstream challenges; see
+	// WithUpstreamCredentials. cseqShifts holds the dialogs whose CSeq
+	// numbers moved when a challenge was answered.
+	credentials func(req, challenge *Message) (string, string, bool)
+	cseqShifts  map[string]*cseqShift
+	attempts    map[string]*upstreamAttempt
+	sessions    map[string]*broadcastSession
+	callIndex   map[string]string
+	// peers maps the client transactions of forwarded requests to where
+	// they were addressed, so header rules and the trust domain can match
+	// their responses.
+	peers map[string]string
+	wg    sync.WaitGroup
+}
+
+// upstreamAttempt is a forwarded request that can be retried on another
+// upstream server or with credentials.
+type upstreamAttempt struct {
+	// original is the request as the proxy received it, before its Via
+	// was added.
+	original  *Message
+	forwarded *Message
+	// challenged is set once the request has been sent with credentials.
+	challenged bool
+	// originated marks a request the proxy generated itself, whose CSeq
+	// the proxy owns.
+	originated bool
 }
 
 func newTransactionUser(events <-chan tuEvent, actions chan<- tuAction, registrar *Registrar, broadcast *BroadcastPolicy) *transactionUser {
 	return &transactionUser{
-		events:    events,
-		actions:   actions,
-		registrar: registrar,
-		broadcast: broadcast,
-		sessions:  make(map[string]*broadcastSession),
-		callIndex: make(map[string]string),
+		events:     events,
+		actions:    actions,
+		registrar:  registrar,
+		broadcast:  broadcast,
+		attempts:   make(map[string]*upstreamAttempt),
+		cseqShifts: make(map[string]*cseqShift),
+		sessions:   make(map[string]*broadcastSession),
+		callIndex:  make(map[string]string),
+		peers:      make(map[string]string),
+		admission:  newCallAdmission(),
+		fanouts:    make(map[string]*messageFanout),
 	}
 }
 
@@ -60,6 +120,12 @@ func (t *transactionUser) start(ctx context.Context) {
 	go func() {
 		defer t.wg.Done()
 		defer close(t.actions)
+		var sweep <-chan time.Time
+		if t.subscriptions != nil {
+			ticker := time.NewTicker(subscriptionSweep)
+			defer ticker.Stop()
+			sweep = ticker.C
+		}
 		for {
 			select {
 			case <-ctx.Done():
@@ -69,6 +135,11 @@ func (t *transactionUser) start(ctx context.Context) {
 					return
 				}
 				t.handleEvent(ctx, event)
+			case <-t.subscriptions.wake():
+				t.notifyChanged(ctx)
+			case <-sweep:
+				t.expireSubscriptions(ctx)
+				t.expirePublications()
 			}
 		}
 	}()
@@ -84,9 +155,10 @@ func (t *transactionUser) handleEvent(ctx context.Context, event tuEvent) {
 		if event.Message == nil {
 			return
 		}
-		req := event.Message.Clone()
+		req := event.Message
+		t.headers.apply(req, "in", viaPeer(req))
 		if t.registrar != nil && strings.EqualFold(req.Method, "REGISTER") {
-			if resp, handled := t.registrar.handleRegister(ctx, req); handled {
+			if resp, handled := t.registrar.handleRegister(req.Context(), req); handled {
 				if resp != nil {
 					action := tuAction{
 						Kind:       tuActionSendResponse,
@@ -94,39 +166,107 @@ func (t *transactionUser) handleEvent(ctx context.Context, event tuEvent) {
 						Message:    resp,
 					}
 					t.sendAction(ctx, action)
+					t.deliverStored(ctx, req, resp)
+				}
+				return
+			}
+		}
+		if t.answersOptions(req) {
+			t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: t.optionsResponse(req)})
+			return
+		}
+		if t.handleSubscribe(ctx, event, req) {
+			return
+		}
+		if t.handlePublish(ctx, event, req) {
+			return
+		}
+		t.assertIdentity(ctx, req)
+		if route, ok := t.emergency.routes(req); ok {
+			if isInitialInvite(req) {
+				t.metrics.emergencyCall()
+				if record, ok := t.calls.begin(event.ServerTxID, req); ok {
+					t.bus.publish(callEvent(EventCallStarted, record))
 				}
+				t.calls.route(event.ServerTxID, route)
+				t.beginDialog(ctx, event.ServerTxID, req)
+			}
+			t.forward(ctx, event.ServerTxID, req)
+			return
+		}
+		if isInitialInvite(req) {
+			if reason := t.overload.shed(); reason != "" {
+				t.metrics.overloadRejected(reason)
+				t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: overloadResponse(req, t.overload.cfg.RetryAfter)})
 				return
 			}
+			if record, ok := t.calls.begin(event.ServerTxID, req); ok {
+				t.bus.publish(callEvent(EventCallStarted, record))
+			}
+			t.beginDialog(ctx, event.ServerTxID, req)
+		}
+		t.shortNums.rewrite(req)
+		if t.applyDialPlan(ctx, event, req) {
+			return
+		}
+		if strings.EqualFold(req.Method, "BYE") {
+			t.admission.hangup(req.GetHeader("Call-ID"))
+			t.dialogChanged(ctx, t.dialogs.hangup(req.GetHeader("Call-ID")))
+			if record, ok := t.calls.hangup(req.GetHeader("Call-ID")); ok {
+				t.bus.publish(callEvent(EventCallEnded, record))
+			}
 		}
 		if strings.EqualFold(req.Method, "CANCEL") {
 			if t.handleBroadcastCancel(ctx, event, req) {
 				return
 			}
 		}
+		if t.handleMessage(ctx, event, req) {
+			return
+		}
 		if strings.EqualFold(req.Method, "INVITE") {
+			if t.admitCall(ctx, event, req) {
+				return
+			}
+			if t.applyCalleeSettings(ctx, event, req) {
+				return
+			}
 			if t.handleBroadcastInvite(ctx, event, req) {
 				return
 			}
 		}
-		branch := newBranchID()
-		prependVia(req, branch)
-		decrementMaxForwards(req)
-		action := tuAction{
-			Kind:       tuActionForwardRequest,
-			ServerTxID: event.ServerTxID,
-			ClientTxID: transactionKey(branch, strings.ToUpper(req.Method)),
-			Message:    req,
-		}
-		t.sendAction(ctx, action)
+		t.forward(ctx, event.ServerTxID, req)
 	case tuEventResponse:
 		if event.Message == nil {
 			return
 		}
-		resp := event.Message.Clone()
+		resp := event.Message
+		t.topology.restore(resp)
+		peer := t.peers[event.ClientTxID]
+		if resp.StatusCode >= 200 {
+			delete(t.peers, event.ClientTxID)
+		}
+		t.headers.apply(resp, "in", peer)
+		if t.identity.untrusted(peer) {
+			resp.DelHeader("P-Asserted-Identity")
+		}
+		if t.notifyResponse(event, resp) {
+			return
+		}
+		if t.answerChallenge(ctx, event, resp) {
+			return
+		}
+		if t.messageResponse(ctx, event, resp) {
+			return
+		}
 		if t.handleBroadcastResponse(ctx, event, resp) {
 			return
 		}
+		if t.retryUpstream(ctx, event, resp) {
+			return
+		}
 		removeTopViaWithBranch(resp, keyBranch(event.ClientTxID))
+		t.unshiftCSeq(resp)
 		action := tuAction{
 			Kind:       tuActionSendResponse,
 			ServerTxID: event.ServerTxID,
@@ -137,13 +277,220 @@ func (t *transactionUser) handleEvent(ctx context.Context, event tuEvent) {
 	}
 }
 
+// forward sends req on towards its target with the proxy's Via on top. With
+// a failover or credentials hook, or trunks to fail over to, it is
+// remembered until its final response, so that it can be retried.
+func (t *transactionUser) forward(ctx context.Context, serverTxID string, req *Message) {
+	var original *Message
+	retryable := t.failover != nil || t.credentials != nil || len(req.trunkAlternates) > 0
+	if retryable && !strings.EqualFold(req.Method, "ACK") && !strings.EqualFold(req.Method, "CANCEL") {
+		original = req.Clone()
+	}
+	// The caller ID depends on the trunk, so a request failing over to
+	// another trunk is rewritten afresh from the original.
+	t.callerIDs.apply(req)
+	t.shiftCSeq(req)
+	branch := newBranchID()
+	prependVia(req, branch)
+	decrementMaxForwards(req)
+	action := tuAction{
+		Kind:       tuActionForwardRequest,
+		ServerTxID: serverTxID,
+		ClientTxID: transactionKey(branch, strings.ToUpper(req.Method)),
+		Message:    req,
+	}
+	if original != nil {
+		t.attempts[action.ClientTxID] = &upstreamAttempt{original: original, forwarded: req.Clone()}
+	}
+	t.sendAction(ctx, action)
+}
+
+// retryUpstream forwards a request again, consuming resp, when its client
+// transaction failed and there is somewhere else to send it: the next
+// cheapest trunk after a timeout, 408, or 5xx, or another upstream server
+// after a timeout or 503 when the failover hook agrees. Any other final
+// response just forgets the request.
+func (t *transactionUser) retryUpstream(ctx context.Context, event tuEvent, resp *Message) bool {
+	attempt, ok := t.attempts[event.ClientTxID]
+	if !ok || resp.StatusCode < 200 {
+		return false
+	}
+	delete(t.attempts, event.ClientTxID)
+	failed := event.TimedOut || resp.StatusCode == 408 || resp.StatusCode >= 500 && resp.StatusCode < 600
+	if failed && len(attempt.original.trunkAlternates) > 0 {
+		next := attempt.original
+		next.sendThrough(next.trunkAlternates)
+		t.metrics.trunkFailover()
+		if isInitialInvite(next) {
+			t.calls.route(event.ServerTxID, next.trunkName)
+		}
+		t.forward(ctx, event.ServerTxID, next)
+		return true
+	}
+	if !event.TimedOut && resp.StatusCode != 503 {
+		return false
+	}
+	if t.failover == nil || !t.failover(attempt.forwarded) {
+		return false
+	}
+	t.metrics.upstreamFailover()
+	t.forward(ctx, event.ServerTxID, attempt.original)
+	return true
+}
+
 func (t *transactionUser) sendAction(ctx context.Context, action tuAction) {
+	// changed holds the users whose calls the response moves on, whose
+	// watchers are notified once it is sent.
+	var changed []string
 	if action.Message != nil {
+		if action.Kind == tuActionForwardRequest {
+			peer := requestPeer(action.Message)
+			t.withholdIdentity(action.Message, peer)
+			t.headers.apply(action.Message, "out", peer)
+			if t.identity.outside(peer) {
+				t.topology.hide(action.Message)
+			}
+			if (t.headers.active() || t.identity.enabled()) && !strings.EqualFold(action.Message.Method, "ACK") {
+				t.peers[action.ClientTxID] = peer
+			}
+		} else {
+			peer := viaPeer(action.Message)
+			t.withholdIdentity(action.Message, peer)
+			t.headers.apply(action.Message, "out", peer)
+		}
 		action.Message.EnsureContentLength()
+		action.Message.traceHop(spanHopTU)
+		if action.Kind == tuActionSendResponse && strings.EqualFold(cseqMethod(action.Message), "INVITE") {
+			t.admission.finish(action.ServerTxID, action.Message.StatusCode)
+			changed = t.dialogs.respond(action.ServerTxID, action.Message)
+			if record, ok := t.calls.finish(action.ServerTxID, action.Message.StatusCode); ok {
+				kind := EventCallEnded
+				if record.Ended.IsZero() {
+					kind = EventCallAnswered
+				}
+				t.bus.publish(callEvent(kind, record))
+			}
+		}
 	}
 	select {
 	case t.actions <- action:
 	case <-ctx.Done():
+		return
+	}
+	t.dialogChanged(ctx, changed)
+}
+
+// applyCalleeSettings enforces the called user's forwarding and do-not-disturb
+// settings on an initial INVITE. Forwarding rewrites the Request-URI in place
+// and takes precedence over do-not-disturb; forwarded requests are not
+// re-evaluated against the new target's settings, so loops cannot form. It
+// reports whether the request was answered locally.
+func (t *transactionUser) applyCalleeSettings(ctx context.Context, event tuEvent, req *Message) bool {
+	if t.registrar == nil || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return false
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil || uri.User == "" {
+		return false
+	}
+	settings := t.registrar.UserSettings(req.Context(), uri.User, uri.Host)
+	if target := settings.ForwardTo(); target != "" {
+		if lower := strings.ToLower(target); !strings.HasPrefix(lower, "sip:") && !strings.HasPrefix(lower, "sips:") {
+			target = "sip:" + target
+		}
+		t.retarget(req, target, 1, causeUnconditional, "unconditional")
+		return false
+	}
+	if settings.DoNotDisturb() {
+		resp := NewResponse(486, "Busy Here")
+		CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+		ensureToTag(resp)
+		t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+		return true
+	}
+	return false
+}
+
+// applyDialPlan routes an out-of-dialog request by the first dial plan rule
+// it matches, rewriting it in place, and reports whether the rule answered it
+// instead. A CANCEL is rewritten like the INVITE it cancels, so it reaches the
+// same server, but never rejected.
+func (t *transactionUser) applyDialPlan(ctx context.Context, event tuEvent, req *Message) bool {
+	if t.dialPlan == nil || strings.EqualFold(req.Method, "ACK") || strings.Contains(strings.ToLower(req.GetHeader("To")), ";tag=") {
+		return false
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil {
+		return false
+	}
+	rule := t.dialPlan.match(req, uri, time.Now())
+	if rule == nil {
+		return false
+	}
+	if rule.Reject == 0 {
+		rule.route(req, uri)
+		if len(rule.hops) > 0 {
+			t.routeByENUM(req)
+		}
+		if strings.EqualFold(req.Method, "CANCEL") {
+			t.followInvite(req)
+		} else if req.trunkName != "" && isInitialInvite(req) {
+			t.calls.route(event.ServerTxID, req.trunkName)
+		}
+		return false
+	}
+	if strings.EqualFold(req.Method, "CANCEL") {
+		return false
+	}
+	resp := NewResponse(rule.Reject, rule.Reason)
+	CopyHeaders(resp, req, "Via", "From", "To", "Call-ID", "CSeq")
+	ensureToTag(resp)
+	t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, Message: resp})
+	return true
+}
+
+// routeByENUM sends a request the dial plan routed through trunks straight to
+// the SIP URI ENUM gives for its number instead, when there is one. A CANCEL
+// finds its INVITE's URI in the ENUM cache.
+func (t *transactionUser) routeByENUM(req *Message) {
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil {
+		return
+	}
+	target, ok := t.enum.Lookup(req.Context(), uri.User)
+	if !ok {
+		return
+	}
+	direct, err := ParseURI(target)
+	if err != nil || direct.Host == "" {
+		return
+	}
+	req.RequestURI = direct.String()
+	req.nextHop = direct.HostPort()
+	req.trunkName = ""
+	req.trunkAlternates = nil
+}
+
+// followInvite sends a CANCEL through the trunk its INVITE has failed over
+// to rather than the one the dial plan tries first.
+func (t *transactionUser) followInvite(cancel *Message) {
+	callID := cancel.GetHeader("Call-ID")
+	number, ok := parseCSeqNumber(cancel.GetHeader("CSeq"))
+	if !ok {
+		return
+	}
+	for _, attempt := range t.attempts {
+		invite := attempt.original
+		if invite.trunkName == "" || !strings.EqualFold(invite.Method, "INVITE") || invite.GetHeader("Call-ID") != callID {
+			continue
+		}
+		if n, ok := parseCSeqNumber(invite.GetHeader("CSeq")); ok && n == number {
+			cancel.RequestURI = invite.RequestURI
+			cancel.nextHop = invite.nextHop
+			cancel.trunkName = invite.trunkName
+			cancel.trunkAlternates = nil
+			return
+		}
 	}
 }
 
@@ -182,9 +529,9 @@ func (t *transactionUser) handleBroadcastInvite(ctx context.Context, event tuEve
 	t.sessions[event.ServerTxID] = session
 
 	sent := 0
-	for _, target := range targets {
+	for i, target := range targets {
 		clone := req.Clone()
-		clone.RequestURI = target
+		t.retarget(clone, target, i+1, 0, "unknown")
 		branch := newBranchID()
 		prependVia(clone, branch)
 		decrementMaxForwards(clone)
@@ -251,7 +598,7 @@ func (t *transactionUser) handleBroadcastCancel(ctx context.Context, event tuEve
 		if fork == nil || fork.final {
 			continue
 		}
-		t.sendCancelForFork(ctx, serverTxID, session, fork)
+		t.sendCancelForFork(ctx, serverTxID, session, fork, req.GetHeader("Reason"))
 	}
 	return true
 }
@@ -290,12 +637,13 @@ func (t *transactionUser) handleBroadcastResponse(ctx context.Context, event tuE
 			session.winner = event.ClientTxID
 			session.winningResp = resp.Clone()
 			session.finalised = true
+			t.metrics.broadcastFinished("answered")
 			t.sendAction(ctx, tuAction{Kind: tuActionSendResponse, ServerTxID: event.ServerTxID, ClientTxID: event.ClientTxID, Message: resp.Clone()})
 			for id, other := range session.forks {
 				if id == event.ClientTxID || other == nil || other.final {
 					continue
 				}
-				t.sendCancelForFork(ctx, event.ServerTxID, session, other)
+				t.sendCancelForFork(ctx, event.ServerTxID, session, other, reasonCompletedElsewhere)
 			}
 		} else if event.ClientTxID != session.winner {
 			t.sendByeForFork(ctx, event.ServerTxID, session, fork, resp)
@@ -307,6 +655,11 @@ func (t *transactionUser) handleBroadcastResponse(ctx context.Context, event tuE
 		}
 		if session.winner == "" && session.allForksFinal() {
 			session.finalised = true
+			if session.canceled {
+				t.metrics.broadcastFinished("cancelled")
+			} else {
+				t.metrics.broadcastFinished("failed")
+			}
 			best := session.bestResponse
 			if best == nil {
 				best = resp.Clone()
@@ -321,7 +674,9 @@ func (t *transactionUser) handleBroadcastResponse(ctx context.Context, event tuE
 	return true
 }
 
-func (t *transactionUser) sendCancelForFork(ctx context.Context, serverTxID string, session *broadcastSession, fork *broadcastFork) {
+// sendCancelForFork cancels a fork still ringing, giving reason, when not
+// empty, as its Reason header.
+func (t *transactionUser) sendCancelForFork(ctx context.Context, serverTxID string, session *broadcastSession, fork *broadcastFork, reason string) {
 	if fork == nil || fork.final || fork.cancelled {
 		return
 	}
@@ -333,6 +688,10 @@ func (t *transactionUser) sendCancelForFork(ctx context.Context, serverTxID stri
 	cancel.ReasonPhrase = ""
 	cancel.SetHeader("CSeq", formatCSeq(session.cseqNumber, "CANCEL"))
 	cancel.DelHeader("Content-Length")
+	cancel.DelHeader("Reason")
+	if reason != "" {
+		cancel.SetHeader("Reason", reason)
+	}
 	fork.cancelled = true
 	action := tuAction{
 		Kind:       tuActionForwardRequest,
@@ -343,6 +702,7 @@ func (t *transactionUser) sendCancelForFork(ctx context.Context, serverTxID stri
 	t.sendAction(ctx, action)
 }
 
+// sendByeForFork hangs up a fork that answered after another won the call.
 func (t *transactionUser) sendByeForFork(ctx context.Context, serverTxID string, session *broadcastSession, fork *broadcastFork, resp *Message) {
 	if fork == nil {
 		return
@@ -354,13 +714,13 @@ func (t *transactionUser) sendByeForFork(ctx context.Context, serverTxID string,
 	bye.StatusCode = 0
 	bye.ReasonPhrase = ""
 	bye.SetHeader("CSeq", formatCSeq(session.cseqNumber+1, "BYE"))
-	if contact := strings.TrimSpace(resp.GetHeader("Contact")); contact != "" {
-		bye.RequestURI = contactAddress(contact)
-		if bye.RequestURI == "" {
-			bye.RequestURI = contact
+	if contacts := resp.HeaderList("Contact"); len(contacts) > 0 {
+		if uri, err := ParseAddress(contacts[0]); err == nil {
+			bye.RequestURI = uri.String()
 		}
 	}
 	bye.DelHeader("Content-Length")
+	bye.SetHeader("Reason", reasonCompletedElsewhere)
 	branch := newBranchID()
 	prependVia(bye, branch)
 	decrementMaxForwards(bye)
@@ -370,6 +730,9 @@ func (t *transactionUser) sendByeForFork(ctx context.Context, serverTxID string,
 		ClientTxID: transactionKey(branch, "BYE"),
 		Message:    bye,
 	}
+	if t.credentials != nil {
+		t.attempts[action.ClientTxID] = &upstreamAttempt{forwarded: bye.Clone(), originated: true}
+	}
 	t.sendAction(ctx, action)
 }
 
@@ -433,8 +796,8 @@ func prependVia(msg *Message, branch string) {
 	if msg == nil {
 		return
 	}
-	via := fmt.Sprintf("SIP/2.0/UDP proxy.local;branch=%s", branch)
-	existing := msg.HeaderValues("Via")
+	via := fmt.Sprintf("SIP/2.0/UDP proxy.local;branch=%s;rport", branch)
+	existing := msg.HeaderList("Via")
 	values := make([]string, 0, len(existing)+1)
 	values = append(values, via)
 	values = append(values, existing...)
@@ -445,7 +808,7 @@ func removeTopViaWithBranch(msg *Message, branch string) {
 	if msg == nil || branch == "" {
 		return
 	}
-	values := msg.HeaderValues("Via")
+	values := msg.HeaderList("Via")
 	if len(values) == 0 {
 		return
 	}
@@ -12,6 +12,10 @@ const (
 	directionUpstream
 )
 
+// transportEvent carries a message between the transport and transaction
+// layers. Like every message passed between layers, the message belongs to
+// the receiver once sent: the sender keeps a clone of anything it still
+// needs, so each hop can modify what it receives without copying it again.
 type transportEvent struct {
 	Direction direction
 	Message   *Message
@@ -24,6 +28,7 @@ type transportLayer struct {
 	serverOut chan *Message
 	toTxn     chan<- transportEvent
 	fromTxn   <-chan transportEvent
+	overflow  *queueOverflow
 	wg        sync.WaitGroup
 }
 
@@ -35,6 +40,7 @@ func newTransportLayer(clientIn, serverIn, clientOut, serverOut chan *Message, t
 		serverOut: serverOut,
 		toTxn:     toTxn,
 		fromTxn:   fromTxn,
+		overflow:  newQueueOverflow(QueueBlock, nil, clientOut),
 	}
 }
 
@@ -55,10 +61,10 @@ func (t *transportLayer) start(ctx context.Context) {
 				if msg == nil {
 					continue
 				}
-				clone := msg.Clone()
-				clone.EnsureContentLength()
+				msg.EnsureContentLength()
+				msg.traceHop(spanHopTransport)
 				select {
-				case t.toTxn <- transportEvent{Direction: directionDownstream, Message: clone}:
+				case t.toTxn <- transportEvent{Direction: directionDownstream, Message: msg}:
 				case <-ctx.Done():
 					return
 				}
@@ -69,10 +75,10 @@ func (t *transportLayer) start(ctx context.Context) {
 				if msg == nil {
 					continue
 				}
-				clone := msg.Clone()
-				clone.EnsureContentLength()
+				msg.EnsureContentLength()
+				msg.traceHop(spanHopTransport)
 				select {
-				case t.toTxn <- transportEvent{Direction: directionUpstream, Message: clone}:
+				case t.toTxn <- transportEvent{Direction: directionUpstream, Message: msg}:
 				case <-ctx.Done():
 					return
 				}
@@ -83,21 +89,15 @@ func (t *transportLayer) start(ctx context.Context) {
 				if evt.Message == nil {
 					continue
 				}
-				msg := evt.Message.Clone()
+				msg := evt.Message
 				msg.EnsureContentLength()
-				switch evt.Direction {
-				case directionDownstream:
-					select {
-					case t.clientOut <- msg:
-					case <-ctx.Done():
-						return
-					}
-				case directionUpstream:
-					select {
-					case t.serverOut <- msg:
-					case <-ctx.Done():
-						return
-					}
+				msg.traceHop(spanHopTransport)
+				queue, out := queueClientOut, t.clientOut
+				if evt.Direction == directionUpstream {
+					queue, out = queueServerOut, t.serverOut
+				}
+				if !t.overflow.send(ctx, queue, out, msg) && ctx.Err() != nil {
+					return
 				}
 			}
 		}
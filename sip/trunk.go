@@ -0,0 +1,636 @@
+package sip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrunkConfig is an account at an upstream provider that the stack registers
+// to, as a phone would, so that the provider delivers calls for the account's
+// numbers to the proxy.
+type TrunkConfig struct {
+	// Registrar is the provider's registrar as host or host:port.
+	Registrar string
+	// Domain is the domain of the registered address of record; the
+	// registrar's host when empty.
+	Domain   string
+	Username string
+	// AuthUsername is the name given in answers to digest challenges;
+	// Username when empty.
+	AuthUsername string
+	Password     string
+	// Expires is the registration lifetime asked for; an hour when zero.
+	Expires time.Duration
+	// Cost ranks the trunk for least-cost routing: of the trunks a dial plan
+	// rule or trunk route names, the cheapest is tried first. It does not
+	// affect the registration.
+	Cost int
+}
+
+// defaultTrunkExpires is the registration lifetime asked for when a trunk
+// does not set one.
+const defaultTrunkExpires = time.Hour
+
+// ParseTrunk parses a trunk written as user:password@host[:port], optionally
+// followed by ;expires=<seconds>, ;auth-user=<name>, ;domain=<domain>, and
+// ;cost=<n> parameters. A leading sip: is allowed, and characters such as '@' or ';' in
+// the password must be %-escaped.
+func ParseTrunk(spec string) (TrunkConfig, error) {
+	spec = strings.TrimSpace(spec)
+	raw := spec
+	if !strings.HasPrefix(strings.ToLower(raw), "sip:") {
+		raw = "sip:" + raw
+	}
+	uri, err := ParseURI(raw)
+	if err != nil {
+		return TrunkConfig{}, fmt.Errorf("trunk %q: %w", spec, err)
+	}
+	if uri.User == "" {
+		return TrunkConfig{}, fmt.Errorf("trunk %q: missing user name", spec)
+	}
+	cfg := TrunkConfig{Registrar: uri.Host, Username: uri.User, Password: uri.Password}
+	if uri.Port != 0 {
+		cfg.Registrar = uri.HostPort()
+	}
+	for _, param := range uri.Params {
+		switch strings.ToLower(param.Name) {
+		case "expires":
+			seconds, err := strconv.Atoi(param.Value)
+			if err != nil || seconds <= 0 {
+				return TrunkConfig{}, fmt.Errorf("trunk %q: invalid expires %q", spec, param.Value)
+			}
+			cfg.Expires = time.Duration(seconds) * time.Second
+		case "auth-user":
+			cfg.AuthUsername = param.Value
+		case "domain":
+			cfg.Domain = param.Value
+		case "cost":
+			cost, err := strconv.Atoi(param.Value)
+			if err != nil || cost < 0 {
+				return TrunkConfig{}, fmt.Errorf("trunk %q: invalid cost %q", spec, param.Value)
+			}
+			cfg.Cost = cost
+		default:
+			return TrunkConfig{}, fmt.Errorf("trunk %q: unknown parameter %q", spec, param.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// normalizeTrunk fills in a trunk's defaults.
+func normalizeTrunk(cfg TrunkConfig) (TrunkConfig, error) {
+	cfg.Registrar = strings.TrimSpace(cfg.Registrar)
+	cfg.Username = strings.TrimSpace(cfg.Username)
+	if cfg.Registrar == "" || cfg.Username == "" {
+		return cfg, fmt.Errorf("trunk needs a registrar and a user name")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Registrar); err != nil {
+		cfg.Registrar = net.JoinHostPort(strings.Trim(cfg.Registrar, "[]"), "5060")
+	}
+	if cfg.Domain == "" {
+		cfg.Domain, _, _ = net.SplitHostPort(cfg.Registrar)
+	}
+	if cfg.AuthUsername == "" {
+		cfg.AuthUsername = cfg.Username
+	}
+	if cfg.Expires <= 0 {
+		cfg.Expires = defaultTrunkExpires
+	}
+	if cfg.Cost < 0 {
+		return cfg, fmt.Errorf("trunk %s has a negative cost", cfg.Username)
+	}
+	return cfg, nil
+}
+
+// normalizeTrunks fills in the defaults of every trunk.
+func normalizeTrunks(cfgs []TrunkConfig) ([]TrunkConfig, error) {
+	trunks := make([]TrunkConfig, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		normalized, err := normalizeTrunk(cfg)
+		if err != nil {
+			return nil, err
+		}
+		trunks = append(trunks, normalized)
+	}
+	return trunks, nil
+}
+
+// trunkRetry is how long the stack waits to register a trunk again after the
+// provider refused the registration or did not answer.
+const trunkRetry = 30 * time.Second
+
+// trunkAttempts bounds the REGISTERs sent in one registration: the first,
+// the answer to a challenge, and one retry after 423 Interval Too Brief.
+const trunkAttempts = 4
+
+// trunk is the registration of one TrunkConfig. Every REGISTER for it shares
+// a Call-ID and From tag and increments the CSeq (RFC 3261 section 10.2).
+type trunk struct {
+	cfg     TrunkConfig
+	addr    *net.UDPAddr
+	callID  string
+	fromTag string
+	// responses carries the answers to the outstanding REGISTER from the
+	// upstream reader to the trunk's goroutine.
+	responses chan *Message
+	// ctx ends when the stack stops or a reload removes the trunk.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu     sync.Mutex
+	branch string
+	cseq   int
+	// realm is the one the registrar last challenged in, by which
+	// challenges to other requests are matched to the trunk.
+	realm string
+}
+
+func newTrunk(cfg TrunkConfig, addr *net.UDPAddr) *trunk {
+	return &trunk{
+		cfg:       cfg,
+		addr:      addr,
+		callID:    newTag() + newTag() + "@" + cfg.Domain,
+		fromTag:   newTag(),
+		responses: make(chan *Message, 4),
+	}
+}
+
+func (t *trunk) aor() string {
+	return "sip:" + t.cfg.Username + "@" + t.cfg.Domain
+}
+
+// answer consumes resp when it answers one of the trunk's REGISTERs, handing
+// it to the trunk's goroutine when it answers the outstanding one.
+func (t *trunk) answer(resp *Message) bool {
+	if resp == nil || resp.IsRequest() || resp.GetHeader("Call-ID") != t.callID {
+		return false
+	}
+	t.mu.Lock()
+	current := t.branch != "" && topViaBranch(resp) == t.branch
+	t.mu.Unlock()
+	if current {
+		select {
+		case t.responses <- resp:
+		default:
+		}
+	}
+	return true
+}
+
+// request builds the trunk's next REGISTER from local, the address the
+// provider reaches the proxy at, carrying credentials when given.
+func (t *trunk) request(local string, expires time.Duration, credentials, header string) *Message {
+	t.mu.Lock()
+	t.cseq++
+	t.branch = newBranchID()
+	cseq, branch := t.cseq, t.branch
+	t.mu.Unlock()
+
+	req := NewRequest("REGISTER", "sip:"+t.cfg.Domain)
+	req.SetHeader("Via", "SIP/2.0/UDP "+local+";branch="+branch+";rport")
+	req.SetHeader("Max-Forwards", "70")
+	req.SetHeader("From", "<"+t.aor()+">;tag="+t.fromTag)
+	req.SetHeader("To", "<"+t.aor()+">")
+	req.SetHeader("Call-ID", t.callID)
+	req.SetHeader("CSeq", formatCSeq(cseq, "REGISTER"))
+	req.SetHeader("Contact", "<"+t.contact(local)+">")
+	req.SetHeader("Expires", strconv.Itoa(int(expires/time.Second)))
+	if credentials != "" {
+		req.SetHeader(header, credentials)
+	}
+	req.SetHeader("Content-Length", "0")
+	return req
+}
+
+func (t *trunk) setRealm(realm string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.realm = realm
+}
+
+// answers reports whether t is the account for a challenge in realm to req:
+// the realm its registrar challenges in, or its domain, or, failing both, a
+// request addressed to its domain or registrar.
+func (t *trunk) answers(realm string, req *Message, byHost bool) bool {
+	t.mu.Lock()
+	known := t.realm
+	t.mu.Unlock()
+	if !byHost {
+		return realm != "" && (realm == known || strings.EqualFold(realm, t.cfg.Domain))
+	}
+	uri, err := ParseURI(req.RequestURI)
+	if err != nil {
+		return false
+	}
+	registrar, _, _ := net.SplitHostPort(t.cfg.Registrar)
+	return strings.EqualFold(uri.Host, t.cfg.Domain) || strings.EqualFold(uri.Host, registrar)
+}
+
+func (t *trunk) contact(local string) string {
+	return "sip:" + t.cfg.Username + "@" + local
+}
+
+// grantedExpires returns the lifetime the registrar granted our contact in
+// its 2xx answer: the contact's expires parameter, else the Expires header,
+// else what was asked for.
+func (t *trunk) grantedExpires(resp *Message, local string, asked time.Duration) time.Duration {
+	want := contactKey("<" + t.contact(local) + ">")
+	for _, value := range resp.HeaderList("Contact") {
+		if contactKey(value) != want {
+			continue
+		}
+		if seconds := parseExpires(GetHeaderParam(value, "expires")); seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if seconds := parseExpires(resp.GetHeader("Expires")); seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return asked
+}
+
+// startTrunks resolves the configured trunks' registrars.
+func (s *SIPStack) startTrunks(ctx context.Context) error {
+	trunks, _, err := resolveTrunks(ctx, s.cfg.Trunks, nil)
+	if err != nil {
+		return err
+	}
+	s.trunkMu.Lock()
+	s.trunks = trunks
+	s.trunkMu.Unlock()
+	return nil
+}
+
+// resolveTrunks returns the trunks for configs. A trunk of current whose
+// registration is unchanged is kept, so its registration carries on; the
+// others are new, with their registrars resolved, and also returned as added.
+func resolveTrunks(ctx context.Context, configs []TrunkConfig, current []*trunk) ([]*trunk, []*trunk, error) {
+	unused := append([]*trunk(nil), current...)
+	var trunks, added []*trunk
+	for _, cfg := range configs {
+		kept := -1
+		for i, t := range unused {
+			if sameRegistration(t.cfg, cfg) {
+				kept = i
+				break
+			}
+		}
+		if kept >= 0 {
+			trunks = append(trunks, unused[kept])
+			unused = append(unused[:kept], unused[kept+1:]...)
+			continue
+		}
+		addr, err := resolveUDPAddr(ctx, cfg.Registrar)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve trunk registrar %s: %w", cfg.Registrar, err)
+		}
+		t := newTrunk(cfg, addr)
+		trunks = append(trunks, t)
+		added = append(added, t)
+	}
+	return trunks, added, nil
+}
+
+// sameRegistration reports whether a and b register the same account in the
+// same way, so that a reload changing only a trunk's cost keeps its
+// registration.
+func sameRegistration(a, b TrunkConfig) bool {
+	a.Cost, b.Cost = 0, 0
+	return a == b
+}
+
+// currentTrunks returns the trunks of the running configuration.
+func (s *SIPStack) currentTrunks() []*trunk {
+	s.trunkMu.RLock()
+	defer s.trunkMu.RUnlock()
+	return s.trunks
+}
+
+// launchTrunk starts t's registration goroutine.
+func (s *SIPStack) launchTrunk(t *trunk) {
+	t.ctx, t.stop = context.WithCancel(s.runCtx)
+	s.wg.Add(1)
+	go s.runTrunk(t)
+}
+
+// answerTrunk consumes resp when it answers a trunk's REGISTER.
+func (s *SIPStack) answerTrunk(resp *Message) bool {
+	for _, t := range s.currentTrunks() {
+		if t.answer(resp) {
+			return true
+		}
+	}
+	return false
+}
+
+// trunkCredentials answers a 401 or 407 challenge to req, a request the
+// proxy sent upstream, with the account of the trunk it went to. It is the
+// stack's WithUpstreamCredentials hook.
+func (s *SIPStack) trunkCredentials(req, challenge *Message) (string, string, bool) {
+	params, header, ok := digestChallenge(challenge)
+	if !ok {
+		return "", "", false
+	}
+	trunks := s.currentTrunks()
+	for _, byHost := range []bool{false, true} {
+		for _, t := range trunks {
+			if !t.answers(params["realm"], req, byHost) {
+				continue
+			}
+			credentials, err := digestCredentials(params, req, t.cfg.AuthUsername, t.cfg.Password)
+			if err != nil {
+				s.logger.Warn("cannot answer upstream challenge", append(messageAttrs(req), "aor", t.aor(), "error", err)...)
+				return "", "", false
+			}
+			return header, credentials, true
+		}
+	}
+	return "", "", false
+}
+
+// runTrunk keeps a trunk registered, refreshing the registration halfway
+// through the lifetime the provider granted.
+func (s *SIPStack) runTrunk(t *trunk) {
+	defer s.wg.Done()
+
+	for {
+		wait := s.registerTrunk(t)
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// registerTrunk registers t once, answering the provider's digest challenge,
+// and returns how long to wait before registering again.
+func (s *SIPStack) registerTrunk(t *trunk) time.Duration {
+	local := s.upstreamLocalAddr(t.addr)
+	expires := t.cfg.Expires
+	var credentials, header, nonce string
+	for attempt := 0; attempt < trunkAttempts; attempt++ {
+		req := t.request(local, expires, credentials, header)
+		resp, err := s.sendTrunkRequest(t, req)
+		if err != nil {
+			if t.ctx.Err() == nil {
+				s.logger.Warn("trunk registration failed", "aor", t.aor(), "registrar", t.addr.String(), "error", err)
+			}
+			return trunkRetry
+		}
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			granted := t.grantedExpires(resp, local, expires)
+			s.logger.Info("trunk registered", "aor", t.aor(), "registrar", t.addr.String(), "expires", granted)
+			if granted < 2*time.Second {
+				return time.Second
+			}
+			return granted / 2
+		case resp.StatusCode == 401 || resp.StatusCode == 407:
+			params, name, ok := digestChallenge(resp)
+			// A second challenge for the same nonce, unless it is only
+			// stale, means the credentials were refused.
+			if !ok || (params["nonce"] == nonce && !strings.EqualFold(params["stale"], "true")) {
+				s.logger.Warn("trunk registration refused", "aor", t.aor(), "registrar", t.addr.String(), "status", resp.StatusCode)
+				return trunkRetry
+			}
+			credentials, err = digestCredentials(params, req, t.cfg.AuthUsername, t.cfg.Password)
+			if err != nil {
+				s.logger.Warn("cannot answer trunk challenge", "aor", t.aor(), "error", err)
+				return trunkRetry
+			}
+			header, nonce = name, params["nonce"]
+			t.setRealm(params["realm"])
+		case resp.StatusCode == 423:
+			minimum := parseExpires(resp.GetHeader("Min-Expires"))
+			if minimum <= 0 || time.Duration(minimum)*time.Second <= expires {
+				return trunkRetry
+			}
+			expires = time.Duration(minimum) * time.Second
+		default:
+			s.logger.Warn("trunk registration refused", "aor", t.aor(), "registrar", t.addr.String(), "status", resp.StatusCode)
+			return trunkRetry
+		}
+	}
+	return trunkRetry
+}
+
+// sendTrunkRequest sends req to the trunk's registrar, retransmitting it as a
+// non-INVITE client transaction does (Timers E and F), and returns its final
+// response.
+func (s *SIPStack) sendTrunkRequest(t *trunk, req *Message) (*Message, error) {
+	payload := req.AppendWire(nil)
+	branch := topViaBranch(req)
+	interval := defaultTimerEInitial
+	retransmit := time.NewTimer(interval)
+	defer retransmit.Stop()
+	deadline := time.NewTimer(defaultTimerF)
+	defer deadline.Stop()
+	send := true
+	for {
+		if send {
+			if _, err := s.upstreamConn.WriteTo(payload, t.addr); err != nil {
+				return nil, err
+			}
+			s.capture(directionUpstream, false, s.upstreamConn, t.addr, payload, req)
+			send = false
+		}
+		select {
+		case <-t.ctx.Done():
+			return nil, t.ctx.Err()
+		case <-deadline.C:
+			return nil, errors.New("no response to REGISTER")
+		case resp := <-t.responses:
+			if topViaBranch(resp) != branch {
+				continue
+			}
+			if resp.StatusCode >= 200 {
+				return resp, nil
+			}
+			// A provisional response slows retransmission to T2.
+			interval = defaultTimerEMax
+		case <-retransmit.C:
+			send = true
+			interval = min(2*interval, defaultTimerEMax)
+			retransmit.Reset(interval)
+		}
+	}
+}
+
+// upstreamLocalAddr returns the address the upstream socket is reached at
+// from remote. A socket bound to a wildcard address takes the address the
+// system routes to remote from.
+func (s *SIPStack) upstreamLocalAddr(remote *net.UDPAddr) string {
+	udp, ok := s.upstreamConn.LocalAddr().(*net.UDPAddr)
+	if !ok || !udp.IP.IsUnspecified() {
+		return s.upstreamConn.LocalAddr().String()
+	}
+	probe, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return udp.String()
+	}
+	defer probe.Close()
+	ip := probe.LocalAddr().(*net.UDPAddr).IP
+	return net.JoinHostPort(ip.String(), strconv.Itoa(udp.Port))
+}
+
+// digestChallenge returns the parameters of the first MD5 Digest challenge in
+// a 401 or 407 response and the header its answer goes in (RFC 3261 section
+// 22): Authorization for WWW-Authenticate and Proxy-Authorization for
+// Proxy-Authenticate.
+func digestChallenge(resp *Message) (map[string]string, string, bool) {
+	challenge, credentials := "WWW-Authenticate", "Authorization"
+	if resp.StatusCode == 407 {
+		challenge, credentials = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+	for _, value := range resp.HeaderValues(challenge) {
+		params, ok := parseDigestAuthorization(value)
+		if !ok {
+			continue
+		}
+		if algorithm := params["algorithm"]; algorithm == "" || strings.EqualFold(algorithm, "md5") {
+			return params, credentials, true
+		}
+	}
+	return nil, "", false
+}
+
+// digestCredentials answers the Digest challenge params for req with the
+// given account, as RFC 2617 describes for the MD5 algorithm with or without
+// qop=auth.
+func digestCredentials(params map[string]string, req *Message, username, password string) (string, error) {
+	algorithm := params["algorithm"]
+	if algorithm != "" && !strings.EqualFold(algorithm, "md5") {
+		return "", fmt.Errorf("unsupported algorithm %s", algorithm)
+	}
+	realm, nonce := params["realm"], params["nonce"]
+	if nonce == "" {
+		return "", fmt.Errorf("challenge without nonce")
+	}
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(strings.ToUpper(req.Method) + ":" + req.RequestURI)
+
+	fields := []string{
+		"username=" + strconv.Quote(username),
+		"realm=" + strconv.Quote(realm),
+		"nonce=" + strconv.Quote(nonce),
+		"uri=" + strconv.Quote(req.RequestURI),
+	}
+	var response string
+	switch qop := offeredQop(params["qop"]); qop {
+	case "":
+		response = md5Hex(ha1 + ":" + nonce + ":" + ha2)
+	case "auth":
+		cnonce := newCnonce()
+		const nc = "00000001"
+		response = md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+		fields = append(fields, "qop=auth", "nc="+nc, "cnonce="+strconv.Quote(cnonce))
+	default:
+		return "", fmt.Errorf("unsupported qop %s", params["qop"])
+	}
+	fields = append(fields, "response="+strconv.Quote(response), "algorithm=MD5")
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, "opaque="+strconv.Quote(opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// offeredQop picks auth from a challenge's qop options, returning "" when
+// the challenge offers none and the options themselves when auth is not
+// among them.
+func offeredQop(options string) string {
+	if options == "" {
+		return ""
+	}
+	for _, option := range strings.Split(options, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), "auth") {
+			return "auth"
+		}
+	}
+	return options
+}
+
+func newCnonce() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// normalizeDID reduces a dialled number to the digits, and a leading '+',
+// it is compared by, dropping visual separators and any user parameters.
+func normalizeDID(number string) string {
+	number, _, _ = strings.Cut(number, ";")
+	var b strings.Builder
+	for i := 0; i < len(number); i++ {
+		c := number[i]
+		if (c >= '0' && c <= '9') || c == '*' || c == '#' || (c == '+' && b.Len() == 0) {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// normalizeDIDs validates the DID routes, keyed by normalised number and
+// pointing at sip: URIs.
+func normalizeDIDs(dids map[string]string) (map[string]string, error) {
+	if len(dids) == 0 {
+		return nil, nil
+	}
+	routes := make(map[string]string, len(dids))
+	for number, target := range dids {
+		key := normalizeDID(number)
+		if key == "" {
+			return nil, fmt.Errorf("invalid DID %q", number)
+		}
+		target = strings.TrimSpace(target)
+		if !strings.HasPrefix(strings.ToLower(target), "sip:") {
+			target = "sip:" + target
+		}
+		uri, err := ParseURI(target)
+		if err != nil || uri.User == "" {
+			return nil, fmt.Errorf("DID %s: invalid local user %q", number, dids[number])
+		}
+		routes[key] = uri.String()
+	}
+	return routes, nil
+}
+
+// routeDID points an out-of-dialog request that arrived from upstream at the
+// local user its number is assigned to. The number is looked for in the
+// Request-URI and then in To, since providers either address the number
+// itself or the trunk's registered contact with the number in To.
+func (s *SIPStack) routeDID(req *Message) bool {
+	s.trunkMu.RLock()
+	dids := s.dids
+	s.trunkMu.RUnlock()
+	if len(dids) == 0 || !req.IsRequest() || GetHeaderParam(req.GetHeader("To"), "tag") != "" {
+		return false
+	}
+	var numbers []string
+	if uri, err := ParseURI(req.RequestURI); err == nil {
+		numbers = append(numbers, uri.User)
+	}
+	if uri, err := ParseAddress(req.GetHeader("To")); err == nil {
+		numbers = append(numbers, uri.User)
+	}
+	for _, number := range numbers {
+		if target, ok := dids[normalizeDID(number)]; ok {
+			s.logger.Debug("routing DID to local user", "did", number, "target", target)
+			req.RequestURI = target
+			return true
+		}
+	}
+	return false
+}
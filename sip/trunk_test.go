@@ -0,0 +1,165 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"xylitol4/sip/userdb"
+)
+
+func TestSIPStackRegistersTrunkAnsweringChallenge(t *testing.T) {
+	provider, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer provider.Close()
+	registered := make(chan *Message, 4)
+	go func() {
+		buf := make([]byte, 65535)
+		nonce := 0
+		for {
+			n, addr, err := provider.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := ParseMessage(string(buf[:n]))
+			if err != nil || req.Method != "REGISTER" {
+				continue
+			}
+			params, ok := parseDigestAuthorization(req.GetHeader("Authorization"))
+			if !ok || verifyDigest(params, req, &userdb.User{Username: "0312345678", PasswordHash: "s3cret"}, "provider.example") != nil {
+				nonce++
+				resp := buildResponseFrom(req, 401, "Unauthorized")
+				resp.SetHeader("WWW-Authenticate", `Digest realm="provider.example", nonce="n`+strconv.Itoa(nonce)+`", qop="auth", opaque="xyz"`)
+				provider.WriteTo([]byte(resp.String()), addr)
+				continue
+			}
+			resp := buildResponseFrom(req, 200, "OK")
+			resp.SetHeader("Contact", req.GetHeader("Contact")+";expires=2")
+			provider.WriteTo([]byte(resp.String()), addr)
+			registered <- req
+		}
+	}()
+
+	store, err := userdb.NewSQLiteStore(openStackTestDB(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	trunk, err := ParseTrunk("0312345678:s3cret@" + provider.LocalAddr().String() + ";domain=provider.example;expires=600")
+	if err != nil {
+		t.Fatalf("ParseTrunk returned error: %v", err)
+	}
+	stack, err := NewSIPStack(SIPStackConfig{
+		ListenAddr:   "127.0.0.1:0",
+		UpstreamBind: "127.0.0.1:0",
+		UserStore:    store,
+		Trunks:       []TrunkConfig{trunk},
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("NewSIPStack returned error: %v", err)
+	}
+	if err := stack.Start(context.Background()); err != nil {
+		t.Fatalf("Start returned error: %v", err)
+	}
+	defer stack.Stop()
+
+	var first *Message
+	select {
+	case first = <-registered:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("trunk did not register")
+	}
+	if got := first.GetHeader("To"); got != "<sip:0312345678@provider.example>" {
+		t.Fatalf("unexpected address of record %q", got)
+	}
+	if got := first.GetHeader("Expires"); got != "600" {
+		t.Fatalf("expected 600 second registration, got %q", got)
+	}
+	if cseq, _ := parseCSeqNumber(first.GetHeader("CSeq")); cseq != 2 {
+		t.Fatalf("expected the answer to the challenge to be CSeq 2, got %q", first.GetHeader("CSeq"))
+	}
+
+	// The provider granted two seconds, so the refresh follows after one.
+	select {
+	case refresh := <-registered:
+		if refresh.GetHeader("Call-ID") != first.GetHeader("Call-ID") {
+			t.Fatalf("refresh changed Call-ID from %q to %q", first.GetHeader("Call-ID"), refresh.GetHeader("Call-ID"))
+		}
+		if cseq, _ := parseCSeqNumber(refresh.GetHeader("CSeq")); cseq != 4 {
+			t.Fatalf("expected refresh to continue the CSeq, got %q", refresh.GetHeader("CSeq"))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("trunk registration was not refreshed")
+	}
+}
+
+func TestTrunkCredentialsAnswerChallengesForTheTrunk(t *testing.T) {
+	cfg, err := normalizeTrunk(TrunkConfig{Registrar: "192.0.2.50", Domain: "provider.example", Username: "0312345678", Password: "s3cret"})
+	if err != nil {
+		t.Fatalf("normalizeTrunk returned error: %v", err)
+	}
+	stack := &SIPStack{
+		trunks: []*trunk{newTrunk(cfg, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 50), Port: 5060})},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	stack.trunks[0].setRealm("voice.provider.example")
+
+	bye := NewRequest("BYE", "sip:+81312345678@192.0.2.50")
+	challenge := NewResponse(407, "Proxy Authentication Required")
+	challenge.AddHeader("Proxy-Authenticate", `Digest realm="voice.provider.example", nonce="abc", algorithm=SHA-256`)
+	challenge.AddHeader("Proxy-Authenticate", `Digest realm="voice.provider.example", nonce="abc"`)
+	header, credentials, ok := stack.trunkCredentials(bye, challenge)
+	if !ok || header != "Proxy-Authorization" {
+		t.Fatalf("expected Proxy-Authorization credentials, got %q %v", header, ok)
+	}
+	params, ok := parseDigestAuthorization(credentials)
+	if !ok || verifyDigest(params, bye, &userdb.User{Username: "0312345678", PasswordHash: "s3cret"}, "voice.provider.example") != nil {
+		t.Fatalf("credentials do not answer the challenge: %s", credentials)
+	}
+
+	elsewhere := NewRequest("INVITE", "sip:bob@other.example")
+	foreign := NewResponse(401, "Unauthorized")
+	foreign.SetHeader("WWW-Authenticate", `Digest realm="other.example", nonce="xyz"`)
+	if _, _, ok := stack.trunkCredentials(elsewhere, foreign); ok {
+		t.Fatalf("challenges from servers other than the trunk must be relayed")
+	}
+}
+
+func TestRouteDIDPointsTrunkCallsAtLocalUser(t *testing.T) {
+	dids, err := normalizeDIDs(map[string]string{"+81-3-1234-5678": "alice@example.com"})
+	if err != nil {
+		t.Fatalf("normalizeDIDs returned error: %v", err)
+	}
+	stack := &SIPStack{dids: dids, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	invite := NewRequest("INVITE", "sip:0312345678@192.0.2.10:5070")
+	invite.SetHeader("To", "<sip:+81312345678@provider.example>")
+	if !stack.routeDID(invite) || invite.RequestURI != "sip:alice@example.com" {
+		t.Fatalf("expected the call to be routed to alice, got %q", invite.RequestURI)
+	}
+
+	byNumber := NewRequest("INVITE", "sip:+81312345678;npdi@provider.example")
+	byNumber.SetHeader("To", "<sip:someone@provider.example>")
+	if !stack.routeDID(byNumber) || byNumber.RequestURI != "sip:alice@example.com" {
+		t.Fatalf("expected the number in the Request-URI to be routed, got %q", byNumber.RequestURI)
+	}
+
+	inDialog := NewRequest("BYE", "sip:0312345678@192.0.2.10:5070")
+	inDialog.SetHeader("To", "<sip:+81312345678@provider.example>;tag=abc")
+	if stack.routeDID(inDialog) {
+		t.Fatalf("requests within a dialog must keep their Request-URI")
+	}
+
+	other := NewRequest("INVITE", "sip:0399999999@192.0.2.10:5070")
+	other.SetHeader("To", "<sip:0399999999@provider.example>")
+	if stack.routeDID(other) {
+		t.Fatalf("unassigned numbers must not be routed")
+	}
+}
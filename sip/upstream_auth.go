@@ -0,0 +1,118 @@
+package sip
+
+import (
+	"context"
+	"strings"
+)
+
+// cseqShift is how far the proxy has moved the CSeq numbers of one side of a
+// dialog. Answering a challenge sends the request again with the next CSeq
+// (RFC 3261 section 8.1.3.5), but the user agent that sent it keeps counting
+// from its own number, so its later requests in the dialog are moved by the
+// same amount going upstream, and the responses to them moved back.
+type cseqShift struct {
+	by int
+	// established is set once an INVITE of the dialog has been answered
+	// 2xx; a failed INVITE before that ends the dialog and the shift.
+	established bool
+}
+
+// cseqShiftKey identifies the side of a dialog a request, or the response to
+// it, belongs to: its Call-ID and From tag.
+func cseqShiftKey(msg *Message) string {
+	callID := strings.TrimSpace(msg.GetHeader("Call-ID"))
+	if callID == "" {
+		return ""
+	}
+	return callID + "|" + GetHeaderParam(msg.GetHeader("From"), "tag")
+}
+
+// shiftCSeq moves a request's CSeq by its dialog's shift.
+func (t *transactionUser) shiftCSeq(req *Message) {
+	shift, ok := t.cseqShifts[cseqShiftKey(req)]
+	if !ok {
+		return
+	}
+	if number, ok := parseCSeqNumber(req.GetHeader("CSeq")); ok {
+		req.SetHeader("CSeq", formatCSeq(number+shift.by, cseqMethod(req)))
+	}
+}
+
+// unshiftCSeq moves a response's CSeq back to the number its request was
+// sent downstream with, forgetting the shift once the dialog has ended.
+func (t *transactionUser) unshiftCSeq(resp *Message) {
+	key := cseqShiftKey(resp)
+	shift, ok := t.cseqShifts[key]
+	if !ok {
+		return
+	}
+	method := strings.ToUpper(cseqMethod(resp))
+	if number, ok := parseCSeqNumber(resp.GetHeader("CSeq")); ok {
+		resp.SetHeader("CSeq", formatCSeq(number-shift.by, method))
+	}
+	switch {
+	case resp.StatusCode < 200:
+	case method == "BYE":
+		delete(t.cseqShifts, key)
+	case method == "INVITE" && resp.StatusCode < 300:
+		shift.established = true
+	case method == "INVITE" && !shift.established:
+		delete(t.cseqShifts, key)
+	}
+}
+
+// answerChallenge sends a request the proxy forwarded or originated again
+// with credentials when it was answered 401 or 407 and the credentials hook
+// has an account for the challenge, consuming resp. A request is answered
+// once: a second challenge is relayed like any other response.
+func (t *transactionUser) answerChallenge(ctx context.Context, event tuEvent, resp *Message) bool {
+	attempt, ok := t.attempts[event.ClientTxID]
+	if !ok {
+		return false
+	}
+	if attempt.originated && resp.StatusCode >= 200 {
+		// Responses to the proxy's own requests are consumed before
+		// retryUpstream would forget them.
+		delete(t.attempts, event.ClientTxID)
+	}
+	if t.credentials == nil || attempt.challenged || (resp.StatusCode != 401 && resp.StatusCode != 407) {
+		return false
+	}
+	header, credentials, ok := t.credentials(attempt.forwarded, resp)
+	if !ok {
+		return false
+	}
+	delete(t.attempts, event.ClientTxID)
+
+	retry := attempt.forwarded.Clone()
+	removeTopViaWithBranch(retry, keyBranch(event.ClientTxID))
+	number, _ := parseCSeqNumber(retry.GetHeader("CSeq"))
+	retry.SetHeader("CSeq", formatCSeq(number+1, cseqMethod(retry)))
+	retry.SetHeader(header, credentials)
+	if !attempt.originated {
+		key := cseqShiftKey(retry)
+		shift, ok := t.cseqShifts[key]
+		if !ok {
+			shift = &cseqShift{}
+			t.cseqShifts[key] = shift
+		}
+		shift.by++
+	}
+	branch := newBranchID()
+	prependVia(retry, branch)
+	action := tuAction{
+		Kind:       tuActionForwardRequest,
+		ServerTxID: event.ServerTxID,
+		ClientTxID: transactionKey(branch, strings.ToUpper(retry.Method)),
+		Message:    retry,
+	}
+	t.attempts[action.ClientTxID] = &upstreamAttempt{
+		original:   attempt.original,
+		forwarded:  retry.Clone(),
+		challenged: true,
+		originated: attempt.originated,
+	}
+	t.metrics.upstreamChallengeAnswered()
+	t.sendAction(ctx, action)
+	return true
+}
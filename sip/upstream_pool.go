@@ -0,0 +1,193 @@
+package sip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamPool is the prioritised list of default upstream servers given by
+// UpstreamAddr. Requests go to the first server that is not marked down. A
+// server is marked down when a request sent to it times out or is answered
+// with 503, and comes back when it answers an OPTIONS ping or, when pings are
+// disabled, once its hold-down has passed. While every server is down the
+// primary is used, so requests are still tried somewhere.
+type upstreamPool struct {
+	servers []*upstreamServer
+	// holdDown is how long a failed server stays down; zero keeps it down
+	// until it answers a ping.
+	holdDown time.Duration
+	// sent remembers which server each client transaction went to, so that
+	// its failure is blamed on the right one. It is only kept when there is
+	// another server to fail over to.
+	sent *transactionRouter
+}
+
+// upstreamServer is one member of the pool with its own OPTIONS probe.
+type upstreamServer struct {
+	addr  *net.UDPAddr
+	probe upstreamProbe
+
+	mu   sync.Mutex
+	down bool
+	// downUntil ends a hold-down; it is zero while the server waits for a
+	// ping to bring it back.
+	downUntil time.Time
+}
+
+// resolveUpstreams resolves the comma-separated list of host:port upstream
+// servers, in priority order.
+func resolveUpstreams(list string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", entry)
+		if err != nil {
+			return nil, fmt.Errorf("resolve upstream address %s: %w", entry, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func newUpstreamPool(addrs []*net.UDPAddr, holdDown, routeTTL time.Duration) *upstreamPool {
+	pool := &upstreamPool{holdDown: holdDown}
+	for _, addr := range addrs {
+		pool.servers = append(pool.servers, &upstreamServer{addr: addr})
+	}
+	if len(pool.servers) > 1 {
+		pool.sent = newTransactionRouter(routeTTL, 0)
+	}
+	return pool
+}
+
+// primary returns the highest-priority server's address.
+func (p *upstreamPool) primary() *net.UDPAddr {
+	if p == nil || len(p.servers) == 0 {
+		return nil
+	}
+	return p.servers[0].addr
+}
+
+// pick returns the server msg should go to now, remembering it for a
+// request's client transaction so that failover can find it.
+func (p *upstreamPool) pick(msg *Message, now time.Time) *net.UDPAddr {
+	if p == nil || len(p.servers) == 0 {
+		return nil
+	}
+	key := ""
+	if p.sent != nil && msg.IsRequest() {
+		key = transactionKeyFromRequest(msg)
+	}
+	// Retransmissions stay with the server the transaction started on.
+	if addr, ok := p.sent.Lookup(key); ok {
+		if udp, ok := addr.(*net.UDPAddr); ok {
+			clone := *udp
+			return &clone
+		}
+	}
+	chosen := p.servers[0]
+	for _, server := range p.servers {
+		if server.up(now) {
+			chosen = server
+			break
+		}
+	}
+	if key != "" {
+		p.sent.Remember(key, chosen.addr)
+	}
+	clone := *chosen.addr
+	return &clone
+}
+
+// failover marks down the server the client transaction of the forwarded
+// request req went to, and reports whether another server is up to retry
+// the request on.
+func (p *upstreamPool) failover(req *Message, now time.Time) bool {
+	if p == nil || p.sent == nil {
+		return false
+	}
+	addr, ok := p.sent.Lookup(transactionKeyFromRequest(req))
+	if !ok {
+		return false
+	}
+	available := false
+	for _, server := range p.servers {
+		if server.addr.String() == addr.String() {
+			server.markDown(now, p.holdDown)
+		} else if server.up(now) {
+			available = true
+		}
+	}
+	return available
+}
+
+// answer consumes resp when it answers one of the servers' pings, bringing
+// that server back up.
+func (p *upstreamPool) answer(resp *Message) bool {
+	if p == nil {
+		return false
+	}
+	for _, server := range p.servers {
+		if server.probe.answer(resp) {
+			server.markUp()
+			return true
+		}
+	}
+	return false
+}
+
+// check summarises the servers' probes as one health check, healthy while
+// any server answers.
+func (p *upstreamPool) check() HealthCheck {
+	result := HealthCheck{Name: "upstream"}
+	details := make([]string, 0, len(p.servers))
+	for _, server := range p.servers {
+		check := server.probe.check(server.addr)
+		result.Healthy = result.Healthy || check.Healthy
+		details = append(details, check.Detail)
+	}
+	result.Detail = strings.Join(details, "; ")
+	return result
+}
+
+func (p *upstreamPool) reset() {
+	if p == nil {
+		return
+	}
+	for _, server := range p.servers {
+		server.probe.reset()
+		server.markUp()
+	}
+}
+
+func (s *upstreamServer) up(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down && !s.downUntil.IsZero() && !now.Before(s.downUntil) {
+		s.down = false
+	}
+	return !s.down
+}
+
+func (s *upstreamServer) markDown(now time.Time, holdDown time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = true
+	s.downUntil = time.Time{}
+	if holdDown > 0 {
+		s.downUntil = now.Add(holdDown)
+	}
+}
+
+func (s *upstreamServer) markUp() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = false
+	s.downUntil = time.Time{}
+}
@@ -0,0 +1,404 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidURI is wrapped by ParseURI for values that are not a valid sip:
+// or sips: URI.
+var ErrInvalidURI = errors.New("sip: invalid URI")
+
+// URI is a SIP or SIPS URI (RFC 3261 section 19.1). User, Password, and the
+// parameter and header names and values hold the unescaped text; String
+// escapes them again. Host holds an IPv6 address without its brackets.
+type URI struct {
+	// Scheme is "sip" or "sips".
+	Scheme   string
+	User     string
+	Password string
+	Host     string
+	// Port is 0 when the URI does not give one.
+	Port int
+	// Params are the URI parameters in the order they appeared. A
+	// parameter without a value, such as lr, has an empty Value.
+	Params []URIParam
+	// Headers are the ?name=value pairs in the order they appeared.
+	Headers []URIParam
+}
+
+// URIParam is one URI parameter or header.
+type URIParam struct {
+	Name  string
+	Value string
+}
+
+// ParseURI parses a bare sip: or sips: URI, such as a Request-URI. The scheme
+// and host are required; escapes are decoded and the port must be between 1
+// and 65535.
+func ParseURI(raw string) (*URI, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w %q: %s", ErrInvalidURI, raw, reason)
+	}
+	scheme, rest, ok := strings.Cut(raw, ":")
+	if !ok {
+		return nil, invalid("missing scheme")
+	}
+	u := &URI{Scheme: strings.ToLower(scheme)}
+	if u.Scheme != "sip" && u.Scheme != "sips" {
+		return nil, invalid("scheme must be sip or sips")
+	}
+	if strings.ContainsAny(rest, " \t\r\n<>\"") {
+		return nil, invalid("contains whitespace, quotes, or angle brackets")
+	}
+
+	// The user part may hold ';' and '?' but '@' only separates it: the
+	// parameters and headers must escape it.
+	if at := strings.LastIndexByte(rest, '@'); at >= 0 {
+		userinfo := rest[:at]
+		rest = rest[at+1:]
+		user, password, hasPassword := strings.Cut(userinfo, ":")
+		var err error
+		if u.User, err = unescapeURI(user); err != nil || u.User == "" {
+			return nil, invalid("invalid user part")
+		}
+		if hasPassword {
+			if u.Password, err = unescapeURI(password); err != nil {
+				return nil, invalid("invalid password")
+			}
+		}
+	}
+	rest, headers, hasHeaders := strings.Cut(rest, "?")
+	hostport, params, hasParams := strings.Cut(rest, ";")
+
+	host, port, hasPort := hostport, "", false
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return nil, invalid("unterminated IPv6 reference")
+		}
+		host = hostport[1:end]
+		if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+			return nil, invalid("invalid IPv6 reference")
+		}
+		switch after := hostport[end+1:]; {
+		case after == "":
+		case after[0] == ':':
+			port, hasPort = after[1:], true
+		default:
+			return nil, invalid("unexpected text after IPv6 reference")
+		}
+	} else {
+		host, port, hasPort = strings.Cut(hostport, ":")
+		if !validHostname(host) {
+			return nil, invalid("invalid host")
+		}
+	}
+	u.Host = host
+	if hasPort {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, invalid("invalid port")
+		}
+		u.Port = n
+	}
+
+	if hasParams {
+		var err error
+		if u.Params, err = parseURIParams(params, ";"); err != nil {
+			return nil, invalid("invalid parameter")
+		}
+	}
+	if hasHeaders {
+		var err error
+		if u.Headers, err = parseURIParams(headers, "&"); err != nil {
+			return nil, invalid("invalid header")
+		}
+	}
+	return u, nil
+}
+
+// ParseAddress extracts the URI from a header value in name-addr form
+// ("Alice" <sip:alice@example.com>;tag=1) or addr-spec form
+// (sip:alice@example.com;tag=1), as found in To, From, Contact, and Route.
+// In addr-spec form the parameters belong to the header, not the URI, which
+// is why a URI holding ';', '?', or ',' must be enclosed in angle brackets
+// (RFC 3261 section 20.10); they are left out of the result.
+func ParseAddress(value string) (*URI, error) {
+	value = strings.TrimSpace(value)
+	if start := quotedIndexByte(value, '<'); start >= 0 {
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("%w %q: unterminated angle bracket", ErrInvalidURI, value)
+		}
+		return ParseURI(value[start+1 : start+end])
+	}
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return ParseURI(value)
+}
+
+// quotedIndexByte is strings.IndexByte ignoring bytes inside a quoted
+// display name.
+func quotedIndexByte(s string, c byte) int {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuote && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && s[i] == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// Param returns the value of the named parameter, compared without regard to
+// case, and whether the URI has it.
+func (u *URI) Param(name string) (string, bool) {
+	for _, p := range u.Params {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetParam replaces the named parameter's value, or appends the parameter
+// when the URI does not have it.
+func (u *URI) SetParam(name, value string) {
+	for i, p := range u.Params {
+		if strings.EqualFold(p.Name, name) {
+			u.Params[i].Value = value
+			return
+		}
+	}
+	u.Params = append(u.Params, URIParam{Name: name, Value: value})
+}
+
+// HostPort returns the host and port to send to, with the port defaulting to
+// 5060, or 5061 for sips.
+func (u *URI) HostPort() string {
+	port := u.Port
+	if port == 0 {
+		port = 5060
+		if u.Scheme == "sips" {
+			port = 5061
+		}
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
+
+// String renders the URI, escaping what its parts require.
+func (u *URI) String() string {
+	var b strings.Builder
+	b.WriteString(u.Scheme)
+	b.WriteByte(':')
+	if u.User != "" {
+		b.WriteString(escapeURI(u.User, userUnreserved))
+		if u.Password != "" {
+			b.WriteByte(':')
+			b.WriteString(escapeURI(u.Password, passwordUnreserved))
+		}
+		b.WriteByte('@')
+	}
+	if strings.Contains(u.Host, ":") {
+		b.WriteByte('[')
+		b.WriteString(u.Host)
+		b.WriteByte(']')
+	} else {
+		b.WriteString(u.Host)
+	}
+	if u.Port != 0 {
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(u.Port))
+	}
+	for _, p := range u.Params {
+		b.WriteByte(';')
+		b.WriteString(escapeURI(p.Name, paramUnreserved))
+		if p.Value != "" {
+			b.WriteByte('=')
+			b.WriteString(escapeURI(p.Value, paramUnreserved))
+		}
+	}
+	for i, h := range u.Headers {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		b.WriteString(escapeURI(h.Name, headerUnreserved))
+		b.WriteByte('=')
+		b.WriteString(escapeURI(h.Value, headerUnreserved))
+	}
+	return b.String()
+}
+
+// Equal compares two URIs by the rules of RFC 3261 section 19.1.4: the user
+// and password are case-sensitive, the host and parameter names are not,
+// parameter order does not matter, a parameter present in only one URI is
+// ignored unless it is user, ttl, method, maddr, or transport, and the
+// headers must match exactly. A component left out, such as the port, does
+// not match one given explicitly with its default value.
+func (u *URI) Equal(v *URI) bool {
+	if u == nil || v == nil {
+		return u == v
+	}
+	if u.Scheme != v.Scheme || u.User != v.User || u.Password != v.Password ||
+		!strings.EqualFold(u.Host, v.Host) || u.Port != v.Port {
+		return false
+	}
+	for _, p := range u.Params {
+		other, ok := v.Param(p.Name)
+		if !ok {
+			if significantURIParam(p.Name) {
+				return false
+			}
+			continue
+		}
+		if !strings.EqualFold(p.Value, other) {
+			return false
+		}
+	}
+	for _, p := range v.Params {
+		if _, ok := u.Param(p.Name); !ok && significantURIParam(p.Name) {
+			return false
+		}
+	}
+	if len(u.Headers) != len(v.Headers) {
+		return false
+	}
+	for _, h := range u.Headers {
+		found := false
+		for _, other := range v.Headers {
+			if strings.EqualFold(h.Name, other.Name) && h.Value == other.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func significantURIParam(name string) bool {
+	switch strings.ToLower(name) {
+	case "user", "ttl", "method", "maddr", "transport":
+		return true
+	}
+	return false
+}
+
+func parseURIParams(raw, sep string) ([]URIParam, error) {
+	var params []URIParam
+	for _, field := range strings.Split(raw, sep) {
+		name, value, _ := strings.Cut(field, "=")
+		var err error
+		p := URIParam{}
+		if p.Name, err = unescapeURI(name); err != nil || p.Name == "" {
+			return nil, ErrInvalidURI
+		}
+		if p.Value, err = unescapeURI(value); err != nil {
+			return nil, err
+		}
+		params = append(params, p)
+	}
+	return params, nil
+}
+
+// validHostname accepts host names and IPv4 addresses.
+func validHostname(host string) bool {
+	if host == "" || host[0] == '.' || host[0] == '-' || strings.Contains(host, "..") {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if !isAlphaNum(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlphaNum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Characters each URI component may hold unescaped besides the unreserved
+// alphanumerics and mark characters of RFC 3261 section 25.1.
+const (
+	userUnreserved     = "&=+$,;?/"
+	passwordUnreserved = "&=+$,"
+	paramUnreserved    = "[]/:&+$"
+	headerUnreserved   = "[]/?:+$"
+)
+
+func escapeURI(s, unreserved string) string {
+	escape := 0
+	for i := 0; i < len(s); i++ {
+		if !uriUnreserved(s[i], unreserved) {
+			escape++
+		}
+	}
+	if escape == 0 {
+		return s
+	}
+	const hex = "0123456789ABCDEF"
+	out := make([]byte, 0, len(s)+2*escape)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if uriUnreserved(c, unreserved) {
+			out = append(out, c)
+			continue
+		}
+		out = append(out, '%', hex[c>>4], hex[c&0xf])
+	}
+	return string(out)
+}
+
+func uriUnreserved(c byte, extra string) bool {
+	return isAlphaNum(c) || strings.IndexByte("-_.!~*'()", c) >= 0 || strings.IndexByte(extra, c) >= 0
+}
+
+func unescapeURI(s string) (string, error) {
+	if strings.IndexByte(s, '%') < 0 {
+		return s, nil
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", ErrInvalidURI
+		}
+		hi, lo := unhex(s[i+1]), unhex(s[i+2])
+		if hi < 0 || lo < 0 {
+			return "", ErrInvalidURI
+		}
+		out = append(out, byte(hi<<4|lo))
+		i += 2
+	}
+	return string(out), nil
+}
+
+func unhex(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
@@ -0,0 +1,107 @@
+package sip
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseURIComponents(t *testing.T) {
+	uri, err := ParseURI("SIPS:al%69ce;x:se%63ret@[2001:db8::1]:5071;transport=tcp;lr;maddr=239.255.255.1?subject=project%20x&priority=urgent")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if uri.Scheme != "sips" || uri.User != "alice;x" || uri.Password != "secret" || uri.Host != "2001:db8::1" || uri.Port != 5071 {
+		t.Fatalf("unexpected components: %+v", uri)
+	}
+	wantParams := []URIParam{{"transport", "tcp"}, {"lr", ""}, {"maddr", "239.255.255.1"}}
+	if !slices.Equal(uri.Params, wantParams) {
+		t.Fatalf("expected params %v in order, got %v", wantParams, uri.Params)
+	}
+	if value, ok := uri.Param("TRANSPORT"); !ok || value != "tcp" {
+		t.Fatalf("expected case-insensitive parameter lookup, got %q %v", value, ok)
+	}
+	wantHeaders := []URIParam{{"subject", "project x"}, {"priority", "urgent"}}
+	if !slices.Equal(uri.Headers, wantHeaders) {
+		t.Fatalf("expected headers %v, got %v", wantHeaders, uri.Headers)
+	}
+	want := "sips:alice;x:secret@[2001:db8::1]:5071;transport=tcp;lr;maddr=239.255.255.1?subject=project%20x&priority=urgent"
+	if got := uri.String(); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if got := uri.HostPort(); got != "[2001:db8::1]:5071" {
+		t.Fatalf("unexpected host and port %q", got)
+	}
+	if got := (&URI{Scheme: "sips", Host: "example.com"}).HostPort(); got != "example.com:5061" {
+		t.Fatalf("expected the sips default port, got %q", got)
+	}
+}
+
+func TestParseURIRejectsMalformedValues(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"alice@example.com",
+		"tel:+15551234",
+		"sip:",
+		"sip:@example.com",
+		"sip:alice@",
+		"sip:alice@example.com:",
+		"sip:alice@example.com:70000",
+		"sip:alice@[2001:db8::1",
+		"sip:alice@[example.com]",
+		"sip:alice@exa mple.com",
+		"sip:al%zzice@example.com",
+		"sip:alice@example.com;=x",
+		"<sip:alice@example.com>",
+	} {
+		if _, err := ParseURI(raw); !errors.Is(err, ErrInvalidURI) {
+			t.Fatalf("expected %q to be rejected, got %v", raw, err)
+		}
+	}
+}
+
+func TestParseAddressSeparatesHeaderParameters(t *testing.T) {
+	for value, want := range map[string]string{
+		`"Bob, Jr. <home>" <sip:bob@example.com;transport=udp>;tag=1`: "sip:bob@example.com;transport=udp",
+		"<sip:bob@192.0.2.4:5070>":                                    "sip:bob@192.0.2.4:5070",
+		"sip:bob@example.com;tag=1":                                   "sip:bob@example.com",
+	} {
+		uri, err := ParseAddress(value)
+		if err != nil {
+			t.Fatalf("parse %q: %v", value, err)
+		}
+		if got := uri.String(); got != want {
+			t.Fatalf("expected %q from %q, got %q", want, value, got)
+		}
+	}
+}
+
+func TestURIEqualFollowsRFC3261Comparison(t *testing.T) {
+	equal := [][2]string{
+		{"sip:%61lice@atlanta.com;transport=TCP", "sip:alice@AtLanTa.CoM;Transport=tcp"},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com;newparam=5"},
+		{"sip:biloxi.com;transport=tcp;method=REGISTER?to=sip:bob%40biloxi.com", "sip:biloxi.com;method=REGISTER;transport=tcp?to=sip:bob%40biloxi.com"},
+		{"sip:alice@atlanta.com?subject=project%20x&priority=urgent", "sip:alice@atlanta.com?priority=urgent&subject=project%20x"},
+	}
+	for _, pair := range equal {
+		a, _ := ParseURI(pair[0])
+		b, _ := ParseURI(pair[1])
+		if !a.Equal(b) || !b.Equal(a) {
+			t.Fatalf("expected %q and %q to be equal", pair[0], pair[1])
+		}
+	}
+	different := [][2]string{
+		{"SIP:ALICE@AtLanTa.CoM;Transport=udp", "sip:alice@AtLanTa.CoM;Transport=UDP"},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com:5060"},
+		{"sip:bob@biloxi.com", "sip:bob@biloxi.com;transport=udp"},
+		{"sip:carol@chicago.com;security=on", "sip:carol@chicago.com;security=off"},
+		{"sip:carol@chicago.com", "sip:carol@chicago.com?Subject=next%20meeting"},
+	}
+	for _, pair := range different {
+		a, _ := ParseURI(pair[0])
+		b, _ := ParseURI(pair[1])
+		if a.Equal(b) || b.Equal(a) {
+			t.Fatalf("expected %q and %q to differ", pair[0], pair[1])
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package userdb
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrAdminNotFound is returned when an administrator account does not exist.
+var ErrAdminNotFound = errors.New("userdb: admin account not found")
+
+// ErrAdminExists is returned when creating an administrator account whose
+// username is already taken.
+var ErrAdminExists = errors.New("userdb: admin account already exists")
+
+// ErrRecoveryCodeInvalid is returned when a two-factor recovery code does not
+// exist or has already been used.
+var ErrRecoveryCodeInvalid = errors.New("userdb: recovery code is invalid or already used")
+
+// AdminRole grants a level of access to the administrative interface. Each
+// role includes everything the roles below it may do.
+type AdminRole string
+
+const (
+	// RoleReadOnly may view users and broadcast rules.
+	RoleReadOnly AdminRole = "read-only"
+	// RoleHelpdesk may additionally create users, suspend and reinstate
+	// them, and reset their passwords.
+	RoleHelpdesk AdminRole = "helpdesk"
+	// RoleSuperadmin may do everything, including deleting users, bulk
+	// import and export, broadcast rules, and managing admin accounts.
+	RoleSuperadmin AdminRole = "superadmin"
+)
+
+// AdminRoles lists the roles from least to most privileged.
+var AdminRoles = []AdminRole{RoleReadOnly, RoleHelpdesk, RoleSuperadmin}
+
+// ParseAdminRole validates a role name.
+func ParseAdminRole(name string) (AdminRole, error) {
+	role := AdminRole(strings.ToLower(strings.TrimSpace(name)))
+	if role.rank() == 0 {
+		return "", fmt.Errorf("userdb: unknown admin role %q", name)
+	}
+	return role, nil
+}
+
+func (r AdminRole) rank() int {
+	for i, role := range AdminRoles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Allows reports whether the role grants at least required.
+func (r AdminRole) Allows(required AdminRole) bool {
+	return r.rank() > 0 && r.rank() >= required.rank()
+}
+
+// AdminAccount is an administrator of the web interface. PasswordHash holds
+// the output of HashAdminPassword. TOTPSecret is the base32 TOTP secret of an
+// account enrolled in two-factor authentication, or empty.
+type AdminAccount struct {
+	Username     string
+	PasswordHash string
+	Role         AdminRole
+	TOTPSecret   string
+}
+
+// adminHashIterations is the PBKDF2-SHA256 work factor for new admin
+// password hashes.
+const adminHashIterations = 600000
+
+// HashAdminPassword derives a salted PBKDF2-SHA256 hash for an admin
+// password, encoded as "pbkdf2-sha256$<iterations>$<salt>$<key>". Unlike the
+// HA1 digests SIP users need, it is deliberately slow to brute-force.
+func HashAdminPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("userdb: generate salt: %w", err)
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, adminHashIterations, sha256.Size)
+	if err != nil {
+		return "", fmt.Errorf("userdb: hash admin password: %w", err)
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", adminHashIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// VerifyAdminPassword reports whether candidate matches a hash produced by
+// HashAdminPassword. Malformed hashes never match.
+func VerifyAdminPassword(stored, candidate string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := enc.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, candidate, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// AdminAccount returns the named administrator account.
+func (s *SQLStore) AdminAccount(ctx context.Context, username string) (*AdminAccount, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT username, password_hash, role, totp_secret FROM admin_accounts WHERE username = ? LIMIT 1`
+	var account AdminAccount
+	var role string
+	var secret sql.NullString
+	err := s.db.QueryRowContext(ctx, s.dialect.rebind(query), username).Scan(&account.Username, &account.PasswordHash, &role, &secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAdminNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("userdb: lookup admin account: %w", err)
+	}
+	account.Role = AdminRole(role)
+	account.TOTPSecret = secret.String
+	return &account, nil
+}
+
+// ListAdminAccounts returns every administrator account ordered by username.
+func (s *SQLStore) ListAdminAccounts(ctx context.Context) ([]AdminAccount, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT username, password_hash, role, totp_secret FROM admin_accounts ORDER BY username`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query admin accounts: %w", err)
+	}
+	defer rows.Close()
+	var accounts []AdminAccount
+	for rows.Next() {
+		var account AdminAccount
+		var role string
+		var secret sql.NullString
+		if err := rows.Scan(&account.Username, &account.PasswordHash, &role, &secret); err != nil {
+			return nil, fmt.Errorf("userdb: scan admin account: %w", err)
+		}
+		account.Role = AdminRole(role)
+		account.TOTPSecret = secret.String
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate admin accounts: %w", err)
+	}
+	return accounts, nil
+}
+
+// CreateAdminAccount inserts an administrator account.
+func (s *SQLStore) CreateAdminAccount(ctx context.Context, account AdminAccount) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if err := validateAdminAccount(account); err != nil {
+		return err
+	}
+	const query = `INSERT INTO admin_accounts (username, password_hash, role, totp_secret) VALUES (?, ?, ?, ?)`
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(query), account.Username, account.PasswordHash, string(account.Role), account.TOTPSecret); err != nil {
+		if isUniqueViolation(err) {
+			return ErrAdminExists
+		}
+		return fmt.Errorf("userdb: insert admin account: %w", err)
+	}
+	return nil
+}
+
+// UpdateAdminAccount replaces an account's role and, when PasswordHash is
+// non-empty, its password. Two-factor settings are left alone; see
+// SetAdminTOTP.
+func (s *SQLStore) UpdateAdminAccount(ctx context.Context, account AdminAccount) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if account.Role.rank() == 0 {
+		return fmt.Errorf("userdb: unknown admin role %q", account.Role)
+	}
+	query := `UPDATE admin_accounts SET role = ? WHERE username = ?`
+	args := []any{string(account.Role), account.Username}
+	if account.PasswordHash != "" {
+		query = `UPDATE admin_accounts SET role = ?, password_hash = ? WHERE username = ?`
+		args = []any{string(account.Role), account.PasswordHash, account.Username}
+	}
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("userdb: update admin account: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update admin account rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrAdminNotFound
+	}
+	return nil
+}
+
+// DeleteAdminAccount removes an administrator account and its recovery codes.
+func (s *SQLStore) DeleteAdminAccount(ctx context.Context, username string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		const query = `DELETE FROM admin_accounts WHERE username = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(query), username)
+		if err != nil {
+			return fmt.Errorf("userdb: delete admin account: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: delete admin account rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrAdminNotFound
+		}
+		const deleteCodes = `DELETE FROM admin_recovery_codes WHERE username = ?`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(deleteCodes), username); err != nil {
+			return fmt.Errorf("userdb: delete admin recovery codes: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetAdminTOTP enrolls an administrator in two-factor authentication with the
+// given secret, replacing any recovery codes with codeHashes (see
+// HashRecoveryCode). An empty secret turns two-factor authentication off and
+// discards the recovery codes.
+func (s *SQLStore) SetAdminTOTP(ctx context.Context, username, secret string, codeHashes []string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if secret == "" {
+		codeHashes = nil
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		const query = `UPDATE admin_accounts SET totp_secret = ? WHERE username = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(query), secret, username)
+		if err != nil {
+			return fmt.Errorf("userdb: update admin two-factor secret: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: update admin two-factor secret rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrAdminNotFound
+		}
+		const deleteCodes = `DELETE FROM admin_recovery_codes WHERE username = ?`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(deleteCodes), username); err != nil {
+			return fmt.Errorf("userdb: delete admin recovery codes: %w", err)
+		}
+		const insertCode = `INSERT INTO admin_recovery_codes (username, code_hash) VALUES (?, ?)`
+		for _, hash := range codeHashes {
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(insertCode), username, hash); err != nil {
+				return fmt.Errorf("userdb: insert admin recovery code: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// UseAdminRecoveryCode consumes one of an administrator's recovery codes,
+// identified by its HashRecoveryCode digest, returning ErrRecoveryCodeInvalid
+// when there is no such unused code. Deleting the row makes each code
+// single-use even under concurrent logins.
+func (s *SQLStore) UseAdminRecoveryCode(ctx context.Context, username, codeHash string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM admin_recovery_codes WHERE username = ? AND code_hash = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), username, codeHash)
+	if err != nil {
+		return fmt.Errorf("userdb: use admin recovery code: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: use admin recovery code rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrRecoveryCodeInvalid
+	}
+	return nil
+}
+
+// HashRecoveryCode digests a two-factor recovery code for storage. Codes are
+// random and long enough that a fast hash suffices, and a deterministic one
+// lets UseAdminRecoveryCode find the code directly. Case, spaces, and dashes
+// are ignored so codes can be typed back as displayed.
+func HashRecoveryCode(code string) string {
+	normalised := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '\t':
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateAdminAccount(account AdminAccount) error {
+	if strings.TrimSpace(account.Username) == "" {
+		return fmt.Errorf("userdb: admin username is required")
+	}
+	if account.PasswordHash == "" {
+		return fmt.Errorf("userdb: admin password is required")
+	}
+	if account.Role.rank() == 0 {
+		return fmt.Errorf("userdb: unknown admin role %q", account.Role)
+	}
+	return nil
+}
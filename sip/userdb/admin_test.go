@@ -0,0 +1,154 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAdminRoleAllows(t *testing.T) {
+	if !RoleSuperadmin.Allows(RoleHelpdesk) || !RoleHelpdesk.Allows(RoleReadOnly) {
+		t.Fatalf("higher roles should include lower ones")
+	}
+	if RoleReadOnly.Allows(RoleHelpdesk) || RoleHelpdesk.Allows(RoleSuperadmin) {
+		t.Fatalf("lower roles should not include higher ones")
+	}
+	if AdminRole("root").Allows(RoleReadOnly) {
+		t.Fatalf("unknown roles should allow nothing")
+	}
+	if role, err := ParseAdminRole(" HelpDesk "); err != nil || role != RoleHelpdesk {
+		t.Fatalf("ParseAdminRole = %q, %v", role, err)
+	}
+	if _, err := ParseAdminRole("root"); err == nil {
+		t.Fatalf("expected unknown role to be rejected")
+	}
+}
+
+func TestAdminPasswordHash(t *testing.T) {
+	hash, err := HashAdminPassword("s3cret")
+	if err != nil {
+		t.Fatalf("HashAdminPassword: %v", err)
+	}
+	if !VerifyAdminPassword(hash, "s3cret") {
+		t.Fatalf("expected password to match")
+	}
+	if VerifyAdminPassword(hash, "other") {
+		t.Fatalf("password should not match")
+	}
+	again, err := HashAdminPassword("s3cret")
+	if err != nil {
+		t.Fatalf("HashAdminPassword: %v", err)
+	}
+	if again == hash {
+		t.Fatalf("hashes should be salted")
+	}
+	for _, malformed := range []string{"", "s3cret", "pbkdf2-sha256$x$AA$AA", "md5$1$AA$AA"} {
+		if VerifyAdminPassword(malformed, "s3cret") {
+			t.Fatalf("malformed hash %q should never match", malformed)
+		}
+	}
+}
+
+func TestSQLStoreAdminAccounts(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	if _, err := store.AdminAccount(ctx, "root"); !errors.Is(err, ErrAdminNotFound) {
+		t.Fatalf("expected ErrAdminNotFound, got %v", err)
+	}
+	if err := store.CreateAdminAccount(ctx, AdminAccount{Username: "root", PasswordHash: "h1", Role: RoleSuperadmin}); err != nil {
+		t.Fatalf("CreateAdminAccount: %v", err)
+	}
+	if err := store.CreateAdminAccount(ctx, AdminAccount{Username: "desk", PasswordHash: "h2", Role: RoleHelpdesk}); err != nil {
+		t.Fatalf("CreateAdminAccount: %v", err)
+	}
+	if err := store.CreateAdminAccount(ctx, AdminAccount{Username: "root", PasswordHash: "h3", Role: RoleReadOnly}); !errors.Is(err, ErrAdminExists) {
+		t.Fatalf("expected ErrAdminExists, got %v", err)
+	}
+	if err := store.CreateAdminAccount(ctx, AdminAccount{Username: "x", PasswordHash: "h", Role: "root"}); err == nil {
+		t.Fatalf("expected unknown role to be rejected")
+	}
+
+	accounts, err := store.ListAdminAccounts(ctx)
+	if err != nil {
+		t.Fatalf("ListAdminAccounts: %v", err)
+	}
+	if len(accounts) != 2 || accounts[0].Username != "desk" || accounts[1].Username != "root" {
+		t.Fatalf("unexpected accounts: %+v", accounts)
+	}
+
+	if err := store.UpdateAdminAccount(ctx, AdminAccount{Username: "desk", Role: RoleReadOnly}); err != nil {
+		t.Fatalf("UpdateAdminAccount: %v", err)
+	}
+	desk, err := store.AdminAccount(ctx, "desk")
+	if err != nil {
+		t.Fatalf("AdminAccount: %v", err)
+	}
+	if desk.Role != RoleReadOnly || desk.PasswordHash != "h2" {
+		t.Fatalf("role-only update should keep the password: %+v", desk)
+	}
+	if err := store.UpdateAdminAccount(ctx, AdminAccount{Username: "desk", PasswordHash: "h4", Role: RoleHelpdesk}); err != nil {
+		t.Fatalf("UpdateAdminAccount: %v", err)
+	}
+	if desk, _ = store.AdminAccount(ctx, "desk"); desk.PasswordHash != "h4" || desk.Role != RoleHelpdesk {
+		t.Fatalf("unexpected account after update: %+v", desk)
+	}
+	if err := store.UpdateAdminAccount(ctx, AdminAccount{Username: "ghost", Role: RoleHelpdesk}); !errors.Is(err, ErrAdminNotFound) {
+		t.Fatalf("expected ErrAdminNotFound, got %v", err)
+	}
+
+	if err := store.DeleteAdminAccount(ctx, "desk"); err != nil {
+		t.Fatalf("DeleteAdminAccount: %v", err)
+	}
+	if err := store.DeleteAdminAccount(ctx, "desk"); !errors.Is(err, ErrAdminNotFound) {
+		t.Fatalf("expected ErrAdminNotFound, got %v", err)
+	}
+}
+
+func TestSQLStoreAdminTOTP(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.CreateAdminAccount(ctx, AdminAccount{Username: "root", PasswordHash: "h", Role: RoleSuperadmin}); err != nil {
+		t.Fatalf("CreateAdminAccount: %v", err)
+	}
+	codes := []string{HashRecoveryCode("AAAA-BBBB"), HashRecoveryCode("CCCC-DDDD")}
+	if err := store.SetAdminTOTP(ctx, "root", "JBSWY3DPEHPK3PXP", codes); err != nil {
+		t.Fatalf("SetAdminTOTP: %v", err)
+	}
+	account, err := store.AdminAccount(ctx, "root")
+	if err != nil {
+		t.Fatalf("AdminAccount: %v", err)
+	}
+	if account.TOTPSecret != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("unexpected secret %q", account.TOTPSecret)
+	}
+
+	if err := store.UseAdminRecoveryCode(ctx, "root", HashRecoveryCode("aaaa bbbb")); err != nil {
+		t.Fatalf("UseAdminRecoveryCode: %v", err)
+	}
+	if err := store.UseAdminRecoveryCode(ctx, "root", HashRecoveryCode("AAAA-BBBB")); !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("expected a used code to be rejected, got %v", err)
+	}
+
+	if err := store.SetAdminTOTP(ctx, "root", "", codes); err != nil {
+		t.Fatalf("SetAdminTOTP off: %v", err)
+	}
+	if account, _ = store.AdminAccount(ctx, "root"); account.TOTPSecret != "" {
+		t.Fatalf("expected two-factor to be off, got %q", account.TOTPSecret)
+	}
+	if err := store.UseAdminRecoveryCode(ctx, "root", HashRecoveryCode("CCCC-DDDD")); !errors.Is(err, ErrRecoveryCodeInvalid) {
+		t.Fatalf("expected recovery codes to be discarded, got %v", err)
+	}
+	if err := store.SetAdminTOTP(ctx, "ghost", "JBSWY3DPEHPK3PXP", nil); !errors.Is(err, ErrAdminNotFound) {
+		t.Fatalf("expected ErrAdminNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package userdb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrAPITokenNotFound is returned when an API token does not exist or has
+// been revoked.
+var ErrAPITokenNotFound = errors.New("userdb: API token not found")
+
+// APIScope grants an API token access to one group of JSON API endpoints.
+type APIScope string
+
+const (
+	// ScopeUsersRead may list and read users and their registrations.
+	ScopeUsersRead APIScope = "users:read"
+	// ScopeUsersWrite may additionally create, change, and delete users.
+	ScopeUsersWrite APIScope = "users:write"
+	// ScopeRulesRead may list and read broadcast rules, trunk routes, domain
+	// settings, short numbers, and caller-ID rules.
+	ScopeRulesRead APIScope = "rules:read"
+	// ScopeRulesWrite may additionally create, change, and delete broadcast
+	// rules, trunk routes, domain settings, short numbers, and caller-ID
+	// rules.
+	ScopeRulesWrite APIScope = "rules:write"
+	// ScopeTrace may control the SIP message tracer and read traced
+	// messages, which include credentials and call details.
+	ScopeTrace APIScope = "trace"
+	// ScopeReload may make the proxy reload its configuration.
+	ScopeReload APIScope = "reload"
+)
+
+// APIScopes lists every scope a token may be granted.
+var APIScopes = []APIScope{ScopeUsersRead, ScopeUsersWrite, ScopeRulesRead, ScopeRulesWrite, ScopeTrace, ScopeReload}
+
+// ParseAPIScopes validates scope names, dropping duplicates and keeping the
+// order of APIScopes.
+func ParseAPIScopes(names []string) ([]APIScope, error) {
+	granted := make(map[APIScope]bool, len(names))
+	for _, name := range names {
+		scope := APIScope(strings.ToLower(strings.TrimSpace(name)))
+		if scope == "" {
+			continue
+		}
+		if !scope.valid() {
+			return nil, fmt.Errorf("userdb: unknown API scope %q", name)
+		}
+		granted[scope] = true
+	}
+	var scopes []APIScope
+	for _, scope := range APIScopes {
+		if granted[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (s APIScope) valid() bool {
+	for _, scope := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken is a long-lived credential for the JSON API. Only the
+// HashAPIToken digest of the secret is stored; the secret itself is shown
+// once when the token is created.
+type APIToken struct {
+	ID        int64
+	Name      string
+	TokenHash string
+	Scopes    []APIScope
+	CreatedBy string
+	Created   time.Time
+}
+
+// Allows reports whether the token grants scope. A write scope implies the
+// matching read scope.
+func (t APIToken) Allows(scope APIScope) bool {
+	for _, granted := range t.Scopes {
+		switch {
+		case granted == scope:
+			return true
+		case granted == ScopeUsersWrite && scope == ScopeUsersRead:
+			return true
+		case granted == ScopeRulesWrite && scope == ScopeRulesRead:
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenPrefix marks secrets from GenerateAPIToken so they are easy to
+// recognise in scripts and secret scanners.
+const apiTokenPrefix = "xyl_"
+
+// GenerateAPIToken returns a new random API token secret and its
+// HashAPIToken digest.
+func GenerateAPIToken() (secret, hash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("userdb: generate API token: %w", err)
+	}
+	secret = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return secret, HashAPIToken(secret), nil
+}
+
+// HashAPIToken digests an API token secret for storage and lookup. Secrets
+// carry 256 random bits, so like recovery codes a fast hash suffices.
+func HashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListAPITokens returns every API token ordered by creation.
+func (s *SQLStore) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT id, name, token_hash, scopes, created_by, created_at FROM api_tokens ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query API tokens: %w", err)
+	}
+	defer rows.Close()
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate API tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// APITokenByHash returns the token whose secret has the given HashAPIToken
+// digest, or ErrAPITokenNotFound.
+func (s *SQLStore) APITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT id, name, token_hash, scopes, created_by, created_at FROM api_tokens WHERE token_hash = ? LIMIT 1`
+	token, err := scanAPIToken(s.db.QueryRowContext(ctx, s.dialect.rebind(query), hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPITokenNotFound
+	}
+	return token, err
+}
+
+// CreateAPIToken stores a token, stamping Created when it is zero, and
+// returns it with its assigned ID.
+func (s *SQLStore) CreateAPIToken(ctx context.Context, token APIToken) (*APIToken, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return nil, fmt.Errorf("userdb: API token name is required")
+	}
+	if token.TokenHash == "" {
+		return nil, fmt.Errorf("userdb: API token hash is required")
+	}
+	if len(token.Scopes) == 0 {
+		return nil, fmt.Errorf("userdb: API token needs at least one scope")
+	}
+	names := make([]string, len(token.Scopes))
+	for i, scope := range token.Scopes {
+		if !scope.valid() {
+			return nil, fmt.Errorf("userdb: unknown API scope %q", scope)
+		}
+		names[i] = string(scope)
+	}
+	if token.Created.IsZero() {
+		token.Created = time.Now()
+	}
+	token.Created = token.Created.UTC()
+	const insert = `INSERT INTO api_tokens (name, token_hash, scopes, created_by, created_at) VALUES (?, ?, ?, ?, ?)`
+	id, err := s.insertReturningID(ctx, s.db, insert, token.Name, token.TokenHash, strings.Join(names, " "), token.CreatedBy, token.Created.Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: insert API token: %w", err)
+	}
+	token.ID = id
+	return &token, nil
+}
+
+// DeleteAPIToken revokes a token, returning ErrAPITokenNotFound when absent.
+func (s *SQLStore) DeleteAPIToken(ctx context.Context, id int64) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM api_tokens WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), id)
+	if err != nil {
+		return fmt.Errorf("userdb: delete API token: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: delete API token rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var token APIToken
+	var scopes, created string
+	if err := row.Scan(&token.ID, &token.Name, &token.TokenHash, &scopes, &token.CreatedBy, &created); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("userdb: scan API token: %w", err)
+	}
+	for _, name := range strings.Fields(scopes) {
+		token.Scopes = append(token.Scopes, APIScope(name))
+	}
+	var err error
+	if token.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+		return nil, fmt.Errorf("userdb: API token %d has invalid time %q: %w", token.ID, created, err)
+	}
+	return &token, nil
+}
@@ -0,0 +1,73 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSQLStoreAPITokens(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	secret, hash, err := GenerateAPIToken()
+	if err != nil {
+		t.Fatalf("GenerateAPIToken: %v", err)
+	}
+	if !strings.HasPrefix(secret, apiTokenPrefix) || hash != HashAPIToken(secret) || strings.Contains(hash, secret) {
+		t.Fatalf("unexpected secret %q or hash %q", secret, hash)
+	}
+	created, err := store.CreateAPIToken(ctx, APIToken{Name: " provisioning ", TokenHash: hash, Scopes: []APIScope{ScopeUsersWrite}, CreatedBy: "root"})
+	if err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if created.ID == 0 || created.Name != "provisioning" || created.Created.IsZero() {
+		t.Fatalf("unexpected created token: %+v", created)
+	}
+	if _, err := store.CreateAPIToken(ctx, APIToken{Name: "empty", TokenHash: "x"}); err == nil {
+		t.Fatal("expected a token without scopes to be rejected")
+	}
+
+	found, err := store.APITokenByHash(ctx, HashAPIToken(" "+secret+"\n"))
+	if err != nil {
+		t.Fatalf("APITokenByHash: %v", err)
+	}
+	if found.ID != created.ID || found.CreatedBy != "root" || len(found.Scopes) != 1 || found.Scopes[0] != ScopeUsersWrite {
+		t.Fatalf("unexpected token: %+v", found)
+	}
+	if !found.Allows(ScopeUsersRead) || !found.Allows(ScopeUsersWrite) || found.Allows(ScopeRulesRead) {
+		t.Fatalf("unexpected scopes for %+v", found)
+	}
+
+	tokens, err := store.ListAPITokens(ctx)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("ListAPITokens: %v %+v", err, tokens)
+	}
+	if err := store.DeleteAPIToken(ctx, created.ID); err != nil {
+		t.Fatalf("DeleteAPIToken: %v", err)
+	}
+	if _, err := store.APITokenByHash(ctx, hash); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected ErrAPITokenNotFound after revoking, got %v", err)
+	}
+	if err := store.DeleteAPIToken(ctx, created.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected ErrAPITokenNotFound for a second revoke, got %v", err)
+	}
+}
+
+func TestParseAPIScopes(t *testing.T) {
+	scopes, err := ParseAPIScopes([]string{"rules:write", " USERS:READ ", "", "rules:write"})
+	if err != nil {
+		t.Fatalf("ParseAPIScopes: %v", err)
+	}
+	if len(scopes) != 2 || scopes[0] != ScopeUsersRead || scopes[1] != ScopeRulesWrite {
+		t.Fatalf("unexpected scopes %v", scopes)
+	}
+	if _, err := ParseAPIScopes([]string{"admin"}); err == nil {
+		t.Fatal("expected an unknown scope to be rejected")
+	}
+}
@@ -0,0 +1,100 @@
+package userdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one administrative change. Before and After hold JSON
+// snapshots of the affected object, either of which is empty when the object
+// did not exist on that side of the change. Secrets such as password hashes
+// are never recorded.
+type AuditEntry struct {
+	ID     int64
+	Time   time.Time
+	Actor  string
+	Action string
+	Target string
+	Before string
+	After  string
+}
+
+// AuditFilter narrows ListAuditEntries. Empty fields match everything; Target
+// matches substrings. A Limit of zero returns every entry.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Limit  int
+	Offset int
+}
+
+// RecordAudit appends an entry to the audit log, stamping it with the current
+// time when entry.Time is zero.
+func (s *SQLStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	const query = `INSERT INTO audit_log (created_at, actor, action, target, before_value, after_value) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.ExecContext(ctx, s.dialect.rebind(query), entry.Time.UTC().Format(time.RFC3339Nano), entry.Actor, entry.Action, entry.Target, entry.Before, entry.After)
+	if err != nil {
+		return fmt.Errorf("userdb: record audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEntries returns audit entries matching filter, newest first.
+func (s *SQLStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	var where []string
+	var args []any
+	if filter.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Target != "" {
+		where = append(where, "target LIKE ?")
+		args = append(args, "%"+filter.Target+"%")
+	}
+	query := `SELECT id, created_at, actor, action, target, before_value, after_value FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.Limit, max(filter.Offset, 0))
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query audit log: %w", err)
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var created string
+		if err := rows.Scan(&entry.ID, &created, &entry.Actor, &entry.Action, &entry.Target, &entry.Before, &entry.After); err != nil {
+			return nil, fmt.Errorf("userdb: scan audit entry: %w", err)
+		}
+		if entry.Time, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, fmt.Errorf("userdb: audit entry %d has invalid time %q: %w", entry.ID, created, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate audit log: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,61 @@
+package userdb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSQLStoreAuditLog(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{Time: base, Actor: "root", Action: "user.create", Target: "alice@example.com", After: `{"username":"alice"}`},
+		{Time: base.Add(time.Minute), Actor: "desk", Action: "user.disable", Target: "alice@example.com", Before: `{"enabled":true}`, After: `{"enabled":false}`},
+		{Time: base.Add(2 * time.Minute), Actor: "root", Action: "user.delete", Target: "bob@example.com", Before: `{"username":"bob"}`},
+	}
+	for _, entry := range entries {
+		if err := store.RecordAudit(ctx, entry); err != nil {
+			t.Fatalf("RecordAudit: %v", err)
+		}
+	}
+
+	all, err := store.ListAuditEntries(ctx, AuditFilter{})
+	if err != nil {
+		t.Fatalf("ListAuditEntries: %v", err)
+	}
+	if len(all) != 3 || all[0].Action != "user.delete" || all[2].Action != "user.create" {
+		t.Fatalf("expected newest first, got %+v", all)
+	}
+	if !all[1].Time.Equal(base.Add(time.Minute)) || all[1].Before != `{"enabled":true}` || all[1].After != `{"enabled":false}` {
+		t.Fatalf("unexpected entry: %+v", all[1])
+	}
+
+	byActor, err := store.ListAuditEntries(ctx, AuditFilter{Actor: "root"})
+	if err != nil {
+		t.Fatalf("ListAuditEntries: %v", err)
+	}
+	if len(byActor) != 2 {
+		t.Fatalf("expected 2 entries by root, got %d", len(byActor))
+	}
+	byTarget, err := store.ListAuditEntries(ctx, AuditFilter{Target: "alice"})
+	if err != nil {
+		t.Fatalf("ListAuditEntries: %v", err)
+	}
+	if len(byTarget) != 2 {
+		t.Fatalf("expected 2 entries for alice, got %d", len(byTarget))
+	}
+	page, err := store.ListAuditEntries(ctx, AuditFilter{Limit: 1, Offset: 1})
+	if err != nil {
+		t.Fatalf("ListAuditEntries: %v", err)
+	}
+	if len(page) != 1 || page[0].Action != "user.disable" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+}
@@ -0,0 +1,210 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultCacheEntries bounds the number of lookups a CachedStore retains.
+const defaultCacheEntries = 10000
+
+// CachedStore wraps a Store with a read-through cache for Lookup and
+// UserSettings so that registration storms and call setup do not translate
+// into database queries per request. Both hits and ErrUserNotFound results are
+// cached for the configured TTL.
+// Writes made through the CachedStore invalidate the affected entry
+// immediately; writes made elsewhere become visible once the entry expires or
+// Purge is called.
+type CachedStore struct {
+	Store
+
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	// generation advances on every invalidation so that a lookup racing
+	// with a write does not repopulate the cache with the old row.
+	generation uint64
+}
+
+type cacheKey struct {
+	username string
+	domain   string
+	settings bool
+}
+
+type cacheEntry struct {
+	user     *User
+	settings UserSettings
+	expires  time.Time
+}
+
+var (
+	_ Store          = (*CachedStore)(nil)
+	_ ChangeNotifier = (*CachedStore)(nil)
+)
+
+// NewCachedStore wraps store with a lookup cache whose entries live for ttl.
+// A non-positive ttl returns store unchanged.
+func NewCachedStore(store Store, ttl time.Duration) Store {
+	if store == nil || ttl <= 0 {
+		return store
+	}
+	return &CachedStore{
+		Store:      store,
+		ttl:        ttl,
+		maxEntries: defaultCacheEntries,
+		now:        time.Now,
+		entries:    make(map[cacheKey]cacheEntry),
+	}
+}
+
+// Lookup serves the user from the cache when a fresh entry exists and
+// otherwise queries the wrapped store.
+func (c *CachedStore) Lookup(ctx context.Context, username, domain string) (*User, error) {
+	key := cacheKey{username: username, domain: domain}
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && entry.expires.After(now) {
+		if entry.user == nil {
+			return nil, ErrUserNotFound
+		}
+		clone := *entry.user
+		return &clone, nil
+	}
+
+	user, err := c.Store.Lookup(ctx, username, domain)
+	switch {
+	case err == nil:
+		clone := *user
+		c.put(key, generation, cacheEntry{user: &clone, expires: now.Add(c.ttl)})
+	case errors.Is(err, ErrUserNotFound):
+		c.put(key, generation, cacheEntry{expires: now.Add(c.ttl)})
+	}
+	return user, err
+}
+
+// UserSettings serves the user's settings from the cache when a fresh entry
+// exists and otherwise queries the wrapped store.
+func (c *CachedStore) UserSettings(ctx context.Context, username, domain string) (UserSettings, error) {
+	key := cacheKey{username: username, domain: domain, settings: true}
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && entry.expires.After(now) {
+		return entry.settings.clone(), nil
+	}
+
+	settings, err := c.Store.UserSettings(ctx, username, domain)
+	if err == nil {
+		c.put(key, generation, cacheEntry{settings: settings.clone(), expires: now.Add(c.ttl)})
+	}
+	return settings, err
+}
+
+// SetUserSetting stores the setting and evicts the stale entry.
+func (c *CachedStore) SetUserSetting(ctx context.Context, username, domain, name, value string) error {
+	err := c.Store.SetUserSetting(ctx, username, domain, name, value)
+	c.Invalidate(username, domain)
+	return err
+}
+
+// DeleteUserSetting removes the setting and evicts the stale entry.
+func (c *CachedStore) DeleteUserSetting(ctx context.Context, username, domain, name string) error {
+	err := c.Store.DeleteUserSetting(ctx, username, domain, name)
+	c.Invalidate(username, domain)
+	return err
+}
+
+// CreateUser inserts the user and drops any cached negative lookup.
+func (c *CachedStore) CreateUser(ctx context.Context, user User) error {
+	err := c.Store.CreateUser(ctx, user)
+	c.Invalidate(user.Username, user.Domain)
+	return err
+}
+
+// DeleteUser removes the user and its cache entry.
+func (c *CachedStore) DeleteUser(ctx context.Context, username, domain string) error {
+	err := c.Store.DeleteUser(ctx, username, domain)
+	c.Invalidate(username, domain)
+	return err
+}
+
+// UpdatePassword stores the new hash and evicts the stale entry.
+func (c *CachedStore) UpdatePassword(ctx context.Context, username, domain, passwordHash string) error {
+	err := c.Store.UpdatePassword(ctx, username, domain, passwordHash)
+	c.Invalidate(username, domain)
+	return err
+}
+
+// SetUserEnabled updates the account state and evicts the stale entry.
+func (c *CachedStore) SetUserEnabled(ctx context.Context, username, domain string, enabled bool) error {
+	err := c.Store.SetUserEnabled(ctx, username, domain, enabled)
+	c.Invalidate(username, domain)
+	return err
+}
+
+// UpdateUser stores the new account fields and evicts the stale entry.
+func (c *CachedStore) UpdateUser(ctx context.Context, user User) error {
+	err := c.Store.UpdateUser(ctx, user)
+	c.Invalidate(user.Username, user.Domain)
+	return err
+}
+
+// Subscribe forwards change notifications from the wrapped store. Stores that
+// cannot notify yield a channel that never fires.
+func (c *CachedStore) Subscribe() (<-chan struct{}, func()) {
+	if notifier, ok := c.Store.(ChangeNotifier); ok {
+		return notifier.Subscribe()
+	}
+	return nil, func() {}
+}
+
+// Invalidate evicts the cached lookup and settings for a single user.
+func (c *CachedStore) Invalidate(username, domain string) {
+	c.mu.Lock()
+	delete(c.entries, cacheKey{username: username, domain: domain})
+	delete(c.entries, cacheKey{username: username, domain: domain, settings: true})
+	c.generation++
+	c.mu.Unlock()
+}
+
+// Purge evicts every cached entry.
+func (c *CachedStore) Purge() {
+	c.mu.Lock()
+	c.entries = make(map[cacheKey]cacheEntry)
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *CachedStore) put(key cacheKey, generation uint64, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= c.maxEntries {
+		now := c.now()
+		for k, e := range c.entries {
+			if !e.expires.After(now) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full of live entries: start over rather than track recency.
+		if len(c.entries) >= c.maxEntries {
+			c.entries = make(map[cacheKey]cacheEntry)
+		}
+	}
+	c.entries[key] = entry
+}
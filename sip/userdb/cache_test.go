@@ -0,0 +1,164 @@
+package userdb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingStore struct {
+	Store
+	lookups        int
+	settingLookups int
+}
+
+func (c *countingStore) UserSettings(ctx context.Context, username, domain string) (UserSettings, error) {
+	c.settingLookups++
+	return c.Store.UserSettings(ctx, username, domain)
+}
+
+func (c *countingStore) Lookup(ctx context.Context, username, domain string) (*User, error) {
+	c.lookups++
+	return c.Store.Lookup(ctx, username, domain)
+}
+
+func newCachedTestStore(t *testing.T) (*CachedStore, *countingStore, *time.Time) {
+	t.Helper()
+	base, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	t.Cleanup(func() { base.Close() })
+	seedTestUsers(t, base.UnderlyingDB())
+	counter := &countingStore{Store: base}
+	cached := NewCachedStore(counter, time.Minute).(*CachedStore)
+	now := time.Unix(1_700_000_000, 0)
+	cached.now = func() time.Time { return now }
+	return cached, counter, &now
+}
+
+func TestCachedStoreServesRepeatedLookups(t *testing.T) {
+	cached, counter, now := newCachedTestStore(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		user, err := cached.Lookup(ctx, "alice", "example.com")
+		if err != nil {
+			t.Fatalf("Lookup returned error: %v", err)
+		}
+		if user.PasswordHash != "hashed-secret" {
+			t.Fatalf("unexpected password hash %q", user.PasswordHash)
+		}
+		user.PasswordHash = "mutated"
+	}
+	if counter.lookups != 1 {
+		t.Fatalf("expected a single backend lookup, got %d", counter.lookups)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	if _, err := cached.Lookup(ctx, "alice", "example.com"); err != nil {
+		t.Fatalf("Lookup after expiry returned error: %v", err)
+	}
+	if counter.lookups != 2 {
+		t.Fatalf("expected expired entry to be refreshed, got %d lookups", counter.lookups)
+	}
+}
+
+func TestCachedStoreInvalidatesOnWrites(t *testing.T) {
+	cached, counter, _ := newCachedTestStore(t)
+	ctx := context.Background()
+
+	if _, err := cached.Lookup(ctx, "carol", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := cached.Lookup(ctx, "carol", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected cached ErrUserNotFound, got %v", err)
+	}
+	if counter.lookups != 1 {
+		t.Fatalf("expected negative result to be cached, got %d lookups", counter.lookups)
+	}
+	if err := cached.CreateUser(ctx, User{Username: "carol", Domain: "example.com", PasswordHash: "h1"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	user, err := cached.Lookup(ctx, "carol", "example.com")
+	if err != nil {
+		t.Fatalf("expected newly created user to be visible, got %v", err)
+	}
+	if user.PasswordHash != "h1" {
+		t.Fatalf("unexpected password hash %q", user.PasswordHash)
+	}
+
+	if err := cached.UpdatePassword(ctx, "carol", "example.com", "h2"); err != nil {
+		t.Fatalf("UpdatePassword returned error: %v", err)
+	}
+	user, err = cached.Lookup(ctx, "carol", "example.com")
+	if err != nil || user.PasswordHash != "h2" {
+		t.Fatalf("expected updated hash after invalidation, got %v, %v", user, err)
+	}
+
+	if err := cached.DeleteUser(ctx, "carol", "example.com"); err != nil {
+		t.Fatalf("DeleteUser returned error: %v", err)
+	}
+	if _, err := cached.Lookup(ctx, "carol", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected deleted user to be gone, got %v", err)
+	}
+}
+
+func TestCachedStoreCachesUserSettings(t *testing.T) {
+	cached, counter, _ := newCachedTestStore(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		settings, err := cached.UserSettings(ctx, "alice", "example.com")
+		if err != nil {
+			t.Fatalf("UserSettings returned error: %v", err)
+		}
+		if settings.DoNotDisturb() {
+			t.Fatalf("unexpected settings %v", settings)
+		}
+	}
+	if counter.settingLookups != 1 {
+		t.Fatalf("expected a single backend settings query, got %d", counter.settingLookups)
+	}
+	if err := cached.SetUserSetting(ctx, "alice", "example.com", SettingDoNotDisturb, "1"); err != nil {
+		t.Fatalf("SetUserSetting returned error: %v", err)
+	}
+	settings, err := cached.UserSettings(ctx, "alice", "example.com")
+	if err != nil || !settings.DoNotDisturb() {
+		t.Fatalf("expected updated settings after invalidation, got %v, %v", settings, err)
+	}
+}
+
+func TestNewCachedStoreDisabledWithoutTTL(t *testing.T) {
+	base, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer base.Close()
+	if got := NewCachedStore(base, 0); got != Store(base) {
+		t.Fatalf("expected zero TTL to return the store unchanged")
+	}
+}
+
+func TestPingBypassesCacheAndFallsBackToLookup(t *testing.T) {
+	cached, counter, _ := newCachedTestStore(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := Ping(ctx, cached); err != nil {
+			t.Fatalf("Ping returned error: %v", err)
+		}
+	}
+	if counter.lookups != 2 {
+		t.Fatalf("expected every ping to reach the store without Ping, got %d lookups", counter.lookups)
+	}
+
+	base := counter.Store.(*SQLStore)
+	if err := base.Ping(ctx); err != nil {
+		t.Fatalf("SQLStore.Ping returned error: %v", err)
+	}
+	base.Close()
+	if err := base.Ping(ctx); err == nil {
+		t.Fatalf("expected Ping to fail after Close")
+	}
+}
@@ -0,0 +1,175 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCallerIDRuleNotFound is returned when a caller-ID rule does not exist.
+var ErrCallerIDRuleNotFound = errors.New("userdb: caller-id rule not found")
+
+// CallerIDRule rewrites the identity of outbound calls, those leaving through
+// a trunk, so that providers receive the numbers they require. Of the rules
+// matching a call the most specific caller wins, then a rule naming the
+// trunk over one for every trunk, then the lowest ID.
+type CallerIDRule struct {
+	ID int64
+	// Caller is the calling user as user@domain, a domain for all of its
+	// users, or empty for every caller, matched against the From header.
+	Caller string
+	// Trunk is the configured trunk account as user@domain, or empty for
+	// every trunk.
+	Trunk string
+	// DisplayName, User, and Host replace the From header's display name,
+	// URI user part, and URI host; empty keeps them.
+	DisplayName string
+	User        string
+	Host        string
+	// PreferredIdentity adds a P-Preferred-Identity header carrying the
+	// rewritten From address.
+	PreferredIdentity bool
+	Description       string
+}
+
+// ValidateCallerIDRule checks a rule before it is stored.
+func ValidateCallerIDRule(rule CallerIDRule) error {
+	if strings.ContainsAny(rule.Caller, " \t<>\";:/") || strings.HasPrefix(rule.Caller, "@") || strings.HasSuffix(rule.Caller, "@") {
+		return fmt.Errorf("userdb: caller-id rule caller %q must be user@domain, a domain, or empty", rule.Caller)
+	}
+	if rule.Trunk != "" {
+		user, domain, ok := strings.Cut(rule.Trunk, "@")
+		if !ok || user == "" || domain == "" {
+			return fmt.Errorf("userdb: caller-id rule trunk %q must be user@domain", rule.Trunk)
+		}
+	}
+	if strings.ContainsAny(rule.DisplayName, "\"\\\r\n") {
+		return fmt.Errorf("userdb: caller-id rule display name %q may not contain quotes, backslashes, or line breaks", rule.DisplayName)
+	}
+	if strings.ContainsAny(rule.User, " \t\r\n<>\"@:;?") {
+		return fmt.Errorf("userdb: caller-id rule user %q is not a URI user part", rule.User)
+	}
+	if strings.ContainsAny(rule.Host, " \t\r\n<>\"@:;?/") {
+		return fmt.Errorf("userdb: caller-id rule host %q is not a host", rule.Host)
+	}
+	if rule.DisplayName == "" && rule.User == "" && rule.Host == "" && !rule.PreferredIdentity {
+		return fmt.Errorf("userdb: caller-id rule changes nothing")
+	}
+	return nil
+}
+
+func normalizeCallerIDRule(rule CallerIDRule) CallerIDRule {
+	rule.Caller = strings.ToLower(strings.TrimSpace(rule.Caller))
+	rule.Trunk = strings.TrimSpace(rule.Trunk)
+	rule.DisplayName = strings.TrimSpace(rule.DisplayName)
+	rule.User = strings.TrimSpace(rule.User)
+	rule.Host = strings.TrimSpace(rule.Host)
+	rule.Description = strings.TrimSpace(rule.Description)
+	return rule
+}
+
+// ListCallerIDRules returns every caller-ID rule ordered by ID.
+func (s *SQLStore) ListCallerIDRules(ctx context.Context) ([]CallerIDRule, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT id, caller, trunk, display_name, from_user, from_host, preferred_identity, description FROM caller_id_rules ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query caller-id rules: %w", err)
+	}
+	defer rows.Close()
+	var rules []CallerIDRule
+	for rows.Next() {
+		var rule CallerIDRule
+		var preferred int
+		var description sql.NullString
+		if err := rows.Scan(&rule.ID, &rule.Caller, &rule.Trunk, &rule.DisplayName, &rule.User, &rule.Host, &preferred, &description); err != nil {
+			return nil, fmt.Errorf("userdb: scan caller-id rule: %w", err)
+		}
+		rule.PreferredIdentity = preferred != 0
+		rule.Description = description.String
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate caller-id rules: %w", err)
+	}
+	return rules, nil
+}
+
+// CreateCallerIDRule stores a new rule and returns it with its assigned ID.
+func (s *SQLStore) CreateCallerIDRule(ctx context.Context, rule CallerIDRule) (*CallerIDRule, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	rule = normalizeCallerIDRule(rule)
+	if err := ValidateCallerIDRule(rule); err != nil {
+		return nil, err
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		const insert = `INSERT INTO caller_id_rules (caller, trunk, display_name, from_user, from_host, preferred_identity, description) VALUES (?, ?, ?, ?, ?, ?, ?)`
+		id, err := s.insertReturningID(ctx, tx, insert, rule.Caller, rule.Trunk, rule.DisplayName, rule.User, rule.Host, boolToInt(rule.PreferredIdentity), rule.Description)
+		if err != nil {
+			return fmt.Errorf("userdb: create caller-id rule: %w", err)
+		}
+		rule.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.changes.notify()
+	return &rule, nil
+}
+
+// UpdateCallerIDRule replaces every field of the rule with rule.ID.
+func (s *SQLStore) UpdateCallerIDRule(ctx context.Context, rule CallerIDRule) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if rule.ID <= 0 {
+		return fmt.Errorf("userdb: caller-id rule id is required")
+	}
+	rule = normalizeCallerIDRule(rule)
+	if err := ValidateCallerIDRule(rule); err != nil {
+		return err
+	}
+	const update = `UPDATE caller_id_rules SET caller = ?, trunk = ?, display_name = ?, from_user = ?, from_host = ?, preferred_identity = ?, description = ? WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(update), rule.Caller, rule.Trunk, rule.DisplayName, rule.User, rule.Host, boolToInt(rule.PreferredIdentity), rule.Description, rule.ID)
+	if err != nil {
+		return fmt.Errorf("userdb: update caller-id rule: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update caller-id rule rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrCallerIDRuleNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteCallerIDRule removes a rule, returning ErrCallerIDRuleNotFound when
+// absent.
+func (s *SQLStore) DeleteCallerIDRule(ctx context.Context, id int64) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM caller_id_rules WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), id)
+	if err != nil {
+		return fmt.Errorf("userdb: delete caller-id rule: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: delete caller-id rule rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrCallerIDRuleNotFound
+	}
+	s.changes.notify()
+	return nil
+}
@@ -0,0 +1,65 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSQLStoreCallerIDRules(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	changes, cancel := store.Subscribe()
+	defer cancel()
+
+	rule, err := store.CreateCallerIDRule(ctx, CallerIDRule{Caller: " Example.COM ", Trunk: "main@provider.example", User: " 0312345678 ", PreferredIdentity: true, Description: "main number"})
+	if err != nil {
+		t.Fatalf("CreateCallerIDRule: %v", err)
+	}
+	if rule.ID == 0 || rule.Caller != "example.com" || rule.User != "0312345678" || !rule.PreferredIdentity {
+		t.Fatalf("unexpected created rule: %+v", rule)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected creating a caller-id rule to notify subscribers")
+	}
+	for _, bad := range []CallerIDRule{
+		{Caller: "example.com"},
+		{Trunk: "provider.example", User: "0312345678"},
+		{Caller: "alice@", User: "0312345678"},
+		{DisplayName: `"Reception"`},
+		{User: "03@12"},
+		{Host: "provider.example;lr"},
+	} {
+		if _, err := store.CreateCallerIDRule(ctx, bad); err == nil {
+			t.Fatalf("expected rule %+v to be rejected", bad)
+		}
+	}
+
+	rule.DisplayName = "Example Inc."
+	rule.PreferredIdentity = false
+	if err := store.UpdateCallerIDRule(ctx, *rule); err != nil {
+		t.Fatalf("UpdateCallerIDRule: %v", err)
+	}
+	if err := store.UpdateCallerIDRule(ctx, CallerIDRule{ID: 999, User: "1"}); !errors.Is(err, ErrCallerIDRuleNotFound) {
+		t.Fatalf("expected ErrCallerIDRuleNotFound, got %v", err)
+	}
+	rules, err := store.ListCallerIDRules(ctx)
+	if err != nil {
+		t.Fatalf("ListCallerIDRules: %v", err)
+	}
+	if len(rules) != 1 || rules[0] != *rule {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+	if err := store.DeleteCallerIDRule(ctx, rule.ID); err != nil {
+		t.Fatalf("DeleteCallerIDRule: %v", err)
+	}
+	if err := store.DeleteCallerIDRule(ctx, rule.ID); !errors.Is(err, ErrCallerIDRuleNotFound) {
+		t.Fatalf("expected ErrCallerIDRuleNotFound, got %v", err)
+	}
+}
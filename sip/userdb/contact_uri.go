@@ -0,0 +1,112 @@
+package userdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidContactURI is wrapped by ParseContactURI for URIs the proxy could
+// not route to, such as a missing sip: scheme or host.
+var ErrInvalidContactURI = errors.New("userdb: invalid contact URI")
+
+// ContactURI is the routing-relevant part of a sip: or sips: URI. Parameters
+// and headers are validated for stray characters but otherwise ignored.
+type ContactURI struct {
+	Secure bool
+	User   string
+	Host   string
+	Port   int
+}
+
+// AddressOfRecord returns "user@host" lower-cased, or "" when the URI has no
+// user part.
+func (c ContactURI) AddressOfRecord() string {
+	if c.User == "" {
+		return ""
+	}
+	return strings.ToLower(c.User + "@" + c.Host)
+}
+
+// ParseContactURI checks that raw is a bare sip: or sips: URI with a host and
+// an optional user part and port, as broadcast targets and contact URIs must
+// be. Display names and angle brackets are rejected; the value is used as a
+// Request-URI as is.
+func ParseContactURI(raw string) (ContactURI, error) {
+	var uri ContactURI
+	if strings.ContainsAny(raw, " \t\r\n<>\"") {
+		return uri, fmt.Errorf("%w %q: contains whitespace, quotes, or angle brackets", ErrInvalidContactURI, raw)
+	}
+	rest := raw
+	lower := strings.ToLower(raw)
+	switch {
+	case strings.HasPrefix(lower, "sip:"):
+		rest = raw[len("sip:"):]
+	case strings.HasPrefix(lower, "sips:"):
+		uri.Secure = true
+		rest = raw[len("sips:"):]
+	default:
+		return uri, fmt.Errorf("%w %q: scheme must be sip: or sips:", ErrInvalidContactURI, raw)
+	}
+	if idx := strings.IndexAny(rest, ";?"); idx != -1 {
+		rest = rest[:idx]
+	}
+	hostPort := rest
+	if at := strings.LastIndex(rest, "@"); at != -1 {
+		uri.User = rest[:at]
+		hostPort = rest[at+1:]
+		if uri.User == "" {
+			return uri, fmt.Errorf("%w %q: empty user part", ErrInvalidContactURI, raw)
+		}
+	}
+	host, port := hostPort, ""
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.Index(hostPort, "]")
+		if end == -1 {
+			return uri, fmt.Errorf("%w %q: unterminated IPv6 reference", ErrInvalidContactURI, raw)
+		}
+		host = hostPort[:end+1]
+		port = strings.TrimPrefix(hostPort[end+1:], ":")
+		if port == "" && len(hostPort) > end+1 {
+			return uri, fmt.Errorf("%w %q: empty port", ErrInvalidContactURI, raw)
+		}
+	} else if idx := strings.LastIndex(hostPort, ":"); idx != -1 {
+		host, port = hostPort[:idx], hostPort[idx+1:]
+		if port == "" {
+			return uri, fmt.Errorf("%w %q: empty port", ErrInvalidContactURI, raw)
+		}
+	}
+	if !validURIHost(host) {
+		return uri, fmt.Errorf("%w %q: invalid host %q", ErrInvalidContactURI, raw, host)
+	}
+	uri.Host = host
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return uri, fmt.Errorf("%w %q: invalid port %q", ErrInvalidContactURI, raw, port)
+		}
+		uri.Port = n
+	}
+	return uri, nil
+}
+
+// validURIHost accepts host names, IPv4 addresses, and bracketed IPv6
+// references.
+func validURIHost(host string) bool {
+	if strings.HasPrefix(host, "[") {
+		inner := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		return inner != "" && strings.Trim(inner, "0123456789abcdefABCDEF:.") == ""
+	}
+	if host == "" || strings.HasPrefix(host, ".") || strings.HasPrefix(host, "-") || strings.Contains(host, "..") {
+		return false
+	}
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
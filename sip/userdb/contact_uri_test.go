@@ -0,0 +1,81 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseContactURI(t *testing.T) {
+	valid := map[string]ContactURI{
+		"sip:alice@example.com":                   {User: "alice", Host: "example.com"},
+		"SIPS:Bob@Example.com:5061;transport=tls": {Secure: true, User: "Bob", Host: "Example.com", Port: 5061},
+		"sip:192.0.2.10:5070":                     {Host: "192.0.2.10", Port: 5070},
+		"sip:carol@[2001:db8::1]:5060":            {User: "carol", Host: "[2001:db8::1]", Port: 5060},
+		"sip:dave@example.com?subject=hi":         {User: "dave", Host: "example.com"},
+	}
+	for raw, want := range valid {
+		got, err := ParseContactURI(raw)
+		if err != nil {
+			t.Fatalf("ParseContactURI(%q) returned error: %v", raw, err)
+		}
+		if got != want {
+			t.Fatalf("ParseContactURI(%q) = %+v, want %+v", raw, got, want)
+		}
+	}
+	if aor := valid["SIPS:Bob@Example.com:5061;transport=tls"].AddressOfRecord(); aor != "bob@example.com" {
+		t.Fatalf("unexpected address of record %q", aor)
+	}
+
+	for _, raw := range []string{
+		"alice@example.com",
+		"tel:+81312345678",
+		"sip:",
+		"sip:@example.com",
+		"sip:alice@",
+		"sip:alice@example.com:",
+		"sip:alice@example.com:99999",
+		"sip:alice@exa mple.com",
+		"<sip:alice@example.com>",
+		"sip:alice@example..com",
+		"sip:alice@[2001:db8::1",
+	} {
+		if _, err := ParseContactURI(raw); !errors.Is(err, ErrInvalidContactURI) {
+			t.Fatalf("ParseContactURI(%q) = %v, want ErrInvalidContactURI", raw, err)
+		}
+	}
+}
+
+func TestReplaceBroadcastTargetsRejectsInvalidURIs(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	if _, err := store.CreateBroadcastRule(ctx, BroadcastRule{
+		Address: "sip:1000@example.com",
+		Targets: []BroadcastTarget{{ContactURI: "alice@example.com"}},
+	}); !errors.Is(err, ErrInvalidContactURI) {
+		t.Fatalf("expected invalid target to be rejected on create, got %v", err)
+	}
+	rule, err := store.CreateBroadcastRule(ctx, BroadcastRule{
+		Address: "sip:1000@example.com",
+		Targets: []BroadcastTarget{{ContactURI: "sip:alice@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateBroadcastRule: %v", err)
+	}
+	err = store.ReplaceBroadcastTargets(ctx, rule.ID, []BroadcastTarget{{ContactURI: "sip:bob@example.com"}, {ContactURI: "sip:carol@"}})
+	if !errors.Is(err, ErrInvalidContactURI) {
+		t.Fatalf("expected invalid target to be rejected on replace, got %v", err)
+	}
+	targets, err := store.LookupBroadcastTargets(ctx, "sip:1000@example.com")
+	if err != nil {
+		t.Fatalf("LookupBroadcastTargets: %v", err)
+	}
+	if len(targets) != 1 || targets[0].ContactURI != "sip:alice@example.com" {
+		t.Fatalf("expected original targets to remain, got %+v", targets)
+	}
+}
@@ -0,0 +1,220 @@
+package userdb
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// csvExportHeader lists the columns written by ExportUsers. ImportUsers
+// accepts the same layout, so an export can be re-imported unchanged.
+var csvExportHeader = []string{"username", "domain", "password_hash", "contact_uri", "enabled"}
+
+// ImportResult summarises a bulk import.
+type ImportResult struct {
+	// Created counts users that did not exist before the import.
+	Created int
+	// Updated counts rows that matched an existing user.
+	Updated int
+}
+
+type csvUserRow struct {
+	line       int
+	user       User
+	hasEnabled bool
+}
+
+// ImportUsers provisions users from CSV. The first record is a header naming
+// the columns; username and domain are required, and password (plaintext),
+// password_hash (an HA1 digest), contact_uri, and enabled are optional. Column
+// names are case-insensitive and their order is free.
+//
+// Every row is validated before the store is touched, so a malformed file
+// changes nothing. Rows for users that already exist update the password when
+// one is given and the enabled state when the column is present; their contact
+// URI is left unchanged. A store error stops the import, and the result
+// reports the rows applied before it.
+func ImportUsers(ctx context.Context, store Store, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	if store == nil {
+		return result, fmt.Errorf("userdb: store is not initialised")
+	}
+	rows, err := parseUserCSV(r)
+	if err != nil {
+		return result, err
+	}
+	for _, row := range rows {
+		created, err := importUser(ctx, store, row)
+		if err != nil {
+			return result, fmt.Errorf("userdb: import line %d: %w", row.line, err)
+		}
+		if created {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+	}
+	return result, nil
+}
+
+func importUser(ctx context.Context, store Store, row csvUserRow) (bool, error) {
+	user := row.user
+	_, err := store.Lookup(ctx, user.Username, user.Domain)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return true, store.CreateUser(ctx, user)
+	case err != nil:
+		return false, err
+	}
+	if user.PasswordHash != "" {
+		if err := store.UpdatePassword(ctx, user.Username, user.Domain, user.PasswordHash); err != nil {
+			return false, err
+		}
+	}
+	if row.hasEnabled {
+		if err := store.SetUserEnabled(ctx, user.Username, user.Domain, !user.Disabled); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+func parseUserCSV(r io.Reader) ([]csvUserRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("userdb: import: missing header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("userdb: import: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch name {
+		case "username", "domain", "password", "password_hash", "contact_uri", "enabled":
+		default:
+			return nil, fmt.Errorf("userdb: import: unknown column %q", name)
+		}
+		if _, dup := columns[name]; dup {
+			return nil, fmt.Errorf("userdb: import: duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"username", "domain"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("userdb: import: missing %s column", required)
+		}
+	}
+	_, hasEnabled := columns["enabled"]
+
+	var rows []csvUserRow
+	seen := make(map[cacheKey]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("userdb: import: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		row := csvUserRow{line: line, hasEnabled: hasEnabled}
+		row.user.Username = field("username")
+		row.user.Domain = field("domain")
+		row.user.ContactURI = field("contact_uri")
+		if row.user.Username == "" || row.user.Domain == "" {
+			return nil, fmt.Errorf("userdb: import line %d: username and domain are required", line)
+		}
+		key := cacheKey{username: row.user.Username, domain: row.user.Domain}
+		if first, dup := seen[key]; dup {
+			return nil, fmt.Errorf("userdb: import line %d: %s@%s already appears on line %d", line, row.user.Username, row.user.Domain, first)
+		}
+		seen[key] = line
+
+		password, hash := field("password"), field("password_hash")
+		switch {
+		case password != "" && hash != "":
+			return nil, fmt.Errorf("userdb: import line %d: give either password or password_hash, not both", line)
+		case password != "":
+			row.user.PasswordHash = HashPassword(row.user.Username, row.user.Domain, password)
+		case hash != "":
+			if len(hash) != 32 || !isHex(hash) {
+				return nil, fmt.Errorf("userdb: import line %d: password_hash must be a 32 digit hex HA1 digest", line)
+			}
+			row.user.PasswordHash = strings.ToLower(hash)
+		}
+		if hasEnabled {
+			enabled, err := parseCSVBool(field("enabled"))
+			if err != nil {
+				return nil, fmt.Errorf("userdb: import line %d: %w", line, err)
+			}
+			row.user.Disabled = !enabled
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseCSVBool interprets the enabled column. An empty cell means enabled.
+func parseCSVBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "1", "true", "t", "yes", "y", "on":
+		return true, nil
+	case "0", "false", "f", "no", "n", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid enabled value %q", value)
+}
+
+// ExportUsers writes every user as CSV in the layout accepted by ImportUsers,
+// sorted by domain and username. Passwords are exported as HA1 digests, with
+// legacy plaintext values hashed on the way out.
+func ExportUsers(ctx context.Context, store Store, w io.Writer) error {
+	if store == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	users, err := store.AllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Domain == users[j].Domain {
+			return users[i].Username < users[j].Username
+		}
+		return users[i].Domain < users[j].Domain
+	})
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvExportHeader); err != nil {
+		return fmt.Errorf("userdb: export users: %w", err)
+	}
+	for _, user := range users {
+		hash := ComputeHA1(user.Username, user.Domain, user.PasswordHash)
+		record := []string{user.Username, user.Domain, hash, user.ContactURI, "1"}
+		if user.Disabled {
+			record[4] = "0"
+		}
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("userdb: export users: %w", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("userdb: export users: %w", err)
+	}
+	return nil
+}
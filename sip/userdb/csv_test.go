@@ -0,0 +1,121 @@
+package userdb
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestImportUsersCreatesAndUpdates(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	input := "Username,Domain,Password,Contact_URI,Enabled\n" +
+		"carol,example.com,s3cret,sip:carol@192.0.2.30,1\n" +
+		"dave,example.com,,,no\n" +
+		"alice,example.com,newpass,,0\n"
+	result, err := ImportUsers(ctx, store, strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ImportUsers returned error: %v", err)
+	}
+	if result.Created != 2 || result.Updated != 1 {
+		t.Fatalf("unexpected import result %+v", result)
+	}
+
+	carol, err := store.Lookup(ctx, "carol", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup carol: %v", err)
+	}
+	if carol.PasswordHash != HashPassword("carol", "example.com", "s3cret") || carol.ContactURI != "sip:carol@192.0.2.30" || carol.Disabled {
+		t.Fatalf("unexpected imported user %#v", carol)
+	}
+	if dave, _ := store.Lookup(ctx, "dave", "example.com"); dave == nil || !dave.Disabled {
+		t.Fatalf("expected dave to be imported disabled, got %#v", dave)
+	}
+	alice, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup alice: %v", err)
+	}
+	if alice.PasswordHash != HashPassword("alice", "example.com", "newpass") || !alice.Disabled {
+		t.Fatalf("expected existing user to be updated, got %#v", alice)
+	}
+	if alice.ContactURI != "sip:alice@192.0.2.10" {
+		t.Fatalf("expected existing contact to be kept, got %q", alice.ContactURI)
+	}
+}
+
+func TestImportUsersRejectsInvalidFileWithoutChanges(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	cases := map[string]string{
+		"unknown column": "username,domain,role\nerin,example.com,admin\n",
+		"missing domain": "username,password\nerin,pw\n",
+		"bad hash":       "username,domain,password_hash\nerin,example.com,nothex\nfrank,example.com,\n",
+		"duplicate row":  "username,domain\nerin,example.com\nerin,example.com\n",
+		"bad enabled":    "username,domain,enabled\nerin,example.com,maybe\n",
+	}
+	for name, input := range cases {
+		if _, err := ImportUsers(ctx, store, strings.NewReader(input)); err == nil {
+			t.Fatalf("%s: expected import to fail", name)
+		}
+	}
+	users, err := store.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers returned error: %v", err)
+	}
+	if len(users) != 0 {
+		t.Fatalf("expected rejected imports to leave the store empty, got %v", users)
+	}
+}
+
+func TestExportUsersRoundTrip(t *testing.T) {
+	source, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer source.Close()
+	seedTestUsers(t, source.UnderlyingDB())
+
+	ctx := context.Background()
+	if err := source.SetUserEnabled(ctx, "bob", "example.com", false); err != nil {
+		t.Fatalf("SetUserEnabled returned error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := ExportUsers(ctx, source, &buf); err != nil {
+		t.Fatalf("ExportUsers returned error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[0] != "username,domain,password_hash,contact_uri,enabled" {
+		t.Fatalf("unexpected export:\n%s", buf.String())
+	}
+	if !strings.HasPrefix(lines[1], "alice,example.com,") || !strings.HasSuffix(lines[2], ",0") {
+		t.Fatalf("unexpected export rows:\n%s", buf.String())
+	}
+
+	target, err := OpenSQLite("file:" + t.Name() + "-target?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("failed to construct target store: %v", err)
+	}
+	defer target.Close()
+	if _, err := ImportUsers(ctx, target, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("re-importing the export failed: %v", err)
+	}
+	bob, err := target.Lookup(ctx, "bob", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup bob: %v", err)
+	}
+	if !bob.Disabled || bob.PasswordHash != ComputeHA1("bob", "example.com", "hashed-secret-2") || bob.ContactURI != "sip:bob@192.0.2.20" {
+		t.Fatalf("unexpected round-tripped user %#v", bob)
+	}
+}
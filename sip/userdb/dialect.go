@@ -0,0 +1,183 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect identifies the SQL flavour spoken by a SQLStore backend.
+type Dialect int
+
+const (
+	// DialectSQLite targets SQLite (and the in-memory test driver).
+	DialectSQLite Dialect = iota
+	// DialectPostgres targets PostgreSQL, which uses $N placeholders.
+	DialectPostgres
+	// DialectMySQL targets MySQL and MariaDB.
+	DialectMySQL
+)
+
+// String returns the canonical backend name for the dialect.
+func (d Dialect) String() string {
+	switch d {
+	case DialectPostgres:
+		return "postgres"
+	case DialectMySQL:
+		return "mysql"
+	default:
+		return "sqlite"
+	}
+}
+
+// ParseDialect maps a backend name such as "sqlite", "postgres", or "mysql"
+// to its Dialect.
+func ParseDialect(name string) (Dialect, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "sqlite", "sqlite3":
+		return DialectSQLite, nil
+	case "postgres", "postgresql", "pgx":
+		return DialectPostgres, nil
+	case "mysql", "mariadb":
+		return DialectMySQL, nil
+	default:
+		return DialectSQLite, fmt.Errorf("userdb: unsupported database backend %q", name)
+	}
+}
+
+// driverNames lists the database/sql driver names commonly registered for the
+// dialect, in order of preference.
+func (d Dialect) driverNames() []string {
+	switch d {
+	case DialectPostgres:
+		return []string{"postgres", "pgx"}
+	case DialectMySQL:
+		return []string{"mysql"}
+	default:
+		return []string{"sqlite", "sqlite3"}
+	}
+}
+
+// rebind rewrites ? placeholders into the dialect's native syntax. Quoted
+// literals are left untouched.
+func (d Dialect) rebind(query string) string {
+	if d != DialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// OpenPostgres opens a PostgreSQL backed store. Multiple proxies may share the
+// same database because all state lives on the server.
+func OpenPostgres(dsn string) (*SQLStore, error) {
+	return openNetworkStore(DialectPostgres, dsn)
+}
+
+// OpenMySQL opens a MySQL backed store.
+func OpenMySQL(dsn string) (*SQLStore, error) {
+	return openNetworkStore(DialectMySQL, dsn)
+}
+
+// NewSQLStore wraps an existing database handle speaking the given dialect.
+// Unlike NewSQLiteStore the connection pool is left to the caller because
+// server databases handle concurrent connections natively.
+func NewSQLStore(db *sql.DB, dialect Dialect) (*SQLStore, error) {
+	if dialect == DialectSQLite {
+		return NewSQLiteStore(db)
+	}
+	if db == nil {
+		return nil, fmt.Errorf("userdb: db handle is nil")
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("userdb: ping %s: %w", dialect, err)
+	}
+	store := &SQLStore{db: db, dialect: dialect}
+	if err := store.Migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func openNetworkStore(dialect Dialect, dsn string) (*SQLStore, error) {
+	if strings.TrimSpace(dsn) == "" {
+		return nil, fmt.Errorf("userdb: %s dsn is required", dialect)
+	}
+	driverName := registeredDriver(dialect)
+	if driverName == "" {
+		return nil, errNoDriver(dialect)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("userdb: open %s: %w", dialect, err)
+	}
+	store, err := NewSQLStore(db, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// errNoDriver reports that the binary links no driver for dialect. The
+// binaries in this module link none, to stay free of dependencies.
+func errNoDriver(dialect Dialect) error {
+	return fmt.Errorf("userdb: no %s driver registered; import one in the binary", dialect)
+}
+
+func registeredDriver(dialect Dialect) string {
+	available := make(map[string]struct{})
+	for _, name := range sql.Drivers() {
+		available[name] = struct{}{}
+	}
+	for _, name := range dialect.driverNames() {
+		if _, ok := available[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// isUniqueViolation reports whether err is a primary key or unique constraint
+// failure. Drivers are not imported directly, so their messages are matched:
+// SQLite (and the embedded driver) report "UNIQUE constraint failed",
+// PostgreSQL "duplicate key value violates unique constraint", and MySQL
+// "Duplicate entry".
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unique constraint") || strings.Contains(msg, "duplicate entry")
+}
+
+// likeOperator returns the case-insensitive pattern match operator. SQLite's
+// LIKE and MySQL's default collations already ignore case; PostgreSQL needs
+// ILIKE.
+func (d Dialect) likeOperator() string {
+	if d == DialectPostgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
@@ -0,0 +1,239 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDialectRebindPostgres(t *testing.T) {
+	query := `UPDATE users SET password_hash = ? WHERE username = ? AND domain = '?'`
+	got := DialectPostgres.rebind(query)
+	want := `UPDATE users SET password_hash = $1 WHERE username = $2 AND domain = '?'`
+	if got != want {
+		t.Fatalf("unexpected rebind result:\n got %s\nwant %s", got, want)
+	}
+	if DialectMySQL.rebind(query) != query {
+		t.Fatalf("mysql placeholders should be left untouched")
+	}
+}
+
+func TestParseDialect(t *testing.T) {
+	cases := map[string]Dialect{
+		"":           DialectSQLite,
+		"sqlite":     DialectSQLite,
+		"PostgreSQL": DialectPostgres,
+		"mysql":      DialectMySQL,
+	}
+	for name, want := range cases {
+		got, err := ParseDialect(name)
+		if err != nil {
+			t.Fatalf("ParseDialect(%q) returned error: %v", name, err)
+		}
+		if got != want {
+			t.Fatalf("ParseDialect(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if _, err := ParseDialect("oracle"); err == nil {
+		t.Fatalf("expected error for unsupported backend")
+	}
+}
+
+func TestOpenMySQLRequiresDriver(t *testing.T) {
+	if _, err := OpenMySQL("sip@tcp(localhost)/sip"); err == nil {
+		t.Fatalf("expected error when no mysql driver is registered")
+	}
+	if err := CheckBackend("mysql"); err == nil {
+		t.Fatalf("expected the mysql backend to be refused without a driver")
+	}
+}
+
+// postgresTestDriver stands in for a PostgreSQL driver. It refuses what a
+// real server would: ? placeholders, $N placeholders that are out of order or
+// do not match the arguments, and LastInsertId. The statements it accepts are
+// translated back and run on the embedded SQLite engine.
+type postgresTestDriver struct {
+	engine  *memoryDriver
+	mu      sync.Mutex
+	queries []string
+}
+
+func (d *postgresTestDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.engine.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTestConn{memoryConn: conn.(*memoryConn), driver: d}, nil
+}
+
+// translate checks query as PostgreSQL would and rewrites it for the SQLite
+// engine.
+func (d *postgresTestDriver) translate(query string, args int) (string, error) {
+	d.mu.Lock()
+	d.queries = append(d.queries, query)
+	d.mu.Unlock()
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			return "", fmt.Errorf("syntax error at or near \"?\" in %q", query)
+		case c == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			n++
+			if query[i+1:j] != strconv.Itoa(n) {
+				return "", fmt.Errorf("expected $%d at %q in %q", n, query[i:j], query)
+			}
+			b.WriteByte('?')
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	if n != args {
+		return "", fmt.Errorf("%d placeholders for %d arguments in %q", n, args, query)
+	}
+	translated := strings.ReplaceAll(b.String(), "BIGSERIAL PRIMARY KEY", "INTEGER PRIMARY KEY AUTOINCREMENT")
+	return strings.ReplaceAll(translated, " ILIKE ", " LIKE "), nil
+}
+
+type postgresTestConn struct {
+	*memoryConn
+	driver *postgresTestDriver
+}
+
+func (c *postgresTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepared statements are not used by SQLStore")
+}
+
+func (c *postgresTestConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query, err := c.driver.translate(query, len(args))
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.memoryConn.ExecContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return postgresTestResult{res}, nil
+}
+
+func (c *postgresTestConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	query, err := c.driver.translate(query, len(args))
+	if err != nil {
+		return nil, err
+	}
+	return c.memoryConn.QueryContext(ctx, query, args)
+}
+
+// postgresTestResult has no LastInsertId, like the PostgreSQL drivers.
+type postgresTestResult struct {
+	driver.Result
+}
+
+func (postgresTestResult) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported by this driver")
+}
+
+var registerPostgresTestDriver = sync.OnceValue(func() *postgresTestDriver {
+	d := &postgresTestDriver{engine: &memoryDriver{databases: make(map[string]*memoryDatabase)}}
+	sql.Register("pgx", d)
+	return d
+})
+
+func TestSQLStoreSpeaksPostgres(t *testing.T) {
+	pg := registerPostgresTestDriver()
+	if err := CheckBackend("postgres"); err != nil {
+		t.Fatalf("expected the registered driver to be accepted, got %v", err)
+	}
+	store, err := OpenPostgres("file:" + t.Name() + "?mode=memory")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	if store.dialect != DialectPostgres {
+		t.Fatalf("expected the PostgreSQL dialect, got %v", store.dialect)
+	}
+	ctx := context.Background()
+
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com", PasswordHash: "hash", ContactURI: "sip:alice@192.0.2.1"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected a duplicate user to be refused, got %v", err)
+	}
+	if err := store.UpdatePassword(ctx, "alice", "example.com", "new-hash"); err != nil {
+		t.Fatalf("update password: %v", err)
+	}
+	if err := store.SetUserEnabled(ctx, "alice", "example.com", false); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil || user.PasswordHash != "new-hash" || !user.Disabled {
+		t.Fatalf("expected the updated user, got %+v, %v", user, err)
+	}
+	page, err := store.QueryUsers(ctx, UserQuery{Search: "ALICE", Limit: 10})
+	if err != nil || page.Total != 1 || len(page.Users) != 1 {
+		t.Fatalf("expected the search to find alice, got %+v, %v", page, err)
+	}
+
+	// A setting is replaced by deleting and inserting it in one transaction.
+	for _, value := range []string{"first", "second"} {
+		if err := store.SetUserSetting(ctx, "alice", "example.com", "forward", value); err != nil {
+			t.Fatalf("set setting: %v", err)
+		}
+	}
+	if settings, err := store.UserSettings(ctx, "alice", "example.com"); err != nil || len(settings) != 1 || settings["forward"] != "second" {
+		t.Fatalf("expected the setting to be replaced, got %v, %v", settings, err)
+	}
+
+	// Auto-increment ids come from RETURNING id, since there is no
+	// LastInsertId.
+	first, err := store.CreateBroadcastRule(ctx, BroadcastRule{Address: "sales@example.com", Targets: []BroadcastTarget{{ContactURI: "sip:alice@192.0.2.1"}}})
+	if err != nil {
+		t.Fatalf("create rule: %v", err)
+	}
+	second, err := store.CreateBroadcastRule(ctx, BroadcastRule{Address: "support@example.com"})
+	if err != nil || first.ID == 0 || second.ID == first.ID {
+		t.Fatalf("expected distinct rule ids, got %v and %v, %v", first, second, err)
+	}
+	if targets, err := store.LookupBroadcastTargets(ctx, "sales@example.com"); err != nil || len(targets) != 1 || targets[0].RuleID != first.ID {
+		t.Fatalf("expected the rule's target, got %+v, %v", targets, err)
+	}
+	if err := store.DeleteBroadcastRule(ctx, first.ID); err != nil {
+		t.Fatalf("delete rule: %v", err)
+	}
+
+	if err := store.DeleteUser(ctx, "alice", "example.com"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.Lookup(ctx, "alice", "example.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected the user to be gone, got %v", err)
+	}
+
+	var sawReturning, sawILike bool
+	for _, query := range pg.queries {
+		sawReturning = sawReturning || strings.HasSuffix(query, " RETURNING id")
+		sawILike = sawILike || strings.Contains(query, " ILIKE $1")
+	}
+	if !sawReturning || !sawILike {
+		t.Fatalf("expected RETURNING id and ILIKE to reach the driver")
+	}
+}
@@ -0,0 +1,219 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrDomainNotFound is returned when a domain has no settings stored.
+var ErrDomainNotFound = errors.New("userdb: domain not found")
+
+// ErrDomainExists is returned when creating settings for a domain that
+// already has them.
+var ErrDomainExists = errors.New("userdb: domain already exists")
+
+// AuthPolicy says how the registrar treats REGISTER requests for a domain.
+type AuthPolicy string
+
+const (
+	// AuthDigest challenges every REGISTER and accepts it only with valid
+	// digest credentials. It is the default.
+	AuthDigest AuthPolicy = "digest"
+	// AuthNone accepts REGISTER for the domain's enabled users without
+	// credentials, for domains served on a trusted network.
+	AuthNone AuthPolicy = "none"
+	// AuthReject refuses every REGISTER with 403, suspending the domain
+	// without deleting its users.
+	AuthReject AuthPolicy = "reject"
+)
+
+// ParseAuthPolicy validates a policy name; empty means AuthDigest.
+func ParseAuthPolicy(name string) (AuthPolicy, error) {
+	switch policy := AuthPolicy(strings.ToLower(strings.TrimSpace(name))); policy {
+	case "":
+		return AuthDigest, nil
+	case AuthDigest, AuthNone, AuthReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("userdb: unknown auth policy %q: use digest, none, or reject", name)
+}
+
+// Domain holds the settings of one domain served by the proxy, so that one
+// instance can serve several independent customers. A domain is served once it
+// has settings or users; one without settings behaves as the zero Domain
+// does.
+type Domain struct {
+	// Name is the domain, in lower case.
+	Name string
+	// Aliases are other host names, such as sip.example.com or the server's
+	// address, that mean the same domain in addresses of record, in lower
+	// case.
+	Aliases []string
+	// DefaultExpires is the registration lifetime, in seconds, granted to
+	// contacts that ask for none; zero uses 3600.
+	DefaultExpires int
+	AuthPolicy     AuthPolicy
+	// Trunk names configured trunks, as user@domain separated by commas,
+	// that out-of-dialog requests from the domain's users leave through
+	// when the dial plan does not route them and they are not addressed to
+	// a served domain.
+	Trunk string
+	// BroadcastNamespace is the domain whose broadcast rules apply to
+	// calls into this one, so that a customer's domains can share one set;
+	// empty keeps the domain's own rules.
+	BroadcastNamespace string
+	Description        string
+}
+
+// ValidateDomain checks domain settings before they are stored.
+func ValidateDomain(domain Domain) error {
+	if domain.Name == "" || strings.ContainsAny(domain.Name, " \t@:;/") {
+		return fmt.Errorf("userdb: domain name %q is invalid", domain.Name)
+	}
+	for _, alias := range domain.Aliases {
+		if alias == "" || alias == domain.Name || strings.ContainsAny(alias, " \t@:;/,") {
+			return fmt.Errorf("userdb: domain alias %q is invalid", alias)
+		}
+	}
+	if domain.DefaultExpires < 0 {
+		return fmt.Errorf("userdb: domain default expiry must not be negative")
+	}
+	if _, err := ParseAuthPolicy(string(domain.AuthPolicy)); err != nil {
+		return err
+	}
+	if domain.Trunk != "" {
+		for _, trunk := range strings.Split(domain.Trunk, ",") {
+			user, host, ok := strings.Cut(strings.TrimSpace(trunk), "@")
+			if !ok || user == "" || host == "" {
+				return fmt.Errorf("userdb: domain trunk %q must be user@domain, or several separated by commas", domain.Trunk)
+			}
+		}
+	}
+	if strings.ContainsAny(domain.BroadcastNamespace, " \t@:;/") {
+		return fmt.Errorf("userdb: broadcast namespace %q is not a domain", domain.BroadcastNamespace)
+	}
+	return nil
+}
+
+func normalizeDomain(domain Domain) Domain {
+	domain.Name = strings.ToLower(strings.TrimSpace(domain.Name))
+	var aliases []string
+	for _, alias := range domain.Aliases {
+		if alias = strings.ToLower(strings.TrimSpace(alias)); alias != "" && !slices.Contains(aliases, alias) {
+			aliases = append(aliases, alias)
+		}
+	}
+	domain.Aliases = aliases
+	domain.AuthPolicy = AuthPolicy(strings.ToLower(strings.TrimSpace(string(domain.AuthPolicy))))
+	if domain.AuthPolicy == "" {
+		domain.AuthPolicy = AuthDigest
+	}
+	domain.Trunk = strings.TrimSpace(domain.Trunk)
+	domain.BroadcastNamespace = strings.ToLower(strings.TrimSpace(domain.BroadcastNamespace))
+	domain.Description = strings.TrimSpace(domain.Description)
+	return domain
+}
+
+// ListDomains returns the settings of every domain ordered by name.
+func (s *SQLStore) ListDomains(ctx context.Context) ([]Domain, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT name, aliases, default_expires, auth_policy, trunk, broadcast_namespace, description FROM domains ORDER BY name`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query domains: %w", err)
+	}
+	defer rows.Close()
+	var domains []Domain
+	for rows.Next() {
+		var domain Domain
+		var policy string
+		var aliases, description sql.NullString
+		if err := rows.Scan(&domain.Name, &aliases, &domain.DefaultExpires, &policy, &domain.Trunk, &domain.BroadcastNamespace, &description); err != nil {
+			return nil, fmt.Errorf("userdb: scan domain: %w", err)
+		}
+		if aliases.String != "" {
+			domain.Aliases = strings.Split(aliases.String, ",")
+		}
+		domain.AuthPolicy = AuthPolicy(policy)
+		domain.Description = description.String
+		domains = append(domains, domain)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate domains: %w", err)
+	}
+	return domains, nil
+}
+
+// CreateDomain stores settings for a domain, returning ErrDomainExists when
+// it already has them.
+func (s *SQLStore) CreateDomain(ctx context.Context, domain Domain) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	domain = normalizeDomain(domain)
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+	const query = `INSERT INTO domains (name, aliases, default_expires, auth_policy, trunk, broadcast_namespace, description) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(query), domain.Name, strings.Join(domain.Aliases, ","), domain.DefaultExpires, string(domain.AuthPolicy), domain.Trunk, domain.BroadcastNamespace, domain.Description); err != nil {
+		if isUniqueViolation(err) {
+			return ErrDomainExists
+		}
+		return fmt.Errorf("userdb: insert domain: %w", err)
+	}
+	s.changes.notify()
+	return nil
+}
+
+// UpdateDomain replaces every setting of the domain named domain.Name.
+func (s *SQLStore) UpdateDomain(ctx context.Context, domain Domain) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	domain = normalizeDomain(domain)
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+	const query = `UPDATE domains SET aliases = ?, default_expires = ?, auth_policy = ?, trunk = ?, broadcast_namespace = ?, description = ? WHERE name = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), strings.Join(domain.Aliases, ","), domain.DefaultExpires, string(domain.AuthPolicy), domain.Trunk, domain.BroadcastNamespace, domain.Description, domain.Name)
+	if err != nil {
+		return fmt.Errorf("userdb: update domain: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update domain rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrDomainNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteDomain removes a domain's settings, returning ErrDomainNotFound when
+// it has none. Its users are kept.
+func (s *SQLStore) DeleteDomain(ctx context.Context, name string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM domains WHERE name = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), strings.ToLower(strings.TrimSpace(name)))
+	if err != nil {
+		return fmt.Errorf("userdb: delete domain: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: delete domain rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrDomainNotFound
+	}
+	s.changes.notify()
+	return nil
+}
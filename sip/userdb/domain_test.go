@@ -0,0 +1,78 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSQLStoreDomains(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	changes, cancel := store.Subscribe()
+	defer cancel()
+
+	if err := store.CreateDomain(ctx, Domain{Name: " Tenant-B.Example ", Aliases: []string{"SIP.tenant-b.example", " 192.0.2.10", "sip.tenant-b.example"}, DefaultExpires: 600, AuthPolicy: "NONE", Trunk: "main@provider.example"}); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected creating a domain to notify subscribers")
+	}
+	if err := store.CreateDomain(ctx, Domain{Name: "tenant-a.example", BroadcastNamespace: "Tenant-B.example"}); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+	if err := store.CreateDomain(ctx, Domain{Name: "tenant-b.example"}); !errors.Is(err, ErrDomainExists) {
+		t.Fatalf("expected ErrDomainExists for a duplicate domain, got %v", err)
+	}
+	for _, bad := range []Domain{
+		{Name: ""},
+		{Name: "alice@example.com"},
+		{Name: "example.com", DefaultExpires: -1},
+		{Name: "example.com", Aliases: []string{"example.com"}},
+		{Name: "example.com", Aliases: []string{"a.example,b.example"}},
+		{Name: "example.com", AuthPolicy: "basic"},
+		{Name: "example.com", Trunk: "provider.example"},
+		{Name: "example.com", BroadcastNamespace: "sip:example.org"},
+	} {
+		if err := store.CreateDomain(ctx, bad); err == nil {
+			t.Fatalf("expected domain %+v to be rejected", bad)
+		}
+	}
+
+	domains, err := store.ListDomains(ctx)
+	if err != nil {
+		t.Fatalf("ListDomains: %v", err)
+	}
+	want := []Domain{
+		{Name: "tenant-a.example", AuthPolicy: AuthDigest, BroadcastNamespace: "tenant-b.example"},
+		{Name: "tenant-b.example", Aliases: []string{"sip.tenant-b.example", "192.0.2.10"}, DefaultExpires: 600, AuthPolicy: AuthNone, Trunk: "main@provider.example"},
+	}
+	if !reflect.DeepEqual(domains, want) {
+		t.Fatalf("unexpected domains: %+v", domains)
+	}
+
+	if err := store.UpdateDomain(ctx, Domain{Name: "tenant-b.example", AuthPolicy: AuthReject, Description: "suspended"}); err != nil {
+		t.Fatalf("UpdateDomain: %v", err)
+	}
+	if err := store.UpdateDomain(ctx, Domain{Name: "missing.example"}); !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("expected ErrDomainNotFound, got %v", err)
+	}
+	domains, _ = store.ListDomains(ctx)
+	if len(domains) != 2 || !reflect.DeepEqual(domains[1], Domain{Name: "tenant-b.example", AuthPolicy: AuthReject, Description: "suspended"}) {
+		t.Fatalf("unexpected domains after update: %+v", domains)
+	}
+
+	if err := store.DeleteDomain(ctx, "Tenant-A.example"); err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+	if err := store.DeleteDomain(ctx, "tenant-a.example"); !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("expected ErrDomainNotFound, got %v", err)
+	}
+}
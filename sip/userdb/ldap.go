@@ -0,0 +1,834 @@
+package userdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReadOnly is returned by backends that cannot modify the requested data.
+var ErrReadOnly = errors.New("userdb: store is read-only")
+
+// ErrInvalidCredentials is returned when a directory rejects a password.
+var ErrInvalidCredentials = errors.New("userdb: invalid credentials")
+
+// LDAPCredentialMode selects how LDAPStore verifies user passwords.
+type LDAPCredentialMode int
+
+const (
+	// LDAPCredentialDigest reads an attribute containing the HA1 digest (or a
+	// plaintext password) so the registrar can verify SIP Digest responses.
+	LDAPCredentialDigest LDAPCredentialMode = iota
+	// LDAPCredentialBind verifies passwords by binding as the user. The
+	// directory never discloses a secret, so SIP Digest authentication is not
+	// possible in this mode; only Authenticate can check credentials.
+	LDAPCredentialBind
+)
+
+// LDAPConfig describes how to reach and interpret an LDAP or Active Directory
+// server.
+type LDAPConfig struct {
+	// URL is an ldap:// or ldaps:// address of the directory server.
+	URL string
+	// BindDN and BindPassword identify the service account used for searches.
+	// Leave both empty for anonymous searches.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the search root for user entries.
+	BaseDN string
+	// Domain is the SIP domain assigned to every directory user.
+	Domain string
+	// ObjectFilter restricts searches to user entries. Defaults to
+	// (objectClass=person).
+	ObjectFilter string
+	// UsernameAttr maps to the SIP username. Defaults to uid; Active
+	// Directory installations typically use sAMAccountName.
+	UsernameAttr string
+	// PasswordAttr holds the HA1 digest or plaintext password in digest mode.
+	PasswordAttr string
+	// ContactAttr optionally maps to the static contact URI.
+	ContactAttr string
+	// CredentialMode selects digest-attribute or bind-based verification.
+	CredentialMode LDAPCredentialMode
+	// Timeout bounds each directory round trip when the context has no
+	// deadline. Defaults to five seconds.
+	Timeout time.Duration
+	// TLSConfig customises ldaps:// connections.
+	TLSConfig *tls.Config
+	// Rules optionally stores broadcast ringing rules, trunk routes, domain
+	// settings, short numbers, caller-ID rules, per-user settings, web
+	// interface admin accounts, and the audit log, which have no natural home in the
+	// directory. Without it the LDAP store exposes none of them.
+	Rules Store
+}
+
+// LDAPStore implements Store on top of an LDAP directory. User entries are
+// read-only; broadcast rules, user settings, and admin accounts are delegated
+// to LDAPConfig.Rules.
+type LDAPStore struct {
+	cfg    LDAPConfig
+	addr   string
+	useTLS bool
+	filter ldapFilter
+	msgID  atomic.Int64
+}
+
+var _ Store = (*LDAPStore)(nil)
+
+// NewLDAPStore validates cfg and returns a store. No connection is made until
+// the first lookup.
+func NewLDAPStore(cfg LDAPConfig) (*LDAPStore, error) {
+	u, err := url.Parse(strings.TrimSpace(cfg.URL))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: parse ldap url: %w", err)
+	}
+	store := &LDAPStore{cfg: cfg}
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		store.addr = hostWithDefaultPort(u.Host, "389")
+	case "ldaps":
+		store.addr = hostWithDefaultPort(u.Host, "636")
+		store.useTLS = true
+	default:
+		return nil, fmt.Errorf("userdb: unsupported ldap scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("userdb: ldap host is required")
+	}
+	if strings.TrimSpace(cfg.BaseDN) == "" {
+		return nil, fmt.Errorf("userdb: ldap base DN is required")
+	}
+	if strings.TrimSpace(cfg.Domain) == "" {
+		return nil, fmt.Errorf("userdb: ldap SIP domain is required")
+	}
+	if cfg.ObjectFilter == "" {
+		store.cfg.ObjectFilter = "(objectClass=person)"
+	}
+	if cfg.UsernameAttr == "" {
+		store.cfg.UsernameAttr = "uid"
+	}
+	if cfg.CredentialMode == LDAPCredentialDigest && cfg.PasswordAttr == "" {
+		return nil, fmt.Errorf("userdb: ldap password attribute is required in digest mode")
+	}
+	if cfg.Timeout <= 0 {
+		store.cfg.Timeout = 5 * time.Second
+	}
+	filter, err := parseLDAPFilter(store.cfg.ObjectFilter)
+	if err != nil {
+		return nil, err
+	}
+	store.filter = filter
+	return store, nil
+}
+
+// OpenLDAP builds an LDAPStore from a URL of the form
+//
+//	ldap://host:389/ou=people,dc=example,dc=com?domain=example.com&bind_dn=...&bind_password=...
+//
+// The path is the base DN. Supported query parameters are domain, bind_dn,
+// bind_password, filter, username_attr, password_attr, contact_attr, and
+// mode (digest or bind).
+func OpenLDAP(dsn string) (*LDAPStore, error) {
+	u, err := url.Parse(strings.TrimSpace(dsn))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: parse ldap dsn: %w", err)
+	}
+	q := u.Query()
+	cfg := LDAPConfig{
+		URL:          u.Scheme + "://" + u.Host,
+		BaseDN:       strings.TrimPrefix(u.Path, "/"),
+		Domain:       q.Get("domain"),
+		BindDN:       q.Get("bind_dn"),
+		BindPassword: q.Get("bind_password"),
+		ObjectFilter: q.Get("filter"),
+		UsernameAttr: q.Get("username_attr"),
+		PasswordAttr: q.Get("password_attr"),
+		ContactAttr:  q.Get("contact_attr"),
+	}
+	switch strings.ToLower(q.Get("mode")) {
+	case "", "digest":
+		cfg.CredentialMode = LDAPCredentialDigest
+	case "bind":
+		cfg.CredentialMode = LDAPCredentialBind
+	default:
+		return nil, fmt.Errorf("userdb: unsupported ldap credential mode %q", q.Get("mode"))
+	}
+	return NewLDAPStore(cfg)
+}
+
+// Close releases resources held by the rule backend, if any. LDAP connections
+// are opened per operation and need no cleanup.
+func (s *LDAPStore) Close() error {
+	if s == nil || s.cfg.Rules == nil {
+		return nil
+	}
+	return s.cfg.Rules.Close()
+}
+
+// Lookup searches the directory for the given username.
+func (s *LDAPStore) Lookup(ctx context.Context, username, domain string) (*User, error) {
+	if s == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	if !strings.EqualFold(strings.TrimSpace(domain), s.cfg.Domain) || strings.TrimSpace(username) == "" {
+		return nil, ErrUserNotFound
+	}
+	conn, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	entry, err := s.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	user := s.userFromEntry(entry)
+	if user.Username == "" {
+		user.Username = username
+	}
+	return &user, nil
+}
+
+// AllUsers returns every entry matching the object filter.
+func (s *LDAPStore) AllUsers(ctx context.Context) ([]User, error) {
+	if s == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	conn, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	filter := ldapAnd(s.filter, ldapFilter{op: ldapFilterPresent, attr: s.cfg.UsernameAttr})
+	entries, err := conn.search(s.cfg.BaseDN, filter, s.attributes(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("userdb: ldap search users: %w", err)
+	}
+	users := make([]User, 0, len(entries))
+	for _, entry := range entries {
+		user := s.userFromEntry(entry)
+		if user.Username == "" {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// QueryUsers searches, sorts, and pages AllUsers in memory; the directory is
+// expected to be small enough that server-side paging is not worth the extra
+// LDAP controls.
+func (s *LDAPStore) QueryUsers(ctx context.Context, query UserQuery) (UserPage, error) {
+	users, err := s.AllUsers(ctx)
+	if err != nil {
+		return UserPage{}, err
+	}
+	return queryUsers(users, query), nil
+}
+
+// Authenticate verifies a plaintext password by binding as the user's DN. It
+// is available in both credential modes.
+func (s *LDAPStore) Authenticate(ctx context.Context, username, domain, password string) error {
+	if s == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if password == "" {
+		// An empty simple bind is an anonymous bind and would always succeed.
+		return ErrInvalidCredentials
+	}
+	if !strings.EqualFold(strings.TrimSpace(domain), s.cfg.Domain) {
+		return ErrUserNotFound
+	}
+	conn, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+	entry, err := s.findUser(conn, username)
+	if err != nil {
+		return err
+	}
+	if err := conn.bind(entry.dn, password); err != nil {
+		var ldapErr *ldapResultError
+		if errors.As(err, &ldapErr) && ldapErr.code == ldapResultInvalidCreds {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("userdb: ldap user bind: %w", err)
+	}
+	return nil
+}
+
+// CreateUser is not supported; provision users in the directory instead.
+func (s *LDAPStore) CreateUser(ctx context.Context, user User) error { return ErrReadOnly }
+
+// DeleteUser is not supported; remove users from the directory instead.
+func (s *LDAPStore) DeleteUser(ctx context.Context, username, domain string) error {
+	return ErrReadOnly
+}
+
+// UpdatePassword is not supported; passwords are managed by the directory.
+func (s *LDAPStore) UpdatePassword(ctx context.Context, username, domain, passwordHash string) error {
+	return ErrReadOnly
+}
+
+// SetUserEnabled is not supported; account state is managed by the directory.
+func (s *LDAPStore) SetUserEnabled(ctx context.Context, username, domain string, enabled bool) error {
+	return ErrReadOnly
+}
+
+// UpdateUser is not supported; accounts are managed by the directory.
+func (s *LDAPStore) UpdateUser(ctx context.Context, user User) error {
+	return ErrReadOnly
+}
+
+// UserSettings delegates to the configured rule backend.
+func (s *LDAPStore) UserSettings(ctx context.Context, username, domain string) (UserSettings, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return UserSettings{}, nil
+	}
+	return s.cfg.Rules.UserSettings(ctx, username, domain)
+}
+
+// SetUserSetting delegates to the configured rule backend.
+func (s *LDAPStore) SetUserSetting(ctx context.Context, username, domain, name, value string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.SetUserSetting(ctx, username, domain, name, value)
+}
+
+// DeleteUserSetting delegates to the configured rule backend.
+func (s *LDAPStore) DeleteUserSetting(ctx context.Context, username, domain, name string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteUserSetting(ctx, username, domain, name)
+}
+
+// ListBroadcastRules delegates to the configured rule backend.
+func (s *LDAPStore) ListBroadcastRules(ctx context.Context) ([]BroadcastRule, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListBroadcastRules(ctx)
+}
+
+// CreateBroadcastRule delegates to the configured rule backend.
+func (s *LDAPStore) CreateBroadcastRule(ctx context.Context, rule BroadcastRule) (*BroadcastRule, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrReadOnly
+	}
+	return s.cfg.Rules.CreateBroadcastRule(ctx, rule)
+}
+
+// UpdateBroadcastRule delegates to the configured rule backend.
+func (s *LDAPStore) UpdateBroadcastRule(ctx context.Context, rule BroadcastRule) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateBroadcastRule(ctx, rule)
+}
+
+// DeleteBroadcastRule delegates to the configured rule backend.
+func (s *LDAPStore) DeleteBroadcastRule(ctx context.Context, ruleID int64) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteBroadcastRule(ctx, ruleID)
+}
+
+// ReplaceBroadcastTargets delegates to the configured rule backend.
+func (s *LDAPStore) ReplaceBroadcastTargets(ctx context.Context, ruleID int64, targets []BroadcastTarget) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.ReplaceBroadcastTargets(ctx, ruleID, targets)
+}
+
+// LookupBroadcastTargets delegates to the configured rule backend.
+func (s *LDAPStore) LookupBroadcastTargets(ctx context.Context, address string) ([]BroadcastTarget, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrBroadcastRuleNotFound
+	}
+	return s.cfg.Rules.LookupBroadcastTargets(ctx, address)
+}
+
+// ListTrunkRoutes delegates to the configured rule backend.
+func (s *LDAPStore) ListTrunkRoutes(ctx context.Context) ([]TrunkRoute, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListTrunkRoutes(ctx)
+}
+
+// CreateTrunkRoute delegates to the configured rule backend.
+func (s *LDAPStore) CreateTrunkRoute(ctx context.Context, route TrunkRoute) (*TrunkRoute, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrReadOnly
+	}
+	return s.cfg.Rules.CreateTrunkRoute(ctx, route)
+}
+
+// UpdateTrunkRoute delegates to the configured rule backend.
+func (s *LDAPStore) UpdateTrunkRoute(ctx context.Context, route TrunkRoute) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateTrunkRoute(ctx, route)
+}
+
+// DeleteTrunkRoute delegates to the configured rule backend.
+func (s *LDAPStore) DeleteTrunkRoute(ctx context.Context, id int64) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteTrunkRoute(ctx, id)
+}
+
+// ListDomains delegates to the configured rule backend.
+func (s *LDAPStore) ListDomains(ctx context.Context) ([]Domain, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListDomains(ctx)
+}
+
+// CreateDomain delegates to the configured rule backend.
+func (s *LDAPStore) CreateDomain(ctx context.Context, domain Domain) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.CreateDomain(ctx, domain)
+}
+
+// UpdateDomain delegates to the configured rule backend.
+func (s *LDAPStore) UpdateDomain(ctx context.Context, domain Domain) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateDomain(ctx, domain)
+}
+
+// DeleteDomain delegates to the configured rule backend.
+func (s *LDAPStore) DeleteDomain(ctx context.Context, name string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteDomain(ctx, name)
+}
+
+// ListShortNumbers delegates to the configured rule backend.
+func (s *LDAPStore) ListShortNumbers(ctx context.Context) ([]ShortNumber, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListShortNumbers(ctx)
+}
+
+// CreateShortNumber delegates to the configured rule backend.
+func (s *LDAPStore) CreateShortNumber(ctx context.Context, number ShortNumber) (*ShortNumber, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrReadOnly
+	}
+	return s.cfg.Rules.CreateShortNumber(ctx, number)
+}
+
+// UpdateShortNumber delegates to the configured rule backend.
+func (s *LDAPStore) UpdateShortNumber(ctx context.Context, number ShortNumber) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateShortNumber(ctx, number)
+}
+
+// DeleteShortNumber delegates to the configured rule backend.
+func (s *LDAPStore) DeleteShortNumber(ctx context.Context, id int64) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteShortNumber(ctx, id)
+}
+
+// ListCallerIDRules delegates to the configured rule backend.
+func (s *LDAPStore) ListCallerIDRules(ctx context.Context) ([]CallerIDRule, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListCallerIDRules(ctx)
+}
+
+// CreateCallerIDRule delegates to the configured rule backend.
+func (s *LDAPStore) CreateCallerIDRule(ctx context.Context, rule CallerIDRule) (*CallerIDRule, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrReadOnly
+	}
+	return s.cfg.Rules.CreateCallerIDRule(ctx, rule)
+}
+
+// UpdateCallerIDRule delegates to the configured rule backend.
+func (s *LDAPStore) UpdateCallerIDRule(ctx context.Context, rule CallerIDRule) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateCallerIDRule(ctx, rule)
+}
+
+// DeleteCallerIDRule delegates to the configured rule backend.
+func (s *LDAPStore) DeleteCallerIDRule(ctx context.Context, id int64) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteCallerIDRule(ctx, id)
+}
+
+// AdminAccount delegates to the configured rule backend.
+func (s *LDAPStore) AdminAccount(ctx context.Context, username string) (*AdminAccount, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrAdminNotFound
+	}
+	return s.cfg.Rules.AdminAccount(ctx, username)
+}
+
+// ListAdminAccounts delegates to the configured rule backend.
+func (s *LDAPStore) ListAdminAccounts(ctx context.Context) ([]AdminAccount, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListAdminAccounts(ctx)
+}
+
+// CreateAdminAccount delegates to the configured rule backend.
+func (s *LDAPStore) CreateAdminAccount(ctx context.Context, account AdminAccount) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.CreateAdminAccount(ctx, account)
+}
+
+// UpdateAdminAccount delegates to the configured rule backend.
+func (s *LDAPStore) UpdateAdminAccount(ctx context.Context, account AdminAccount) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.UpdateAdminAccount(ctx, account)
+}
+
+// DeleteAdminAccount delegates to the configured rule backend.
+func (s *LDAPStore) DeleteAdminAccount(ctx context.Context, username string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteAdminAccount(ctx, username)
+}
+
+// SetAdminTOTP delegates to the configured rule backend.
+func (s *LDAPStore) SetAdminTOTP(ctx context.Context, username, secret string, codeHashes []string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.SetAdminTOTP(ctx, username, secret, codeHashes)
+}
+
+// UseAdminRecoveryCode delegates to the configured rule backend.
+func (s *LDAPStore) UseAdminRecoveryCode(ctx context.Context, username, codeHash string) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrRecoveryCodeInvalid
+	}
+	return s.cfg.Rules.UseAdminRecoveryCode(ctx, username, codeHash)
+}
+
+// RecordAudit delegates to the configured rule backend. Without one there is
+// nowhere to keep the log, so entries are dropped.
+func (s *LDAPStore) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	if s == nil || s.cfg.Rules == nil {
+		return nil
+	}
+	return s.cfg.Rules.RecordAudit(ctx, entry)
+}
+
+// ListAuditEntries delegates to the configured rule backend.
+func (s *LDAPStore) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListAuditEntries(ctx, filter)
+}
+
+// ListAPITokens delegates to the configured rule backend.
+func (s *LDAPStore) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, nil
+	}
+	return s.cfg.Rules.ListAPITokens(ctx)
+}
+
+// APITokenByHash delegates to the configured rule backend.
+func (s *LDAPStore) APITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrAPITokenNotFound
+	}
+	return s.cfg.Rules.APITokenByHash(ctx, hash)
+}
+
+// CreateAPIToken delegates to the configured rule backend.
+func (s *LDAPStore) CreateAPIToken(ctx context.Context, token APIToken) (*APIToken, error) {
+	if s == nil || s.cfg.Rules == nil {
+		return nil, ErrReadOnly
+	}
+	return s.cfg.Rules.CreateAPIToken(ctx, token)
+}
+
+// DeleteAPIToken delegates to the configured rule backend.
+func (s *LDAPStore) DeleteAPIToken(ctx context.Context, id int64) error {
+	if s == nil || s.cfg.Rules == nil {
+		return ErrReadOnly
+	}
+	return s.cfg.Rules.DeleteAPIToken(ctx, id)
+}
+
+func (s *LDAPStore) attributes() []string {
+	attrs := []string{s.cfg.UsernameAttr}
+	if s.cfg.CredentialMode == LDAPCredentialDigest && s.cfg.PasswordAttr != "" {
+		attrs = append(attrs, s.cfg.PasswordAttr)
+	}
+	if s.cfg.ContactAttr != "" {
+		attrs = append(attrs, s.cfg.ContactAttr)
+	}
+	return attrs
+}
+
+func (s *LDAPStore) findUser(conn *ldapConn, username string) (ldapEntry, error) {
+	filter := ldapAnd(s.filter, ldapEquals(s.cfg.UsernameAttr, username))
+	entries, err := conn.search(s.cfg.BaseDN, filter, s.attributes(), 2)
+	if err != nil {
+		return ldapEntry{}, fmt.Errorf("userdb: ldap search user: %w", err)
+	}
+	switch len(entries) {
+	case 0:
+		return ldapEntry{}, ErrUserNotFound
+	case 1:
+		return entries[0], nil
+	default:
+		return ldapEntry{}, fmt.Errorf("userdb: ldap username %q is ambiguous", username)
+	}
+}
+
+func (s *LDAPStore) userFromEntry(entry ldapEntry) User {
+	user := User{
+		Username: entry.first(s.cfg.UsernameAttr),
+		Domain:   s.cfg.Domain,
+	}
+	if s.cfg.CredentialMode == LDAPCredentialDigest {
+		user.PasswordHash = entry.first(s.cfg.PasswordAttr)
+	}
+	if s.cfg.ContactAttr != "" {
+		user.ContactURI = entry.first(s.cfg.ContactAttr)
+	}
+	return user
+}
+
+func (s *LDAPStore) open(ctx context.Context) (*ldapConn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(s.cfg.Timeout)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var (
+		raw net.Conn
+		err error
+	)
+	if s.useTLS {
+		tlsCfg := s.cfg.TLSConfig
+		if tlsCfg == nil {
+			host, _, _ := net.SplitHostPort(s.addr)
+			tlsCfg = &tls.Config{ServerName: host}
+		}
+		raw, err = (&tls.Dialer{NetDialer: dialer, Config: tlsCfg}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("userdb: dial ldap %s: %w", s.addr, err)
+	}
+	raw.SetDeadline(deadline)
+	conn := &ldapConn{conn: raw, r: bufio.NewReader(raw), ids: &s.msgID}
+	if s.cfg.BindDN != "" || s.cfg.BindPassword != "" {
+		if err := conn.bind(s.cfg.BindDN, s.cfg.BindPassword); err != nil {
+			conn.close()
+			return nil, fmt.Errorf("userdb: ldap service bind: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func hostWithDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	ids  *atomic.Int64
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e ldapEntry) first(attr string) string {
+	values := e.attrs[strings.ToLower(attr)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+type ldapResultError struct {
+	code    int64
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("ldap result code %d", e.code)
+	}
+	return fmt.Sprintf("ldap result code %d: %s", e.code, e.message)
+}
+
+func (c *ldapConn) close() {
+	if c == nil || c.conn == nil {
+		return
+	}
+	id := c.ids.Add(1)
+	c.conn.Write(berConcat(berTagSequence, berInteger(berTagInteger, id), berEncode(ldapOpUnbindRequest, nil)))
+	c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	id := c.ids.Add(1)
+	msg := berConcat(berTagSequence, berInteger(berTagInteger, id), op)
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// receive reads the next message addressed to id and returns its protocol op.
+func (c *ldapConn) receive(id int64) (berPacket, error) {
+	for {
+		raw, err := berRead(c.r)
+		if err != nil {
+			return berPacket{}, err
+		}
+		msg, _, err := berParse(raw)
+		if err != nil {
+			return berPacket{}, err
+		}
+		if len(msg.children) < 2 {
+			return berPacket{}, errBERTruncated
+		}
+		if msg.children[0].int() != id {
+			continue
+		}
+		return msg.children[1], nil
+	}
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	op := berConcat(ldapOpBindRequest,
+		berInteger(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(ldapAuthSimple, password),
+	)
+	id, err := c.send(op)
+	if err != nil {
+		return err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if resp.tag != ldapOpBindResponse {
+		return fmt.Errorf("unexpected ldap response tag 0x%x", resp.tag)
+	}
+	return ldapResult(resp)
+}
+
+func (c *ldapConn) search(base string, filter ldapFilter, attrs []string, sizeLimit int) ([]ldapEntry, error) {
+	attrParts := make([][]byte, 0, len(attrs))
+	for _, attr := range attrs {
+		attrParts = append(attrParts, berString(berTagOctetString, attr))
+	}
+	op := berConcat(ldapOpSearchRequest,
+		berString(berTagOctetString, base),
+		berInteger(berTagEnumerated, ldapScopeWholeSubtree),
+		berInteger(berTagEnumerated, ldapDerefNever),
+		berInteger(berTagInteger, int64(sizeLimit)),
+		berInteger(berTagInteger, 0),
+		berBool(false),
+		filter.encode(),
+		berConcat(berTagSequence, attrParts...),
+	)
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case ldapOpSearchEntry:
+			if len(resp.children) < 2 {
+				return nil, errBERTruncated
+			}
+			entry := ldapEntry{dn: resp.children[0].str(), attrs: make(map[string][]string)}
+			for _, attr := range resp.children[1].children {
+				if len(attr.children) < 2 {
+					continue
+				}
+				name := strings.ToLower(attr.children[0].str())
+				for _, value := range attr.children[1].children {
+					entry.attrs[name] = append(entry.attrs[name], value.str())
+				}
+			}
+			entries = append(entries, entry)
+		case ldapOpSearchReference:
+			// Referrals are not chased.
+		case ldapOpSearchDone:
+			if err := ldapResult(resp); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected ldap response tag 0x%x", resp.tag)
+		}
+	}
+}
+
+func ldapResult(resp berPacket) error {
+	if len(resp.children) < 3 {
+		return errBERTruncated
+	}
+	code := resp.children[0].int()
+	if code == ldapResultSuccess {
+		return nil
+	}
+	return &ldapResultError{code: code, message: resp.children[2].str()}
+}
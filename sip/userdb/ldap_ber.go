@@ -0,0 +1,311 @@
+package userdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file contains the small subset of BER (X.690) and RFC 4511 encoding
+// needed by LDAPStore: simple binds, subtree searches, and result parsing.
+
+const (
+	berClassUniversal   = 0x00
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x10 | berConstructed
+	berTagSet         = 0x11 | berConstructed
+
+	ldapOpBindRequest      = berClassApplication | berConstructed | 0
+	ldapOpBindResponse     = berClassApplication | berConstructed | 1
+	ldapOpUnbindRequest    = berClassApplication | 2
+	ldapOpSearchRequest    = berClassApplication | berConstructed | 3
+	ldapOpSearchEntry      = berClassApplication | berConstructed | 4
+	ldapOpSearchDone       = berClassApplication | berConstructed | 5
+	ldapOpSearchReference  = berClassApplication | berConstructed | 19
+	ldapAuthSimple         = berClassContext | 0
+	ldapScopeWholeSubtree  = 2
+	ldapDerefNever         = 0
+	ldapResultSuccess      = 0
+	ldapResultInvalidCreds = 49
+)
+
+var errBERTruncated = errors.New("userdb: truncated ldap message")
+
+type berPacket struct {
+	tag      byte
+	value    []byte
+	children []berPacket
+}
+
+func berEncode(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	out = append(out, berLength(len(value))...)
+	return append(out, value...)
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var buf []byte
+	for v := n; v > 0; v >>= 8 {
+		buf = append([]byte{byte(v)}, buf...)
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+func berInteger(tag byte, v int64) []byte {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(v)}, buf...)
+		if (v < 0x80 && v >= -0x80) || len(buf) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berEncode(tag, buf)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+	return berEncode(berTagBoolean, []byte{0x00})
+}
+
+func berConcat(tag byte, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	return berEncode(tag, body)
+}
+
+// berRead reads one complete TLV element from r.
+func berRead(r *bufio.Reader) ([]byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{tag, first}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return nil, fmt.Errorf("userdb: unsupported ldap length encoding")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			header = append(header, b)
+			length = length<<8 | int(b)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// berParse decodes a single TLV and, for constructed types, its children.
+func berParse(data []byte) (berPacket, []byte, error) {
+	if len(data) < 2 {
+		return berPacket{}, nil, errBERTruncated
+	}
+	tag := data[0]
+	length := int(data[1])
+	offset := 2
+	if data[1]&0x80 != 0 {
+		count := int(data[1] & 0x7f)
+		if count == 0 || count > 4 || len(data) < 2+count {
+			return berPacket{}, nil, errBERTruncated
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			length = length<<8 | int(data[2+i])
+		}
+		offset += count
+	}
+	if len(data) < offset+length {
+		return berPacket{}, nil, errBERTruncated
+	}
+	pkt := berPacket{tag: tag, value: data[offset : offset+length]}
+	if tag&berConstructed != 0 {
+		rest := pkt.value
+		for len(rest) > 0 {
+			child, remaining, err := berParse(rest)
+			if err != nil {
+				return berPacket{}, nil, err
+			}
+			pkt.children = append(pkt.children, child)
+			rest = remaining
+		}
+	}
+	return pkt, data[offset+length:], nil
+}
+
+func (p berPacket) int() int64 {
+	var v int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+func (p berPacket) str() string {
+	return string(p.value)
+}
+
+// ldapFilter is a parsed RFC 4515 search filter.
+type ldapFilter struct {
+	op       byte
+	attr     string
+	value    string
+	children []ldapFilter
+}
+
+const (
+	ldapFilterAnd      = berClassContext | berConstructed | 0
+	ldapFilterOr       = berClassContext | berConstructed | 1
+	ldapFilterNot      = berClassContext | berConstructed | 2
+	ldapFilterEquality = berClassContext | berConstructed | 3
+	ldapFilterPresent  = berClassContext | 7
+)
+
+// parseLDAPFilter parses the subset of RFC 4515 filters used for directory
+// lookups: &, |, !, equality, and presence (attr=*).
+func parseLDAPFilter(raw string) (ldapFilter, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ldapFilter{}, fmt.Errorf("userdb: empty ldap filter")
+	}
+	if !strings.HasPrefix(raw, "(") {
+		raw = "(" + raw + ")"
+	}
+	filter, rest, err := parseLDAPFilterAt(raw)
+	if err != nil {
+		return ldapFilter{}, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return ldapFilter{}, fmt.Errorf("userdb: trailing data in ldap filter %q", raw)
+	}
+	return filter, nil
+}
+
+func parseLDAPFilterAt(s string) (ldapFilter, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return ldapFilter{}, "", fmt.Errorf("userdb: invalid ldap filter %q", s)
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|', '!':
+		op := map[byte]byte{'&': ldapFilterAnd, '|': ldapFilterOr, '!': ldapFilterNot}[s[0]]
+		node := ldapFilter{op: op}
+		s = s[1:]
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := parseLDAPFilterAt(s)
+			if err != nil {
+				return ldapFilter{}, "", err
+			}
+			node.children = append(node.children, child)
+			s = rest
+		}
+		if len(s) == 0 || s[0] != ')' {
+			return ldapFilter{}, "", fmt.Errorf("userdb: unterminated ldap filter")
+		}
+		if op == ldapFilterNot && len(node.children) != 1 {
+			return ldapFilter{}, "", fmt.Errorf("userdb: ldap not filter requires one operand")
+		}
+		return node, s[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end == -1 {
+		return ldapFilter{}, "", fmt.Errorf("userdb: unterminated ldap filter")
+	}
+	item := s[:end]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return ldapFilter{}, "", fmt.Errorf("userdb: unsupported ldap filter item %q", item)
+	}
+	attr := strings.TrimSpace(item[:eq])
+	value := item[eq+1:]
+	if value == "*" {
+		return ldapFilter{op: ldapFilterPresent, attr: attr}, s[end+1:], nil
+	}
+	decoded, err := unescapeLDAPValue(value)
+	if err != nil {
+		return ldapFilter{}, "", err
+	}
+	return ldapFilter{op: ldapFilterEquality, attr: attr, value: decoded}, s[end+1:], nil
+}
+
+func unescapeLDAPValue(value string) (string, error) {
+	if !strings.Contains(value, `\`) {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("userdb: invalid escape in ldap filter")
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("userdb: invalid escape in ldap filter: %w", err)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func (f ldapFilter) encode() []byte {
+	switch f.op {
+	case ldapFilterAnd, ldapFilterOr, ldapFilterNot:
+		parts := make([][]byte, 0, len(f.children))
+		for _, child := range f.children {
+			parts = append(parts, child.encode())
+		}
+		return berConcat(f.op, parts...)
+	case ldapFilterPresent:
+		return berString(ldapFilterPresent, f.attr)
+	default:
+		return berConcat(ldapFilterEquality, berString(berTagOctetString, f.attr), berString(berTagOctetString, f.value))
+	}
+}
+
+func ldapAnd(filters ...ldapFilter) ldapFilter {
+	return ldapFilter{op: ldapFilterAnd, children: filters}
+}
+
+func ldapEquals(attr, value string) ldapFilter {
+	return ldapFilter{op: ldapFilterEquality, attr: attr, value: value}
+}
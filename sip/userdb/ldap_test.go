@@ -0,0 +1,196 @@
+package userdb
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+)
+
+type fakeLDAPUser struct {
+	dn       string
+	password string
+	attrs    map[string]string
+}
+
+// startFakeLDAP serves simple binds and searches over the given users. Search
+// filters are matched by looking for an equality item on "uid".
+func startFakeLDAP(t *testing.T, serviceDN, servicePass string, users []fakeLDAPUser) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeLDAP(conn, serviceDN, servicePass, users)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func serveFakeLDAP(conn net.Conn, serviceDN, servicePass string, users []fakeLDAPUser) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id int64, op []byte) {
+		conn.Write(berConcat(berTagSequence, berInteger(berTagInteger, id), op))
+	}
+	result := func(tag byte, code int64) []byte {
+		return berConcat(tag, berInteger(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, ""))
+	}
+	for {
+		raw, err := berRead(r)
+		if err != nil {
+			return
+		}
+		msg, _, err := berParse(raw)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		id := msg.children[0].int()
+		op := msg.children[1]
+		switch op.tag {
+		case ldapOpBindRequest:
+			dn, pass := op.children[1].str(), string(op.children[2].value)
+			code := int64(ldapResultInvalidCreds)
+			if dn == serviceDN && pass == servicePass {
+				code = ldapResultSuccess
+			}
+			for _, u := range users {
+				if dn == u.dn && pass == u.password {
+					code = ldapResultSuccess
+				}
+			}
+			reply(id, result(ldapOpBindResponse, code))
+		case ldapOpSearchRequest:
+			wanted := findEquality(op.children[6], "uid")
+			for _, u := range users {
+				if wanted != "" && u.attrs["uid"] != wanted {
+					continue
+				}
+				var attrs [][]byte
+				for name, value := range u.attrs {
+					attrs = append(attrs, berConcat(berTagSequence,
+						berString(berTagOctetString, name),
+						berConcat(berTagSet, berString(berTagOctetString, value))))
+				}
+				reply(id, berConcat(ldapOpSearchEntry, berString(berTagOctetString, u.dn), berConcat(berTagSequence, attrs...)))
+			}
+			reply(id, result(ldapOpSearchDone, ldapResultSuccess))
+		case ldapOpUnbindRequest:
+			return
+		}
+	}
+}
+
+func findEquality(filter berPacket, attr string) string {
+	if filter.tag == ldapFilterEquality && len(filter.children) == 2 && filter.children[0].str() == attr {
+		return filter.children[1].str()
+	}
+	for _, child := range filter.children {
+		if v := findEquality(child, attr); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func newFakeDirectory(t *testing.T, mode string) *LDAPStore {
+	t.Helper()
+	url := startFakeLDAP(t, "cn=svc,dc=example,dc=com", "svc-secret", []fakeLDAPUser{
+		{
+			dn:       "uid=alice,ou=people,dc=example,dc=com",
+			password: "wonderland",
+			attrs:    map[string]string{"uid": "alice", "sipHA1": "0123456789abcdef0123456789abcdef", "sipContact": "sip:alice@192.0.2.10"},
+		},
+		{
+			dn:       "uid=bob,ou=people,dc=example,dc=com",
+			password: "builder",
+			attrs:    map[string]string{"uid": "bob", "sipHA1": "fedcba9876543210fedcba9876543210"},
+		},
+	})
+	store, err := OpenLDAP(url + "/ou=people,dc=example,dc=com?domain=example.com&bind_dn=cn=svc,dc=example,dc=com&bind_password=svc-secret&password_attr=sipHA1&contact_attr=sipContact&mode=" + mode)
+	if err != nil {
+		t.Fatalf("OpenLDAP returned error: %v", err)
+	}
+	return store
+}
+
+func TestLDAPStoreLookupDigestMode(t *testing.T) {
+	store := newFakeDirectory(t, "digest")
+	ctx := context.Background()
+
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.PasswordHash != "0123456789abcdef0123456789abcdef" {
+		t.Fatalf("unexpected password hash %q", user.PasswordHash)
+	}
+	if user.ContactURI != "sip:alice@192.0.2.10" {
+		t.Fatalf("unexpected contact %q", user.ContactURI)
+	}
+	if _, err := store.Lookup(ctx, "carol", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := store.Lookup(ctx, "alice", "other.example"); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound for foreign domain, got %v", err)
+	}
+
+	users, err := store.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers returned error: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(users))
+	}
+	if err := store.CreateUser(ctx, User{Username: "dave", Domain: "example.com"}); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestLDAPStoreBindModeAuthenticate(t *testing.T) {
+	store := newFakeDirectory(t, "bind")
+	ctx := context.Background()
+
+	user, err := store.Lookup(ctx, "bob", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.PasswordHash != "" {
+		t.Fatalf("bind mode must not expose password attributes, got %q", user.PasswordHash)
+	}
+	if err := store.Authenticate(ctx, "bob", "example.com", "builder"); err != nil {
+		t.Fatalf("Authenticate returned error: %v", err)
+	}
+	if err := store.Authenticate(ctx, "bob", "example.com", "wrong"); err != ErrInvalidCredentials {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if err := store.Authenticate(ctx, "bob", "example.com", ""); err != ErrInvalidCredentials {
+		t.Fatalf("expected empty password to be rejected, got %v", err)
+	}
+}
+
+func TestParseLDAPFilter(t *testing.T) {
+	filter, err := parseLDAPFilter(`(&(objectClass=person)(!(disabled=*))(cn=a\2ab))`)
+	if err != nil {
+		t.Fatalf("parseLDAPFilter returned error: %v", err)
+	}
+	if filter.op != ldapFilterAnd || len(filter.children) != 3 {
+		t.Fatalf("unexpected filter tree: %#v", filter)
+	}
+	if filter.children[1].op != ldapFilterNot || filter.children[1].children[0].op != ldapFilterPresent {
+		t.Fatalf("unexpected not/presence item: %#v", filter.children[1])
+	}
+	if filter.children[2].value != "a*b" {
+		t.Fatalf("expected escaped value to decode, got %q", filter.children[2].value)
+	}
+	if _, err := parseLDAPFilter("(cn=a"); err == nil {
+		t.Fatalf("expected error for unterminated filter")
+	}
+}
@@ -0,0 +1,276 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration describes one schema upgrade step. Statements are rendered per
+// dialect so the same version history applies to every SQL backend.
+type migration struct {
+	version     int
+	description string
+	statements  func(d Dialect) []string
+}
+
+// migrations lists every schema version in ascending order. New entries must
+// only ever be appended; released versions are never edited.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "users and broadcast ringing tables",
+		statements: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS users (
+        username ` + d.textType() + ` NOT NULL,
+        domain ` + d.textType() + ` NOT NULL,
+        password_hash TEXT,
+        contact_uri TEXT,
+        PRIMARY KEY (username, domain)
+)`,
+				`CREATE TABLE IF NOT EXISTS broadcast_rules (
+        id ` + d.autoIncrementKey() + `,
+        address ` + d.textType() + ` NOT NULL,
+        description TEXT
+)`,
+				`CREATE TABLE IF NOT EXISTS broadcast_targets (
+        id ` + d.autoIncrementKey() + `,
+        rule_id INTEGER NOT NULL,
+        contact_uri TEXT NOT NULL,
+        priority INTEGER NOT NULL
+)`,
+			}
+		},
+	},
+	{
+		version:     2,
+		description: "users.enabled flag",
+		statements: func(d Dialect) []string {
+			return []string{`ALTER TABLE users ADD COLUMN enabled INTEGER NOT NULL DEFAULT 1`}
+		},
+	},
+	{
+		version:     3,
+		description: "per-user settings",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS user_settings (
+        username ` + d.textType() + ` NOT NULL,
+        domain ` + d.textType() + ` NOT NULL,
+        name ` + d.textType() + ` NOT NULL,
+        value TEXT,
+        PRIMARY KEY (username, domain, name)
+)`}
+		},
+	},
+	{
+		version:     4,
+		description: "web interface admin accounts",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS admin_accounts (
+        username ` + d.textType() + ` NOT NULL PRIMARY KEY,
+        password_hash TEXT NOT NULL,
+        role ` + d.textType() + ` NOT NULL
+)`}
+		},
+	},
+	{
+		version:     5,
+		description: "admin two-factor authentication",
+		statements: func(d Dialect) []string {
+			return []string{
+				`ALTER TABLE admin_accounts ADD COLUMN totp_secret TEXT`,
+				`CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+        username ` + d.textType() + ` NOT NULL,
+        code_hash ` + d.textType() + ` NOT NULL,
+        PRIMARY KEY (username, code_hash)
+)`,
+			}
+		},
+	},
+	{
+		version:     6,
+		description: "audit log of administrative changes",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS audit_log (
+        id ` + d.autoIncrementKey() + `,
+        created_at ` + d.textType() + ` NOT NULL,
+        actor ` + d.textType() + ` NOT NULL,
+        action ` + d.textType() + ` NOT NULL,
+        target TEXT NOT NULL,
+        before_value TEXT NOT NULL,
+        after_value TEXT NOT NULL
+)`}
+		},
+	},
+	{
+		version:     7,
+		description: "scoped API tokens",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS api_tokens (
+        id ` + d.autoIncrementKey() + `,
+        name ` + d.textType() + ` NOT NULL,
+        token_hash ` + d.textType() + ` NOT NULL,
+        scopes TEXT NOT NULL,
+        created_by ` + d.textType() + ` NOT NULL,
+        created_at ` + d.textType() + ` NOT NULL
+)`}
+		},
+	},
+	{
+		version:     8,
+		description: "prefix trunk routes",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS trunk_routes (
+        id ` + d.autoIncrementKey() + `,
+        prefix ` + d.textType() + ` NOT NULL,
+        trunk TEXT NOT NULL,
+        strip INTEGER NOT NULL,
+        prepend TEXT NOT NULL,
+        description TEXT
+)`}
+		},
+	},
+	{
+		version:     9,
+		description: "per-domain settings",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS domains (
+        name ` + d.textType() + ` NOT NULL PRIMARY KEY,
+        default_expires INTEGER NOT NULL,
+        auth_policy ` + d.textType() + ` NOT NULL,
+        trunk TEXT NOT NULL,
+        broadcast_namespace ` + d.textType() + ` NOT NULL,
+        description TEXT
+)`}
+		},
+	},
+	{
+		version:     10,
+		description: "domain aliases",
+		statements: func(d Dialect) []string {
+			return []string{`ALTER TABLE domains ADD COLUMN aliases TEXT`}
+		},
+	},
+	{
+		version:     11,
+		description: "short numbers",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS short_numbers (
+        id ` + d.autoIncrementKey() + `,
+        domain ` + d.textType() + ` NOT NULL,
+        number ` + d.textType() + ` NOT NULL,
+        target TEXT NOT NULL,
+        description TEXT
+)`}
+		},
+	},
+	{
+		version:     12,
+		description: "caller-id rules",
+		statements: func(d Dialect) []string {
+			return []string{`CREATE TABLE IF NOT EXISTS caller_id_rules (
+        id ` + d.autoIncrementKey() + `,
+        caller TEXT NOT NULL,
+        trunk TEXT NOT NULL,
+        display_name TEXT NOT NULL,
+        from_user TEXT NOT NULL,
+        from_host TEXT NOT NULL,
+        preferred_identity INTEGER NOT NULL DEFAULT 0,
+        description TEXT
+)`}
+		},
+	},
+}
+
+// LatestSchemaVersion reports the schema version the current code expects.
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the highest migration recorded in schema_version, or
+// zero for a database that has never been migrated.
+func (s *SQLStore) SchemaVersion(ctx context.Context) (int, error) {
+	if s == nil || s.db == nil {
+		return 0, fmt.Errorf("userdb: store is not initialised")
+	}
+	if err := s.ensureVersionTable(ctx); err != nil {
+		return 0, err
+	}
+	var current sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&current); err != nil {
+		return 0, fmt.Errorf("userdb: query schema version: %w", err)
+	}
+	return int(current.Int64), nil
+}
+
+// Migrate creates the schema on an empty database and applies any pending
+// upgrades. Tables created by hand before versioning existed are adopted
+// because every DDL statement is idempotent. Each migration runs in its own
+// transaction together with its schema_version record; MySQL commits DDL
+// implicitly, so there a failed step may leave part of it applied.
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("userdb: database schema version %d is newer than supported version %d", current, LatestSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := s.withTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range m.statements(s.dialect) {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return fmt.Errorf("userdb: migration %d (%s): %w", m.version, m.description, err)
+				}
+			}
+			const record = `INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`
+			if _, err := tx.ExecContext(ctx, s.dialect.rebind(record), m.version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+				return fmt.Errorf("userdb: record migration %d: %w", m.version, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) ensureVersionTable(ctx context.Context) error {
+	const create = `CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER NOT NULL,
+        applied_at TEXT
+)`
+	if _, err := s.db.ExecContext(ctx, create); err != nil {
+		return fmt.Errorf("userdb: create schema_version: %w", err)
+	}
+	return nil
+}
+
+// textType returns a column type usable in primary keys. MySQL cannot index
+// unbounded TEXT columns.
+func (d Dialect) textType() string {
+	if d == DialectMySQL {
+		return "VARCHAR(255)"
+	}
+	return "TEXT"
+}
+
+func (d Dialect) autoIncrementKey() string {
+	switch d {
+	case DialectPostgres:
+		return "BIGSERIAL PRIMARY KEY"
+	case DialectMySQL:
+		return "BIGINT PRIMARY KEY AUTO_INCREMENT"
+	default:
+		return "INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+}
@@ -0,0 +1,97 @@
+package userdb
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewSQLiteStoreMigratesFreshDatabase(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("SchemaVersion returned error: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com", PasswordHash: "hash"}); err != nil {
+		t.Fatalf("CreateUser on migrated schema returned error: %v", err)
+	}
+	if _, err := store.CreateBroadcastRule(ctx, BroadcastRule{Address: "sip:all@example.com"}); err != nil {
+		t.Fatalf("CreateBroadcastRule on migrated schema returned error: %v", err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openTestDatabase(t)
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate run %d returned error: %v", i+1, err)
+		}
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_version`)
+	if err != nil {
+		t.Fatalf("query schema_version: %v", err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if count != len(migrations) {
+		t.Fatalf("expected %d recorded migrations, got %d", len(migrations), count)
+	}
+}
+
+func TestMigrateAdoptsHandCreatedSchema(t *testing.T) {
+	db := openTestDatabase(t)
+	seedTestUsers(t, db)
+
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to construct store over existing schema: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, err := store.Lookup(ctx, "alice", "example.com"); err != nil {
+		t.Fatalf("expected existing rows to survive migration, got %v", err)
+	}
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("SchemaVersion returned error: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db := openTestDatabase(t)
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`, LatestSchemaVersion()+1, ""); err != nil {
+		t.Fatalf("insert future version: %v", err)
+	}
+	if err := store.Migrate(ctx); err == nil {
+		t.Fatalf("expected Migrate to refuse a newer schema")
+	}
+}
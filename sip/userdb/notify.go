@@ -0,0 +1,59 @@
+package userdb
+
+import "sync"
+
+// ChangeNotifier is implemented by stores that can announce modifications to
+// users, broadcast rules, trunk routes, domain settings, short numbers, or
+// caller-ID rules. Subscribers receive a value after each change; bursts are coalesced, so a
+// receive means "reload", not "one change".
+type ChangeNotifier interface {
+	Subscribe() (changes <-chan struct{}, cancel func())
+}
+
+var _ ChangeNotifier = (*SQLStore)(nil)
+
+// changeFeed fans change signals out to subscribers. The zero value is ready
+// for use.
+type changeFeed struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]chan struct{}
+}
+
+func (f *changeFeed) subscribe() (<-chan struct{}, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[int]chan struct{})
+	}
+	id := f.nextID
+	f.nextID++
+	ch := make(chan struct{}, 1)
+	f.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			f.mu.Lock()
+			delete(f.subs, id)
+			f.mu.Unlock()
+		})
+	}
+}
+
+func (f *changeFeed) notify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range f.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe reports changes made through this store handle. Writes issued by
+// other processes or handles are not observed; callers that share a database
+// should combine this with periodic reloads.
+func (s *SQLStore) Subscribe() (<-chan struct{}, func()) {
+	return s.changes.subscribe()
+}
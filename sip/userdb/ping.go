@@ -0,0 +1,65 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Pinger is implemented by stores that can check their connection to the
+// backing database or directory server without reading user data.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+var (
+	_ Pinger = (*SQLStore)(nil)
+	_ Pinger = (*LDAPStore)(nil)
+	_ Pinger = (*CachedStore)(nil)
+)
+
+// Ping checks that store can reach its backend. Stores that do not implement
+// Pinger are probed with a lookup of a user that cannot exist, which succeeds
+// when it reports ErrUserNotFound.
+func Ping(ctx context.Context, store Store) error {
+	if store == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if pinger, ok := store.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	if _, err := store.Lookup(ctx, "", ""); err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Ping verifies that the database connection is alive.
+func (s *SQLStore) Ping(ctx context.Context) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("userdb: ping %s: %w", s.dialect, err)
+	}
+	return nil
+}
+
+// Ping opens, and binds when configured, a connection to the directory
+// server.
+func (s *LDAPStore) Ping(ctx context.Context) error {
+	if s == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	conn, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	conn.close()
+	return nil
+}
+
+// Ping bypasses the cache and checks the wrapped store.
+func (c *CachedStore) Ping(ctx context.Context) error {
+	return Ping(ctx, c.Store)
+}
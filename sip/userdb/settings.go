@@ -0,0 +1,171 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Well-known per-user setting names. The user_settings table accepts any
+// name so new features can store their options without a schema change;
+// these constants cover the ones the proxy itself interprets.
+const (
+	// SettingMaxContacts caps how many bindings the registrar accepts for
+	// the user. Zero or absent means unlimited.
+	SettingMaxContacts = "max_contacts"
+	// SettingCallerIDName is the display name presented for the user's calls.
+	SettingCallerIDName = "caller_id_name"
+	// SettingCallLimit caps the user's concurrent calls. Zero or absent means
+	// unlimited.
+	SettingCallLimit = "call_limit"
+	// SettingDoNotDisturb rejects incoming calls with 486 Busy Here.
+	SettingDoNotDisturb = "dnd"
+	// SettingForwardTo unconditionally retargets incoming calls to a URI.
+	SettingForwardTo = "forward_to"
+)
+
+// UserSettings holds the free-form settings stored for one user, keyed by
+// setting name. A nil UserSettings is valid and reports every setting as
+// unset.
+type UserSettings map[string]string
+
+// String returns the trimmed value of a setting, or "" when unset.
+func (s UserSettings) String(name string) string {
+	return strings.TrimSpace(s[name])
+}
+
+// Int parses a setting as a decimal integer. The boolean is false when the
+// setting is unset or malformed.
+func (s UserSettings) Int(name string) (int, bool) {
+	value, err := strconv.Atoi(s.String(name))
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// Bool reports whether a setting holds a true value ("1", "true", "t",
+// "yes", or "on", case-insensitively).
+func (s UserSettings) Bool(name string) bool {
+	switch strings.ToLower(s.String(name)) {
+	case "1", "true", "t", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// MaxContacts returns the binding limit, or zero when unlimited.
+func (s UserSettings) MaxContacts() int {
+	return s.nonNegative(SettingMaxContacts)
+}
+
+// CallerIDName returns the configured caller-ID display name.
+func (s UserSettings) CallerIDName() string {
+	return s.String(SettingCallerIDName)
+}
+
+// CallLimit returns the concurrent call limit, or zero when unlimited.
+func (s UserSettings) CallLimit() int {
+	return s.nonNegative(SettingCallLimit)
+}
+
+// DoNotDisturb reports whether incoming calls should be rejected.
+func (s UserSettings) DoNotDisturb() bool {
+	return s.Bool(SettingDoNotDisturb)
+}
+
+// ForwardTo returns the unconditional forwarding target, or "".
+func (s UserSettings) ForwardTo() string {
+	return s.String(SettingForwardTo)
+}
+
+func (s UserSettings) nonNegative(name string) int {
+	value, ok := s.Int(name)
+	if !ok || value < 0 {
+		return 0
+	}
+	return value
+}
+
+func (s UserSettings) clone() UserSettings {
+	if s == nil {
+		return nil
+	}
+	out := make(UserSettings, len(s))
+	for k, v := range s {
+		out[k] = v
+	}
+	return out
+}
+
+// UserSettings returns every setting stored for a user. Users without
+// settings yield an empty map.
+func (s *SQLStore) UserSettings(ctx context.Context, username, domain string) (UserSettings, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT name, value FROM user_settings WHERE username = ? AND domain = ?`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query), username, domain)
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query user settings: %w", err)
+	}
+	defer rows.Close()
+
+	settings := make(UserSettings)
+	for rows.Next() {
+		var name string
+		var value sql.NullString
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("userdb: scan user setting: %w", err)
+		}
+		settings[name] = value.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate user settings: %w", err)
+	}
+	return settings, nil
+}
+
+// SetUserSetting stores a single setting for a user, replacing any previous
+// value. The user is not checked against the users table so that an LDAPStore
+// can keep settings for directory users here.
+func (s *SQLStore) SetUserSetting(ctx context.Context, username, domain, name, value string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("userdb: setting name is required")
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		const deleteSetting = `DELETE FROM user_settings WHERE username = ? AND domain = ? AND name = ?`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(deleteSetting), username, domain, name); err != nil {
+			return fmt.Errorf("userdb: replace user setting: %w", err)
+		}
+		const insertSetting = `INSERT INTO user_settings (username, domain, name, value) VALUES (?, ?, ?, ?)`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(insertSetting), username, domain, name, value); err != nil {
+			return fmt.Errorf("userdb: store user setting: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteUserSetting removes a setting. Deleting an unset name is not an error.
+func (s *SQLStore) DeleteUserSetting(ctx context.Context, username, domain, name string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM user_settings WHERE username = ? AND domain = ? AND name = ?`
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(query), username, domain, strings.TrimSpace(name)); err != nil {
+		return fmt.Errorf("userdb: delete user setting: %w", err)
+	}
+	s.changes.notify()
+	return nil
+}
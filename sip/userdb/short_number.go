@@ -0,0 +1,199 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrShortNumberNotFound is returned when a short number does not exist.
+var ErrShortNumberNotFound = errors.New("userdb: short number not found")
+
+// ErrShortNumberExists is returned when creating or changing a short number
+// would give a domain the same number twice.
+var ErrShortNumberExists = errors.New("userdb: short number already exists in domain")
+
+// ShortNumber maps a short extension dialed within Domain, such as 100, to
+// the full address of record it stands for, so that phones can dial
+// internal numbers without knowing every URI.
+type ShortNumber struct {
+	ID     int64
+	Domain string
+	Number string
+	// Target is the sip: or sips: URI the number is rewritten to.
+	Target      string
+	Description string
+}
+
+// ValidateShortNumber checks a short number before it is stored. The number
+// may only hold digits, '+', '*', and '#', and the target must be a SIP URI
+// with a user part.
+func ValidateShortNumber(number ShortNumber) error {
+	if number.Domain == "" || strings.ContainsAny(number.Domain, " \t@:;/") {
+		return fmt.Errorf("userdb: short number domain %q is invalid", number.Domain)
+	}
+	if number.Number == "" {
+		return fmt.Errorf("userdb: short number is required")
+	}
+	if !isDialString(number.Number) {
+		return fmt.Errorf("userdb: short number %q may only contain digits, +, *, and #", number.Number)
+	}
+	target, err := ParseContactURI(number.Target)
+	if err != nil {
+		return err
+	}
+	if target.User == "" {
+		return fmt.Errorf("userdb: short number target %q needs a user part", number.Target)
+	}
+	return nil
+}
+
+func normalizeShortNumber(number ShortNumber) ShortNumber {
+	number.Domain = strings.ToLower(strings.TrimSpace(number.Domain))
+	number.Number = strings.TrimSpace(number.Number)
+	number.Target = strings.TrimSpace(number.Target)
+	number.Description = strings.TrimSpace(number.Description)
+	return number
+}
+
+// ListShortNumbers returns every short number ordered by domain and number.
+func (s *SQLStore) ListShortNumbers(ctx context.Context) ([]ShortNumber, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT id, domain, number, target, description FROM short_numbers ORDER BY domain, number, id`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query short numbers: %w", err)
+	}
+	defer rows.Close()
+	var numbers []ShortNumber
+	for rows.Next() {
+		var number ShortNumber
+		var description sql.NullString
+		if err := rows.Scan(&number.ID, &number.Domain, &number.Number, &number.Target, &description); err != nil {
+			return nil, fmt.Errorf("userdb: scan short number: %w", err)
+		}
+		number.Description = description.String
+		numbers = append(numbers, number)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate short numbers: %w", err)
+	}
+	return numbers, nil
+}
+
+// CreateShortNumber stores a new short number and returns it with its
+// assigned ID, or ErrShortNumberExists when its domain already has the
+// number.
+func (s *SQLStore) CreateShortNumber(ctx context.Context, number ShortNumber) (*ShortNumber, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	number = normalizeShortNumber(number)
+	if err := ValidateShortNumber(number); err != nil {
+		return nil, err
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkShortNumberFree(ctx, tx, number, 0); err != nil {
+			return err
+		}
+		const insert = `INSERT INTO short_numbers (domain, number, target, description) VALUES (?, ?, ?, ?)`
+		id, err := s.insertReturningID(ctx, tx, insert, number.Domain, number.Number, number.Target, number.Description)
+		if err != nil {
+			return fmt.Errorf("userdb: create short number: %w", err)
+		}
+		number.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.changes.notify()
+	return &number, nil
+}
+
+// UpdateShortNumber replaces every field of the short number with number.ID.
+func (s *SQLStore) UpdateShortNumber(ctx context.Context, number ShortNumber) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if number.ID <= 0 {
+		return fmt.Errorf("userdb: short number id is required")
+	}
+	number = normalizeShortNumber(number)
+	if err := ValidateShortNumber(number); err != nil {
+		return err
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkShortNumberFree(ctx, tx, number, number.ID); err != nil {
+			return err
+		}
+		const update = `UPDATE short_numbers SET domain = ?, number = ?, target = ?, description = ? WHERE id = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(update), number.Domain, number.Number, number.Target, number.Description, number.ID)
+		if err != nil {
+			return fmt.Errorf("userdb: update short number: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: update short number rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrShortNumberNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteShortNumber removes a short number, returning ErrShortNumberNotFound
+// when absent.
+func (s *SQLStore) DeleteShortNumber(ctx context.Context, id int64) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM short_numbers WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), id)
+	if err != nil {
+		return fmt.Errorf("userdb: delete short number: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: delete short number rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrShortNumberNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// checkShortNumberFree returns ErrShortNumberExists when a short number other
+// than self already has number's domain and number.
+func (s *SQLStore) checkShortNumberFree(ctx context.Context, q sqlQuerier, number ShortNumber, self int64) error {
+	const query = `SELECT id FROM short_numbers WHERE domain = ? AND number = ?`
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(query), number.Domain, number.Number)
+	if err != nil {
+		return fmt.Errorf("userdb: look up short number: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("userdb: scan short number: %w", err)
+		}
+		if id != self {
+			return ErrShortNumberExists
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("userdb: iterate short numbers: %w", err)
+	}
+	return nil
+}
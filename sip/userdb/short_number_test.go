@@ -0,0 +1,76 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSQLStoreShortNumbers(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	changes, cancel := store.Subscribe()
+	defer cancel()
+
+	reception, err := store.CreateShortNumber(ctx, ShortNumber{Domain: " Example.COM ", Number: " 100 ", Target: "sip:reception@example.com", Description: "front desk"})
+	if err != nil {
+		t.Fatalf("CreateShortNumber: %v", err)
+	}
+	if reception.ID == 0 || reception.Domain != "example.com" || reception.Number != "100" {
+		t.Fatalf("unexpected created short number: %+v", reception)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected creating a short number to notify subscribers")
+	}
+	other, err := store.CreateShortNumber(ctx, ShortNumber{Domain: "example.org", Number: "100", Target: "sip:alice@example.org"})
+	if err != nil {
+		t.Fatalf("expected the same number in another domain to be allowed, got %v", err)
+	}
+	if _, err := store.CreateShortNumber(ctx, ShortNumber{Domain: "example.com", Number: "100", Target: "sip:bob@example.com"}); !errors.Is(err, ErrShortNumberExists) {
+		t.Fatalf("expected ErrShortNumberExists for a duplicate number, got %v", err)
+	}
+	for _, bad := range []ShortNumber{
+		{Domain: "", Number: "100", Target: "sip:a@example.com"},
+		{Domain: "example.com", Number: "", Target: "sip:a@example.com"},
+		{Domain: "example.com", Number: "1x", Target: "sip:a@example.com"},
+		{Domain: "example.com", Number: "101", Target: "alice@example.com"},
+		{Domain: "example.com", Number: "101", Target: "sip:example.com"},
+	} {
+		if _, err := store.CreateShortNumber(ctx, bad); err == nil {
+			t.Fatalf("expected short number %+v to be rejected", bad)
+		}
+	}
+
+	other.Domain = "example.com"
+	if err := store.UpdateShortNumber(ctx, *other); !errors.Is(err, ErrShortNumberExists) {
+		t.Fatalf("expected ErrShortNumberExists when moving onto a taken number, got %v", err)
+	}
+	reception.Target = "sip:operator@example.com"
+	if err := store.UpdateShortNumber(ctx, *reception); err != nil {
+		t.Fatalf("UpdateShortNumber: %v", err)
+	}
+	if err := store.UpdateShortNumber(ctx, ShortNumber{ID: 999, Domain: "example.com", Number: "1", Target: "sip:a@example.com"}); !errors.Is(err, ErrShortNumberNotFound) {
+		t.Fatalf("expected ErrShortNumberNotFound, got %v", err)
+	}
+
+	numbers, err := store.ListShortNumbers(ctx)
+	if err != nil {
+		t.Fatalf("ListShortNumbers: %v", err)
+	}
+	if len(numbers) != 2 || numbers[0] != *reception || numbers[1].Domain != "example.org" {
+		t.Fatalf("unexpected short numbers: %+v", numbers)
+	}
+
+	if err := store.DeleteShortNumber(ctx, other.ID); err != nil {
+		t.Fatalf("DeleteShortNumber: %v", err)
+	}
+	if err := store.DeleteShortNumber(ctx, other.ID); !errors.Is(err, ErrShortNumberNotFound) {
+		t.Fatalf("expected ErrShortNumberNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,628 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUserNotFound is returned when a user lookup does not yield any results.
+var ErrUserNotFound = errors.New("userdb: user not found")
+
+// ErrUserExists is returned when creating a user whose username and domain
+// are already taken.
+var ErrUserExists = errors.New("userdb: user already exists")
+
+// ErrBroadcastRuleNotFound indicates that a broadcast ringing rule could not be located.
+var ErrBroadcastRuleNotFound = errors.New("userdb: broadcast rule not found")
+
+// User models a SIP user entry stored in the registrar database. Disabled
+// accounts are kept in the directory but must not register or receive calls;
+// the zero value is an enabled user.
+type User struct {
+	Username     string
+	Domain       string
+	PasswordHash string
+	ContactURI   string
+	Disabled     bool
+}
+
+// SQLStore implements Store on top of database/sql. The dialect controls
+// placeholder syntax so the same queries run against SQLite, PostgreSQL, and
+// MySQL.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+	changes changeFeed
+}
+
+// BroadcastRule describes an address that should ring a collection of downstream contacts.
+type BroadcastRule struct {
+	ID          int64
+	Address     string
+	Description string
+	Targets     []BroadcastTarget
+}
+
+// BroadcastTarget records an individual contact URI associated with a broadcast rule.
+type BroadcastTarget struct {
+	ID         int64
+	RuleID     int64
+	ContactURI string
+	Priority   int
+}
+
+// Close releases the underlying database resources.
+func (s *SQLStore) Close() error {
+	if s == nil || s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Lookup returns a user entry by username and domain.
+func (s *SQLStore) Lookup(ctx context.Context, username, domain string) (*User, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT username, domain, password_hash, contact_uri, enabled FROM users WHERE username = ? AND domain = ? LIMIT 1`
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(query), username, domain)
+	var user User
+	var password sql.NullString
+	var contact sql.NullString
+	var enabled sql.NullString
+	if err := row.Scan(&user.Username, &user.Domain, &password, &contact, &enabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("userdb: lookup user: %w", err)
+	}
+	if password.Valid {
+		user.PasswordHash = password.String
+	}
+	if contact.Valid {
+		user.ContactURI = contact.String
+	}
+	user.Disabled = !enabledFlag(enabled)
+	return &user, nil
+}
+
+// AllUsers returns every user entry stored in the database, ordered by domain
+// and username.
+func (s *SQLStore) AllUsers(ctx context.Context) ([]User, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT username, domain, password_hash, contact_uri, enabled FROM users ORDER BY domain, username`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		var password sql.NullString
+		var contact sql.NullString
+		var enabled sql.NullString
+		if err := rows.Scan(&user.Username, &user.Domain, &password, &contact, &enabled); err != nil {
+			return nil, fmt.Errorf("userdb: scan user: %w", err)
+		}
+		if password.Valid {
+			user.PasswordHash = password.String
+		}
+		if contact.Valid {
+			user.ContactURI = contact.String
+		}
+		user.Disabled = !enabledFlag(enabled)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate users: %w", err)
+	}
+	return users, nil
+}
+
+// CreateUser inserts a new user entry into the database.
+func (s *SQLStore) CreateUser(ctx context.Context, user User) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if strings.TrimSpace(user.Username) == "" {
+		return fmt.Errorf("userdb: username is required")
+	}
+	if strings.TrimSpace(user.Domain) == "" {
+		return fmt.Errorf("userdb: domain is required")
+	}
+	const query = `INSERT INTO users (username, domain, password_hash, contact_uri, enabled) VALUES (?, ?, ?, ?, ?)`
+	if _, err := s.db.ExecContext(ctx, s.dialect.rebind(query), user.Username, user.Domain, user.PasswordHash, user.ContactURI, boolToInt(!user.Disabled)); err != nil {
+		if isUniqueViolation(err) {
+			return ErrUserExists
+		}
+		return fmt.Errorf("userdb: create user: %w", err)
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteUser removes a user entry and its settings from the database.
+func (s *SQLStore) DeleteUser(ctx context.Context, username, domain string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		const query = `DELETE FROM users WHERE username = ? AND domain = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(query), username, domain)
+		if err != nil {
+			return fmt.Errorf("userdb: delete user: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: delete user rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrUserNotFound
+		}
+		const deleteSettings = `DELETE FROM user_settings WHERE username = ? AND domain = ?`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(deleteSettings), username, domain); err != nil {
+			return fmt.Errorf("userdb: delete user settings: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+// UpdatePassword updates the stored password hash for a user.
+func (s *SQLStore) UpdatePassword(ctx context.Context, username, domain, passwordHash string) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `UPDATE users SET password_hash = ? WHERE username = ? AND domain = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), passwordHash, username, domain)
+	if err != nil {
+		return fmt.Errorf("userdb: update password: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update password rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// UpdateUser replaces a user's contact URI and enabled flag and, when
+// user.PasswordHash is non-empty, its password hash.
+func (s *SQLStore) UpdateUser(ctx context.Context, user User) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	query := `UPDATE users SET contact_uri = ?, enabled = ? WHERE username = ? AND domain = ?`
+	args := []any{user.ContactURI, boolToInt(!user.Disabled), user.Username, user.Domain}
+	if user.PasswordHash != "" {
+		query = `UPDATE users SET contact_uri = ?, enabled = ?, password_hash = ? WHERE username = ? AND domain = ?`
+		args = []any{user.ContactURI, boolToInt(!user.Disabled), user.PasswordHash, user.Username, user.Domain}
+	}
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("userdb: update user: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update user rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// SetUserEnabled suspends or reinstates an account without deleting it.
+func (s *SQLStore) SetUserEnabled(ctx context.Context, username, domain string, enabled bool) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `UPDATE users SET enabled = ? WHERE username = ? AND domain = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), boolToInt(enabled), username, domain)
+	if err != nil {
+		return fmt.Errorf("userdb: set user enabled: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: set user enabled rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// UnderlyingDB exposes the raw database handle. It is primarily intended for
+// testing purposes where schema initialisation is required.
+func (s *SQLStore) UnderlyingDB() *sql.DB {
+	if s == nil {
+		return nil
+	}
+	return s.db
+}
+
+// ListBroadcastRules returns all broadcast ringing rules with their associated targets.
+func (s *SQLStore) ListBroadcastRules(ctx context.Context) ([]BroadcastRule, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const rulesQuery = `SELECT id, address, description FROM broadcast_rules ORDER BY address, id`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(rulesQuery))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query broadcast rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []BroadcastRule
+	for rows.Next() {
+		var rule BroadcastRule
+		var description sql.NullString
+		if err := rows.Scan(&rule.ID, &rule.Address, &description); err != nil {
+			return nil, fmt.Errorf("userdb: scan broadcast rule: %w", err)
+		}
+		if description.Valid {
+			rule.Description = description.String
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate broadcast rules: %w", err)
+	}
+	ids := make([]int64, len(rules))
+	for i, rule := range rules {
+		ids[i] = rule.ID
+	}
+	targets, err := s.targetsForRules(ctx, s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Targets = targets[rules[i].ID]
+	}
+	return rules, nil
+}
+
+// CreateBroadcastRule inserts a new broadcast rule and optional targets. The
+// rule and its targets are written in one transaction.
+func (s *SQLStore) CreateBroadcastRule(ctx context.Context, rule BroadcastRule) (*BroadcastRule, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	if strings.TrimSpace(rule.Address) == "" {
+		return nil, fmt.Errorf("userdb: broadcast rule address is required")
+	}
+	var created *BroadcastRule
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		exists, err := s.broadcastRuleIDByAddress(ctx, tx, rule.Address)
+		if err != nil && !errors.Is(err, ErrBroadcastRuleNotFound) {
+			return err
+		}
+		if err == nil && exists > 0 {
+			return fmt.Errorf("userdb: broadcast rule for address %q already exists", rule.Address)
+		}
+		const insertRule = `INSERT INTO broadcast_rules (address, description) VALUES (?, ?)`
+		ruleID, err := s.insertReturningID(ctx, tx, insertRule, rule.Address, rule.Description)
+		if err != nil {
+			return fmt.Errorf("userdb: create broadcast rule: %w", err)
+		}
+		created = &BroadcastRule{ID: ruleID, Address: rule.Address, Description: rule.Description}
+		if len(rule.Targets) == 0 {
+			return nil
+		}
+		if err := s.replaceTargets(ctx, tx, ruleID, rule.Targets); err != nil {
+			return err
+		}
+		targets, err := s.targetsForRule(ctx, tx, ruleID)
+		if err != nil {
+			return err
+		}
+		created.Targets = targets
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.changes.notify()
+	return created, nil
+}
+
+// UpdateBroadcastRule modifies an existing broadcast rule's address or description.
+func (s *SQLStore) UpdateBroadcastRule(ctx context.Context, rule BroadcastRule) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if rule.ID <= 0 {
+		return fmt.Errorf("userdb: broadcast rule id is required")
+	}
+	if strings.TrimSpace(rule.Address) == "" {
+		return fmt.Errorf("userdb: broadcast rule address is required")
+	}
+	const updateRule = `UPDATE broadcast_rules SET address = ?, description = ? WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(updateRule), rule.Address, rule.Description, rule.ID)
+	if err != nil {
+		return fmt.Errorf("userdb: update broadcast rule: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: update broadcast rule rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrBroadcastRuleNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteBroadcastRule removes a broadcast rule and its associated targets in
+// one transaction.
+func (s *SQLStore) DeleteBroadcastRule(ctx context.Context, ruleID int64) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if ruleID <= 0 {
+		return fmt.Errorf("userdb: broadcast rule id is required")
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		const deleteTargets = `DELETE FROM broadcast_targets WHERE rule_id = ?`
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(deleteTargets), ruleID); err != nil {
+			return fmt.Errorf("userdb: delete broadcast targets: %w", err)
+		}
+		const deleteRule = `DELETE FROM broadcast_rules WHERE id = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(deleteRule), ruleID)
+		if err != nil {
+			return fmt.Errorf("userdb: delete broadcast rule: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: delete broadcast rule rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrBroadcastRuleNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+// ReplaceBroadcastTargets overwrites the contact list for the given broadcast
+// rule. Either every target is replaced or, on error, none are. Targets must
+// be valid sip: or sips: URIs (see ParseContactURI).
+func (s *SQLStore) ReplaceBroadcastTargets(ctx context.Context, ruleID int64, targets []BroadcastTarget) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if ruleID <= 0 {
+		return fmt.Errorf("userdb: broadcast rule id is required")
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// Ensure the rule exists before modifying its targets.
+		if _, err := s.broadcastRuleByID(ctx, tx, ruleID); err != nil {
+			return err
+		}
+		return s.replaceTargets(ctx, tx, ruleID, targets)
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+func (s *SQLStore) replaceTargets(ctx context.Context, q sqlQuerier, ruleID int64, targets []BroadcastTarget) error {
+	const deleteTargets = `DELETE FROM broadcast_targets WHERE rule_id = ?`
+	if _, err := q.ExecContext(ctx, s.dialect.rebind(deleteTargets), ruleID); err != nil {
+		return fmt.Errorf("userdb: clear broadcast targets: %w", err)
+	}
+	const insertTarget = `INSERT INTO broadcast_targets (rule_id, contact_uri, priority) VALUES (?, ?, ?)`
+	for i, target := range targets {
+		contact := strings.TrimSpace(target.ContactURI)
+		if contact == "" {
+			return fmt.Errorf("userdb: broadcast target contact URI is required")
+		}
+		if _, err := ParseContactURI(contact); err != nil {
+			return fmt.Errorf("userdb: broadcast target %d: %w", i+1, err)
+		}
+		priority := target.Priority
+		if priority == 0 {
+			priority = i
+		}
+		if _, err := q.ExecContext(ctx, s.dialect.rebind(insertTarget), ruleID, contact, priority); err != nil {
+			return fmt.Errorf("userdb: insert broadcast target: %w", err)
+		}
+	}
+	return nil
+}
+
+// LookupBroadcastTargets returns the contacts configured for the given broadcast address.
+func (s *SQLStore) LookupBroadcastTargets(ctx context.Context, address string) ([]BroadcastTarget, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	ruleID, err := s.broadcastRuleIDByAddress(ctx, s.db, address)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.targetsForRule(ctx, s.db, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+func (s *SQLStore) targetsForRule(ctx context.Context, q sqlQuerier, ruleID int64) ([]BroadcastTarget, error) {
+	const targetsQuery = `SELECT id, rule_id, contact_uri, priority FROM broadcast_targets WHERE rule_id = ? ORDER BY priority, id`
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(targetsQuery), ruleID)
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query broadcast targets: %w", err)
+	}
+	defer rows.Close()
+
+	var targets []BroadcastTarget
+	for rows.Next() {
+		var target BroadcastTarget
+		if err := rows.Scan(&target.ID, &target.RuleID, &target.ContactURI, &target.Priority); err != nil {
+			return nil, fmt.Errorf("userdb: scan broadcast target: %w", err)
+		}
+		targets = append(targets, target)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate broadcast targets: %w", err)
+	}
+	return targets, nil
+}
+
+// maxInListSize bounds the placeholders in one IN list so batched lookups
+// stay within every backend's bind-parameter limit.
+const maxInListSize = 500
+
+// targetsForRules loads the targets of every listed rule with one IN query
+// per maxInListSize rules, keyed by rule ID and ordered by priority within
+// each rule.
+func (s *SQLStore) targetsForRules(ctx context.Context, q sqlQuerier, ruleIDs []int64) (map[int64][]BroadcastTarget, error) {
+	targets := make(map[int64][]BroadcastTarget, len(ruleIDs))
+	for start := 0; start < len(ruleIDs); start += maxInListSize {
+		batch := ruleIDs[start:min(start+maxInListSize, len(ruleIDs))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		query := `SELECT id, rule_id, contact_uri, priority FROM broadcast_targets WHERE rule_id IN (` + inPlaceholders(len(batch)) + `) ORDER BY priority, id`
+		rows, err := q.QueryContext(ctx, s.dialect.rebind(query), args...)
+		if err != nil {
+			return nil, fmt.Errorf("userdb: query broadcast targets: %w", err)
+		}
+		for rows.Next() {
+			var target BroadcastTarget
+			if err := rows.Scan(&target.ID, &target.RuleID, &target.ContactURI, &target.Priority); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("userdb: scan broadcast target: %w", err)
+			}
+			targets[target.RuleID] = append(targets[target.RuleID], target)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("userdb: iterate broadcast targets: %w", err)
+		}
+	}
+	return targets, nil
+}
+
+// inPlaceholders returns "?, ?, ..." with n placeholders for an IN list.
+func inPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (s *SQLStore) broadcastRuleIDByAddress(ctx context.Context, q sqlQuerier, address string) (int64, error) {
+	const query = `SELECT id FROM broadcast_rules WHERE address = ? LIMIT 1`
+	row := q.QueryRowContext(ctx, s.dialect.rebind(query), address)
+	var id int64
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrBroadcastRuleNotFound
+		}
+		return 0, fmt.Errorf("userdb: lookup broadcast rule id: %w", err)
+	}
+	return id, nil
+}
+
+func (s *SQLStore) broadcastRuleByID(ctx context.Context, q sqlQuerier, id int64) (*BroadcastRule, error) {
+	const query = `SELECT id, address, description FROM broadcast_rules WHERE id = ? LIMIT 1`
+	row := q.QueryRowContext(ctx, s.dialect.rebind(query), id)
+	var rule BroadcastRule
+	var description sql.NullString
+	if err := row.Scan(&rule.ID, &rule.Address, &description); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrBroadcastRuleNotFound
+		}
+		return nil, fmt.Errorf("userdb: lookup broadcast rule: %w", err)
+	}
+	if description.Valid {
+		rule.Description = description.String
+	}
+	return &rule, nil
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx so that helpers can run
+// standalone or as part of a larger transaction.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insertReturningID runs an INSERT into a table with an auto-increment id
+// column and returns the new row's id. PostgreSQL drivers do not implement
+// LastInsertId, so there the statement is extended with RETURNING id.
+func (s *SQLStore) insertReturningID(ctx context.Context, q sqlQuerier, query string, args ...any) (int64, error) {
+	if s.dialect == DialectPostgres {
+		var id int64
+		if err := q.QueryRowContext(ctx, s.dialect.rebind(query+` RETURNING id`), args...).Scan(&id); err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+	res, err := q.ExecContext(ctx, s.dialect.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// withTx runs fn inside a transaction, committing when it returns nil and
+// rolling back otherwise. Statements inside fn must go through tx: SQLite
+// pools hold a single connection, so touching s.db would deadlock.
+func (s *SQLStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("userdb: begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("userdb: commit transaction: %w", err)
+	}
+	return nil
+}
+
+// enabledFlag interprets the users.enabled column. Rows written before the
+// column existed may read back empty, which counts as enabled.
+func enabledFlag(value sql.NullString) bool {
+	if !value.Valid {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(value.String)) {
+	case "0", "false", "f":
+		return false
+	}
+	return true
+}
+
+func boolToInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -7,8 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -17,6 +18,10 @@ func init() {
 	sql.Register("sqlite", &memoryDriver{databases: make(map[string]*memoryDatabase)})
 }
 
+// memoryDriver serves every connection to the same datasource name from one
+// shared memoryDatabase. In-memory databases live for the life of the process;
+// file-backed ones are loaded on first open and dropped once their last
+// connection closes, so a later open reads the file afresh.
 type memoryDriver struct {
 	mu        sync.Mutex
 	databases map[string]*memoryDatabase
@@ -25,24 +30,66 @@ type memoryDriver struct {
 func (d *memoryDriver) Open(name string) (driver.Conn, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	db := d.databases[name]
+	key := name
+	path := memoryDatabasePath(name)
+	if path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		key = "file:" + path
+	}
+	db := d.databases[key]
 	if db == nil {
-		db = newMemoryDatabase()
-		d.databases[name] = db
+		if path == "" {
+			db = newMemoryDatabase()
+		} else {
+			loaded, err := loadMemoryDatabase(path)
+			if err != nil {
+				return nil, err
+			}
+			db = loaded
+		}
+		d.databases[key] = db
+	}
+	db.conns++
+	return &memoryConn{db: db, release: func() { d.release(key, db) }}, nil
+}
+
+func (d *memoryDriver) release(key string, db *memoryDatabase) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db.conns--
+	if db.conns <= 0 && db.path != "" && d.databases[key] == db {
+		delete(d.databases, key)
+		db.closeLog()
 	}
-	return &memoryConn{db: db}, nil
 }
 
 type memoryConn struct {
-	db *memoryDatabase
+	db      *memoryDatabase
+	release func()
+	closed  bool
+	tx      *memoryTx
+	// replaying marks the internal connection that re-applies the
+	// write-ahead log on open; its statements are not logged again.
+	replaying bool
 }
 
 func (c *memoryConn) Prepare(query string) (driver.Stmt, error) {
-	return &memoryStmt{db: c.db, query: query}, nil
+	return &memoryStmt{conn: c, query: query}, nil
+}
+
+func (c *memoryConn) Close() error {
+	if c.tx != nil {
+		c.tx.Rollback()
+	}
+	if !c.closed && c.release != nil {
+		c.closed = true
+		c.release()
+	}
+	return nil
 }
 
-func (c *memoryConn) Close() error                   { return nil }
-func (c *memoryConn) Begin() (driver.Tx, error)      { return nil, errors.New("transactions not supported") }
 func (c *memoryConn) Ping(ctx context.Context) error { return nil }
 
 func (c *memoryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
@@ -58,38 +105,55 @@ func (c *memoryConn) exec(query string, args []driver.NamedValue) (driver.Result
 	if err != nil {
 		return nil, err
 	}
+	var entry *walEntry
+	if _, isSelect := stmt.(selectStmt); !isSelect {
+		defer c.lockWrite()()
+		if entry, err = c.logEntry(query, args); err != nil {
+			return nil, err
+		}
+	}
 	switch s := stmt.(type) {
 	case createTableStmt:
-		if err := c.db.createTable(s); err != nil {
+		if err := c.db.createTable(s, entry); err != nil {
+			return nil, err
+		}
+		return memoryResult{}, nil
+	case alterTableStmt:
+		if err := c.db.addColumn(s, entry); err != nil {
 			return nil, err
 		}
 		return memoryResult{}, nil
 	case insertStmt:
-		bound, err := bindInsertValues(s.values, args)
+		bound, err := bindInsertValues(s.tokens, args)
 		if err != nil {
 			return nil, err
 		}
 		s.values = bound
-		if err := c.db.insertRow(s); err != nil {
+		inserted, _, err := c.db.insertRow(s, entry)
+		if err != nil {
 			return nil, err
 		}
-		return memoryResult{rowsAffected: int64(len(s.values))}, nil
+		result := memoryResult{rowsAffected: int64(len(inserted))}
+		if len(inserted) > 0 {
+			result.lastInsertID, result.hasLastInsertID = inserted[len(inserted)-1]["id"].(int64)
+		}
+		return result, nil
 	case updateStmt:
-		setValues, whereValues, err := bindUpdateArgs(s, args)
+		setValues, where, err := bindUpdateArgs(s, args)
 		if err != nil {
 			return nil, err
 		}
-		affected, err := c.db.updateRows(s, setValues, whereValues)
+		affected, err := c.db.updateRows(s, setValues, where, entry)
 		if err != nil {
 			return nil, err
 		}
 		return memoryResult{rowsAffected: affected}, nil
 	case deleteStmt:
-		whereValues, err := bindDeleteArgs(s, args)
+		where, err := bindDeleteArgs(s, args)
 		if err != nil {
 			return nil, err
 		}
-		affected, err := c.db.deleteRows(s, whereValues)
+		affected, err := c.db.deleteRows(s, where, entry)
 		if err != nil {
 			return nil, err
 		}
@@ -107,15 +171,45 @@ func (c *memoryConn) query(query string, args []driver.NamedValue) (driver.Rows,
 	if err != nil {
 		return nil, err
 	}
-	sel, ok := stmt.(selectStmt)
-	if !ok {
-		return nil, fmt.Errorf("statement is not a SELECT")
-	}
-	values := make([]string, len(args))
-	for i, arg := range args {
-		values[i] = fmt.Sprint(arg.Value)
+	var columns []string
+	var rows [][]any
+	switch s := stmt.(type) {
+	case selectStmt:
+		bound, err := bindSelectArgs(s, args)
+		if err != nil {
+			return nil, err
+		}
+		columns, rows = c.db.selectRows(bound)
+	case insertStmt:
+		if s.returning == nil {
+			return nil, fmt.Errorf("INSERT without RETURNING requires Exec")
+		}
+		bound, err := bindInsertValues(s.tokens, args)
+		if err != nil {
+			return nil, err
+		}
+		s.values = bound
+		entry, err := c.logEntry(query, args)
+		if err != nil {
+			return nil, err
+		}
+		unlock := c.lockWrite()
+		inserted, returning, err := c.db.insertRow(s, entry)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+		columns = returning
+		for _, stored := range inserted {
+			row := make([]any, len(columns))
+			for i, col := range columns {
+				row[i] = stored[col]
+			}
+			rows = append(rows, row)
+		}
+	default:
+		return nil, fmt.Errorf("statement is not a SELECT or INSERT ... RETURNING")
 	}
-	rows := c.db.selectRows(sel, values)
 	data := make([][]driver.Value, len(rows))
 	for i, row := range rows {
 		record := make([]driver.Value, len(row))
@@ -124,11 +218,22 @@ func (c *memoryConn) query(query string, args []driver.NamedValue) (driver.Rows,
 		}
 		data[i] = record
 	}
-	return &memoryRows{columns: sel.columns, data: data}, nil
+	return &memoryRows{columns: columns, data: data}, nil
+}
+
+// lockWrite serialises a write outside a transaction against any open
+// transaction on another connection, so a rollback cannot discard it. It
+// returns the matching unlock, which is a no-op inside a transaction.
+func (c *memoryConn) lockWrite() func() {
+	if c.tx != nil {
+		return func() {}
+	}
+	c.db.writeMu.Lock()
+	return c.db.writeMu.Unlock
 }
 
 type memoryStmt struct {
-	db    *memoryDatabase
+	conn  *memoryConn
 	query string
 }
 
@@ -140,7 +245,7 @@ func (s *memoryStmt) Exec(args []driver.Value) (driver.Result, error) {
 	for i, v := range args {
 		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
 	}
-	return (&memoryConn{db: s.db}).exec(s.query, named)
+	return s.conn.exec(s.query, named)
 }
 
 func (s *memoryStmt) Query(args []driver.Value) (driver.Rows, error) {
@@ -148,7 +253,7 @@ func (s *memoryStmt) Query(args []driver.Value) (driver.Rows, error) {
 	for i, v := range args {
 		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
 	}
-	return (&memoryConn{db: s.db}).query(s.query, named)
+	return s.conn.query(s.query, named)
 }
 
 type memoryRows struct {
@@ -179,64 +284,261 @@ func (r *memoryRows) Next(dest []driver.Value) error {
 
 type memoryResult struct {
 	rowsAffected int64
+	// lastInsertID is the id of the last row inserted by the statement, set
+	// only for INSERTs into a table with an integer id column.
+	lastInsertID    int64
+	hasLastInsertID bool
 }
 
-func (r memoryResult) LastInsertId() (int64, error) { return 0, errors.New("not supported") }
+func (r memoryResult) LastInsertId() (int64, error) {
+	if !r.hasLastInsertID {
+		return 0, errors.New("LastInsertId is only available after inserting into a table with an id column")
+	}
+	return r.lastInsertID, nil
+}
 func (r memoryResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
 
 type memoryDatabase struct {
 	mu     sync.RWMutex
 	tables map[string]*memoryTable
+	// writeMu is held by an open transaction for its whole lifetime and
+	// briefly by every write outside one, serialising writers.
+	writeMu sync.Mutex
+	// inTx defers persistence until the open transaction commits; guarded
+	// by mu.
+	inTx bool
+	// path is the backing file, or "" for a purely in-memory database.
+	path string
+	// Write-ahead log state; see sqlite_wal.go. All fields are guarded by mu.
+	wal        *os.File
+	walSize    int64
+	walSeq     uint64
+	walRecords int
+	// txLog buffers the statements of the open transaction until Commit
+	// writes them to the log as one record.
+	txLog []walEntry
+	// replaying is set while the log is re-applied on open.
+	replaying bool
+	// conns counts open connections; guarded by memoryDriver.mu.
+	conns int
 }
 
 type memoryTable struct {
-	columns       []string
-	rows          []map[string]string
+	columns []string
+	// types holds each column's declared type. It is nil for tables loaded
+	// from a version 1 snapshot, which predates typed values.
+	types         map[string]string
+	rows          []map[string]any
 	autoIncrement int64
+	// uniqueKeys lists the column sets declared PRIMARY KEY or UNIQUE.
+	uniqueKeys [][]string
+	// defaults holds the DEFAULT value of each column that declares one.
+	defaults map[string]any
+}
+
+// affinity returns the type affinity of the named column.
+func (t *memoryTable) affinity(column string) columnAffinity {
+	return affinityOf(t.types[column])
+}
+
+// checkUnique reports a SQLite-style constraint error when two of rows share
+// the same values for any unique key. As in SQLite, a row whose key includes a
+// NULL never conflicts.
+func (t *memoryTable) checkUnique(table string, rows []map[string]any) error {
+	for _, key := range t.uniqueKeys {
+		seen := make(map[string]struct{}, len(rows))
+		for _, row := range rows {
+			values := make([]string, len(key))
+			null := false
+			for i, col := range key {
+				v := row[col]
+				if v == nil {
+					null = true
+					break
+				}
+				values[i] = uniqueKeyPart(v)
+			}
+			if null {
+				continue
+			}
+			joined := strings.Join(values, "\x00")
+			if _, dup := seen[joined]; dup {
+				qualified := make([]string, len(key))
+				for i, col := range key {
+					qualified[i] = table + "." + col
+				}
+				return fmt.Errorf("UNIQUE constraint failed: %s", strings.Join(qualified, ", "))
+			}
+			seen[joined] = struct{}{}
+		}
+	}
+	return nil
 }
 
 func newMemoryDatabase() *memoryDatabase {
 	return &memoryDatabase{tables: make(map[string]*memoryTable)}
 }
 
-func (db *memoryDatabase) createTable(stmt createTableStmt) error {
+func (db *memoryDatabase) createTable(stmt createTableStmt, entry *walEntry) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	if _, ok := db.tables[stmt.name]; ok {
-		return fmt.Errorf("table %s already exists", stmt.name)
+	if existing, ok := db.tables[stmt.name]; ok {
+		if !stmt.ifNotExists {
+			return fmt.Errorf("table %s already exists", stmt.name)
+		}
+		if existing.types == nil {
+			return db.upgradeLegacyTableLocked(stmt, existing, entry)
+		}
+		return nil
 	}
-	db.tables[stmt.name] = &memoryTable{columns: stmt.columns}
-	return nil
+	db.tables[stmt.name] = &memoryTable{columns: stmt.columns, types: stmt.types, uniqueKeys: stmt.uniqueKeys, defaults: stmt.defaults}
+	return db.commitLocked(stmt.name, nil, entry)
 }
 
-func (db *memoryDatabase) insertRow(stmt insertStmt) error {
+// upgradeLegacyTableLocked adopts the column types and constraints of stmt for
+// a table loaded from a version 1 snapshot, which stored neither. Existing
+// values are converted to their column's affinity. Columns added later by
+// ALTER TABLE are kept as untyped without a default, and phantom columns that the old parser
+// created from table-level constraints are dropped. Constraints the stored
+// rows already violate are not adopted. The caller holds db.mu.
+func (db *memoryDatabase) upgradeLegacyTableLocked(stmt createTableStmt, table *memoryTable, entry *walEntry) error {
+	before := db.snapshotLocked(stmt.name)
+	types := make(map[string]string, len(stmt.types))
+	for col, typ := range stmt.types {
+		types[col] = typ
+	}
+	columns := append([]string(nil), stmt.columns...)
+	for _, col := range table.columns {
+		switch strings.ToUpper(col) {
+		case "PRIMARY", "UNIQUE", "CONSTRAINT", "FOREIGN", "CHECK":
+			continue
+		}
+		if _, ok := types[col]; !ok {
+			columns = append(columns, col)
+			types[col] = ""
+		}
+	}
+	for _, row := range table.rows {
+		for col, v := range row {
+			if _, ok := types[col]; !ok {
+				delete(row, col)
+				continue
+			}
+			row[col] = affinityOf(types[col]).apply(v)
+		}
+	}
+	table.columns = columns
+	table.types = types
+	table.defaults = stmt.defaults
+	if (&memoryTable{uniqueKeys: stmt.uniqueKeys}).checkUnique(stmt.name, table.rows) == nil {
+		table.uniqueKeys = stmt.uniqueKeys
+	}
+	return db.commitLocked(stmt.name, before, entry)
+}
+
+// addColumn appends a column to the table. Existing rows take the column's
+// default, or NULL without one. As in SQLite, the new column may not be
+// PRIMARY KEY or UNIQUE, and a NOT NULL column needs a non-NULL default.
+func (db *memoryDatabase) addColumn(stmt alterTableStmt, entry *walEntry) error {
+	col := stmt.column
+	switch {
+	case col.unique:
+		return fmt.Errorf("Cannot add a UNIQUE or PRIMARY KEY column")
+	case col.notNull && col.defaultValue == nil:
+		return fmt.Errorf("Cannot add a NOT NULL column with default value NULL")
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	table, ok := db.tables[stmt.table]
 	if !ok {
 		return fmt.Errorf("table %s does not exist", stmt.table)
 	}
+	if table.hasColumn(col.name) {
+		return fmt.Errorf("duplicate column name: %s", col.name)
+	}
+	before := db.snapshotLocked(stmt.table)
+	table.columns = append(table.columns, col.name)
+	if table.types != nil {
+		table.types[col.name] = col.declaredType
+	}
+	if col.hasDefault {
+		if table.defaults == nil {
+			table.defaults = make(map[string]any)
+		}
+		table.defaults[col.name] = col.defaultValue
+		if value := table.affinity(col.name).apply(col.defaultValue); value != nil {
+			for _, row := range table.rows {
+				row[col.name] = value
+			}
+		}
+	}
+	return db.commitLocked(stmt.table, before, entry)
+}
+
+// insertRow appends the statement's rows and returns them as stored,
+// together with the resolved RETURNING column list ("*" expanded).
+func (db *memoryDatabase) insertRow(stmt insertStmt, entry *walEntry) ([]map[string]any, []string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	table, ok := db.tables[stmt.table]
+	if !ok {
+		return nil, nil, fmt.Errorf("table %s does not exist", stmt.table)
+	}
 	for _, vals := range stmt.values {
 		if len(vals) != len(stmt.columns) {
-			return fmt.Errorf("column count mismatch")
+			return nil, nil, fmt.Errorf("column count mismatch")
+		}
+	}
+	for _, col := range stmt.columns {
+		if !table.hasColumn(col) {
+			return nil, nil, fmt.Errorf("table %s has no column named %s", stmt.table, col)
+		}
+	}
+	returning := stmt.returning
+	if len(returning) == 1 && returning[0] == "*" {
+		returning = append([]string(nil), table.columns...)
+	}
+	for _, col := range returning {
+		if !table.hasColumn(col) {
+			return nil, nil, fmt.Errorf("no such column: %s", col)
+		}
+	}
+	before := db.snapshotLocked(stmt.table)
+	rows := append([]map[string]any(nil), table.rows...)
+	autoIncrement := table.autoIncrement
+	for _, vals := range stmt.values {
+		row := make(map[string]any, len(table.columns))
+		for col, value := range table.defaults {
+			if value != nil {
+				row[col] = table.affinity(col).apply(value)
+			}
 		}
-		row := make(map[string]string, len(stmt.columns))
 		for i, col := range stmt.columns {
-			row[col] = vals[i]
+			row[col] = table.affinity(col).apply(vals[i])
 		}
 		if table.hasColumn("id") {
-			if raw, ok := row["id"]; ok {
-				if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n > table.autoIncrement {
-					table.autoIncrement = n
+			// A NULL id is assigned the next value, as for SQLite's
+			// INTEGER PRIMARY KEY.
+			if id := row["id"]; id != nil {
+				if n, ok := id.(int64); ok && n > autoIncrement {
+					autoIncrement = n
 				}
 			} else {
-				table.autoIncrement++
-				row["id"] = strconv.FormatInt(table.autoIncrement, 10)
+				autoIncrement++
+				row["id"] = autoIncrement
 			}
 		}
-		table.rows = append(table.rows, row)
+		rows = append(rows, row)
 	}
-	return nil
+	if err := table.checkUnique(stmt.table, rows); err != nil {
+		return nil, nil, err
+	}
+	table.rows = rows
+	table.autoIncrement = autoIncrement
+	if err := db.commitLocked(stmt.table, before, entry); err != nil {
+		return nil, nil, err
+	}
+	return rows[len(rows)-len(stmt.values):], returning, nil
 }
 
 func (t *memoryTable) hasColumn(name string) bool {
@@ -248,7 +550,7 @@ func (t *memoryTable) hasColumn(name string) bool {
 	return false
 }
 
-func (db *memoryDatabase) updateRows(stmt updateStmt, setValues, whereValues []string) (int64, error) {
+func (db *memoryDatabase) updateRows(stmt updateStmt, setValues []any, where []condition, entry *walEntry) (int64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	table, ok := db.tables[stmt.table]
@@ -258,40 +560,52 @@ func (db *memoryDatabase) updateRows(stmt updateStmt, setValues, whereValues []s
 	if len(stmt.setColumns) != len(setValues) {
 		return 0, fmt.Errorf("update column/value mismatch")
 	}
-	where := make(map[string]string, len(stmt.whereColumns))
-	for i, col := range stmt.whereColumns {
-		if i < len(whereValues) {
-			where[col] = whereValues[i]
+	before := db.snapshotLocked(stmt.table)
+	var affected int64
+	for _, col := range stmt.setColumns {
+		if !table.hasColumn(col) {
+			return 0, fmt.Errorf("no such column: %s", col)
 		}
 	}
-	var affected int64
-	for _, row := range table.rows {
+	rows := make([]map[string]any, len(table.rows))
+	for i, row := range table.rows {
+		rows[i] = row
 		if !rowMatches(row, where) {
 			continue
 		}
-		for i, col := range stmt.setColumns {
-			row[col] = setValues[i]
+		updated := make(map[string]any, len(row)+len(stmt.setColumns))
+		for col, value := range row {
+			updated[col] = value
+		}
+		for j, col := range stmt.setColumns {
+			updated[col] = table.affinity(col).apply(setValues[j])
 		}
+		rows[i] = updated
 		affected++
 	}
+	if affected == 0 {
+		return 0, nil
+	}
+	if err := table.checkUnique(stmt.table, rows); err != nil {
+		return 0, err
+	}
+	table.rows = rows
+	if err := db.commitLocked(stmt.table, before, entry); err != nil {
+		return 0, err
+	}
 	return affected, nil
 }
 
-func (db *memoryDatabase) deleteRows(stmt deleteStmt, whereValues []string) (int64, error) {
+func (db *memoryDatabase) deleteRows(stmt deleteStmt, where []condition, entry *walEntry) (int64, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	table, ok := db.tables[stmt.table]
 	if !ok {
 		return 0, fmt.Errorf("table %s does not exist", stmt.table)
 	}
-	where := make(map[string]string, len(stmt.whereColumns))
-	for i, col := range stmt.whereColumns {
-		if i < len(whereValues) {
-			where[col] = whereValues[i]
-		}
-	}
+	before := db.snapshotLocked(stmt.table)
 	var affected int64
-	kept := make([]map[string]string, 0, len(table.rows))
+	kept := make([]map[string]any, 0, len(table.rows))
 	for _, row := range table.rows {
 		if rowMatches(row, where) {
 			affected++
@@ -299,86 +613,151 @@ func (db *memoryDatabase) deleteRows(stmt deleteStmt, whereValues []string) (int
 		}
 		kept = append(kept, row)
 	}
+	if affected == 0 {
+		return 0, nil
+	}
 	table.rows = kept
+	if err := db.commitLocked(stmt.table, before, entry); err != nil {
+		return 0, err
+	}
 	return affected, nil
 }
 
-func (db *memoryDatabase) selectRows(stmt selectStmt, args []string) [][]string {
+// selectRows returns the resolved column list, which expands "*" to the
+// table's columns, together with the matching rows after ORDER BY, OFFSET,
+// and LIMIT have been applied. An aggregate query yields one row computed
+// over every matching row, to which OFFSET and LIMIT still apply. stmt must
+// already be bound.
+func (db *memoryDatabase) selectRows(stmt selectStmt) ([]string, [][]any) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	table, ok := db.tables[stmt.table]
 	if !ok {
-		return nil
-	}
-	var rows [][]string
-	argMap := make(map[string]string, len(stmt.whereColumns))
-	for i, col := range stmt.whereColumns {
-		if i < len(args) {
-			argMap[col] = args[i]
-		}
+		return stmt.columns, nil
 	}
 	requestedColumns := stmt.columns
 	if len(requestedColumns) == 0 {
 		requestedColumns = table.columns
 	}
+	// Without ORDER BY the scan can stop as soon as the window is filled.
+	stopAt := -1
+	if len(stmt.orderBy) == 0 && len(stmt.aggregates) == 0 && stmt.limit >= 0 {
+		stopAt = stmt.offset + stmt.limit
+	}
+	var matched []map[string]any
 	for _, stored := range table.rows {
-		if len(argMap) > 0 {
-			matched := true
-			for col, expected := range argMap {
-				if stored[col] != expected {
-					matched = false
-					break
-				}
-			}
-			if !matched {
-				continue
-			}
+		if stopAt >= 0 && len(matched) >= stopAt {
+			break
 		}
-		row := make([]string, len(requestedColumns))
-		for i, col := range requestedColumns {
-			row[i] = stored[col]
+		if rowMatches(stored, stmt.where) {
+			matched = append(matched, stored)
 		}
-		rows = append(rows, row)
-		if stmt.limitOne && len(rows) == 1 {
-			break
+	}
+	if len(stmt.aggregates) > 0 {
+		if stmt.offset > 0 || stmt.limit == 0 {
+			return stmt.columns, nil
+		}
+		row := make([]any, len(stmt.aggregates))
+		for i, agg := range stmt.aggregates {
+			row[i] = agg.compute(matched)
+		}
+		return stmt.columns, [][]any{row}
+	}
+	if len(stmt.orderBy) > 0 {
+		sortRows(matched, stmt.orderBy)
+	}
+	if stmt.offset >= len(matched) {
+		return requestedColumns, nil
+	}
+	matched = matched[stmt.offset:]
+	if stmt.limit >= 0 && stmt.limit < len(matched) {
+		matched = matched[:stmt.limit]
+	}
+	rows := make([][]any, len(matched))
+	for i, stored := range matched {
+		row := make([]any, len(requestedColumns))
+		for j, col := range requestedColumns {
+			row[j] = stored[col]
 		}
+		rows[i] = row
 	}
-	return rows
+	return requestedColumns, rows
 }
 
 type createTableStmt struct {
-	name    string
-	columns []string
+	name        string
+	columns     []string
+	types       map[string]string
+	uniqueKeys  [][]string
+	defaults    map[string]any
+	ifNotExists bool
 }
 
+type alterTableStmt struct {
+	table  string
+	column columnDef
+}
+
+// columnDef is one parsed column definition. Constraints other than
+// PRIMARY KEY, UNIQUE, NOT NULL, and DEFAULT are ignored.
+type columnDef struct {
+	name         string
+	declaredType string
+	unique       bool
+	notNull      bool
+	hasDefault   bool
+	defaultValue any
+}
+
+// insertStmt holds the raw value tokens of each tuple ("?" for a
+// placeholder) until bindInsertValues turns them into values.
 type insertStmt struct {
 	table   string
 	columns []string
-	values  [][]string
+	tokens  [][]string
+	values  [][]any
+	// returning lists the RETURNING columns, or is nil without the clause.
+	returning []string
 }
 
 type updateStmt struct {
-	table        string
-	setColumns   []string
-	setValues    []string
-	whereColumns []string
+	table      string
+	setColumns []string
+	// setTokens holds the raw assignment operands; see insertStmt.
+	setTokens []string
+	where     []condition
 }
 
 type deleteStmt struct {
-	table        string
-	whereColumns []string
+	table string
+	where []condition
 }
 
 type selectStmt struct {
-	columns      []string
-	table        string
-	whereColumns []string
-	limitOne     bool
+	columns []string
+	table   string
+	where   []condition
+	orderBy []orderTerm
+	// aggregates is set when every result column is an aggregate; columns
+	// then holds their names.
+	aggregates []aggregate
+	// limitArg and offsetArg hold the raw LIMIT/OFFSET operands ("" when
+	// absent, "?" for a placeholder); bindSelectArgs resolves them into
+	// limit (-1 for no limit) and offset.
+	limitArg  string
+	offsetArg string
+	limit     int
+	offset    int
 }
 
 var (
-	createTableRegex = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*\((.+)\)$`)
-	insertRegex      = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*\(([^)]+)\)\s+VALUES\s*(.+)$`)
+	createTableRegex     = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(IF\s+NOT\s+EXISTS\s+)?([a-zA-Z_][a-zA-Z0-9_]*)\s*\((.+)\)$`)
+	alterTableRegex      = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+([a-zA-Z_][a-zA-Z0-9_]*)\s+ADD\s+(?:COLUMN\s+)?([a-zA-Z_][a-zA-Z0-9_]*(?:\s.*)?)$`)
+	tableConstraintRegex = regexp.MustCompile(`(?is)^(?:CONSTRAINT\s+[a-zA-Z_][a-zA-Z0-9_]*\s+)?(PRIMARY\s+KEY|UNIQUE|FOREIGN\s+KEY|CHECK)\b\s*(?:\(([^)]*)\))?`)
+	columnKeyRegex       = regexp.MustCompile(`(?i)\s(PRIMARY\s+KEY|UNIQUE)\b`)
+	columnDefaultRegex   = regexp.MustCompile(`(?is)\sDEFAULT\s+('(?:[^']|'')*'|"(?:[^"]|"")*"|\([^)]*\)|[^\s]+)`)
+	notNullRegex         = regexp.MustCompile(`(?i)\sNOT\s+NULL\b`)
+	insertRegex          = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+([a-zA-Z_][a-zA-Z0-9_]*)\s*\(([^)]+)\)\s+VALUES\s*(.+)$`)
 )
 
 func parseSQL(query string) (interface{}, error) {
@@ -387,6 +766,9 @@ func parseSQL(query string) (interface{}, error) {
 	if strings.HasPrefix(strings.ToUpper(trimmed), "CREATE TABLE") {
 		return parseCreateTable(trimmed)
 	}
+	if strings.HasPrefix(strings.ToUpper(trimmed), "ALTER TABLE") {
+		return parseAlterTable(trimmed)
+	}
 	if strings.HasPrefix(strings.ToUpper(trimmed), "INSERT INTO") {
 		return parseInsert(trimmed)
 	}
@@ -404,13 +786,17 @@ func parseSQL(query string) (interface{}, error) {
 
 func parseCreateTable(query string) (createTableStmt, error) {
 	matches := createTableRegex.FindStringSubmatch(query)
-	if len(matches) != 3 {
+	if len(matches) != 4 {
 		return createTableStmt{}, fmt.Errorf("invalid CREATE TABLE syntax")
 	}
-	name := matches[1]
-	colsSegment := matches[2]
+	ifNotExists := strings.TrimSpace(matches[1]) != ""
+	name := matches[2]
+	colsSegment := matches[3]
 	colDefs := splitComma(colsSegment)
 	columns := make([]string, 0, len(colDefs))
+	types := make(map[string]string, len(colDefs))
+	var uniqueKeys [][]string
+	var defaults map[string]any
 	for _, def := range colDefs {
 		def = strings.TrimSpace(def)
 		if def == "" {
@@ -420,12 +806,103 @@ func parseCreateTable(query string) (createTableStmt, error) {
 		if len(fields) == 0 {
 			continue
 		}
-		columns = append(columns, fields[0])
+		if key, isConstraint, err := parseTableConstraint(def); isConstraint {
+			if err != nil {
+				return createTableStmt{}, err
+			}
+			if key != nil {
+				uniqueKeys = append(uniqueKeys, key)
+			}
+			continue
+		}
+		col, err := parseColumnDef(def)
+		if err != nil {
+			return createTableStmt{}, err
+		}
+		if col.unique {
+			uniqueKeys = append(uniqueKeys, []string{col.name})
+		}
+		if col.hasDefault {
+			if defaults == nil {
+				defaults = make(map[string]any)
+			}
+			defaults[col.name] = col.defaultValue
+		}
+		columns = append(columns, col.name)
+		types[col.name] = col.declaredType
 	}
 	if len(columns) == 0 {
 		return createTableStmt{}, fmt.Errorf("no columns defined")
 	}
-	return createTableStmt{name: name, columns: columns}, nil
+	return createTableStmt{name: name, columns: columns, types: types, uniqueKeys: uniqueKeys, defaults: defaults, ifNotExists: ifNotExists}, nil
+}
+
+// parseTableConstraint recognises table-level constraints such as
+// "PRIMARY KEY (a, b)" or "CONSTRAINT name UNIQUE (a)". PRIMARY KEY and UNIQUE
+// yield their key columns; FOREIGN KEY and CHECK are accepted but not
+// enforced and yield a nil key.
+func parseTableConstraint(def string) ([]string, bool, error) {
+	matches := tableConstraintRegex.FindStringSubmatch(def)
+	if matches == nil {
+		return nil, false, nil
+	}
+	kind := strings.ToUpper(strings.Join(strings.Fields(matches[1]), " "))
+	if kind != "PRIMARY KEY" && kind != "UNIQUE" {
+		return nil, true, nil
+	}
+	var key []string
+	for _, col := range splitComma(matches[2]) {
+		if col = strings.TrimSpace(col); col != "" {
+			key = append(key, col)
+		}
+	}
+	if len(key) == 0 {
+		return nil, true, fmt.Errorf("invalid %s constraint", kind)
+	}
+	return key, true, nil
+}
+
+// parseAlterTable accepts ALTER TABLE ... ADD [COLUMN] name [definition].
+func parseAlterTable(query string) (alterTableStmt, error) {
+	matches := alterTableRegex.FindStringSubmatch(query)
+	if len(matches) != 3 {
+		return alterTableStmt{}, fmt.Errorf("invalid ALTER TABLE syntax")
+	}
+	col, err := parseColumnDef(matches[2])
+	if err != nil {
+		return alterTableStmt{}, err
+	}
+	return alterTableStmt{table: matches[1], column: col}, nil
+}
+
+// parseColumnDef parses "name [type] [constraints]". A DEFAULT must be a
+// constant literal, optionally parenthesised: the write-ahead log replays
+// statements, so a default such as CURRENT_TIMESTAMP would not come back
+// with the value first stored.
+func parseColumnDef(def string) (columnDef, error) {
+	def = strings.TrimSpace(def)
+	fields := strings.Fields(def)
+	if len(fields) == 0 {
+		return columnDef{}, fmt.Errorf("empty column definition")
+	}
+	col := columnDef{name: fields[0], declaredType: declaredType(fields[1:])}
+	constraints := def
+	if matches := columnDefaultRegex.FindStringSubmatchIndex(def); matches != nil {
+		literal := strings.TrimSpace(def[matches[2]:matches[3]])
+		for len(literal) >= 2 && literal[0] == '(' && literal[len(literal)-1] == ')' {
+			literal = strings.TrimSpace(literal[1 : len(literal)-1])
+		}
+		value, err := parseLiteral(literal)
+		if err != nil {
+			return columnDef{}, fmt.Errorf("column %s: non-constant DEFAULT is not supported: %w", col.name, err)
+		}
+		col.hasDefault = true
+		col.defaultValue = value
+		constraints = def[:matches[0]] + def[matches[1]:]
+	}
+	col.unique = columnKeyRegex.MatchString(constraints)
+	col.notNull = notNullRegex.MatchString(constraints)
+	return col, nil
 }
 
 func parseInsert(query string) (insertStmt, error) {
@@ -439,11 +916,23 @@ func parseInsert(query string) (insertStmt, error) {
 		columns[i] = strings.TrimSpace(col)
 	}
 	valuesPart := strings.TrimSpace(matches[3])
+	var returning []string
+	if idx := indexKeyword(valuesPart, "RETURNING"); idx != -1 {
+		for _, col := range splitComma(valuesPart[idx+len("RETURNING"):]) {
+			if col = strings.TrimSpace(col); col != "" {
+				returning = append(returning, col)
+			}
+		}
+		if len(returning) == 0 {
+			return insertStmt{}, fmt.Errorf("empty RETURNING clause")
+		}
+		valuesPart = strings.TrimSpace(valuesPart[:idx])
+	}
 	if !strings.HasPrefix(valuesPart, "(") {
 		return insertStmt{}, fmt.Errorf("invalid INSERT values")
 	}
 	tuples := splitTuples(valuesPart)
-	values := make([][]string, 0, len(tuples))
+	tokens := make([][]string, 0, len(tuples))
 	for _, tuple := range tuples {
 		fields := splitComma(tuple)
 		if len(fields) != len(columns) {
@@ -451,11 +940,17 @@ func parseInsert(query string) (insertStmt, error) {
 		}
 		row := make([]string, len(columns))
 		for i, value := range fields {
-			row[i] = unquote(strings.TrimSpace(value))
+			row[i] = strings.TrimSpace(value)
+			if row[i] == "?" {
+				continue
+			}
+			if _, err := parseLiteral(row[i]); err != nil {
+				return insertStmt{}, err
+			}
 		}
-		values = append(values, row)
+		tokens = append(tokens, row)
 	}
-	return insertStmt{table: table, columns: columns, values: values}, nil
+	return insertStmt{table: table, columns: columns, tokens: tokens, returning: returning}, nil
 }
 
 func parseUpdate(query string) (updateStmt, error) {
@@ -470,16 +965,16 @@ func parseUpdate(query string) (updateStmt, error) {
 	}
 	table := strings.TrimSpace(remainder[:setIdx])
 	remainder = strings.TrimSpace(remainder[setIdx+len(" SET "):])
-	whereIdx := strings.Index(strings.ToUpper(remainder), " WHERE ")
+	whereIdx := indexKeyword(remainder, "WHERE")
 	assignments := remainder
 	whereClause := ""
 	if whereIdx != -1 {
 		assignments = strings.TrimSpace(remainder[:whereIdx])
-		whereClause = strings.TrimSpace(remainder[whereIdx+len(" WHERE "):])
+		whereClause = strings.TrimSpace(remainder[whereIdx+len("WHERE"):])
 	}
 	parts := splitComma(assignments)
 	setColumns := make([]string, 0, len(parts))
-	setValues := make([]string, 0, len(parts))
+	setTokens := make([]string, 0, len(parts))
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
 		if part == "" {
@@ -489,17 +984,23 @@ func parseUpdate(query string) (updateStmt, error) {
 		if len(pieces) != 2 {
 			continue
 		}
+		token := strings.TrimSpace(pieces[1])
+		if token != "?" {
+			if _, err := parseLiteral(token); err != nil {
+				return updateStmt{}, err
+			}
+		}
 		setColumns = append(setColumns, strings.TrimSpace(pieces[0]))
-		setValues = append(setValues, strings.TrimSpace(pieces[1]))
+		setTokens = append(setTokens, token)
 	}
 	if len(setColumns) == 0 {
 		return updateStmt{}, fmt.Errorf("no columns to update")
 	}
-	whereColumns := []string{}
-	if whereClause != "" {
-		whereColumns = parseWhere(whereClause)
+	where, err := parseWhere(whereClause)
+	if err != nil {
+		return updateStmt{}, err
 	}
-	return updateStmt{table: table, setColumns: setColumns, setValues: setValues, whereColumns: whereColumns}, nil
+	return updateStmt{table: table, setColumns: setColumns, setTokens: setTokens, where: where}, nil
 }
 
 func parseDelete(query string) (deleteStmt, error) {
@@ -509,29 +1010,39 @@ func parseDelete(query string) (deleteStmt, error) {
 	}
 	remainder := strings.TrimSpace(query[len("DELETE FROM "):])
 	table := remainder
-	whereColumns := []string{}
-	if idx := strings.Index(strings.ToUpper(remainder), " WHERE "); idx != -1 {
+	var where []condition
+	if idx := indexKeyword(remainder, "WHERE"); idx != -1 {
 		table = strings.TrimSpace(remainder[:idx])
-		clause := strings.TrimSpace(remainder[idx+len(" WHERE "):])
-		whereColumns = parseWhere(clause)
+		var err error
+		where, err = parseWhere(remainder[idx+len("WHERE"):])
+		if err != nil {
+			return deleteStmt{}, err
+		}
+	}
+	return deleteStmt{table: table, where: where}, nil
+}
+
+// bindToken resolves one value token, taking the next argument for a "?".
+func bindToken(token string, args []driver.NamedValue, argIdx int) (any, int, error) {
+	if token == "?" {
+		if argIdx >= len(args) {
+			return nil, argIdx, fmt.Errorf("missing argument for placeholder")
+		}
+		return normalizeArg(args[argIdx].Value), argIdx + 1, nil
 	}
-	return deleteStmt{table: table, whereColumns: whereColumns}, nil
+	v, err := parseLiteral(token)
+	return v, argIdx, err
 }
 
-func bindInsertValues(values [][]string, args []driver.NamedValue) ([][]string, error) {
-	bound := make([][]string, len(values))
+func bindInsertValues(tokens [][]string, args []driver.NamedValue) ([][]any, error) {
+	bound := make([][]any, len(tokens))
 	argIdx := 0
-	for i, tuple := range values {
-		row := make([]string, len(tuple))
-		for j, val := range tuple {
-			if val == "?" {
-				if argIdx >= len(args) {
-					return nil, fmt.Errorf("missing argument for INSERT placeholder")
-				}
-				row[j] = fmt.Sprint(args[argIdx].Value)
-				argIdx++
-			} else {
-				row[j] = val
+	for i, tuple := range tokens {
+		row := make([]any, len(tuple))
+		for j, token := range tuple {
+			var err error
+			if row[j], argIdx, err = bindToken(token, args, argIdx); err != nil {
+				return nil, err
 			}
 		}
 		bound[i] = row
@@ -542,116 +1053,118 @@ func bindInsertValues(values [][]string, args []driver.NamedValue) ([][]string,
 	return bound, nil
 }
 
-func bindUpdateArgs(stmt updateStmt, args []driver.NamedValue) ([]string, []string, error) {
-	setValues := make([]string, len(stmt.setValues))
+func bindUpdateArgs(stmt updateStmt, args []driver.NamedValue) ([]any, []condition, error) {
+	setValues := make([]any, len(stmt.setTokens))
 	argIdx := 0
-	for i, raw := range stmt.setValues {
-		if raw == "?" {
-			if argIdx >= len(args) {
-				return nil, nil, fmt.Errorf("missing argument for UPDATE placeholder")
-			}
-			setValues[i] = fmt.Sprint(args[argIdx].Value)
-			argIdx++
-		} else {
-			setValues[i] = unquote(raw)
+	for i, token := range stmt.setTokens {
+		var err error
+		if setValues[i], argIdx, err = bindToken(token, args, argIdx); err != nil {
+			return nil, nil, err
 		}
 	}
-	whereValues := make([]string, len(stmt.whereColumns))
-	for i := range whereValues {
-		if argIdx >= len(args) {
-			return nil, nil, fmt.Errorf("missing argument for UPDATE WHERE placeholder")
-		}
-		whereValues[i] = fmt.Sprint(args[argIdx].Value)
-		argIdx++
+	where, argIdx, err := bindConditions(stmt.where, args, argIdx)
+	if err != nil {
+		return nil, nil, err
 	}
 	if argIdx != len(args) {
 		return nil, nil, fmt.Errorf("unexpected argument count for UPDATE")
 	}
-	return setValues, whereValues, nil
+	return setValues, where, nil
 }
 
-func bindDeleteArgs(stmt deleteStmt, args []driver.NamedValue) ([]string, error) {
-	whereValues := make([]string, len(stmt.whereColumns))
-	if len(args) != len(stmt.whereColumns) {
+func bindDeleteArgs(stmt deleteStmt, args []driver.NamedValue) ([]condition, error) {
+	where, argIdx, err := bindConditions(stmt.where, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if argIdx != len(args) {
 		return nil, fmt.Errorf("unexpected argument count for DELETE")
 	}
-	for i := range whereValues {
-		whereValues[i] = fmt.Sprint(args[i].Value)
+	return where, nil
+}
+
+// bindSelectArgs resolves the WHERE, LIMIT, and OFFSET placeholders of stmt
+// in that order.
+func bindSelectArgs(stmt selectStmt, args []driver.NamedValue) (selectStmt, error) {
+	where, argIdx, err := bindConditions(stmt.where, args, 0)
+	if err != nil {
+		return selectStmt{}, err
+	}
+	stmt.where = where
+	if stmt.limit, argIdx, err = bindCount(stmt.limitArg, -1, args, argIdx); err != nil {
+		return selectStmt{}, err
+	}
+	if stmt.offset, argIdx, err = bindCount(stmt.offsetArg, 0, args, argIdx); err != nil {
+		return selectStmt{}, err
+	}
+	if stmt.offset < 0 {
+		stmt.offset = 0
 	}
-	return whereValues, nil
+	if argIdx != len(args) {
+		return selectStmt{}, fmt.Errorf("unexpected argument count for SELECT")
+	}
+	return stmt, nil
 }
 
 func parseSelect(query string) (selectStmt, error) {
-	upper := strings.ToUpper(query)
-	fromIdx := strings.Index(upper, " FROM ")
+	fromIdx := indexKeyword(query, "FROM")
 	if fromIdx == -1 {
 		return selectStmt{}, fmt.Errorf("missing FROM clause")
 	}
 	columnsPart := strings.TrimSpace(query[len("SELECT"):fromIdx])
-	remainder := strings.TrimSpace(query[fromIdx+len(" FROM "):])
-	table := remainder
-	whereColumns := []string{}
-	limitOne := false
-	if idx := strings.Index(strings.ToUpper(remainder), " WHERE "); idx != -1 {
-		table = strings.TrimSpace(remainder[:idx])
-		remainder = strings.TrimSpace(remainder[idx+len(" WHERE "):])
-		if whereEnd := strings.Index(strings.ToUpper(remainder), " LIMIT "); whereEnd != -1 {
-			whereClause := strings.TrimSpace(remainder[:whereEnd])
-			remainder = strings.TrimSpace(remainder[whereEnd+len(" LIMIT "):])
-			limitOne = parseLimit(remainder)
-			whereColumns = parseWhere(whereClause)
-		} else {
-			whereColumns = parseWhere(remainder)
-			remainder = ""
+	remainder := strings.TrimSpace(query[fromIdx+len("FROM"):])
+	stmt := selectStmt{}
+
+	// Peel the optional clauses off the end so each one only sees its own
+	// text: LIMIT, then ORDER BY, then WHERE.
+	if idx := indexKeyword(remainder, "LIMIT"); idx != -1 {
+		limit, offset, err := parseLimitClause(remainder[idx+len("LIMIT"):])
+		if err != nil {
+			return selectStmt{}, err
 		}
-	} else if idx := strings.Index(strings.ToUpper(remainder), " LIMIT "); idx != -1 {
-		table = strings.TrimSpace(remainder[:idx])
-		remainder = strings.TrimSpace(remainder[idx+len(" LIMIT "):])
-		limitOne = parseLimit(remainder)
+		stmt.limitArg, stmt.offsetArg = limit, offset
+		remainder = strings.TrimSpace(remainder[:idx])
+	}
+	if idx := indexKeyword(remainder, "ORDER BY"); idx != -1 {
+		// indexKeyword matched "ORDER <space> BY"; skip both words.
+		clause := strings.TrimSpace(remainder[idx+len("ORDER"):])
+		orderBy, err := parseOrderBy(clause[len("BY"):])
+		if err != nil {
+			return selectStmt{}, err
+		}
+		stmt.orderBy = orderBy
+		remainder = strings.TrimSpace(remainder[:idx])
+	}
+	stmt.table = remainder
+	if idx := indexKeyword(remainder, "WHERE"); idx != -1 {
+		stmt.table = strings.TrimSpace(remainder[:idx])
+		where, err := parseWhere(remainder[idx+len("WHERE"):])
+		if err != nil {
+			return selectStmt{}, err
+		}
+		stmt.where = where
 	}
 	columns := splitComma(columnsPart)
 	for i, col := range columns {
 		columns[i] = strings.TrimSpace(col)
+		agg, name, ok, err := parseAggregate(columns[i])
+		if err != nil {
+			return selectStmt{}, err
+		}
+		if ok {
+			stmt.aggregates = append(stmt.aggregates, agg)
+			columns[i] = name
+		}
+	}
+	if len(stmt.aggregates) > 0 && len(stmt.aggregates) != len(columns) {
+		return selectStmt{}, fmt.Errorf("aggregate and plain result columns cannot be mixed without GROUP BY")
 	}
 	if len(columns) == 1 && columns[0] == "*" {
 		// We'll expand at runtime based on table definition
 		columns = nil
 	}
-	return selectStmt{columns: columns, table: table, whereColumns: whereColumns, limitOne: limitOne}, nil
-}
-
-func parseLimit(part string) bool {
-	part = strings.TrimSpace(part)
-	if part == "" {
-		return false
-	}
-	if strings.HasPrefix(part, "(") {
-		part = strings.TrimSpace(strings.Trim(part, "()"))
-	}
-	value, err := strconv.Atoi(part)
-	if err != nil {
-		return false
-	}
-	return value == 1
-}
-
-func parseWhere(clause string) []string {
-	clause = strings.TrimSpace(clause)
-	if clause == "" {
-		return nil
-	}
-	conditions := strings.Split(clause, "AND")
-	columns := make([]string, 0, len(conditions))
-	for _, cond := range conditions {
-		cond = strings.TrimSpace(cond)
-		parts := strings.Split(cond, "=")
-		if len(parts) != 2 {
-			continue
-		}
-		column := strings.TrimSpace(parts[0])
-		columns = append(columns, column)
-	}
-	return columns
+	stmt.columns = columns
+	return stmt, nil
 }
 
 func splitComma(input string) []string {
@@ -737,15 +1250,3 @@ func unquote(value string) string {
 	value = strings.ReplaceAll(value, "\"\"", "\"")
 	return value
 }
-
-func rowMatches(row map[string]string, conditions map[string]string) bool {
-	if len(conditions) == 0 {
-		return true
-	}
-	for col, expected := range conditions {
-		if row[col] != expected {
-			return false
-		}
-	}
-	return true
-}
@@ -0,0 +1,314 @@
+package userdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// memorySnapshotVersion identifies the on-disk layout written by the embedded
+// driver so that future formats can be told apart. Version 1 stored every
+// value as a string and recorded no column types; it is still read.
+const memorySnapshotVersion = 2
+
+type memorySnapshot struct {
+	Version int `json:"version"`
+	// WALSequence is the last write-ahead log record folded into the
+	// snapshot; replay skips records up to it.
+	WALSequence uint64                         `json:"wal_sequence,omitempty"`
+	Tables      map[string]memoryTableSnapshot `json:"tables"`
+}
+
+// memoryTableSnapshot is one table on disk. Row values are JSON null,
+// numbers, or strings, matching the NULL, INTEGER/REAL, and TEXT storage
+// classes.
+type memoryTableSnapshot struct {
+	Columns       []string                     `json:"columns"`
+	Types         map[string]string            `json:"types,omitempty"`
+	Rows          []map[string]json.RawMessage `json:"rows"`
+	AutoIncrement int64                        `json:"auto_increment"`
+	UniqueKeys    [][]string                   `json:"unique_keys,omitempty"`
+	Defaults      map[string]json.RawMessage   `json:"defaults,omitempty"`
+}
+
+// memoryDatabasePath maps a datasource name onto the file that backs it.
+// ":memory:", empty names, and "file:" URIs with mode=memory stay purely in
+// memory and yield "". Anything else is treated as a filesystem path, with an
+// optional "file:" prefix and query string stripped.
+func memoryDatabasePath(dsn string) string {
+	dsn = strings.TrimSpace(dsn)
+	if dsn == "" || dsn == ":memory:" {
+		return ""
+	}
+	path, rawQuery, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if query, err := url.ParseQuery(rawQuery); err == nil && strings.EqualFold(query.Get("mode"), "memory") {
+		return ""
+	}
+	if path == "" || path == ":memory:" {
+		return ""
+	}
+	return path
+}
+
+// loadMemoryDatabase opens the database stored at path, starting from an
+// empty one when the snapshot does not exist yet, and replays the write-ahead
+// log on top.
+func loadMemoryDatabase(path string) (*memoryDatabase, error) {
+	db := newMemoryDatabase()
+	db.path = path
+	if err := db.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := db.replayLog(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *memoryDatabase) loadSnapshot() error {
+	path := db.path
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read database %s: %w", path, err)
+	}
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("database %s is corrupt: %w", path, err)
+	}
+	if snapshot.Version != 1 && snapshot.Version != memorySnapshotVersion {
+		return fmt.Errorf("database %s has unsupported format version %d", path, snapshot.Version)
+	}
+	for name, table := range snapshot.Tables {
+		loaded := &memoryTable{
+			columns:       table.Columns,
+			types:         table.Types,
+			rows:          make([]map[string]any, len(table.Rows)),
+			autoIncrement: table.AutoIncrement,
+			uniqueKeys:    table.UniqueKeys,
+		}
+		if snapshot.Version >= 2 && loaded.types == nil {
+			loaded.types = make(map[string]string)
+		}
+		for col, rawValue := range table.Defaults {
+			v, err := decodeSnapshotValue(rawValue)
+			if err != nil {
+				return fmt.Errorf("database %s is corrupt: table %s default for %s: %w", path, name, col, err)
+			}
+			if loaded.defaults == nil {
+				loaded.defaults = make(map[string]any, len(table.Defaults))
+			}
+			loaded.defaults[col] = v
+		}
+		for i, row := range table.Rows {
+			decoded := make(map[string]any, len(row))
+			for col, rawValue := range row {
+				v, err := decodeSnapshotValue(rawValue)
+				if err != nil {
+					return fmt.Errorf("database %s is corrupt: table %s: %w", path, name, err)
+				}
+				decoded[col] = v
+			}
+			loaded.rows[i] = decoded
+		}
+		db.tables[name] = loaded
+	}
+	db.walSeq = snapshot.WALSequence
+	return nil
+}
+
+// decodeSnapshotValue turns one stored JSON value back into a storage class.
+// Integers are told apart from reals by the absence of a fraction or
+// exponent, which strconv.FormatFloat always writes for reals.
+func decodeSnapshotValue(raw json.RawMessage) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	switch n := v.(type) {
+	case nil, string:
+		return n, nil
+	case json.Number:
+		if !strings.ContainsAny(n.String(), ".eE") {
+			return n.Int64()
+		}
+		return n.Float64()
+	}
+	return nil, fmt.Errorf("unsupported value %s", raw)
+}
+
+// encodeSnapshotValue renders a stored value as JSON. Reals always carry a
+// fraction or exponent so that decodeSnapshotValue reads them back as reals.
+func encodeSnapshotValue(v any) (json.RawMessage, error) {
+	if f, ok := v.(float64); ok {
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("cannot store %v", f)
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return json.RawMessage(s), nil
+	}
+	return json.Marshal(v)
+}
+
+// persistLocked writes the whole database to its snapshot file. The snapshot
+// is written to a temporary file, synced, and renamed over the previous one so
+// a crash leaves either the old or the new contents. The caller holds db.mu.
+func (db *memoryDatabase) persistLocked() error {
+	if db.path == "" {
+		return nil
+	}
+	snapshot := memorySnapshot{Version: memorySnapshotVersion, WALSequence: db.walSeq, Tables: make(map[string]memoryTableSnapshot, len(db.tables))}
+	for name, table := range db.tables {
+		rows := make([]map[string]json.RawMessage, len(table.rows))
+		for i, row := range table.rows {
+			encoded := make(map[string]json.RawMessage, len(row))
+			for col, v := range row {
+				raw, err := encodeSnapshotValue(v)
+				if err != nil {
+					return fmt.Errorf("encode database: table %s column %s: %w", name, col, err)
+				}
+				encoded[col] = raw
+			}
+			rows[i] = encoded
+		}
+		var defaults map[string]json.RawMessage
+		for col, v := range table.defaults {
+			raw, err := encodeSnapshotValue(v)
+			if err != nil {
+				return fmt.Errorf("encode database: table %s default for %s: %w", name, col, err)
+			}
+			if defaults == nil {
+				defaults = make(map[string]json.RawMessage, len(table.defaults))
+			}
+			defaults[col] = raw
+		}
+		snapshot.Tables[name] = memoryTableSnapshot{Columns: table.columns, Types: table.types, Rows: rows, AutoIncrement: table.autoIncrement, UniqueKeys: table.uniqueKeys, Defaults: defaults}
+	}
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("encode database: %w", err)
+	}
+	dir := filepath.Dir(db.path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(db.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("write database %s: %w", db.path, err)
+	}
+	tmpName := tmp.Name()
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("write database %s: %w", db.path, err)
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		return cleanup(err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("write database %s: %w", db.path, err)
+	}
+	if err := os.Rename(tmpName, db.path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("write database %s: %w", db.path, err)
+	}
+	// Syncing the directory makes the rename itself durable; not every
+	// platform allows it, so failures are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// commitLocked makes a mutation of the named table durable by appending entry
+// to the write-ahead log. If the append fails the table is restored to
+// before, which is nil for a table that was just created, so memory never
+// runs ahead of disk. Inside a transaction the entry is buffered until
+// Commit. A nil entry, used for in-memory databases and while replaying the
+// log, needs no logging. The caller holds db.mu.
+func (db *memoryDatabase) commitLocked(name string, before *memoryTable, entry *walEntry) error {
+	if entry == nil {
+		return nil
+	}
+	if db.inTx {
+		db.txLog = append(db.txLog, *entry)
+		return nil
+	}
+	err := db.appendLogLocked([]walEntry{*entry})
+	if err == nil {
+		return nil
+	}
+	if before == nil {
+		delete(db.tables, name)
+	} else {
+		db.tables[name] = before
+	}
+	return err
+}
+
+// snapshotLocked returns a deep copy of the named table for commitLocked, or
+// nil when no rollback copy is needed because the database is not file-backed,
+// a transaction already holds one, or the log is being replayed.
+func (db *memoryDatabase) snapshotLocked(name string) *memoryTable {
+	if db.path == "" || db.inTx || db.replaying {
+		return nil
+	}
+	table, ok := db.tables[name]
+	if !ok {
+		return nil
+	}
+	return table.clone()
+}
+
+func (t *memoryTable) clone() *memoryTable {
+	rows := make([]map[string]any, len(t.rows))
+	for i, row := range t.rows {
+		copied := make(map[string]any, len(row))
+		for k, v := range row {
+			copied[k] = v
+		}
+		rows[i] = copied
+	}
+	var types map[string]string
+	if t.types != nil {
+		types = make(map[string]string, len(t.types))
+		for col, typ := range t.types {
+			types[col] = typ
+		}
+	}
+	var defaults map[string]any
+	if t.defaults != nil {
+		defaults = make(map[string]any, len(t.defaults))
+		for col, v := range t.defaults {
+			defaults[col] = v
+		}
+	}
+	return &memoryTable{
+		columns:       append([]string(nil), t.columns...),
+		types:         types,
+		rows:          rows,
+		autoIncrement: t.autoIncrement,
+		uniqueKeys:    t.uniqueKeys,
+		defaults:      defaults,
+	}
+}
@@ -0,0 +1,580 @@
+package userdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// condition is one predicate of a WHERE clause. Predicates are joined with
+// AND; OR is only supported inside a parenthesised group of simple
+// predicates, such as "(a LIKE ? OR b LIKE ?)".
+type condition struct {
+	column string
+	// op is one of =, !=, <, <=, >, >=, LIKE, NOT LIKE, IS NULL, IS NOT NULL,
+	// IN, NOT IN.
+	op string
+	// value holds the literal operand, or the bound argument once
+	// placeholder has been resolved. For IN and NOT IN it holds the bound
+	// []any list.
+	value       any
+	placeholder bool
+	// list holds the raw IN list tokens ("?" for a placeholder) until
+	// bindConditions resolves them into value.
+	list []string
+	// anyOf holds the alternatives of an OR group, in which case the other
+	// fields are unused and the condition holds when any alternative does.
+	anyOf []condition
+}
+
+// orderTerm is one ORDER BY key.
+type orderTerm struct {
+	column string
+	desc   bool
+}
+
+// aggregate is one aggregate result column: COUNT(*), COUNT(col), MIN(col),
+// MAX(col), or SUM(col). A SELECT made of aggregates yields a single row
+// computed over every matching row; GROUP BY is not supported.
+type aggregate struct {
+	fn string
+	// column is empty for COUNT(*).
+	column string
+}
+
+var (
+	aggregateRegex = regexp.MustCompile(`(?is)^(COUNT|MIN|MAX|SUM)\s*\(\s*(\*|[a-zA-Z_][a-zA-Z0-9_]*)\s*\)$`)
+	aliasRegex     = regexp.MustCompile(`(?is)^(.+?)\s+AS\s+([a-zA-Z_][a-zA-Z0-9_]*)$`)
+	conditionRegex = regexp.MustCompile(`(?is)^([a-zA-Z_][a-zA-Z0-9_]*)\s*(IS\s+NOT\s+NULL|IS\s+NULL|NOT\s+LIKE|LIKE|NOT\s+IN|IN|<=|>=|<>|!=|==|=|<|>)\s*(.*)$`)
+	andRegex       = regexp.MustCompile(`(?i)\sAND\s`)
+	orRegex        = regexp.MustCompile(`(?i)\sOR\s`)
+)
+
+// parseWhere splits a WHERE clause into its AND-ed predicates.
+func parseWhere(clause string) ([]condition, error) {
+	clause = strings.TrimSpace(clause)
+	if clause == "" {
+		return nil, nil
+	}
+	var conditions []condition
+	for _, part := range splitOutsideQuotes(clause, andRegex) {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "(") || !strings.HasSuffix(part, ")") {
+			cond, err := parseCondition(part)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, cond)
+			continue
+		}
+		var group condition
+		for _, alt := range splitOutsideQuotes(part[1:len(part)-1], orRegex) {
+			cond, err := parseCondition(strings.TrimSpace(alt))
+			if err != nil {
+				return nil, err
+			}
+			group.anyOf = append(group.anyOf, cond)
+		}
+		conditions = append(conditions, group)
+	}
+	return conditions, nil
+}
+
+// parseCondition parses a single predicate such as "col = ?".
+func parseCondition(part string) (condition, error) {
+	matches := conditionRegex.FindStringSubmatch(part)
+	if matches == nil {
+		return condition{}, fmt.Errorf("unsupported WHERE condition %q", part)
+	}
+	cond := condition{column: matches[1], op: strings.ToUpper(strings.Join(strings.Fields(matches[2]), " "))}
+	switch cond.op {
+	case "<>":
+		cond.op = "!="
+	case "==":
+		cond.op = "="
+	}
+	operand := strings.TrimSpace(matches[3])
+	switch {
+	case cond.op == "IS NULL" || cond.op == "IS NOT NULL":
+		if operand != "" {
+			return condition{}, fmt.Errorf("unsupported WHERE condition %q", part)
+		}
+	case cond.op == "IN" || cond.op == "NOT IN":
+		list, err := parseInList(operand)
+		if err != nil {
+			return condition{}, fmt.Errorf("unsupported WHERE condition %q: %w", part, err)
+		}
+		cond.list = list
+	case operand == "?":
+		cond.placeholder = true
+	case operand == "":
+		return condition{}, fmt.Errorf("missing operand in WHERE condition %q", part)
+	default:
+		value, err := parseLiteral(operand)
+		if err != nil {
+			return condition{}, fmt.Errorf("unsupported WHERE condition %q: %w", part, err)
+		}
+		cond.value = value
+	}
+	return cond, nil
+}
+
+// parseInList parses the parenthesised operand of IN into its element
+// tokens, each a ? placeholder or a literal. An empty list is allowed, as in
+// SQLite.
+func parseInList(operand string) ([]string, error) {
+	if len(operand) < 2 || operand[0] != '(' || operand[len(operand)-1] != ')' {
+		return nil, fmt.Errorf("IN requires a parenthesised list")
+	}
+	inner := strings.TrimSpace(operand[1 : len(operand)-1])
+	if inner == "" {
+		return []string{}, nil
+	}
+	list := splitComma(inner)
+	for i, token := range list {
+		token = strings.TrimSpace(token)
+		if token != "?" {
+			if _, err := parseLiteral(token); err != nil {
+				return nil, err
+			}
+		}
+		list[i] = token
+	}
+	return list, nil
+}
+
+// parseOrderBy parses "col [ASC|DESC], ...".
+func parseOrderBy(clause string) ([]orderTerm, error) {
+	var terms []orderTerm
+	for _, part := range splitComma(clause) {
+		fields := strings.Fields(part)
+		switch {
+		case len(fields) == 1:
+			terms = append(terms, orderTerm{column: fields[0]})
+		case len(fields) == 2 && strings.EqualFold(fields[1], "ASC"):
+			terms = append(terms, orderTerm{column: fields[0]})
+		case len(fields) == 2 && strings.EqualFold(fields[1], "DESC"):
+			terms = append(terms, orderTerm{column: fields[0], desc: true})
+		default:
+			return nil, fmt.Errorf("unsupported ORDER BY term %q", strings.TrimSpace(part))
+		}
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty ORDER BY clause")
+	}
+	return terms, nil
+}
+
+// parseLimitClause parses "N [OFFSET M]" or "M, N". Either operand may be a
+// ? placeholder, bound when the statement runs.
+func parseLimitClause(clause string) (limit, offset string, err error) {
+	clause = strings.TrimSpace(clause)
+	if parts := splitComma(clause); len(parts) == 2 {
+		offset, limit = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	} else if idx := indexKeyword(clause, "OFFSET"); idx != -1 {
+		limit = strings.TrimSpace(clause[:idx])
+		offset = strings.TrimSpace(clause[idx+len("OFFSET"):])
+	} else {
+		limit = clause
+	}
+	limit = strings.TrimSpace(strings.Trim(limit, "()"))
+	for _, operand := range []string{limit, offset} {
+		if operand == "" || operand == "?" {
+			continue
+		}
+		if _, err := strconv.Atoi(operand); err != nil {
+			return "", "", fmt.Errorf("invalid LIMIT clause %q", clause)
+		}
+	}
+	if limit == "" {
+		return "", "", fmt.Errorf("invalid LIMIT clause %q", clause)
+	}
+	return limit, offset, nil
+}
+
+// parseAggregate recognises an aggregate result column, optionally renamed
+// with AS. Without an alias the column is named after the expression as
+// written, as in SQLite.
+func parseAggregate(expr string) (aggregate, string, bool, error) {
+	name := expr
+	if matches := aliasRegex.FindStringSubmatch(expr); matches != nil {
+		expr, name = strings.TrimSpace(matches[1]), matches[2]
+	}
+	matches := aggregateRegex.FindStringSubmatch(expr)
+	if matches == nil {
+		return aggregate{}, "", false, nil
+	}
+	agg := aggregate{fn: strings.ToUpper(matches[1]), column: matches[2]}
+	if agg.column == "*" {
+		if agg.fn != "COUNT" {
+			return aggregate{}, "", false, fmt.Errorf("%s(*) is not supported", agg.fn)
+		}
+		agg.column = ""
+	}
+	return agg, name, true, nil
+}
+
+// compute evaluates the aggregate over rows. NULLs are skipped, so COUNT(col)
+// counts non-NULL values and MIN, MAX, and SUM of no values are NULL. SUM
+// stays an INTEGER until it meets a REAL; text that reads as a number is
+// summed as one and other text counts as zero, as in SQLite.
+func (a aggregate) compute(rows []map[string]any) any {
+	if a.fn == "COUNT" {
+		if a.column == "" {
+			return int64(len(rows))
+		}
+		var n int64
+		for _, row := range rows {
+			if row[a.column] != nil {
+				n++
+			}
+		}
+		return n
+	}
+	var result any
+	for _, row := range rows {
+		v := row[a.column]
+		if v == nil {
+			continue
+		}
+		switch {
+		case result == nil && a.fn != "SUM":
+			result = v
+		case a.fn == "MIN":
+			if compareValues(v, result) < 0 {
+				result = v
+			}
+		case a.fn == "MAX":
+			if compareValues(v, result) > 0 {
+				result = v
+			}
+		case a.fn == "SUM":
+			num, ok := numericValue(v)
+			if !ok {
+				if num, ok = parseNumber(valueText(v)); !ok {
+					num = int64(0)
+				}
+			}
+			if result == nil {
+				result = int64(0)
+			}
+			x, xInt := result.(int64)
+			y, yInt := num.(int64)
+			if xInt && yInt && (y <= 0 || x <= math.MaxInt64-y) && (y >= 0 || x >= math.MinInt64-y) {
+				result = x + y
+			} else {
+				result = toFloat(result) + toFloat(num)
+			}
+		}
+	}
+	return result
+}
+
+// bindConditions fills placeholder operands from args starting at argIdx and
+// returns the bound conditions with the index of the next unused argument.
+func bindConditions(conds []condition, args []driver.NamedValue, argIdx int) ([]condition, int, error) {
+	bound := make([]condition, len(conds))
+	for i, cond := range conds {
+		if cond.anyOf != nil {
+			var err error
+			if cond.anyOf, argIdx, err = bindConditions(cond.anyOf, args, argIdx); err != nil {
+				return nil, argIdx, err
+			}
+			bound[i] = cond
+			continue
+		}
+		if cond.list != nil {
+			values := make([]any, len(cond.list))
+			for j, token := range cond.list {
+				var err error
+				if values[j], argIdx, err = bindToken(token, args, argIdx); err != nil {
+					return nil, argIdx, fmt.Errorf("IN list: %w", err)
+				}
+			}
+			cond.value = values
+			cond.list = nil
+		}
+		if cond.placeholder {
+			if argIdx >= len(args) {
+				return nil, argIdx, fmt.Errorf("missing argument for WHERE placeholder")
+			}
+			cond.value = normalizeArg(args[argIdx].Value)
+			cond.placeholder = false
+			argIdx++
+		}
+		bound[i] = cond
+	}
+	return bound, argIdx, nil
+}
+
+// bindCount resolves a LIMIT or OFFSET operand. An empty operand yields def.
+func bindCount(operand string, def int, args []driver.NamedValue, argIdx int) (int, int, error) {
+	raw := operand
+	switch operand {
+	case "":
+		return def, argIdx, nil
+	case "?":
+		if argIdx >= len(args) {
+			return 0, argIdx, fmt.Errorf("missing argument for LIMIT placeholder")
+		}
+		raw = fmt.Sprint(args[argIdx].Value)
+		argIdx++
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, argIdx, fmt.Errorf("invalid LIMIT value %q", raw)
+	}
+	return n, argIdx, nil
+}
+
+// rowMatches reports whether row satisfies every condition. NULL, whether
+// stored or because the column is missing from the row, satisfies IS NULL and
+// fails every comparison, as does comparing against a NULL operand.
+func rowMatches(row map[string]any, conds []condition) bool {
+	for _, cond := range conds {
+		if cond.anyOf != nil {
+			if !anyMatches(row, cond.anyOf) {
+				return false
+			}
+			continue
+		}
+		value := row[cond.column]
+		switch cond.op {
+		case "IS NULL":
+			if value != nil {
+				return false
+			}
+			continue
+		case "IS NOT NULL":
+			if value == nil {
+				return false
+			}
+			continue
+		case "IN", "NOT IN":
+			if !inListMatches(value, cond.value.([]any), cond.op == "NOT IN") {
+				return false
+			}
+			continue
+		}
+		if value == nil || cond.value == nil {
+			return false
+		}
+		var ok bool
+		switch cond.op {
+		case "=":
+			ok = compareValues(value, cond.value) == 0
+		case "!=":
+			ok = compareValues(value, cond.value) != 0
+		case "<":
+			ok = compareValues(value, cond.value) < 0
+		case "<=":
+			ok = compareValues(value, cond.value) <= 0
+		case ">":
+			ok = compareValues(value, cond.value) > 0
+		case ">=":
+			ok = compareValues(value, cond.value) >= 0
+		case "LIKE":
+			ok = likeMatch(valueText(cond.value), valueText(value))
+		case "NOT LIKE":
+			ok = !likeMatch(valueText(cond.value), valueText(value))
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// anyMatches reports whether row satisfies at least one of alternatives.
+func anyMatches(row map[string]any, alternatives []condition) bool {
+	for _, alt := range alternatives {
+		if rowMatches(row, []condition{alt}) {
+			return true
+		}
+	}
+	return false
+}
+
+// inListMatches evaluates value [NOT] IN list with SQL's three-valued logic,
+// treating an unknown result as a non-match: a NULL value matches nothing
+// unless the list is empty, and a NULL in the list keeps NOT IN from matching
+// values that are not otherwise found.
+func inListMatches(value any, list []any, negate bool) bool {
+	if len(list) == 0 {
+		return negate
+	}
+	if value == nil {
+		return false
+	}
+	sawNull := false
+	for _, item := range list {
+		if item == nil {
+			sawNull = true
+			continue
+		}
+		if compareValues(value, item) == 0 {
+			return !negate
+		}
+	}
+	return negate && !sawNull
+}
+
+// sortRows orders rows by terms. NULLs sort first in ascending order, as in
+// SQLite, and the sort is stable so ties keep insertion order.
+func sortRows(rows []map[string]any, terms []orderTerm) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, term := range terms {
+			a, b := rows[i][term.column], rows[j][term.column]
+			var c int
+			switch {
+			case a == nil && b == nil:
+				c = 0
+			case a == nil:
+				c = -1
+			case b == nil:
+				c = 1
+			default:
+				c = compareValues(a, b)
+			}
+			if c == 0 {
+				continue
+			}
+			if term.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// likeMatch implements SQL LIKE with % and _ wildcards. Matching is
+// case-insensitive, as SQLite's is for ASCII text; ESCAPE is not supported.
+func likeMatch(pattern, value string) bool {
+	pattern = strings.ToLower(pattern)
+	value = strings.ToLower(value)
+	// star and mark remember the most recent % so the matcher can backtrack.
+	star, mark := -1, 0
+	p, v := 0, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '%':
+				star, mark = p, v
+				p++
+				continue
+			case '_':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				p++
+				v += size
+				continue
+			default:
+				pr, psize := utf8.DecodeRuneInString(pattern[p:])
+				vr, vsize := utf8.DecodeRuneInString(value[v:])
+				if pr == vr {
+					p += psize
+					v += vsize
+					continue
+				}
+			}
+		}
+		if star == -1 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value[mark:])
+		mark += size
+		p, v = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '%' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// indexKeyword finds keyword as a whole word outside quoted literals,
+// ignoring case, and returns its byte offset or -1.
+func indexKeyword(s, keyword string) int {
+	re := regexp.MustCompile(`(?i)(^|\s)` + strings.ReplaceAll(regexp.QuoteMeta(keyword), " ", `\s+`) + `(\s|$)`)
+	offset := 0
+	for _, segment := range quoteSegments(s) {
+		if !segment.quoted {
+			if loc := re.FindStringIndex(segment.text); loc != nil {
+				idx := loc[0]
+				if segment.text[idx] == ' ' || segment.text[idx] == '\t' || segment.text[idx] == '\n' || segment.text[idx] == '\r' {
+					idx++
+				}
+				return offset + idx
+			}
+		}
+		offset += len(segment.text)
+	}
+	return -1
+}
+
+// splitOutsideQuotes splits s at every match of sep that lies outside a
+// quoted literal.
+func splitOutsideQuotes(s string, sep *regexp.Regexp) []string {
+	var parts []string
+	var current strings.Builder
+	for _, segment := range quoteSegments(s) {
+		if segment.quoted {
+			current.WriteString(segment.text)
+			continue
+		}
+		text := segment.text
+		for {
+			loc := sep.FindStringIndex(text)
+			if loc == nil {
+				break
+			}
+			current.WriteString(text[:loc[0]])
+			parts = append(parts, current.String())
+			current.Reset()
+			text = text[loc[1]:]
+		}
+		current.WriteString(text)
+	}
+	return append(parts, current.String())
+}
+
+type quoteSegment struct {
+	text   string
+	quoted bool
+}
+
+// quoteSegments cuts s into alternating unquoted and quoted runs; quoted runs
+// include their delimiters.
+func quoteSegments(s string) []quoteSegment {
+	var segments []quoteSegment
+	start := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == 0 && (c == '\'' || c == '"'):
+			if i > start {
+				segments = append(segments, quoteSegment{text: s[start:i]})
+			}
+			quote = c
+			start = i
+		case quote != 0 && c == quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				// A doubled quote is an escaped delimiter.
+				i++
+				continue
+			}
+			segments = append(segments, quoteSegment{text: s[start : i+1], quoted: true})
+			quote = 0
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		segments = append(segments, quoteSegment{text: s[start:], quoted: quote != 0})
+	}
+	return segments
+}
@@ -3,7 +3,11 @@ package userdb
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -138,6 +142,975 @@ func TestSQLiteStoreUpdatePassword(t *testing.T) {
 	}
 }
 
+func TestSQLiteStoreUpdateUser(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	update := User{Username: "alice", Domain: "example.com", ContactURI: "sip:alice@198.51.100.7", Disabled: true}
+	if err := store.UpdateUser(ctx, update); err != nil {
+		t.Fatalf("UpdateUser returned error: %v", err)
+	}
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.ContactURI != "sip:alice@198.51.100.7" || !user.Disabled || user.PasswordHash != "hashed-secret" {
+		t.Fatalf("expected contact and state to change but not the password, got %#v", user)
+	}
+
+	update = User{Username: "alice", Domain: "example.com", PasswordHash: "new-hash"}
+	if err := store.UpdateUser(ctx, update); err != nil {
+		t.Fatalf("UpdateUser returned error: %v", err)
+	}
+	user, err = store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.ContactURI != "" || user.Disabled || user.PasswordHash != "new-hash" {
+		t.Fatalf("expected cleared contact, enabled account, and new hash, got %#v", user)
+	}
+
+	if err := store.UpdateUser(ctx, User{Username: "carol", Domain: "example.com"}); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteStoreSetUserEnabled(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.Disabled {
+		t.Fatalf("rows without an enabled value should default to enabled")
+	}
+	if err := store.SetUserEnabled(ctx, "alice", "example.com", false); err != nil {
+		t.Fatalf("SetUserEnabled returned error: %v", err)
+	}
+	if user, _ := store.Lookup(ctx, "alice", "example.com"); user == nil || !user.Disabled {
+		t.Fatalf("expected alice to be disabled, got %#v", user)
+	}
+	if err := store.SetUserEnabled(ctx, "alice", "example.com", true); err != nil {
+		t.Fatalf("SetUserEnabled returned error: %v", err)
+	}
+	if user, _ := store.Lookup(ctx, "alice", "example.com"); user == nil || user.Disabled {
+		t.Fatalf("expected alice to be enabled again, got %#v", user)
+	}
+	if err := store.SetUserEnabled(ctx, "carol", "example.com", false); err != ErrUserNotFound {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := store.CreateUser(ctx, User{Username: "dave", Domain: "example.com", Disabled: true}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	users, err := store.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers returned error: %v", err)
+	}
+	for _, u := range users {
+		if u.Disabled != (u.Username == "dave") {
+			t.Fatalf("unexpected enabled state for %s: disabled=%v", u.Username, u.Disabled)
+		}
+	}
+}
+
+func TestSQLiteStoreUserSettings(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	settings, err := store.UserSettings(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("UserSettings returned error: %v", err)
+	}
+	if len(settings) != 0 || settings.MaxContacts() != 0 || settings.DoNotDisturb() {
+		t.Fatalf("expected no settings for a fresh user, got %v", settings)
+	}
+
+	for name, value := range map[string]string{
+		SettingMaxContacts:  "2",
+		SettingCallerIDName: " Reception ",
+		SettingCallLimit:    "-1",
+		SettingDoNotDisturb: "on",
+		SettingForwardTo:    "sip:bob@example.com",
+	} {
+		if err := store.SetUserSetting(ctx, "alice", "example.com", name, value); err != nil {
+			t.Fatalf("SetUserSetting(%s) returned error: %v", name, err)
+		}
+	}
+	if err := store.SetUserSetting(ctx, "alice", "example.com", SettingMaxContacts, "3"); err != nil {
+		t.Fatalf("SetUserSetting overwrite returned error: %v", err)
+	}
+	if err := store.SetUserSetting(ctx, "alice", "example.com", " ", "x"); err == nil {
+		t.Fatalf("expected empty setting name to be rejected")
+	}
+
+	settings, err = store.UserSettings(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("UserSettings returned error: %v", err)
+	}
+	if settings.MaxContacts() != 3 {
+		t.Fatalf("expected overwritten max contacts, got %d", settings.MaxContacts())
+	}
+	if settings.CallerIDName() != "Reception" {
+		t.Fatalf("unexpected caller ID name %q", settings.CallerIDName())
+	}
+	if settings.CallLimit() != 0 {
+		t.Fatalf("expected negative call limit to read as unlimited, got %d", settings.CallLimit())
+	}
+	if !settings.DoNotDisturb() || settings.ForwardTo() != "sip:bob@example.com" {
+		t.Fatalf("unexpected DND/forwarding settings: %v", settings)
+	}
+	if other, _ := store.UserSettings(ctx, "bob", "example.com"); len(other) != 0 {
+		t.Fatalf("settings leaked to another user: %v", other)
+	}
+
+	if err := store.DeleteUserSetting(ctx, "alice", "example.com", SettingDoNotDisturb); err != nil {
+		t.Fatalf("DeleteUserSetting returned error: %v", err)
+	}
+	if settings, _ := store.UserSettings(ctx, "alice", "example.com"); settings.DoNotDisturb() {
+		t.Fatalf("expected DND to be cleared, got %v", settings)
+	}
+
+	if err := store.DeleteUser(ctx, "alice", "example.com"); err != nil {
+		t.Fatalf("DeleteUser returned error: %v", err)
+	}
+	if settings, _ := store.UserSettings(ctx, "alice", "example.com"); len(settings) != 0 {
+		t.Fatalf("expected settings to be removed with the user, got %v", settings)
+	}
+}
+
+func TestOpenSQLitePersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	ctx := context.Background()
+
+	store, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite returned error: %v", err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com", PasswordHash: "h1"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if err := store.CreateUser(ctx, User{Username: "bob", Domain: "example.com"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if err := store.DeleteUser(ctx, "bob", "example.com"); err != nil {
+		t.Fatalf("DeleteUser returned error: %v", err)
+	}
+	if _, err := store.CreateBroadcastRule(ctx, BroadcastRule{Address: "sip:1000@example.com"}); err != nil {
+		t.Fatalf("CreateBroadcastRule returned error: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	reopened, err := OpenSQLite("file:" + path)
+	if err != nil {
+		t.Fatalf("reopening returned error: %v", err)
+	}
+	defer reopened.Close()
+	user, err := reopened.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("expected alice to survive a restart, got %v", err)
+	}
+	if user.PasswordHash != "h1" {
+		t.Fatalf("unexpected password hash %q", user.PasswordHash)
+	}
+	if _, err := reopened.Lookup(ctx, "bob", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected deleted user to stay deleted, got %v", err)
+	}
+	created, err := reopened.CreateBroadcastRule(ctx, BroadcastRule{Address: "sip:2000@example.com"})
+	if err != nil {
+		t.Fatalf("CreateBroadcastRule returned error: %v", err)
+	}
+	if created.ID != 2 {
+		t.Fatalf("expected auto-increment counter to survive a restart, got id %d", created.ID)
+	}
+	if version, err := reopened.SchemaVersion(ctx); err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("expected schema version to persist, got %d, %v", version, err)
+	}
+}
+
+func TestOpenSQLiteReplaysWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.db")
+	ctx := context.Background()
+
+	store, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite returned error: %v", err)
+	}
+	defer store.Close()
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com", PasswordHash: "h1"}); err != nil {
+		t.Fatalf("CreateUser returned error: %v", err)
+	}
+	if err := store.SetUserSetting(ctx, "alice", "example.com", SettingMaxContacts, "2"); err != nil {
+		t.Fatalf("SetUserSetting returned error: %v", err)
+	}
+
+	// Copy the files while the store is still open, as a crash would leave
+	// them, and append a torn record.
+	crashed := filepath.Join(t.TempDir(), "users.db")
+	for _, suffix := range []string{"", "-wal"} {
+		raw, err := os.ReadFile(path + suffix)
+		if errors.Is(err, fs.ErrNotExist) && suffix == "" {
+			// Nothing has been compacted into a snapshot yet.
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ReadFile returned error: %v", err)
+		}
+		if suffix == "-wal" {
+			raw = append(raw, []byte(`0badc0de {"seq":99,"entr`)...)
+		}
+		if err := os.WriteFile(crashed+suffix, raw, 0o600); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+	}
+	staleLog, err := os.ReadFile(crashed + "-wal")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+
+	recovered, err := OpenSQLite(crashed)
+	if err != nil {
+		t.Fatalf("reopening after a crash returned error: %v", err)
+	}
+	if user, err := recovered.Lookup(ctx, "alice", "example.com"); err != nil || user.PasswordHash != "h1" {
+		t.Fatalf("expected alice to be recovered from the log, got %#v (%v)", user, err)
+	}
+	if err := recovered.CreateUser(ctx, User{Username: "bob", Domain: "example.com"}); err != nil {
+		t.Fatalf("CreateUser after recovery returned error: %v", err)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// Put back a log whose records the snapshot already contains, as if the
+	// process died between writing the snapshot and truncating the log.
+	if err := os.WriteFile(crashed+"-wal", staleLog, 0o600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	reopened, err := OpenSQLite(crashed)
+	if err != nil {
+		t.Fatalf("reopening with a stale log returned error: %v", err)
+	}
+	defer reopened.Close()
+	users, err := reopened.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers returned error: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected alice and bob exactly once, got %v", users)
+	}
+	settings, err := reopened.UserSettings(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("UserSettings returned error: %v", err)
+	}
+	if settings.MaxContacts() != 2 {
+		t.Fatalf("expected recovered setting, got %v", settings)
+	}
+}
+
+func TestOpenSQLiteRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	if err := os.WriteFile(path, []byte("not a database"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if store, err := OpenSQLite(path); err == nil {
+		store.Close()
+		t.Fatalf("expected corrupt database to be rejected")
+	}
+}
+
+func TestMemoryDatabasePath(t *testing.T) {
+	cases := map[string]string{
+		"":                                   "",
+		":memory:":                           "",
+		"file:test?mode=memory&cache=shared": "",
+		"./users.db":                         "./users.db",
+		"file:/var/lib/xylitol/users.db?cache=shared": "/var/lib/xylitol/users.db",
+	}
+	for dsn, want := range cases {
+		if got := memoryDatabasePath(dsn); got != want {
+			t.Fatalf("memoryDatabasePath(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
+
+func TestSQLiteStoreCreateUserRejectsDuplicate(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	err = store.CreateUser(ctx, User{Username: "alice", Domain: "example.com", PasswordHash: "other"})
+	if !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected ErrUserExists, got %v", err)
+	}
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.PasswordHash != "hashed-secret" {
+		t.Fatalf("expected duplicate insert to leave alice unchanged, got %#v", user)
+	}
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.org"}); err != nil {
+		t.Fatalf("expected same username in another domain to be accepted, got %v", err)
+	}
+}
+
+func TestSQLiteDriverEnforcesUniqueConstraints(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	stmts := []string{
+		`CREATE TABLE accounts (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT UNIQUE, name TEXT)`,
+		`INSERT INTO accounts (email, name) VALUES ('a@example.com', 'a'), ('b@example.com', 'b')`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO accounts (email, name) VALUES (?, ?)`, "a@example.com", "dup"); err == nil || !strings.Contains(err.Error(), "UNIQUE constraint failed: accounts.email") {
+		t.Fatalf("expected unique violation on insert, got %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO accounts (id, email) VALUES (?, ?)`, 1, "c@example.com"); err == nil {
+		t.Fatalf("expected primary key violation on insert")
+	}
+	if _, err := db.Exec(`INSERT INTO accounts (email, name) VALUES (?, ?), (?, ?)`, "d@example.com", "d", "d@example.com", "d"); err == nil {
+		t.Fatalf("expected duplicate rows within one insert to be rejected")
+	}
+	if _, err := db.Exec(`UPDATE accounts SET email = ? WHERE name = ?`, "a@example.com", "b"); err == nil {
+		t.Fatalf("expected unique violation on update")
+	}
+	var email string
+	if err := db.QueryRow(`SELECT email FROM accounts WHERE name = ?`, "b").Scan(&email); err != nil {
+		t.Fatalf("select returned error: %v", err)
+	}
+	if email != "b@example.com" {
+		t.Fatalf("expected failed update to leave the row unchanged, got %q", email)
+	}
+	rows, err := db.Query(`SELECT * FROM accounts`)
+	if err != nil {
+		t.Fatalf("select returned error: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("Columns returned error: %v", err)
+	}
+	if len(columns) != 3 {
+		t.Fatalf("expected constraints not to be treated as columns, got %v", columns)
+	}
+}
+
+func TestSQLiteDriverFiltersOrdersAndLimits(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, rank INTEGER)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO items (name, rank) VALUES ('Alpha', 10), ('beta', 2), ('gamma', 30), ('alpine', 2)`); err != nil {
+		t.Fatalf("insert rows: %v", err)
+	}
+	if _, err := db.Exec(`ALTER TABLE items ADD COLUMN note TEXT`); err != nil {
+		t.Fatalf("alter table: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE items SET note = ? WHERE name = 'gamma'`, "x"); err != nil {
+		t.Fatalf("update row: %v", err)
+	}
+
+	names := func(query string, args ...any) []string {
+		t.Helper()
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		defer rows.Close()
+		var out []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			out = append(out, name)
+		}
+		return out
+	}
+	cases := []struct {
+		query string
+		args  []any
+		want  string
+	}{
+		{`SELECT name FROM items ORDER BY rank DESC, name`, nil, "gamma,Alpha,alpine,beta"},
+		{`SELECT name FROM items WHERE rank > ? ORDER BY name`, []any{5}, "Alpha,gamma"},
+		{`SELECT name FROM items WHERE rank <= 2 AND name != 'beta'`, nil, "alpine"},
+		{`SELECT name FROM items WHERE name LIKE ? ORDER BY id`, []any{"al%"}, "Alpha,alpine"},
+		{`SELECT name FROM items WHERE name NOT LIKE '_l%' ORDER BY id`, nil, "beta,gamma"},
+		{`SELECT name FROM items WHERE note IS NULL ORDER BY id`, nil, "Alpha,beta,alpine"},
+		{`SELECT name FROM items WHERE note IS NOT NULL`, nil, "gamma"},
+		{`SELECT name FROM items ORDER BY id LIMIT 2`, nil, "Alpha,beta"},
+		{`SELECT name FROM items ORDER BY id LIMIT ? OFFSET ?`, []any{2, 1}, "beta,gamma"},
+		{`SELECT name FROM items ORDER BY id LIMIT 3, 5`, nil, "alpine"},
+	}
+	for _, tc := range cases {
+		if got := strings.Join(names(tc.query, tc.args...), ","); got != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.query, got, tc.want)
+		}
+	}
+
+	res, err := db.Exec(`DELETE FROM items WHERE rank < ? AND name LIKE 'a%'`, 5)
+	if err != nil {
+		t.Fatalf("delete rows: %v", err)
+	}
+	if affected, _ := res.RowsAffected(); affected != 1 {
+		t.Fatalf("expected one row deleted, got %d", affected)
+	}
+	if _, err := db.Query(`SELECT name FROM items WHERE rank = 1 OR rank = 2`); err == nil {
+		t.Fatalf("expected OR to be rejected rather than misread")
+	}
+}
+
+func TestSQLiteDriverTypedValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "typed.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	stmts := []string{
+		`CREATE TABLE vals (id INTEGER PRIMARY KEY AUTOINCREMENT, n INTEGER, label TEXT, ratio REAL, raw BLOB)`,
+		`INSERT INTO vals (n, label, ratio, raw) VALUES ('42', 7, 2, '007')`,
+		`INSERT INTO vals (n, label, ratio, raw) VALUES (NULL, NULL, 0.5, 3)`,
+		`ALTER TABLE vals ADD COLUMN extra INTEGER`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO vals (n, label) VALUES (?, ?)`, nil, "x"); err != nil {
+		t.Fatalf("insert NULL argument: %v", err)
+	}
+
+	check := func(db *sql.DB) {
+		t.Helper()
+		var (
+			n     sql.NullInt64
+			label sql.NullString
+			ratio sql.NullFloat64
+			raw   any
+			extra sql.NullInt64
+		)
+		row := db.QueryRow(`SELECT n, label, ratio, raw, extra FROM vals WHERE id = ?`, 1)
+		if err := row.Scan(&n, &label, &ratio, &raw, &extra); err != nil {
+			t.Fatalf("scan row 1: %v", err)
+		}
+		if !n.Valid || n.Int64 != 42 || label.String != "7" || ratio.Float64 != 2 || raw != "007" || extra.Valid {
+			t.Fatalf("unexpected row 1: %v %v %v %#v %v", n, label, ratio, raw, extra)
+		}
+		row = db.QueryRow(`SELECT n, label, raw FROM vals WHERE id = ?`, 2)
+		if err := row.Scan(&n, &label, &raw); err != nil {
+			t.Fatalf("scan row 2: %v", err)
+		}
+		if n.Valid || label.Valid || raw != int64(3) {
+			t.Fatalf("unexpected row 2: %v %v %#v", n, label, raw)
+		}
+		var plain string
+		if err := db.QueryRow(`SELECT n FROM vals WHERE id = ?`, 3).Scan(&plain); err == nil {
+			t.Fatalf("expected scanning NULL into a string to fail")
+		}
+		var count int
+		rows, err := db.Query(`SELECT id FROM vals WHERE n IS NULL AND ratio < 1`)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		for rows.Next() {
+			count++
+		}
+		rows.Close()
+		if count != 1 {
+			t.Fatalf("expected one row with NULL n and ratio < 1, got %d", count)
+		}
+		if err := db.QueryRow(`SELECT id FROM vals WHERE n = ?`, "42").Scan(&count); err != nil || count != 1 {
+			t.Fatalf("expected text operand to match INTEGER 42, got id %d, err %v", count, err)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+func TestOpenSQLiteUpgradesVersionOneFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	legacy := `{"version":1,"tables":{"users":{"columns":["username","domain","password_hash","contact_uri","PRIMARY"],` +
+		`"rows":[{"username":"alice","domain":"example.com","password_hash":"h1","contact_uri":"sip:alice@192.0.2.10"}],"auto_increment":0}}}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+	store, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite returned error: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	user, err := store.Lookup(ctx, "alice", "example.com")
+	if err != nil {
+		t.Fatalf("Lookup returned error: %v", err)
+	}
+	if user.PasswordHash != "h1" || user.Disabled {
+		t.Fatalf("unexpected upgraded user %#v", user)
+	}
+	if err := store.CreateUser(ctx, User{Username: "alice", Domain: "example.com"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected the upgraded table to enforce its primary key, got %v", err)
+	}
+	rows, err := store.UnderlyingDB().Query(`SELECT * FROM users`)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	defer rows.Close()
+	columns, _ := rows.Columns()
+	if strings.Join(columns, ",") != "username,domain,password_hash,contact_uri,enabled" {
+		t.Fatalf("unexpected upgraded columns %v", columns)
+	}
+}
+
+func TestSQLiteDriverLastInsertIdAndReturning(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE notes (id INTEGER PRIMARY KEY AUTOINCREMENT, body TEXT)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	res, err := db.Exec(`INSERT INTO notes (body) VALUES (?), (?)`, "a", "b")
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if id, err := res.LastInsertId(); err != nil || id != 2 {
+		t.Fatalf("expected LastInsertId 2, got %d (%v)", id, err)
+	}
+	var id int64
+	var body string
+	if err := db.QueryRow(`INSERT INTO notes (body) VALUES (?) RETURNING id, body`, "c").Scan(&id, &body); err != nil {
+		t.Fatalf("insert returning: %v", err)
+	}
+	if id != 3 || body != "c" {
+		t.Fatalf("unexpected RETURNING row %d %q", id, body)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE tags (name TEXT)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	res, err = db.Exec(`INSERT INTO tags (name) VALUES ('x')`)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	if _, err := res.LastInsertId(); err == nil {
+		t.Fatalf("expected LastInsertId to fail for a table without an id column")
+	}
+}
+
+func TestSQLiteDriverAggregates(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE scores (name TEXT, points INTEGER)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO scores (name, points) VALUES ('a', 3), ('b', 7), ('c', NULL), ('d', 5)`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	var total, counted, high, low, sum int64
+	if err := db.QueryRow(`SELECT COUNT(*), COUNT(points), MAX(points), MIN(points), SUM(points) FROM scores`).Scan(&total, &counted, &high, &low, &sum); err != nil {
+		t.Fatalf("aggregate query: %v", err)
+	}
+	if total != 4 || counted != 3 || high != 7 || low != 3 || sum != 15 {
+		t.Fatalf("unexpected aggregates %d %d %d %d %d", total, counted, high, low, sum)
+	}
+
+	rows, err := db.Query(`SELECT count(*) AS n FROM scores WHERE points > ?`, 4)
+	if err != nil {
+		t.Fatalf("filtered count: %v", err)
+	}
+	columns, err := rows.Columns()
+	if err != nil || len(columns) != 1 || columns[0] != "n" {
+		t.Fatalf("expected aliased column n, got %v (%v)", columns, err)
+	}
+	var n int64
+	if !rows.Next() {
+		t.Fatalf("expected one row from an aggregate query")
+	}
+	if err := rows.Scan(&n); err != nil || n != 2 {
+		t.Fatalf("expected 2 rows above 4 points, got %d (%v)", n, err)
+	}
+	rows.Close()
+
+	var none sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(points) FROM scores WHERE name = 'zzz'`).Scan(&none); err != nil {
+		t.Fatalf("empty MAX: %v", err)
+	}
+	if none.Valid {
+		t.Fatalf("expected MAX over no rows to be NULL, got %d", none.Int64)
+	}
+
+	if _, err := db.Query(`SELECT name, COUNT(*) FROM scores`); err == nil {
+		t.Fatalf("expected mixing aggregate and plain columns to be rejected")
+	}
+}
+
+func TestSQLiteDriverAddColumnWithDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alter.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`CREATE TABLE accounts (name TEXT, tier TEXT DEFAULT 'basic')`,
+		`INSERT INTO accounts (name) VALUES ('a'), ('b')`,
+		`ALTER TABLE accounts ADD COLUMN quota INTEGER NOT NULL DEFAULT (10)`,
+		`ALTER TABLE accounts ADD COLUMN label TEXT DEFAULT 'two words'`,
+		`ALTER TABLE accounts ADD note TEXT`,
+		`INSERT INTO accounts (name, quota) VALUES ('c', 3)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	for _, stmt := range []string{
+		`ALTER TABLE accounts ADD COLUMN required TEXT NOT NULL`,
+		`ALTER TABLE accounts ADD COLUMN code TEXT UNIQUE`,
+		`ALTER TABLE accounts ADD COLUMN created TEXT DEFAULT CURRENT_TIMESTAMP`,
+		`ALTER TABLE accounts ADD COLUMN name TEXT`,
+	} {
+		if _, err := db.Exec(stmt); err == nil {
+			t.Fatalf("expected %q to be rejected", stmt)
+		}
+	}
+
+	check := func(db *sql.DB) {
+		t.Helper()
+		rows, err := db.Query(`SELECT name, tier, quota, label, note FROM accounts ORDER BY name`)
+		if err != nil {
+			t.Fatalf("select: %v", err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var name, tier, label string
+			var quota int64
+			var note sql.NullString
+			if err := rows.Scan(&name, &tier, &quota, &label, &note); err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			got = append(got, fmt.Sprintf("%s/%s/%d/%s/%v", name, tier, quota, label, note.Valid))
+		}
+		want := "a/basic/10/two words/false b/basic/10/two words/false c/basic/3/two words/false"
+		if strings.Join(got, " ") != want {
+			t.Fatalf("expected %q, got %q", want, strings.Join(got, " "))
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	check(reopened)
+	if _, err := reopened.Exec(`INSERT INTO accounts (name) VALUES ('d')`); err != nil {
+		t.Fatalf("insert after reopen: %v", err)
+	}
+	var quota int64
+	if err := reopened.QueryRow(`SELECT quota FROM accounts WHERE name = 'd'`).Scan(&quota); err != nil || quota != 10 {
+		t.Fatalf("expected the persisted default 10, got %d (%v)", quota, err)
+	}
+}
+
+func TestSQLiteDriverInLists(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER, tag TEXT)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO items (id, tag) VALUES (1, 'a'), (2, 'b'), (3, NULL), (4, 'd')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	cases := []struct {
+		query string
+		args  []any
+		want  []int64
+	}{
+		{`SELECT id FROM items WHERE id IN (?, ?, ?) ORDER BY id`, []any{4, 1, 9}, []int64{1, 4}},
+		{`SELECT id FROM items WHERE tag IN ('b', ?) AND id > ? ORDER BY id`, []any{"d", 2}, []int64{4}},
+		{`SELECT id FROM items WHERE tag NOT IN ('a') ORDER BY id`, nil, []int64{2, 4}},
+		{`SELECT id FROM items WHERE tag NOT IN ('a', NULL)`, nil, nil},
+		{`SELECT id FROM items WHERE id IN ()`, nil, nil},
+	}
+	for _, tc := range cases {
+		rows, err := db.Query(tc.query, tc.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		var got []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("%s: scan: %v", tc.query, err)
+			}
+			got = append(got, id)
+		}
+		rows.Close()
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	res, err := db.Exec(`DELETE FROM items WHERE id IN (?, ?)`, 2, 3)
+	if err != nil {
+		t.Fatalf("delete with IN: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Fatalf("expected 2 rows deleted, got %d", n)
+	}
+	if _, err := db.Query(`SELECT id FROM items WHERE id IN ?`, 1); err == nil {
+		t.Fatalf("expected an unparenthesised IN operand to be rejected")
+	}
+}
+
+func TestSQLiteDriverOrGroups(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER, name TEXT, note TEXT)`); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO items (id, name, note) VALUES (1, 'Alice', NULL), (2, 'bob', 'likes alice'), (3, 'carol', 'none'), (4, 'dave', 'Or else')`); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	cases := []struct {
+		query string
+		args  []any
+		want  []int64
+	}{
+		{`SELECT id FROM items WHERE (name LIKE ? OR note LIKE ?) ORDER BY id`, []any{"%alice%", "%alice%"}, []int64{1, 2}},
+		{`SELECT id FROM items WHERE (name LIKE ? OR note LIKE ?) AND id > ? ORDER BY id`, []any{"%alice%", "%alice%", 1}, []int64{2}},
+		{`SELECT id FROM items WHERE id > ? AND (id = 1 OR note = 'Or else') ORDER BY id`, []any{0}, []int64{1, 4}},
+		{`SELECT COUNT(*) FROM items WHERE (note IS NULL OR id IN (?, ?))`, []any{3, 4}, []int64{3}},
+	}
+	for _, tc := range cases {
+		rows, err := db.Query(tc.query, tc.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		var got []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("%s: scan: %v", tc.query, err)
+			}
+			got = append(got, id)
+		}
+		rows.Close()
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+	if _, err := db.Query(`SELECT id FROM items WHERE (id = 1 AND name = 'x')`); err == nil {
+		t.Fatalf("expected AND inside an OR group to be rejected")
+	}
+}
+
+func TestSQLiteTransactionRollbackRestoresTables(t *testing.T) {
+	store, err := NewSQLiteStore(openTestDatabase(t))
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+	seedTestUsers(t, store.UnderlyingDB())
+
+	ctx := context.Background()
+	db := store.UnderlyingDB()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx returned error: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE username = ?`, "alice"); err != nil {
+		t.Fatalf("delete in transaction: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS scratch (id INTEGER PRIMARY KEY AUTOINCREMENT)`); err != nil {
+		t.Fatalf("create in transaction: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback returned error: %v", err)
+	}
+	if _, err := store.Lookup(ctx, "alice", "example.com"); err != nil {
+		t.Fatalf("expected rollback to restore alice, got %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO scratch (id) VALUES (?)`, 1); err == nil {
+		t.Fatalf("expected table created in a rolled back transaction to be gone")
+	}
+
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx returned error: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE username = ?`, "alice"); err != nil {
+		t.Fatalf("delete in transaction: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	if _, err := store.Lookup(ctx, "alice", "example.com"); err != ErrUserNotFound {
+		t.Fatalf("expected committed delete to stick, got %v", err)
+	}
+}
+
+func TestSQLiteTransactionPersistsOnCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	ctx := context.Background()
+
+	store, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("OpenSQLite returned error: %v", err)
+	}
+	rule, err := store.CreateBroadcastRule(ctx, BroadcastRule{
+		Address: "sip:1000@example.com",
+		Targets: []BroadcastTarget{{ContactURI: "sip:a@example.com"}, {ContactURI: "sip:b@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateBroadcastRule returned error: %v", err)
+	}
+	tx, err := store.UnderlyingDB().BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx returned error: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM broadcast_targets WHERE rule_id = ?`, rule.ID); err != nil {
+		t.Fatalf("delete in transaction: %v", err)
+	}
+	logged, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if strings.Contains(string(logged), "DELETE FROM broadcast_targets") {
+		t.Fatalf("expected uncommitted delete not to reach disk")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	reopened, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("reopening returned error: %v", err)
+	}
+	defer reopened.Close()
+	targets, err := reopened.LookupBroadcastTargets(ctx, "sip:1000@example.com")
+	if err != nil {
+		t.Fatalf("LookupBroadcastTargets returned error: %v", err)
+	}
+	if len(targets) != 0 {
+		t.Fatalf("expected committed delete to be persisted, got %v", targets)
+	}
+}
+
+func TestReplaceBroadcastTargetsIsAtomic(t *testing.T) {
+	db := openTestDatabase(t)
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	ruleID := seedBroadcastRule(t, store.UnderlyingDB(), "sip:1000@example.com", "sip:a@example.com", "sip:b@example.com")
+	err = store.ReplaceBroadcastTargets(ctx, ruleID, []BroadcastTarget{{ContactURI: "sip:c@example.com"}, {ContactURI: " "}})
+	if err == nil {
+		t.Fatalf("expected blank contact URI to be rejected")
+	}
+	targets, err := store.LookupBroadcastTargets(ctx, "sip:1000@example.com")
+	if err != nil {
+		t.Fatalf("LookupBroadcastTargets returned error: %v", err)
+	}
+	if len(targets) != 2 || targets[0].ContactURI != "sip:a@example.com" || targets[1].ContactURI != "sip:b@example.com" {
+		t.Fatalf("expected failed replace to keep the original targets, got %v", targets)
+	}
+}
+
+func TestListBroadcastRulesGroupsTargetsByRule(t *testing.T) {
+	db := openTestDatabase(t)
+	store, err := NewSQLiteStore(db)
+	if err != nil {
+		t.Fatalf("failed to construct store: %v", err)
+	}
+	defer store.Close()
+
+	seedBroadcastRule(t, store.UnderlyingDB(), "sip:2000@example.com", "sip:c@example.com")
+	seedBroadcastRule(t, store.UnderlyingDB(), "sip:1000@example.com", "sip:a@example.com", "sip:b@example.com")
+	seedBroadcastRule(t, store.UnderlyingDB(), "sip:3000@example.com")
+
+	rules, err := store.ListBroadcastRules(context.Background())
+	if err != nil {
+		t.Fatalf("ListBroadcastRules returned error: %v", err)
+	}
+	got := make([]string, len(rules))
+	for i, rule := range rules {
+		uris := make([]string, len(rule.Targets))
+		for j, target := range rule.Targets {
+			if target.RuleID != rule.ID {
+				t.Fatalf("target %v attached to rule %d", target, rule.ID)
+			}
+			uris[j] = target.ContactURI
+		}
+		got[i] = rule.Address + "=" + strings.Join(uris, ",")
+	}
+	want := "sip:1000@example.com=sip:a@example.com,sip:b@example.com sip:2000@example.com=sip:c@example.com sip:3000@example.com="
+	if strings.Join(got, " ") != want {
+		t.Fatalf("expected %q, got %q", want, strings.Join(got, " "))
+	}
+}
+
 func TestBroadcastRuleLifecycle(t *testing.T) {
 	db := openTestDatabase(t)
 	store, err := NewSQLiteStore(db)
@@ -0,0 +1,95 @@
+package userdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// memoryTx gives the embedded driver BEGIN/COMMIT/ROLLBACK semantics by
+// snapshotting every table when the transaction starts. Statements run
+// against the live tables; Rollback swaps the snapshot back in and Commit
+// appends all of the transaction's statements to the write-ahead log as a
+// single record. The transaction holds the database's writeMu, so writers on
+// other connections wait for it to finish.
+// Readers on other connections are not blocked and may observe uncommitted
+// rows.
+type memoryTx struct {
+	conn   *memoryConn
+	before map[string]*memoryTable
+}
+
+// Begin starts a transaction on the connection.
+func (c *memoryConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. Only the default isolation level is offered,
+// and read-only transactions are accepted but not enforced.
+func (c *memoryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("transaction already in progress")
+	}
+	if opts.Isolation != driver.IsolationLevel(0) {
+		return nil, errors.New("isolation levels are not supported")
+	}
+	db := c.db
+	db.writeMu.Lock()
+	db.mu.Lock()
+	before := make(map[string]*memoryTable, len(db.tables))
+	for name, table := range db.tables {
+		before[name] = table.clone()
+	}
+	db.inTx = true
+	db.mu.Unlock()
+	c.tx = &memoryTx{conn: c, before: before}
+	return c.tx, nil
+}
+
+// Commit persists the transaction's changes. When the write fails the
+// database is restored to its state at Begin and the error is returned.
+func (tx *memoryTx) Commit() error {
+	db, err := tx.finish()
+	if err != nil {
+		return err
+	}
+	defer db.writeMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.inTx = false
+	entries := db.txLog
+	db.txLog = nil
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := db.appendLogLocked(entries); err != nil {
+		db.tables = tx.before
+		return err
+	}
+	return nil
+}
+
+// Rollback discards every change made since Begin.
+func (tx *memoryTx) Rollback() error {
+	db, err := tx.finish()
+	if err != nil {
+		return err
+	}
+	defer db.writeMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tables = tx.before
+	db.inTx = false
+	db.txLog = nil
+	return nil
+}
+
+func (tx *memoryTx) finish() (*memoryDatabase, error) {
+	if tx.conn == nil || tx.conn.tx != tx {
+		return nil, errors.New("transaction has already been committed or rolled back")
+	}
+	db := tx.conn.db
+	tx.conn.tx = nil
+	tx.conn = nil
+	return db, nil
+}
@@ -0,0 +1,265 @@
+package userdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stored cells are typed like SQLite's storage classes: nil is NULL, int64 is
+// INTEGER, float64 is REAL, and string is TEXT. A column missing from a row
+// map reads as NULL.
+
+// columnAffinity is the SQLite type affinity derived from a column's declared
+// type. It decides how a value is converted when it is stored.
+type columnAffinity int
+
+const (
+	// affinityBlob stores values unchanged; it applies to BLOB columns and
+	// to columns declared without a type.
+	affinityBlob columnAffinity = iota
+	affinityText
+	affinityInteger
+	affinityReal
+	affinityNumeric
+)
+
+// affinityOf applies SQLite's rules for deriving affinity from a declared
+// column type, in SQLite's order of precedence.
+func affinityOf(declared string) columnAffinity {
+	t := strings.ToUpper(declared)
+	switch {
+	case strings.Contains(t, "INT"):
+		return affinityInteger
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return affinityText
+	case t == "", strings.Contains(t, "BLOB"):
+		return affinityBlob
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return affinityReal
+	default:
+		return affinityNumeric
+	}
+}
+
+// apply converts v for storage in a column with affinity a: numbers become
+// text in TEXT columns, and text that looks like a number becomes a number in
+// INTEGER, REAL, and NUMERIC columns.
+func (a columnAffinity) apply(v any) any {
+	switch a {
+	case affinityText:
+		switch n := v.(type) {
+		case int64, float64:
+			return valueText(n)
+		}
+	case affinityInteger, affinityNumeric:
+		switch n := v.(type) {
+		case string:
+			if num, ok := parseNumber(n); ok {
+				return integralValue(num)
+			}
+		case float64:
+			return integralValue(n)
+		}
+	case affinityReal:
+		switch n := v.(type) {
+		case int64:
+			return float64(n)
+		case string:
+			if num, ok := parseNumber(n); ok {
+				return toFloat(num)
+			}
+		}
+	}
+	return v
+}
+
+var numberRegex = regexp.MustCompile(`^[+-]?(?:\d+\.?\d*|\.\d+)(?:[eE][+-]?\d+)?$`)
+
+// parseNumber interprets s as an INTEGER or REAL literal. Hexadecimal,
+// infinities, and NaN are not numbers here.
+func parseNumber(s string) (any, bool) {
+	s = strings.TrimSpace(s)
+	if !numberRegex.MatchString(s) {
+		return nil, false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// integralValue narrows a REAL with no fractional part to an INTEGER, as
+// INTEGER and NUMERIC affinity do.
+func integralValue(v any) any {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return v
+	}
+	return int64(f)
+}
+
+func toFloat(v any) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// parseLiteral converts a SQL literal token: a quoted string, a number, NULL,
+// TRUE, or FALSE.
+func parseLiteral(token string) (any, error) {
+	token = strings.TrimSpace(token)
+	switch strings.ToUpper(token) {
+	case "NULL":
+		return nil, nil
+	case "TRUE":
+		return int64(1), nil
+	case "FALSE":
+		return int64(0), nil
+	}
+	if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') {
+		if segments := quoteSegments(token); len(segments) == 1 && segments[0].quoted && token[len(token)-1] == token[0] {
+			return unquote(token), nil
+		}
+	}
+	if num, ok := parseNumber(token); ok {
+		return num, nil
+	}
+	return nil, fmt.Errorf("unsupported literal %q", token)
+}
+
+// normalizeArg maps a bound argument onto a storage class. database/sql has
+// already reduced arguments to driver.Value types.
+func normalizeArg(v driver.Value) any {
+	switch n := v.(type) {
+	case nil, int64, float64, string:
+		return n
+	case bool:
+		if n {
+			return int64(1)
+		}
+		return int64(0)
+	case []byte:
+		return string(n)
+	case time.Time:
+		return n.Format("2006-01-02 15:04:05.999999999-07:00")
+	default:
+		return fmt.Sprint(n)
+	}
+}
+
+// valueText renders a stored value as text, as SQLite's CAST(x AS TEXT) does;
+// NULL renders as "".
+func valueText(v any) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case float64:
+		s := strconv.FormatFloat(n, 'f', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return s
+	case string:
+		return n
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues orders two non-NULL values the way SQLite orders storage
+// classes: numbers before text. Text that reads as a number is compared
+// numerically against a number, approximating the affinity SQLite applies to
+// the operand of a comparison with a column.
+func compareValues(a, b any) int {
+	an, aNum := numericValue(a)
+	bn, bNum := numericValue(b)
+	switch {
+	case aNum && bNum:
+		return compareNumbers(an, bn)
+	case aNum:
+		if bs, ok := b.(string); ok {
+			if parsed, ok := parseNumber(bs); ok {
+				return compareNumbers(an, parsed)
+			}
+		}
+		return -1
+	case bNum:
+		if as, ok := a.(string); ok {
+			if parsed, ok := parseNumber(as); ok {
+				return compareNumbers(parsed, bn)
+			}
+		}
+		return 1
+	}
+	return strings.Compare(valueText(a), valueText(b))
+}
+
+func numericValue(v any) (any, bool) {
+	switch v.(type) {
+	case int64, float64:
+		return v, true
+	}
+	return nil, false
+}
+
+func compareNumbers(a, b any) int {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	x, y := toFloat(a), toFloat(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// uniqueKeyPart encodes a non-NULL value so that values comparing equal
+// produce the same key.
+func uniqueKeyPart(v any) string {
+	switch n := integralValue(v).(type) {
+	case int64:
+		return "i" + strconv.FormatInt(n, 10)
+	case float64:
+		return "r" + strconv.FormatFloat(n, 'g', -1, 64)
+	}
+	return "t" + valueText(v)
+}
+
+// declaredType extracts the type name from a column definition such as
+// "name VARCHAR(255) NOT NULL", stopping at the first constraint keyword.
+func declaredType(fields []string) string {
+	var words []string
+	for _, field := range fields {
+		switch strings.ToUpper(field) {
+		case "NOT", "NULL", "DEFAULT", "PRIMARY", "UNIQUE", "CHECK", "REFERENCES", "COLLATE", "CONSTRAINT", "AUTOINCREMENT", "AUTO_INCREMENT", "GENERATED":
+			return strings.Join(words, " ")
+		}
+		words = append(words, field)
+	}
+	return strings.Join(words, " ")
+}
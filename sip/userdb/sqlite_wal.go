@@ -0,0 +1,219 @@
+package userdb
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// A file-backed database is stored as a snapshot plus a write-ahead log next
+// to it ("<path>-wal"). Every committed statement is appended to the log and
+// synced before the caller sees success, so a crash loses nothing that was
+// acknowledged. Once memoryWALCompactEvery statements have accumulated, and
+// whenever the last connection closes, the tables are written out as a fresh
+// snapshot and the log is emptied.
+//
+// Each log line is "<crc32 hex> <json record>". A record carries a sequence
+// number and the statements of one commit: a single statement, or every
+// statement of a transaction, so transactions replay atomically. On open,
+// records up to the snapshot's sequence are skipped (a crash between writing
+// the snapshot and truncating the log leaves them behind), the rest are
+// re-executed, and a torn or corrupt tail left by a crash mid-append is cut
+// off.
+
+// memoryWALCompactEvery bounds how many logged statements accumulate before
+// the log is folded into the snapshot.
+const memoryWALCompactEvery = 1000
+
+// walEntry is one logged statement with its bound arguments, encoded like
+// snapshot values.
+type walEntry struct {
+	SQL  string            `json:"sql"`
+	Args []json.RawMessage `json:"args,omitempty"`
+}
+
+type walRecord struct {
+	Seq     uint64     `json:"seq"`
+	Entries []walEntry `json:"entries"`
+}
+
+func walPath(path string) string { return path + "-wal" }
+
+// logEntry captures a statement for the write-ahead log, or returns nil when
+// nothing needs logging because the database lives only in memory or the
+// statement is itself being replayed.
+func (c *memoryConn) logEntry(query string, args []driver.NamedValue) (*walEntry, error) {
+	if c.db.path == "" || c.replaying {
+		return nil, nil
+	}
+	entry := &walEntry{SQL: query, Args: make([]json.RawMessage, len(args))}
+	for i, arg := range args {
+		raw, err := encodeSnapshotValue(normalizeArg(arg.Value))
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		entry.Args[i] = raw
+	}
+	return entry, nil
+}
+
+// appendLogLocked writes entries as one record and syncs the log. A failed
+// append is cut back off so later records are not stranded behind a torn
+// line. The caller holds db.mu.
+func (db *memoryDatabase) appendLogLocked(entries []walEntry) error {
+	if db.path == "" || len(entries) == 0 {
+		return nil
+	}
+	if db.wal == nil {
+		f, err := os.OpenFile(walPath(db.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("open database log %s: %w", walPath(db.path), err)
+		}
+		db.wal = f
+	}
+	payload, err := json.Marshal(walRecord{Seq: db.walSeq + 1, Entries: entries})
+	if err != nil {
+		return fmt.Errorf("encode database log record: %w", err)
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+	if _, err := db.wal.WriteString(line); err != nil {
+		db.wal.Truncate(db.walSize)
+		return fmt.Errorf("write database log %s: %w", walPath(db.path), err)
+	}
+	if err := db.wal.Sync(); err != nil {
+		db.wal.Truncate(db.walSize)
+		return fmt.Errorf("sync database log %s: %w", walPath(db.path), err)
+	}
+	db.walSeq++
+	db.walSize += int64(len(line))
+	db.walRecords += len(entries)
+	if db.walRecords >= memoryWALCompactEvery {
+		// A failed compaction loses nothing: the log still holds every
+		// record, and the next append retries.
+		db.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked folds the log into a new snapshot and empties it. The
+// snapshot records the last sequence it contains, so if the process dies
+// before the log is truncated the stale records are skipped on replay. The
+// caller holds db.mu.
+func (db *memoryDatabase) compactLocked() error {
+	if err := db.persistLocked(); err != nil {
+		return err
+	}
+	if db.wal != nil {
+		if err := db.wal.Truncate(0); err != nil {
+			return fmt.Errorf("truncate database log %s: %w", walPath(db.path), err)
+		}
+	} else if err := os.Truncate(walPath(db.path), 0); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("truncate database log %s: %w", walPath(db.path), err)
+	}
+	db.walSize = 0
+	db.walRecords = 0
+	return nil
+}
+
+// closeLog compacts the database and closes the log once the last connection
+// has gone, so a clean shutdown leaves everything in the snapshot.
+func (db *memoryDatabase) closeLog() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.walRecords > 0 {
+		db.compactLocked()
+	}
+	if db.wal != nil {
+		db.wal.Close()
+		db.wal = nil
+	}
+}
+
+// replayLog re-executes the log records newer than the snapshot. It runs
+// while the database is being opened and is not yet shared.
+func (db *memoryDatabase) replayLog() error {
+	path := walPath(db.path)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read database log %s: %w", path, err)
+	}
+	db.replaying = true
+	defer func() { db.replaying = false }()
+	conn := &memoryConn{db: db, replaying: true}
+	valid := 0
+	applied := 0
+	for valid < len(raw) {
+		end := bytes.IndexByte(raw[valid:], '\n')
+		if end == -1 {
+			break
+		}
+		record, ok := parseWALLine(raw[valid : valid+end])
+		if !ok {
+			break
+		}
+		if record.Seq > db.walSeq {
+			for _, entry := range record.Entries {
+				if err := conn.replay(entry); err != nil {
+					return fmt.Errorf("database log %s is corrupt: record %d: %w", path, record.Seq, err)
+				}
+				applied++
+			}
+			db.walSeq = record.Seq
+		}
+		valid += end + 1
+	}
+	if valid < len(raw) {
+		// Drop the torn tail so new records follow the last good one.
+		if err := os.Truncate(path, int64(valid)); err != nil {
+			return fmt.Errorf("truncate database log %s: %w", path, err)
+		}
+	}
+	db.walSize = int64(valid)
+	db.walRecords = applied
+	if valid > 0 {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.compactLocked()
+	}
+	return nil
+}
+
+// parseWALLine checks a log line's checksum and decodes its record.
+func parseWALLine(line []byte) (walRecord, bool) {
+	sum, payload, ok := bytes.Cut(line, []byte{' '})
+	if !ok {
+		return walRecord{}, false
+	}
+	want, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil || uint32(want) != crc32.ChecksumIEEE(payload) {
+		return walRecord{}, false
+	}
+	var record walRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return walRecord{}, false
+	}
+	return record, true
+}
+
+// replay re-executes one logged statement.
+func (c *memoryConn) replay(entry walEntry) error {
+	args := make([]driver.NamedValue, len(entry.Args))
+	for i, raw := range entry.Args {
+		v, err := decodeSnapshotValue(raw)
+		if err != nil {
+			return err
+		}
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	_, err := c.exec(entry.SQL, args)
+	return err
+}
@@ -0,0 +1,188 @@
+package userdb
+
+import (
+	"context"
+	"strings"
+)
+
+// Store describes a user directory backend consumed by the SIP stack, the
+// registrar, and the web interface. SQLStore is the reference
+// implementation; alternative backends only need to satisfy this interface to
+// be plugged into the proxy.
+type Store interface {
+	// Lookup returns a user entry by username and domain, or ErrUserNotFound.
+	Lookup(ctx context.Context, username, domain string) (*User, error)
+	// AllUsers returns every user entry stored in the directory.
+	AllUsers(ctx context.Context) ([]User, error)
+	// QueryUsers returns one searched, sorted page of the directory.
+	QueryUsers(ctx context.Context, query UserQuery) (UserPage, error)
+	// CreateUser inserts a new user entry, returning ErrUserExists when the
+	// username and domain are already taken.
+	CreateUser(ctx context.Context, user User) error
+	// DeleteUser removes a user entry, returning ErrUserNotFound when absent.
+	DeleteUser(ctx context.Context, username, domain string) error
+	// UpdatePassword replaces the stored password hash for a user.
+	UpdatePassword(ctx context.Context, username, domain, passwordHash string) error
+	// SetUserEnabled suspends or reinstates an account without deleting it.
+	SetUserEnabled(ctx context.Context, username, domain string, enabled bool) error
+	// UpdateUser replaces a user's contact URI and enabled flag and, when a
+	// hash is given, password. It returns ErrUserNotFound when absent.
+	UpdateUser(ctx context.Context, user User) error
+
+	// UserSettings returns the free-form settings stored for a user.
+	UserSettings(ctx context.Context, username, domain string) (UserSettings, error)
+	// SetUserSetting stores or replaces a single setting for a user.
+	SetUserSetting(ctx context.Context, username, domain, name, value string) error
+	// DeleteUserSetting removes a single setting for a user.
+	DeleteUserSetting(ctx context.Context, username, domain, name string) error
+
+	// ListBroadcastRules returns all broadcast ringing rules with their targets.
+	ListBroadcastRules(ctx context.Context) ([]BroadcastRule, error)
+	// CreateBroadcastRule inserts a new broadcast rule and optional targets.
+	CreateBroadcastRule(ctx context.Context, rule BroadcastRule) (*BroadcastRule, error)
+	// UpdateBroadcastRule modifies an existing rule's address or description.
+	UpdateBroadcastRule(ctx context.Context, rule BroadcastRule) error
+	// DeleteBroadcastRule removes a rule and its targets.
+	DeleteBroadcastRule(ctx context.Context, ruleID int64) error
+	// ReplaceBroadcastTargets overwrites the contact list for a rule.
+	ReplaceBroadcastTargets(ctx context.Context, ruleID int64, targets []BroadcastTarget) error
+	// LookupBroadcastTargets returns the contacts configured for an address.
+	LookupBroadcastTargets(ctx context.Context, address string) ([]BroadcastTarget, error)
+
+	// ListTrunkRoutes returns the prefix routes to trunks, ordered by prefix.
+	ListTrunkRoutes(ctx context.Context) ([]TrunkRoute, error)
+	// CreateTrunkRoute inserts a trunk route, returning ErrTrunkRouteExists
+	// when its prefix is taken.
+	CreateTrunkRoute(ctx context.Context, route TrunkRoute) (*TrunkRoute, error)
+	// UpdateTrunkRoute replaces a trunk route, returning
+	// ErrTrunkRouteNotFound when absent.
+	UpdateTrunkRoute(ctx context.Context, route TrunkRoute) error
+	// DeleteTrunkRoute removes a trunk route, returning ErrTrunkRouteNotFound
+	// when absent.
+	DeleteTrunkRoute(ctx context.Context, id int64) error
+
+	// ListDomains returns the settings of every domain, ordered by name.
+	ListDomains(ctx context.Context) ([]Domain, error)
+	// CreateDomain stores settings for a domain, returning ErrDomainExists
+	// when it has them already.
+	CreateDomain(ctx context.Context, domain Domain) error
+	// UpdateDomain replaces a domain's settings, returning
+	// ErrDomainNotFound when it has none.
+	UpdateDomain(ctx context.Context, domain Domain) error
+	// DeleteDomain removes a domain's settings, returning ErrDomainNotFound
+	// when it has none.
+	DeleteDomain(ctx context.Context, name string) error
+
+	// ListShortNumbers returns the short numbers of every domain, ordered by
+	// domain and number.
+	ListShortNumbers(ctx context.Context) ([]ShortNumber, error)
+	// CreateShortNumber inserts a short number, returning
+	// ErrShortNumberExists when its domain already has the number.
+	CreateShortNumber(ctx context.Context, number ShortNumber) (*ShortNumber, error)
+	// UpdateShortNumber replaces a short number, returning
+	// ErrShortNumberNotFound when absent.
+	UpdateShortNumber(ctx context.Context, number ShortNumber) error
+	// DeleteShortNumber removes a short number, returning
+	// ErrShortNumberNotFound when absent.
+	DeleteShortNumber(ctx context.Context, id int64) error
+
+	// ListCallerIDRules returns every caller-ID rule ordered by ID.
+	ListCallerIDRules(ctx context.Context) ([]CallerIDRule, error)
+	// CreateCallerIDRule inserts a caller-ID rule and returns it with its ID.
+	CreateCallerIDRule(ctx context.Context, rule CallerIDRule) (*CallerIDRule, error)
+	// UpdateCallerIDRule replaces a caller-ID rule, returning
+	// ErrCallerIDRuleNotFound when absent.
+	UpdateCallerIDRule(ctx context.Context, rule CallerIDRule) error
+	// DeleteCallerIDRule removes a caller-ID rule, returning
+	// ErrCallerIDRuleNotFound when absent.
+	DeleteCallerIDRule(ctx context.Context, id int64) error
+
+	// AdminAccount returns a web interface administrator, or ErrAdminNotFound.
+	AdminAccount(ctx context.Context, username string) (*AdminAccount, error)
+	// ListAdminAccounts returns every web interface administrator.
+	ListAdminAccounts(ctx context.Context) ([]AdminAccount, error)
+	// CreateAdminAccount inserts an administrator, returning ErrAdminExists
+	// when the username is taken.
+	CreateAdminAccount(ctx context.Context, account AdminAccount) error
+	// UpdateAdminAccount changes an administrator's role and, when a hash is
+	// given, password.
+	UpdateAdminAccount(ctx context.Context, account AdminAccount) error
+	// DeleteAdminAccount removes an administrator, returning ErrAdminNotFound
+	// when absent.
+	DeleteAdminAccount(ctx context.Context, username string) error
+	// SetAdminTOTP enrolls an administrator in two-factor authentication and
+	// replaces its recovery codes, or turns it off for an empty secret.
+	SetAdminTOTP(ctx context.Context, username, secret string, codeHashes []string) error
+	// UseAdminRecoveryCode consumes a recovery code, returning
+	// ErrRecoveryCodeInvalid when it is unknown or already used.
+	UseAdminRecoveryCode(ctx context.Context, username, codeHash string) error
+
+	// RecordAudit appends an entry to the audit log of administrative changes.
+	RecordAudit(ctx context.Context, entry AuditEntry) error
+	// ListAuditEntries returns audit log entries matching filter, newest first.
+	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+
+	// ListAPITokens returns every JSON API token.
+	ListAPITokens(ctx context.Context) ([]APIToken, error)
+	// APITokenByHash returns the token with the given HashAPIToken digest, or
+	// ErrAPITokenNotFound.
+	APITokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	// CreateAPIToken stores a new token and returns it with its ID.
+	CreateAPIToken(ctx context.Context, token APIToken) (*APIToken, error)
+	// DeleteAPIToken revokes a token, returning ErrAPITokenNotFound when
+	// absent.
+	DeleteAPIToken(ctx context.Context, id int64) error
+
+	// Close releases any resources held by the backend.
+	Close() error
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// OpenStore opens a directory backend by name. "sqlite", "postgres", and
+// "mysql" are served by SQLStore and take a datasource name; "ldap" takes an
+// LDAP URL as described by OpenLDAP. The PostgreSQL and MySQL backends require
+// the binary to import a database/sql driver (for example
+// github.com/jackc/pgx/v5/stdlib or github.com/go-sql-driver/mysql) so that it
+// registers itself.
+func OpenStore(backend, dsn string) (Store, error) {
+	if isLDAPBackend(backend) {
+		return OpenLDAP(dsn)
+	}
+	dialect, err := ParseDialect(backend)
+	if err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case DialectPostgres:
+		return OpenPostgres(dsn)
+	case DialectMySQL:
+		return OpenMySQL(dsn)
+	default:
+		return OpenSQLite(dsn)
+	}
+}
+
+// CheckBackend reports whether OpenStore understands the backend name and,
+// for PostgreSQL and MySQL, whether the binary registered a driver for it.
+func CheckBackend(backend string) error {
+	if isLDAPBackend(backend) {
+		return nil
+	}
+	dialect, err := ParseDialect(backend)
+	if err != nil {
+		return err
+	}
+	if dialect != DialectSQLite && registeredDriver(dialect) == "" {
+		return errNoDriver(dialect)
+	}
+	return nil
+}
+
+func isLDAPBackend(backend string) bool {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "ldap", "ldaps", "ad", "activedirectory":
+		return true
+	}
+	return false
+}
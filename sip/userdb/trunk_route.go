@@ -0,0 +1,220 @@
+package userdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTrunkRouteNotFound is returned when a trunk route does not exist.
+var ErrTrunkRouteNotFound = errors.New("userdb: trunk route not found")
+
+// ErrTrunkRouteExists is returned when creating or changing a trunk route
+// would give two routes the same prefix.
+var ErrTrunkRouteExists = errors.New("userdb: trunk route for prefix already exists")
+
+// TrunkRoute sends calls whose dialed number starts with Prefix through a
+// trunk, PSTN style. Of the routes matching a number the one with the longest
+// prefix applies. Strip leading characters are removed from the number and
+// Prepend is then put in front, so that 0120 numbers can be sent as +81120.
+type TrunkRoute struct {
+	ID     int64
+	Prefix string
+	// Trunk names configured trunk accounts as user@domain, separated by
+	// commas when several can complete the call; the cheapest is tried
+	// first.
+	Trunk       string
+	Strip       int
+	Prepend     string
+	Description string
+}
+
+// ValidateTrunkRoute checks a route before it is stored. The prefix and the
+// prepended digits may only hold digits, '+', '*', and '#'.
+func ValidateTrunkRoute(route TrunkRoute) error {
+	if route.Prefix == "" {
+		return fmt.Errorf("userdb: trunk route prefix is required")
+	}
+	if !isDialString(route.Prefix) {
+		return fmt.Errorf("userdb: trunk route prefix %q may only contain digits, +, *, and #", route.Prefix)
+	}
+	if !isDialString(route.Prepend) {
+		return fmt.Errorf("userdb: trunk route prepend %q may only contain digits, +, *, and #", route.Prepend)
+	}
+	if route.Strip < 0 {
+		return fmt.Errorf("userdb: trunk route strip must not be negative")
+	}
+	for _, trunk := range strings.Split(route.Trunk, ",") {
+		user, domain, ok := strings.Cut(strings.TrimSpace(trunk), "@")
+		if !ok || user == "" || domain == "" {
+			return fmt.Errorf("userdb: trunk route trunk %q must be user@domain, or several separated by commas", route.Trunk)
+		}
+	}
+	return nil
+}
+
+func isDialString(text string) bool {
+	for _, r := range text {
+		if (r < '0' || r > '9') && r != '+' && r != '*' && r != '#' {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeTrunkRoute(route TrunkRoute) TrunkRoute {
+	route.Prefix = strings.TrimSpace(route.Prefix)
+	route.Trunk = strings.TrimSpace(route.Trunk)
+	route.Prepend = strings.TrimSpace(route.Prepend)
+	route.Description = strings.TrimSpace(route.Description)
+	return route
+}
+
+// ListTrunkRoutes returns every trunk route ordered by prefix.
+func (s *SQLStore) ListTrunkRoutes(ctx context.Context) ([]TrunkRoute, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `SELECT id, prefix, trunk, strip, prepend, description FROM trunk_routes ORDER BY prefix, id`
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return nil, fmt.Errorf("userdb: query trunk routes: %w", err)
+	}
+	defer rows.Close()
+	var routes []TrunkRoute
+	for rows.Next() {
+		route, err := scanTrunkRoute(rows)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, *route)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("userdb: iterate trunk routes: %w", err)
+	}
+	return routes, nil
+}
+
+// CreateTrunkRoute stores a new route and returns it with its assigned ID,
+// or ErrTrunkRouteExists when another route has its prefix.
+func (s *SQLStore) CreateTrunkRoute(ctx context.Context, route TrunkRoute) (*TrunkRoute, error) {
+	if s == nil || s.db == nil {
+		return nil, fmt.Errorf("userdb: store is not initialised")
+	}
+	route = normalizeTrunkRoute(route)
+	if err := ValidateTrunkRoute(route); err != nil {
+		return nil, err
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkTrunkPrefixFree(ctx, tx, route.Prefix, 0); err != nil {
+			return err
+		}
+		const insert = `INSERT INTO trunk_routes (prefix, trunk, strip, prepend, description) VALUES (?, ?, ?, ?, ?)`
+		id, err := s.insertReturningID(ctx, tx, insert, route.Prefix, route.Trunk, route.Strip, route.Prepend, route.Description)
+		if err != nil {
+			return fmt.Errorf("userdb: create trunk route: %w", err)
+		}
+		route.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.changes.notify()
+	return &route, nil
+}
+
+// UpdateTrunkRoute replaces every field of the route with route.ID.
+func (s *SQLStore) UpdateTrunkRoute(ctx context.Context, route TrunkRoute) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	if route.ID <= 0 {
+		return fmt.Errorf("userdb: trunk route id is required")
+	}
+	route = normalizeTrunkRoute(route)
+	if err := ValidateTrunkRoute(route); err != nil {
+		return err
+	}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if err := s.checkTrunkPrefixFree(ctx, tx, route.Prefix, route.ID); err != nil {
+			return err
+		}
+		const update = `UPDATE trunk_routes SET prefix = ?, trunk = ?, strip = ?, prepend = ?, description = ? WHERE id = ?`
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(update), route.Prefix, route.Trunk, route.Strip, route.Prepend, route.Description, route.ID)
+		if err != nil {
+			return fmt.Errorf("userdb: update trunk route: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("userdb: update trunk route rows affected: %w", err)
+		}
+		if affected == 0 {
+			return ErrTrunkRouteNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.notify()
+	return nil
+}
+
+// DeleteTrunkRoute removes a route, returning ErrTrunkRouteNotFound when
+// absent.
+func (s *SQLStore) DeleteTrunkRoute(ctx context.Context, id int64) error {
+	if s == nil || s.db == nil {
+		return fmt.Errorf("userdb: store is not initialised")
+	}
+	const query = `DELETE FROM trunk_routes WHERE id = ?`
+	res, err := s.db.ExecContext(ctx, s.dialect.rebind(query), id)
+	if err != nil {
+		return fmt.Errorf("userdb: delete trunk route: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("userdb: delete trunk route rows affected: %w", err)
+	}
+	if affected == 0 {
+		return ErrTrunkRouteNotFound
+	}
+	s.changes.notify()
+	return nil
+}
+
+// checkTrunkPrefixFree returns ErrTrunkRouteExists when a route other than
+// self already has prefix.
+func (s *SQLStore) checkTrunkPrefixFree(ctx context.Context, q sqlQuerier, prefix string, self int64) error {
+	const query = `SELECT id FROM trunk_routes WHERE prefix = ?`
+	rows, err := q.QueryContext(ctx, s.dialect.rebind(query), prefix)
+	if err != nil {
+		return fmt.Errorf("userdb: look up trunk route prefix: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("userdb: scan trunk route: %w", err)
+		}
+		if id != self {
+			return ErrTrunkRouteExists
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("userdb: iterate trunk routes: %w", err)
+	}
+	return nil
+}
+
+func scanTrunkRoute(row rowScanner) (*TrunkRoute, error) {
+	var route TrunkRoute
+	var description sql.NullString
+	if err := row.Scan(&route.ID, &route.Prefix, &route.Trunk, &route.Strip, &route.Prepend, &description); err != nil {
+		return nil, fmt.Errorf("userdb: scan trunk route: %w", err)
+	}
+	route.Description = description.String
+	return &route, nil
+}
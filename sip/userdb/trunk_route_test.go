@@ -0,0 +1,77 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSQLStoreTrunkRoutes(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	changes, cancel := store.Subscribe()
+	defer cancel()
+
+	freeDial, err := store.CreateTrunkRoute(ctx, TrunkRoute{Prefix: " 0120 ", Trunk: "0312345678@provider.example", Strip: 1, Prepend: "+81", Description: "toll free"})
+	if err != nil {
+		t.Fatalf("CreateTrunkRoute: %v", err)
+	}
+	if freeDial.ID == 0 || freeDial.Prefix != "0120" {
+		t.Fatalf("unexpected created route: %+v", freeDial)
+	}
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected creating a route to notify subscribers")
+	}
+	international, err := store.CreateTrunkRoute(ctx, TrunkRoute{Prefix: "+", Trunk: "intl@carrier.example"})
+	if err != nil {
+		t.Fatalf("CreateTrunkRoute: %v", err)
+	}
+	if _, err := store.CreateTrunkRoute(ctx, TrunkRoute{Prefix: "0120", Trunk: "other@provider.example"}); !errors.Is(err, ErrTrunkRouteExists) {
+		t.Fatalf("expected ErrTrunkRouteExists for a duplicate prefix, got %v", err)
+	}
+	for _, bad := range []TrunkRoute{
+		{Prefix: "", Trunk: "a@b"},
+		{Prefix: "0x", Trunk: "a@b"},
+		{Prefix: "0", Trunk: "a@b", Prepend: "p"},
+		{Prefix: "0", Trunk: "a@b", Strip: -1},
+		{Prefix: "0", Trunk: "provider.example"},
+	} {
+		if _, err := store.CreateTrunkRoute(ctx, bad); err == nil {
+			t.Fatalf("expected route %+v to be rejected", bad)
+		}
+	}
+
+	international.Prefix = "0120"
+	if err := store.UpdateTrunkRoute(ctx, *international); !errors.Is(err, ErrTrunkRouteExists) {
+		t.Fatalf("expected ErrTrunkRouteExists when moving onto a taken prefix, got %v", err)
+	}
+	freeDial.Strip = 0
+	freeDial.Prepend = ""
+	if err := store.UpdateTrunkRoute(ctx, *freeDial); err != nil {
+		t.Fatalf("UpdateTrunkRoute: %v", err)
+	}
+	if err := store.UpdateTrunkRoute(ctx, TrunkRoute{ID: 999, Prefix: "1", Trunk: "a@b"}); !errors.Is(err, ErrTrunkRouteNotFound) {
+		t.Fatalf("expected ErrTrunkRouteNotFound, got %v", err)
+	}
+
+	routes, err := store.ListTrunkRoutes(ctx)
+	if err != nil {
+		t.Fatalf("ListTrunkRoutes: %v", err)
+	}
+	if len(routes) != 2 || routes[0].Prefix != "+" || routes[1] != *freeDial {
+		t.Fatalf("unexpected routes: %+v", routes)
+	}
+
+	if err := store.DeleteTrunkRoute(ctx, international.ID); err != nil {
+		t.Fatalf("DeleteTrunkRoute: %v", err)
+	}
+	if err := store.DeleteTrunkRoute(ctx, international.ID); !errors.Is(err, ErrTrunkRouteNotFound) {
+		t.Fatalf("expected ErrTrunkRouteNotFound, got %v", err)
+	}
+}
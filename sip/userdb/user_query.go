@@ -0,0 +1,159 @@
+package userdb
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UserSort names a column the user list can be ordered by.
+type UserSort string
+
+const (
+	SortByUsername UserSort = "username"
+	SortByDomain   UserSort = "domain"
+	SortByContact  UserSort = "contact"
+	SortByEnabled  UserSort = "enabled"
+)
+
+// ParseUserSort maps a sort name to its UserSort. An empty name yields
+// SortByDomain, the order AllUsers uses.
+func ParseUserSort(name string) (UserSort, error) {
+	switch sort := UserSort(strings.ToLower(strings.TrimSpace(name))); sort {
+	case "":
+		return SortByDomain, nil
+	case SortByUsername, SortByDomain, SortByContact, SortByEnabled:
+		return sort, nil
+	default:
+		return "", fmt.Errorf("userdb: unknown user sort %q", name)
+	}
+}
+
+// column returns the users table column backing the sort.
+func (s UserSort) column() string {
+	switch s {
+	case SortByUsername:
+		return "username"
+	case SortByContact:
+		return "contact_uri"
+	case SortByEnabled:
+		return "enabled"
+	default:
+		return "domain"
+	}
+}
+
+// UserQuery selects one page of the user directory. Search matches a
+// case-insensitive substring of the username, domain, or contact URI; an
+// empty Search matches every user. Ties in the sort column are broken by
+// domain and username. A Limit of zero returns every matching user.
+type UserQuery struct {
+	Search     string
+	Sort       UserSort
+	Descending bool
+	Limit      int
+	Offset     int
+}
+
+// UserPage is one page of QueryUsers results along with the number of users
+// matching the search across all pages.
+type UserPage struct {
+	Users []User
+	Total int
+}
+
+// QueryUsers returns the page of users selected by query.
+func (s *SQLStore) QueryUsers(ctx context.Context, query UserQuery) (UserPage, error) {
+	if s == nil || s.db == nil {
+		return UserPage{}, fmt.Errorf("userdb: store is not initialised")
+	}
+	var where string
+	var args []any
+	if search := strings.TrimSpace(query.Search); search != "" {
+		like := s.dialect.likeOperator()
+		where = fmt.Sprintf(` WHERE (username %[1]s ? OR domain %[1]s ? OR contact_uri %[1]s ?)`, like)
+		pattern := "%" + search + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	var page UserPage
+	countQuery := `SELECT COUNT(*) FROM users` + where
+	if err := s.db.QueryRowContext(ctx, s.dialect.rebind(countQuery), args...).Scan(&page.Total); err != nil {
+		return UserPage{}, fmt.Errorf("userdb: count users: %w", err)
+	}
+
+	direction := ""
+	if query.Descending {
+		direction = " DESC"
+	}
+	selectQuery := `SELECT username, domain, password_hash, contact_uri, enabled FROM users` + where +
+		` ORDER BY ` + query.Sort.column() + direction + `, domain, username`
+	if query.Limit > 0 {
+		selectQuery += ` LIMIT ? OFFSET ?`
+		args = append(args, query.Limit, max(query.Offset, 0))
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.rebind(selectQuery), args...)
+	if err != nil {
+		return UserPage{}, fmt.Errorf("userdb: query users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		var password, contact, enabled sql.NullString
+		if err := rows.Scan(&user.Username, &user.Domain, &password, &contact, &enabled); err != nil {
+			return UserPage{}, fmt.Errorf("userdb: scan user: %w", err)
+		}
+		user.PasswordHash = password.String
+		user.ContactURI = contact.String
+		user.Disabled = !enabledFlag(enabled)
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPage{}, fmt.Errorf("userdb: iterate users: %w", err)
+	}
+	return page, nil
+}
+
+// queryUsers applies query to an in-memory user list, for backends that
+// cannot search and sort server-side.
+func queryUsers(users []User, query UserQuery) UserPage {
+	search := strings.ToLower(strings.TrimSpace(query.Search))
+	var matched []User
+	for _, user := range users {
+		if search == "" ||
+			strings.Contains(strings.ToLower(user.Username), search) ||
+			strings.Contains(strings.ToLower(user.Domain), search) ||
+			strings.Contains(strings.ToLower(user.ContactURI), search) {
+			matched = append(matched, user)
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b User) int {
+		var c int
+		switch query.Sort {
+		case SortByUsername:
+			c = cmp.Compare(a.Username, b.Username)
+		case SortByContact:
+			c = cmp.Compare(a.ContactURI, b.ContactURI)
+		case SortByEnabled:
+			// Disabled users sort first, as enabled = 0 does in SQL.
+			c = cmp.Compare(boolToInt(!a.Disabled), boolToInt(!b.Disabled))
+		default:
+			c = cmp.Compare(a.Domain, b.Domain)
+		}
+		if query.Descending {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.Domain, b.Domain), cmp.Compare(a.Username, b.Username))
+	})
+	page := UserPage{Total: len(matched)}
+	start := min(max(query.Offset, 0), len(matched))
+	end := len(matched)
+	if query.Limit > 0 {
+		end = min(start+query.Limit, end)
+	}
+	page.Users = matched[start:end]
+	return page
+}
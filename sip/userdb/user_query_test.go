@@ -0,0 +1,87 @@
+package userdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestSQLStoreQueryUsers(t *testing.T) {
+	store, err := OpenSQLite("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("OpenSQLite: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	users := []User{
+		{Username: "alice", Domain: "example.com", ContactURI: "sip:alice@192.0.2.10"},
+		{Username: "bob", Domain: "example.com", ContactURI: "sip:bob@192.0.2.20", Disabled: true},
+		{Username: "carol", Domain: "branch.example.org"},
+		{Username: "dave", Domain: "example.com", ContactURI: "sip:office-ALICE@192.0.2.30"},
+		{Username: "erin", Domain: "branch.example.org", ContactURI: "sip:erin@192.0.2.40"},
+	}
+	for _, user := range users {
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatalf("CreateUser(%s): %v", user.Username, err)
+		}
+		if user.Disabled {
+			if err := store.SetUserEnabled(ctx, user.Username, user.Domain, false); err != nil {
+				t.Fatalf("SetUserEnabled: %v", err)
+			}
+		}
+	}
+	all, err := store.AllUsers(ctx)
+	if err != nil {
+		t.Fatalf("AllUsers: %v", err)
+	}
+
+	cases := []struct {
+		query UserQuery
+		want  []string
+		total int
+	}{
+		{UserQuery{}, []string{"carol", "erin", "alice", "bob", "dave"}, 5},
+		{UserQuery{Sort: SortByUsername, Descending: true, Limit: 2}, []string{"erin", "dave"}, 5},
+		{UserQuery{Sort: SortByUsername, Limit: 2, Offset: 4}, []string{"erin"}, 5},
+		{UserQuery{Search: "alice"}, []string{"alice", "dave"}, 2},
+		{UserQuery{Search: "EXAMPLE.ORG", Sort: SortByUsername, Descending: true}, []string{"erin", "carol"}, 2},
+		{UserQuery{Sort: SortByEnabled}, []string{"bob", "carol", "erin", "alice", "dave"}, 5},
+		{UserQuery{Sort: SortByContact, Limit: 3}, []string{"carol", "alice", "bob"}, 5},
+		{UserQuery{Search: "nobody"}, nil, 0},
+	}
+	for _, tc := range cases {
+		page, err := store.QueryUsers(ctx, tc.query)
+		if err != nil {
+			t.Fatalf("QueryUsers(%+v): %v", tc.query, err)
+		}
+		if got := usernames(page.Users); fmt.Sprint(got) != fmt.Sprint(tc.want) || page.Total != tc.total {
+			t.Errorf("QueryUsers(%+v) = %v (total %d), want %v (total %d)", tc.query, got, page.Total, tc.want, tc.total)
+		}
+		// The in-memory fallback used by LDAP must agree with SQL.
+		mem := queryUsers(all, tc.query)
+		if got := usernames(mem.Users); fmt.Sprint(got) != fmt.Sprint(tc.want) || mem.Total != tc.total {
+			t.Errorf("queryUsers(%+v) = %v (total %d), want %v (total %d)", tc.query, got, mem.Total, tc.want, tc.total)
+		}
+	}
+}
+
+func TestParseUserSort(t *testing.T) {
+	if sort, err := ParseUserSort(""); err != nil || sort != SortByDomain {
+		t.Fatalf("ParseUserSort(\"\") = %q, %v", sort, err)
+	}
+	if sort, err := ParseUserSort(" Contact "); err != nil || sort != SortByContact {
+		t.Fatalf("ParseUserSort(Contact) = %q, %v", sort, err)
+	}
+	if _, err := ParseUserSort("password_hash"); err == nil {
+		t.Fatalf("expected an unknown sort to be rejected")
+	}
+}
+
+func usernames(users []User) []string {
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	return names
+}
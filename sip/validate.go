@@ -0,0 +1,101 @@
+package sip
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ValidationError reports why Validate refused a message. Reason is worded
+// to serve as the reason phrase of the 400 response, such as "Missing
+// Call-ID Header", and Err is ErrMissingHeader for a missing header and
+// ErrInvalidMessage otherwise.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// requiredRequestHeaders and requiredResponseHeaders list the headers
+	// every request (RFC 3261 section 8.1.1) and every response must carry.
+	requiredRequestHeaders  = []string{"Via", "From", "To", "Call-ID", "CSeq", "Max-Forwards"}
+	requiredResponseHeaders = []string{"Via", "From", "To", "Call-ID", "CSeq"}
+	// methodHeaders adds the headers particular methods need: a Contact
+	// for requests that establish a dialog, and the event package and
+	// refer target of RFC 6665 and RFC 3515.
+	methodHeaders = map[string][]string{
+		"INVITE":    {"Contact"},
+		"SUBSCRIBE": {"Contact", "Event"},
+		"NOTIFY":    {"Contact", "Event", "Subscription-State"},
+		"REFER":     {"Contact", "Refer-To"},
+	}
+	// singleHeaders may appear at most once.
+	singleHeaders = []string{"From", "To", "Call-ID", "CSeq", "Max-Forwards", "Content-Length"}
+)
+
+// Validate checks that the message carries the headers RFC 3261 makes
+// mandatory, and those its method needs, that the CSeq is well formed and
+// names the request's method, that Max-Forwards is a number from 0 to 255,
+// and that a Content-Length header matches the body. It returns a
+// *ValidationError describing the first problem found, or nil.
+func (m *Message) Validate() error {
+	if m == nil {
+		return &ValidationError{Reason: "Empty Message", Err: ErrInvalidMessage}
+	}
+	required := requiredResponseHeaders
+	if m.IsRequest() {
+		required = requiredRequestHeaders
+	}
+	for _, name := range slices.Concat(required, methodHeaders[m.Method]) {
+		if strings.TrimSpace(m.GetHeader(name)) == "" {
+			return &ValidationError{Reason: "Missing " + name + " Header", Err: ErrMissingHeader}
+		}
+	}
+	for _, name := range singleHeaders {
+		if len(m.Headers[canonicalHeader(name)]) > 1 {
+			return invalid("Duplicate " + name + " Header")
+		}
+	}
+
+	cseq := strings.Fields(m.GetHeader("CSeq"))
+	if len(cseq) != 2 || !isToken(cseq[1]) {
+		return invalid("Malformed CSeq Header")
+	}
+	if seq, err := strconv.ParseUint(cseq[0], 10, 32); err != nil || seq >= 1<<31 {
+		return invalid("Malformed CSeq Header")
+	}
+	if m.IsRequest() && !strings.EqualFold(cseq[1], m.Method) {
+		return invalid("CSeq Method Mismatch")
+	}
+
+	if m.IsRequest() {
+		hops, err := strconv.Atoi(strings.TrimSpace(m.GetHeader("Max-Forwards")))
+		if err != nil || hops < 0 || hops > 255 {
+			return invalid("Malformed Max-Forwards Header")
+		}
+	}
+
+	if values := m.Headers["Content-Length"]; len(values) == 1 {
+		length, err := strconv.Atoi(strings.TrimSpace(values[0]))
+		if err != nil || length < 0 {
+			return invalid("Malformed Content-Length Header")
+		}
+		if length != len(m.Body) {
+			return invalid("Content-Length Mismatch")
+		}
+	}
+	return nil
+}
+
+func invalid(reason string) *ValidationError {
+	return &ValidationError{Reason: reason, Err: ErrInvalidMessage}
+}
@@ -0,0 +1,196 @@
+package sip
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// viaHop is one element of a Via header (RFC 3261 section 20.42): the
+// sent-protocol, the sent-by host and port, and the parameters in order.
+type viaHop struct {
+	// protocol is the sent-protocol without whitespace, such as
+	// "SIP/2.0/UDP".
+	protocol string
+	// host holds an IPv6 address without its brackets.
+	host string
+	// port is 0 when the sent-by does not give one.
+	port int
+	// params holds a flag parameter, such as a bare rport, with an empty
+	// Value.
+	params []URIParam
+}
+
+// parseVia parses one Via element, as returned by HeaderList.
+func parseVia(value string) (*viaHop, bool) {
+	head, rawParams, _ := strings.Cut(value, ";")
+	fields := strings.Fields(head)
+	if len(fields) < 2 {
+		return nil, false
+	}
+	hop := &viaHop{protocol: strings.Join(fields[:len(fields)-1], "")}
+	sentBy := fields[len(fields)-1]
+	host, port := sentBy, ""
+	if strings.HasPrefix(sentBy, "[") || strings.Count(sentBy, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(sentBy); err != nil {
+			if !strings.HasSuffix(sentBy, "]") {
+				return nil, false
+			}
+			host, port = strings.Trim(sentBy, "[]"), ""
+		}
+	}
+	if host == "" {
+		return nil, false
+	}
+	hop.host = host
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, false
+		}
+		hop.port = n
+	}
+	if rawParams != "" {
+		for _, field := range strings.Split(rawParams, ";") {
+			name, value, _ := strings.Cut(field, "=")
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, false
+			}
+			hop.params = append(hop.params, URIParam{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+	return hop, true
+}
+
+// param returns the value of the named parameter, compared without regard to
+// case, and whether the Via has it.
+func (v *viaHop) param(name string) (string, bool) {
+	for _, p := range v.params {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// setParam replaces the named parameter's value, or appends the parameter
+// when the Via does not have it.
+func (v *viaHop) setParam(name, value string) {
+	for i, p := range v.params {
+		if strings.EqualFold(p.Name, name) {
+			v.params[i].Value = value
+			return
+		}
+	}
+	v.params = append(v.params, URIParam{Name: name, Value: value})
+}
+
+func (v *viaHop) String() string {
+	var b strings.Builder
+	b.WriteString(v.protocol)
+	b.WriteByte(' ')
+	if strings.Contains(v.host, ":") {
+		b.WriteString("[" + v.host + "]")
+	} else {
+		b.WriteString(v.host)
+	}
+	if v.port != 0 {
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(v.port))
+	}
+	for _, p := range v.params {
+		b.WriteByte(';')
+		b.WriteString(p.Name)
+		if p.Value != "" {
+			b.WriteByte('=')
+			b.WriteString(p.Value)
+		}
+	}
+	return b.String()
+}
+
+// stampVia records in the top Via of a received request where it actually
+// came from. A received parameter is added when the sent-by host is not the
+// source address (RFC 3261 section 18.2.1), and an rport parameter without a
+// value is filled in with the source port, together with received (RFC 3581
+// section 4). It reports whether the Via changed.
+func stampVia(msg *Message, source net.Addr) bool {
+	udp, ok := source.(*net.UDPAddr)
+	if !ok || udp.IP == nil {
+		return false
+	}
+	vias := msg.HeaderList("Via")
+	if len(vias) == 0 {
+		return false
+	}
+	hop, ok := parseVia(vias[0])
+	if !ok {
+		return false
+	}
+	_, rport := hop.param("rport")
+	if !rport && udp.IP.Equal(net.ParseIP(hop.host)) {
+		return false
+	}
+	hop.setParam("received", udp.IP.String())
+	if rport {
+		hop.setParam("rport", strconv.Itoa(udp.Port))
+	}
+	vias[0] = hop.String()
+	msg.SetHeader("Via", vias...)
+	return true
+}
+
+// viaSource returns the address a request came from according to its top
+// Via as stampVia left it: the received parameter, else the sent-by host when
+// it is an address. It returns nil when neither is.
+func viaSource(msg *Message) net.IP {
+	vias := msg.HeaderList("Via")
+	if len(vias) == 0 {
+		return nil
+	}
+	hop, ok := parseVia(vias[0])
+	if !ok {
+		return nil
+	}
+	if received, ok := hop.param("received"); ok {
+		return net.ParseIP(received)
+	}
+	return net.ParseIP(hop.host)
+}
+
+// viaResponseTarget returns the host and port a response goes to according
+// to its top Via. symmetric is true when the Via carries both received and
+// a filled-in rport, so the response goes back to the exact address and port
+// the request came from (RFC 3581 section 4). Otherwise RFC 3261 section
+// 18.2.2 applies: the maddr address, else the received address, else the
+// sent-by host, at the sent-by port or 5060. The host may be a name still to
+// be resolved.
+func viaResponseTarget(msg *Message) (target string, symmetric bool) {
+	vias := msg.HeaderList("Via")
+	if len(vias) == 0 {
+		return "", false
+	}
+	hop, ok := parseVia(vias[0])
+	if !ok {
+		return "", false
+	}
+	received, _ := hop.param("received")
+	if rport, _ := hop.param("rport"); received != "" && rport != "" {
+		if port, err := strconv.Atoi(rport); err == nil && port > 0 && port <= 65535 {
+			return net.JoinHostPort(received, rport), true
+		}
+	}
+	host := hop.host
+	if maddr, _ := hop.param("maddr"); maddr != "" {
+		host = strings.Trim(maddr, "[]")
+	} else if received != "" {
+		host = received
+	}
+	port := hop.port
+	if port == 0 {
+		port = 5060
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), false
+}